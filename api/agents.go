@@ -17,6 +17,30 @@ type AgentRegisterRequest struct {
 	PID                int      `json:"pid,omitempty"`
 	MachineID          string   `json:"machine_id,omitempty"`
 	Features           []string `json:"features"`
+
+	// Signed evidence of the host the agent is running on, if it's been
+	// asked to attest to it
+	Attestation *AgentAttestation `json:"attestation,omitempty"`
+}
+
+// AgentAttestation is signed evidence of the host an agent is running on,
+// that the API can verify before it lets the agent run jobs
+type AgentAttestation struct {
+	// aws for an EC2 instance identity document, gcp for a GCP instance
+	// identity token, or tpm for a TPM quote
+	Type string `json:"type"`
+
+	// The document, token or TPM quote, with binary data base64 encoded
+	Document string `json:"document"`
+
+	// The document's PKCS7 signature, or the quote's signature
+	Signature string `json:"signature,omitempty"`
+
+	// The PCR values the TPM quote covers
+	PCRs string `json:"pcrs,omitempty"`
+
+	// A random value the TPM quote was made over, so it can't be replayed
+	Nonce string `json:"nonce,omitempty"`
 }
 
 // AgentRegisterResponse is the response from the Buildkite Agent API
@@ -29,6 +53,10 @@ type AgentRegisterResponse struct {
 	JobStatusInterval int      `json:"job_status_interval"`
 	HeartbeatInterval int      `json:"heartbeat_interval"`
 	Tags              []string `json:"meta_data"`
+
+	// Whether the API verified the agent's attestation: verified, or
+	// unverified if it couldn't
+	AttestationStatus string `json:"attestation_status,omitempty"`
 }
 
 // Registers the agent against the Buildkite Agent API. The client for this
@@ -50,12 +50,16 @@ type Artifact struct {
 	ContentType string `json:"-"`
 }
 
+// ArtifactBatch is a batch of artifacts to create on Buildkite together, and
+// where they're going to be uploaded
 type ArtifactBatch struct {
 	ID                string      `json:"id"`
 	Artifacts         []*Artifact `json:"artifacts"`
 	UploadDestination string      `json:"upload_destination"`
 }
 
+// ArtifactUploadInstructions are how to upload artifacts to Buildkite's
+// artifact storage, as a form of Data posted to Action
 type ArtifactUploadInstructions struct {
 	Data   map[string]string `json:"data"`
 	Action struct {
@@ -66,6 +70,8 @@ type ArtifactUploadInstructions struct {
 	}
 }
 
+// ArtifactBatchCreateResponse is the IDs of a batch of artifacts that were
+// created, in the order they were in the batch, and how to upload them
 type ArtifactBatchCreateResponse struct {
 	ID                 string                      `json:"id"`
 	ArtifactIDs        []string                    `json:"artifact_ids"`
@@ -82,11 +88,14 @@ type ArtifactSearchOptions struct {
 	IncludeDuplicates  bool   `url:"include_duplicates,omitempty"`
 }
 
+// ArtifactBatchUpdateArtifact is the new state of an artifact, like finished
+// or error
 type ArtifactBatchUpdateArtifact struct {
 	ID    string `json:"id"`
 	State string `json:"state"`
 }
 
+// ArtifactBatchUpdateRequest updates the states of a batch of artifacts
 type ArtifactBatchUpdateRequest struct {
 	Artifacts []*ArtifactBatchUpdateArtifact `json:"artifacts"`
 }
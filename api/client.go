@@ -1,6 +1,6 @@
 package api
 
-//go:generate interfacer -for github.com/buildkite/agent/v3/api.Client -as agent.APIClient -o ../agent/api.go
+//go:generate interfacer -for github.com/buildkite/agent/v3/api.Client -as agent.APIClient -o ../internal/agent/api.go
 
 import (
 	"bytes"
@@ -45,6 +45,13 @@ type Config struct {
 	// If true, requests and responses will be dumped and set to the logger
 	DebugHTTP bool
 
+	// If set, requests and responses are recorded to it
+	HTTPCapture *HTTPCapture
+
+	// Used to make connections, instead of the default dialer. Can be used
+	// to change how hostnames are resolved.
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+
 	// The http client used, leave nil for the default
 	HTTPClient *http.Client
 }
@@ -59,6 +66,9 @@ type Client struct {
 
 	// The logger used
 	logger logger.Logger
+
+	// The rate limit reported by the API
+	rateLimiter *rateLimiter
 }
 
 // NewClient returns a new Buildkite Agent API Client.
@@ -86,23 +96,33 @@ func NewClient(l logger.Logger, conf Config) *Client {
 			TLSHandshakeTimeout: 30 * time.Second,
 		}
 
+		if conf.DialContext != nil {
+			t.DialContext = conf.DialContext
+		}
+
 		if conf.DisableHTTP2 {
 			t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
 		}
 
+		var delegate http.RoundTripper = t
+		if conf.HTTPCapture != nil {
+			delegate = &captureTransport{capture: conf.HTTPCapture, Delegate: t}
+		}
+
 		httpClient = &http.Client{
 			Timeout: 60 * time.Second,
 			Transport: &authenticatedTransport{
 				Token:    conf.Token,
-				Delegate: t,
+				Delegate: delegate,
 			},
 		}
 	}
 
 	return &Client{
-		logger: l,
-		client: httpClient,
-		conf:   conf,
+		logger:      l,
+		client:      httpClient,
+		conf:        conf,
+		rateLimiter: &rateLimiter{},
 	}
 }
 
@@ -124,7 +144,7 @@ func (c *Client) FromAgentRegisterResponse(resp *AgentRegisterResponse) *Client
 		conf.Endpoint = resp.Endpoint
 	}
 
-	return NewClient(c.logger, conf)
+	return c.derive(conf)
 }
 
 // FromPing returns a new instance using a new endpoint from a ping response
@@ -136,9 +156,19 @@ func (c *Client) FromPing(resp *Ping) *Client {
 		conf.Endpoint = resp.Endpoint
 	}
 
-	return NewClient(c.logger, conf)
+	return c.derive(conf)
 }
 
+// derive returns a new client with different config, which shares the rate
+// limit with this one
+func (c *Client) derive(conf Config) *Client {
+	client := NewClient(c.logger, conf)
+	client.rateLimiter = c.rateLimiter
+	return client
+}
+
+// Header is an extra HTTP header to send with a request, like an
+// IdempotencyKeyHeader
 type Header struct {
 	Name  string
 	Value string
@@ -259,6 +289,8 @@ func (c *Client) doRequest(req *http.Request, v any) (*Response, error) {
 	defer resp.Body.Close()
 	defer io.Copy(io.Discard, resp.Body)
 
+	c.rateLimiter.update(resp, time.Now())
+
 	response := newResponse(resp)
 
 	if c.conf.DebugHTTP {
@@ -310,6 +342,8 @@ func (r *ErrorResponse) Error() string {
 	return s
 }
 
+// IsErrHavingStatus returns whether err is, or wraps, an *ErrorResponse for a
+// response with the HTTP status code
 func IsErrHavingStatus(err error, code int) bool {
 	var apierr *ErrorResponse
 	return errors.As(err, &apierr) && apierr.Response.StatusCode == code
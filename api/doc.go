@@ -1,4 +1,9 @@
-// Package api provides an API client for the Buildkite Pipelines API.
+// Package api provides a client for the Buildkite Agent API, which agents
+// register and run jobs with, and which tools running in jobs use to upload
+// artifacts, pipelines, annotations and meta-data.
 //
-// It is intended for internal use by buildkite-agent only.
+// A Client is made with NewClient, from a Config with an agent's
+// registration or access token. It's the same client buildkite-agent uses,
+// and its exported API is covered by the module's semantic versioning, so it
+// only changes incompatibly in a new major version.
 package api
@@ -13,6 +13,12 @@ type HeaderTimes struct {
 
 // SaveHeaderTimes saves the header times to the job
 func (c *Client) SaveHeaderTimes(ctx context.Context, jobId string, headerTimes *HeaderTimes) (*Response, error) {
+	// Header times are only used to show timings in the job log, so they can
+	// wait for the rate limit
+	if err := c.throttle(ctx); err != nil {
+		return nil, err
+	}
+
 	u := fmt.Sprintf("jobs/%s/header_times", jobId)
 
 	req, err := c.newRequest(ctx, "POST", u, headerTimes)
@@ -0,0 +1,388 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/version"
+)
+
+const (
+	// Bodies are cut short beyond this many bytes
+	maxCapturedBodySize = 64 * 1024
+
+	// When capturing to JSON lines, the file is rotated once it's this big,
+	// and this many of the previous files are kept
+	maxCaptureFileSize  = 10 * 1024 * 1024
+	maxCaptureFileCount = 5
+
+	redacted = "[REDACTED]"
+)
+
+// Headers that carry credentials
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// A JSON string value and its key, such as an env var in a job
+var jsonStringPair = regexp.MustCompile(`("((?:[^"\\]|\\.)*)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// Keys that look like they hold a credential, such as an "access_token" or a
+// job's BUILDKITE_AGENT_ACCESS_TOKEN env var
+var credentialKey = regexp.MustCompile(`(?i)token|secret|password|passphrase|private_key|credential`)
+
+// HTTPCapture records API requests and responses to a file for a limited
+// time, with credentials redacted, so that intermittent problems talking to
+// the API can be reported along with what was actually sent and received.
+//
+// If the path ends in .har, an HTTP archive is written, which browsers and
+// other tools can open. Otherwise each request is written as a line of JSON,
+// in the same format as a HAR entry, and the file is rotated as it grows.
+type HTTPCapture struct {
+	path         string
+	har          bool
+	until        time.Time
+	redactedVars []string
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	entries int
+	closed  bool
+}
+
+// NewHTTPCapture starts capturing to path, stopping once duration has passed.
+// Values in bodies whose keys match one of the redactedVars patterns, like the
+// agent's --redacted-vars, are redacted along with ones that look like
+// credentials.
+func NewHTTPCapture(path string, duration time.Duration, redactedVars []string) (*HTTPCapture, error) {
+	c := &HTTPCapture{
+		path:         path,
+		har:          strings.HasSuffix(path, ".har"),
+		until:        time.Now().Add(duration),
+		redactedVars: redactedVars,
+	}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close stops capturing, and closes the file
+func (c *HTTPCapture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.close()
+}
+
+func (c *HTTPCapture) open() error {
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("opening HTTP capture file: %w", err)
+	}
+	c.file = f
+	c.size = 0
+	c.entries = 0
+
+	if c.har {
+		header := fmt.Sprintf(`{"log":{"version":"1.2","creator":{"name":"buildkite-agent","version":%q},"entries":[`, version.Version())
+		n, err := f.WriteString(header)
+		c.size = int64(n)
+		if err != nil {
+			return err
+		}
+		return c.writeHARTrailer()
+	}
+	return nil
+}
+
+func (c *HTTPCapture) close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.file.Close()
+}
+
+// The HAR file is kept valid after every entry by writing the end of the
+// document, which the next entry then overwrites
+func (c *HTTPCapture) writeHARTrailer() error {
+	_, err := c.file.WriteAt([]byte("]}}\n"), c.size)
+	return err
+}
+
+func (c *HTTPCapture) record(e *harEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	if time.Now().After(c.until) {
+		return c.close()
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if c.har {
+		if c.entries > 0 {
+			data = append([]byte(","), data...)
+		}
+		n, err := c.file.WriteAt(data, c.size)
+		c.size += int64(n)
+		c.entries++
+		if err != nil {
+			return err
+		}
+		return c.writeHARTrailer()
+	}
+
+	if c.size+int64(len(data)) > maxCaptureFileSize && c.entries > 0 {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := c.file.Write(append(data, '\n'))
+	c.size += int64(n)
+	c.entries++
+	return err
+}
+
+// rotate moves path to path.1, path.1 to path.2 and so on, and starts a new
+// file at path
+func (c *HTTPCapture) rotate() error {
+	if err := c.file.Close(); err != nil {
+		return err
+	}
+	for i := maxCaptureFileCount - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", c.path, i), fmt.Sprintf("%s.%d", c.path, i+1))
+	}
+	if err := os.Rename(c.path, c.path+".1"); err != nil {
+		return err
+	}
+	return c.open()
+}
+
+func (c *HTTPCapture) active() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.closed
+}
+
+// captureTransport records requests and their responses to a HTTPCapture
+type captureTransport struct {
+	capture  *HTTPCapture
+	Delegate http.RoundTripper
+}
+
+func (t *captureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.capture.active() {
+		return t.Delegate.RoundTrip(req)
+	}
+
+	var reqBody []byte
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			reqBody, _ = io.ReadAll(body)
+			body.Close()
+		}
+	}
+
+	started := time.Now()
+	resp, err := t.Delegate.RoundTrip(req)
+	elapsed := time.Since(started)
+
+	var respBody []byte
+	if resp != nil {
+		respBody, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	}
+
+	// Failing to capture shouldn't fail the request
+	_ = t.capture.record(t.capture.newHAREntry(req, reqBody, resp, respBody, started, elapsed, err))
+
+	return resp, err
+}
+
+// CancelRequest cancels an in-flight request by closing its connection.
+func (t *captureTransport) CancelRequest(req *http.Request) {
+	cancelableTransport := t.Delegate.(canceler)
+	cancelableTransport.CancelRequest(req)
+}
+
+// The parts of the HAR 1.2 format that are needed to describe an API call.
+// See http://www.softwareishard.com/blog/har-12-spec/
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func (c *HTTPCapture) newHAREntry(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte, started time.Time, elapsed time.Duration, err error) *harEntry {
+	ms := float64(elapsed) / float64(time.Millisecond)
+
+	e := &harEntry{
+		StartedDateTime: started,
+		Time:            ms,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(req.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(reqBody),
+		},
+		Response: harResponse{
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings: harTimings{Wait: ms},
+	}
+
+	for name, values := range req.URL.Query() {
+		for _, v := range values {
+			e.Request.QueryString = append(e.Request.QueryString, harNameValue{Name: name, Value: v})
+		}
+	}
+
+	if len(reqBody) > 0 {
+		e.Request.PostData = &harPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     c.capturedBody(req.Header.Get("Content-Type"), reqBody),
+		}
+	}
+
+	if err != nil {
+		e.Comment = err.Error()
+	}
+
+	if resp != nil {
+		e.Response.Status = resp.StatusCode
+		e.Response.StatusText = http.StatusText(resp.StatusCode)
+		e.Response.HTTPVersion = resp.Proto
+		e.Response.Headers = harHeaders(resp.Header)
+		e.Response.BodySize = len(respBody)
+		e.Response.Content = harContent{
+			Size:     len(respBody),
+			MimeType: resp.Header.Get("Content-Type"),
+			Text:     c.capturedBody(resp.Header.Get("Content-Type"), respBody),
+		}
+	}
+
+	return e
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	nvs := []harNameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			for _, r := range redactedHeaders {
+				if http.CanonicalHeaderKey(name) == r {
+					v = redacted
+				}
+			}
+			nvs = append(nvs, harNameValue{Name: name, Value: v})
+		}
+	}
+	return nvs
+}
+
+// capturedBody returns the body as it should be recorded: truncated, with
+// anything that looks like a credential redacted
+func (c *HTTPCapture) capturedBody(contentType string, body []byte) string {
+	// These are artifact uploads, which aren't useful and could be huge
+	if strings.Contains(contentType, "multipart/form-data") {
+		return fmt.Sprintf("[%d byte multipart body not captured]", len(body))
+	}
+
+	s := jsonStringPair.ReplaceAllStringFunc(string(body), func(pair string) string {
+		m := jsonStringPair.FindStringSubmatch(pair)
+		if !c.redactedKey(m[2]) {
+			return pair
+		}
+		return m[1] + `"` + redacted + `"`
+	})
+	if len(s) > maxCapturedBodySize {
+		s = s[:maxCapturedBodySize] + "...[truncated]"
+	}
+	return s
+}
+
+// redactedKey returns whether the value of a JSON key should be redacted
+func (c *HTTPCapture) redactedKey(key string) bool {
+	if credentialKey.MatchString(key) {
+		return true
+	}
+	for _, pattern := range c.redactedVars {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
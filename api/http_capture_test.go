@@ -0,0 +1,118 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestHTTPCaptureRedactsTokens(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(rw, `{"id":"12-34-56-78-91","name":"agent-1","access_token":"alpacas","env":{"DEPLOY_KEY":"vicunas"}}`)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "capture.har")
+	capture, err := api.NewHTTPCapture(path, time.Minute, []string{"*_KEY"})
+	if err != nil {
+		t.Fatalf("api.NewHTTPCapture(%q, time.Minute, *_KEY) error = %v", path, err)
+	}
+	defer capture.Close()
+
+	c := api.NewClient(logger.Discard, api.Config{
+		Endpoint:    server.URL,
+		Token:       "llamas",
+		HTTPCapture: capture,
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.Register(context.Background(), &api.AgentRegisterRequest{Name: "agent-1"}); err != nil {
+			t.Fatalf("c.Register() error = %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q) error = %v", path, err)
+	}
+
+	// The archive should be complete after each request
+	var har struct {
+		Log struct {
+			Entries []struct {
+				Request struct {
+					Method string `json:"method"`
+				} `json:"request"`
+				Response struct {
+					Status int `json:"status"`
+				} `json:"response"`
+			} `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal(data, &har); err != nil {
+		t.Fatalf("json.Unmarshal(capture) error = %v\n%s", err, data)
+	}
+
+	if got, want := len(har.Log.Entries), 2; got != want {
+		t.Fatalf("len(har.Log.Entries) = %d, want %d", got, want)
+	}
+	if got, want := har.Log.Entries[0].Response.Status, http.StatusOK; got != want {
+		t.Errorf("har.Log.Entries[0].Response.Status = %d, want %d", got, want)
+	}
+
+	for _, secret := range []string{"llamas", "alpacas", "vicunas"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("capture contains %q, want it redacted", secret)
+		}
+	}
+	if !strings.Contains(string(data), "agent-1") {
+		t.Errorf("capture doesn't contain %q", "agent-1")
+	}
+}
+
+func TestHTTPCaptureStopsAfterDuration(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	capture, err := api.NewHTTPCapture(path, 0, nil)
+	if err != nil {
+		t.Fatalf("api.NewHTTPCapture(%q, 0, nil) error = %v", path, err)
+	}
+	defer capture.Close()
+
+	c := api.NewClient(logger.Discard, api.Config{
+		Endpoint:    server.URL,
+		Token:       "llamas",
+		HTTPCapture: capture,
+	})
+
+	if _, err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("c.Connect() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q) error = %v", path, err)
+	}
+	if len(data) != 0 {
+		t.Errorf("capture = %q, want it empty", data)
+	}
+}
@@ -22,6 +22,13 @@ type Job struct {
 	ChunksFailedCount  int               `json:"chunks_failed_count,omitempty"`
 }
 
+// IdempotencyKeyHeader identifies the attempts at a call that changes a job,
+// like accepting it, so that when a call is retried after its response was
+// lost, Buildkite acts on it once and answers the retries as it answered the
+// first attempt
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// JobState is the state of a job, like running or canceling
 type JobState struct {
 	State string `json:"state,omitempty"`
 }
@@ -77,10 +84,10 @@ func (c *Client) AcquireJob(ctx context.Context, id string, headers ...Header) (
 // AcceptJob accepts the passed in job. Returns the job with its finalized set of
 // environment variables (when a job is accepted, the agents environment is
 // applied to the job)
-func (c *Client) AcceptJob(ctx context.Context, job *Job) (*Job, *Response, error) {
+func (c *Client) AcceptJob(ctx context.Context, job *Job, headers ...Header) (*Job, *Response, error) {
 	u := fmt.Sprintf("jobs/%s/accept", job.ID)
 
-	req, err := c.newRequest(ctx, "PUT", u, nil)
+	req, err := c.newRequest(ctx, "PUT", u, nil, headers...)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -95,12 +102,12 @@ func (c *Client) AcceptJob(ctx context.Context, job *Job) (*Job, *Response, erro
 }
 
 // StartJob starts the passed in job
-func (c *Client) StartJob(ctx context.Context, job *Job) (*Response, error) {
+func (c *Client) StartJob(ctx context.Context, job *Job, headers ...Header) (*Response, error) {
 	u := fmt.Sprintf("jobs/%s/start", job.ID)
 
 	req, err := c.newRequest(ctx, "PUT", u, &jobStartRequest{
 		StartedAt: job.StartedAt,
-	})
+	}, headers...)
 	if err != nil {
 		return nil, err
 	}
@@ -109,7 +116,7 @@ func (c *Client) StartJob(ctx context.Context, job *Job) (*Response, error) {
 }
 
 // FinishJob finishes the passed in job
-func (c *Client) FinishJob(ctx context.Context, job *Job) (*Response, error) {
+func (c *Client) FinishJob(ctx context.Context, job *Job, headers ...Header) (*Response, error) {
 	u := fmt.Sprintf("jobs/%s/finish", job.ID)
 
 	req, err := c.newRequest(ctx, "PUT", u, &jobFinishRequest{
@@ -118,7 +125,7 @@ func (c *Client) FinishJob(ctx context.Context, job *Job) (*Response, error) {
 		Signal:            job.Signal,
 		SignalReason:      job.SignalReason,
 		ChunksFailedCount: job.ChunksFailedCount,
-	})
+	}, headers...)
 	if err != nil {
 		return nil, err
 	}
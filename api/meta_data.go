@@ -66,6 +66,7 @@ func (c *Client) ExistsMetaData(ctx context.Context, jobId string, key string) (
 	return e, resp, err
 }
 
+// MetaDataKeys returns the keys of the meta-data set on a job's build
 func (c *Client) MetaDataKeys(ctx context.Context, jobId string) ([]string, *Response, error) {
 	u := fmt.Sprintf("jobs/%s/data/keys", jobId)
 
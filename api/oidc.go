@@ -5,10 +5,13 @@ import (
 	"fmt"
 )
 
+// OIDCToken is an OpenID Connect token for a job, signed by Buildkite
 type OIDCToken struct {
 	Token string `json:"token"`
 }
 
+// OIDCTokenRequest is a request for an OIDC token for a job. The audience,
+// lifetime in seconds, and extra claims are optional.
 type OIDCTokenRequest struct {
 	Job      string
 	Audience string
@@ -16,6 +19,8 @@ type OIDCTokenRequest struct {
 	Claims   []string
 }
 
+// OIDCToken requests an OIDC token for a job, to authenticate to other
+// services that trust Buildkite as an identity provider
 func (c *Client) OIDCToken(ctx context.Context, methodReq *OIDCTokenRequest) (*OIDCToken, *Response, error) {
 	m := &struct {
 		Audience string   `json:"audience,omitempty"`
@@ -10,7 +10,9 @@ type Ping struct {
 	Endpoint string `json:"endpoint,omitempty"`
 }
 
-// Pings the API and returns any work the client needs to perform
+// Pings the API and returns any work the client needs to perform. Pings
+// aren't throttled near the rate limit, as they're how agents are given jobs,
+// and a throttled agent would leave its jobs waiting.
 func (c *Client) Ping(ctx context.Context) (*Ping, *Response, error) {
 	req, err := c.newRequest(ctx, "GET", "ping", nil)
 	if err != nil {
@@ -14,6 +14,8 @@ type PipelineChange struct {
 	Replace  bool   `json:"replace,omitempty"`
 }
 
+// PipelineUploadStatus is how Buildkite is getting on with processing an
+// uploaded pipeline, with a message explaining why if it failed
 type PipelineUploadStatus struct {
 	State   string `json:"state"`
 	Message string `json:"message"`
@@ -54,6 +56,8 @@ func (c *Client) UploadPipelineAsync(
 	return c.doRequest(req, nil)
 }
 
+// PipelineUploadStatus returns the status of the pipeline a job uploaded with
+// a UUID
 func (c *Client) PipelineUploadStatus(
 	ctx context.Context,
 	jobId string,
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Once no more than this fraction of the rate limit remains, non-critical
+	// calls wait for the limit to reset, leaving what's left for the calls
+	// that running jobs depend on
+	rateLimitReserve = 0.1
+
+	// The longest a non-critical call is held back for
+	maxThrottleDelay = time.Minute
+)
+
+// RateLimit is the state of the API rate limit as of the last response that
+// reported it
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// RateLimitStats are running totals of how the rate limit has affected calls
+type RateLimitStats struct {
+	// Non-critical calls that were held back because the limit was nearly used
+	Throttled int64
+
+	// Responses with a 429 Too Many Requests status
+	RateLimited int64
+}
+
+// rateLimiter tracks the rate limit reported by the API. It's shared between
+// a client and the clients derived from it, as they share the same limit.
+type rateLimiter struct {
+	mu    sync.Mutex
+	limit RateLimit
+	stats RateLimitStats
+}
+
+// update records the rate limit reported by a response
+func (rl *rateLimiter) update(resp *http.Response, now time.Time) {
+	limit, ok := parseRateLimit(resp.Header, now)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		rl.stats.RateLimited++
+
+		// We're out, whatever the headers say
+		limit.Remaining = 0
+		if retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			limit.Reset = now.Add(time.Duration(retryAfter) * time.Second)
+		}
+		ok = !limit.Reset.IsZero()
+	}
+
+	if ok {
+		rl.limit = limit
+	}
+}
+
+// throttleDelay returns how long a non-critical call should wait before being
+// made, which is zero unless the limit is nearly used up
+func (rl *rateLimiter) throttleDelay(now time.Time) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.limit.Reset.IsZero() || !now.Before(rl.limit.Reset) {
+		return 0
+	}
+	if float64(rl.limit.Remaining) > float64(rl.limit.Limit)*rateLimitReserve {
+		return 0
+	}
+
+	rl.stats.Throttled++
+
+	delay := rl.limit.Reset.Sub(now)
+	if delay > maxThrottleDelay {
+		delay = maxThrottleDelay
+	}
+	return delay
+}
+
+// parseRateLimit reads the rate limit headers from a response. The reset
+// header can either be a number of seconds, or a unix timestamp.
+func parseRateLimit(h http.Header, now time.Time) (RateLimit, bool) {
+	get := func(name string) (int, bool) {
+		v := h.Get("RateLimit-" + name)
+		if v == "" {
+			v = h.Get("X-RateLimit-" + name)
+		}
+		i, err := strconv.Atoi(v)
+		return i, err == nil
+	}
+
+	limit, okLimit := get("Limit")
+	remaining, okRemaining := get("Remaining")
+	reset, okReset := get("Reset")
+	if !okLimit || !okRemaining || !okReset {
+		return RateLimit{}, false
+	}
+
+	rl := RateLimit{Limit: limit, Remaining: remaining}
+	if reset > 1e9 {
+		rl.Reset = time.Unix(int64(reset), 0)
+	} else {
+		rl.Reset = now.Add(time.Duration(reset) * time.Second)
+	}
+	return rl, true
+}
+
+// RateLimit returns the rate limit as of the last response that reported it
+func (c *Client) RateLimit() RateLimit {
+	c.rateLimiter.mu.Lock()
+	defer c.rateLimiter.mu.Unlock()
+	return c.rateLimiter.limit
+}
+
+// RateLimitStats returns totals of how the rate limit has affected calls made
+// by this client, and those derived from it
+func (c *Client) RateLimitStats() RateLimitStats {
+	c.rateLimiter.mu.Lock()
+	defer c.rateLimiter.mu.Unlock()
+	return c.rateLimiter.stats
+}
+
+// throttle holds back a non-critical call while the rate limit is nearly used
+// up, so that the calls running jobs depend on (like uploading log chunks and
+// finishing jobs) aren't the ones that get rejected
+func (c *Client) throttle(ctx context.Context) error {
+	delay := c.rateLimiter.throttleDelay(time.Now())
+	if delay == 0 {
+		return nil
+	}
+
+	c.logger.Debug("Rate limit nearly reached, waiting %v before making a non-critical request", delay)
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
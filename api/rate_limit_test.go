@@ -0,0 +1,87 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestNonCriticalCallsAreThrottledNearTheRateLimit(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("RateLimit-Limit", "100")
+		rw.Header().Set("RateLimit-Remaining", "5")
+		rw.Header().Set("RateLimit-Reset", "60")
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	c := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+
+	// Nothing is known about the rate limit until the first response
+	if _, _, err := c.Ping(ctx); err != nil {
+		t.Fatalf("c.Ping() error = %v", err)
+	}
+
+	if got, want := c.RateLimit().Remaining, 5; got != want {
+		t.Errorf("c.RateLimit().Remaining = %d, want %d", got, want)
+	}
+
+	// Saving header times now waits for the limit to reset
+	throttledCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.SaveHeaderTimes(throttledCtx, "job", &api.HeaderTimes{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("c.SaveHeaderTimes() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// But job-critical calls go straight through, as do pings, which is how
+	// the agent gets its next job
+	if _, err := c.FinishJob(ctx, &api.Job{ID: "job"}); err != nil {
+		t.Errorf("c.FinishJob() error = %v", err)
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if _, _, err := c.Ping(pingCtx); err != nil {
+		t.Errorf("c.Ping() error = %v", err)
+	}
+
+	if got, want := c.RateLimitStats(), (api.RateLimitStats{Throttled: 1}); got != want {
+		t.Errorf("c.RateLimitStats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestRateLimitedResponsesAreCounted(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Retry-After", "60")
+		http.Error(rw, `{"message":"slow down"}`, http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	c := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+
+	if _, err := c.FinishJob(ctx, &api.Job{ID: "job"}); !api.IsErrHavingStatus(err, http.StatusTooManyRequests) {
+		t.Fatalf("c.FinishJob() error = %v, want status %d", err, http.StatusTooManyRequests)
+	}
+
+	if got, want := c.RateLimit().Remaining, 0; got != want {
+		t.Errorf("c.RateLimit().Remaining = %d, want %d", got, want)
+	}
+
+	// Clients derived from this one share its limit
+	c2 := c.FromPing(&api.Ping{Endpoint: server.URL})
+	if got, want := c2.RateLimitStats(), (api.RateLimitStats{RateLimited: 1}); got != want {
+		t.Errorf("c.FromPing().RateLimitStats() = %+v, want %+v", got, want)
+	}
+}
@@ -12,6 +12,8 @@ type StepExportRequest struct {
 	Format    string `json:"format,omitempty"`
 }
 
+// StepExportResponse is the value of a step's attribute, in the format it
+// was asked for
 type StepExportResponse struct {
 	Output string `json:"output"`
 }
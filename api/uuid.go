@@ -2,6 +2,13 @@ package api
 
 import "github.com/pborman/uuid"
 
+// NewUUID returns a new random UUID
 func NewUUID() string {
 	return uuid.New()
 }
+
+// NewNamedUUID returns a UUID derived from name, so the same name always
+// gives the same UUID
+func NewNamedUUID(name string) string {
+	return uuid.NewSHA1(uuid.NameSpace_OID, []byte(name)).String()
+}
@@ -1,6 +1,9 @@
-// Package env provides utilities for dealing with environment variables.
+// Package env provides utilities for dealing with environment variables,
+// with the case-insensitive names Windows has, and diffs between
+// environments, like the changes a hook made to a job's.
 //
-// It is intended for internal use by buildkite-agent only.
+// It's public because a shell.Shell's environment is an Environment, and
+// like shell, it follows the module's semantic versioning.
 package env
 
 import (
@@ -14,6 +17,7 @@ import (
 // for case-insensitive operating systems
 type Environment map[string]string
 
+// New returns an empty Environment
 func New() Environment {
 	return Environment{}
 }
@@ -145,6 +149,8 @@ func (e Environment) Merge(other Environment) Environment {
 	return c
 }
 
+// Apply returns a copy of the environment with a diff applied to it: the
+// variables it added or changed set, and the ones it removed removed
 func (e Environment) Apply(diff Diff) Environment {
 	c := e.Copy()
 
@@ -185,6 +191,32 @@ func (e Environment) ToSlice() []string {
 	return s
 }
 
+// FromNullDelimited creates a new environment from KEY=VALUE entries that are
+// each terminated by a null byte, like the output of `env -0`. Unlike JSON,
+// this keeps values exactly as they are, even if they aren't valid UTF-8.
+func FromNullDelimited(data []byte) Environment {
+	env := New()
+
+	for _, l := range strings.Split(string(data), "\x00") {
+		if k, v, ok := Split(l); ok {
+			env.Set(k, v)
+		}
+	}
+
+	return env
+}
+
+// ToNullDelimited returns the environment as sorted KEY=VALUE entries that are
+// each terminated by a null byte, which FromNullDelimited reads back
+func (e Environment) ToNullDelimited() []byte {
+	var b strings.Builder
+	for _, l := range e.ToSlice() {
+		b.WriteString(l)
+		b.WriteByte(0)
+	}
+	return []byte(b.String())
+}
+
 func (e Environment) MarshalJSON() ([]byte, error) {
 	normalised := make(map[string]string, len(e))
 	for k, v := range e {
@@ -241,23 +273,27 @@ func normalizeKeyName(key string) string {
 	}
 }
 
+// Diff is how one environment differs from another
 type Diff struct {
 	Added   map[string]string
 	Changed map[string]DiffPair
 	Removed map[string]struct{}
 }
 
+// DiffPair is the old and new values of a variable that changed
 type DiffPair struct {
 	Old string
 	New string
 }
 
+// Remove removes a variable from the diff, however it was different
 func (diff *Diff) Remove(key string) {
 	delete(diff.Added, key)
 	delete(diff.Changed, key)
 	delete(diff.Removed, key)
 }
 
+// Empty returns whether there aren't any differences
 func (diff *Diff) Empty() bool {
 	return len(diff.Added) == 0 && len(diff.Changed) == 0 && len(diff.Removed) == 0
 }
@@ -0,0 +1,98 @@
+package agent
+
+// AgentConfiguration is the run-time configuration for an agent that
+// has been loaded from the config file and command-line params
+type AgentConfiguration struct {
+	ConfigPath                 string
+	BootstrapScript            string
+	BuildPath                  string
+	BuildPathLayout            string
+	BuildDirEncryption         string
+	BuildDirEncryptionSize     string
+	BuildDirTmpfs              bool
+	BuildDirTmpfsSize          string
+	BuildDirOverlayPath        string
+	BuildDirOverlayRefresh     int
+	BuildDirSELinuxLabel       string
+	HooksPath                  string
+	HookChecksumsPath          string
+	SecretScan                 string
+	SecretScanRulesPath        string
+	PolicyScannerPath          string
+	FailureBundlePaths         string
+	FailureBundleMaxSize       int64
+	DockerDaemon               string
+	DockerDaemonImage          string
+	Rootless                   bool
+	JobRestrictedToken         bool
+	VirtualDisplay             string
+	VirtualDisplaySize         string
+	GitCheckoutStrategy        string
+	GitShallowDepth            int
+	GitLFS                     bool
+	GitMirrorsPath             string
+	GitMirrorsLockTimeout      int
+	GitMirrorsSkipUpdate       bool
+	PluginsPath                string
+	PluginsCachePath           string
+	GitCheckoutFlags           string
+	GitCloneFlags              string
+	GitCloneMirrorFlags        string
+	GitCleanFlags              string
+	GitFetchFlags              string
+	GitSubmodules              bool
+	SSHKeyscan                 bool
+	SSHStrictHostChecking      bool
+	CommandEval                bool
+	PluginsEnabled             bool
+	PluginValidation           bool
+	AllowedPlugins             []string
+	DeniedPlugins              []string
+	LocalHooksEnabled          bool
+	RunInPty                   bool
+	TimestampLines             bool
+	CollapseProgressOutput     bool
+	JobOutputEncoding          string
+	JobLogPhaseMarkers         bool
+	JobLogLineMetadata         bool
+	JobLogFormat               string
+	JobUmask                   string
+	JobDirectoryMode           string
+	JobLocale                  string
+	JobTimezone                string
+	JobEnv                     []string
+	ParallelSkewThreshold      int
+	BuildCacheURL              string
+	ArtifactContentStore       string
+	ArtifactPreviews           bool
+	HealthCheckAddr            string
+	DisconnectAfterJob         bool
+	DisconnectAfterIdleTimeout int
+	CancelGracePeriod          int
+	SignalGracePeriodSeconds   int
+	EnableJobLogTmpfile        bool
+	Shell                      string
+	Profile                    string
+	RedactedVars               []string
+	AcquireJob                 string
+	TracingBackend             string
+	TracingServiceName         string
+	DNSOverrides               []string
+	DNSResolver                string
+	TagsFromToolchains         bool
+	HostFingerprint            string
+	HostFingerprintDrift       []string
+	MaxJobRuntimes             []JobRuntimeLimit
+	JobResourceUsage           bool
+	JobEnergyCPUWatts          float64
+	JobEnergyCarbonIntensity   int
+	JobEnergyAnnotation        bool
+	BuildDirQuotas             []BuildDirQuota
+	JobEgressPolicy            bool
+	JobEgressAllow             EgressAllowlist
+	JobNetworkAudit            bool
+	JobWriteGuard              string
+	JobWriteAllow              []string
+	JobEphemeralUser           bool
+	JobEnvSpillSize            int64
+}
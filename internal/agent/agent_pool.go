@@ -4,7 +4,7 @@ import (
 	"context"
 	"sync"
 
-	"github.com/buildkite/agent/v3/status"
+	"github.com/buildkite/agent/v3/internal/status"
 )
 
 // AgentPool manages multiple parallel AgentWorkers
@@ -7,14 +7,15 @@ import (
 	"math/rand"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/metrics"
+	"github.com/buildkite/agent/v3/internal/status"
 	"github.com/buildkite/agent/v3/logger"
-	"github.com/buildkite/agent/v3/metrics"
 	"github.com/buildkite/agent/v3/process"
-	"github.com/buildkite/agent/v3/status"
 	"github.com/buildkite/roko"
 )
 
@@ -33,6 +34,10 @@ type AgentWorkerConfig struct {
 
 	// The configuration of the agent from the CLI
 	AgentConfiguration AgentConfiguration
+
+	// The jobs run by all the workers on this host, for honouring jobs'
+	// affinity hints
+	JobHistory *JobHistory
 }
 
 type agentStats struct {
@@ -43,6 +48,9 @@ type agentStats struct {
 
 	// The last error that occurred during heartbeat, or nil if it was successful
 	lastHeartbeatError error
+
+	// The rate limit totals as of the last time they were sent as metrics
+	lastRateLimitStats api.RateLimitStats
 }
 
 type AgentWorker struct {
@@ -83,6 +91,9 @@ type AgentWorker struct {
 	// The index of this agent worker
 	spawnIndex int
 
+	// The jobs run on this host, shared with the other workers
+	jobHistory *JobHistory
+
 	// When this worker runs a job, we'll store an instance of the
 	// JobRunner here
 	jobRunner jobRunner
@@ -119,6 +130,10 @@ func (e *errUnrecoverable) Unwrap() error {
 
 // Creates the agent worker and initializes its API Client
 func NewAgentWorker(l logger.Logger, a *api.AgentRegisterResponse, m *metrics.Collector, apiClient APIClient, c AgentWorkerConfig) *AgentWorker {
+	if c.JobHistory == nil {
+		c.JobHistory = NewJobHistory()
+	}
+
 	return &AgentWorker{
 		logger:             l,
 		agent:              a,
@@ -130,6 +145,7 @@ func NewAgentWorker(l logger.Logger, a *api.AgentRegisterResponse, m *metrics.Co
 		stop:               make(chan struct{}),
 		cancelSig:          c.CancelSignal,
 		spawnIndex:         c.SpawnIndex,
+		jobHistory:         c.JobHistory,
 		retrySleepFunc:     time.Sleep, // https://github.com/buildkite/roko/issues/2
 	}
 }
@@ -193,6 +209,10 @@ func (a *AgentWorker) Start(ctx context.Context, idleMonitor *IdleMonitor) error
 
 	go a.runHeartbeatLoop(heartbeatCtx)
 
+	if a.agentConfiguration.TagsFromToolchains {
+		go a.runToolchainLoop(heartbeatCtx)
+	}
+
 	// If the agent is booted in acquisition mode, then we don't need to
 	// bother about starting the ping loop.
 	if a.agentConfiguration.AcquireJob != "" {
@@ -239,6 +259,8 @@ func (a *AgentWorker) runHeartbeatLoop(ctx context.Context) {
 				a.stats.Unlock()
 			}
 
+			a.reportRateLimitStats()
+
 		case <-ctx.Done():
 			a.logger.Debug("Stopping heartbeats")
 			return
@@ -246,6 +268,38 @@ func (a *AgentWorker) runHeartbeatLoop(ctx context.Context) {
 	}
 }
 
+// Checks the versions of tools against those the agent registered with, as
+// the agent's tags can't change until it registers again
+func (a *AgentWorker) runToolchainLoop(ctx context.Context) {
+	registered := toolchainsFromTags(a.agent.Tags)
+	if len(registered) == 0 {
+		registered = DetectToolchains(ctx)
+	}
+	last := registered
+
+	ticker := time.NewTicker(toolchainCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Only report when something changed since the last check, so
+			// it isn't repeated, but report how they differ from what the
+			// agent registered with, which could be nothing if a change was
+			// undone
+			current := DetectToolchains(ctx)
+			if changes := toolchainChanges(registered, current); len(changes) > 0 && len(toolchainChanges(last, current)) > 0 {
+				a.logger.Warn("Toolchains have changed since the agent registered: %s. The agent's tags will be updated when it's restarted",
+					strings.Join(changes, ", "))
+				a.metrics.Count("toolchains.changed", int64(len(changes)))
+			}
+			last = current
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func (a *AgentWorker) runPingLoop(ctx context.Context, idleMonitor *IdleMonitor) error {
 	ctx, setStat, done := status.AddSimpleItem(ctx, "Ping loop")
 	defer done()
@@ -270,6 +324,9 @@ func (a *AgentWorker) runPingLoop(ctx context.Context, idleMonitor *IdleMonitor)
 				} else {
 					a.logger.Warn("%v", err)
 				}
+			} else if job != nil && !a.admitJob(job) {
+				// Leave the job to be offered to another agent
+				setStat("🙅 Left job for another agent")
 			} else if job != nil {
 				// Let other agents know this agent is now busy and
 				// not to idle terminate
@@ -277,7 +334,9 @@ func (a *AgentWorker) runPingLoop(ctx context.Context, idleMonitor *IdleMonitor)
 				setStat("💼 Accepting job")
 
 				// Runs the job, only errors if something goes wrong
-				if runErr := a.AcceptAndRunJob(ctx, job); runErr != nil {
+				runErr := a.AcceptAndRunJob(ctx, job)
+				a.jobHistory.done(job, time.Now())
+				if runErr != nil {
 					a.logger.Error("%v", runErr)
 				} else {
 					if a.agentConfiguration.DisconnectAfterJob {
@@ -403,6 +462,25 @@ func (a *AgentWorker) Connect(ctx context.Context) error {
 	})
 }
 
+// Sends metrics for how often the API rate limit has affected calls since
+// they were last sent
+func (a *AgentWorker) reportRateLimitStats() {
+	current := a.apiClient.RateLimitStats()
+
+	a.stats.Lock()
+	last := a.stats.lastRateLimitStats
+	a.stats.lastRateLimitStats = current
+	a.stats.Unlock()
+
+	if n := current.Throttled - last.Throttled; n > 0 {
+		a.metrics.Count("api.rate_limit.throttled", n)
+	}
+	if n := current.RateLimited - last.RateLimited; n > 0 {
+		a.logger.Warn("%d API requests were rejected by the rate limit since the last heartbeat", n)
+		a.metrics.Count("api.rate_limit.rejected", n)
+	}
+}
+
 // Performs a heatbeat
 func (a *AgentWorker) Heartbeat(ctx context.Context) error {
 	var beat *api.Heartbeat
@@ -591,24 +669,42 @@ func (a *AgentWorker) AcquireAndRunJob(ctx context.Context, jobId string) error
 	}
 
 	// Now that we've acquired the job, let's run it
-	return a.RunJob(ctx, acquiredJob)
+	return a.RunJob(ctx, acquiredJob, time.Time{})
+}
+
+// admitJob returns whether the job's affinity hints allow it to run here
+func (a *AgentWorker) admitJob(job *api.Job) bool {
+	admitted, reason := a.jobHistory.admit(job, time.Now())
+	if !admitted {
+		a.logger.Info("Leaving job %s for another agent, as %s", job.ID, reason)
+		a.metrics.Count("jobs.left", 1)
+	}
+	return admitted
 }
 
 // Accepts a job and runs it, only returns an error if something goes wrong
 func (a *AgentWorker) AcceptAndRunJob(ctx context.Context, job *api.Job) error {
+	assignedAt := time.Now()
 	a.logger.Info("Assigned job %s. Accepting...", job.ID)
 
 	// Accept the job. We'll retry on connection related issues, but if
 	// Buildkite returns a 422 or 500 for example, we'll just bail out,
-	// re-ping, and try the whole process again.
+	// re-ping, and try the whole process again. Each attempt has the same
+	// idempotency key, so if one's response is lost, the next one doesn't
+	// accept the job again, and so does accepting it again if it's offered
+	// again after an attempt that might have accepted it.
 	var accepted *api.Job
+	key := a.jobHistory.acceptKey(job)
+	unknown := false
 	err := roko.NewRetrier(
 		roko.WithMaxAttempts(30),
 		roko.WithStrategy(roko.Constant(5*time.Second)),
 	).DoWithContext(ctx, func(r *roko.Retrier) error {
 		var err error
-		accepted, _, err = a.apiClient.AcceptJob(ctx, job)
+		var response *api.Response
+		accepted, response, err = a.apiClient.AcceptJob(ctx, job, key)
 		if err != nil {
+			unknown = unknown || outcomeUnknown(response)
 			if api.IsRetryableError(err) {
 				a.logger.Warn("%s (%s)", err, r)
 			} else {
@@ -620,16 +716,27 @@ func (a *AgentWorker) AcceptAndRunJob(ctx context.Context, job *api.Job) error {
 		return err
 	})
 
-	// If `accepted` is nil, then the job was never accepted
+	// If `accepted` is nil, then the job wasn't accepted here, and can be
+	// if it's offered again. If an attempt might have accepted it without
+	// us knowing, it's accepted with the same key, so it's still only run
+	// once.
 	if accepted == nil {
+		if unknown {
+			a.jobHistory.acceptUnknown(job)
+		} else {
+			a.jobHistory.forget(job)
+		}
 		return fmt.Errorf("Failed to accept job: %v", err)
 	}
 
 	// Now that we've accepted the job, let's run it
-	return a.RunJob(ctx, accepted)
+	return a.RunJob(ctx, accepted, assignedAt)
 }
 
-func (a *AgentWorker) RunJob(ctx context.Context, acceptResponse *api.Job) error {
+// RunJob runs a job that has been accepted or acquired. assignedAt is when the
+// job was assigned to this agent, if known, and is used to report how long the
+// job took to start.
+func (a *AgentWorker) RunJob(ctx context.Context, acceptResponse *api.Job, assignedAt time.Time) error {
 	jobMetricsScope := a.metrics.With(metrics.Tags{
 		"pipeline": acceptResponse.Env["BUILDKITE_PIPELINE_SLUG"],
 		"org":      acceptResponse.Env["BUILDKITE_ORGANIZATION_SLUG"],
@@ -644,6 +751,9 @@ func (a *AgentWorker) RunJob(ctx context.Context, acceptResponse *api.Job) error
 		DebugHTTP:          a.debugHTTP,
 		CancelSignal:       a.cancelSig,
 		AgentConfiguration: a.agentConfiguration,
+		AssignedAt:         assignedAt,
+		AcceptedAt:         time.Now(),
+		SpawnIndex:         a.spawnIndex,
 	})
 	if err != nil {
 		return fmt.Errorf("Failed to initialize job: %v", err)
@@ -10,7 +10,7 @@ import (
 
 // APIClient is an interface generated for "github.com/buildkite/agent/v3/api.Client".
 type APIClient interface {
-	AcceptJob(context.Context, *api.Job) (*api.Job, *api.Response, error)
+	AcceptJob(context.Context, *api.Job, ...api.Header) (*api.Job, *api.Response, error)
 	AcquireJob(context.Context, string, ...api.Header) (*api.Job, *api.Response, error)
 	Annotate(context.Context, string, *api.Annotation) (*api.Response, error)
 	AnnotationRemove(context.Context, string, string) (*api.Response, error)
@@ -19,7 +19,7 @@ type APIClient interface {
 	CreateArtifacts(context.Context, string, *api.ArtifactBatch) (*api.ArtifactBatchCreateResponse, *api.Response, error)
 	Disconnect(context.Context) (*api.Response, error)
 	ExistsMetaData(context.Context, string, string) (*api.MetaDataExists, *api.Response, error)
-	FinishJob(context.Context, *api.Job) (*api.Response, error)
+	FinishJob(context.Context, *api.Job, ...api.Header) (*api.Response, error)
 	FromAgentRegisterResponse(*api.AgentRegisterResponse) *api.Client
 	FromPing(*api.Ping) *api.Client
 	GetJobState(context.Context, string) (*api.JobState, *api.Response, error)
@@ -28,11 +28,13 @@ type APIClient interface {
 	MetaDataKeys(context.Context, string) ([]string, *api.Response, error)
 	Ping(context.Context) (*api.Ping, *api.Response, error)
 	PipelineUploadStatus(context.Context, string, string, ...api.Header) (*api.PipelineUploadStatus, *api.Response, error)
+	RateLimit() api.RateLimit
+	RateLimitStats() api.RateLimitStats
 	Register(context.Context, *api.AgentRegisterRequest) (*api.AgentRegisterResponse, *api.Response, error)
 	SaveHeaderTimes(context.Context, string, *api.HeaderTimes) (*api.Response, error)
 	SearchArtifacts(context.Context, string, *api.ArtifactSearchOptions) ([]*api.Artifact, *api.Response, error)
 	SetMetaData(context.Context, string, *api.MetaData) (*api.Response, error)
-	StartJob(context.Context, *api.Job) (*api.Response, error)
+	StartJob(context.Context, *api.Job, ...api.Header) (*api.Response, error)
 	StepExport(context.Context, string, *api.StepExportRequest) (*api.StepExportResponse, *api.Response, error)
 	StepUpdate(context.Context, string, *api.StepUpdate) (*api.Response, error)
 	UpdateArtifacts(context.Context, string, map[string]string) (*api.Response, error)
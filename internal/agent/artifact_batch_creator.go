@@ -2,6 +2,7 @@ package agent
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
@@ -59,7 +60,7 @@ func (a *ArtifactBatchCreator) Create(ctx context.Context) ([]*api.Artifact, err
 		// twice, it'll just return the previous data and skip the
 		// upload)
 		batch := &api.ArtifactBatch{
-			ID:                api.NewUUID(),
+			ID:                batchID(theseArtifacts),
 			Artifacts:         theseArtifacts,
 			UploadDestination: a.conf.UploadDestination,
 		}
@@ -102,3 +103,17 @@ func (a *ArtifactBatchCreator) Create(ctx context.Context) ([]*api.Artifact, err
 
 	return a.conf.Artifacts, nil
 }
+
+// batchID returns an ID for a batch of artifacts that's the same each time
+// they're created, so a retried upload doesn't create them again. If any of
+// them don't have an ID of their own, a new batch ID is used each time.
+func batchID(artifacts []*api.Artifact) string {
+	ids := make([]string, 0, len(artifacts))
+	for _, artifact := range artifacts {
+		if artifact.ID == "" {
+			return api.NewUUID()
+		}
+		ids = append(ids, artifact.ID)
+	}
+	return api.NewNamedUUID(strings.Join(ids, ","))
+}
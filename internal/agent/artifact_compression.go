@@ -0,0 +1,394 @@
+package agent
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The ways artifacts can be compressed before they're uploaded
+const (
+	ArtifactCompressionGzip = "gzip"
+	ArtifactCompressionZstd = "zstd"
+)
+
+// What's added to the paths of compressed artifacts, so they can be found
+// and decompressed when they're downloaded. Directories are archived, and
+// get .tar before it.
+var artifactCompressionExtensions = map[string]string{
+	ArtifactCompressionGzip: ".gz",
+	ArtifactCompressionZstd: ".zst",
+}
+
+// ValidArtifactCompression returns whether artifacts can be compressed with
+// the named compression
+func ValidArtifactCompression(compression string) bool {
+	_, ok := artifactCompressionExtensions[compression]
+	return ok
+}
+
+// compressedArtifactPath returns the path a compressed artifact is uploaded
+// to
+func compressedArtifactPath(path, compression string, dir bool) string {
+	if dir {
+		path += ".tar"
+	}
+	return path + artifactCompressionExtensions[compression]
+}
+
+// decompressedArtifactPath returns the path an artifact is decompressed to,
+// how it was compressed, and whether it's an archived directory. The
+// compression is empty if the artifact wasn't compressed.
+func decompressedArtifactPath(path string) (decompressed, compression string, dir bool) {
+	for c, ext := range artifactCompressionExtensions {
+		if strings.HasSuffix(path, ext) {
+			path = strings.TrimSuffix(path, ext)
+			if strings.HasSuffix(path, ".tar") {
+				return strings.TrimSuffix(path, ".tar"), c, true
+			}
+			return path, c, false
+		}
+	}
+	return path, "", false
+}
+
+// artifactArchiveCompression returns whether an artifact is a tar archive
+// that can be extracted as it's downloaded, and how it's compressed, if it
+// is
+func artifactArchiveCompression(path string) (compression string, ok bool) {
+	switch {
+	case strings.HasSuffix(path, ".tar"):
+		return "", true
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return ArtifactCompressionGzip, true
+	case strings.HasSuffix(path, ".tar.zst"), strings.HasSuffix(path, ".tzst"):
+		return ArtifactCompressionZstd, true
+	}
+	return "", false
+}
+
+// compressArtifact writes the file or directory at src, compressed, to a new
+// file at dst. Directories are archived with tar first.
+func compressArtifact(compression, src, dst string) (err error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	w, err := newCompressor(compression, f)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		err = archiveDir(w, src)
+	} else {
+		err = writeFileTo(w, src)
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// decompressArtifact decompresses the artifact at src to dst, unpacking
+// archived directories into a directory at dst
+func decompressArtifact(compression, src, dst string, dir bool) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := newDecompressor(compression, f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if dir {
+		return unarchiveDir(r, dst)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeFileTo writes the contents of the file at path to w
+func writeFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// archiveDir writes a tar archive of dir to w. Its entries are under dir's
+// name, so unpacking it next to where dir was puts it back.
+func archiveDir(w io.Writer, dir string) error {
+	return archivePaths(w, filepath.Dir(dir), []string{dir})
+}
+
+// archivePaths writes a tar archive of files and directories to w, with
+// their entries named relative to base, which they all have to be inside
+func archivePaths(w io.Writer, base string, paths []string) error {
+	tw := tar.NewWriter(w)
+
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			link := ""
+			if info.Mode()&os.ModeSymlink != 0 {
+				if link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			}
+
+			header, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			name, err := filepath.Rel(base, path)
+			if err != nil || isOutside(name) {
+				return fmt.Errorf("%q is outside of %q", path, base)
+			}
+			header.Name = filepath.ToSlash(name)
+			if info.IsDir() {
+				header.Name += "/"
+			}
+
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			return writeFileTo(tw, path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// unarchiveDir unpacks a tar archive written by archiveDir into dst, which
+// takes the place of the directory that was archived
+func unarchiveDir(r io.Reader, dst string) error {
+	return extractTar(r, dst, true)
+}
+
+// extractTar unpacks a tar archive into dir. If stripRoot is true, the
+// directory every entry is under is swapped for dir. Entries outside of dir,
+// and links out of it, are errors.
+func extractTar(r io.Reader, dir string, stripRoot bool) error {
+	tr := tar.NewReader(r)
+	root := ""
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.FromSlash(strings.TrimSuffix(header.Name, "/"))
+		if stripRoot && root == "" {
+			root = strings.SplitN(name, string(filepath.Separator), 2)[0]
+		}
+		rel, err := filepath.Rel(root, name)
+		if root == "" {
+			rel, err = filepath.Clean(name), nil
+		}
+		if err != nil || isOutside(rel) || filepath.IsAbs(name) {
+			return fmt.Errorf("archive entry %q is outside of %q", header.Name, dir)
+		}
+		path := filepath.Join(dir, rel)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0o777); err != nil {
+				return err
+			}
+
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			// Links out of the directory could have later entries written
+			// through them to anywhere
+			if filepath.IsAbs(header.Linkname) || isOutside(filepath.Join(filepath.Dir(rel), filepath.FromSlash(header.Linkname))) {
+				return fmt.Errorf("archive entry %q links outside of %q", header.Name, dir)
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+				return err
+			}
+			// It may be left from extracting the archive before
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// isOutside returns whether a clean relative path goes up out of the
+// directory it's relative to
+func isOutside(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// newCompressor returns a writer that compresses what's written to it into
+// w. It has to be closed to finish writing.
+func newCompressor(compression string, w io.Writer) (io.WriteCloser, error) {
+	switch compression {
+	case ArtifactCompressionGzip:
+		return gzip.NewWriter(w), nil
+
+	case ArtifactCompressionZstd:
+		cmd, err := zstdCommand("--compress")
+		if err != nil {
+			return nil, err
+		}
+		cmd.Stdout = w
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &commandWriter{WriteCloser: stdin, cmd: cmd}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", compression)
+}
+
+// newDecompressor returns a reader that decompresses what's read from r
+func newDecompressor(compression string, r io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case ArtifactCompressionGzip:
+		return gzip.NewReader(r)
+
+	case ArtifactCompressionZstd:
+		cmd, err := zstdCommand("--decompress")
+		if err != nil {
+			return nil, err
+		}
+		cmd.Stdin = r
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &commandReader{ReadCloser: stdout, cmd: cmd}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", compression)
+}
+
+// zstdCommand returns a command that runs zstd from the PATH as a filter
+func zstdCommand(mode string) (*exec.Cmd, error) {
+	path, err := exec.LookPath("zstd")
+	if err != nil {
+		return nil, errors.New("zstd compression needs the zstd command, which wasn't found in $PATH")
+	}
+	cmd := exec.Command(path, mode, "--quiet", "--stdout")
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
+
+// commandWriter writes to a command's stdin, and waits for it to exit when
+// it's closed
+type commandWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (w *commandWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if waitErr := w.cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	return err
+}
+
+// commandReader reads from a command's stdout, and waits for it to exit
+// when it's closed
+type commandReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *commandReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		// A command that failed part way through shouldn't look like the
+		// end of what it wrote
+		if waitErr := r.wait(); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (r *commandReader) Close() error {
+	r.ReadCloser.Close()
+	return r.wait()
+}
+
+func (r *commandReader) wait() error {
+	if r.cmd.ProcessState != nil {
+		if !r.cmd.ProcessState.Success() {
+			return fmt.Errorf("%s exited with %s", r.cmd.Path, r.cmd.ProcessState)
+		}
+		return nil
+	}
+	return r.cmd.Wait()
+}
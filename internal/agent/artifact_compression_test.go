@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecompressedArtifactPath(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		path, decompressed, compression string
+		dir                             bool
+	}{
+		{path: "logs/build.log", decompressed: "logs/build.log"},
+		{path: "logs/build.log.gz", decompressed: "logs/build.log", compression: ArtifactCompressionGzip},
+		{path: "logs/build.log.zst", decompressed: "logs/build.log", compression: ArtifactCompressionZstd},
+		{path: "coverage.tar.gz", decompressed: "coverage", compression: ArtifactCompressionGzip, dir: true},
+		{path: "coverage.tar.zst", decompressed: "coverage", compression: ArtifactCompressionZstd, dir: true},
+	} {
+		tc := tc
+		t.Run(tc.path, func(t *testing.T) {
+			t.Parallel()
+
+			decompressed, compression, dir := decompressedArtifactPath(tc.path)
+			assert.Equal(t, tc.decompressed, decompressed)
+			assert.Equal(t, tc.compression, compression)
+			assert.Equal(t, tc.dir, dir)
+
+			if tc.compression != "" {
+				assert.Equal(t, tc.path, compressedArtifactPath(tc.decompressed, tc.compression, tc.dir))
+			}
+		})
+	}
+}
+
+func TestCompressArtifactRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, compression := range []string{ArtifactCompressionGzip, ArtifactCompressionZstd} {
+		compression := compression
+		t.Run(compression, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := exec.LookPath("zstd"); err != nil && compression == ArtifactCompressionZstd {
+				t.Skip("zstd isn't installed")
+			}
+
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src", "coverage")
+			require.NoError(t, os.MkdirAll(filepath.Join(src, "html", "empty"), 0o777))
+			require.NoError(t, os.WriteFile(filepath.Join(src, "lcov.info"), bytes.Repeat([]byte("TN:\n"), 1000), 0o644))
+			require.NoError(t, os.WriteFile(filepath.Join(src, "html", "index.html"), []byte("<html></html>"), 0o644))
+			if runtime.GOOS != "windows" {
+				require.NoError(t, os.Symlink("html/index.html", filepath.Join(src, "index.html")))
+			}
+
+			// A file
+			compressed := filepath.Join(dir, "lcov.info.compressed")
+			require.NoError(t, compressArtifact(compression, filepath.Join(src, "lcov.info"), compressed))
+			info, err := os.Stat(compressed)
+			require.NoError(t, err)
+			assert.Less(t, info.Size(), int64(4000))
+
+			require.NoError(t, decompressArtifact(compression, compressed, filepath.Join(dir, "lcov.info"), false))
+			data, err := os.ReadFile(filepath.Join(dir, "lcov.info"))
+			require.NoError(t, err)
+			assert.Equal(t, bytes.Repeat([]byte("TN:\n"), 1000), data)
+
+			// A directory, unpacked somewhere else
+			archive := filepath.Join(dir, "coverage.archive")
+			require.NoError(t, compressArtifact(compression, src, archive))
+
+			dst := filepath.Join(dir, "dst", "coverage")
+			require.NoError(t, decompressArtifact(compression, archive, dst, true))
+
+			data, err = os.ReadFile(filepath.Join(dst, "html", "index.html"))
+			require.NoError(t, err)
+			assert.Equal(t, "<html></html>", string(data))
+			assert.DirExists(t, filepath.Join(dst, "html", "empty"))
+			if runtime.GOOS != "windows" {
+				link, err := os.Readlink(filepath.Join(dst, "index.html"))
+				require.NoError(t, err)
+				assert.Equal(t, "html/index.html", link)
+			}
+		})
+	}
+}
+
+func TestUnarchiveDirRejectsEntriesOutsideIt(t *testing.T) {
+	t.Parallel()
+
+	for _, header := range []*tar.Header{
+		{Name: "coverage/../../evil", Typeflag: tar.TypeReg},
+		{Name: "coverage/link", Typeflag: tar.TypeSymlink, Linkname: "../../etc"},
+		{Name: "coverage/link", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+	} {
+		header := header
+		t.Run(header.Name+" "+header.Linkname, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: "coverage/", Typeflag: tar.TypeDir, Mode: 0o755}))
+			require.NoError(t, tw.WriteHeader(header))
+			require.NoError(t, tw.Close())
+
+			dir := t.TempDir()
+			assert.Error(t, unarchiveDir(&buf, filepath.Join(dir, "dst", "coverage")))
+			assert.NoFileExists(t, filepath.Join(dir, "evil"))
+			assert.NoFileExists(t, filepath.Join(dir, "dst", "coverage", "link"))
+		})
+	}
+}
+
+func TestCollectWithCompression(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "coverage", "html"), 0o777))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "coverage", "html", "index.html"), []byte("<html></html>"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "build.log"), []byte("build\n"), 0o644))
+
+	wd, _ := os.Getwd()
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths:       "coverage;*.log;coverage/*",
+		Compression: ArtifactCompressionGzip,
+	})
+
+	artifacts, err := uploader.Collect()
+	require.NoError(t, err)
+
+	// Only the directory named without wildcards is archived
+	paths := map[string]string{}
+	for _, a := range artifacts {
+		paths[a.Path] = a.AbsolutePath
+	}
+	require.Len(t, paths, 2)
+	require.Contains(t, paths, "coverage.tar.gz")
+	require.Contains(t, paths, "build.log.gz")
+
+	// What's uploaded is the compressed file
+	f, err := os.Open(paths["build.log.gz"])
+	require.NoError(t, err)
+	r, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(r)
+	require.NoError(t, err)
+	f.Close()
+	assert.Equal(t, "build\n", buf.String())
+
+	uploader.removeCompressed()
+	assert.NoFileExists(t, paths["build.log.gz"])
+}
+
+func TestArtifactDownloaderDecompresses(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "build.log")
+	require.NoError(t, os.WriteFile(src, []byte("build\n"), 0o644))
+	target := filepath.Join(dir, "dst", "build.log.gz")
+	require.NoError(t, os.MkdirAll(filepath.Dir(target), 0o777))
+	require.NoError(t, compressArtifact(ArtifactCompressionGzip, src, target))
+
+	// Artifacts are left compressed unless they're asked to be decompressed
+	d := NewArtifactDownloader(logger.Discard, nil, ArtifactDownloaderConfig{})
+	require.NoError(t, d.decompress(target))
+	assert.FileExists(t, target)
+
+	d = NewArtifactDownloader(logger.Discard, nil, ArtifactDownloaderConfig{Decompress: true})
+	require.NoError(t, d.decompress(target))
+	assert.NoFileExists(t, target)
+
+	data, err := os.ReadFile(filepath.Join(dir, "dst", "build.log"))
+	require.NoError(t, err)
+	assert.Equal(t, "build\n", string(data))
+}
+
+func TestExtractTarRejectsEntriesOutsideIt(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "ok.txt", Typeflag: tar.TypeReg, Mode: 0o644}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0o644}))
+	require.NoError(t, tw.Close())
+
+	dir := t.TempDir()
+	assert.Error(t, extractTar(&buf, filepath.Join(dir, "dst"), false))
+	assert.FileExists(t, filepath.Join(dir, "dst", "ok.txt"))
+	assert.NoFileExists(t, filepath.Join(dir, "evil"))
+}
@@ -0,0 +1,465 @@
+package agent
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/glob"
+	"github.com/buildkite/agent/v3/internal/pool"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// How many times an artifact is downloaded before giving up on it not having
+// the digest it was uploaded with
+const artifactDownloadVerifyAttempts = 3
+
+type ArtifactDownloaderConfig struct {
+	// The ID of the Build
+	BuildID string
+
+	// The query used to find the artifacts
+	Query string
+
+	// Which step should we look at for the jobs
+	Step string
+
+	// Whether to include artifacts from retried jobs in the search
+	IncludeRetriedJobs bool
+
+	// Where we'll be downloading artifacts to
+	Destination string
+
+	// A content store to link artifacts out of when they're already on the
+	// host, and into once they're downloaded, or empty to always download
+	ContentStorePath string
+
+	// Whether to decompress artifacts that were compressed when they were
+	// uploaded, which are found by their .gz and .zst extensions
+	Decompress bool
+
+	// Whether to stream tar archives, .tar, .tar.gz, .tgz, .tar.zst and
+	// .tzst, into the directory they'd be downloaded to, unpacking them as
+	// they're downloaded instead of writing them to disk first
+	Extract bool
+
+	// Whether to show HTTP debugging
+	DebugHTTP bool
+}
+
+type ArtifactDownloader struct {
+	// The config for downloading
+	conf ArtifactDownloaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+
+	// The APIClient that will be used when uploading jobs
+	apiClient APIClient
+}
+
+func NewArtifactDownloader(l logger.Logger, ac APIClient, c ArtifactDownloaderConfig) ArtifactDownloader {
+	return ArtifactDownloader{
+		logger:    l,
+		apiClient: ac,
+		conf:      c,
+	}
+}
+
+func (a *ArtifactDownloader) Download(ctx context.Context) error {
+	// Turn the download destination into an absolute path and confirm it exists
+	downloadDestination, _ := filepath.Abs(a.conf.Destination)
+	fileInfo, err := os.Stat(downloadDestination)
+	if err != nil {
+		return fmt.Errorf("Could not find information about destination: %s %v",
+			downloadDestination, err)
+	}
+	if !fileInfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", downloadDestination)
+	}
+
+	artifacts, err := a.search(ctx)
+	if err != nil {
+		return err
+	}
+
+	artifactCount := len(artifacts)
+
+	if artifactCount == 0 {
+		return errors.New("No artifacts found for downloading")
+	}
+
+	a.logger.Info("Found %d artifacts. Starting to download to: %s", artifactCount, downloadDestination)
+
+	p := pool.New(pool.MaxConcurrencyLimit)
+	errors := []error{}
+	s3Clients, err := a.generateS3Clients(artifacts)
+	if err != nil {
+		return fmt.Errorf("failed to generate S3 clients for artifact upload: %w", err)
+	}
+
+	var store *ContentStore
+	if a.conf.ContentStorePath != "" {
+		if store, err = NewContentStore(a.conf.ContentStorePath); err != nil {
+			a.logger.Warn("Downloading artifacts without the content store %s: %v", a.conf.ContentStorePath, err)
+		}
+	}
+
+	for _, artifact := range artifacts {
+		// Create new instance of the artifact for the goroutine
+		// See: http://golang.org/doc/effective_go.html#channels
+		artifact := artifact
+
+		p.Spawn(func() {
+			// Convert windows paths to slashes, otherwise we get a literal
+			// download of "dir/dir/file" vs sub-directories on non-windows agents
+			path := artifact.Path
+			if runtime.GOOS != "windows" {
+				path = strings.Replace(path, `\`, `/`, -1)
+			}
+
+			// Archives being extracted are streamed into the directory
+			// they'd have been downloaded to, without being written to
+			// disk whole, so they're not in the content store
+			targetFile := getTargetPath(path, downloadDestination)
+			var stream func(io.Reader) error
+			compression, extract := "", false
+			if a.conf.Extract {
+				compression, extract = artifactArchiveCompression(path)
+			}
+			if extract {
+				stream = a.extractStream(artifact, compression, filepath.Dir(targetFile))
+			}
+
+			// A file that was linked out of the content store is replaced
+			// rather than written through, which would change the store's
+			if store != nil && !extract {
+				if a.restoreArtifact(store, artifact, targetFile) {
+					if err := a.decompress(targetFile); err != nil {
+						a.logger.Error("Failed to download artifact: %s", err)
+
+						p.Lock()
+						errors = append(errors, err)
+						p.Unlock()
+					}
+					return
+				}
+				_ = os.Remove(targetFile)
+			}
+
+			// Handle downloading from S3, GS, RT, or Azure Blob Storage
+			var dler artifactDownload
+			switch {
+			case strings.HasPrefix(artifact.UploadDestination, "s3://"):
+				bucketName, _ := ParseS3Destination(artifact.UploadDestination)
+				dler = NewS3Downloader(a.logger, S3DownloaderConfig{
+					S3Client:    s3Clients[bucketName],
+					Path:        path,
+					S3Path:      artifact.UploadDestination,
+					Destination: downloadDestination,
+					Retries:     5,
+					DebugHTTP:   a.conf.DebugHTTP,
+					Stream:      stream,
+				})
+			case strings.HasPrefix(artifact.UploadDestination, "gs://"):
+				dler = NewGSDownloader(a.logger, GSDownloaderConfig{
+					Path:        path,
+					Bucket:      artifact.UploadDestination,
+					Destination: downloadDestination,
+					Retries:     5,
+					DebugHTTP:   a.conf.DebugHTTP,
+					Stream:      stream,
+				})
+			case strings.HasPrefix(artifact.UploadDestination, "rt://"):
+				dler = NewArtifactoryDownloader(a.logger, ArtifactoryDownloaderConfig{
+					Path:        path,
+					Repository:  artifact.UploadDestination,
+					Destination: downloadDestination,
+					Retries:     5,
+					DebugHTTP:   a.conf.DebugHTTP,
+					Stream:      stream,
+				})
+			case strings.HasPrefix(artifact.UploadDestination, "azblob://"):
+				dler = NewAzureBlobDownloader(a.logger, AzureBlobDownloaderConfig{
+					Path:        path,
+					Container:   artifact.UploadDestination,
+					Destination: downloadDestination,
+					Retries:     5,
+					DebugHTTP:   a.conf.DebugHTTP,
+					Stream:      stream,
+				})
+			default:
+				dler = NewDownload(a.logger, http.DefaultClient, DownloadConfig{
+					URL:         artifact.URL,
+					Path:        path,
+					Destination: downloadDestination,
+					Retries:     5,
+					DebugHTTP:   a.conf.DebugHTTP,
+					Stream:      stream,
+				})
+			}
+
+			// If the downloaded encountered an error, lock
+			// the pool, collect it, then unlock the pool
+			// again.
+			var err error
+			if extract {
+				err = dler.Start(ctx)
+			} else {
+				err = a.download(ctx, dler, artifact, targetFile)
+			}
+			if err != nil {
+				a.logger.Error("Failed to download artifact: %s", err)
+
+				p.Lock()
+				errors = append(errors, err)
+				p.Unlock()
+				return
+			}
+			if extract {
+				return
+			}
+
+			if store != nil {
+				a.storeArtifact(store, artifact, targetFile)
+			}
+
+			if err := a.decompress(targetFile); err != nil {
+				a.logger.Error("Failed to download artifact: %s", err)
+
+				p.Lock()
+				errors = append(errors, err)
+				p.Unlock()
+			}
+		})
+	}
+
+	p.Wait()
+
+	if len(errors) > 0 {
+		return fmt.Errorf("There were errors with downloading some of the artifacts")
+	}
+
+	return nil
+}
+
+// decompress replaces an artifact that was compressed when it was uploaded
+// with what it was compressed from, if the downloader's decompressing
+func (a *ArtifactDownloader) decompress(targetFile string) error {
+	if !a.conf.Decompress {
+		return nil
+	}
+	path, compression, dir := decompressedArtifactPath(targetFile)
+	if compression == "" {
+		return nil
+	}
+
+	if err := decompressArtifact(compression, targetFile, path, dir); err != nil {
+		return fmt.Errorf("Error decompressing %q: %w", targetFile, err)
+	}
+	a.logger.Debug("Decompressed %s to %s", targetFile, path)
+	return os.Remove(targetFile)
+}
+
+// search finds the artifacts that match the query. Its patterns are
+// separated by ArtifactPathDelimiter, and those starting with ! exclude the
+// artifacts the others match, the same as they do for uploads. Buildkite is
+// searched for each of the other patterns' brace expansions, and what it
+// finds is matched against the patterns again, so they mean the same thing
+// to both.
+func (a *ArtifactDownloader) search(ctx context.Context) ([]*api.Artifact, error) {
+	searcher := NewArtifactSearcher(a.logger, a.apiClient, a.conf.BuildID)
+
+	patterns, err := glob.NewSet(strings.Split(a.conf.Query, ArtifactPathDelimiter))
+	if err != nil {
+		return nil, err
+	}
+	if patterns.Empty() {
+		return searcher.Search(ctx, a.conf.Query, a.conf.Step, a.conf.IncludeRetriedJobs, false)
+	}
+
+	var artifacts []*api.Artifact
+	seen := make(map[string]bool)
+
+	for _, pattern := range patterns.Include() {
+		queries := pattern.Expansions()
+		if len(queries) == 1 {
+			queries = []string{pattern.String()}
+		}
+
+		for _, query := range queries {
+			found, err := searcher.Search(ctx, query, a.conf.Step, a.conf.IncludeRetriedJobs, false)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, artifact := range found {
+				// Artifacts uploaded from Windows can have \ in their paths
+				if seen[artifact.ID] || !patterns.Match(strings.ReplaceAll(artifact.Path, `\`, "/")) {
+					continue
+				}
+				seen[artifact.ID] = true
+				artifacts = append(artifacts, artifact)
+			}
+		}
+	}
+	return artifacts, nil
+}
+
+// We want to have as few S3 clients as possible, as creating them is kind of an expensive operation
+// But it's also theoretically possible that we'll have multiple artifacts with different S3 buckets, and each
+// S3Client only applies to one bucket, so we need to store the S3 clients in a map, one for each bucket
+func (a *ArtifactDownloader) generateS3Clients(artifacts []*api.Artifact) (map[string]*s3.S3, error) {
+	s3Clients := map[string]*s3.S3{}
+
+	for _, artifact := range artifacts {
+		if !strings.HasPrefix(artifact.UploadDestination, "s3://") {
+			continue
+		}
+
+		bucketName, _ := ParseS3Destination(artifact.UploadDestination)
+		if _, has := s3Clients[bucketName]; !has {
+			client, err := NewS3Client(a.logger, bucketName)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create S3 client for bucket %s: %w", bucketName, err)
+			}
+
+			s3Clients[bucketName] = client
+		}
+	}
+
+	return s3Clients, nil
+}
+
+// artifactDigest returns the strongest digest the artifact has
+func artifactDigest(artifact *api.Artifact) (algorithm, digest string) {
+	if artifact.Sha256Sum != "" {
+		return "sha256", artifact.Sha256Sum
+	}
+	return "sha1", artifact.Sha1Sum
+}
+
+// extractStream returns a func that unpacks an archive artifact into dir as
+// it's downloaded, checking it has the digest it was uploaded with. An
+// archive that doesn't is an error, so it's downloaded again.
+func (a *ArtifactDownloader) extractStream(artifact *api.Artifact, compression, dir string) func(io.Reader) error {
+	return func(r io.Reader) error {
+		algorithm, digest := artifactDigest(artifact)
+		h, err := newContentHash(algorithm)
+		if err != nil {
+			return err
+		}
+		r = io.TeeReader(r, h)
+
+		if compression != "" {
+			dr, err := newDecompressor(compression, r)
+			if err != nil {
+				return err
+			}
+			defer dr.Close()
+			r = dr
+		}
+
+		if err := os.MkdirAll(dir, 0o777); err != nil {
+			return err
+		}
+		if err := extractTar(r, dir, false); err != nil {
+			return fmt.Errorf("Error extracting %q: %w", artifact.Path, err)
+		}
+
+		// The archive's padded out past its last entry, and the digest is
+		// of all of it
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return err
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); digest != "" && got != digest {
+			return fmt.Errorf("downloaded %q has the %s digest %s, not the %s it was uploaded with", artifact.Path, algorithm, got, digest)
+		}
+
+		a.logger.Info("Extracted %s into %s", artifact.Path, dir)
+		return nil
+	}
+}
+
+// artifactDownload is a download of an artifact from where it was uploaded
+type artifactDownload interface {
+	Start(context.Context) error
+}
+
+// download downloads an artifact to targetFile, and downloads it again if it
+// was corrupted on the way. If it's never right, it's removed.
+func (a *ArtifactDownloader) download(ctx context.Context, dler artifactDownload, artifact *api.Artifact, targetFile string) error {
+	for attempt := 1; ; attempt++ {
+		if err := dler.Start(ctx); err != nil {
+			return err
+		}
+
+		err := verifyArtifact(artifact, targetFile)
+		if err == nil {
+			return nil
+		}
+		if attempt == artifactDownloadVerifyAttempts {
+			_ = os.Remove(targetFile)
+			return err
+		}
+		a.logger.Warn("%s, downloading it again", err)
+	}
+}
+
+// verifyArtifact checks a downloaded artifact has the digest it was uploaded
+// with. Artifacts that were uploaded without one can't be checked.
+func verifyArtifact(artifact *api.Artifact, path string) error {
+	algorithm, digest := artifactDigest(artifact)
+	if digest == "" {
+		return nil
+	}
+
+	got, err := fileDigest(algorithm, path)
+	if err != nil {
+		return err
+	}
+	if got != digest {
+		return fmt.Errorf("downloaded %q has the %s digest %s, not the %s it was uploaded with", artifact.Path, algorithm, got, digest)
+	}
+	return nil
+}
+
+// restoreArtifact links the artifact to targetFile from the content store,
+// returning whether it was there to be
+func (a *ArtifactDownloader) restoreArtifact(store *ContentStore, artifact *api.Artifact, targetFile string) bool {
+	algorithm, digest := artifactDigest(artifact)
+	if digest == "" {
+		return false
+	}
+
+	method, ok, err := store.Restore(algorithm, digest, artifact.FileSize, targetFile)
+	if err != nil {
+		a.logger.Warn("Failed to restore %s from the content store: %v", artifact.Path, err)
+		return false
+	}
+	if ok {
+		a.logger.Info("Restored \"%s\" from the content store with a %s", artifact.Path, method)
+	}
+	return ok
+}
+
+// storeArtifact adds a downloaded artifact to the content store, so the next
+// download of it doesn't need to
+func (a *ArtifactDownloader) storeArtifact(store *ContentStore, artifact *api.Artifact, targetFile string) {
+	algorithm, digest := artifactDigest(artifact)
+	if digest == "" {
+		return
+	}
+	if err := store.Add(algorithm, digest, targetFile); err != nil {
+		a.logger.Warn("Failed to add %s to the content store: %v", artifact.Path, err)
+	}
+}
@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactDownloaderConnectsToEndpoint(t *testing.T) {
+	defer os.Remove("llamas.txt")
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"absolute_path": "llamas.txt",
+				"path": "llamas.txt",
+				"url": "http://%s/download"
+			}]`, req.Host)
+		case "/download":
+			fmt.Fprintln(rw, "OK")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID: "my-build",
+	})
+
+	if err := d.Download(ctx); err != nil {
+		t.Errorf("d.Download() = %v", err)
+	}
+}
+
+func TestArtifactDownloaderVerifiesDownloads(t *testing.T) {
+	t.Parallel()
+
+	// The SHA-256 of "llamas\n"
+	const sha256sum = "b36293fc54a3dc9e1582b8fa065aacd3b71e0622777b3a25be508671db5d47cd"
+
+	for _, tc := range []struct {
+		name      string
+		corrupted int
+		wantErr   bool
+	}{
+		{name: "intact"},
+		{name: "corrupted once", corrupted: 1},
+		{name: "always corrupted", corrupted: artifactDownloadVerifyAttempts, wantErr: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			downloads := 0
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				switch req.URL.RequestURI() {
+				case "/builds/my-build/artifacts/search?state=finished":
+					fmt.Fprintf(rw, `[{"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32", "file_size": 7, "path": "llamas.txt", "sha256sum": %q, "url": "http://%s/download"}]`, sha256sum, req.Host)
+				case "/download":
+					downloads++
+					if downloads <= tc.corrupted {
+						fmt.Fprintln(rw, "alpaca")
+						return
+					}
+					fmt.Fprintln(rw, "llamas")
+				default:
+					http.Error(rw, "Not found", http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			ac := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamasforever"})
+			d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+				BuildID:     "my-build",
+				Destination: dir,
+			})
+			err := d.Download(context.Background())
+
+			if tc.wantErr {
+				assert.Error(t, err)
+				assert.Equal(t, artifactDownloadVerifyAttempts, downloads)
+				assert.NoFileExists(t, filepath.Join(dir, "llamas.txt"))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.corrupted+1, downloads)
+			got, err := os.ReadFile(filepath.Join(dir, "llamas.txt"))
+			require.NoError(t, err)
+			assert.Equal(t, "llamas\n", string(got))
+		})
+	}
+}
+
+func TestArtifactDownloaderExtractsArchives(t *testing.T) {
+	t.Parallel()
+
+	var archive bytes.Buffer
+	gw := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gw)
+	for _, f := range []struct{ name, body string }{
+		{"node_modules/", ""},
+		{"node_modules/left-pad/index.js", "module.exports = leftPad\n"},
+	} {
+		header := &tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.body)), Typeflag: tar.TypeReg}
+		if f.body == "" {
+			header.Typeflag, header.Mode = tar.TypeDir, 0o755
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		_, err := tw.Write([]byte(f.body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	sum := sha256.Sum256(archive.Bytes())
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprintf(rw, `[{"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32", "file_size": %d, "path": "cache/deps.tar.gz", "sha256sum": "%x", "url": "http://%s/download"}]`, archive.Len(), sum, req.Host)
+		case "/download":
+			rw.Write(archive.Bytes())
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	ac := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamasforever"})
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: dir,
+		Extract:     true,
+	})
+	require.NoError(t, d.Download(context.Background()))
+
+	// It's unpacked where it would have been downloaded, and isn't there
+	// itself
+	got, err := os.ReadFile(filepath.Join(dir, "cache", "node_modules", "left-pad", "index.js"))
+	require.NoError(t, err)
+	assert.Equal(t, "module.exports = leftPad\n", string(got))
+	assert.NoFileExists(t, filepath.Join(dir, "cache", "deps.tar.gz"))
+}
+
+func TestArtifactDownloaderSearchesEachPattern(t *testing.T) {
+	t.Parallel()
+
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query().Get("query")
+		queries = append(queries, query)
+
+		// Buildkite's own matching is looser than the agent's
+		switch query {
+		case "dist/*.js":
+			fmt.Fprint(rw, `[{"id": "1", "path": "dist/app.js"}, {"id": "2", "path": "dist/vendor.min.js"}, {"id": "3", "path": "dist/sub/other.js"}]`)
+		case "dist/*.css":
+			fmt.Fprint(rw, `[{"id": "4", "path": "dist\\app.css"}, {"id": "1", "path": "dist/app.js"}]`)
+		default:
+			fmt.Fprint(rw, `[]`)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamasforever"})
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID: "my-build",
+		Query:   "dist/*.{js,css}; !**/*.min.js",
+	})
+
+	artifacts, err := d.search(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dist/*.js", "dist/*.css"}, queries)
+
+	paths := []string{}
+	for _, a := range artifacts {
+		paths = append(paths, a.Path)
+	}
+	assert.Equal(t, []string{"dist/app.js", `dist\app.css`}, paths)
+}
@@ -15,12 +15,12 @@ import (
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
-	"github.com/buildkite/agent/v3/experiments"
+	"github.com/buildkite/agent/v3/internal/experiments"
+	"github.com/buildkite/agent/v3/internal/glob"
+	"github.com/buildkite/agent/v3/internal/mime"
+	"github.com/buildkite/agent/v3/internal/pool"
 	"github.com/buildkite/agent/v3/logger"
-	"github.com/buildkite/agent/v3/mime"
-	"github.com/buildkite/agent/v3/pool"
 	"github.com/buildkite/roko"
-	zglob "github.com/mattn/go-zglob"
 )
 
 const (
@@ -46,6 +46,15 @@ type ArtifactUploaderConfig struct {
 
 	// Whether to follow symbolic links when resolving globs
 	FollowSymlinks bool
+
+	// The size in bytes of the parts large artifacts are uploaded in, and
+	// how many are uploaded at once, by uploaders that can
+	PartSize        int64
+	PartConcurrency int
+
+	// How to compress artifacts before they're uploaded, one of the
+	// ArtifactCompression* names, or empty to upload them as they are
+	Compression string
 }
 
 type ArtifactUploader struct {
@@ -57,6 +66,9 @@ type ArtifactUploader struct {
 
 	// The APIClient that will be used when uploading jobs
 	apiClient APIClient
+
+	// Where compressed artifacts are written before they're uploaded
+	compressedDir string
 }
 
 func NewArtifactUploader(l logger.Logger, ac APIClient, c ArtifactUploaderConfig) *ArtifactUploader {
@@ -70,6 +82,7 @@ func NewArtifactUploader(l logger.Logger, ac APIClient, c ArtifactUploaderConfig
 func (a *ArtifactUploader) Upload(ctx context.Context) error {
 	// Create artifact structs for all the files we need to upload
 	artifacts, err := a.Collect()
+	defer a.removeCompressed()
 	if err != nil {
 		return err
 	}
@@ -104,23 +117,20 @@ func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
 	// file paths are deduplicated after resolving globs etc
 	seenPaths := make(map[string]bool)
 
-	for _, globPath := range strings.Split(a.conf.Paths, ArtifactPathDelimiter) {
-		globPath = strings.TrimSpace(globPath)
-		if globPath == "" {
-			continue
-		}
+	// Paths starting with ! exclude the files the others match
+	patterns, err := glob.NewSet(strings.Split(a.conf.Paths, ArtifactPathDelimiter))
+	if err != nil {
+		return nil, err
+	}
 
+	for _, pattern := range patterns.Include() {
+		globPath := pattern.String()
 		a.logger.Debug("Searching for %s", globPath)
 
-		// Resolve the globs (with * and ** in them), if it's a non-globbed path and doesn't exists
+		// Resolve the globs (with *, ** and {} in them), if it's a non-globbed path and doesn't exists
 		// then we will get the ErrNotExist that is handled below
-		globfunc := zglob.Glob
-		if a.conf.FollowSymlinks {
-			// Follow symbolic links for files & directories while expanding globs
-			globfunc = zglob.GlobFollowSymlinks
-		}
-		files, err := globfunc(globPath)
-		if err == os.ErrNotExist {
+		files, err := pattern.Glob(a.conf.FollowSymlinks)
+		if errors.Is(err, os.ErrNotExist) {
 			a.logger.Info("File not found: %s", globPath)
 			continue
 		} else if err != nil {
@@ -141,8 +151,10 @@ func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
 			}
 			seenPaths[absolutePath] = true
 
-			// Ignore directories, we only want files
-			if isDir(absolutePath) {
+			// Ignore directories, we only want files, unless they're being
+			// compressed and were asked for by name, when they're archived
+			dir := isDir(absolutePath)
+			if dir && (a.conf.Compression == "" || !pattern.Literal(file)) {
 				a.logger.Debug("Skipping directory %s", file)
 				continue
 			}
@@ -165,13 +177,23 @@ func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
 				return nil, err
 			}
 
+			if patterns.Excluded(file) || patterns.Excluded(path) {
+				a.logger.Debug("Skipping excluded path %s", file)
+				continue
+			}
+
 			if experiments.IsEnabled("normalised-upload-paths") {
 				// Convert any Windows paths to Unix/URI form
 				path = filepath.ToSlash(path)
 			}
 
 			// Build an artifact object using the paths we have.
-			artifact, err := a.build(path, absolutePath, globPath)
+			var artifact *api.Artifact
+			if a.conf.Compression != "" {
+				artifact, err = a.buildCompressed(path, absolutePath, globPath, dir)
+			} else {
+				artifact, err = a.build(path, absolutePath, globPath)
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -215,8 +237,11 @@ func (a *ArtifactUploader) build(path string, absolutePath string, globPath stri
 		}
 	}
 
-	// Create our new artifact data structure
+	// Create our new artifact data structure. Its ID comes from what it is,
+	// so if it's uploaded again after a failure Buildkite can tell it's the
+	// same artifact rather than making another one
 	artifact := &api.Artifact{
+		ID:           api.NewNamedUUID(strings.Join([]string{a.conf.JobID, path, sha256sum}, "/")),
 		Path:         path,
 		AbsolutePath: absolutePath,
 		GlobPath:     globPath,
@@ -229,6 +254,49 @@ func (a *ArtifactUploader) build(path string, absolutePath string, globPath stri
 	return artifact, nil
 }
 
+// buildCompressed compresses a file, or archives and compresses a directory,
+// and builds an artifact for what it was compressed to. The compression's
+// extension is added to the artifact's path.
+func (a *ArtifactUploader) buildCompressed(path string, absolutePath string, globPath string, dir bool) (*api.Artifact, error) {
+	if a.compressedDir == "" {
+		tmp, err := os.MkdirTemp("", "buildkite-artifacts")
+		if err != nil {
+			return nil, err
+		}
+		a.compressedDir = tmp
+	}
+
+	path = compressedArtifactPath(path, a.conf.Compression, dir)
+	compressedPath, err := os.MkdirTemp(a.compressedDir, "")
+	if err != nil {
+		return nil, err
+	}
+	compressedPath = filepath.Join(compressedPath, filepath.Base(path))
+
+	if err := compressArtifact(a.conf.Compression, absolutePath, compressedPath); err != nil {
+		return nil, fmt.Errorf("Error compressing %q: %w", absolutePath, err)
+	}
+
+	artifact, err := a.build(path, compressedPath, globPath)
+	if err != nil {
+		return nil, err
+	}
+	a.logger.Debug("Compressed %s to %s (%d bytes)", absolutePath, path, artifact.FileSize)
+	return artifact, nil
+}
+
+// removeCompressed removes the compressed artifacts once they've been
+// uploaded
+func (a *ArtifactUploader) removeCompressed() {
+	if a.compressedDir == "" {
+		return
+	}
+	if err := os.RemoveAll(a.compressedDir); err != nil {
+		a.logger.Warn("Couldn't remove compressed artifacts from %s: %v", a.compressedDir, err)
+	}
+	a.compressedDir = ""
+}
+
 func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact) error {
 	var uploader Uploader
 	var err error
@@ -237,8 +305,10 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 	if a.conf.Destination != "" {
 		if strings.HasPrefix(a.conf.Destination, "s3://") {
 			uploader, err = NewS3Uploader(a.logger, S3UploaderConfig{
-				Destination: a.conf.Destination,
-				DebugHTTP:   a.conf.DebugHTTP,
+				Destination:     a.conf.Destination,
+				DebugHTTP:       a.conf.DebugHTTP,
+				PartSize:        a.conf.PartSize,
+				PartConcurrency: a.conf.PartConcurrency,
 			})
 		} else if strings.HasPrefix(a.conf.Destination, "gs://") {
 			uploader, err = NewGSUploader(a.logger, GSUploaderConfig{
@@ -250,8 +320,15 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 				Destination: a.conf.Destination,
 				DebugHTTP:   a.conf.DebugHTTP,
 			})
+		} else if strings.HasPrefix(a.conf.Destination, "azblob://") {
+			uploader, err = NewAzureBlobUploader(a.logger, AzureBlobUploaderConfig{
+				Destination:     a.conf.Destination,
+				DebugHTTP:       a.conf.DebugHTTP,
+				PartSize:        a.conf.PartSize,
+				PartConcurrency: a.conf.PartConcurrency,
+			})
 		} else {
-			return errors.New(fmt.Sprintf("Invalid upload destination: '%v'. Only s3://, gs:// or rt:// upload destinations are allowed. Did you forget to surround your artifact upload pattern in double quotes?", a.conf.Destination))
+			return errors.New(fmt.Sprintf("Invalid upload destination: '%v'. Only s3://, gs://, rt:// or azblob:// upload destinations are allowed. Did you forget to surround your artifact upload pattern in double quotes?", a.conf.Destination))
 		}
 
 		a.logger.Info("Uploading to %q, using your agent configuration", a.conf.Destination)
@@ -385,6 +462,12 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 			if err != nil {
 				a.logger.Error("Error uploading artifact \"%s\": %s", artifact.Path, err)
 
+				// It won't be retried again, so the parts that were
+				// uploaded aren't needed
+				if r, ok := uploader.(ResumableUploader); ok {
+					r.Abandon(artifact)
+				}
+
 				// Track the error that was raised. We need to
 				// acquire a lock since we mutate the errors
 				// slice in multiple routines.
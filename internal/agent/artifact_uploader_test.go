@@ -1,16 +1,20 @@
 package agent
 
 import (
+	"context"
 	"fmt"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/buildkite/agent/v3/api"
-	"github.com/buildkite/agent/v3/experiments"
+	"github.com/buildkite/agent/v3/internal/experiments"
+	"github.com/buildkite/agent/v3/internal/fakeapi"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func findArtifact(artifacts []*api.Artifact, search string) *api.Artifact {
@@ -27,7 +31,7 @@ func TestCollect(t *testing.T) {
 	// t.Parallel() cannot be used with experiments.Enable
 
 	wd, _ := os.Getwd()
-	root := filepath.Join(wd, "..")
+	root := filepath.Join(wd, "..", "..")
 	os.Chdir(root)
 	defer os.Chdir(wd)
 
@@ -168,7 +172,7 @@ func TestCollect(t *testing.T) {
 
 func TestCollectThatDoesntMatchAnyFiles(t *testing.T) {
 	wd, _ := os.Getwd()
-	root := filepath.Join(wd, "..")
+	root := filepath.Join(wd, "..", "..")
 	os.Chdir(root)
 	defer os.Chdir(wd)
 
@@ -191,7 +195,7 @@ func TestCollectThatDoesntMatchAnyFiles(t *testing.T) {
 
 func TestCollectWithSomeGlobsThatDontMatchAnything(t *testing.T) {
 	wd, _ := os.Getwd()
-	root := filepath.Join(wd, "..")
+	root := filepath.Join(wd, "..", "..")
 	os.Chdir(root)
 	defer os.Chdir(wd)
 
@@ -215,7 +219,7 @@ func TestCollectWithSomeGlobsThatDontMatchAnything(t *testing.T) {
 
 func TestCollectWithSomeGlobsThatDontMatchAnythingFollowingSymlinks(t *testing.T) {
 	wd, _ := os.Getwd()
-	root := filepath.Join(wd, "..")
+	root := filepath.Join(wd, "..", "..")
 	os.Chdir(root)
 	defer os.Chdir(wd)
 
@@ -241,7 +245,7 @@ func TestCollectWithSomeGlobsThatDontMatchAnythingFollowingSymlinks(t *testing.T
 
 func TestCollectWithDuplicateMatches(t *testing.T) {
 	wd, _ := os.Getwd()
-	root := filepath.Join(wd, "..")
+	root := filepath.Join(wd, "..", "..")
 	os.Chdir(root)
 	defer os.Chdir(wd)
 
@@ -275,7 +279,7 @@ func TestCollectWithDuplicateMatches(t *testing.T) {
 
 func TestCollectWithDuplicateMatchesFollowingSymlinks(t *testing.T) {
 	wd, _ := os.Getwd()
-	root := filepath.Join(wd, "..")
+	root := filepath.Join(wd, "..", "..")
 	os.Chdir(root)
 	defer os.Chdir(wd)
 
@@ -308,3 +312,66 @@ func TestCollectWithDuplicateMatchesFollowingSymlinks(t *testing.T) {
 		paths,
 	)
 }
+
+func TestCollectWithBracesAndExclusions(t *testing.T) {
+	wd, _ := os.Getwd()
+	root := filepath.Join(wd, "..", "..")
+	os.Chdir(root)
+	defer os.Chdir(wd)
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths: strings.Join([]string{
+			filepath.Join("test", "fixtures", "artifacts", "**", "*.{jpg,gif}"),
+			"!" + filepath.Join("test", "fixtures", "artifacts", "folder", "**"),
+			"!**/Smile.gif",
+		}, ";"),
+	})
+
+	artifacts, err := uploader.Collect()
+	require.NoError(t, err)
+
+	paths := []string{}
+	for _, a := range artifacts {
+		paths = append(paths, a.Path)
+	}
+	assert.ElementsMatch(
+		t,
+		[]string{
+			filepath.Join("test", "fixtures", "artifacts", "Mr Freeze.jpg"),
+			filepath.Join("test", "fixtures", "artifacts", "this is a folder with a space", "The Terminator.jpg"),
+			filepath.Join("test", "fixtures", "artifacts", "links", "terminator", "terminator2.jpg"),
+		},
+		paths,
+	)
+}
+
+func TestUploadingAgainDoesntDuplicateArtifacts(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	server := fakeapi.NewServer(logger.Discard, fakeapi.Config{})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	jobID := server.AddJob(nil)
+	reg, _, err := api.NewClient(logger.Discard, api.Config{Endpoint: ts.URL, Token: "llamas"}).
+		Register(ctx, &api.AgentRegisterRequest{Name: "agent-1"})
+	require.NoError(t, err)
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: ts.URL, Token: reg.AccessToken})
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "out.txt"), []byte("some output"), 0600))
+
+	for i := 0; i < 2; i++ {
+		uploader := NewArtifactUploader(logger.Discard, client, ArtifactUploaderConfig{
+			JobID: jobID,
+			Paths: filepath.Join(dir, "*.txt"),
+		})
+		require.NoError(t, uploader.Upload(ctx))
+	}
+
+	artifacts := server.Artifacts()
+	require.Len(t, artifacts, 1)
+	assert.Equal(t, "finished", artifacts[0].State)
+	assert.Equal(t, []byte("some output"), artifacts[0].Contents)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path"
@@ -30,6 +31,10 @@ type ArtifactoryDownloaderConfig struct {
 
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// If set, the downloaded file is streamed to this instead of being
+	// written to Path
+	Stream func(io.Reader) error
 }
 
 type ArtifactoryDownloader struct {
@@ -76,6 +81,7 @@ func (d ArtifactoryDownloader) Start(ctx context.Context) error {
 		Retries:     d.conf.Retries,
 		Headers:     headers,
 		DebugHTTP:   d.conf.DebugHTTP,
+		Stream:      d.conf.Stream,
 	}).Start(ctx)
 }
 
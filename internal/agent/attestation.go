@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/buildkite/agent/v3/api"
+)
+
+// The kinds of evidence an agent can attest to its host with
+const (
+	AttestationAWS = "aws"
+	AttestationGCP = "gcp"
+	AttestationTPM = "tpm"
+)
+
+// The PCRs a TPM quote covers, which measure the firmware and boot loader
+const attestationPCRs = "sha256:0,1,2,3,4,5,6,7"
+
+// AttestationConfig is what an agent attests to its host with
+type AttestationConfig struct {
+	// aws, gcp or tpm
+	Type string
+
+	// The audience of a GCP identity token, which should be the API endpoint
+	Audience string
+
+	// The context of the TPM attestation key to sign quotes with
+	TPMKey string
+}
+
+// Attest gathers signed evidence of the host the agent is running on, to be
+// sent when it registers
+func Attest(ctx context.Context, conf AttestationConfig) (*api.AgentAttestation, error) {
+	switch conf.Type {
+	case AttestationAWS:
+		return attestAWS(ctx)
+	case AttestationGCP:
+		return attestGCP(conf.Audience)
+	case AttestationTPM:
+		return attestTPM(ctx, conf.TPMKey)
+	default:
+		return nil, fmt.Errorf("Unknown attestation %q, expected aws, gcp or tpm", conf.Type)
+	}
+}
+
+// attestAWS gets the EC2 instance identity document, which is signed by AWS
+func attestAWS(ctx context.Context) (*api.AgentAttestation, error) {
+	c, err := newAWSClient()
+	if err != nil {
+		return nil, err
+	}
+
+	document, err := c.GetDynamicDataWithContext(ctx, "instance-identity/document")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the instance identity document: %w", err)
+	}
+	signature, err := c.GetDynamicDataWithContext(ctx, "instance-identity/pkcs7")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the instance identity document's signature: %w", err)
+	}
+
+	return &api.AgentAttestation{Type: AttestationAWS, Document: document, Signature: signature}, nil
+}
+
+// attestGCP gets an identity token for the instance, signed by Google, with
+// its full details, like its project, zone and image
+func attestGCP(audience string) (*api.AgentAttestation, error) {
+	token, err := metadata.Get("instance/service-accounts/default/identity?format=full&audience=" + url.QueryEscape(audience))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get an instance identity token: %w", err)
+	}
+
+	return &api.AgentAttestation{Type: AttestationGCP, Document: token}, nil
+}
+
+// attestTPM has the host's TPM quote the PCRs measuring how it booted, over a
+// random nonce, with tpm2_quote from tpm2-tools
+func attestTPM(ctx context.Context, key string) (*api.AgentAttestation, error) {
+	if key == "" {
+		return nil, fmt.Errorf("TPM attestation needs the context of an attestation key to sign the quote with")
+	}
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "buildkite-agent-attestation")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	message, signature, pcrs := filepath.Join(dir, "quote.msg"), filepath.Join(dir, "quote.sig"), filepath.Join(dir, "quote.pcrs")
+	out, err := exec.CommandContext(ctx, "tpm2_quote",
+		"--key-context", key,
+		"--pcr-list", attestationPCRs,
+		"--qualification", hex.EncodeToString(nonce),
+		"--message", message,
+		"--signature", signature,
+		"--pcr", pcrs,
+	).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("tpm2_quote: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	attestation := &api.AgentAttestation{Type: AttestationTPM, Nonce: hex.EncodeToString(nonce)}
+	for path, field := range map[string]*string{
+		message:   &attestation.Document,
+		signature: &attestation.Signature,
+		pcrs:      &attestation.PCRs,
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the TPM quote: %w", err)
+		}
+		*field = base64.StdEncoding.EncodeToString(data)
+	}
+	return attestation, nil
+}
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttestTPM(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake tpm2_quote is a shell script")
+	}
+
+	// A fake tpm2_quote that quotes its arguments
+	dir := t.TempDir()
+	script := `#!/bin/sh
+args=""
+while [ $# -gt 0 ]; do
+  case "$1" in
+    --message) msg="$2" ;;
+    --signature) sig="$2" ;;
+    --pcr) pcrs="$2" ;;
+  esac
+  args="$args$1 $2
+"
+  shift 2
+done
+printf "%s" "$args" > "$msg"
+echo signed > "$sig"
+echo measured > "$pcrs"
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tpm2_quote"), []byte(script), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	attestation, err := Attest(context.Background(), AttestationConfig{Type: AttestationTPM, TPMKey: "/etc/ak.ctx"})
+	require.NoError(t, err)
+
+	decode := func(s string) string {
+		b, err := base64.StdEncoding.DecodeString(s)
+		require.NoError(t, err)
+		return string(b)
+	}
+	assert.Equal(t, AttestationTPM, attestation.Type)
+	assert.Len(t, attestation.Nonce, 64)
+	args := decode(attestation.Document)
+	assert.Contains(t, args, "--key-context /etc/ak.ctx\n")
+	assert.Contains(t, args, "--pcr-list "+attestationPCRs+"\n")
+	assert.Contains(t, args, "--qualification "+attestation.Nonce+"\n")
+	assert.Equal(t, "signed\n", decode(attestation.Signature))
+	assert.Equal(t, "measured\n", decode(attestation.PCRs))
+}
+
+func TestAttestTPMNeedsAKey(t *testing.T) {
+	t.Parallel()
+
+	_, err := Attest(context.Background(), AttestationConfig{Type: AttestationTPM})
+	assert.Error(t, err)
+}
+
+func TestAttestGCP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/identity" ||
+			req.URL.Query().Get("format") != "full" ||
+			req.URL.Query().Get("audience") != "https://agent.buildkite.com/v3" {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Header().Set("Metadata-Flavor", "Google")
+		rw.Write([]byte("header.payload.signature"))
+	}))
+	defer server.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(server.URL, "http://"))
+
+	attestation, err := Attest(context.Background(), AttestationConfig{Type: AttestationGCP, Audience: "https://agent.buildkite.com/v3"})
+	require.NoError(t, err)
+
+	assert.Equal(t, AttestationGCP, attestation.Type)
+	assert.Equal(t, "header.payload.signature", attestation.Document)
+}
@@ -0,0 +1,226 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	azureBlobSASTokenEnvVar = "BUILDKITE_AZURE_BLOB_SAS_TOKEN"
+	azureBlobEndpointEnvVar = "BUILDKITE_AZURE_BLOB_ENDPOINT"
+
+	// The Blob service REST API version requests are made with
+	azureBlobAPIVersion = "2021-08-06"
+
+	// What tokens from Azure AD are for
+	azureStorageResource = "https://storage.azure.com/"
+
+	// Where managed identities get their tokens on Azure VMs
+	azureIMDSTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+)
+
+// ParseAzureBlobDestination splits an azblob://account/container/path
+// destination into its storage account, container and path
+func ParseAzureBlobDestination(destination string) (account, container, path string) {
+	parts := strings.SplitN(strings.TrimPrefix(destination, "azblob://"), "/", 3)
+	account = parts[0]
+	if len(parts) > 1 {
+		container = parts[1]
+	}
+	if len(parts) > 2 {
+		path = strings.Trim(parts[2], "/")
+	}
+	return account, container, path
+}
+
+// azureBlobURL returns the URL of a blob in a storage account's container.
+// BUILDKITE_AZURE_BLOB_ENDPOINT replaces the account's endpoint, for
+// sovereign clouds and storage emulators like Azurite.
+func azureBlobURL(account, container, blob string) *url.URL {
+	u := &url.URL{Scheme: "https", Host: account + ".blob.core.windows.net"}
+	if endpoint := os.Getenv(azureBlobEndpointEnvVar); endpoint != "" {
+		if parsed, err := url.Parse(strings.TrimSuffix(endpoint, "/")); err == nil {
+			u = parsed
+		}
+	}
+	u.Path = strings.Join([]string{u.Path, container, blob}, "/")
+	return u
+}
+
+// newAzureBlobClient returns an HTTP client that authorizes its requests to
+// Azure Blob Storage. A SAS token in BUILDKITE_AZURE_BLOB_SAS_TOKEN is used
+// if there is one. Otherwise it gets tokens from Azure AD with the
+// credentials DefaultAzureCredential would find in the environment: a
+// service principal's secret, a workload identity's federated token, or the
+// VM's managed identity.
+func newAzureBlobClient() *http.Client {
+	return &http.Client{
+		Transport: &azureBlobTransport{
+			sasToken: strings.TrimPrefix(os.Getenv(azureBlobSASTokenEnvVar), "?"),
+			base:     http.DefaultTransport,
+		},
+	}
+}
+
+type azureBlobTransport struct {
+	sasToken string
+	base     http.RoundTripper
+
+	// The Azure AD token, and when it expires
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func (t *azureBlobTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers mustn't change the request they're given
+	req = req.Clone(req.Context())
+	req.Header.Set("x-ms-version", azureBlobAPIVersion)
+
+	if t.sasToken != "" {
+		if req.URL.RawQuery == "" {
+			req.URL.RawQuery = t.sasToken
+		} else {
+			req.URL.RawQuery += "&" + t.sasToken
+		}
+		return t.base.RoundTrip(req)
+	}
+
+	token, err := t.accessToken(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("getting an Azure AD token for Azure Blob Storage: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
+
+// accessToken returns an Azure AD token, getting a new one if it's close to
+// expiring
+func (t *azureBlobTransport) accessToken(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && time.Until(t.expiresAt) > 5*time.Minute {
+		return t.token, nil
+	}
+
+	token, expiresAt, err := azureADToken(ctx, &http.Client{Transport: t.base})
+	if err != nil {
+		return "", err
+	}
+	t.token, t.expiresAt = token, expiresAt
+	return token, nil
+}
+
+// azureADToken gets a token for Azure Storage with the first credentials
+// the environment has
+func azureADToken(ctx context.Context, client *http.Client) (string, time.Time, error) {
+	tenantID, clientID := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID")
+	authority := strings.TrimSuffix(os.Getenv("AZURE_AUTHORITY_HOST"), "/")
+	if authority == "" {
+		authority = "https://login.microsoftonline.com"
+	}
+
+	form := url.Values{
+		"client_id": {clientID},
+		"scope":     {azureStorageResource + ".default"},
+	}
+
+	switch {
+	case tenantID != "" && clientID != "" && os.Getenv("AZURE_CLIENT_SECRET") != "":
+		form.Set("grant_type", "client_credentials")
+		form.Set("client_secret", os.Getenv("AZURE_CLIENT_SECRET"))
+
+	case tenantID != "" && clientID != "" && os.Getenv("AZURE_FEDERATED_TOKEN_FILE") != "":
+		assertion, err := os.ReadFile(os.Getenv("AZURE_FEDERATED_TOKEN_FILE"))
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		form.Set("grant_type", "client_credentials")
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+
+	default:
+		return azureManagedIdentityToken(ctx, client, clientID)
+	}
+
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", authority, url.PathEscape(tenantID))
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doAzureTokenRequest(client, req)
+}
+
+// azureManagedIdentityToken gets a token for the VM's managed identity, or
+// the user-assigned one with the client ID
+func azureManagedIdentityToken(ctx context.Context, client *http.Client, clientID string) (string, time.Time, error) {
+	query := url.Values{
+		"api-version": {"2018-02-01"},
+		"resource":    {azureStorageResource},
+	}
+	if clientID != "" {
+		query.Set("client_id", clientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", azureIMDSTokenURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	token, expiresAt, err := doAzureTokenRequest(client, req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("no SAS token in %s or Azure AD credentials in AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET or AZURE_FEDERATED_TOKEN_FILE, and there's no managed identity (%v)", azureBlobSASTokenEnvVar, err)
+	}
+	return token, expiresAt, nil
+}
+
+func doAzureTokenRequest(client *http.Client, req *http.Request) (string, time.Time, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if res.StatusCode/100 != 2 {
+		return "", time.Time{}, fmt.Errorf("%s %s: %s", req.Method, req.URL.Host, res.Status)
+	}
+
+	// Azure AD gives how many seconds the token expires in as a number, and
+	// managed identities give it, and when it expires, as strings
+	var token struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+		ExpiresOn   json.Number `json:"expires_on"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", time.Time{}, err
+	}
+	if token.AccessToken == "" {
+		return "", time.Time{}, errors.New("the response didn't have a token")
+	}
+
+	expiresAt := time.Now().Add(time.Hour)
+	if on, err := strconv.ParseInt(token.ExpiresOn.String(), 10, 64); err == nil {
+		expiresAt = time.Unix(on, 0)
+	} else if in, err := strconv.ParseInt(token.ExpiresIn.String(), 10, 64); err == nil {
+		expiresAt = time.Now().Add(time.Duration(in) * time.Second)
+	}
+	return token.AccessToken, expiresAt, nil
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+type AzureBlobDownloaderConfig struct {
+	// The storage account, container and path the artifact was uploaded to,
+	// for example, azblob://my-account/my-container/foo/bar
+	Container string
+
+	// The root directory of the download
+	Destination string
+
+	// The relative path that should be preserved in the download folder,
+	// also its location in the container
+	Path string
+
+	// How many times should it retry the download before giving up
+	Retries int
+
+	// If failed responses should be dumped to the log
+	DebugHTTP bool
+
+	// If set, the downloaded file is streamed to this instead of being
+	// written to Path
+	Stream func(io.Reader) error
+}
+
+type AzureBlobDownloader struct {
+	// The config for the downloader
+	conf AzureBlobDownloaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+}
+
+func NewAzureBlobDownloader(l logger.Logger, c AzureBlobDownloaderConfig) *AzureBlobDownloader {
+	return &AzureBlobDownloader{
+		logger: l,
+		conf:   c,
+	}
+}
+
+func (d AzureBlobDownloader) Start(ctx context.Context) error {
+	account, container, _ := ParseAzureBlobDestination(d.conf.Container)
+
+	// We can now cheat and pass the URL onto our regular downloader, with a
+	// client that authorizes its requests
+	return NewDownload(d.logger, newAzureBlobClient(), DownloadConfig{
+		URL:         azureBlobURL(account, container, d.BlobPath()).String(),
+		Path:        d.conf.Path,
+		Destination: d.conf.Destination,
+		Retries:     d.conf.Retries,
+		DebugHTTP:   d.conf.DebugHTTP,
+		Stream:      d.conf.Stream,
+	}).Start(ctx)
+}
+
+// BlobPath returns the name of the artifact's blob in the container
+func (d AzureBlobDownloader) BlobPath() string {
+	_, _, path := ParseAzureBlobDestination(d.conf.Container)
+	if path == "" {
+		return d.conf.Path
+	}
+	return path + "/" + strings.TrimPrefix(filepath.ToSlash(d.conf.Path), "/")
+}
@@ -0,0 +1,281 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/pool"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+const (
+	azureBlobMaxBlocksPerBlob  = 50000
+	azureBlobBlockIDNumberSize = 8
+)
+
+type AzureBlobUploaderConfig struct {
+	// The destination which includes the storage account, container and
+	// path, e.g. azblob://my-account/my-container/foo/bar
+	Destination string
+
+	// Whether or not HTTP calls should be debugged
+	DebugHTTP bool
+
+	// Files larger than PartSize bytes are uploaded a block of that size at
+	// a time, PartConcurrency blocks at once. They default to
+	// DefaultUploadPartSize and DefaultUploadPartConcurrency.
+	PartSize        int64
+	PartConcurrency int
+}
+
+type AzureBlobUploader struct {
+	// The storage account, container and path set from the destination
+	Account   string
+	Container string
+	Path      string
+
+	// The client that authorizes requests to Azure Blob Storage
+	client *http.Client
+
+	// The configuration
+	conf AzureBlobUploaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+
+	// The blocks that were uploaded of blobs that failed part way through,
+	// by blob URL, so they can be resumed
+	mu     sync.Mutex
+	blocks map[string]map[int]bool
+}
+
+func NewAzureBlobUploader(l logger.Logger, c AzureBlobUploaderConfig) (*AzureBlobUploader, error) {
+	account, container, path := ParseAzureBlobDestination(c.Destination)
+	if account == "" || container == "" {
+		return nil, fmt.Errorf("Invalid Azure Blob Storage destination %q, expected azblob://account/container/path", c.Destination)
+	}
+
+	if c.PartSize <= 0 {
+		c.PartSize = DefaultUploadPartSize
+	}
+	if c.PartConcurrency <= 0 {
+		c.PartConcurrency = DefaultUploadPartConcurrency
+	}
+
+	return &AzureBlobUploader{
+		Account:   account,
+		Container: container,
+		Path:      path,
+		client:    newAzureBlobClient(),
+		conf:      c,
+		logger:    l,
+		blocks:    make(map[string]map[int]bool),
+	}, nil
+}
+
+func (u *AzureBlobUploader) URL(artifact *api.Artifact) string {
+	return azureBlobURL(u.Account, u.Container, u.artifactPath(artifact)).String()
+}
+
+func (u *AzureBlobUploader) Upload(artifact *api.Artifact) error {
+	ctx := context.Background()
+
+	// Open file from filesystem
+	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	blobURL := azureBlobURL(u.Account, u.Container, u.artifactPath(artifact))
+	u.logger.Debug("Uploading \"%s\" to `%s`", artifact.Path, blobURL)
+
+	headers := map[string]string{
+		"x-ms-blob-content-type": artifact.ContentType,
+	}
+
+	if info.Size() <= u.conf.PartSize {
+		headers["x-ms-blob-type"] = "BlockBlob"
+		return u.put(ctx, blobURL, nil, headers, f, info.Size())
+	}
+
+	blockIDs, err := u.putBlocks(ctx, blobURL, f, info.Size())
+	if err != nil {
+		return err
+	}
+	if err := u.putBlockList(ctx, blobURL, blockIDs, headers); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	delete(u.blocks, blobURL.String())
+	u.mu.Unlock()
+	return nil
+}
+
+// Abandon forgets the blocks that were uploaded of the artifact's blob, if it
+// failed part way through. Azure Blob Storage discards uncommitted blocks
+// after a week.
+func (u *AzureBlobUploader) Abandon(artifact *api.Artifact) {
+	blobURL := azureBlobURL(u.Account, u.Container, u.artifactPath(artifact))
+
+	u.mu.Lock()
+	delete(u.blocks, blobURL.String())
+	u.mu.Unlock()
+}
+
+// putBlocks uploads a file's blocks, a few at once, and returns their IDs in
+// the order they're in the file. If it fails, the blocks that were uploaded
+// are remembered, and only the rest are uploaded when it's retried.
+func (u *AzureBlobUploader) putBlocks(ctx context.Context, blobURL *url.URL, f *os.File, size int64) ([]string, error) {
+	blockSize := u.conf.PartSize
+	count := int((size + blockSize - 1) / blockSize)
+	if count > azureBlobMaxBlocksPerBlob {
+		return nil, fmt.Errorf("the file is larger than the %d GiB Azure Blob Storage can have uploaded in %d MiB blocks", int64(azureBlobMaxBlocksPerBlob)*blockSize>>30, blockSize>>20)
+	}
+
+	u.mu.Lock()
+	uploaded, ok := u.blocks[blobURL.String()]
+	if !ok {
+		uploaded = make(map[int]bool)
+		u.blocks[blobURL.String()] = uploaded
+	} else {
+		u.logger.Info("Resuming the upload of %q, which has %d blocks uploaded", blobURL, len(uploaded))
+	}
+	u.mu.Unlock()
+
+	blockIDs := make([]string, count)
+	p := pool.New(u.conf.PartConcurrency)
+	var errs []error
+
+	for i := range blockIDs {
+		i := i
+
+		// IDs must all be the same length
+		blockIDs[i] = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%0*d", azureBlobBlockIDNumberSize, i)))
+
+		p.Lock()
+		done := uploaded[i]
+		p.Unlock()
+		if done {
+			continue
+		}
+
+		p.Spawn(func() {
+			offset := int64(i) * blockSize
+			length := size - offset
+			if length > blockSize {
+				length = blockSize
+			}
+
+			query := url.Values{"comp": {"block"}, "blockid": {blockIDs[i]}}
+			err := u.put(ctx, blobURL, query, nil, io.NewSectionReader(f, offset, length), length)
+
+			p.Lock()
+			defer p.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("block %d: %w", i, err))
+				return
+			}
+			uploaded[i] = true
+		})
+	}
+	p.Wait()
+
+	if len(errs) > 0 {
+		u.logger.Info("Uploaded %d of %d blocks of %q, the rest will be uploaded if it's retried", len(uploaded), count, blobURL)
+		return nil, errs[0]
+	}
+	return blockIDs, nil
+}
+
+// putBlockList commits the uploaded blocks as the blob
+func (u *AzureBlobUploader) putBlockList(ctx context.Context, blobURL *url.URL, blockIDs []string, headers map[string]string) error {
+	list := struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{Latest: blockIDs}
+
+	body, err := xml.Marshal(list)
+	if err != nil {
+		return err
+	}
+	body = append([]byte(xml.Header), body...)
+
+	headers["Content-Type"] = "application/xml"
+	return u.put(ctx, blobURL, url.Values{"comp": {"blocklist"}}, headers, bytes.NewReader(body), int64(len(body)))
+}
+
+func (u *AzureBlobUploader) put(ctx context.Context, blobURL *url.URL, query url.Values, headers map[string]string, body io.Reader, size int64) error {
+	reqURL := *blobURL
+	reqURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", reqURL.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		// Otherwise the length is taken to be unknown
+		req.Body = http.NoBody
+	}
+	for k, v := range headers {
+		if v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return checkAzureBlobResponse(res)
+}
+
+func (u *AzureBlobUploader) artifactPath(artifact *api.Artifact) string {
+	if u.Path == "" {
+		return filepath.ToSlash(artifact.Path)
+	}
+	return u.Path + "/" + filepath.ToSlash(artifact.Path)
+}
+
+// checkAzureBlobResponse returns an error with the code and message Azure
+// Blob Storage responded with, if the request failed
+func checkAzureBlobResponse(res *http.Response) error {
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+
+	var azureErr struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(res.Body)
+	if err := xml.Unmarshal(data, &azureErr); err != nil || azureErr.Code == "" {
+		return errors.New(res.Status)
+	}
+
+	// The message's last lines are the request's ID and the time
+	message, _, _ := strings.Cut(azureErr.Message, "\n")
+	return fmt.Errorf("%s: %s: %s", res.Status, azureErr.Code, message)
+}
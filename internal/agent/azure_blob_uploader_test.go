@@ -0,0 +1,302 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAzureBlobDestination(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		dest, account, container, path string
+	}{
+		{
+			dest:      "azblob://my-account/my-container/foo/bar",
+			account:   "my-account",
+			container: "my-container",
+			path:      "foo/bar",
+		},
+		{
+			dest:      "azblob://my-account/my-container/foo/bar/",
+			account:   "my-account",
+			container: "my-container",
+			path:      "foo/bar",
+		},
+		{
+			dest:      "azblob://my-account/my-container",
+			account:   "my-account",
+			container: "my-container",
+		},
+		{
+			dest:    "azblob://my-account",
+			account: "my-account",
+		},
+	}
+	for _, tc := range tests {
+		account, container, path := ParseAzureBlobDestination(tc.dest)
+		if account != tc.account || container != tc.container || path != tc.path {
+			t.Errorf("ParseAzureBlobDestination(%q) = (%q, %q, %q), want (%q, %q, %q)", tc.dest, account, container, path, tc.account, tc.container, tc.path)
+		}
+	}
+}
+
+// fakeBlobService is enough of Azure Blob Storage to upload block blobs to,
+// and download them from
+type fakeBlobService struct {
+	t *testing.T
+
+	// The authorization each request must have
+	sasToken, bearerToken string
+
+	mu           sync.Mutex
+	blobs        map[string][]byte
+	contentTypes map[string]string
+	blocks       map[string][]byte
+	blockPuts    int
+
+	// The IDs of blocks to fail the next put of
+	failBlocks map[string]bool
+}
+
+func newFakeBlobService(t *testing.T) *fakeBlobService {
+	return &fakeBlobService{
+		t:            t,
+		blobs:        make(map[string][]byte),
+		contentTypes: make(map[string]string),
+		blocks:       make(map[string][]byte),
+	}
+}
+
+func (s *fakeBlobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	assert.Equal(s.t, azureBlobAPIVersion, r.Header.Get("x-ms-version"))
+	if s.sasToken != "" && r.URL.Query().Get("sig") != s.sasToken {
+		http.Error(w, "<Error><Code>AuthenticationFailed</Code><Message>No SAS token\nRequestId:1</Message></Error>", http.StatusForbidden)
+		return
+	}
+	if s.bearerToken != "" && r.Header.Get("Authorization") != "Bearer "+s.bearerToken {
+		http.Error(w, "<Error><Code>NoAuthenticationInformation</Code><Message>No token</Message></Error>", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	require.NoError(s.t, err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == "GET":
+		blob, ok := s.blobs[r.URL.Path]
+		if !ok {
+			http.Error(w, "<Error><Code>BlobNotFound</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Write(blob)
+
+	case r.URL.Query().Get("comp") == "block":
+		if id := r.URL.Query().Get("blockid"); s.failBlocks[id] {
+			delete(s.failBlocks, id)
+			http.Error(w, "<Error><Code>ServerBusy</Code><Message>Try again</Message></Error>", http.StatusServiceUnavailable)
+			return
+		}
+		s.blocks[r.URL.Path+"#"+r.URL.Query().Get("blockid")] = body
+		s.blockPuts++
+		w.WriteHeader(http.StatusCreated)
+
+	case r.URL.Query().Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		require.NoError(s.t, xml.Unmarshal(body, &list))
+		var blob []byte
+		for _, id := range list.Latest {
+			blob = append(blob, s.blocks[r.URL.Path+"#"+id]...)
+		}
+		s.blobs[r.URL.Path] = blob
+		s.contentTypes[r.URL.Path] = r.Header.Get("x-ms-blob-content-type")
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		assert.Equal(s.t, "BlockBlob", r.Header.Get("x-ms-blob-type"))
+		s.blobs[r.URL.Path] = body
+		s.contentTypes[r.URL.Path] = r.Header.Get("x-ms-blob-content-type")
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func writeArtifact(t *testing.T, dir, path string, size int) *api.Artifact {
+	t.Helper()
+
+	data := bytes.Repeat([]byte("llamas!"), size/7+1)[:size]
+	abs := filepath.Join(dir, filepath.FromSlash(path))
+	require.NoError(t, os.MkdirAll(filepath.Dir(abs), 0o777))
+	require.NoError(t, os.WriteFile(abs, data, 0o666))
+
+	return &api.Artifact{Path: path, AbsolutePath: abs, FileSize: int64(size), ContentType: "text/plain"}
+}
+
+func TestAzureBlobUploaderWithSASToken(t *testing.T) {
+	service := newFakeBlobService(t)
+	service.sasToken = "llamas"
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	t.Setenv(azureBlobEndpointEnvVar, server.URL)
+	t.Setenv(azureBlobSASTokenEnvVar, "?sv=2021-08-06&sig=llamas")
+
+	uploader, err := NewAzureBlobUploader(logger.Discard, AzureBlobUploaderConfig{
+		Destination: "azblob://my-account/my-container/builds/1",
+	})
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	small := writeArtifact(t, dir, "logs/small log.txt", 1024)
+	large := writeArtifact(t, dir, "large.txt", DefaultUploadPartSize*2+1)
+	empty := writeArtifact(t, dir, "empty.txt", 0)
+
+	// The URL doesn't have the SAS token in it, as it's shown to users
+	assert.Equal(t, server.URL+"/my-container/builds/1/logs/small%20log.txt", uploader.URL(small))
+
+	for _, a := range []*api.Artifact{small, large, empty} {
+		require.NoError(t, uploader.Upload(a), "Upload(%q)", a.Path)
+	}
+
+	for _, a := range []*api.Artifact{small, large, empty} {
+		want, err := os.ReadFile(a.AbsolutePath)
+		require.NoError(t, err)
+		got := service.blobs["/my-container/builds/1/"+a.Path]
+		assert.Equal(t, len(want), len(got), "uploaded %q", a.Path)
+		assert.True(t, bytes.Equal(want, got), "uploaded %q", a.Path)
+		assert.Equal(t, "text/plain", service.contentTypes["/my-container/builds/1/"+a.Path])
+	}
+
+	// Only the large file was uploaded in blocks
+	assert.Equal(t, 3, service.blockPuts)
+
+	// And it can be downloaded again
+	downloads := t.TempDir()
+	err = NewAzureBlobDownloader(logger.Discard, AzureBlobDownloaderConfig{
+		Container:   "azblob://my-account/my-container/builds/1",
+		Path:        "logs/small log.txt",
+		Destination: downloads,
+		Retries:     1,
+	}).Start(context.Background())
+	require.NoError(t, err)
+
+	got, err := os.ReadFile(filepath.Join(downloads, "logs", "small log.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, service.blobs["/my-container/builds/1/logs/small log.txt"], got)
+}
+
+func TestAzureBlobUploaderResumesUploads(t *testing.T) {
+	service := newFakeBlobService(t)
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	t.Setenv(azureBlobEndpointEnvVar, server.URL)
+	t.Setenv(azureBlobSASTokenEnvVar, "?sig=llamas")
+
+	uploader, err := NewAzureBlobUploader(logger.Discard, AzureBlobUploaderConfig{
+		Destination:     "azblob://my-account/my-container",
+		PartSize:        1024,
+		PartConcurrency: 2,
+	})
+	require.NoError(t, err)
+
+	large := writeArtifact(t, t.TempDir(), "large.txt", 1024*5+1)
+
+	// The third block fails the first time it's put
+	service.failBlocks = map[string]bool{base64.StdEncoding.EncodeToString([]byte("00000002")): true}
+	assert.Error(t, uploader.Upload(large))
+	assert.Equal(t, 5, service.blockPuts)
+	assert.NotContains(t, service.blobs, "/my-container/large.txt")
+
+	// Only the block that failed is put again
+	require.NoError(t, uploader.Upload(large))
+	assert.Equal(t, 6, service.blockPuts)
+
+	want, err := os.ReadFile(large.AbsolutePath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(want, service.blobs["/my-container/large.txt"]))
+}
+
+func TestAzureBlobUploaderWithServicePrincipal(t *testing.T) {
+	service := newFakeBlobService(t)
+	service.bearerToken = "alpacas"
+	tokenRequests := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/my-tenant/oauth2/v2.0/token", func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		assert.Equal(t, "client_credentials", r.FormValue("grant_type"))
+		assert.Equal(t, "my-client", r.FormValue("client_id"))
+		assert.Equal(t, "my-secret", r.FormValue("client_secret"))
+		assert.Equal(t, "https://storage.azure.com/.default", r.FormValue("scope"))
+		w.Write([]byte(`{"token_type":"Bearer","expires_in":3599,"access_token":"alpacas"}`))
+	})
+	mux.Handle("/", service)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	t.Setenv(azureBlobEndpointEnvVar, server.URL)
+	t.Setenv(azureBlobSASTokenEnvVar, "")
+	t.Setenv("AZURE_AUTHORITY_HOST", server.URL)
+	t.Setenv("AZURE_TENANT_ID", "my-tenant")
+	t.Setenv("AZURE_CLIENT_ID", "my-client")
+	t.Setenv("AZURE_CLIENT_SECRET", "my-secret")
+
+	uploader, err := NewAzureBlobUploader(logger.Discard, AzureBlobUploaderConfig{
+		Destination: "azblob://my-account/my-container",
+	})
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	for _, path := range []string{"one.txt", "two.txt"} {
+		require.NoError(t, uploader.Upload(writeArtifact(t, dir, path, 10)))
+		assert.Contains(t, service.blobs, "/my-container/"+path)
+	}
+
+	// The token's used until it's close to expiring
+	assert.Equal(t, 1, tokenRequests)
+}
+
+func TestAzureBlobUploaderReturnsStorageErrors(t *testing.T) {
+	service := newFakeBlobService(t)
+	service.sasToken = "llamas"
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	t.Setenv(azureBlobEndpointEnvVar, server.URL)
+	t.Setenv(azureBlobSASTokenEnvVar, "sig=alpacas")
+
+	uploader, err := NewAzureBlobUploader(logger.Discard, AzureBlobUploaderConfig{
+		Destination: "azblob://my-account/my-container",
+	})
+	require.NoError(t, err)
+
+	err = uploader.Upload(writeArtifact(t, t.TempDir(), "llamas.txt", 10))
+	assert.EqualError(t, err, "403 Forbidden: AuthenticationFailed: No SAS token")
+}
+
+func TestNewAzureBlobUploaderNeedsAContainer(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewAzureBlobUploader(logger.Discard, AzureBlobUploaderConfig{
+		Destination: "azblob://my-account",
+	})
+	assert.Error(t, err)
+}
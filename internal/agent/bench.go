@@ -0,0 +1,549 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/metrics"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/process"
+	"github.com/buildkite/shellwords"
+)
+
+// Where synthetic jobs write their artifacts, relative to their checkout
+const benchArtifactDir = "bench-artifacts"
+
+// BenchJobSpec is the work each synthetic job in a benchmark does
+type BenchJobSpec struct {
+	// How many bytes of log output the job writes, and how quickly in bytes
+	// per second, or 0 for as quickly as it can
+	OutputBytes int
+	OutputRate  int
+
+	// How many artifacts the job uploads, and how many bytes each is
+	ArtifactCount int
+	ArtifactSize  int
+}
+
+// Args returns the flags to `buildkite-agent bench-job` that do the spec's
+// work
+func (s BenchJobSpec) Args() []string {
+	return []string{
+		"--output-bytes", strconv.Itoa(s.OutputBytes),
+		"--output-rate", strconv.Itoa(s.OutputRate),
+		"--artifacts", strconv.Itoa(s.ArtifactCount),
+		"--artifact-size", strconv.Itoa(s.ArtifactSize),
+	}
+}
+
+// Generate writes the job's log output to w, and its artifacts to where
+// RunBench uploads them from in dir
+func (s BenchJobSpec) Generate(ctx context.Context, w io.Writer, dir string) error {
+	if err := s.writeArtifacts(filepath.Join(dir, benchArtifactDir)); err != nil {
+		return err
+	}
+	return s.writeOutput(ctx, w)
+}
+
+// writeOutput writes OutputBytes of numbered 80 byte lines to w, no faster
+// than OutputRate
+func (s BenchJobSpec) writeOutput(ctx context.Context, w io.Writer) error {
+	start := time.Now()
+	filler := strings.Repeat("x", 70)
+
+	for written, n := 0, 1; written < s.OutputBytes; n++ {
+		line := fmt.Sprintf("%08d %s\n", n, filler)
+		if remaining := s.OutputBytes - written; len(line) > remaining {
+			line = line[:remaining]
+		}
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+		written += len(line)
+
+		if s.OutputRate <= 0 {
+			continue
+		}
+		due := start.Add(time.Duration(float64(written) / float64(s.OutputRate) * float64(time.Second)))
+		if wait := time.Until(due); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+	}
+	return nil
+}
+
+// writeArtifacts writes ArtifactCount files of random bytes to dir, so no two
+// are the same
+func (s BenchJobSpec) writeArtifacts(dir string) error {
+	if s.ArtifactCount <= 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return err
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 1; i <= s.ArtifactCount; i++ {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("artifact-%d.bin", i)))
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(f, rng, int64(s.ArtifactSize))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// benchJobStats is what the BenchServer saw of a job
+type benchJobStats struct {
+	ExitStatus string
+	LogBytes   int64
+	LogChunks  int
+	Usage      *JobUsage
+}
+
+// BenchServer stands in for the Agent API in a benchmark, accepting
+// everything the job runner and bootstrap send it and keeping count
+type BenchServer struct {
+	logger logger.Logger
+
+	mu                 sync.Mutex
+	jobs               map[string]*benchJobStats
+	artifacts          int
+	artifactBytes      int64
+	metaData           map[string]string
+	unexpectedRequests map[string]int
+}
+
+func NewBenchServer(l logger.Logger) *BenchServer {
+	return &BenchServer{
+		logger:             l,
+		jobs:               map[string]*benchJobStats{},
+		metaData:           map[string]string{},
+		unexpectedRequests: map[string]int{},
+	}
+}
+
+func (s *BenchServer) job(id string) *benchJobStats {
+	if s.jobs[id] == nil {
+		s.jobs[id] = &benchJobStats{}
+	}
+	return s.jobs[id]
+}
+
+func (s *BenchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	if len(parts) == 1 && parts[0] == "uploads" && r.Method == http.MethodPost {
+		n, _ := io.Copy(io.Discard, r.Body)
+		s.mu.Lock()
+		s.artifactBytes += n
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	if len(parts) < 2 || parts[0] != "jobs" {
+		s.unexpected(w, r)
+		return
+	}
+	id, action := parts[1], strings.Join(parts[2:], "/")
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		fmt.Fprint(w, `{"state":"running"}`)
+
+	case action == "start" && r.Method == http.MethodPut:
+
+	case action == "finish" && r.Method == http.MethodPut:
+		var job api.Job
+		if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.job(id).ExitStatus = job.ExitStatus
+		s.mu.Unlock()
+
+	case action == "chunks" && r.Method == http.MethodPost:
+		size, _ := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+		_, _ = io.Copy(io.Discard, r.Body)
+		s.mu.Lock()
+		s.job(id).LogBytes += size
+		s.job(id).LogChunks++
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+
+	case action == "header_times" && r.Method == http.MethodPost:
+
+	case action == "artifacts" && r.Method == http.MethodPost:
+		var batch api.ArtifactBatch
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.mu.Lock()
+		first := s.artifacts
+		s.artifacts += len(batch.Artifacts)
+		s.mu.Unlock()
+
+		creation := api.ArtifactBatchCreateResponse{
+			ID:                 batch.ID,
+			UploadInstructions: &api.ArtifactUploadInstructions{},
+		}
+		for i := range batch.Artifacts {
+			creation.ArtifactIDs = append(creation.ArtifactIDs, fmt.Sprintf("bench-artifact-%d", first+i+1))
+		}
+		creation.UploadInstructions.Action.URL = "http://" + r.Host
+		creation.UploadInstructions.Action.Method = http.MethodPost
+		creation.UploadInstructions.Action.Path = "/uploads"
+		creation.UploadInstructions.Action.FileInput = "file"
+
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(creation)
+
+	case action == "artifacts" && r.Method == http.MethodPut:
+
+	case action == "data/set" && r.Method == http.MethodPost:
+		var data api.MetaData
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.metaData[data.Key] = data.Value
+		s.mu.Unlock()
+
+		if data.Key == jobUsageMetaDataPrefix+id {
+			var usage JobUsage
+			if err := json.Unmarshal([]byte(data.Value), &usage); err == nil {
+				s.mu.Lock()
+				s.job(id).Usage = &usage
+				s.mu.Unlock()
+			}
+		}
+
+	case action == "data/exists" && r.Method == http.MethodPost:
+		var data api.MetaData
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		_, exists := s.metaData[data.Key]
+		s.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(api.MetaDataExists{Exists: exists})
+
+	default:
+		s.unexpected(w, r)
+	}
+}
+
+// unexpected counts a request the BenchServer doesn't know how to handle,
+// which the report flags, as the benchmark isn't measuring all the job did
+func (s *BenchServer) unexpected(w http.ResponseWriter, r *http.Request) {
+	s.logger.Warn("[Bench] Unexpected API request %s %s", r.Method, r.URL.Path)
+
+	s.mu.Lock()
+	s.unexpectedRequests[r.Method+" "+r.URL.Path]++
+	s.mu.Unlock()
+
+	http.Error(w, "Not supported by the benchmark", http.StatusNotFound)
+}
+
+// BenchConfig is how RunBench runs a benchmark
+type BenchConfig struct {
+	// How many synthetic jobs to run, and how many at a time
+	Jobs        int
+	Concurrency int
+
+	// What each job does
+	Spec BenchJobSpec
+
+	// The command that does a spec's work, given its Args
+	JobCommand string
+
+	// The agent's configuration, which the jobs are run with
+	AgentConfiguration AgentConfiguration
+}
+
+// BenchReport is how a benchmark went
+type BenchReport struct {
+	Jobs        int
+	FailedJobs  int
+	Concurrency int
+	Elapsed     time.Duration
+
+	// How long each job took to run, from the job runner being started to it
+	// finishing, shortest first
+	JobDurations []time.Duration
+
+	LogBytes      int64
+	LogChunks     int
+	Artifacts     int
+	ArtifactBytes int64
+
+	// The total CPU time and highest peak memory of the jobs, if they could
+	// be measured
+	CPUSeconds   float64
+	PeakRSSBytes int64
+
+	// Agent API requests the benchmark's mock API couldn't handle, by method
+	// and path
+	UnexpectedRequests map[string]int
+}
+
+// Percentile returns the job duration that p percent of jobs took no longer
+// than
+func (r *BenchReport) Percentile(p int) time.Duration {
+	if len(r.JobDurations) == 0 {
+		return 0
+	}
+	i := (len(r.JobDurations)*p + 99) / 100
+	if i < 1 {
+		i = 1
+	}
+	return r.JobDurations[i-1]
+}
+
+func (r *BenchReport) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	seconds := r.Elapsed.Seconds()
+	rate := func(n int64) string {
+		if seconds <= 0 {
+			return "-"
+		}
+		return formatBytes(int64(float64(n)/seconds)) + "/s"
+	}
+
+	fmt.Fprintf(&b, "Jobs:          %d (%d failed), %d at a time\n", r.Jobs, r.FailedJobs, r.Concurrency)
+	fmt.Fprintf(&b, "Elapsed:       %s\n", r.Elapsed.Round(time.Millisecond))
+	if seconds > 0 {
+		fmt.Fprintf(&b, "Throughput:    %.2f jobs/s\n", float64(r.Jobs)/seconds)
+	}
+	fmt.Fprintf(&b, "Job duration:  p50 %s, p90 %s, p99 %s, max %s\n",
+		r.Percentile(50).Round(time.Millisecond), r.Percentile(90).Round(time.Millisecond),
+		r.Percentile(99).Round(time.Millisecond), r.Percentile(100).Round(time.Millisecond))
+	fmt.Fprintf(&b, "Log output:    %s in %d chunks, %s\n", formatBytes(r.LogBytes), r.LogChunks, rate(r.LogBytes))
+	fmt.Fprintf(&b, "Artifacts:     %d, %s, %s\n", r.Artifacts, formatBytes(r.ArtifactBytes), rate(r.ArtifactBytes))
+	if r.CPUSeconds > 0 {
+		fmt.Fprintf(&b, "Job usage:     CPU %.1fs, peak memory %s\n", r.CPUSeconds, formatBytes(r.PeakRSSBytes))
+	}
+
+	if len(r.UnexpectedRequests) > 0 {
+		var requests []string
+		for request := range r.UnexpectedRequests {
+			requests = append(requests, request)
+		}
+		sort.Strings(requests)
+
+		b.WriteString("\nThese Agent API requests weren't benchmarked:\n")
+		for _, request := range requests {
+			fmt.Fprintf(&b, "  %s (%d)\n", request, r.UnexpectedRequests[request])
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// report returns how the benchmark went, from what the BenchServer saw
+func (s *BenchServer) report() *BenchReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := &BenchReport{
+		Artifacts:          s.artifacts,
+		ArtifactBytes:      s.artifactBytes,
+		UnexpectedRequests: map[string]int{},
+	}
+	for _, job := range s.jobs {
+		if job.ExitStatus != "0" {
+			r.FailedJobs++
+		}
+		r.LogBytes += job.LogBytes
+		r.LogChunks += job.LogChunks
+		if job.Usage != nil {
+			r.CPUSeconds += job.Usage.CPUSeconds
+			if job.Usage.PeakRSSBytes > r.PeakRSSBytes {
+				r.PeakRSSBytes = job.Usage.PeakRSSBytes
+			}
+		}
+	}
+	for request, count := range s.unexpectedRequests {
+		r.UnexpectedRequests[request] = count
+	}
+	return r
+}
+
+// newBenchRepository creates a git repository in dir with a commit on main
+// for the synthetic jobs to check out, so they go through all of the
+// bootstrap like real jobs do
+func newBenchRepository(ctx context.Context, dir string) error {
+	if err := os.WriteFile(filepath.Join(dir, "README.md"), []byte("A repository for buildkite-agent bench to check out\n"), 0o666); err != nil {
+		return err
+	}
+
+	for _, args := range [][]string{
+		{"init"},
+		{"symbolic-ref", "HEAD", "refs/heads/main"},
+		{"add", "README.md"},
+		{"-c", "user.name=buildkite-agent", "-c", "user.email=bench@buildkite.invalid", "commit", "-m", "Benchmark"},
+	} {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git %s: %w\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	return nil
+}
+
+// RunBench runs synthetic jobs through the job runner and bootstrap, against
+// a BenchServer rather than Buildkite, and reports how long they took and
+// how much they sent. Jobs that run at the same time are given different
+// agent names, as an agent's spawned workers are, so they have their own
+// checkouts.
+func RunBench(ctx context.Context, l logger.Logger, cfg BenchConfig) (*BenchReport, error) {
+	if cfg.Jobs < 1 || cfg.Concurrency < 1 {
+		return nil, fmt.Errorf("a benchmark needs at least 1 job, run at least 1 at a time")
+	}
+
+	repository, err := os.MkdirTemp("", "buildkite-bench-repository-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(repository)
+	if err := newBenchRepository(ctx, repository); err != nil {
+		return nil, fmt.Errorf("creating the repository to check out: %w", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := NewBenchServer(l)
+	httpServer := &http.Server{Handler: server}
+	go func() { _ = httpServer.Serve(listener) }()
+	defer httpServer.Close()
+
+	const accessToken = "bench"
+	ag := &api.AgentRegisterResponse{Name: "bench", AccessToken: accessToken}
+	client := api.NewClient(l, api.Config{
+		Endpoint: "http://" + listener.Addr().String(),
+		Token:    accessToken,
+	})
+	scope := metrics.NewCollector(l, metrics.CollectorConfig{}).Scope(metrics.Tags{})
+
+	command := cfg.JobCommand
+	for _, arg := range cfg.Spec.Args() {
+		command += " " + shellwords.Quote(arg)
+	}
+
+	// Each worker is a slot jobs are run in, one at a time
+	workers := make(chan int, cfg.Concurrency)
+	for i := 1; i <= cfg.Concurrency; i++ {
+		workers <- i
+	}
+
+	var (
+		mu        sync.Mutex
+		durations []time.Duration
+		runErr    error
+		wg        sync.WaitGroup
+	)
+
+	start := time.Now()
+	for i := 1; i <= cfg.Jobs && ctx.Err() == nil; i++ {
+		var worker int
+		select {
+		case worker = <-workers:
+		case <-ctx.Done():
+			continue
+		}
+
+		id := fmt.Sprintf("bench-job-%d", i)
+		job := &api.Job{
+			ID:                 id,
+			ChunksMaxSizeBytes: 100 * 1024,
+			Env: map[string]string{
+				"BUILDKITE_JOB_ID":            id,
+				"BUILDKITE_BUILD_ID":          "bench",
+				"BUILDKITE_AGENT_NAME":        fmt.Sprintf("bench-%d", worker),
+				"BUILDKITE_ORGANIZATION_SLUG": "bench",
+				"BUILDKITE_PIPELINE_SLUG":     "bench",
+				"BUILDKITE_PIPELINE_PROVIDER": "git",
+				"BUILDKITE_REPO":              repository,
+				"BUILDKITE_COMMIT":            "HEAD",
+				"BUILDKITE_BRANCH":            "main",
+				"BUILDKITE_COMMAND":           command,
+			},
+		}
+		if cfg.Spec.ArtifactCount > 0 {
+			job.Env["BUILDKITE_ARTIFACT_PATHS"] = benchArtifactDir + "/*"
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { workers <- worker }()
+
+			jobStart := time.Now()
+			jr, err := NewJobRunner(l, scope, ag, job, client, JobRunnerConfig{
+				AgentConfiguration: cfg.AgentConfiguration,
+				CancelSignal:       process.SIGTERM,
+				SpawnIndex:         worker,
+			})
+			if err == nil {
+				err = jr.Run(ctx)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && runErr == nil {
+				runErr = fmt.Errorf("running %s: %w", job.ID, err)
+			}
+			durations = append(durations, time.Since(jobStart))
+		}()
+	}
+	wg.Wait()
+
+	if runErr != nil {
+		return nil, runErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	report := server.report()
+	report.Jobs = len(durations)
+	report.Concurrency = cfg.Concurrency
+	report.Elapsed = time.Since(start)
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	report.JobDurations = durations
+	return report, nil
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBenchJobSpecGenerate(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	spec := BenchJobSpec{OutputBytes: 1000, ArtifactCount: 3, ArtifactSize: 512}
+
+	var out bytes.Buffer
+	require.NoError(t, spec.Generate(context.Background(), &out, dir))
+
+	assert.Equal(t, 1000, out.Len())
+	assert.True(t, strings.HasPrefix(out.String(), "00000001 xxx"), out.String()[:20])
+
+	artifacts, err := filepath.Glob(filepath.Join(dir, benchArtifactDir, "*"))
+	require.NoError(t, err)
+	require.Len(t, artifacts, 3)
+	for _, artifact := range artifacts {
+		info, err := os.Stat(artifact)
+		require.NoError(t, err)
+		assert.Equal(t, int64(512), info.Size())
+	}
+}
+
+func TestBenchJobSpecOutputRate(t *testing.T) {
+	t.Parallel()
+
+	spec := BenchJobSpec{OutputBytes: 800, OutputRate: 4000}
+
+	start := time.Now()
+	var out bytes.Buffer
+	require.NoError(t, spec.Generate(context.Background(), &out, t.TempDir()))
+
+	assert.GreaterOrEqual(t, time.Since(start), 190*time.Millisecond)
+	assert.Equal(t, 800, out.Len())
+}
+
+func TestBenchServer(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	server := NewBenchServer(logger.Discard)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: ts.URL, Token: "bench"})
+	job := &api.Job{ID: "bench-job-1"}
+
+	_, err := client.StartJob(ctx, job)
+	require.NoError(t, err)
+
+	_, err = client.UploadChunk(ctx, job.ID, &api.Chunk{Data: "hello world\n", Sequence: 1, Size: 12})
+	require.NoError(t, err)
+
+	creation, _, err := client.CreateArtifacts(ctx, job.ID, &api.ArtifactBatch{
+		ID:        "batch",
+		Artifacts: []*api.Artifact{{Path: "a.bin"}, {Path: "b.bin"}},
+	})
+	require.NoError(t, err)
+	assert.Len(t, creation.ArtifactIDs, 2)
+
+	resp, err := http.Post(ts.URL+creation.UploadInstructions.Action.Path, "application/octet-stream", strings.NewReader("0123456789"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	exists, _, err := client.ExistsMetaData(ctx, job.ID, "buildkite:git:commit")
+	require.NoError(t, err)
+	assert.False(t, exists.Exists)
+
+	_, err = client.SetMetaData(ctx, job.ID, &api.MetaData{Key: "buildkite:git:commit", Value: "abc"})
+	require.NoError(t, err)
+	_, err = client.SetMetaData(ctx, job.ID, &api.MetaData{Key: jobUsageMetaDataPrefix + job.ID, Value: `{"source":"rusage","cpu_seconds":1.5,"peak_rss_bytes":2048}`})
+	require.NoError(t, err)
+
+	exists, _, err = client.ExistsMetaData(ctx, job.ID, "buildkite:git:commit")
+	require.NoError(t, err)
+	assert.True(t, exists.Exists)
+
+	_, _, err = client.GetMetaData(ctx, job.ID, "buildkite:git:commit")
+	assert.Error(t, err)
+
+	job.ExitStatus = "0"
+	_, err = client.FinishJob(ctx, job)
+	require.NoError(t, err)
+
+	report := server.report()
+	assert.Equal(t, 0, report.FailedJobs)
+	assert.Equal(t, int64(12), report.LogBytes)
+	assert.Equal(t, 1, report.LogChunks)
+	assert.Equal(t, 2, report.Artifacts)
+	assert.Equal(t, int64(10), report.ArtifactBytes)
+	assert.Equal(t, 1.5, report.CPUSeconds)
+	assert.Equal(t, int64(2048), report.PeakRSSBytes)
+	assert.Equal(t, map[string]int{"POST /jobs/bench-job-1/data/get": 1}, report.UnexpectedRequests)
+}
+
+func TestBenchReport(t *testing.T) {
+	t.Parallel()
+
+	report := &BenchReport{
+		Jobs:               4,
+		FailedJobs:         1,
+		Concurrency:        2,
+		Elapsed:            2 * time.Second,
+		JobDurations:       []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 4 * time.Second},
+		LogBytes:           4096,
+		LogChunks:          2,
+		UnexpectedRequests: map[string]int{"POST /jobs/1/annotations": 2},
+	}
+
+	assert.Equal(t, 2*time.Second, report.Percentile(50))
+	assert.Equal(t, 4*time.Second, report.Percentile(90))
+	assert.Equal(t, time.Second, report.Percentile(0))
+	assert.Equal(t, time.Duration(0), (&BenchReport{}).Percentile(50))
+
+	var out bytes.Buffer
+	_, err := report.WriteTo(&out)
+	require.NoError(t, err)
+
+	assert.Contains(t, out.String(), "Jobs:          4 (1 failed), 2 at a time\n")
+	assert.Contains(t, out.String(), "Throughput:    2.00 jobs/s\n")
+	assert.Contains(t, out.String(), "Job duration:  p50 2s, p90 4s, p99 4s, max 4s\n")
+	assert.Contains(t, out.String(), "Log output:    4.0 KiB in 2 chunks, 2.0 KiB/s\n")
+	assert.Contains(t, out.String(), "  POST /jobs/1/annotations (2)\n")
+	assert.NotContains(t, out.String(), "Job usage")
+}
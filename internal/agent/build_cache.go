@@ -0,0 +1,306 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// ErrBuildCacheMiss is returned by a BuildCacheStore that doesn't have an entry
+var ErrBuildCacheMiss = errors.New("not in the build cache")
+
+// Cache keys are hex digests, like the SHA-256 Bazel uses or the MD5 Gradle
+// does by default
+var buildCacheKeyRegexp = regexp.MustCompile(`^[a-f0-9]{32,128}$`)
+
+// BuildCacheStore is where the build cache server keeps its entries. Keys
+// are slash separated paths like cas/<digest>.
+type BuildCacheStore interface {
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	Put(ctx context.Context, key string, r io.Reader) error
+}
+
+// NewBuildCacheStore returns the store for a build cache destination, either
+// an S3 path like s3://my-bucket/build-cache or a local directory
+func NewBuildCacheStore(l logger.Logger, destination string) (BuildCacheStore, error) {
+	switch {
+	case strings.HasPrefix(destination, "s3://"):
+		bucketName, bucketPath := ParseS3Destination(destination)
+		client, err := NewS3Client(l, bucketName)
+		if err != nil {
+			return nil, err
+		}
+		return &s3BuildCacheStore{client: client, bucket: bucketName, prefix: bucketPath}, nil
+
+	case strings.Contains(destination, "://"):
+		return nil, fmt.Errorf("Unsupported build cache destination %q, expected an s3:// path or a local directory", destination)
+
+	default:
+		if err := os.MkdirAll(destination, 0o755); err != nil {
+			return nil, err
+		}
+		return dirBuildCacheStore(destination), nil
+	}
+}
+
+// dirBuildCacheStore keeps the build cache in a local directory, which can be
+// shared between the agents on a host
+type dirBuildCacheStore string
+
+func (d dirBuildCacheStore) path(key string) string {
+	return filepath.Join(string(d), filepath.FromSlash(key))
+}
+
+func (d dirBuildCacheStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(d.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrBuildCacheMiss
+	}
+	return f, err
+}
+
+func (d dirBuildCacheStore) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := os.Stat(d.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Put writes the entry to a temporary file first, so it's never read half
+// written
+func (d dirBuildCacheStore) Put(ctx context.Context, key string, r io.Reader) error {
+	dst := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// s3BuildCacheStore keeps the build cache in an S3 bucket, the same way
+// artifacts can be
+type s3BuildCacheStore struct {
+	client *s3.S3
+	bucket string
+	prefix string
+}
+
+func (s *s3BuildCacheStore) key(key string) string {
+	return path.Join(s.prefix, key)
+}
+
+func (s *s3BuildCacheStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if isS3NotFound(err) {
+		return nil, ErrBuildCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *s3BuildCacheStore) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if isS3NotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *s3BuildCacheStore) Put(ctx context.Context, key string, r io.Reader) error {
+	_, err := s3manager.NewUploaderWithClient(s.client).UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+		Body:   r,
+	})
+	return err
+}
+
+func isS3NotFound(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	return aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound"
+}
+
+// BuildCacheServer is a remote cache for build tools, speaking the HTTP
+// protocols of Bazel's remote cache, with its action cache at /ac/<digest>
+// and content addressable store at /cas/<digest>, and of Gradle's build
+// cache, at /cache/<key>. Entries are read with GET and HEAD, and written
+// with PUT.
+type BuildCacheServer struct {
+	store  BuildCacheStore
+	logger logger.Logger
+}
+
+func NewBuildCacheServer(l logger.Logger, store BuildCacheStore) *BuildCacheServer {
+	return &BuildCacheServer{
+		store:  store,
+		logger: l,
+	}
+}
+
+// buildCacheKey returns the store key for a request path, ignoring anything
+// before the last two parts of it, like the instance name Bazel can add
+func buildCacheKey(urlPath string) (kind, digest string, ok bool) {
+	parts := strings.Split(strings.Trim(urlPath, "/"), "/")
+	if len(parts) < 2 {
+		return "", "", false
+	}
+	kind, digest = parts[len(parts)-2], parts[len(parts)-1]
+	switch kind {
+	case "ac", "cas":
+	case "cache":
+		kind = "gradle"
+	default:
+		return "", "", false
+	}
+	if !buildCacheKeyRegexp.MatchString(digest) {
+		return "", "", false
+	}
+	return kind, digest, true
+}
+
+func (s *BuildCacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kind, digest, ok := buildCacheKey(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	key := kind + "/" + digest
+
+	switch r.Method {
+	case http.MethodGet:
+		body, err := s.store.Get(r.Context(), key)
+		if errors.Is(err, ErrBuildCacheMiss) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			s.logger.Error("Build cache: failed to get %s: %v", key, err)
+			http.Error(w, "Failed to read from the build cache", http.StatusInternalServerError)
+			return
+		}
+		defer body.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if _, err := io.Copy(w, body); err != nil {
+			s.logger.Warn("Build cache: failed to send %s: %v", key, err)
+		}
+
+	case http.MethodHead:
+		exists, err := s.store.Exists(r.Context(), key)
+		if err != nil {
+			s.logger.Error("Build cache: failed to find %s: %v", key, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+	case http.MethodPut:
+		if err := s.put(r.Context(), kind, digest, r.Body); err != nil {
+			var badDigest *buildCacheDigestError
+			if errors.As(err, &badDigest) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.logger.Error("Build cache: failed to put %s: %v", key, err)
+			http.Error(w, "Failed to write to the build cache", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type buildCacheDigestError struct {
+	want, got string
+}
+
+func (e *buildCacheDigestError) Error() string {
+	return fmt.Sprintf("The content's SHA-256 digest is %s, not %s", e.got, e.want)
+}
+
+// put spools the entry to a temporary file before storing it, so that the
+// content addressable store's entries can be checked against their digest,
+// and only whole entries are stored
+func (s *BuildCacheServer) put(ctx context.Context, kind, digest string, body io.Reader) error {
+	tmp, err := os.CreateTemp("", "buildkite-build-cache-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), body); err != nil {
+		return err
+	}
+	if kind == "cas" && len(digest) == sha256.Size*2 {
+		if got := hex.EncodeToString(hash.Sum(nil)); got != digest {
+			return &buildCacheDigestError{want: digest, got: got}
+		}
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return s.store.Put(ctx, kind+"/"+digest, tmp)
+}
+
+// BuildCacheURL returns the URL jobs can reach the build cache server
+// listening on addr at
+func BuildCacheURL(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
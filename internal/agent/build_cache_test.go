@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBuildCacheServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	store, err := NewBuildCacheStore(logger.Discard, t.TempDir())
+	require.NoError(t, err)
+
+	server := httptest.NewServer(NewBuildCacheServer(logger.Discard, store))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func buildCacheRequest(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	got, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(got)
+}
+
+func TestBuildCacheServerBazel(t *testing.T) {
+	t.Parallel()
+
+	server := newTestBuildCacheServer(t)
+
+	content := "llamas are great"
+	sum := sha256.Sum256([]byte(content))
+	digest := hex.EncodeToString(sum[:])
+
+	status, _ := buildCacheRequest(t, http.MethodGet, server.URL+"/cas/"+digest, "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _ = buildCacheRequest(t, http.MethodHead, server.URL+"/cas/"+digest, "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _ = buildCacheRequest(t, http.MethodPut, server.URL+"/cas/"+digest, content)
+	assert.Equal(t, http.StatusCreated, status)
+
+	status, _ = buildCacheRequest(t, http.MethodHead, server.URL+"/cas/"+digest, "")
+	assert.Equal(t, http.StatusOK, status)
+
+	status, got := buildCacheRequest(t, http.MethodGet, server.URL+"/cas/"+digest, "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, content, got)
+
+	// With an instance name in front
+	status, got = buildCacheRequest(t, http.MethodGet, server.URL+"/my-instance/cas/"+digest, "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, content, got)
+
+	// The action cache is separate, and isn't content addressed
+	status, _ = buildCacheRequest(t, http.MethodGet, server.URL+"/ac/"+digest, "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _ = buildCacheRequest(t, http.MethodPut, server.URL+"/ac/"+digest, "an action result")
+	assert.Equal(t, http.StatusCreated, status)
+
+	status, got = buildCacheRequest(t, http.MethodGet, server.URL+"/ac/"+digest, "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "an action result", got)
+}
+
+func TestBuildCacheServerRejectsContentNotMatchingItsDigest(t *testing.T) {
+	t.Parallel()
+
+	server := newTestBuildCacheServer(t)
+
+	sum := sha256.Sum256([]byte("llamas are great"))
+	digest := hex.EncodeToString(sum[:])
+
+	status, _ := buildCacheRequest(t, http.MethodPut, server.URL+"/cas/"+digest, "alpacas are great")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = buildCacheRequest(t, http.MethodGet, server.URL+"/cas/"+digest, "")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestBuildCacheServerGradle(t *testing.T) {
+	t.Parallel()
+
+	server := newTestBuildCacheServer(t)
+	key := "b9e6f1d5c3a7e2f4b9e6f1d5c3a7e2f4"
+
+	status, _ := buildCacheRequest(t, http.MethodGet, server.URL+"/cache/"+key, "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _ = buildCacheRequest(t, http.MethodPut, server.URL+"/cache/"+key, "task outputs")
+	assert.Equal(t, http.StatusCreated, status)
+
+	status, got := buildCacheRequest(t, http.MethodGet, server.URL+"/cache/"+key, "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "task outputs", got)
+}
+
+func TestBuildCacheServerRejectsInvalidPaths(t *testing.T) {
+	t.Parallel()
+
+	server := newTestBuildCacheServer(t)
+
+	for _, path := range []string{
+		"/",
+		"/cas",
+		"/cas/not-a-digest",
+		"/cas/..%2f..%2fetc%2fpasswd",
+		"/other/b9e6f1d5c3a7e2f4b9e6f1d5c3a7e2f4",
+	} {
+		status, _ := buildCacheRequest(t, http.MethodPut, server.URL+path, "content")
+		assert.Equal(t, http.StatusNotFound, status, path)
+	}
+
+	status, _ := buildCacheRequest(t, http.MethodDelete, server.URL+"/cache/b9e6f1d5c3a7e2f4b9e6f1d5c3a7e2f4", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+}
+
+func TestBuildCacheURL(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "http://localhost:9092", BuildCacheURL(":9092"))
+	assert.Equal(t, "http://localhost:9092", BuildCacheURL("0.0.0.0:9092"))
+	assert.Equal(t, "http://127.0.0.1:9092", BuildCacheURL("127.0.0.1:9092"))
+	assert.Equal(t, "http://[::1]:9092", BuildCacheURL("[::1]:9092"))
+}
@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/bootstrap"
+)
+
+// How often the size of a job's build directory is checked against its quota
+const buildDirQuotaInterval = 30 * time.Second
+
+// BuildDirQuota is the most disk space a pipeline's build directory can use
+// while a job runs in it. If Pipeline is empty, it applies to every pipeline
+// without a quota of its own.
+type BuildDirQuota struct {
+	Pipeline string
+	Limit    int64
+}
+
+// ParseBuildDirQuotas parses quotas like "20GB", or "my-pipeline=100GB" for a
+// quota that only applies to one pipeline
+func ParseBuildDirQuotas(quotas []string) ([]BuildDirQuota, error) {
+	var parsed []BuildDirQuota
+	for _, s := range quotas {
+		var q BuildDirQuota
+
+		size := s
+		if pipeline, limit, ok := strings.Cut(s, "="); ok {
+			if strings.TrimSpace(pipeline) == "" {
+				return nil, fmt.Errorf("invalid build dir quota %q, expected pipeline=size", s)
+			}
+			q.Pipeline, size = strings.TrimSpace(pipeline), limit
+		}
+
+		limit, err := ParseByteSize(size)
+		if err != nil {
+			return nil, fmt.Errorf("invalid build dir quota %q: %w", s, err)
+		}
+		q.Limit = limit
+
+		parsed = append(parsed, q)
+	}
+	return parsed, nil
+}
+
+var byteSizeRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([KMGT]I?B?|B)?$`)
+
+// ParseByteSize parses sizes like 512MB or 1.5GiB. Units are powers of 1024
+// either way, as that's what disk usage is reported in.
+func ParseByteSize(s string) (int64, error) {
+	m := byteSizeRegexp.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(s)))
+	if m == nil {
+		return 0, fmt.Errorf("expected a size like 500MB or 20GB")
+	}
+
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+
+	multiplier := int64(1)
+	if m[2] != "" && m[2] != "B" {
+		multiplier = 1 << (10 * (strings.IndexByte("KMGT", m[2][0]) + 1))
+	}
+
+	size := int64(n * float64(multiplier))
+	if size <= 0 {
+		return 0, fmt.Errorf("it must be more than 0")
+	}
+	return size, nil
+}
+
+// buildDirQuota returns the quota for a pipeline's build directory, or 0 if it
+// has none. A pipeline's own quota takes precedence over one for every
+// pipeline.
+func buildDirQuota(quotas []BuildDirQuota, pipeline string) int64 {
+	var limit int64
+	for _, q := range quotas {
+		switch q.Pipeline {
+		case pipeline:
+			return q.Limit
+		case "":
+			limit = q.Limit
+		}
+	}
+	return limit
+}
+
+// dirSize returns the size of the files in a directory. Files that are
+// removed while it's walking the directory are skipped.
+func dirSize(ctx context.Context, dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path != dir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// checkoutPath returns where the bootstrap will check out the job, which is
+// the directory its quota applies to
+func (r *JobRunner) checkoutPath() string {
+	if path := r.job.Env["BUILDKITE_BUILD_CHECKOUT_PATH"]; path != "" {
+		return path
+	}
+	buildPath := r.conf.AgentConfiguration.BuildPath
+	if r.jobUser != nil {
+		buildPath = r.jobUser.buildPath()
+	}
+	return filepath.Join(buildPath, bootstrap.CheckoutDir(
+		r.conf.AgentConfiguration.BuildPathLayout,
+		r.job.Env["BUILDKITE_AGENT_META_DATA_QUEUE"],
+		r.agent.Name,
+		r.conf.SpawnIndex,
+		r.job.Env["BUILDKITE_ORGANIZATION_SLUG"],
+		r.job.Env["BUILDKITE_PIPELINE_SLUG"],
+	))
+}
+
+// buildDirQuotaChecker periodically measures the job's build directory, and
+// cancels the job if it grows beyond its quota, so that one pipeline can't
+// fill up a disk that other pipelines share
+func (r *JobRunner) buildDirQuotaChecker(ctx context.Context, wg *sync.WaitGroup, limit int64) {
+	defer wg.Done()
+
+	select {
+	case <-r.process.Started():
+	case <-ctx.Done():
+		return
+	}
+
+	dir := r.checkoutPath()
+	ticker := time.NewTicker(buildDirQuotaInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		case <-r.process.Done():
+			return
+		}
+
+		size, err := dirSize(ctx, dir)
+		if err != nil {
+			r.logger.Debug("[JobRunner] Couldn't measure the size of %s: %v", dir, err)
+			continue
+		}
+		if size <= limit {
+			continue
+		}
+
+		r.logger.Warn("[JobRunner] Job %s's build directory %s is using %s, more than its quota of %s, canceling it",
+			r.job.ID, dir, formatBytes(size), formatBytes(limit))
+		fmt.Fprintf(r.output, "This job's build directory %s is using %s, which is more than this agent's quota of %s for the pipeline, so it's being canceled. Remove large temporary files as the job goes, or ask for a larger quota.\n",
+			dir, formatBytes(size), formatBytes(limit))
+		r.metrics.Count("jobs.build_dir_quota_exceeded", 1)
+
+		if err := r.Cancel(); err != nil {
+			r.logger.Error("Unexpected error canceling process that exceeded its build directory quota (job: %s) (err: %s)", r.job.ID, err)
+		}
+		return
+	}
+}
@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/bootstrap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBuildDirQuotas(t *testing.T) {
+	quotas, err := ParseBuildDirQuotas([]string{"20GB", "big-pipeline = 1.5TiB", "tiny=512mb"})
+	require.NoError(t, err)
+	assert.Equal(t, []BuildDirQuota{
+		{Limit: 20 << 30},
+		{Pipeline: "big-pipeline", Limit: 3 << 39},
+		{Pipeline: "tiny", Limit: 512 << 20},
+	}, quotas)
+
+	for _, invalid := range []string{"lots", "=20GB", "my-pipeline=", "0GB", "20PB"} {
+		_, err := ParseBuildDirQuotas([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestBuildDirQuota(t *testing.T) {
+	quotas := []BuildDirQuota{
+		{Pipeline: "big-pipeline", Limit: 100},
+		{Limit: 10},
+	}
+	assert.Equal(t, int64(100), buildDirQuota(quotas, "big-pipeline"))
+	assert.Equal(t, int64(10), buildDirQuota(quotas, "other-pipeline"))
+	assert.Equal(t, int64(0), buildDirQuota(quotas[:1], "other-pipeline"))
+}
+
+func TestDirSize(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "one"), make([]byte, 100), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a", "b", "two"), make([]byte, 50), 0644))
+
+	size, err := dirSize(context.Background(), dir)
+	require.NoError(t, err)
+	assert.Equal(t, int64(150), size)
+
+	_, err = dirSize(context.Background(), filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestCheckoutPathFollowsBuildPathLayout(t *testing.T) {
+	t.Parallel()
+
+	env := map[string]string{
+		"BUILDKITE_AGENT_META_DATA_QUEUE": "deploy",
+		"BUILDKITE_ORGANIZATION_SLUG":     "acme",
+		"BUILDKITE_PIPELINE_SLUG":         "web-app",
+	}
+	newRunner := func(layout string) *JobRunner {
+		return &JobRunner{
+			agent: &api.AgentRegisterResponse{Name: "my-agent-1"},
+			job:   &api.Job{Env: env},
+			conf: JobRunnerConfig{
+				SpawnIndex:         1,
+				AgentConfiguration: AgentConfiguration{BuildPath: "/builds", BuildPathLayout: layout},
+			},
+		}
+	}
+
+	assert.Equal(t, filepath.Join("/builds", "my-agent-1", "acme", "web-app"), newRunner("").checkoutPath())
+	assert.Equal(t,
+		filepath.Join("/builds", bootstrap.CheckoutDir(bootstrap.BuildPathLayoutHashed, "deploy", "my-agent-1", 1, "acme", "web-app")),
+		newRunner(bootstrap.BuildPathLayoutHashed).checkoutPath())
+	assert.Equal(t, filepath.Join("/builds", "deploy"), filepath.Dir(newRunner(bootstrap.BuildPathLayoutHashed).checkoutPath()))
+}
@@ -0,0 +1,270 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// CacheConfig is the configuration of a Cache
+type CacheConfig struct {
+	// Where the cache's entries are kept, an s3://, gs://, rt:// or azblob://
+	// path, the same as artifact upload destinations
+	Store string
+
+	// How entries are compressed when they're saved, gzip or zstd. Entries
+	// are restored however they were saved.
+	Compression string
+
+	// If failed responses should be dumped to the log
+	DebugHTTP bool
+}
+
+// Cache saves files and directories, like a build's dependencies, to a store
+// under a key, and restores them from it in later builds. Each entry is a
+// compressed tar archive of paths relative to the working directory.
+type Cache struct {
+	conf   CacheConfig
+	logger logger.Logger
+}
+
+// NewCache returns a cache for a store, or an error if the store or the
+// compression isn't one that's supported
+func NewCache(l logger.Logger, c CacheConfig) (*Cache, error) {
+	if c.Compression == "" {
+		c.Compression = ArtifactCompressionGzip
+	}
+	if !ValidArtifactCompression(c.Compression) {
+		return nil, fmt.Errorf("Invalid cache compression %q, expected gzip or zstd", c.Compression)
+	}
+
+	switch {
+	case strings.HasPrefix(c.Store, "s3://"),
+		strings.HasPrefix(c.Store, "gs://"),
+		strings.HasPrefix(c.Store, "rt://"),
+		strings.HasPrefix(c.Store, "azblob://"):
+	default:
+		return nil, fmt.Errorf("Invalid cache store %q. Only s3://, gs://, rt:// or azblob:// stores are allowed", c.Store)
+	}
+
+	return &Cache{conf: c, logger: l}, nil
+}
+
+// Save archives paths, which are relative to the working directory and
+// have to be inside it, and uploads them to the store under key, replacing
+// any entry that's already there. Paths that don't exist are skipped.
+func (c *Cache) Save(ctx context.Context, key string, paths []string) error {
+	if err := validateCacheKey(key); err != nil {
+		return err
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	var found []string
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(abs); os.IsNotExist(err) {
+			c.logger.Warn("Not caching %s, which doesn't exist", path)
+			continue
+		} else if err != nil {
+			return err
+		}
+		found = append(found, abs)
+	}
+	if len(found) == 0 {
+		return errors.New("None of the paths to cache exist")
+	}
+
+	entryPath := cacheEntryPath(key, c.conf.Compression)
+	f, err := os.CreateTemp("", "buildkite-cache-*-"+filepath.Base(entryPath))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w, err := newCompressor(c.conf.Compression, f)
+	if err != nil {
+		return err
+	}
+	if err := archivePaths(w, wd, found); err != nil {
+		w.Close()
+		return fmt.Errorf("Couldn't archive the paths to cache: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	uploader, err := c.uploader()
+	if err != nil {
+		return fmt.Errorf("Error creating uploader: %v", err)
+	}
+
+	artifact := &api.Artifact{
+		Path:         entryPath,
+		AbsolutePath: f.Name(),
+		FileSize:     info.Size(),
+		ContentType:  cacheContentTypes[c.conf.Compression],
+	}
+	artifact.URL = uploader.URL(artifact)
+
+	c.logger.Info("Saving %d bytes to the cache under %q", info.Size(), key)
+	if err := uploader.Upload(artifact); err != nil {
+		return fmt.Errorf("Error uploading cache entry %q: %w", key, err)
+	}
+	return nil
+}
+
+// Restore unpacks the entry of the first of the keys that's in the store
+// into the working directory, and returns that key. If none of them are
+// there, it returns an empty key. A key whose entry can't be downloaded is
+// skipped like one that isn't there, as a build can carry on without it.
+func (c *Cache) Restore(ctx context.Context, keys []string) (string, error) {
+	for _, key := range keys {
+		if err := validateCacheKey(key); err != nil {
+			return "", err
+		}
+	}
+
+	// Entries are looked for with the compression that's configured first,
+	// in case they were saved with the other
+	compressions := []string{c.conf.Compression}
+	for _, compression := range []string{ArtifactCompressionGzip, ArtifactCompressionZstd} {
+		if compression != c.conf.Compression {
+			compressions = append(compressions, compression)
+		}
+	}
+
+	for _, key := range keys {
+		for _, compression := range compressions {
+			err := c.restore(ctx, key, compression)
+			if isDownloadNotFound(err) {
+				continue
+			}
+			if err != nil {
+				c.logger.Warn("Couldn't restore cache entry %q: %v", key, err)
+				break
+			}
+			c.logger.Info("Restored cache entry %q", key)
+			return key, nil
+		}
+		c.logger.Info("No cache entry for %q", key)
+	}
+	return "", nil
+}
+
+func (c *Cache) restore(ctx context.Context, key, compression string) error {
+	stream := func(r io.Reader) error {
+		dr, err := newDecompressor(compression, r)
+		if err != nil {
+			return err
+		}
+		if err := extractTar(dr, ".", false); err != nil {
+			dr.Close()
+			return err
+		}
+		return dr.Close()
+	}
+
+	dler, err := c.downloader(cacheEntryPath(key, compression), stream)
+	if err != nil {
+		return err
+	}
+	return dler.Start(ctx)
+}
+
+func (c *Cache) uploader() (Uploader, error) {
+	switch {
+	case strings.HasPrefix(c.conf.Store, "s3://"):
+		return NewS3Uploader(c.logger, S3UploaderConfig{
+			Destination: c.conf.Store,
+			DebugHTTP:   c.conf.DebugHTTP,
+		})
+	case strings.HasPrefix(c.conf.Store, "gs://"):
+		return NewGSUploader(c.logger, GSUploaderConfig{
+			Destination: c.conf.Store,
+			DebugHTTP:   c.conf.DebugHTTP,
+		})
+	case strings.HasPrefix(c.conf.Store, "rt://"):
+		return NewArtifactoryUploader(c.logger, ArtifactoryUploaderConfig{
+			Destination: c.conf.Store,
+			DebugHTTP:   c.conf.DebugHTTP,
+		})
+	default:
+		return NewAzureBlobUploader(c.logger, AzureBlobUploaderConfig{
+			Destination: c.conf.Store,
+			DebugHTTP:   c.conf.DebugHTTP,
+		})
+	}
+}
+
+func (c *Cache) downloader(path string, stream func(io.Reader) error) (artifactDownload, error) {
+	switch {
+	case strings.HasPrefix(c.conf.Store, "s3://"):
+		bucketName, _ := ParseS3Destination(c.conf.Store)
+		client, err := NewS3Client(c.logger, bucketName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create S3 client for bucket %s: %w", bucketName, err)
+		}
+		return NewS3Downloader(c.logger, S3DownloaderConfig{
+			S3Client:  client,
+			S3Path:    c.conf.Store,
+			Path:      path,
+			Retries:   5,
+			DebugHTTP: c.conf.DebugHTTP,
+			Stream:    stream,
+		}), nil
+	case strings.HasPrefix(c.conf.Store, "gs://"):
+		return NewGSDownloader(c.logger, GSDownloaderConfig{
+			Bucket:    c.conf.Store,
+			Path:      path,
+			Retries:   5,
+			DebugHTTP: c.conf.DebugHTTP,
+			Stream:    stream,
+		}), nil
+	case strings.HasPrefix(c.conf.Store, "rt://"):
+		return NewArtifactoryDownloader(c.logger, ArtifactoryDownloaderConfig{
+			Repository: c.conf.Store,
+			Path:       path,
+			Retries:    5,
+			DebugHTTP:  c.conf.DebugHTTP,
+			Stream:     stream,
+		}), nil
+	default:
+		return NewAzureBlobDownloader(c.logger, AzureBlobDownloaderConfig{
+			Container: c.conf.Store,
+			Path:      path,
+			Retries:   5,
+			DebugHTTP: c.conf.DebugHTTP,
+			Stream:    stream,
+		}), nil
+	}
+}
+
+var cacheContentTypes = map[string]string{
+	ArtifactCompressionGzip: "application/gzip",
+	ArtifactCompressionZstd: "application/zstd",
+}
+
+// cacheEntryPath returns where a key's entry is in the store
+func cacheEntryPath(key, compression string) string {
+	return compressedArtifactPath(key, compression, true)
+}
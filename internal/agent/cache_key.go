@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/buildkite/agent/v3/internal/glob"
+)
+
+// Cache keys are slash separated names, like node/linux-amd64/3f2a...
+var cacheKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9_.+=-]+(/[A-Za-z0-9_.+=-]+)*$`)
+
+// cacheKeyData is what cache keys are templated with
+type cacheKeyData struct {
+	// The OS and architecture the agent was built for, like linux and amd64
+	OS   string
+	Arch string
+}
+
+// ExpandCacheKey expands the template in a cache key, like
+// node-{{ .OS }}-{{ checksum "package-lock.json" }}. As well as .OS and
+// .Arch, it can use checksum, with the SHA-256 checksum of the files that
+// match one or more glob patterns, and env, with an environment variable.
+func ExpandCacheKey(key string) (string, error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Funcs(template.FuncMap{
+		"checksum": checksumFiles,
+		"env":      os.Getenv,
+	}).Parse(key)
+	if err != nil {
+		return "", fmt.Errorf("Invalid cache key template %q: %w", key, err)
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, cacheKeyData{OS: runtime.GOOS, Arch: runtime.GOARCH}); err != nil {
+		return "", fmt.Errorf("Couldn't expand cache key %q: %w", key, err)
+	}
+
+	expanded := b.String()
+	if err := validateCacheKey(expanded); err != nil {
+		return "", err
+	}
+	return expanded, nil
+}
+
+func validateCacheKey(key string) error {
+	if !cacheKeyRegexp.MatchString(key) {
+		return fmt.Errorf("Invalid cache key %q, which can only have letters, numbers, and _ . + = - / in it", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "." || part == ".." {
+			return fmt.Errorf("Invalid cache key %q, which can't have . or .. path components", key)
+		}
+	}
+	return nil
+}
+
+// checksumFiles returns the SHA-256 checksum of the files that match the
+// patterns, and their paths, so it changes when one is changed, added,
+// removed or renamed. It's an error for a pattern not to match any files.
+func checksumFiles(patterns ...string) (string, error) {
+	if len(patterns) == 0 {
+		return "", errors.New("checksum needs at least one path")
+	}
+
+	seen := make(map[string]bool)
+	var files []string
+	for _, pattern := range patterns {
+		p, err := glob.Compile(pattern)
+		if err != nil {
+			return "", err
+		}
+		matches, err := p.Glob(false)
+		if err != nil {
+			return "", err
+		}
+
+		matched := false
+		for _, m := range matches {
+			if isDir(m) {
+				continue
+			}
+			matched = true
+			if !seen[m] {
+				seen[m] = true
+				files = append(files, m)
+			}
+		}
+		if !matched {
+			return "", fmt.Errorf("no files match %q", pattern)
+		}
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		fh := sha256.New()
+		_, err = io.Copy(fh, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		// Paths are hashed with slashes, so keys are the same on Windows
+		fmt.Fprintf(h, "%x  %s\n", fh.Sum(nil), filepath.ToSlash(file))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
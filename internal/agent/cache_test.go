@@ -0,0 +1,140 @@
+package agent
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestCacheSaveAndRestore(t *testing.T) {
+	service := newFakeBlobService(t)
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	t.Setenv(azureBlobEndpointEnvVar, server.URL)
+	t.Setenv(azureBlobSASTokenEnvVar, "?sig=llamas")
+
+	cache, err := NewCache(logger.Discard, CacheConfig{Store: "azblob://my-account/my-container/cache"})
+	require.NoError(t, err)
+
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "node_modules", "left-pad"), 0o777))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "node_modules", "left-pad", "index.js"), []byte("module.exports = {}\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, ".npmrc"), []byte("audit=false\n"), 0o644))
+	chdir(t, src)
+
+	require.NoError(t, cache.Save(context.Background(), "node/abc123", []string{"node_modules", ".npmrc", "missing"}))
+	assert.Contains(t, service.blobs, "/my-container/cache/node/abc123.tar.gz")
+	assert.Equal(t, "application/gzip", service.contentTypes["/my-container/cache/node/abc123.tar.gz"])
+
+	// Keys that aren't there are skipped, without being downloaded again
+	dst := t.TempDir()
+	chdir(t, dst)
+
+	start := time.Now()
+	restored, err := cache.Restore(context.Background(), []string{"node/def456", "node/abc123"})
+	require.NoError(t, err)
+	assert.Equal(t, "node/abc123", restored)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	data, err := os.ReadFile(filepath.Join(dst, "node_modules", "left-pad", "index.js"))
+	require.NoError(t, err)
+	assert.Equal(t, "module.exports = {}\n", string(data))
+	assert.FileExists(t, filepath.Join(dst, ".npmrc"))
+
+	restored, err = cache.Restore(context.Background(), []string{"node/def456"})
+	require.NoError(t, err)
+	assert.Equal(t, "", restored)
+}
+
+func TestCacheSaveNeedsPathsInsideTheWorkingDirectory(t *testing.T) {
+	cache, err := NewCache(logger.Discard, CacheConfig{Store: "azblob://my-account/my-container"})
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "checkout"), 0o777))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secrets"), []byte("hunter2\n"), 0o644))
+	chdir(t, filepath.Join(dir, "checkout"))
+
+	assert.Error(t, cache.Save(context.Background(), "secrets", []string{"../secrets"}))
+	assert.EqualError(t, cache.Save(context.Background(), "nothing", []string{"missing"}), "None of the paths to cache exist")
+}
+
+func TestNewCache(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		store, compression, err string
+	}{
+		{store: "s3://my-bucket/cache"},
+		{store: "gs://my-bucket/cache", compression: ArtifactCompressionZstd},
+		{store: "rt://my-repo/cache"},
+		{store: "azblob://my-account/my-container"},
+		{store: "/var/cache", err: `Invalid cache store "/var/cache". Only s3://, gs://, rt:// or azblob:// stores are allowed`},
+		{store: "s3://my-bucket", compression: "bzip2", err: `Invalid cache compression "bzip2", expected gzip or zstd`},
+	} {
+		_, err := NewCache(logger.Discard, CacheConfig{Store: tc.store, Compression: tc.compression})
+		if tc.err == "" {
+			assert.NoError(t, err, "NewCache(%q, %q)", tc.store, tc.compression)
+		} else {
+			assert.EqualError(t, err, tc.err, "NewCache(%q, %q)", tc.store, tc.compression)
+		}
+	}
+}
+
+func TestExpandCacheKey(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "web"), 0o777))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "package-lock.json"), []byte("{}\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "web", "package-lock.json"), []byte("{}\n"), 0o644))
+	chdir(t, dir)
+	t.Setenv("BUILDKITE_BRANCH", "main")
+
+	key, err := ExpandCacheKey(`node/{{ .OS }}-{{ .Arch }}/{{ env "BUILDKITE_BRANCH" }}`)
+	require.NoError(t, err)
+	assert.Equal(t, "node/"+runtime.GOOS+"-"+runtime.GOARCH+"/main", key)
+
+	// Checksums change when the files do, and when there are more of them
+	one, err := ExpandCacheKey(`node-{{ checksum "package-lock.json" }}`)
+	require.NoError(t, err)
+	assert.Regexp(t, `^node-[a-f0-9]{64}$`, one)
+
+	all, err := ExpandCacheKey(`node-{{ checksum "**/package-lock.json" }}`)
+	require.NoError(t, err)
+	assert.NotEqual(t, one, all)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "package-lock.json"), []byte("{\"lockfileVersion\": 3}\n"), 0o644))
+	changed, err := ExpandCacheKey(`node-{{ checksum "package-lock.json" }}`)
+	require.NoError(t, err)
+	assert.NotEqual(t, one, changed)
+
+	for _, key := range []string{
+		`node-{{ checksum "yarn.lock" }}`,
+		`{{ env "UNSET_CACHE_KEY_VAR" }}`,
+		`node/../../secrets`,
+		`node key`,
+		`/node`,
+		`{{ .Nope }}`,
+		`{{ checksum }}`,
+	} {
+		_, err := ExpandCacheKey(key)
+		assert.Error(t, err, "ExpandCacheKey(%q)", key)
+	}
+}
@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// How a file was linked into or out of a ContentStore, from cheapest to
+// dearest. Reflinks share blocks until either copy is written to, and copies
+// are, well, copies.
+const (
+	linkMethodReflink = "reflink"
+	linkMethodCopy    = "copy"
+)
+
+var errReflinkUnsupported = errors.New("reflinks aren't supported on this platform")
+
+var contentDigestRegexp = regexp.MustCompile(`^[a-f0-9]+$`)
+
+// ContentStore is a directory of files named by the digest of their contents,
+// that can be shared between the jobs on a host. Files are linked out of it
+// with a reflink where the filesystem supports them, and copied where it
+// doesn't. They're never hardlinked, as a job could then change the store's
+// file by writing to its own.
+type ContentStore struct {
+	dir string
+}
+
+func NewContentStore(dir string) (*ContentStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &ContentStore{dir: dir}, nil
+}
+
+// entryPath returns where the file with digest is kept, spread over
+// directories by the start of the digest
+func (s *ContentStore) entryPath(algorithm, digest string) (string, error) {
+	h, err := newContentHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if len(digest) != h.Size()*2 || !contentDigestRegexp.MatchString(digest) {
+		return "", fmt.Errorf("invalid %s digest %q", algorithm, digest)
+	}
+	return filepath.Join(s.dir, algorithm, digest[:2], digest), nil
+}
+
+// Restore links the file with digest to dst, if it's in the store, returning
+// how it was linked. An entry that isn't size bytes, or that was hardlinked
+// into the store by an older agent and has been changed through the link
+// since, is taken out of the store rather than restored.
+func (s *ContentStore) Restore(algorithm, digest string, size int64, dst string) (method string, ok bool, err error) {
+	entry, err := s.entryPath(algorithm, digest)
+	if err != nil {
+		return "", false, err
+	}
+
+	info, err := os.Stat(entry)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if size >= 0 && info.Size() != size {
+		return "", false, os.Remove(entry)
+	}
+
+	// Older agents hardlinked entries in and made them read only, so the
+	// job that downloaded them had the same file, and could have changed it
+	if info.Mode().Perm()&0o222 == 0 {
+		got, err := fileDigest(algorithm, entry)
+		if err != nil {
+			return "", false, err
+		}
+		if got != digest {
+			return "", false, os.Remove(entry)
+		}
+	}
+
+	method, err = linkFile(entry, dst)
+	if err != nil {
+		return "", false, err
+	}
+	return method, true, nil
+}
+
+// Add links src into the store as the file with digest, if it isn't there
+// already, after checking that's its digest. It's a reflink or copy of src,
+// so changing src afterwards doesn't change the store's.
+func (s *ContentStore) Add(algorithm, digest, src string) error {
+	entry, err := s.entryPath(algorithm, digest)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(entry); err == nil {
+		return nil
+	}
+
+	got, err := fileDigest(algorithm, src)
+	if err != nil {
+		return err
+	}
+	if got != digest {
+		return fmt.Errorf("%s has the %s digest %s, not %s", src, algorithm, got, digest)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(entry), 0o755); err != nil {
+		return err
+	}
+
+	// Link it in somewhere else first, so it's never seen half linked
+	tmpDir, err := os.MkdirTemp(filepath.Dir(entry), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmp := filepath.Join(tmpDir, digest)
+	if _, err := linkFile(src, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, entry)
+}
+
+// linkFile reflinks or copies src to dst, whichever the filesystem allows,
+// replacing dst if it already exists rather than writing through it
+func linkFile(src, dst string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o777); err != nil {
+		return "", err
+	}
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if err := reflinkFile(src, dst); err == nil {
+		return linkMethodReflink, nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		return "", err
+	}
+	return linkMethodCopy, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+func newContentHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+}
+
+func fileDigest(algorithm, path string) (string, error) {
+	h, err := newContentHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentStoreRestoresAddedFiles(t *testing.T) {
+	t.Parallel()
+
+	store, err := NewContentStore(filepath.Join(t.TempDir(), "store"))
+	require.NoError(t, err)
+
+	workspace := t.TempDir()
+	content := []byte("llamas are great")
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+
+	_, ok, err := store.Restore("sha256", digest, int64(len(content)), filepath.Join(workspace, "a", "llamas.txt"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	src := filepath.Join(workspace, "llamas.txt")
+	require.NoError(t, os.WriteFile(src, content, 0o644))
+	require.NoError(t, store.Add("sha256", digest, src))
+
+	dst := filepath.Join(workspace, "b", "llamas.txt")
+	method, ok, err := store.Restore("sha256", digest, int64(len(content)), dst)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Contains(t, []string{linkMethodReflink, linkMethodCopy}, method)
+
+	got, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+}
+
+func TestContentStoreRejectsFilesNotMatchingTheirDigest(t *testing.T) {
+	t.Parallel()
+
+	store, err := NewContentStore(t.TempDir())
+	require.NoError(t, err)
+
+	sum := sha256.Sum256([]byte("llamas are great"))
+	digest := hex.EncodeToString(sum[:])
+
+	src := filepath.Join(t.TempDir(), "alpacas.txt")
+	require.NoError(t, os.WriteFile(src, []byte("alpacas are great"), 0o644))
+
+	assert.ErrorContains(t, store.Add("sha256", digest, src), "not "+digest)
+
+	_, ok, err := store.Restore("sha256", digest, -1, filepath.Join(t.TempDir(), "llamas.txt"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestContentStoreDropsEntriesOfTheWrongSize(t *testing.T) {
+	t.Parallel()
+
+	store, err := NewContentStore(t.TempDir())
+	require.NoError(t, err)
+
+	content := []byte("llamas are great")
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+
+	src := filepath.Join(t.TempDir(), "llamas.txt")
+	require.NoError(t, os.WriteFile(src, content, 0o644))
+	require.NoError(t, store.Add("sha256", digest, src))
+
+	_, ok, err := store.Restore("sha256", digest, 100, filepath.Join(t.TempDir(), "llamas.txt"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, ok, err = store.Restore("sha256", digest, int64(len(content)), filepath.Join(t.TempDir(), "llamas.txt"))
+	require.NoError(t, err)
+	assert.False(t, ok, "the entry should have been dropped")
+}
+
+func TestContentStoreEntriesArentChangedThroughTheWorkspace(t *testing.T) {
+	t.Parallel()
+
+	store, err := NewContentStore(t.TempDir())
+	require.NoError(t, err)
+
+	content := []byte("llamas are great")
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+
+	// The job rewrites the file it downloaded in place, at the same size
+	src := filepath.Join(t.TempDir(), "llamas.txt")
+	require.NoError(t, os.WriteFile(src, content, 0o644))
+	require.NoError(t, store.Add("sha256", digest, src))
+	require.NoError(t, os.WriteFile(src, []byte("llamas are grim"), 0o644))
+
+	info, err := os.Stat(src)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o644), info.Mode().Perm(), "the job's own file should be left writable")
+
+	dst := filepath.Join(t.TempDir(), "llamas.txt")
+	_, ok, err := store.Restore("sha256", digest, int64(len(content)), dst)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	got, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+}
+
+func TestContentStoreDropsChangedHardlinkedEntries(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	store, err := NewContentStore(dir)
+	require.NoError(t, err)
+
+	content := []byte("llamas are great")
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+
+	// An older agent hardlinked the entry in, and the job changed it
+	// through the link, keeping its size
+	entry := filepath.Join(dir, "sha256", digest[:2], digest)
+	require.NoError(t, os.MkdirAll(filepath.Dir(entry), 0o755))
+	require.NoError(t, os.WriteFile(entry, []byte("llamas are grim!"), 0o444))
+
+	_, ok, err := store.Restore("sha256", digest, int64(len(content)), filepath.Join(t.TempDir(), "llamas.txt"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = os.Stat(entry)
+	assert.True(t, os.IsNotExist(err), "the entry should have been dropped")
+}
+
+func TestContentStoreRejectsInvalidDigests(t *testing.T) {
+	t.Parallel()
+
+	store, err := NewContentStore(t.TempDir())
+	require.NoError(t, err)
+
+	for _, test := range []struct{ algorithm, digest string }{
+		{"sha256", "../../etc/passwd"},
+		{"sha256", "abc123"},
+		{"sha1", "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed2aae6c35c94fcfb415dbe95f"},
+		{"md5", "5d41402abc4b2a76b9719d911017c592"},
+	} {
+		_, _, err := store.Restore(test.algorithm, test.digest, -1, filepath.Join(t.TempDir(), "file"))
+		assert.Error(t, err, "%s %s", test.algorithm, test.digest)
+	}
+}
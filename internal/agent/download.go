@@ -2,6 +2,7 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -33,6 +34,10 @@ type DownloadConfig struct {
 
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// If set, the downloaded file is streamed to this instead of being
+	// written to Path
+	Stream func(io.Reader) error
 }
 
 type Download struct {
@@ -61,6 +66,10 @@ func (d Download) Start(ctx context.Context) error {
 	).DoWithContext(ctx, func(r *roko.Retrier) error {
 		if err := d.try(ctx); err != nil {
 			d.logger.Warn("Error trying to download %s (%s) %s", d.conf.URL, err, r)
+			// It's not going to be there next time either
+			if isDownloadNotFound(err) {
+				r.Break()
+			}
 			return err
 		}
 		return nil
@@ -130,7 +139,16 @@ func (d Download) try(ctx context.Context) error {
 			}
 		}
 
-		return &downloadError{response.Status}
+		return &downloadError{s: response.Status, statusCode: response.StatusCode}
+	}
+
+	if d.conf.Stream != nil {
+		if err := d.conf.Stream(response.Body); err != nil {
+			return fmt.Errorf("Error when streaming data %s (%T: %v)", d.conf.URL, err, err)
+		}
+
+		d.logger.Info("Successfully streamed \"%s\"", d.conf.Path)
+		return nil
 	}
 
 	// Now make the folder for our file
@@ -158,9 +176,17 @@ func (d Download) try(ctx context.Context) error {
 }
 
 type downloadError struct {
-	s string
+	s          string
+	statusCode int
 }
 
 func (e *downloadError) Error() string {
 	return e.s
 }
+
+// isDownloadNotFound returns whether a download failed because there wasn't
+// anything at its URL
+func isDownloadNotFound(err error) bool {
+	var derr *downloadError
+	return errors.As(err, &derr) && derr.statusCode == http.StatusNotFound
+}
@@ -0,0 +1,203 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+const defaultGitHubAPIURL = "https://api.github.com"
+
+type GitHubReleaseUploaderConfig struct {
+	// The destination which includes the repository and the release's tag.
+	// For example, github://my-org/my-repo/v1.2.3
+	Destination string
+
+	// The token to authenticate to GitHub with
+	Token string
+
+	// The URL of the GitHub API, for GitHub Enterprise
+	APIURL string
+
+	// Whether or not HTTP calls should be debugged
+	DebugHTTP bool
+}
+
+// GitHubReleaseUploader uploads files as the assets of a GitHub release,
+// creating the release if it doesn't exist yet
+type GitHubReleaseUploader struct {
+	// The repository, like my-org/my-repo
+	Repository string
+
+	// The tag of the release
+	Tag string
+
+	// The release being uploaded to
+	release githubRelease
+
+	// The GitHub client to use
+	client *http.Client
+
+	// The configuration
+	conf GitHubReleaseUploaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+}
+
+type githubRelease struct {
+	ID        int64  `json:"id"`
+	HTMLURL   string `json:"html_url"`
+	UploadURL string `json:"upload_url"`
+}
+
+type githubReleaseAsset struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+func NewGitHubReleaseUploader(l logger.Logger, c GitHubReleaseUploaderConfig) (*GitHubReleaseUploader, error) {
+	repo, tag, err := ParseGitHubReleaseDestination(c.Destination)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token == "" {
+		return nil, errors.New("Must set a GitHub token when using a github:// destination")
+	}
+	if c.APIURL == "" {
+		c.APIURL = defaultGitHubAPIURL
+	}
+
+	u := &GitHubReleaseUploader{
+		logger:     l,
+		conf:       c,
+		client:     &http.Client{},
+		Repository: repo,
+		Tag:        tag,
+	}
+
+	// Find the release up front, so its assets' URLs are known before
+	// they're uploaded
+	if err := u.findOrCreateRelease(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// ParseGitHubReleaseDestination returns the repository and the tag of the
+// release in a destination like github://my-org/my-repo/v1.2.3
+func ParseGitHubReleaseDestination(destination string) (repo string, tag string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(destination, "github://"), "/", 3)
+	if len(parts) < 3 || parts[0] == "" || parts[1] == "" || strings.Trim(parts[2], "/") == "" {
+		return "", "", fmt.Errorf("Invalid GitHub release destination %q, expected github://owner/repo/tag", destination)
+	}
+	return parts[0] + "/" + parts[1], strings.Trim(parts[2], "/"), nil
+}
+
+func (u *GitHubReleaseUploader) URL(artifact *api.Artifact) string {
+	base := strings.Replace(u.release.HTMLURL, "/releases/tag/", "/releases/download/", 1)
+	return base + "/" + url.PathEscape(artifact.Path)
+}
+
+func (u *GitHubReleaseUploader) Upload(artifact *api.Artifact) error {
+	// Replace the asset if it's already been uploaded, as GitHub won't
+	var assets []githubReleaseAsset
+	if err := u.do("GET", u.apiURL("releases/%d/assets?per_page=100", u.release.ID), nil, &assets); err != nil {
+		return err
+	}
+	for _, asset := range assets {
+		if asset.Name == artifact.Path {
+			u.logger.Debug("Replacing the existing asset %q", asset.Name)
+			if err := u.do("DELETE", u.apiURL("releases/assets/%d", asset.ID), nil, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+	}
+	defer f.Close()
+
+	uploadURL := u.release.UploadURL
+	if i := strings.Index(uploadURL, "{"); i >= 0 {
+		uploadURL = uploadURL[:i]
+	}
+	uploadURL += "?name=" + url.QueryEscape(artifact.Path)
+
+	u.logger.Debug("Uploading \"%s\" to release %s of %s", artifact.Path, u.Tag, u.Repository)
+
+	req, err := http.NewRequest("POST", uploadURL, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = artifact.FileSize
+	req.Header.Set("Content-Type", artifact.ContentType)
+	return u.send(req, nil)
+}
+
+// findOrCreateRelease finds the release with the tag, or creates it
+func (u *GitHubReleaseUploader) findOrCreateRelease() error {
+	err := u.do("GET", u.apiURL("releases/tags/%s", url.PathEscape(u.Tag)), nil, &u.release)
+	var respErr *httpResponseError
+	if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusNotFound {
+		return err
+	}
+
+	u.logger.Info("Creating release %s of %s", u.Tag, u.Repository)
+	return u.do("POST", u.apiURL("releases"), map[string]string{"tag_name": u.Tag}, &u.release)
+}
+
+func (u *GitHubReleaseUploader) apiURL(format string, args ...any) string {
+	return strings.TrimSuffix(u.conf.APIURL, "/") + "/repos/" + u.Repository + "/" + fmt.Sprintf(format, args...)
+}
+
+func (u *GitHubReleaseUploader) do(method, url string, body, result any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return u.send(req, result)
+}
+
+func (u *GitHubReleaseUploader) send(req *http.Request, result any) error {
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+u.conf.Token)
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := checkHTTPResponse(res); err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
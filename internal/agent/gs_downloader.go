@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/buildkite/agent/v3/logger"
@@ -26,6 +27,10 @@ type GSDownloaderConfig struct {
 
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// If set, the downloaded file is streamed to this instead of being
+	// written to Path
+	Stream func(io.Reader) error
 }
 
 type GSDownloader struct {
@@ -58,6 +63,7 @@ func (d GSDownloader) Start(ctx context.Context) error {
 		Destination: d.conf.Destination,
 		Retries:     d.conf.Retries,
 		DebugHTTP:   d.conf.DebugHTTP,
+		Stream:      d.conf.Stream,
 	}).Start(ctx)
 }
 
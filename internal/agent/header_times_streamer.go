@@ -7,8 +7,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/buildkite/agent/v3/internal/status"
 	"github.com/buildkite/agent/v3/logger"
-	"github.com/buildkite/agent/v3/status"
 )
 
 type headerTimesStreamer struct {
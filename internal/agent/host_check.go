@@ -0,0 +1,17 @@
+package agent
+
+// HostCheck is the result of checking the host for something that running
+// jobs needs or benefits from
+type HostCheck struct {
+	// What was checked, like "user namespaces"
+	Name string
+
+	// Whether the host has it
+	OK bool
+
+	// Whether jobs can't run without it
+	Required bool
+
+	// What was found, or how to fix it
+	Detail string
+}
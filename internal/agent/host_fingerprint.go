@@ -0,0 +1,213 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// The kernel settings that most often explain a build behaving differently
+// on one host
+var fingerprintSysctls = map[string][]string{
+	"linux": {
+		"fs.file-max",
+		"fs.inotify.max_user_watches",
+		"kernel.pid_max",
+		"net.core.somaxconn",
+		"vm.max_map_count",
+		"vm.overcommit_memory",
+	},
+	"darwin": {
+		"kern.maxfiles",
+		"kern.maxfilesperproc",
+		"kern.maxproc",
+	},
+}
+
+// HostFingerprint describes the parts of a host that builds most often
+// depend on, so hosts that should be the same can be compared
+type HostFingerprint struct {
+	OS       string            `json:"os"`
+	Arch     string            `json:"arch"`
+	Kernel   string            `json:"kernel"`
+	Packages map[string]string `json:"packages"`
+	Sysctls  map[string]string `json:"sysctls"`
+}
+
+// FingerprintHost returns the fingerprint of the host the agent is running on
+func FingerprintHost(ctx context.Context) HostFingerprint {
+	return hostFingerprinter{
+		goos:     runtime.GOOS,
+		goarch:   runtime.GOARCH,
+		readFile: os.ReadFile,
+		run: func(ctx context.Context, args ...string) (string, error) {
+			if _, err := exec.LookPath(args[0]); err != nil {
+				return "", err
+			}
+			out, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+			return string(out), err
+		},
+	}.fingerprint(ctx)
+}
+
+type hostFingerprinter struct {
+	goos, goarch string
+	readFile     func(string) ([]byte, error)
+	run          func(context.Context, ...string) (string, error)
+}
+
+func (f hostFingerprinter) fingerprint(ctx context.Context) HostFingerprint {
+	fp := HostFingerprint{
+		OS:       f.osVersion(ctx),
+		Arch:     f.goarch,
+		Kernel:   f.kernelVersion(ctx),
+		Packages: detectToolchains(ctx, f.goos, f.run),
+		Sysctls:  map[string]string{},
+	}
+
+	for _, name := range fingerprintSysctls[f.goos] {
+		if value, ok := f.sysctl(ctx, name); ok {
+			fp.Sysctls[name] = value
+		}
+	}
+	return fp
+}
+
+func (f hostFingerprinter) osVersion(ctx context.Context) string {
+	switch f.goos {
+	case "linux":
+		if data, err := f.readFile("/etc/os-release"); err == nil {
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			for scanner.Scan() {
+				if line := scanner.Text(); strings.HasPrefix(line, "PRETTY_NAME=") {
+					return strings.Trim(strings.TrimPrefix(line, "PRETTY_NAME="), `"'`)
+				}
+			}
+		}
+
+	case "darwin":
+		if out, err := f.run(ctx, "sw_vers", "-productVersion"); err == nil {
+			return "macOS " + strings.TrimSpace(out)
+		}
+	}
+	return f.goos
+}
+
+func (f hostFingerprinter) kernelVersion(ctx context.Context) string {
+	switch f.goos {
+	case "linux":
+		if data, err := f.readFile("/proc/sys/kernel/osrelease"); err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	case "windows":
+		return ""
+	}
+	if out, err := f.run(ctx, "uname", "-r"); err == nil {
+		return strings.TrimSpace(out)
+	}
+	return ""
+}
+
+func (f hostFingerprinter) sysctl(ctx context.Context, name string) (string, bool) {
+	if f.goos == "linux" {
+		data, err := f.readFile("/proc/sys/" + strings.ReplaceAll(name, ".", "/"))
+		if err != nil {
+			return "", false
+		}
+		return strings.Join(strings.Fields(string(data)), " "), true
+	}
+
+	out, err := f.run(ctx, "sysctl", "-n", name)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(out), true
+}
+
+// Hash returns a short hash of the fingerprint, which is the same for hosts
+// with the same fingerprint
+func (fp HostFingerprint) Hash() string {
+	// Maps are marshalled with their keys sorted, so this is stable
+	data, _ := json.Marshal(fp)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Diff describes how the fingerprint differs from a baseline, e.g.
+// "kernel: 6.1.0 (baseline 5.15.0)", sorted by what differs
+func (fp HostFingerprint) Diff(baseline HostFingerprint) []string {
+	current, base := fp.flatten(), baseline.flatten()
+
+	names := map[string]bool{}
+	for name := range current {
+		names[name] = true
+	}
+	for name := range base {
+		names[name] = true
+	}
+
+	var diffs []string
+	for name := range names {
+		is, was := current[name], base[name]
+		switch {
+		case is == was:
+			continue
+		case was == "":
+			diffs = append(diffs, fmt.Sprintf("%s: %s (not in baseline)", name, is))
+		case is == "":
+			diffs = append(diffs, fmt.Sprintf("%s: missing (baseline %s)", name, was))
+		default:
+			diffs = append(diffs, fmt.Sprintf("%s: %s (baseline %s)", name, is, was))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+func (fp HostFingerprint) flatten() map[string]string {
+	flat := map[string]string{
+		"os":     fp.OS,
+		"arch":   fp.Arch,
+		"kernel": fp.Kernel,
+	}
+	for name, version := range fp.Packages {
+		flat["packages."+name] = version
+	}
+	for name, value := range fp.Sysctls {
+		flat["sysctls."+name] = value
+	}
+	return flat
+}
+
+// LoadHostFingerprint reads a fingerprint written by WriteHostFingerprint
+func LoadHostFingerprint(path string) (HostFingerprint, error) {
+	var fp HostFingerprint
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fp, err
+	}
+	if err := json.Unmarshal(data, &fp); err != nil {
+		return fp, fmt.Errorf("parsing host fingerprint %s: %w", path, err)
+	}
+	return fp, nil
+}
+
+// WriteHostFingerprint writes the fingerprint to path as JSON, so it can be
+// used as the baseline for other hosts
+func WriteHostFingerprint(path string, fp HostFingerprint) error {
+	data, err := json.MarshalIndent(fp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
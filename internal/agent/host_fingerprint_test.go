@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprintingLinuxHost(t *testing.T) {
+	files := map[string]string{
+		"/etc/os-release":                       "NAME=\"Ubuntu\"\nPRETTY_NAME=\"Ubuntu 22.04.3 LTS\"\n",
+		"/proc/sys/kernel/osrelease":            "5.15.0-1047-aws\n",
+		"/proc/sys/vm/max_map_count":            "65530\n",
+		"/proc/sys/fs/inotify/max_user_watches": "8192\n",
+	}
+
+	f := hostFingerprinter{
+		goos:   "linux",
+		goarch: "amd64",
+		readFile: func(path string) ([]byte, error) {
+			if data, ok := files[path]; ok {
+				return []byte(data), nil
+			}
+			return nil, os.ErrNotExist
+		},
+		run: func(_ context.Context, args ...string) (string, error) {
+			if args[0] == "git" {
+				return "git version 2.39.2", nil
+			}
+			return "", errors.New("not found")
+		},
+	}
+
+	assert.Equal(t, HostFingerprint{
+		OS:       "Ubuntu 22.04.3 LTS",
+		Arch:     "amd64",
+		Kernel:   "5.15.0-1047-aws",
+		Packages: map[string]string{"git": "2.39.2"},
+		Sysctls: map[string]string{
+			"vm.max_map_count":            "65530",
+			"fs.inotify.max_user_watches": "8192",
+		},
+	}, f.fingerprint(context.Background()))
+}
+
+func TestHostFingerprintDiff(t *testing.T) {
+	baseline := HostFingerprint{
+		OS:       "Ubuntu 22.04.3 LTS",
+		Arch:     "amd64",
+		Kernel:   "5.15.0",
+		Packages: map[string]string{"git": "2.39.2", "docker": "24.0.5"},
+		Sysctls:  map[string]string{"vm.max_map_count": "65530"},
+	}
+
+	assert.Empty(t, baseline.Diff(baseline))
+
+	current := HostFingerprint{
+		OS:       "Ubuntu 22.04.3 LTS",
+		Arch:     "amd64",
+		Kernel:   "6.2.0",
+		Packages: map[string]string{"git": "2.39.2", "node": "18.17.0"},
+		Sysctls:  map[string]string{"vm.max_map_count": "262144"},
+	}
+
+	assert.NotEqual(t, baseline.Hash(), current.Hash())
+	assert.Equal(t, []string{
+		"kernel: 6.2.0 (baseline 5.15.0)",
+		"packages.docker: missing (baseline 24.0.5)",
+		"packages.node: 18.17.0 (not in baseline)",
+		"sysctls.vm.max_map_count: 262144 (baseline 65530)",
+	}, current.Diff(baseline))
+}
+
+func TestHostFingerprintRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	fp := HostFingerprint{
+		OS:       "macOS 14.0",
+		Arch:     "arm64",
+		Kernel:   "23.0.0",
+		Packages: map[string]string{"xcode": "15.0"},
+		Sysctls:  map[string]string{"kern.maxfiles": "245760"},
+	}
+
+	require.NoError(t, WriteHostFingerprint(path, fp))
+
+	loaded, err := LoadHostFingerprint(path)
+	require.NoError(t, err)
+	assert.Equal(t, fp, loaded)
+	assert.Equal(t, fp.Hash(), loaded.Hash())
+}
@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+type HTTPUploaderConfig struct {
+	// The URL the files are put under. For example,
+	// https://releases.example.com/my-app
+	Destination string
+
+	// Headers to send with each request, like "Authorization: Bearer xyz"
+	Headers []string
+
+	// Whether or not HTTP calls should be debugged
+	DebugHTTP bool
+}
+
+// HTTPUploader uploads each file with a PUT request to its URL under the
+// destination, with its SHA-256 checksum in the X-Checksum-SHA256 header
+type HTTPUploader struct {
+	// The URL the files are put under
+	baseURL *url.URL
+
+	// The headers to send with each request
+	headers http.Header
+
+	// The HTTP client to use
+	client *http.Client
+
+	// The configuration
+	conf HTTPUploaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+}
+
+func NewHTTPUploader(l logger.Logger, c HTTPUploaderConfig) (*HTTPUploader, error) {
+	baseURL, err := url.Parse(c.Destination)
+	if err != nil {
+		return nil, err
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, fmt.Errorf("Invalid HTTP destination %q, expected an http:// or https:// URL", c.Destination)
+	}
+
+	headers := http.Header{}
+	for _, h := range c.Headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("Invalid header %q, expected a header like \"Name: value\"", h)
+		}
+		headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	return &HTTPUploader{
+		logger:  l,
+		conf:    c,
+		client:  &http.Client{},
+		baseURL: baseURL,
+		headers: headers,
+	}, nil
+}
+
+func (u *HTTPUploader) URL(artifact *api.Artifact) string {
+	url := *u.baseURL
+	url.Path = strings.TrimSuffix(url.Path, "/") + "/" + artifact.Path
+	url.RawPath = ""
+	return url.String()
+}
+
+func (u *HTTPUploader) Upload(artifact *api.Artifact) error {
+	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+	}
+	defer f.Close()
+
+	u.logger.Debug("Uploading \"%s\" to `%s`", artifact.Path, u.URL(artifact))
+
+	req, err := http.NewRequest("PUT", u.URL(artifact), f)
+	if err != nil {
+		return err
+	}
+	req.Header = u.headers.Clone()
+	req.ContentLength = artifact.FileSize
+	req.Header.Set("Content-Type", artifact.ContentType)
+	if artifact.Sha256Sum != "" {
+		req.Header.Set("X-Checksum-SHA256", artifact.Sha256Sum)
+	}
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return checkHTTPResponse(res)
+}
+
+// httpResponseError is a response with a status outside the 200 range
+type httpResponseError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *httpResponseError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("%s %s: %d", e.Method, e.URL, e.StatusCode)
+	}
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
+// checkHTTPResponse returns an error with the start of the response's body if
+// its status is outside the 200 range. Unlike checkResponse, the body can be
+// anything.
+func checkHTTPResponse(r *http.Response) error {
+	if c := r.StatusCode; 200 <= c && c <= 299 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(r.Body, 1024))
+	return &httpResponseError{
+		Method:     r.Request.Method,
+		URL:        r.Request.URL.String(),
+		StatusCode: r.StatusCode,
+		Body:       strings.TrimSpace(string(body)),
+	}
+}
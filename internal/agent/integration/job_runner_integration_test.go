@@ -0,0 +1,414 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/experiments"
+	"github.com/buildkite/agent/v3/internal/metrics"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/bintest/v3"
+)
+
+func TestJobRunner_WhenJobHasToken_ItOverridesAccessToken(t *testing.T) {
+	agentAccessToken := "llamasrock"
+	jobToken := "actually-llamas-are-only-okay"
+
+	ag := &api.AgentRegisterResponse{
+		AccessToken: agentAccessToken,
+	}
+
+	j := &api.Job{
+		ID:                 "my-job-id",
+		ChunksMaxSizeBytes: 1024,
+		Token:              jobToken,
+		Env: map[string]string{
+			"BUILDKITE_COMMAND": "echo hello world",
+		},
+	}
+
+	cfg := agent.AgentConfiguration{}
+
+	runJob(t, ag, j, cfg, func(c *bintest.Call) {
+		if got, want := c.GetEnv("BUILDKITE_AGENT_ACCESS_TOKEN"), jobToken; got != want {
+			t.Errorf("c.GetEnv(BUILDKITE_AGENT_ACCESS_TOKEN) = %q, want %q", got, want)
+		}
+		c.Exit(0)
+	})
+}
+
+func TestJobRunnerPassesAccessTokenToBootstrap(t *testing.T) {
+	ag := &api.AgentRegisterResponse{
+		AccessToken: "llamasrock",
+	}
+
+	j := &api.Job{
+		ID:                 "my-job-id",
+		ChunksMaxSizeBytes: 1024,
+		Env: map[string]string{
+			"BUILDKITE_COMMAND": "echo hello world",
+		},
+	}
+
+	cfg := agent.AgentConfiguration{}
+
+	runJob(t, ag, j, cfg, func(c *bintest.Call) {
+		if got, want := c.GetEnv("BUILDKITE_AGENT_ACCESS_TOKEN"), "llamasrock"; got != want {
+			t.Errorf("c.GetEnv(BUILDKITE_AGENT_ACCESS_TOKEN) = %q, want %q", got, want)
+		}
+		c.Exit(0)
+	})
+}
+
+func TestJobRunnerIgnoresPipelineChangesToProtectedVars(t *testing.T) {
+	ag := &api.AgentRegisterResponse{
+		AccessToken: "llamasrock",
+	}
+
+	j := &api.Job{
+		ID:                 "my-job-id",
+		ChunksMaxSizeBytes: 1024,
+		Env: map[string]string{
+			"BUILDKITE_COMMAND":      "echo hello world",
+			"BUILDKITE_COMMAND_EVAL": "false",
+		},
+	}
+
+	cfg := agent.AgentConfiguration{
+		CommandEval: true,
+	}
+
+	runJob(t, ag, j, cfg, func(c *bintest.Call) {
+		if got, want := c.GetEnv("BUILDKITE_COMMAND_EVAL"), "true"; got != want {
+			t.Errorf("c.GetEnv(BUILDKITE_COMMAND_EVAL) = %q, want %q", got, want)
+		}
+		c.Exit(0)
+	})
+
+}
+
+func TestJobRunnerPassesAttestationStatusToBootstrap(t *testing.T) {
+	ag := &api.AgentRegisterResponse{
+		AccessToken:       "llamasrock",
+		AttestationStatus: "verified",
+	}
+
+	j := &api.Job{
+		ID:                 "my-job-id",
+		ChunksMaxSizeBytes: 1024,
+		Env: map[string]string{
+			"BUILDKITE_COMMAND":           "echo hello world",
+			"BUILDKITE_AGENT_ATTESTATION": "forged",
+		},
+	}
+
+	runJob(t, ag, j, agent.AgentConfiguration{}, func(c *bintest.Call) {
+		if got, want := c.GetEnv("BUILDKITE_AGENT_ATTESTATION"), "verified"; got != want {
+			t.Errorf("c.GetEnv(BUILDKITE_AGENT_ATTESTATION) = %q, want %q", got, want)
+		}
+		c.Exit(0)
+	})
+}
+
+func TestJobRunnerDoesntPassJobAttestationStatusWithoutAttestation(t *testing.T) {
+	ag := &api.AgentRegisterResponse{
+		AccessToken: "llamasrock",
+	}
+
+	j := &api.Job{
+		ID:                 "my-job-id",
+		ChunksMaxSizeBytes: 1024,
+		Env: map[string]string{
+			"BUILDKITE_COMMAND":           "echo hello world",
+			"BUILDKITE_AGENT_ATTESTATION": "verified",
+		},
+	}
+
+	runJob(t, ag, j, agent.AgentConfiguration{}, func(c *bintest.Call) {
+		if got, want := c.GetEnv("BUILDKITE_AGENT_ATTESTATION"), ""; got != want {
+			t.Errorf("c.GetEnv(BUILDKITE_AGENT_ATTESTATION) = %q, want %q", got, want)
+		}
+		c.Exit(0)
+	})
+}
+
+func TestJobRunnerIgnoresJobPermissionsPolicyWhenAgentHasNone(t *testing.T) {
+	ag := &api.AgentRegisterResponse{
+		AccessToken: "llamasrock",
+	}
+
+	j := &api.Job{
+		ID:                 "my-job-id",
+		ChunksMaxSizeBytes: 1024,
+		Env: map[string]string{
+			"BUILDKITE_COMMAND":            "echo hello world",
+			"BUILDKITE_JOB_UMASK":          "000",
+			"BUILDKITE_JOB_DIRECTORY_MODE": "0777",
+		},
+	}
+
+	runJob(t, ag, j, agent.AgentConfiguration{}, func(c *bintest.Call) {
+		for _, name := range []string{"BUILDKITE_JOB_UMASK", "BUILDKITE_JOB_DIRECTORY_MODE"} {
+			if got, want := c.GetEnv(name), ""; got != want {
+				t.Errorf("c.GetEnv(%s) = %q, want %q", name, got, want)
+			}
+		}
+		c.Exit(0)
+	})
+}
+
+func TestJobRunnerIgnoresJobFailureBundleMaxSizeWhenAgentHasNone(t *testing.T) {
+	ag := &api.AgentRegisterResponse{
+		AccessToken: "llamasrock",
+	}
+
+	j := &api.Job{
+		ID:                 "my-job-id",
+		ChunksMaxSizeBytes: 1024,
+		Env: map[string]string{
+			"BUILDKITE_COMMAND":                 "echo hello world",
+			"BUILDKITE_FAILURE_BUNDLE_MAX_SIZE": "999999999999",
+		},
+	}
+
+	runJob(t, ag, j, agent.AgentConfiguration{}, func(c *bintest.Call) {
+		if got, want := c.GetEnv("BUILDKITE_FAILURE_BUNDLE_MAX_SIZE"), ""; got != want {
+			t.Errorf("c.GetEnv(BUILDKITE_FAILURE_BUNDLE_MAX_SIZE) = %q, want %q", got, want)
+		}
+		c.Exit(0)
+	})
+}
+
+func TestJobRunnerIgnoresJobHostFingerprintWhenAgentHasNone(t *testing.T) {
+	ag := &api.AgentRegisterResponse{
+		AccessToken: "llamasrock",
+	}
+
+	j := &api.Job{
+		ID:                 "my-job-id",
+		ChunksMaxSizeBytes: 1024,
+		Env: map[string]string{
+			"BUILDKITE_COMMAND":                "echo hello world",
+			"BUILDKITE_AGENT_HOST_FINGERPRINT": "sha256:forged",
+			"BUILDKITE_AGENT_HOST_DRIFT":       "kernel: 6.1 -> 6.2",
+		},
+	}
+
+	runJob(t, ag, j, agent.AgentConfiguration{}, func(c *bintest.Call) {
+		for _, name := range []string{"BUILDKITE_AGENT_HOST_FINGERPRINT", "BUILDKITE_AGENT_HOST_DRIFT"} {
+			if got, want := c.GetEnv(name), ""; got != want {
+				t.Errorf("c.GetEnv(%s) = %q, want %q", name, got, want)
+			}
+		}
+		c.Exit(0)
+	})
+}
+
+func TestJobRunnerDoesntPassJobAccessTokenWhenTheJobAPIHasIt(t *testing.T) {
+	experiments.Enable("job-api")
+	defer experiments.Disable("job-api")
+
+	ag := &api.AgentRegisterResponse{
+		AccessToken: "llamasrock",
+	}
+
+	j := &api.Job{
+		ID:                 "my-job-id",
+		ChunksMaxSizeBytes: 1024,
+		Env: map[string]string{
+			"BUILDKITE_COMMAND":            "echo hello world",
+			"BUILDKITE_AGENT_ACCESS_TOKEN": "forged",
+		},
+	}
+
+	runJob(t, ag, j, agent.AgentConfiguration{}, func(c *bintest.Call) {
+		if got, want := c.GetEnv("BUILDKITE_AGENT_ACCESS_TOKEN"), ""; got != want {
+			t.Errorf("c.GetEnv(BUILDKITE_AGENT_ACCESS_TOKEN) = %q, want %q", got, want)
+		}
+		if c.GetEnv("BUILDKITE_AGENT_JOB_API_SOCKET") == "" {
+			t.Errorf("c.GetEnv(BUILDKITE_AGENT_JOB_API_SOCKET) = %q, want the job API's socket", "")
+		}
+		c.Exit(0)
+	})
+}
+
+func TestJobRunnerIgnoresJobAPISocketWithoutJobAPI(t *testing.T) {
+	ag := &api.AgentRegisterResponse{
+		AccessToken: "llamasrock",
+	}
+
+	j := &api.Job{
+		ID:                 "my-job-id",
+		ChunksMaxSizeBytes: 1024,
+		Env: map[string]string{
+			"BUILDKITE_COMMAND":              "echo hello world",
+			"BUILDKITE_AGENT_JOB_API_SOCKET": "/tmp/evil.sock",
+		},
+	}
+
+	runJob(t, ag, j, agent.AgentConfiguration{}, func(c *bintest.Call) {
+		if got, want := c.GetEnv("BUILDKITE_AGENT_JOB_API_SOCKET"), ""; got != want {
+			t.Errorf("c.GetEnv(BUILDKITE_AGENT_JOB_API_SOCKET) = %q, want %q", got, want)
+		}
+		c.Exit(0)
+	})
+}
+
+func TestJobRunnerIgnoresJobDNSSettingsWhenAgentHasNone(t *testing.T) {
+	ag := &api.AgentRegisterResponse{
+		AccessToken: "llamasrock",
+	}
+
+	j := &api.Job{
+		ID:                 "my-job-id",
+		ChunksMaxSizeBytes: 1024,
+		Env: map[string]string{
+			"BUILDKITE_COMMAND":             "echo hello world",
+			"BUILDKITE_AGENT_DNS_OVERRIDES": "agent.buildkite.com=203.0.113.1",
+			"BUILDKITE_AGENT_DNS_RESOLVER":  "203.0.113.53:53",
+		},
+	}
+
+	runJob(t, ag, j, agent.AgentConfiguration{}, func(c *bintest.Call) {
+		for _, name := range []string{"BUILDKITE_AGENT_DNS_OVERRIDES", "BUILDKITE_AGENT_DNS_RESOLVER"} {
+			if got, want := c.GetEnv(name), ""; got != want {
+				t.Errorf("c.GetEnv(%s) = %q, want %q", name, got, want)
+			}
+		}
+		c.Exit(0)
+	})
+}
+
+func TestJobRunnerIgnoresJobStartTimingsFile(t *testing.T) {
+	ag := &api.AgentRegisterResponse{
+		AccessToken: "llamasrock",
+	}
+
+	j := &api.Job{
+		ID:                 "my-job-id",
+		ChunksMaxSizeBytes: 1024,
+		Env: map[string]string{
+			"BUILDKITE_COMMAND":            "echo hello world",
+			"BUILDKITE_START_TIMINGS_FILE": "/etc/passwd",
+		},
+	}
+
+	runJob(t, ag, j, agent.AgentConfiguration{}, func(c *bintest.Call) {
+		if got := c.GetEnv("BUILDKITE_START_TIMINGS_FILE"); got == "/etc/passwd" {
+			t.Errorf("c.GetEnv(BUILDKITE_START_TIMINGS_FILE) = %q, want the agent's file", got)
+		}
+		c.Exit(0)
+	})
+}
+
+func TestJobRunnerIgnoresJobSpilledEnvWhenNothingWasSpilled(t *testing.T) {
+	ag := &api.AgentRegisterResponse{
+		AccessToken: "llamasrock",
+	}
+
+	j := &api.Job{
+		ID:                 "my-job-id",
+		ChunksMaxSizeBytes: 1024,
+		Env: map[string]string{
+			"BUILDKITE_COMMAND":     "echo hello world",
+			"BUILDKITE_SPILLED_ENV": "SSH_PRIVATE_KEY",
+			"SSH_PRIVATE_KEY_FILE":  "/etc/shadow",
+		},
+	}
+
+	runJob(t, ag, j, agent.AgentConfiguration{}, func(c *bintest.Call) {
+		if got, want := c.GetEnv("BUILDKITE_SPILLED_ENV"), ""; got != want {
+			t.Errorf("c.GetEnv(BUILDKITE_SPILLED_ENV) = %q, want %q", got, want)
+		}
+		c.Exit(0)
+	})
+}
+
+func TestJobRunnerIgnoresJobSignalGracePeriod(t *testing.T) {
+	ag := &api.AgentRegisterResponse{
+		AccessToken: "llamasrock",
+	}
+
+	j := &api.Job{
+		ID:                 "my-job-id",
+		ChunksMaxSizeBytes: 1024,
+		Env: map[string]string{
+			"BUILDKITE_COMMAND":                     "echo hello world",
+			"BUILDKITE_SIGNAL_GRACE_PERIOD_SECONDS": "3600",
+		},
+	}
+
+	runJob(t, ag, j, agent.AgentConfiguration{}, func(c *bintest.Call) {
+		if got, want := c.GetEnv("BUILDKITE_SIGNAL_GRACE_PERIOD_SECONDS"), ""; got != want {
+			t.Errorf("c.GetEnv(BUILDKITE_SIGNAL_GRACE_PERIOD_SECONDS) = %q, want %q", got, want)
+		}
+		if got, want := c.GetEnv("BUILDKITE_IGNORED_ENV"), "BUILDKITE_SIGNAL_GRACE_PERIOD_SECONDS"; got != want {
+			t.Errorf("c.GetEnv(BUILDKITE_IGNORED_ENV) = %q, want %q", got, want)
+		}
+		c.Exit(0)
+	})
+}
+
+func runJob(t *testing.T, ag *api.AgentRegisterResponse, j *api.Job, cfg agent.AgentConfiguration, bootstrap func(c *bintest.Call)) {
+	// create a mock agent API
+	server := createTestAgentEndpoint(t, "my-job-id")
+	defer server.Close()
+
+	// set up a mock bootstrap that the runner will call
+	bs, err := bintest.NewMock("buildkite-agent-bootstrap")
+	if err != nil {
+		t.Fatalf("bintest.NewMock() error = %v", err)
+	}
+	defer bs.CheckAndClose(t)
+
+	// execute the callback we have inside the bootstrap mock
+	bs.Expect().Once().AndExitWith(0).AndCallFunc(bootstrap)
+
+	l := logger.Discard
+
+	// minimal metrics, this could be cleaner
+	m := metrics.NewCollector(l, metrics.CollectorConfig{})
+	scope := m.Scope(metrics.Tags{})
+
+	// set the bootstrap into the config
+	cfg.BootstrapScript = bs.Path
+
+	client := api.NewClient(l, api.Config{
+		Endpoint: server.URL,
+		Token:    ag.AccessToken,
+	})
+
+	jr, err := agent.NewJobRunner(l, scope, ag, j, client, agent.JobRunnerConfig{
+		AgentConfiguration: cfg,
+	})
+	if err != nil {
+		t.Fatalf("agent.NewJobRunner() error = %v", err)
+	}
+
+	if err := jr.Run(context.Background()); err != nil {
+		t.Errorf("jr.Run() = %v", err)
+	}
+}
+
+func createTestAgentEndpoint(t *testing.T, jobID string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/jobs/" + jobID:
+			rw.WriteHeader(http.StatusOK)
+			fmt.Fprintf(rw, `{"state":"running"}`)
+		case "/jobs/" + jobID + "/start":
+			rw.WriteHeader(http.StatusOK)
+		case "/jobs/" + jobID + "/chunks":
+			rw.WriteHeader(http.StatusCreated)
+		case "/jobs/" + jobID + "/finish":
+			rw.WriteHeader(http.StatusOK)
+		default:
+			http.Error(rw, fmt.Sprintf("not found; method = %q, path = %q", req.Method, req.URL.Path), http.StatusNotFound)
+		}
+	}))
+}
@@ -0,0 +1,118 @@
+//go:build linux
+// +build linux
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// jobCgroup is a cgroup v2 group that a job's processes are put in, so that
+// their resource usage is accounted for together. It's created under the
+// agent's own group, which needs to have been delegated to the agent's user,
+// as systemd does for services with Delegate=yes.
+//
+// cgroups don't account for network traffic, so that isn't measured.
+type jobCgroup struct {
+	path string
+}
+
+func newJobCgroup(jobID string) (*jobCgroup, error) {
+	self, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, err
+	}
+
+	// On cgroup v2, the agent's group is the only line, like 0::/system.slice/buildkite-agent.service
+	var parent string
+	for _, line := range strings.Split(strings.TrimSpace(string(self)), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			parent = filepath.Join(cgroupRoot, strings.TrimPrefix(line, "0::"))
+		}
+	}
+	if parent == "" {
+		return nil, errors.New("cgroup v2 isn't in use")
+	}
+
+	// Memory and IO are only accounted for if their controllers are enabled
+	// for the parent's children, which fails if the parent has processes in
+	// it, and then only CPU time is measured this way
+	_ = os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+memory +io"), 0)
+
+	c := &jobCgroup{path: filepath.Join(parent, "buildkite-job-"+jobID)}
+	if err := os.Mkdir(c.path, 0755); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *jobCgroup) add(pid int) error {
+	return os.WriteFile(filepath.Join(c.path, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0)
+}
+
+// read sets what the group has used on u, returning false if nothing could be
+// read
+func (c *jobCgroup) read(u *JobUsage) bool {
+	cpu, err := c.stats("cpu.stat")
+	if err != nil {
+		return false
+	}
+	u.CPUSeconds = float64(cpu["usage_usec"]) / 1e6
+
+	if peak, err := os.ReadFile(filepath.Join(c.path, "memory.peak")); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(string(peak)), 10, 64); err == nil {
+			u.PeakRSSBytes = n
+		}
+	}
+
+	if io, err := c.stats("io.stat"); err == nil {
+		u.DiskReadBytes = io["rbytes"]
+		u.DiskWriteBytes = io["wbytes"]
+	}
+	return true
+}
+
+// stats reads a file of stats, in either the flat keyed format of cpu.stat
+// ("usage_usec 123") or the nested keyed format of io.stat
+// ("8:0 rbytes=123 wbytes=456"), summing values with the same key
+func (c *jobCgroup) stats(name string) (map[string]int64, error) {
+	data, err := os.ReadFile(filepath.Join(c.path, name))
+	if err != nil {
+		return nil, err
+	}
+
+	stats := map[string]int64{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && !strings.Contains(fields[1], "=") {
+			n, _ := strconv.ParseInt(fields[1], 10, 64)
+			stats[fields[0]] += n
+			continue
+		}
+		for _, field := range fields {
+			if key, value, ok := strings.Cut(field, "="); ok {
+				n, _ := strconv.ParseInt(value, 10, 64)
+				stats[key] += n
+			}
+		}
+	}
+	return stats, scanner.Err()
+}
+
+// remove deletes the group, which only works once everything in it has exited
+func (c *jobCgroup) remove() error {
+	if err := os.Remove(c.path); err != nil {
+		return fmt.Errorf("removing %s: %w", c.path, err)
+	}
+	return nil
+}
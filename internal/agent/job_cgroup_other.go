@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import "errors"
+
+// jobCgroup is only supported on Linux
+type jobCgroup struct{}
+
+func newJobCgroup(string) (*jobCgroup, error) {
+	return nil, errors.New("cgroups are only supported on Linux")
+}
+
+func (*jobCgroup) add(int) error       { return nil }
+func (*jobCgroup) read(*JobUsage) bool { return false }
+func (*jobCgroup) remove() error       { return nil }
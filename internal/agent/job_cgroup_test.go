@@ -0,0 +1,46 @@
+//go:build linux
+// +build linux
+
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobCgroupRead(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"cpu.stat":    "usage_usec 2500000\nuser_usec 2000000\nsystem_usec 500000\n",
+		"memory.peak": "104857600\n",
+		"io.stat":     "8:0 rbytes=1000 wbytes=2000 rios=1 wios=2 dbytes=0 dios=0\n8:16 rbytes=24 wbytes=48 rios=1 wios=1 dbytes=0 dios=0\n",
+	}
+	for name, data := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(data), 0644))
+	}
+
+	usage := JobUsage{PeakRSSBytes: 1}
+	assert.True(t, (&jobCgroup{path: dir}).read(&usage))
+	assert.Equal(t, JobUsage{
+		CPUSeconds:     2.5,
+		PeakRSSBytes:   104857600,
+		DiskReadBytes:  1024,
+		DiskWriteBytes: 2048,
+	}, usage)
+}
+
+func TestJobCgroupReadWithOnlyCPU(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cpu.stat"), []byte("usage_usec 1000000\n"), 0644))
+
+	// What couldn't be read from the cgroup is left as it was
+	usage := JobUsage{PeakRSSBytes: 4096}
+	assert.True(t, (&jobCgroup{path: dir}).read(&usage))
+	assert.Equal(t, JobUsage{CPUSeconds: 1, PeakRSSBytes: 4096}, usage)
+
+	assert.False(t, (&jobCgroup{path: filepath.Join(dir, "missing")}).read(&usage))
+}
@@ -0,0 +1,276 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Pipelines can allow their jobs to reach more destinations than the agent's
+// allowlist with a comma separated list of CIDRs and domains in
+// BUILDKITE_JOB_EGRESS_ALLOW. It's read when the job starts, so the job's
+// own scripts can't change it.
+const jobEgressAllowEnv = "BUILDKITE_JOB_EGRESS_ALLOW"
+
+// EgressAllowlist is where jobs are allowed to connect to when the agent
+// applies a network egress policy to them
+type EgressAllowlist struct {
+	Prefixes []netip.Prefix
+	Domains  []string
+}
+
+// ParseEgressAllowlist parses CIDRs like 10.0.0.0/8, IP addresses, and
+// domains like github.com
+func ParseEgressAllowlist(entries []string) (EgressAllowlist, error) {
+	var allow EgressAllowlist
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			allow.Prefixes = append(allow.Prefixes, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			allow.Prefixes = append(allow.Prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		if strings.ContainsAny(entry, "/: ") {
+			return allow, fmt.Errorf("invalid egress allowlist entry %q, expected a CIDR, IP address or domain", entry)
+		}
+		allow.Domains = append(allow.Domains, strings.ToLower(strings.TrimSuffix(entry, ".")))
+	}
+	return allow, nil
+}
+
+// Merge returns an allowlist with the entries of both
+func (a EgressAllowlist) Merge(b EgressAllowlist) EgressAllowlist {
+	return EgressAllowlist{
+		Prefixes: append(append([]netip.Prefix{}, a.Prefixes...), b.Prefixes...),
+		Domains:  append(append([]string{}, a.Domains...), b.Domains...),
+	}
+}
+
+// resolve returns the IPv4 prefixes the allowlist allows, with its domains
+// resolved to their addresses now. Domains that can't be resolved are
+// returned separately.
+func (a EgressAllowlist) resolve(ctx context.Context, lookup func(context.Context, string) ([]netip.Addr, error)) ([]netip.Prefix, []string) {
+	seen := map[netip.Prefix]bool{}
+	var prefixes []netip.Prefix
+	add := func(p netip.Prefix) {
+		if p.Addr().Is4() && !seen[p] {
+			seen[p] = true
+			prefixes = append(prefixes, p)
+		}
+	}
+
+	for _, p := range a.Prefixes {
+		add(p)
+	}
+
+	var unresolved []string
+	for _, domain := range a.Domains {
+		addrs, err := lookup(ctx, domain)
+		if err != nil || len(addrs) == 0 {
+			unresolved = append(unresolved, domain)
+			continue
+		}
+		for _, addr := range addrs {
+			addr = addr.Unmap()
+			add(netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+
+	// nftables won't accept a set with overlapping prefixes, so leave out
+	// those within others
+	var merged []netip.Prefix
+	for _, p := range prefixes {
+		contained := false
+		for _, q := range prefixes {
+			if q.Bits() < p.Bits() && q.Contains(p.Addr()) {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			merged = append(merged, p)
+		}
+	}
+
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].String() < merged[j].String()
+	})
+	return merged, unresolved
+}
+
+func lookupIPv4(ctx context.Context, host string) ([]netip.Addr, error) {
+	return net.DefaultResolver.LookupNetIP(ctx, "ip4", host)
+}
+
+// jobEgressAllowlist returns where the job is allowed to connect to: the
+// agent's allowlist, the pipeline's, the Buildkite API, and the job's
+// repository
+func (r *JobRunner) jobEgressAllowlist() (EgressAllowlist, error) {
+	allow := r.conf.AgentConfiguration.JobEgressAllow
+
+	if env := r.job.Env[jobEgressAllowEnv]; env != "" {
+		pipelineAllow, err := ParseEgressAllowlist(strings.Split(env, ","))
+		if err != nil {
+			return allow, fmt.Errorf("%s: %w", jobEgressAllowEnv, err)
+		}
+		allow = allow.Merge(pipelineAllow)
+	}
+
+	var hosts []string
+	if u, err := url.Parse(r.apiClient.Config().Endpoint); err == nil && u.Hostname() != "" {
+		hosts = append(hosts, u.Hostname())
+	}
+	if host := repositoryHost(r.job.Env["BUILDKITE_REPO"]); host != "" {
+		hosts = append(hosts, host)
+	}
+	hostAllow, err := ParseEgressAllowlist(hosts)
+	if err != nil {
+		return allow, err
+	}
+	return allow.Merge(hostAllow), nil
+}
+
+// repositoryHost returns the host of a git repository, which can be a URL or
+// an scp-like address such as git@github.com:org/repo.git
+func repositoryHost(repository string) string {
+	if strings.Contains(repository, "://") {
+		if u, err := url.Parse(repository); err == nil {
+			return u.Hostname()
+		}
+		return ""
+	}
+	if host, _, ok := strings.Cut(repository, ":"); ok {
+		if i := strings.LastIndex(host, "@"); i >= 0 {
+			host = host[i+1:]
+		}
+		return host
+	}
+	return ""
+}
+
+// nameservers returns the IPv4 nameservers in a resolv.conf
+func nameservers(path string) []netip.Addr {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var addrs []netip.Addr
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(fields[1]); err == nil && addr.Is4() {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// egressRuleset returns the nftables ruleset that's applied inside a job's
+// network namespace. Connections to anywhere not allowed are logged with
+// logPrefix, counted, and dropped.
+func egressRuleset(allowed []netip.Prefix, resolvers []netip.Addr, logPrefix string) string {
+	var b strings.Builder
+	b.WriteString("table inet buildkite_egress {\n")
+	b.WriteString("\tcounter blocked {}\n\n")
+	b.WriteString("\tchain output {\n")
+	b.WriteString("\t\ttype filter hook output priority 0; policy drop;\n")
+	b.WriteString("\t\toif \"lo\" accept\n")
+	b.WriteString("\t\tct state established,related accept\n")
+
+	if len(resolvers) > 0 {
+		var addrs []string
+		for _, addr := range resolvers {
+			addrs = append(addrs, addr.String())
+		}
+		fmt.Fprintf(&b, "\t\tip daddr { %s } meta l4proto { tcp, udp } th dport 53 accept\n", strings.Join(addrs, ", "))
+	}
+
+	if len(allowed) > 0 {
+		var prefixes []string
+		for _, p := range allowed {
+			prefixes = append(prefixes, p.String())
+		}
+		fmt.Fprintf(&b, "\t\tip daddr { %s } accept\n", strings.Join(prefixes, ", "))
+	}
+
+	fmt.Fprintf(&b, "\t\tlog prefix %q counter name \"blocked\" drop\n", logPrefix)
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// startJobNetwork sets up a network namespace for the job that only allows
+// it to connect to its allowlist, and returns cmd wrapped to run inside it
+func (r *JobRunner) startJobNetwork(cmd []string) ([]string, error) {
+	allow, err := r.jobEgressAllowlist()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	allowed, unresolved := allow.resolve(ctx, lookupIPv4)
+	for _, domain := range unresolved {
+		fmt.Fprintf(r.output, "Couldn't resolve %s from the egress allowlist, so this job can't connect to it\n", domain)
+	}
+
+	network, err := newJobNetwork(ctx, r.job.ID, allowed)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to set up the job's network egress policy: %w", err)
+	}
+	r.network = network
+	return network.wrap(cmd), nil
+}
+
+// reportBlockedEgress adds how many packets the job's egress policy blocked
+// to its log
+func (r *JobRunner) reportBlockedEgress(ctx context.Context) {
+	if r.network == nil {
+		return
+	}
+
+	blocked, err := r.network.blocked(ctx)
+	if err != nil {
+		r.logger.Warn("[JobRunner] Couldn't count the packets blocked by the job's egress policy: %v", err)
+		return
+	}
+	if blocked == 0 {
+		return
+	}
+
+	r.logger.Warn("[JobRunner] Job %s tried to connect to destinations that aren't allowed, %d packets were blocked", r.job.ID, blocked)
+	fmt.Fprintf(r.output, "This job's network egress policy blocked %d packets to destinations it isn't allowed to connect to. They're in the agent host's kernel log, and can be allowed with %s.\n",
+		blocked, jobEgressAllowEnv)
+	r.metrics.Count("jobs.egress_blocked", int64(blocked))
+}
+
+// closeJobNetwork removes the job's network namespace, if it has one
+func (r *JobRunner) closeJobNetwork(ctx context.Context) {
+	if r.network == nil {
+		return
+	}
+	if err := r.network.close(ctx); err != nil {
+		r.logger.Warn("[JobRunner] %v", err)
+	}
+	r.network = nil
+}
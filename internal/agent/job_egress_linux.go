@@ -0,0 +1,283 @@
+//go:build linux
+// +build linux
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Each job's network namespace is connected to the host by a pair of
+// addresses in a /30 from this range
+var jobNetworkRange = netip.MustParsePrefix("10.213.0.0/16")
+
+var jobNetworkSubnets = struct {
+	sync.Mutex
+	used map[int]bool
+}{used: map[int]bool{}}
+
+// IP forwarding is host-wide, so it's turned on while any job network needs
+// it, and put back the way it was once none do
+var ipForwarding = struct {
+	sync.Mutex
+	users    int
+	previous []byte
+}{}
+
+// The capabilities a job is run without in its namespace. Without
+// CAP_NET_ADMIN it can't change the ruleset that enforces its egress policy,
+// and without the others it can't join or load its way into another network
+// namespace, like the host's with nsenter --net=/proc/1/ns/net.
+var jobNetworkDroppedCaps = []string{"net_admin", "sys_admin", "sys_ptrace", "sys_module"}
+
+// jobNetwork is a network namespace that a job runs in, which only lets it
+// connect to the destinations it's allowed to. Traffic leaves through a veth
+// pair and is masqueraded as the host's. Setting it up needs the ip, nft and
+// setpriv commands, and the agent to be running as root.
+type jobNetwork struct {
+	name   string
+	link   string
+	subnet int
+	run    func(ctx context.Context, stdin string, args ...string) (string, error)
+
+	// Where IP forwarding is turned on and off
+	ipForwardPath string
+
+	// What setup has created so far, so close only removes those, and never
+	// another job's namespace or table
+	createdNetns    bool
+	createdHostLink bool
+	createdTable    bool
+	forwarding      bool
+}
+
+func runNetworkCommand(ctx context.Context, stdin string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// newJobNetwork creates a network namespace for a job, with an nftables
+// ruleset that only allows connections to allowed and the host's nameservers
+func newJobNetwork(ctx context.Context, jobID string, allowed []netip.Prefix) (*jobNetwork, error) {
+	n := newJobNetworkNames(jobID)
+	n.run = runNetworkCommand
+	if err := n.setup(ctx, allowed, nameservers("/etc/resolv.conf")); err != nil {
+		n.close(context.Background())
+		return nil, err
+	}
+	return n, nil
+}
+
+// newJobNetworkNames names a job's namespace after its whole ID, as job IDs
+// are time ordered and jobs started close together share a prefix. Interface
+// names can only be 15 characters, so the veth pair is named after the end of
+// the ID, which is random.
+func newJobNetworkNames(jobID string) *jobNetwork {
+	id := strings.ReplaceAll(jobID, "-", "")
+	link := id
+	if len(link) > 10 {
+		link = link[len(link)-10:]
+	}
+	return &jobNetwork{name: "bk-" + id, link: link, subnet: -1, ipForwardPath: "/proc/sys/net/ipv4/ip_forward"}
+}
+
+func (n *jobNetwork) setup(ctx context.Context, allowed []netip.Prefix, resolvers []netip.Addr) error {
+	jobNetworkSubnets.Lock()
+	for i := 0; i < 1<<(32-jobNetworkRange.Bits()-2); i++ {
+		if !jobNetworkSubnets.used[i] {
+			jobNetworkSubnets.used[i] = true
+			n.subnet = i
+			break
+		}
+	}
+	jobNetworkSubnets.Unlock()
+	if n.subnet < 0 {
+		return fmt.Errorf("no free subnets for job networks in %s", jobNetworkRange)
+	}
+
+	hostAddr, jobAddr := n.addrs()
+	hostLink, jobLink := n.hostLink(), "bkj-"+n.link
+
+	if _, err := n.run(ctx, "", "ip", "netns", "add", n.name); err != nil {
+		return err
+	}
+	n.createdNetns = true
+
+	if _, err := n.run(ctx, "", "ip", "link", "add", hostLink, "type", "veth", "peer", "name", jobLink); err != nil {
+		return err
+	}
+	n.createdHostLink = true
+
+	// Once the job's end is in the namespace, the pair goes when it does
+	if _, err := n.run(ctx, "", "ip", "link", "set", jobLink, "netns", n.name); err != nil {
+		return err
+	}
+	n.createdHostLink = false
+
+	commands := [][]string{
+		{"ip", "addr", "add", hostAddr.String() + "/30", "dev", hostLink},
+		{"ip", "link", "set", hostLink, "up"},
+		{"ip", "-n", n.name, "addr", "add", jobAddr.String() + "/30", "dev", jobLink},
+		{"ip", "-n", n.name, "link", "set", jobLink, "up"},
+		{"ip", "-n", n.name, "link", "set", "lo", "up"},
+		{"ip", "-n", n.name, "route", "add", "default", "via", hostAddr.String()},
+	}
+	for _, args := range commands {
+		if _, err := n.run(ctx, "", args...); err != nil {
+			return err
+		}
+	}
+
+	if err := n.enableForwarding(); err != nil {
+		return fmt.Errorf("enabling IP forwarding: %w", err)
+	}
+
+	masquerade := fmt.Sprintf("table ip %s {\n\tchain postrouting {\n\t\ttype nat hook postrouting priority srcnat;\n\t\tip saddr %s masquerade\n\t}\n}\n",
+		n.hostTable(), jobAddr)
+	if _, err := n.run(ctx, masquerade, "nft", "-f", "-"); err != nil {
+		return err
+	}
+	n.createdTable = true
+
+	ruleset := egressRuleset(allowed, resolvers, fmt.Sprintf("buildkite %s blocked: ", n.name))
+	_, err := n.run(ctx, ruleset, "ip", "netns", "exec", n.name, "nft", "-f", "-")
+	return err
+}
+
+// enableForwarding turns on IP forwarding, remembering how it was if this is
+// the first job network to need it
+func (n *jobNetwork) enableForwarding() error {
+	ipForwarding.Lock()
+	defer ipForwarding.Unlock()
+
+	if ipForwarding.users == 0 {
+		previous, err := os.ReadFile(n.ipForwardPath)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(n.ipForwardPath, []byte("1"), 0644); err != nil {
+			return err
+		}
+		ipForwarding.previous = previous
+	}
+	ipForwarding.users++
+	n.forwarding = true
+	return nil
+}
+
+// restoreForwarding puts IP forwarding back how it was before job networks
+// needed it, once this is the last one
+func (n *jobNetwork) restoreForwarding() error {
+	ipForwarding.Lock()
+	defer ipForwarding.Unlock()
+
+	n.forwarding = false
+	ipForwarding.users--
+	if ipForwarding.users > 0 || bytes.Equal(bytes.TrimSpace(ipForwarding.previous), []byte("1")) {
+		return nil
+	}
+	return os.WriteFile(n.ipForwardPath, ipForwarding.previous, 0644)
+}
+
+func (n *jobNetwork) addrs() (host, job netip.Addr) {
+	base := jobNetworkRange.Addr().As4()
+	offset := n.subnet * 4
+	base[2] += byte(offset >> 8)
+	base[3] += byte(offset)
+	host = netip.AddrFrom4(base).Next()
+	return host, host.Next()
+}
+
+func (n *jobNetwork) hostLink() string {
+	return "bkh-" + n.link
+}
+
+func (n *jobNetwork) hostTable() string {
+	return "buildkite_" + strings.ReplaceAll(n.name, "-", "_")
+}
+
+// wrap returns the command to run args in the job's network namespace, with
+// setpriv dropping the capabilities the job could escape its egress policy
+// with before running args
+func (n *jobNetwork) wrap(args []string) []string {
+	caps := "-" + strings.Join(jobNetworkDroppedCaps, ",-")
+	return append([]string{
+		"ip", "netns", "exec", n.name,
+		"setpriv", "--inh-caps=" + caps, "--ambient-caps=" + caps, "--bounding-set=" + caps, "--",
+	}, args...)
+}
+
+// blocked returns how many packets the job tried to send somewhere it isn't
+// allowed to
+func (n *jobNetwork) blocked(ctx context.Context) (int, error) {
+	out, err := n.run(ctx, "", "ip", "netns", "exec", n.name, "nft", "list", "counter", "inet", "buildkite_egress", "blocked")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(out)
+	for i, f := range fields {
+		if f == "packets" && i+1 < len(fields) {
+			return strconv.Atoi(fields[i+1])
+		}
+	}
+	return 0, fmt.Errorf("no packet count in %q", out)
+}
+
+// close removes what setup created. Removing the network namespace removes
+// the veth pair with it.
+func (n *jobNetwork) close(ctx context.Context) error {
+	var errs []string
+	if n.createdTable {
+		if _, err := n.run(ctx, "", "nft", "delete", "table", "ip", n.hostTable()); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			n.createdTable = false
+		}
+	}
+	if n.createdHostLink {
+		if _, err := n.run(ctx, "", "ip", "link", "delete", n.hostLink()); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			n.createdHostLink = false
+		}
+	}
+	if n.createdNetns {
+		if _, err := n.run(ctx, "", "ip", "netns", "delete", n.name); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			n.createdNetns = false
+		}
+	}
+	if n.forwarding {
+		if err := n.restoreForwarding(); err != nil {
+			errs = append(errs, fmt.Sprintf("restoring IP forwarding: %v", err))
+		}
+	}
+
+	if n.subnet >= 0 {
+		jobNetworkSubnets.Lock()
+		delete(jobNetworkSubnets.used, n.subnet)
+		jobNetworkSubnets.Unlock()
+		n.subnet = -1
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("removing job network %s: %s", n.name, strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+//go:build linux
+// +build linux
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobNetworkNamesAreUniqueForJobsStartedTogether(t *testing.T) {
+	t.Parallel()
+
+	// Job IDs are time ordered, so ones from the same minute share a prefix
+	a := newJobNetworkNames("0188a1b2-c3d4-7e5f-8a9b-0c1d2e3f4a5b")
+	b := newJobNetworkNames("0188a1b2-ffff-7e5f-8a9b-9f8e7d6c5b4a")
+
+	assert.NotEqual(t, a.name, b.name)
+	assert.NotEqual(t, a.hostLink(), b.hostLink())
+	assert.NotEqual(t, a.hostTable(), b.hostTable())
+	assert.LessOrEqual(t, len(a.hostLink()), 15)
+}
+
+func TestJobNetworkSetupFailureOnlyRemovesWhatItCreated(t *testing.T) {
+	t.Parallel()
+
+	n := newJobNetworkNames("0188a1b2-c3d4-7e5f-8a9b-0c1d2e3f4a5b")
+	var ran []string
+	n.run = func(_ context.Context, _ string, args ...string) (string, error) {
+		cmd := strings.Join(args, " ")
+		ran = append(ran, cmd)
+		if strings.HasPrefix(cmd, "ip netns add ") {
+			return "", errors.New("File exists")
+		}
+		return "", nil
+	}
+
+	assert.Error(t, n.setup(context.Background(), nil, nil))
+	assert.NoError(t, n.close(context.Background()))
+
+	// Another job's namespace with the same name mustn't be removed
+	assert.Equal(t, []string{"ip netns add " + n.name}, ran)
+}
+
+func TestJobNetworkRemovesHostLinkThatWasntMoved(t *testing.T) {
+	t.Parallel()
+
+	n := newJobNetworkNames("0188a1b2-c3d4-7e5f-8a9b-0c1d2e3f4a5b")
+	var ran []string
+	n.run = func(_ context.Context, _ string, args ...string) (string, error) {
+		cmd := strings.Join(args, " ")
+		ran = append(ran, cmd)
+		if strings.Contains(cmd, " netns "+n.name) && strings.HasPrefix(cmd, "ip link set ") {
+			return "", errors.New("Operation not permitted")
+		}
+		return "", nil
+	}
+
+	assert.Error(t, n.setup(context.Background(), nil, nil))
+	ran = nil
+	assert.NoError(t, n.close(context.Background()))
+	assert.Equal(t, []string{
+		"ip link delete " + n.hostLink(),
+		"ip netns delete " + n.name,
+	}, ran)
+}
+
+func TestJobNetworkWrapDropsCapabilitiesToEscapeTheNamespace(t *testing.T) {
+	t.Parallel()
+
+	n := newJobNetworkNames("0188a1b2-c3d4-7e5f-8a9b-0c1d2e3f4a5b")
+	cmd := strings.Join(n.wrap([]string{"buildkite-agent", "bootstrap"}), " ")
+
+	assert.True(t, strings.HasPrefix(cmd, "ip netns exec "+n.name+" setpriv "), cmd)
+	assert.Contains(t, cmd, "--bounding-set=-net_admin,-sys_admin,-sys_ptrace,-sys_module ")
+	assert.Contains(t, cmd, "--inh-caps=-net_admin,-sys_admin,-sys_ptrace,-sys_module ")
+	assert.Contains(t, cmd, "--ambient-caps=-net_admin,-sys_admin,-sys_ptrace,-sys_module ")
+	assert.True(t, strings.HasSuffix(cmd, " -- buildkite-agent bootstrap"), cmd)
+}
+
+func TestJobNetworksRestoreIPForwardingAfterTheLastOne(t *testing.T) {
+	ipForward := filepath.Join(t.TempDir(), "ip_forward")
+	require.NoError(t, os.WriteFile(ipForward, []byte("0\n"), 0644))
+
+	newNetwork := func(jobID string) *jobNetwork {
+		n := newJobNetworkNames(jobID)
+		n.ipForwardPath = ipForward
+		n.run = func(context.Context, string, ...string) (string, error) { return "", nil }
+		require.NoError(t, n.setup(context.Background(), nil, nil))
+		return n
+	}
+	forwarding := func() string {
+		data, err := os.ReadFile(ipForward)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	a := newNetwork("0188a1b2-c3d4-7e5f-8a9b-0c1d2e3f4a5b")
+	b := newNetwork("0188a1b2-ffff-7e5f-8a9b-9f8e7d6c5b4a")
+	assert.Equal(t, "1", forwarding())
+
+	// Still needed by the other job
+	require.NoError(t, a.close(context.Background()))
+	assert.Equal(t, "1", forwarding())
+
+	require.NoError(t, b.close(context.Background()))
+	assert.Equal(t, "0\n", forwarding())
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+)
+
+// jobNetwork is only supported on Linux
+type jobNetwork struct{}
+
+func newJobNetwork(context.Context, string, []netip.Prefix) (*jobNetwork, error) {
+	return nil, errors.New("job egress policies are only supported on Linux")
+}
+
+func (*jobNetwork) wrap(args []string) []string          { return args }
+func (*jobNetwork) blocked(context.Context) (int, error) { return 0, nil }
+func (*jobNetwork) close(context.Context) error          { return nil }
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEgressAllowlist(t *testing.T) {
+	allow, err := ParseEgressAllowlist([]string{"10.1.2.3/8", "192.168.1.1", " GitHub.com. ", ""})
+	require.NoError(t, err)
+	assert.Equal(t, EgressAllowlist{
+		Prefixes: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("192.168.1.1/32"),
+		},
+		Domains: []string{"github.com"},
+	}, allow)
+
+	_, err = ParseEgressAllowlist([]string{"https://github.com"})
+	assert.Error(t, err)
+}
+
+func TestEgressAllowlistResolve(t *testing.T) {
+	allow := EgressAllowlist{
+		Prefixes: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("2001:db8::/32"),
+		},
+		Domains: []string{"github.com", "internal.example.com", "missing.example.com"},
+	}
+
+	lookup := func(_ context.Context, host string) ([]netip.Addr, error) {
+		switch host {
+		case "github.com":
+			return []netip.Addr{netip.MustParseAddr("140.82.112.3")}, nil
+		case "internal.example.com":
+			return []netip.Addr{netip.MustParseAddr("10.1.2.3")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	prefixes, unresolved := allow.resolve(context.Background(), lookup)
+
+	// IPv6 isn't routed to jobs, and addresses within allowed CIDRs are left out
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("140.82.112.3/32"),
+	}, prefixes)
+	assert.Equal(t, []string{"missing.example.com"}, unresolved)
+}
+
+func TestRepositoryHost(t *testing.T) {
+	for repo, host := range map[string]string{
+		"git@github.com:buildkite/agent.git":     "github.com",
+		"https://github.com/buildkite/agent.git": "github.com",
+		"ssh://git@gitlab.example.com:2222/a/b":  "gitlab.example.com",
+		"github.com:buildkite/agent.git":         "github.com",
+		"/var/lib/repos/agent.git":               "",
+		"":                                       "",
+	} {
+		assert.Equal(t, host, repositoryHost(repo), repo)
+	}
+}
+
+func TestEgressRuleset(t *testing.T) {
+	ruleset := egressRuleset(
+		[]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("140.82.112.3/32")},
+		[]netip.Addr{netip.MustParseAddr("1.1.1.1")},
+		"buildkite bk-1234 blocked: ",
+	)
+
+	assert.Equal(t, `table inet buildkite_egress {
+	counter blocked {}
+
+	chain output {
+		type filter hook output priority 0; policy drop;
+		oif "lo" accept
+		ct state established,related accept
+		ip daddr { 1.1.1.1 } meta l4proto { tcp, udp } th dport 53 accept
+		ip daddr { 10.0.0.0/8, 140.82.112.3/32 } accept
+		log prefix "buildkite bk-1234 blocked: " counter name "blocked" drop
+	}
+}
+`, ruleset)
+}
@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/roko"
+)
+
+const (
+	// The annotation that jobs' energy estimates are appended to
+	jobEnergyAnnotationContext = "job-energy"
+
+	// Roughly the worldwide average carbon intensity of electricity, in grams
+	// of CO2 equivalent per kWh
+	DefaultCarbonIntensity = 475
+
+	// What one CPU is assumed to draw when busy, in watts, when it isn't known
+	// from the instance type
+	DefaultCPUWatts = 3.5
+)
+
+// The watts one vCPU draws when busy, including the data centre's overhead,
+// for instance types by their prefix. They're the averages published for each
+// provider's processors, so are only a rough guide. The longest matching
+// prefix wins.
+var instanceCPUWatts = map[string]float64{
+	// AWS Graviton
+	"a1.": 1.8,
+	"c6g": 1.9,
+	"c7g": 1.9,
+	"m6g": 1.9,
+	"m7g": 1.9,
+	"r6g": 1.9,
+	"r7g": 1.9,
+	"t4g": 1.9,
+
+	// AWS x86
+	"c5":  4.0,
+	"c6i": 4.0,
+	"c6a": 3.1,
+	"m5":  4.0,
+	"m6i": 4.0,
+	"m6a": 3.1,
+	"t3":  4.0,
+	"t3a": 3.1,
+
+	// GCP
+	"e2-":  4.8,
+	"n1-":  4.8,
+	"n2-":  4.8,
+	"n2d-": 3.4,
+	"c2-":  4.8,
+	"t2a-": 1.9,
+	"t2d-": 3.4,
+}
+
+// CPUWattsForInstanceType returns the watts one vCPU of an instance type
+// draws when busy, if it's known, e.g. for m6g.large or n2-standard-4
+func CPUWattsForInstanceType(instanceType string) (float64, bool) {
+	var match string
+	for prefix := range instanceCPUWatts {
+		if strings.HasPrefix(instanceType, prefix) && len(prefix) > len(match) {
+			match = prefix
+		}
+	}
+	if match == "" {
+		return 0, false
+	}
+	return instanceCPUWatts[match], true
+}
+
+// InstanceTypeFromTags returns the instance type from the tags the agent
+// fetched from EC2 or GCP meta-data, if any
+func InstanceTypeFromTags(tags []string) string {
+	for _, tag := range tags {
+		for _, prefix := range []string{"aws:instance-type=", "gcp:machine-type="} {
+			if strings.HasPrefix(tag, prefix) {
+				return strings.TrimPrefix(tag, prefix)
+			}
+		}
+	}
+	return ""
+}
+
+// JobEnergy is an estimate of the energy a job used and the carbon emitted
+// generating it, from its CPU time
+type JobEnergy struct {
+	WattHours   float64 `json:"watt_hours"`
+	CarbonGrams float64 `json:"carbon_grams"`
+}
+
+func estimateJobEnergy(cpuSeconds, cpuWatts float64, carbonIntensity int) JobEnergy {
+	wh := cpuSeconds * cpuWatts / 3600
+	return JobEnergy{
+		WattHours:   wh,
+		CarbonGrams: wh / 1000 * float64(carbonIntensity),
+	}
+}
+
+func (e JobEnergy) String() string {
+	return fmt.Sprintf("%.2f Wh, %.2f g CO2e", e.WattHours, e.CarbonGrams)
+}
+
+// annotateJobEnergy appends the job's energy estimate to the build's energy
+// annotation
+func (r *JobRunner) annotateJobEnergy(ctx context.Context, energy JobEnergy) {
+	label := r.job.Env["BUILDKITE_LABEL"]
+	if label == "" {
+		label = r.job.ID
+	}
+
+	annotation := &api.Annotation{
+		Body:    fmt.Sprintf("- %s used an estimated %s\n", label, energy),
+		Context: jobEnergyAnnotationContext,
+		Style:   "info",
+		Append:  true,
+	}
+
+	err := roko.NewRetrier(
+		roko.WithMaxAttempts(3),
+		roko.WithStrategy(roko.Constant(2*time.Second)),
+	).DoWithContext(ctx, func(*roko.Retrier) error {
+		_, err := r.apiClient.Annotate(ctx, r.job.ID, annotation)
+		return err
+	})
+	if err != nil {
+		r.logger.Warn("[JobUsage] Couldn't annotate the build with the job's energy estimate: %v", err)
+	}
+}
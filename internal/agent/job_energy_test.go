@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCPUWattsForInstanceType(t *testing.T) {
+	for _, tc := range []struct {
+		instanceType string
+		watts        float64
+		ok           bool
+	}{
+		{"m6g.large", 1.9, true},
+		{"t3.micro", 4.0, true},
+		{"t3a.micro", 3.1, true},
+		{"n2d-standard-8", 3.4, true},
+		{"n2-standard-8", 4.8, true},
+		{"x2iedn.xlarge", 0, false},
+	} {
+		t.Run(tc.instanceType, func(t *testing.T) {
+			watts, ok := CPUWattsForInstanceType(tc.instanceType)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.watts, watts)
+		})
+	}
+}
+
+func TestInstanceTypeFromTags(t *testing.T) {
+	assert.Equal(t, "c6g.xlarge", InstanceTypeFromTags([]string{"queue=default", "aws:instance-type=c6g.xlarge"}))
+	assert.Equal(t, "e2-medium", InstanceTypeFromTags([]string{"gcp:machine-type=e2-medium"}))
+	assert.Equal(t, "", InstanceTypeFromTags([]string{"queue=default"}))
+}
+
+func TestEstimateJobEnergy(t *testing.T) {
+	// An hour of CPU time at 4 W is 4 Wh, and 2 g of CO2e at 500 g/kWh
+	energy := estimateJobEnergy(3600, 4, 500)
+	assert.InDelta(t, 4.0, energy.WattHours, 0.0001)
+	assert.InDelta(t, 2.0, energy.CarbonGrams, 0.0001)
+	assert.Equal(t, "4.00 Wh, 2.00 g CO2e", energy.String())
+}
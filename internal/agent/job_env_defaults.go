@@ -0,0 +1,44 @@
+package agent
+
+import "strings"
+
+// jobEnvDefaults returns the environment variables the agent is configured
+// to give every job, for its locale, timezone and --job-env, so jobs behave
+// the same whichever agent runs them. Those the job's own environment sets
+// are left out, so pipelines can override them.
+func jobEnvDefaults(conf AgentConfiguration, jobEnv map[string]string) map[string]string {
+	defaults := make(map[string]string)
+
+	for _, e := range conf.JobEnv {
+		k, v, ok := strings.Cut(e, "=")
+		if !ok || k == "" {
+			continue
+		}
+		if _, exists := jobEnv[k]; !exists {
+			defaults[k] = v
+		}
+	}
+
+	// LC_ALL overrides every other locale variable, so pinning it would
+	// undo a pipeline that sets any of them
+	if conf.JobLocale != "" && !setsLocale(jobEnv) {
+		defaults["LANG"] = conf.JobLocale
+		defaults["LC_ALL"] = conf.JobLocale
+	}
+
+	if _, exists := jobEnv["TZ"]; !exists && conf.JobTimezone != "" {
+		defaults["TZ"] = conf.JobTimezone
+	}
+
+	return defaults
+}
+
+// setsLocale returns whether an environment sets LANG or any LC_ variable
+func setsLocale(env map[string]string) bool {
+	for k := range env {
+		if k == "LANG" || strings.HasPrefix(k, "LC_") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobEnvDefaults(t *testing.T) {
+	t.Parallel()
+
+	conf := AgentConfiguration{
+		JobLocale:   "C.UTF-8",
+		JobTimezone: "UTC",
+		JobEnv:      []string{"PYTHONHASHSEED=0", "SOURCE_DATE_EPOCH=0", "EMPTY=", "OPTS=a=b"},
+	}
+
+	tests := []struct {
+		name   string
+		jobEnv map[string]string
+		want   map[string]string
+	}{
+		{
+			name:   "pinned",
+			jobEnv: map[string]string{"BUILDKITE_JOB_ID": "1"},
+			want: map[string]string{
+				"LANG":              "C.UTF-8",
+				"LC_ALL":            "C.UTF-8",
+				"TZ":                "UTC",
+				"PYTHONHASHSEED":    "0",
+				"SOURCE_DATE_EPOCH": "0",
+				"EMPTY":             "",
+				"OPTS":              "a=b",
+			},
+		},
+		{
+			name:   "overridden by the pipeline",
+			jobEnv: map[string]string{"LC_COLLATE": "en_AU.UTF-8", "TZ": "Australia/Melbourne", "PYTHONHASHSEED": "random"},
+			want: map[string]string{
+				"SOURCE_DATE_EPOCH": "0",
+				"EMPTY":             "",
+				"OPTS":              "a=b",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.want, jobEnvDefaults(conf, tc.jobEnv))
+		})
+	}
+}
+
+func TestJobEnvDefaultsUnconfigured(t *testing.T) {
+	t.Parallel()
+
+	assert.Empty(t, jobEnvDefaults(AgentConfiguration{}, map[string]string{"LANG": "C"}))
+}
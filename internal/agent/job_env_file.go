@@ -0,0 +1,27 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// writeEnvFile writes the environment as lines of KEY="value", sorted by key,
+// with each value quoted like a Go string (%q). Newlines and other special
+// characters are escaped, so every variable is on its own line for tools that
+// read the file line by line, and multiline values like PEM keys read back
+// exactly with strconv.Unquote.
+func writeEnvFile(w io.Writer, env map[string]string) error {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if _, err := fmt.Fprintf(w, "%s=%q\n", key, env[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// envLimits are how large a process's environment can be on an operating
+// system, in bytes
+type envLimits struct {
+	OS string
+
+	// For all of the environment, which may be shared with the arguments
+	Total int
+
+	// For each KEY=value, or 0 if there's no limit of its own
+	PerVar int
+}
+
+// envLimitsFor returns the environment size limits on an operating system.
+// The true limits depend on how the system is configured, so these are for
+// the common defaults.
+func envLimitsFor(goos string) envLimits {
+	switch goos {
+	case "linux":
+		// ARG_MAX is a quarter of the default 8 MiB stack, and each string
+		// is limited to MAX_ARG_STRLEN
+		return envLimits{OS: goos, Total: 2 * 1024 * 1024, PerVar: 128 * 1024}
+	case "darwin":
+		return envLimits{OS: goos, Total: 1024 * 1024}
+	case "windows":
+		return envLimits{OS: goos, Total: 16 * 1024 * 1024, PerVar: 32767}
+	default:
+		return envLimits{OS: goos, Total: 256 * 1024}
+	}
+}
+
+// envEntrySize is the size of KEY=value in a process's environment,
+// including its NUL terminator
+func envEntrySize(key, value string) int {
+	return len(key) + len(value) + 2
+}
+
+type envVarSize struct {
+	name string
+	size int
+}
+
+func largestEnvVars(env map[string]string, n int) []envVarSize {
+	sizes := make([]envVarSize, 0, len(env))
+	for k, v := range env {
+		sizes = append(sizes, envVarSize{name: k, size: envEntrySize(k, v)})
+	}
+	sortEnvVarSizes(sizes)
+	if len(sizes) > n {
+		sizes = sizes[:n]
+	}
+	return sizes
+}
+
+func sortEnvVarSizes(sizes []envVarSize) {
+	sort.Slice(sizes, func(i, j int) bool {
+		if sizes[i].size != sizes[j].size {
+			return sizes[i].size > sizes[j].size
+		}
+		return sizes[i].name < sizes[j].name
+	})
+}
+
+func describeEnvVars(sizes []envVarSize) string {
+	parts := make([]string, 0, len(sizes))
+	for _, s := range sizes {
+		parts = append(parts, fmt.Sprintf("%s (%s)", s.name, formatBytes(int64(s.size))))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// checkEnvSize returns an error naming the largest variables if the
+// environment is too large for a process to be started with, as otherwise
+// starting it fails with an error like "argument list too long". If it's
+// getting close, it returns a warning instead.
+func checkEnvSize(env map[string]string, limits envLimits) (warning string, err error) {
+	const advice = "Set --job-env-spill-size on the agent to pass large variables to jobs as files instead"
+
+	total := 0
+	var tooLarge []envVarSize
+	for k, v := range env {
+		size := envEntrySize(k, v)
+		total += size
+		if limits.PerVar > 0 && size > limits.PerVar {
+			tooLarge = append(tooLarge, envVarSize{name: k, size: size})
+		}
+	}
+
+	if len(tooLarge) > 0 {
+		sortEnvVarSizes(tooLarge)
+		return "", fmt.Errorf("The job's environment has variables larger than the %s each can be on %s: %s. %s",
+			formatBytes(int64(limits.PerVar)), limits.OS, describeEnvVars(tooLarge), advice)
+	}
+
+	largest := describeEnvVars(largestEnvVars(env, 5))
+	switch {
+	case total > limits.Total:
+		return "", fmt.Errorf("The job's environment is %s, larger than the %s it can be on %s. The largest variables are %s. %s",
+			formatBytes(int64(total)), formatBytes(int64(limits.Total)), limits.OS, largest, advice)
+	case total > limits.Total/4*3:
+		return fmt.Sprintf("The job's environment is %s, close to the %s it can be on %s. The largest variables are %s",
+			formatBytes(int64(total)), formatBytes(int64(limits.Total)), limits.OS, largest), nil
+	}
+	return "", nil
+}
+
+// spillEnv moves the job's variables larger than the spill size into files,
+// and points to each with <KEY>_FILE, so they don't take up room in the
+// job's environment. The variables set by the agent, and those the
+// bootstrap reads, are left alone. It returns the names of the variables
+// that were moved.
+func (r *JobRunner) spillEnv(env map[string]string) ([]string, error) {
+	size := r.conf.AgentConfiguration.JobEnvSpillSize
+	if size <= 0 {
+		return nil, nil
+	}
+
+	var spill []string
+	for k := range r.job.Env {
+		v, ok := env[k]
+		if !ok || strings.HasPrefix(k, "BUILDKITE") || int64(envEntrySize(k, v)) <= size {
+			continue
+		}
+		if _, exists := env[k+"_FILE"]; exists {
+			r.logger.Warn("[JobRunner] Not moving %s to a file, as %s_FILE is already set", k, k)
+			continue
+		}
+		spill = append(spill, k)
+	}
+	if len(spill) == 0 {
+		return nil, nil
+	}
+	sort.Strings(spill)
+
+	if r.envSpillDir == "" {
+		dir, err := os.MkdirTemp(r.tempDir, fmt.Sprintf("job-env-spill-%s", r.job.ID))
+		if err != nil {
+			return nil, err
+		}
+		r.envSpillDir = dir
+	}
+
+	for _, k := range spill {
+		path := filepath.Join(r.envSpillDir, k)
+		if err := os.WriteFile(path, []byte(env[k]), 0600); err != nil {
+			return nil, err
+		}
+		delete(env, k)
+		env[k+"_FILE"] = path
+	}
+	return spill, nil
+}
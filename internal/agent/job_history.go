@@ -0,0 +1,186 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+const (
+	// Jobs can ask to run on an agent that has recently run a job for the same
+	// pipeline, e.g. for its warm caches, with BUILDKITE_JOB_AFFINITY=pipeline
+	jobAffinityEnv = "BUILDKITE_JOB_AFFINITY"
+
+	// Jobs can ask to never run alongside another job for the same pipeline on
+	// one host with BUILDKITE_JOB_ANTI_AFFINITY=pipeline
+	jobAntiAffinityEnv = "BUILDKITE_JOB_ANTI_AFFINITY"
+
+	// How long since a pipeline last ran a job here that the host still counts
+	// as having run it recently
+	recentJobWindow = time.Hour
+
+	// How long the host remembers the jobs it's accepted, so that a job
+	// that's offered again, because Buildkite never got the response to it
+	// being accepted, isn't run twice
+	acceptedJobWindow = 24 * time.Hour
+)
+
+// JobHistory keeps track of the pipelines that the agent workers on this host
+// are running and have recently run jobs for, so that jobs' affinity hints can
+// be honoured when deciding whether to accept them. It's safe to share
+// between workers.
+//
+// Buildkite doesn't know about the hints, so a job is left for another agent
+// by not accepting it, and it'll be offered to the next agent that pings.
+type JobHistory struct {
+	mu sync.Mutex
+
+	// The number of jobs running for each pipeline
+	running map[string]int
+
+	// When each pipeline last finished a job
+	finished map[string]time.Time
+
+	// The jobs that were left for a warmer agent, and when. If they're
+	// offered again, no such agent took them, so they're accepted.
+	left map[string]time.Time
+
+	// The jobs admitted on this host, so they're never run twice
+	accepted map[string]*acceptedJob
+}
+
+// acceptedJob is a job that's been admitted on this host
+type acceptedJob struct {
+	at time.Time
+
+	// The idempotency key the job is accepted with
+	key api.Header
+
+	// Whether the call to accept it failed in a way that Buildkite might
+	// have accepted it anyway. If it's offered again, it wasn't, and it's
+	// accepted again with the same key.
+	unknown bool
+}
+
+func NewJobHistory() *JobHistory {
+	return &JobHistory{
+		running:  map[string]int{},
+		finished: map[string]time.Time{},
+		left:     map[string]time.Time{},
+		accepted: map[string]*acceptedJob{},
+	}
+}
+
+// admit returns whether the job should be accepted given its hints, or why
+// not. Admitted jobs must be passed to done once they've finished.
+func (h *JobHistory) admit(job *api.Job, now time.Time) (bool, string) {
+	pipeline := job.Env["BUILDKITE_PIPELINE_SLUG"]
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for id, at := range h.left {
+		if now.Sub(at) > recentJobWindow {
+			delete(h.left, id)
+		}
+	}
+	for id, accepted := range h.accepted {
+		if now.Sub(accepted.at) > acceptedJobWindow {
+			delete(h.accepted, id)
+		}
+	}
+
+	accepted, ok := h.accepted[job.ID]
+	if ok && !accepted.unknown {
+		return false, "it's already been accepted on this host"
+	}
+
+	if hasHint(job.Env[jobAntiAffinityEnv], "pipeline") && h.running[pipeline] > 0 {
+		return false, fmt.Sprintf("another job for %s is running on this host", pipeline)
+	}
+
+	if hasHint(job.Env[jobAffinityEnv], "pipeline") && !h.recent(pipeline, now) {
+		if _, ok := h.left[job.ID]; !ok {
+			h.left[job.ID] = now
+			return false, fmt.Sprintf("this host hasn't run a job for %s recently", pipeline)
+		}
+	}
+
+	delete(h.left, job.ID)
+	if ok {
+		accepted.at = now
+		accepted.unknown = false
+	} else {
+		h.accepted[job.ID] = &acceptedJob{at: now, key: newIdempotencyKey()}
+	}
+	h.running[pipeline]++
+	return true, ""
+}
+
+// acceptKey returns the idempotency key to accept an admitted job with, which
+// is the same each time it's admitted until it's forgotten
+func (h *JobHistory) acceptKey(job *api.Job) api.Header {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	accepted, ok := h.accepted[job.ID]
+	if !ok {
+		return newIdempotencyKey()
+	}
+	return accepted.key
+}
+
+// acceptUnknown records that an admitted job might have been accepted
+// without the agent knowing. If it's offered again, it wasn't, so it's
+// admitted again to be accepted with the same key.
+func (h *JobHistory) acceptUnknown(job *api.Job) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if accepted, ok := h.accepted[job.ID]; ok {
+		accepted.unknown = true
+	}
+}
+
+// forget records that an admitted job was never accepted, so that it can be
+// admitted again if it's offered again
+func (h *JobHistory) forget(job *api.Job) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.accepted, job.ID)
+}
+
+// done records that an admitted job has finished
+func (h *JobHistory) done(job *api.Job, now time.Time) {
+	pipeline := job.Env["BUILDKITE_PIPELINE_SLUG"]
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.running[pipeline]--; h.running[pipeline] <= 0 {
+		delete(h.running, pipeline)
+	}
+	h.finished[pipeline] = now
+}
+
+func (h *JobHistory) recent(pipeline string, now time.Time) bool {
+	if h.running[pipeline] > 0 {
+		return true
+	}
+	finished, ok := h.finished[pipeline]
+	return ok && now.Sub(finished) <= recentJobWindow
+}
+
+// hasHint returns whether a comma separated list of hints includes hint
+func hasHint(hints, hint string) bool {
+	for _, h := range strings.Split(hints, ",") {
+		if strings.TrimSpace(h) == hint {
+			return true
+		}
+	}
+	return false
+}
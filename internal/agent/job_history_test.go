@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func newHintedJob(id, pipeline string, env map[string]string) *api.Job {
+	job := &api.Job{ID: id, Env: map[string]string{"BUILDKITE_PIPELINE_SLUG": pipeline}}
+	for k, v := range env {
+		job.Env[k] = v
+	}
+	return job
+}
+
+func TestJobHistoryAdmitsJobsWithoutHints(t *testing.T) {
+	h := NewJobHistory()
+	now := time.Now()
+
+	admitted, _ := h.admit(newHintedJob("1", "llamas", nil), now)
+	assert.True(t, admitted)
+
+	admitted, _ = h.admit(newHintedJob("2", "llamas", nil), now)
+	assert.True(t, admitted)
+}
+
+func TestJobHistoryAntiAffinity(t *testing.T) {
+	h := NewJobHistory()
+	now := time.Now()
+	hints := map[string]string{"BUILDKITE_JOB_ANTI_AFFINITY": "pipeline"}
+
+	first := newHintedJob("1", "llamas", hints)
+	admitted, _ := h.admit(first, now)
+	assert.True(t, admitted)
+
+	admitted, reason := h.admit(newHintedJob("2", "llamas", hints), now)
+	assert.False(t, admitted)
+	assert.Equal(t, "another job for llamas is running on this host", reason)
+
+	// Other pipelines aren't affected
+	admitted, _ = h.admit(newHintedJob("3", "alpacas", hints), now)
+	assert.True(t, admitted)
+
+	h.done(first, now)
+	admitted, _ = h.admit(newHintedJob("2", "llamas", hints), now)
+	assert.True(t, admitted)
+}
+
+func TestJobHistoryAffinity(t *testing.T) {
+	h := NewJobHistory()
+	now := time.Now()
+	hints := map[string]string{"BUILDKITE_JOB_AFFINITY": "pipeline"}
+
+	// A cold host leaves the job the first time, and takes it if it comes back
+	job := newHintedJob("1", "llamas", hints)
+	admitted, reason := h.admit(job, now)
+	assert.False(t, admitted)
+	assert.Equal(t, "this host hasn't run a job for llamas recently", reason)
+
+	admitted, _ = h.admit(job, now)
+	assert.True(t, admitted)
+	h.done(job, now)
+
+	// Now it's warm
+	admitted, _ = h.admit(newHintedJob("2", "llamas", hints), now.Add(time.Minute))
+	assert.True(t, admitted)
+
+	// Until it's been long enough
+	admitted, _ = h.admit(newHintedJob("3", "alpacas", nil), now)
+	assert.True(t, admitted)
+	h.done(newHintedJob("3", "alpacas", nil), now)
+
+	admitted, _ = h.admit(newHintedJob("4", "alpacas", hints), now.Add(2*recentJobWindow))
+	assert.False(t, admitted)
+}
+
+func TestJobHistoryNeverAdmitsAJobTwice(t *testing.T) {
+	h := NewJobHistory()
+	now := time.Now()
+
+	job := newHintedJob("1", "llamas", nil)
+	admitted, _ := h.admit(job, now)
+	assert.True(t, admitted)
+	h.done(job, now)
+
+	// Offered again, because Buildkite never heard it was accepted
+	admitted, reason := h.admit(job, now.Add(time.Minute))
+	assert.False(t, admitted)
+	assert.Equal(t, "it's already been accepted on this host", reason)
+
+	// Unless it was never accepted after all
+	h.forget(job)
+	admitted, _ = h.admit(job, now.Add(time.Minute))
+	assert.True(t, admitted)
+	h.done(job, now)
+
+	// Or it's been long enough
+	admitted, _ = h.admit(job, now.Add(2*acceptedJobWindow))
+	assert.True(t, admitted)
+}
+
+func TestJobHistoryAdmitsJobsWhoseAcceptIsUnknownAgainWithTheSameKey(t *testing.T) {
+	h := NewJobHistory()
+	now := time.Now()
+
+	job := newHintedJob("1", "llamas", nil)
+	admitted, _ := h.admit(job, now)
+	assert.True(t, admitted)
+	key := h.acceptKey(job)
+
+	// While it's being accepted, it isn't admitted again
+	admitted, _ = h.admit(job, now)
+	assert.False(t, admitted)
+
+	// Accepting it failed with a 5xx, so Buildkite might have accepted it
+	h.acceptUnknown(job)
+	h.done(job, now)
+
+	// It's offered again, so it wasn't, and it's accepted with the same key
+	admitted, _ = h.admit(job, now.Add(time.Minute))
+	assert.True(t, admitted)
+	assert.Equal(t, key, h.acceptKey(job))
+	h.done(job, now)
+
+	// Unless accepting it fails again, it's never admitted again
+	admitted, reason := h.admit(job, now.Add(2*time.Minute))
+	assert.False(t, admitted)
+	assert.Equal(t, "it's already been accepted on this host", reason)
+
+	// Jobs that are forgotten get a new key
+	h.forget(job)
+	admitted, _ = h.admit(job, now.Add(3*time.Minute))
+	assert.True(t, admitted)
+	assert.NotEqual(t, key, h.acceptKey(job))
+}
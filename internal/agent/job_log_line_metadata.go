@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/buildkite/agent/v3/process"
+)
+
+// The job artifact that where each line of the job's output came from is
+// uploaded as
+const lineMetadataArtifact = "log-line-metadata.json"
+
+// LineMetadataSummary is what's uploaded as a job's line metadata artifact.
+// Each entry applies to the lines of the job's output from its line on, until
+// the next entry, so tools can filter out stderr or find which hook or plugin
+// a noisy line is from.
+type LineMetadataSummary struct {
+	JobID string                 `json:"job_id"`
+	Lines []process.LineMetadata `json:"lines"`
+}
+
+// uploadLineMetadata uploads where each line of the job's output came from,
+// if it was tagged
+func (r *JobRunner) uploadLineMetadata(ctx context.Context) {
+	if r.lineMetadata == nil {
+		return
+	}
+	records := r.lineMetadata.Records()
+	r.lineMetadata = nil
+	if len(records) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(LineMetadataSummary{JobID: r.job.ID, Lines: records})
+	if err != nil {
+		r.logger.Warn("[JobRunner] Couldn't encode the job's line metadata: %v", err)
+		return
+	}
+	if err := r.uploadJobArtifact(ctx, lineMetadataArtifact, data); err != nil {
+		r.logger.Warn("[JobRunner] Couldn't upload the job's line metadata: %v", err)
+	}
+}
@@ -0,0 +1,360 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The job artifact that the network audit summary is uploaded as
+const networkAuditArtifact = "network-audit.json"
+
+// NetworkAuditEntry is a destination a job's processes connected to or
+// looked up, and how many times
+type NetworkAuditEntry struct {
+	// dns, http or https
+	Type string `json:"type"`
+
+	// The host, or host:port that was connected to
+	Destination string `json:"destination"`
+
+	// For https, the server name the client sent in its TLS handshake, which
+	// can differ from the host it connected to
+	SNI string `json:"sni,omitempty"`
+
+	// For dns, the addresses it resolved to
+	Addresses []string `json:"addresses,omitempty"`
+
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// NetworkAuditSummary is what's uploaded as a job's network audit artifact
+type NetworkAuditSummary struct {
+	JobID   string              `json:"job_id"`
+	Entries []NetworkAuditEntry `json:"entries"`
+}
+
+// networkAudit is an HTTP proxy that a job's processes are pointed at with
+// HTTP_PROXY and HTTPS_PROXY, which records the DNS lookups it makes for
+// them, the hosts they send requests to, and the server names in their TLS
+// handshakes. Processes that ignore the proxy variables aren't seen.
+type networkAudit struct {
+	listener net.Listener
+	server   *http.Server
+	resolver *net.Resolver
+
+	mu      sync.Mutex
+	entries map[string]*NetworkAuditEntry
+}
+
+func newNetworkAudit() *networkAudit {
+	return &networkAudit{
+		resolver: net.DefaultResolver,
+		entries:  map[string]*NetworkAuditEntry{},
+	}
+}
+
+// start starts the proxy listening on a random local port
+func (a *networkAudit) start() error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	a.listener = l
+	a.server = &http.Server{Handler: a, ReadHeaderTimeout: time.Minute}
+	go func() { _ = a.server.Serve(l) }()
+	return nil
+}
+
+// URL returns the URL for a job's processes to use as their proxy
+func (a *networkAudit) URL() string {
+	return "http://" + a.listener.Addr().String()
+}
+
+func (a *networkAudit) close() error {
+	if a.server == nil {
+		return nil
+	}
+	return a.server.Close()
+}
+
+func (a *networkAudit) record(typ, destination, sni string, addresses []string) {
+	key := typ + " " + destination + " " + sni
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if e, ok := a.entries[key]; ok {
+		e.Count++
+		return
+	}
+	a.entries[key] = &NetworkAuditEntry{
+		Type:        typ,
+		Destination: destination,
+		SNI:         sni,
+		Addresses:   addresses,
+		Count:       1,
+		FirstSeen:   time.Now().UTC(),
+	}
+}
+
+// summary returns what's been recorded, in the order it was first seen
+func (a *networkAudit) summary(jobID string) NetworkAuditSummary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := NetworkAuditSummary{JobID: jobID, Entries: []NetworkAuditEntry{}}
+	for _, e := range a.entries {
+		s.Entries = append(s.Entries, *e)
+	}
+	sort.SliceStable(s.Entries, func(i, j int) bool {
+		if !s.Entries[i].FirstSeen.Equal(s.Entries[j].FirstSeen) {
+			return s.Entries[i].FirstSeen.Before(s.Entries[j].FirstSeen)
+		}
+		return s.Entries[i].Destination < s.Entries[j].Destination
+	})
+	return s
+}
+
+// dial resolves the host itself so the lookup is recorded, then connects
+func (a *networkAudit) dial(ctx context.Context, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := []string{host}
+	if net.ParseIP(host) == nil {
+		addrs, err = a.resolver.LookupHost(ctx, host)
+		a.record("dns", host, "", addrs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var d net.Dialer
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, "tcp", net.JoinHostPort(addr, port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (a *networkAudit) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodConnect {
+		a.serveConnect(w, req)
+		return
+	}
+
+	if req.URL.Host == "" {
+		http.Error(w, "This is a proxy, requests must have an absolute URL", http.StatusBadRequest)
+		return
+	}
+	a.record("http", req.URL.Host, "", nil)
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+			return a.dial(ctx, address)
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	out.Header.Del("Proxy-Connection")
+	out.Header.Del("Proxy-Authorization")
+
+	resp, err := transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for key, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(key, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// serveConnect tunnels a connection, recording the server name from the TLS
+// handshake if the client sends one
+func (a *networkAudit) serveConnect(w http.ResponseWriter, req *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Can't tunnel this connection", http.StatusInternalServerError)
+		return
+	}
+
+	upstream, err := a.dial(req.Context(), req.Host)
+	if err != nil {
+		a.record("https", req.Host, "", nil)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	client, buf, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+
+	// Peek at the start of the handshake for its server name, and send it on
+	// as if nothing had happened. Clients of protocols where the server
+	// speaks first won't send anything yet, so don't wait long.
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	hello, _ := peekTLSRecord(buf.Reader)
+	_ = client.SetReadDeadline(time.Time{})
+
+	sni, _ := parseSNI(hello)
+	a.record("https", req.Host, sni, nil)
+
+	go func() {
+		_, _ = io.Copy(upstream, buf)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// peekTLSRecord returns the first TLS record the client has sent, without
+// consuming it
+func peekTLSRecord(r *bufio.Reader) ([]byte, error) {
+	header, err := r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if length > r.Size()-5 {
+		length = r.Size() - 5
+	}
+	return r.Peek(5 + length)
+}
+
+// parseSNI returns the server name from a TLS ClientHello record
+func parseSNI(record []byte) (string, bool) {
+	// A handshake record holding a ClientHello
+	if len(record) < 9 || record[0] != 0x16 || record[5] != 0x01 {
+		return "", false
+	}
+	b := record[9:]
+
+	// Skip the version and random
+	if len(b) < 34 {
+		return "", false
+	}
+	b = b[34:]
+
+	// Skip the session ID, cipher suites and compression methods
+	for _, lenBytes := range []int{1, 2, 1} {
+		if len(b) < lenBytes {
+			return "", false
+		}
+		n := int(b[0])
+		if lenBytes == 2 {
+			n = int(binary.BigEndian.Uint16(b))
+		}
+		if len(b) < lenBytes+n {
+			return "", false
+		}
+		b = b[lenBytes+n:]
+	}
+
+	if len(b) < 2 {
+		return "", false
+	}
+	b = b[2:]
+
+	for len(b) >= 4 {
+		extType, extLen := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+extLen {
+			return "", false
+		}
+		ext := b[4 : 4+extLen]
+		b = b[4+extLen:]
+
+		// The server_name extension, with a list of names of which the only
+		// type is host_name
+		if extType != 0 || len(ext) < 5 || ext[2] != 0 {
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(ext[3:]))
+		if len(ext) < 5+n {
+			return "", false
+		}
+		return string(ext[5 : 5+n]), true
+	}
+	return "", false
+}
+
+// startNetworkAudit starts the proxy that the job's network activity is
+// recorded by
+func (r *JobRunner) startNetworkAudit() error {
+	audit := newNetworkAudit()
+	if err := audit.start(); err != nil {
+		return fmt.Errorf("Failed to start the job's network audit proxy: %w", err)
+	}
+	r.networkAudit = audit
+	return nil
+}
+
+// networkAuditEnv points the job's processes at the network audit proxy
+func (r *JobRunner) networkAuditEnv(env map[string]string) {
+	if r.networkAudit == nil {
+		return
+	}
+	url := r.networkAudit.URL()
+	for _, key := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+		env[key] = url
+	}
+}
+
+// finishNetworkAudit stops the network audit proxy and uploads what it
+// recorded as a job artifact
+func (r *JobRunner) finishNetworkAudit(ctx context.Context) {
+	if r.networkAudit == nil {
+		return
+	}
+	audit := r.networkAudit
+	r.networkAudit = nil
+
+	if err := audit.close(); err != nil {
+		r.logger.Warn("[NetworkAudit] Couldn't stop the network audit proxy: %v", err)
+	}
+
+	summary := audit.summary(r.job.ID)
+	fmt.Fprintf(r.output, "Network audit recorded %d destinations, uploading them as %s\n", len(summary.Entries), networkAuditArtifact)
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		r.logger.Warn("[NetworkAudit] Couldn't encode the network audit: %v", err)
+		return
+	}
+	if err := r.uploadJobArtifact(ctx, networkAuditArtifact, data); err != nil {
+		r.logger.Warn("[NetworkAudit] Couldn't upload the network audit: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSNI(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: "example.com"}).Handshake()
+	}()
+
+	record := make([]byte, 16*1024)
+	n, err := server.Read(record)
+	require.NoError(t, err)
+	client.Close()
+
+	sni, ok := parseSNI(record[:n])
+	assert.True(t, ok)
+	assert.Equal(t, "example.com", sni)
+
+	_, ok = parseSNI([]byte("GET / HTTP/1.1\r\n"))
+	assert.False(t, ok)
+}
+
+func TestNetworkAuditRecordsRequests(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "plain")
+	}))
+	defer plain.Close()
+
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "secure")
+	}))
+	defer secure.Close()
+
+	audit := newNetworkAudit()
+	require.NoError(t, audit.start())
+	defer audit.close()
+
+	proxyURL, err := url.Parse(audit.URL())
+	require.NoError(t, err)
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{
+			ServerName:         "secure.example.com",
+			InsecureSkipVerify: true,
+		},
+	}}
+
+	_, plainPort, _ := net.SplitHostPort(plain.Listener.Addr().String())
+	for url, body := range map[string]string{
+		"http://localhost:" + plainPort: "plain",
+		secure.URL:                      "secure",
+	} {
+		resp, err := client.Get(url)
+		require.NoError(t, err)
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, body, string(got))
+	}
+
+	summary := audit.summary("my-job")
+	assert.Equal(t, "my-job", summary.JobID)
+
+	var seen []string
+	for _, e := range summary.Entries {
+		seen = append(seen, e.Type+" "+e.Destination+" "+e.SNI)
+	}
+	assert.ElementsMatch(t, []string{
+		"http localhost:" + plainPort + " ",
+		"dns localhost ",
+		"https " + secure.Listener.Addr().String() + " secure.example.com",
+	}, seen)
+}
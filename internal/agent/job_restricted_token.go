@@ -0,0 +1,17 @@
+package agent
+
+// highIntegrityFileLabel is the mandatory label that stops lower integrity
+// processes reading, writing or executing a file. It has no inheritance
+// flags, so when it's put on the config file it doesn't spread to anything
+// next to it, like the agent's binary, builds, hooks or plugins, which jobs
+// with restricted tokens still need.
+const highIntegrityFileLabel = "S:(ML;;NRNWNX;;;HI)"
+
+// restrictedJobLabelTargets returns the paths that are labeled high
+// integrity, so jobs with restricted tokens can't get at them
+func restrictedJobLabelTargets(configPath string) []string {
+	if configPath == "" {
+		return nil
+	}
+	return []string{configPath}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import "errors"
+
+// ProtectFromRestrictedJobs fails, as restricted tokens are only supported
+// on Windows
+func ProtectFromRestrictedJobs(configPath string) error {
+	return errors.New("Jobs can only be run with restricted tokens on Windows")
+}
@@ -0,0 +1,31 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestrictedJobLabelTargetsDefaultWindowsLayout(t *testing.T) {
+	t.Parallel()
+
+	// The layout install.ps1 and packaging/github/windows/buildkite-agent.cfg
+	// set up, where the config file sits next to everything jobs need
+	const configPath = `C:\buildkite-agent\buildkite-agent.cfg`
+
+	assert.Equal(t, []string{configPath}, restrictedJobLabelTargets(configPath))
+
+	// An ACE is (type;flags;rights;...), and any flags would make the label
+	// inherited by the bin, builds, hooks and plugins directories
+	ace := strings.TrimSuffix(strings.TrimPrefix(highIntegrityFileLabel, "S:("), ")")
+	fields := strings.Split(ace, ";")
+	assert.Equal(t, "ML", fields[0])
+	assert.Empty(t, fields[1], "label has inheritance flags %q", fields[1])
+}
+
+func TestRestrictedJobLabelTargetsWithoutConfigFile(t *testing.T) {
+	t.Parallel()
+
+	assert.Empty(t, restrictedJobLabelTargets(""))
+}
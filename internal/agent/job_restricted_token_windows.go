@@ -0,0 +1,59 @@
+//go:build windows
+// +build windows
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// The RID of the high integrity label
+const highIntegrity = 0x3000
+
+// ProtectFromRestrictedJobs checks the agent can run jobs with restricted
+// tokens, which are medium integrity, and labels its configuration file high
+// integrity so they can't read or write it
+func ProtectFromRestrictedJobs(configPath string) error {
+	level, err := integrityLevel(windows.GetCurrentProcessToken())
+	if err != nil {
+		return fmt.Errorf("Failed to find the agent's integrity level: %w", err)
+	}
+	if level < highIntegrity {
+		return errors.New("Jobs can only be run with restricted tokens when the agent's elevated or a service, so they run at a lower integrity than it")
+	}
+
+	sd, err := windows.SecurityDescriptorFromString(highIntegrityFileLabel)
+	if err != nil {
+		return err
+	}
+	sacl, _, err := sd.SACL()
+	if err != nil {
+		return err
+	}
+	for _, path := range restrictedJobLabelTargets(configPath) {
+		if err := windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, windows.LABEL_SECURITY_INFORMATION, nil, nil, nil, sacl); err != nil {
+			return fmt.Errorf("Failed to label %s high integrity: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// integrityLevel returns the RID of a token's integrity label
+func integrityLevel(token windows.Token) (uint32, error) {
+	var n uint32
+	_ = windows.GetTokenInformation(token, windows.TokenIntegrityLevel, nil, 0, &n)
+	if n == 0 {
+		return 0, errors.New("the token has no integrity level")
+	}
+	buf := make([]byte, n)
+	if err := windows.GetTokenInformation(token, windows.TokenIntegrityLevel, &buf[0], n, &n); err != nil {
+		return 0, err
+	}
+	label := (*windows.Tokenmandatorylabel)(unsafe.Pointer(&buf[0]))
+	sid := label.Label.Sid
+	return sid.SubAuthority(uint32(sid.SubAuthorityCount()) - 1), nil
+}
@@ -6,20 +6,22 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
-	"github.com/buildkite/agent/v3/bootstrap/shell"
-	"github.com/buildkite/agent/v3/experiments"
-	"github.com/buildkite/agent/v3/hook"
-	"github.com/buildkite/agent/v3/kubernetes"
+	"github.com/buildkite/agent/v3/internal/experiments"
+	"github.com/buildkite/agent/v3/internal/hook"
+	"github.com/buildkite/agent/v3/internal/jobapi"
+	"github.com/buildkite/agent/v3/internal/kubernetes"
+	"github.com/buildkite/agent/v3/internal/metrics"
+	"github.com/buildkite/agent/v3/internal/status"
 	"github.com/buildkite/agent/v3/logger"
-	"github.com/buildkite/agent/v3/metrics"
 	"github.com/buildkite/agent/v3/process"
-	"github.com/buildkite/agent/v3/status"
+	"github.com/buildkite/agent/v3/shell"
 	"github.com/buildkite/roko"
 	"github.com/buildkite/shellwords"
 )
@@ -42,6 +44,10 @@ const (
 
 	// BuildkiteMessageName is the env var name of the build/commit message.
 	BuildkiteMessageName = "BUILDKITE_MESSAGE"
+
+	// How often a snapshot of a progress bar is written when progress output
+	// is collapsed
+	progressSnapshotInterval = 10 * time.Second
 )
 
 type JobRunnerConfig struct {
@@ -56,6 +62,15 @@ type JobRunnerConfig struct {
 
 	// Whether to set debug HTTP Requests in the job
 	DebugHTTP bool
+
+	// When the job was assigned to the agent, and when the agent finished
+	// accepting it
+	AssignedAt time.Time
+	AcceptedAt time.Time
+
+	// The index of the worker running the job, when the agent's spawned
+	// more than one
+	SpawnIndex int
 }
 
 type jobRunner interface {
@@ -85,12 +100,33 @@ type JobRunner struct {
 	// The internal process of the job
 	process jobAPI
 
+	// Measures what the job uses, if enabled
+	usage *jobUsageTracker
+
+	// The network namespace the job runs in, if it has an egress policy
+	network *jobNetwork
+
+	// The proxy that records the job's network activity, if enabled
+	networkAudit *networkAudit
+
+	// What the job wrote outside of the paths it's allowed to, if watched
+	writeGuard *jobWriteGuard
+
+	// The user the job runs as, if it has one of its own
+	jobUser *jobUser
+
+	// Where each line of the job's output came from, if it's tagged
+	lineMetadata *process.LineMetadataExtractor
+
 	// The internal buffer of the process output
 	output *process.Buffer
 
 	// The internal header time streamer
 	headerTimesStreamer *headerTimesStreamer
 
+	// The spans marked in the job's output
+	spans *jobSpans
+
 	// The internal log streamer
 	logStreamer *LogStreamer
 
@@ -105,6 +141,28 @@ type JobRunner struct {
 
 	// File containing a copy of the job env
 	envFile *os.File
+
+	// Directory of the job's variables that were too large for its env, if
+	// any were
+	envSpillDir string
+
+	// Whether the job env is too large for the bootstrap to be started with,
+	// or close to it
+	envSizeErr     error
+	envSizeWarning string
+
+	// How long it took to build the job env
+	envBuildDuration time.Duration
+
+	// File the bootstrap writes its start timings to
+	startTimingsPath string
+
+	// Directory the agent creates the job's files in, or the default
+	// temporary directory if empty
+	tempDir string
+
+	// Local server that queues up API calls made by the job
+	jobAPIServer *jobapi.Server
 }
 
 type jobAPI interface {
@@ -139,6 +197,7 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 
 	// Create our header times struct
 	runner.headerTimesStreamer = newHeaderTimesStreamer(l, runner.onUploadHeaderTime)
+	runner.spans = newJobSpans()
 
 	// The log streamer that will take the output chunks, and send them to
 	// the Buildkite Agent API
@@ -147,8 +206,28 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 		MaxChunkSizeBytes: job.ChunksMaxSizeBytes,
 	})
 
+	// Give the job a user of its own to run as, if asked to, whose home
+	// directory holds everything the agent sets up for it. Run removes the
+	// user when the job finishes, so if the job can't be set up to run, it's
+	// removed here instead.
+	setUp := false
+	if conf.AgentConfiguration.JobEphemeralUser {
+		if err := runner.startJobUser(); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if !setUp {
+				runner.removeJobUser()
+			}
+		}()
+	}
+
 	// TempDir is not guaranteed to exist
 	tempDir := os.TempDir()
+	if runner.jobUser != nil {
+		tempDir = runner.jobUser.tempDir()
+	}
+	runner.tempDir = tempDir
 	if _, err := os.Stat(tempDir); os.IsNotExist(err) {
 		// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
 		if err = os.MkdirAll(tempDir, 0777); err != nil {
@@ -164,10 +243,68 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 		runner.envFile = file
 	}
 
+	// Prepare a file for the bootstrap to report how long it took to start
+	if file, err := os.CreateTemp(tempDir, fmt.Sprintf("job-start-timings-%s", job.ID)); err != nil {
+		return runner, err
+	} else {
+		runner.startTimingsPath = file.Name()
+		file.Close()
+	}
+
+	// Give the job a socket to make its API calls through. With batching,
+	// meta-data and annotation calls are queued up so they can be coalesced
+	// into fewer API requests. Otherwise, the job's calls are made with our
+	// token, so the job doesn't need it.
+	batching, proxying := experiments.IsEnabled("job-api-batching"), experiments.IsEnabled("job-api")
+	if batching || proxying {
+		socketPath := filepath.Join(tempDir, fmt.Sprintf("bk-job-%s.sock", job.ID))
+		server := jobapi.NewServer(l, socketPath, job.ID, runner.apiClient)
+		if !batching {
+			server.BatchInterval = 0
+		}
+		if proxying {
+			apiConfig := runner.apiClient.Config()
+			server.AgentEndpoint = apiConfig.Endpoint
+			server.AgentToken = apiConfig.Token
+			server.BuildID = job.Env["BUILDKITE_BUILD_ID"]
+		}
+		if err := server.Start(); err != nil {
+			l.Warn("[JobRunner] Failed to start job API server, job will call the API directly: %v", err)
+		} else {
+			runner.jobAPIServer = server
+		}
+	}
+
+	if conf.AgentConfiguration.JobNetworkAudit {
+		if err := runner.startNetworkAudit(); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.AgentConfiguration.JobWriteGuard != "" {
+		if err := runner.startJobWriteGuard(); err != nil {
+			return nil, err
+		}
+	}
+
+	envStartedAt := time.Now()
 	env, err := runner.createEnvironment()
 	if err != nil {
 		return nil, err
 	}
+	runner.envBuildDuration = time.Since(envStartedAt)
+
+	// The files the agent created for the job have to be the job's user's
+	// for it to use them
+	var credential *process.Credential
+	dir := conf.AgentConfiguration.BuildPath
+	if runner.jobUser != nil {
+		if err := runner.jobUser.chownHome(); err != nil {
+			return nil, fmt.Errorf("Failed to give the job's files to its user: %w", err)
+		}
+		credential = &process.Credential{UID: runner.jobUser.uid, GID: runner.jobUser.gid}
+		dir = runner.jobUser.buildPath()
+	}
 
 	// The bootstrap-script gets parsed based on the operating system
 	cmd, err := shellwords.Split(conf.AgentConfiguration.BootstrapScript)
@@ -195,19 +332,31 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 			return fmt.Sprintf("\x1b_bk;t=%d\x07",
 				time.Now().UnixNano()/int64(time.Millisecond))
 		})
-		processWriter = prefixer
+		processWriter = io.MultiWriter(pw, prefixer)
 		flush = prefixer.Flush
 
+		// Use a scanner to process output for spans only
+		go func() {
+			defer runner.spans.doneScanning()
+			err := process.NewScanner(l).ScanLines(pr, runner.spans.Scan)
+			if err != nil {
+				l.Error("[JobRunner] Encountered error %v", err)
+			}
+		}()
+
 	case conf.AgentConfiguration.TimestampLines:
 		// If we have timestamp lines on, we have to buffer lines before we flush them
 		// because we need to know if the line is a header or not. It's a bummer.
 		processWriter = pw
 
 		go func() {
+			defer runner.spans.doneScanning()
+
 			// Use a scanner to process output line by line
 			err := process.NewScanner(l).ScanLines(pr, func(line string) {
 				// Send to our header streamer and determine if it's a header
 				isHeader := runner.headerTimesStreamer.Scan(line)
+				runner.spans.Scan(line)
 
 				// Prefix non-header log lines with timestamps
 				if !(isHeaderExpansion(line) || isHeader) {
@@ -226,10 +375,12 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 		// Write output directly to the line buffer so we
 		processWriter = io.MultiWriter(pw, runner.output)
 
-		// Use a scanner to process output for headers only
+		// Use a scanner to process output for headers and spans only
 		go func() {
+			defer runner.spans.doneScanning()
 			err := process.NewScanner(l).ScanLines(pr, func(line string) {
 				runner.headerTimesStreamer.Scan(line)
+				runner.spans.Scan(line)
 			})
 			if err != nil {
 				l.Error("[JobRunner] Encountered error %v", err)
@@ -237,6 +388,21 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 		}()
 	}
 
+	// The tags the bootstrap starts each line with are taken out of the
+	// output before it's logged, into a record that's uploaded with the job
+	if conf.AgentConfiguration.JobLogLineMetadata {
+		extractor := process.NewLineMetadataExtractor(processWriter)
+		runner.lineMetadata = extractor
+		processWriter = extractor
+		flushOutput := flush
+		flush = func() error {
+			if err := extractor.Flush(); err != nil {
+				return err
+			}
+			return flushOutput()
+		}
+	}
+
 	// if agent config "EnableJobLogTmpfile" is set, we extend the processWriter to write to a temporary file.
 	// BUILDKITE_JOB_LOG_TMPFILE is an environment variable that contains the path to this temporary file.
 	var tmpFile *os.File
@@ -249,6 +415,37 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 		processWriter = io.MultiWriter(processWriter, tmpFile)
 	}
 
+	// Progress bars are collapsed before the output is logged, so
+	// their updates don't take up the log or the log file
+	if conf.AgentConfiguration.CollapseProgressOutput {
+		collapser := process.NewProgressCollapser(processWriter, progressSnapshotInterval)
+		processWriter = collapser
+		flushOutput := flush
+		flush = func() error {
+			if err := collapser.Flush(); err != nil {
+				return err
+			}
+			return flushOutput()
+		}
+	}
+
+	// Output that isn't UTF-8 is converted before anything else sees it, so
+	// it's also collapsed and written to the log file as UTF-8
+	if conf.AgentConfiguration.JobOutputEncoding != "" {
+		transcoder, err := process.NewOutputTranscoder(processWriter, conf.AgentConfiguration.JobOutputEncoding)
+		if err != nil {
+			return nil, err
+		}
+		processWriter = transcoder
+		flushOutput := flush
+		flush = func() error {
+			if err := transcoder.Flush(); err != nil {
+				return err
+			}
+			return flushOutput()
+		}
+	}
+
 	// Copy the current processes ENV and merge in the new ones. We do this
 	// so the sub process gets PATH and stuff. We merge our path in over
 	// the top of the current one so the ENV from Buildkite and the agent
@@ -268,15 +465,23 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 			ClientCount: containerCount,
 		})
 	} else {
+		if conf.AgentConfiguration.JobEgressPolicy {
+			if cmd, err = runner.startJobNetwork(cmd); err != nil {
+				return nil, err
+			}
+		}
+
 		runner.process = process.New(l, process.Config{
 			Path:            cmd[0],
 			Args:            cmd[1:],
-			Dir:             conf.AgentConfiguration.BuildPath,
+			Dir:             dir,
 			Env:             processEnv,
 			PTY:             conf.AgentConfiguration.RunInPty,
 			Stdout:          processWriter,
 			Stderr:          processWriter,
 			InterruptSignal: conf.CancelSignal,
+			RestrictedToken: conf.AgentConfiguration.JobRestrictedToken,
+			Credential:      credential,
 		})
 	}
 
@@ -296,6 +501,7 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 		}
 	}()
 
+	setUp = true
 	return runner, nil
 }
 
@@ -308,6 +514,13 @@ func (r *JobRunner) Run(ctx context.Context) error {
 
 	startedAt := time.Now()
 
+	// However the job ends, stop the job API server
+	defer r.stopJobAPI(ctx)
+	defer r.closeJobNetwork(ctx)
+	defer r.finishNetworkAudit(ctx)
+	defer r.finishJobWriteGuard()
+	defer r.removeJobUser()
+
 	// Start the build in the Buildkite Agent API. This is the first thing
 	// we do so if it fails, we don't have to worry about cleaning things
 	// up like started log streamer workers, and so on.
@@ -361,6 +574,19 @@ func (r *JobRunner) Run(ctx context.Context) error {
 		}
 	}
 
+	// The bootstrap can't be started with an env that's too large, so explain
+	// which variables are to blame rather than fail with an exec error
+	if environmentCommandOkay && r.envSizeErr != nil {
+		environmentCommandOkay = false
+		r.logStreamer.Process(r.envSizeErr.Error() + "\n")
+		r.logger.Error("[JobRunner] %v", r.envSizeErr)
+
+		exitStatus = "-1"
+		signalReason = "process_run_error"
+	} else if environmentCommandOkay && r.envSizeWarning != "" {
+		r.logStreamer.Process("⚠️ " + r.envSizeWarning + "\n")
+	}
+
 	// Used to wait on various routines that we spin up
 	var wg sync.WaitGroup
 
@@ -375,8 +601,41 @@ func (r *JobRunner) Run(ctx context.Context) error {
 		go r.jobLogStreamer(cctx, &wg)
 		go r.jobCancellationChecker(cctx, &wg)
 
+		if mp, ok := r.process.(measurableProcess); ok && (r.conf.AgentConfiguration.JobResourceUsage || r.conf.AgentConfiguration.JobEnergyCPUWatts > 0) {
+			r.usage = newJobUsageTracker(r.logger, r.job.ID)
+			wg.Add(1)
+			go r.usage.track(cctx, &wg, mp)
+		}
+
+		if limit := buildDirQuota(r.conf.AgentConfiguration.BuildDirQuotas, r.job.Env["BUILDKITE_PIPELINE_SLUG"]); limit > 0 {
+			wg.Add(1)
+			go r.buildDirQuotaChecker(cctx, &wg, limit)
+		}
+
+		if mp, ok := r.process.(measurableProcess); ok && r.writeGuard != nil {
+			wg.Add(1)
+			go r.jobWriteGuardian(cctx, &wg, mp)
+		}
+
+		if limit := jobRuntimeLimit(r.conf.AgentConfiguration.MaxJobRuntimes, r.job.Env); limit > 0 {
+			wg.Add(1)
+			go r.jobRuntimeLimiter(cctx, &wg, limit)
+		}
+
 		// Run the process. This will block until it finishes.
-		if err := r.process.Run(cctx); err != nil {
+		processErr := r.process.Run(cctx)
+
+		// Send whatever the job queued up before the job is finished
+		r.stopJobAPI(ctx)
+
+		r.reportJobUsage(ctx)
+		r.reportJobSpans(ctx)
+		r.reportBlockedEgress(ctx)
+		r.finishNetworkAudit(ctx)
+		r.finishJobWriteGuard()
+		r.uploadLineMetadata(ctx)
+
+		if err := processErr; err != nil {
 			// Send the error as output
 			r.logStreamer.Process(fmt.Sprintf("%s", err))
 
@@ -426,6 +685,15 @@ func (r *JobRunner) Run(ctx context.Context) error {
 	r.logger.Debug("[JobRunner] Waiting for all other routines to finish")
 	wg.Wait()
 
+	r.reportStartLatency()
+
+	// Remove the start timings file, if any
+	if r.startTimingsPath != "" {
+		if err := os.Remove(r.startTimingsPath); err != nil {
+			r.logger.Warn("[JobRunner] Error cleaning up start timings file: %s", err)
+		}
+	}
+
 	// Remove the env file, if any
 	if r.envFile != nil {
 		if err := os.Remove(r.envFile.Name()); err != nil {
@@ -434,6 +702,16 @@ func (r *JobRunner) Run(ctx context.Context) error {
 		r.logger.Debug("[JobRunner] Deleted env file: %s", r.envFile.Name())
 	}
 
+	// Remove the variables that were too large for the env, if any
+	if r.envSpillDir != "" {
+		if err := os.RemoveAll(r.envSpillDir); err != nil {
+			r.logger.Warn("[JobRunner] Error cleaning up env spill directory: %s", err)
+		}
+	}
+
+	// Remove the job's user, along with everything it left behind
+	r.removeJobUser()
+
 	// Write some metrics about the job run
 	jobMetrics := r.metrics.With(metrics.Tags{
 		"exit_code": exitStatus,
@@ -446,6 +724,10 @@ func (r *JobRunner) Run(ctx context.Context) error {
 		jobMetrics.Count("jobs.failed", 1)
 	}
 
+	// Any artifacts the job created but never finished uploading would
+	// otherwise be left waiting for an upload that's never going to come
+	r.reconcileArtifacts(ctx)
+
 	// Finish the build in the Buildkite Agent API
 	//
 	// Once we tell the API we're finished it might assign us new work, so make
@@ -505,6 +787,23 @@ func (r *JobRunner) Cancel() error {
 	}
 }
 
+// stopJobAPI stops the job API server, if there is one, after sending any calls
+// the job has queued. Failures are added to the job log.
+func (r *JobRunner) stopJobAPI(ctx context.Context) {
+	if r.jobAPIServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	if err := r.jobAPIServer.Stop(ctx); err != nil {
+		r.logger.Error("[JobRunner] Job API calls failed: %v", err)
+		fmt.Fprintf(r.output, "Some meta-data or annotation calls made by this job failed: %v\n", err)
+	}
+	r.jobAPIServer = nil
+}
+
 // Creates the environment variables that will be used in the process and writes a flat environment file
 func (r *JobRunner) createEnvironment() ([]string, error) {
 	// Create a clone of our jobs environment. We'll then set the
@@ -523,10 +822,8 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	// We present only the clean environment - i.e only variables configured
 	// on the job upstream - and expose the path in another environment variable.
 	if r.envFile != nil {
-		for key, value := range env {
-			if _, err := r.envFile.WriteString(fmt.Sprintf("%s=%q\n", key, value)); err != nil {
-				return nil, err
-			}
+		if err := writeEnvFile(r.envFile, env); err != nil {
+			return nil, err
 		}
 		if err := r.envFile.Close(); err != nil {
 			return nil, err
@@ -534,6 +831,24 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 		env["BUILDKITE_ENV_FILE"] = r.envFile.Name()
 	}
 
+	if r.startTimingsPath != "" {
+		env["BUILDKITE_START_TIMINGS_FILE"] = r.startTimingsPath
+	} else {
+		delete(env, "BUILDKITE_START_TIMINGS_FILE")
+	}
+
+	if r.jobAPIServer != nil {
+		env["BUILDKITE_AGENT_JOB_API_SOCKET"] = r.jobAPIServer.SocketPath
+	} else {
+		delete(env, "BUILDKITE_AGENT_JOB_API_SOCKET")
+	}
+
+	r.networkAuditEnv(env)
+
+	for k, v := range jobEnvDefaults(r.conf.AgentConfiguration, r.job.Env) {
+		env[k] = v
+	}
+
 	// Certain env can only be set by agent configuration.
 	// We show the user a warning in the bootstrap if they use any of these at a job level.
 
@@ -545,14 +860,36 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 		"BUILDKITE_BIN_PATH",
 		"BUILDKITE_CONFIG_PATH",
 		"BUILDKITE_BUILD_PATH",
+		"BUILDKITE_BUILD_PATH_LAYOUT",
+		"BUILDKITE_AGENT_SPAWN_INDEX",
+		"BUILDKITE_JOB_LOG_LINE_METADATA",
+		"BUILDKITE_BUILD_DIR_ENCRYPTION",
+		"BUILDKITE_BUILD_DIR_ENCRYPTION_SIZE",
+		"BUILDKITE_BUILD_DIR_TMPFS",
+		"BUILDKITE_BUILD_DIR_TMPFS_SIZE",
+		"BUILDKITE_BUILD_DIR_OVERLAY_PATH",
+		"BUILDKITE_BUILD_DIR_OVERLAY_REFRESH_INTERVAL",
+		"BUILDKITE_BUILD_DIR_SELINUX_LABEL",
 		"BUILDKITE_GIT_MIRRORS_PATH",
 		"BUILDKITE_GIT_MIRRORS_SKIP_UPDATE",
 		"BUILDKITE_HOOKS_PATH",
+		"BUILDKITE_HOOK_CHECKSUMS_PATH",
+		"BUILDKITE_SECRET_SCAN",
+		"BUILDKITE_SECRET_SCAN_RULES_PATH",
+		"BUILDKITE_POLICY_SCANNER",
+		"BUILDKITE_FAILURE_BUNDLE_MAX_SIZE",
+		"BUILDKITE_DOCKER_DAEMON",
+		"BUILDKITE_DOCKER_DAEMON_IMAGE",
+		"BUILDKITE_ROOTLESS",
 		"BUILDKITE_PLUGINS_PATH",
+		"BUILDKITE_PLUGINS_CACHE_PATH",
 		"BUILDKITE_SSH_KEYSCAN",
+		"BUILDKITE_SSH_STRICT_HOST_CHECKING",
 		"BUILDKITE_GIT_SUBMODULES",
 		"BUILDKITE_COMMAND_EVAL",
 		"BUILDKITE_PLUGINS_ENABLED",
+		"BUILDKITE_ALLOWED_PLUGINS",
+		"BUILDKITE_DENIED_PLUGINS",
 		"BUILDKITE_LOCAL_HOOKS_ENABLED",
 		"BUILDKITE_GIT_CHECKOUT_FLAGS",
 		"BUILDKITE_GIT_CLONE_FLAGS",
@@ -561,6 +898,17 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 		"BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT",
 		"BUILDKITE_GIT_CLEAN_FLAGS",
 		"BUILDKITE_SHELL",
+		"BUILDKITE_START_TIMINGS_FILE",
+		"BUILDKITE_AGENT_JOB_API_SOCKET",
+		"BUILDKITE_AGENT_DNS_OVERRIDES",
+		"BUILDKITE_AGENT_DNS_RESOLVER",
+		"BUILDKITE_AGENT_HOST_FINGERPRINT",
+		"BUILDKITE_AGENT_HOST_DRIFT",
+		"BUILDKITE_AGENT_ATTESTATION",
+		"BUILDKITE_JOB_UMASK",
+		"BUILDKITE_JOB_DIRECTORY_MODE",
+		"BUILDKITE_SPILLED_ENV",
+		"BUILDKITE_SIGNAL_GRACE_PERIOD_SECONDS",
 	}
 
 	var ignoredEnv []string
@@ -580,7 +928,12 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	// Add the API configuration
 	apiConfig := r.apiClient.Config()
 	env["BUILDKITE_AGENT_ENDPOINT"] = apiConfig.Endpoint
-	env["BUILDKITE_AGENT_ACCESS_TOKEN"] = apiConfig.Token
+	if r.jobAPIServer == nil || r.jobAPIServer.AgentToken == "" {
+		env["BUILDKITE_AGENT_ACCESS_TOKEN"] = apiConfig.Token
+	} else {
+		// The job API proxies calls with the token instead
+		delete(env, "BUILDKITE_AGENT_ACCESS_TOKEN")
+	}
 
 	// Add agent environment variables
 	env["BUILDKITE_AGENT_DEBUG"] = fmt.Sprintf("%t", r.conf.Debug)
@@ -602,14 +955,88 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	// Add options from the agent configuration
 	env["BUILDKITE_CONFIG_PATH"] = r.conf.AgentConfiguration.ConfigPath
 	env["BUILDKITE_BUILD_PATH"] = r.conf.AgentConfiguration.BuildPath
+	env["BUILDKITE_BUILD_PATH_LAYOUT"] = r.conf.AgentConfiguration.BuildPathLayout
+	env["BUILDKITE_AGENT_SPAWN_INDEX"] = fmt.Sprintf("%d", r.conf.SpawnIndex)
+	env["BUILDKITE_JOB_LOG_LINE_METADATA"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.JobLogLineMetadata)
+	env["BUILDKITE_BUILD_DIR_ENCRYPTION"] = r.conf.AgentConfiguration.BuildDirEncryption
+	env["BUILDKITE_BUILD_DIR_ENCRYPTION_SIZE"] = r.conf.AgentConfiguration.BuildDirEncryptionSize
+	env["BUILDKITE_BUILD_DIR_TMPFS"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.BuildDirTmpfs)
+	env["BUILDKITE_BUILD_DIR_TMPFS_SIZE"] = r.conf.AgentConfiguration.BuildDirTmpfsSize
+	env["BUILDKITE_BUILD_DIR_OVERLAY_PATH"] = r.conf.AgentConfiguration.BuildDirOverlayPath
+	env["BUILDKITE_BUILD_DIR_OVERLAY_REFRESH_INTERVAL"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.BuildDirOverlayRefresh)
+	env["BUILDKITE_BUILD_DIR_SELINUX_LABEL"] = r.conf.AgentConfiguration.BuildDirSELinuxLabel
 	env["BUILDKITE_GIT_MIRRORS_PATH"] = r.conf.AgentConfiguration.GitMirrorsPath
 	env["BUILDKITE_GIT_MIRRORS_SKIP_UPDATE"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.GitMirrorsSkipUpdate)
 	env["BUILDKITE_HOOKS_PATH"] = r.conf.AgentConfiguration.HooksPath
+	env["BUILDKITE_HOOK_CHECKSUMS_PATH"] = r.conf.AgentConfiguration.HookChecksumsPath
+	env["BUILDKITE_SECRET_SCAN"] = r.conf.AgentConfiguration.SecretScan
+	env["BUILDKITE_SECRET_SCAN_RULES_PATH"] = r.conf.AgentConfiguration.SecretScanRulesPath
+	env["BUILDKITE_POLICY_SCANNER"] = r.conf.AgentConfiguration.PolicyScannerPath
+	env["BUILDKITE_DOCKER_DAEMON"] = r.conf.AgentConfiguration.DockerDaemon
+	env["BUILDKITE_DOCKER_DAEMON_IMAGE"] = r.conf.AgentConfiguration.DockerDaemonImage
+	env["BUILDKITE_ROOTLESS"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.Rootless)
+	if r.conf.AgentConfiguration.FailureBundleMaxSize > 0 {
+		env["BUILDKITE_FAILURE_BUNDLE_MAX_SIZE"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.FailureBundleMaxSize)
+	} else {
+		delete(env, "BUILDKITE_FAILURE_BUNDLE_MAX_SIZE")
+	}
+
+	// A job can bundle up its own paths when it fails, rather than the agent's
+	if _, exists := env["BUILDKITE_FAILURE_BUNDLE_PATHS"]; !exists && r.conf.AgentConfiguration.FailureBundlePaths != "" {
+		env["BUILDKITE_FAILURE_BUNDLE_PATHS"] = r.conf.AgentConfiguration.FailureBundlePaths
+	}
+
+	// Likewise a job can ask for a virtual display, or a different one
+	if _, exists := env["BUILDKITE_VIRTUAL_DISPLAY"]; !exists && r.conf.AgentConfiguration.VirtualDisplay != "" {
+		env["BUILDKITE_VIRTUAL_DISPLAY"] = r.conf.AgentConfiguration.VirtualDisplay
+	}
+	if _, exists := env["BUILDKITE_VIRTUAL_DISPLAY_SIZE"]; !exists && r.conf.AgentConfiguration.VirtualDisplaySize != "" {
+		env["BUILDKITE_VIRTUAL_DISPLAY_SIZE"] = r.conf.AgentConfiguration.VirtualDisplaySize
+	}
+	// And for its repository to be checked out another way
+	if _, exists := env["BUILDKITE_GIT_CHECKOUT_STRATEGY"]; !exists && r.conf.AgentConfiguration.GitCheckoutStrategy != "" {
+		env["BUILDKITE_GIT_CHECKOUT_STRATEGY"] = r.conf.AgentConfiguration.GitCheckoutStrategy
+	}
+	if _, exists := env["BUILDKITE_GIT_SHALLOW_DEPTH"]; !exists && r.conf.AgentConfiguration.GitShallowDepth > 0 {
+		env["BUILDKITE_GIT_SHALLOW_DEPTH"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.GitShallowDepth)
+	}
+	if _, exists := env["BUILDKITE_GIT_LFS"]; !exists && r.conf.AgentConfiguration.GitLFS {
+		env["BUILDKITE_GIT_LFS"] = "true"
+	}
+	// And for its phases to be marked in its log
+	if _, exists := env["BUILDKITE_JOB_LOG_PHASE_MARKERS"]; !exists && r.conf.AgentConfiguration.JobLogPhaseMarkers {
+		env["BUILDKITE_JOB_LOG_PHASE_MARKERS"] = "true"
+	}
+	// And for the format of its log
+	if _, exists := env["BUILDKITE_JOB_LOG_FORMAT"]; !exists && r.conf.AgentConfiguration.JobLogFormat != "" {
+		env["BUILDKITE_JOB_LOG_FORMAT"] = r.conf.AgentConfiguration.JobLogFormat
+	}
+	// Let build tools find the agent's build cache server
+	if r.conf.AgentConfiguration.BuildCacheURL != "" {
+		env["BUILDKITE_BUILD_CACHE_URL"] = r.conf.AgentConfiguration.BuildCacheURL
+	}
+	// And for artifacts to be linked from the host's content store
+	if _, exists := env["BUILDKITE_ARTIFACT_CONTENT_STORE"]; !exists && r.conf.AgentConfiguration.ArtifactContentStore != "" {
+		env["BUILDKITE_ARTIFACT_CONTENT_STORE"] = r.conf.AgentConfiguration.ArtifactContentStore
+	}
+	// And for the images and reports it uploads to be previewed
+	if _, exists := env["BUILDKITE_ARTIFACT_PREVIEWS"]; !exists && r.conf.AgentConfiguration.ArtifactPreviews {
+		env["BUILDKITE_ARTIFACT_PREVIEWS"] = "true"
+	}
+	// And for how long its parallel jobs take to be compared
+	if _, exists := env["BUILDKITE_PARALLEL_SKEW_THRESHOLD"]; !exists && r.conf.AgentConfiguration.ParallelSkewThreshold > 0 {
+		env["BUILDKITE_PARALLEL_SKEW_THRESHOLD"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.ParallelSkewThreshold)
+	}
 	env["BUILDKITE_PLUGINS_PATH"] = r.conf.AgentConfiguration.PluginsPath
+	env["BUILDKITE_PLUGINS_CACHE_PATH"] = r.conf.AgentConfiguration.PluginsCachePath
+	r.jobUserEnv(env)
 	env["BUILDKITE_SSH_KEYSCAN"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKeyscan)
+	env["BUILDKITE_SSH_STRICT_HOST_CHECKING"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHStrictHostChecking)
 	env["BUILDKITE_GIT_SUBMODULES"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.GitSubmodules)
 	env["BUILDKITE_COMMAND_EVAL"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.CommandEval)
 	env["BUILDKITE_PLUGINS_ENABLED"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.PluginsEnabled)
+	env["BUILDKITE_ALLOWED_PLUGINS"] = strings.Join(r.conf.AgentConfiguration.AllowedPlugins, ",")
+	env["BUILDKITE_DENIED_PLUGINS"] = strings.Join(r.conf.AgentConfiguration.DeniedPlugins, ",")
 	env["BUILDKITE_LOCAL_HOOKS_ENABLED"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.LocalHooksEnabled)
 	env["BUILDKITE_GIT_CHECKOUT_FLAGS"] = r.conf.AgentConfiguration.GitCheckoutFlags
 	env["BUILDKITE_GIT_CLONE_FLAGS"] = r.conf.AgentConfiguration.GitCloneFlags
@@ -621,11 +1048,62 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	env["BUILDKITE_AGENT_EXPERIMENT"] = strings.Join(experiments.Enabled(), ",")
 	env["BUILDKITE_REDACTED_VARS"] = strings.Join(r.conf.AgentConfiguration.RedactedVars, ",")
 
+	// So the agent commands run by the job resolve hosts the same way we do
+	if len(r.conf.AgentConfiguration.DNSOverrides) > 0 {
+		env["BUILDKITE_AGENT_DNS_OVERRIDES"] = strings.Join(r.conf.AgentConfiguration.DNSOverrides, ",")
+	} else {
+		delete(env, "BUILDKITE_AGENT_DNS_OVERRIDES")
+	}
+	if r.conf.AgentConfiguration.DNSResolver != "" {
+		env["BUILDKITE_AGENT_DNS_RESOLVER"] = r.conf.AgentConfiguration.DNSResolver
+	} else {
+		delete(env, "BUILDKITE_AGENT_DNS_RESOLVER")
+	}
+
+	// So builds that only fail on some agents can be told apart by the host
+	if r.conf.AgentConfiguration.HostFingerprint != "" {
+		env["BUILDKITE_AGENT_HOST_FINGERPRINT"] = r.conf.AgentConfiguration.HostFingerprint
+	} else {
+		delete(env, "BUILDKITE_AGENT_HOST_FINGERPRINT")
+	}
+	if len(r.conf.AgentConfiguration.HostFingerprintDrift) > 0 {
+		env["BUILDKITE_AGENT_HOST_DRIFT"] = strings.Join(r.conf.AgentConfiguration.HostFingerprintDrift, "\n")
+	} else {
+		delete(env, "BUILDKITE_AGENT_HOST_DRIFT")
+	}
+
+	// And whether the host it's running on was verified to be sanctioned,
+	// which the job can't claim for itself when it wasn't
+	if r.agent != nil && r.agent.AttestationStatus != "" {
+		env["BUILDKITE_AGENT_ATTESTATION"] = r.agent.AttestationStatus
+	} else {
+		delete(env, "BUILDKITE_AGENT_ATTESTATION")
+	}
+
 	// propagate CancelSignal to bootstrap, unless it's the default SIGTERM
 	if r.conf.CancelSignal != process.SIGTERM {
 		env["BUILDKITE_CANCEL_SIGNAL"] = r.conf.CancelSignal.String()
 	}
 
+	// The permissions policy is the agent's, so jobs can't loosen it
+	if r.conf.AgentConfiguration.JobUmask != "" {
+		env["BUILDKITE_JOB_UMASK"] = r.conf.AgentConfiguration.JobUmask
+	} else {
+		delete(env, "BUILDKITE_JOB_UMASK")
+	}
+	if r.conf.AgentConfiguration.JobDirectoryMode != "" {
+		env["BUILDKITE_JOB_DIRECTORY_MODE"] = r.conf.AgentConfiguration.JobDirectoryMode
+	} else {
+		delete(env, "BUILDKITE_JOB_DIRECTORY_MODE")
+	}
+
+	// And how long it waits after cancelling before it kills what's left
+	if r.conf.AgentConfiguration.SignalGracePeriodSeconds > 0 {
+		env["BUILDKITE_SIGNAL_GRACE_PERIOD_SECONDS"] = strconv.Itoa(r.conf.AgentConfiguration.SignalGracePeriodSeconds)
+	} else {
+		delete(env, "BUILDKITE_SIGNAL_GRACE_PERIOD_SECONDS")
+	}
+
 	// Whether to enable profiling in the bootstrap
 	if r.conf.AgentConfiguration.Profile != "" {
 		env["BUILDKITE_AGENT_PROFILE"] = r.conf.AgentConfiguration.Profile
@@ -659,6 +1137,23 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 		// attempt to continue anyway
 	}
 
+	// Move large variables out of the env if we've been asked to, then check
+	// the rest will fit
+	spilled, err := r.spillEnv(env)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to move large environment variables to files: %w", err)
+	}
+	if len(spilled) > 0 {
+		env["BUILDKITE_SPILLED_ENV"] = strings.Join(spilled, ",")
+		r.logger.Info("[JobRunner] Moved large environment variables to files: %s", strings.Join(spilled, ", "))
+	} else {
+		delete(env, "BUILDKITE_SPILLED_ENV")
+	}
+	r.envSizeWarning, r.envSizeErr = checkEnvSize(env, envLimitsFor(runtime.GOOS))
+	if r.envSizeWarning != "" {
+		r.logger.Warn("[JobRunner] %s", r.envSizeWarning)
+	}
+
 	// Convert the env map into a slice (which is what the script gear
 	// needs)
 	envSlice := []string{}
@@ -729,13 +1224,25 @@ func (r *JobRunner) executePreBootstrapHook(ctx context.Context, hook string) (b
 func (r *JobRunner) startJob(ctx context.Context, startedAt time.Time) error {
 	r.job.StartedAt = startedAt.UTC().Format(time.RFC3339Nano)
 
+	key := newIdempotencyKey()
+	unknown := false
+
 	return roko.NewRetrier(
 		roko.WithMaxAttempts(7),
 		roko.WithStrategy(roko.Exponential(2*time.Second, 0)),
 	).DoWithContext(ctx, func(rtr *roko.Retrier) error {
-		response, err := r.apiClient.StartJob(ctx, r.job)
+		response, err := r.apiClient.StartJob(ctx, r.job, key)
 
 		if err != nil {
+			// Buildkite rejecting a retry after an attempt whose response
+			// was lost means that attempt started the job
+			if unknown && response != nil && response.StatusCode == 422 {
+				r.logger.Warn("Buildkite rejected the retried call to start the job, so an earlier attempt started it (%s)", err)
+				rtr.Break()
+				return nil
+			}
+			unknown = unknown || outcomeUnknown(response)
+
 			if response != nil && api.IsRetryableStatus(response) {
 				r.logger.Warn("%s (%s)", err, rtr)
 			} else if api.IsRetryableError(err) {
@@ -750,6 +1257,19 @@ func (r *JobRunner) startJob(ctx context.Context, startedAt time.Time) error {
 	})
 }
 
+// newIdempotencyKey returns a header to send with each attempt at a call that
+// changes a job, so that Buildkite only acts on one of them
+func newIdempotencyKey() api.Header {
+	return api.Header{Name: api.IdempotencyKeyHeader, Value: api.NewUUID()}
+}
+
+// outcomeUnknown returns whether a call that failed with response might have
+// been acted on by Buildkite anyway, because the response was lost, or it
+// came from a proxy or load balancer in front of Buildkite
+func outcomeUnknown(response *api.Response) bool {
+	return response == nil || response.StatusCode >= 500
+}
+
 // finishJob finishes the job in the Buildkite Agent API. If the FinishJob call
 // cannot return successfully, this will retry for a long time.
 func (r *JobRunner) finishJob(ctx context.Context, finishedAt time.Time, exitStatus, signal, signalReason string, failedChunkCount int) error {
@@ -765,13 +1285,26 @@ func (r *JobRunner) finishJob(ctx context.Context, finishedAt time.Time, exitSta
 	ctx, cancel := context.WithTimeout(ctx, 48*time.Hour)
 	defer cancel()
 
+	key := newIdempotencyKey()
+	unknown := false
+
 	return roko.NewRetrier(
 		roko.TryForever(),
 		roko.WithJitter(),
 		roko.WithStrategy(roko.Constant(1*time.Second)),
 	).DoWithContext(ctx, func(retrier *roko.Retrier) error {
-		response, err := r.apiClient.FinishJob(ctx, r.job)
+		response, err := r.apiClient.FinishJob(ctx, r.job, key)
 		if err != nil {
+			// Likewise, a rejected retry after an attempt whose response
+			// was lost means that attempt finished the job, with this exit
+			// status
+			if unknown && response != nil && response.StatusCode == 422 {
+				r.logger.Warn("Buildkite rejected the retried call to finish the job, so an earlier attempt finished it (%s)", err)
+				retrier.Break()
+				return nil
+			}
+			unknown = unknown || outcomeUnknown(response)
+
 			// If the API returns with a 422, that means that we
 			// succesfully tried to finish the job, but Buildkite
 			// rejected the finish for some reason. This can
@@ -833,6 +1366,32 @@ func (r *JobRunner) jobLogStreamer(ctx context.Context, wg *sync.WaitGroup) {
 	// The final output after the process has finished is processed in Run().
 }
 
+// jobRuntimeLimiter cancels the job if it runs for longer than limit, which
+// protects the agent from jobs that Buildkite won't time out
+func (r *JobRunner) jobRuntimeLimiter(ctx context.Context, wg *sync.WaitGroup, limit time.Duration) {
+	defer wg.Done()
+
+	select {
+	case <-r.process.Started():
+	case <-ctx.Done():
+		return
+	}
+
+	select {
+	case <-time.After(limit):
+		r.logger.Warn("[JobRunner] Job %s has run for longer than the maximum of %s, canceling it", r.job.ID, limit)
+		fmt.Fprintf(r.output, "This job has run for longer than this agent's maximum job runtime of %s, so it's being canceled\n", limit)
+		r.metrics.Count("jobs.max_runtime_exceeded", 1)
+
+		if err := r.Cancel(); err != nil {
+			r.logger.Error("Unexpected error canceling process that exceeded the maximum runtime (job: %s) (err: %s)", r.job.ID, err)
+		}
+
+	case <-ctx.Done():
+	case <-r.process.Done():
+	}
+}
+
 // jobCancellationChecker waits for the processs to start, then continuously
 // polls GetJobState to see if the job has been cancelled server-side. If so,
 // it calls r.Cancel.
@@ -938,3 +1497,63 @@ func (r *JobRunner) onUploadChunk(ctx context.Context, chunk *LogStreamerChunk)
 		return err
 	})
 }
+
+// reconcileArtifacts marks the artifacts the job created, but which were
+// never uploaded, as errored
+func (r *JobRunner) reconcileArtifacts(ctx context.Context) {
+	buildID := r.job.Env["BUILDKITE_BUILD_ID"]
+	if buildID == "" {
+		return
+	}
+
+	artifacts, _, err := r.apiClient.SearchArtifacts(ctx, buildID, &api.ArtifactSearchOptions{
+		Scope:             r.job.ID,
+		State:             "new",
+		IncludeDuplicates: true,
+	})
+	if err != nil {
+		r.logger.Warn("[JobRunner] Couldn't find the job's unfinished artifacts: %v", err)
+		return
+	}
+
+	states := map[string]string{}
+	for _, artifact := range artifacts {
+		if artifact.JobID == r.job.ID {
+			states[artifact.ID] = "error"
+		}
+	}
+	if len(states) == 0 {
+		return
+	}
+
+	r.logger.Warn("[JobRunner] %d of the job's artifacts were never uploaded", len(states))
+	if _, err := r.apiClient.UpdateArtifacts(ctx, r.job.ID, states); err != nil {
+		r.logger.Warn("[JobRunner] Couldn't mark the job's unfinished artifacts as errored: %v", err)
+	}
+}
+
+// uploadJobArtifact uploads data the agent's recorded about the job as one
+// of its artifacts
+func (r *JobRunner) uploadJobArtifact(ctx context.Context, name string, data []byte) error {
+	dir, err := os.MkdirTemp("", "buildkite-job-artifact")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+
+	uploader := NewArtifactUploader(r.logger, r.apiClient, ArtifactUploaderConfig{
+		JobID:       r.job.ID,
+		Destination: strings.TrimSpace(r.job.Env["BUILDKITE_ARTIFACT_UPLOAD_DESTINATION"]),
+		DebugHTTP:   r.conf.DebugHTTP,
+	})
+	artifact, err := uploader.build(name, path, path)
+	if err != nil {
+		return err
+	}
+	return uploader.upload(ctx, []*api.Artifact{artifact})
+}
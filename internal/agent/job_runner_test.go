@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/fakeapi"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTruncateEnv(t *testing.T) {
+	l := logger.NewBuffer()
+	env := map[string]string{"FOO": strings.Repeat("a", 100)}
+	err := truncateEnv(l, env, "FOO", 64)
+	require.NoError(t, err)
+	assert.Equal(t, "aaaaaaaaaaaaaaaaaaaaaaaaaa[value truncated 100 -> 59 bytes]", env["FOO"])
+	assert.Equal(t, 64, len(fmt.Sprintf("FOO=%s\000", env["FOO"])))
+}
+
+func TestFinishJobAfterLostResponse(t *testing.T) {
+	t.Parallel()
+
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/jobs/finishuuid/finish":
+			keys = append(keys, req.Header.Get(api.IdempotencyKeyHeader))
+			if len(keys) == 1 {
+				// The job's finished, but the response doesn't make it back
+				http.Error(rw, "Bad gateway", http.StatusBadGateway)
+				return
+			}
+			http.Error(rw, `{"message": "Job is already finished"}`, http.StatusUnprocessableEntity)
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	r := &JobRunner{
+		logger:    logger.Discard,
+		job:       &api.Job{ID: "finishuuid"},
+		apiClient: api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"}),
+	}
+
+	err := r.finishJob(context.Background(), time.Now(), "0", "", "", 0)
+	assert.NoError(t, err)
+
+	require.Len(t, keys, 2)
+	assert.NotEmpty(t, keys[0])
+	assert.Equal(t, keys[0], keys[1], "each attempt should have the same idempotency key")
+}
+
+func TestReconcileArtifacts(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	server := fakeapi.NewServer(logger.Discard, fakeapi.Config{})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	jobID := server.AddJob(nil)
+	otherJobID := server.AddJob(nil)
+	reg, _, err := api.NewClient(logger.Discard, api.Config{Endpoint: ts.URL, Token: "llamas"}).
+		Register(ctx, &api.AgentRegisterRequest{Name: "agent-1"})
+	require.NoError(t, err)
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: ts.URL, Token: reg.AccessToken})
+
+	// Artifacts that were created, but which never finished uploading
+	for _, id := range []string{jobID, otherJobID} {
+		_, _, err = client.CreateArtifacts(ctx, id, &api.ArtifactBatch{
+			Artifacts: []*api.Artifact{{Path: "out.txt"}},
+		})
+		require.NoError(t, err)
+	}
+
+	r := &JobRunner{
+		logger:    logger.Discard,
+		job:       &api.Job{ID: jobID, Env: map[string]string{"BUILDKITE_BUILD_ID": server.BuildID()}},
+		apiClient: client,
+	}
+	r.reconcileArtifacts(ctx)
+
+	states := map[string]string{}
+	for _, a := range server.Artifacts() {
+		states[a.JobID] = a.State
+	}
+	assert.Equal(t, map[string]string{jobID: "error", otherJobID: "new"}, states)
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// JobRuntimeLimit is the longest a job can run before the agent cancels it,
+// regardless of the timeout Buildkite has for it. If Tag is set, it only
+// applies to jobs run with that tag, e.g. queue=deploy.
+type JobRuntimeLimit struct {
+	Tag   string
+	Value string
+	Limit time.Duration
+}
+
+// ParseJobRuntimeLimits parses limits like "2h", or "queue=deploy:30m" for a
+// limit that only applies to jobs run with a tag
+func ParseJobRuntimeLimits(limits []string) ([]JobRuntimeLimit, error) {
+	var parsed []JobRuntimeLimit
+	for _, s := range limits {
+		var l JobRuntimeLimit
+
+		duration := s
+		if i := strings.LastIndex(s, ":"); i >= 0 {
+			tag, value, ok := strings.Cut(s[:i], "=")
+			if !ok || tag == "" {
+				return nil, fmt.Errorf("invalid max job runtime %q, expected tag=value:duration", s)
+			}
+			l.Tag, l.Value, duration = strings.TrimSpace(tag), strings.TrimSpace(value), s[i+1:]
+		}
+
+		d, err := time.ParseDuration(strings.TrimSpace(duration))
+		if err != nil {
+			return nil, fmt.Errorf("invalid max job runtime %q: %w", s, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid max job runtime %q, it must be more than 0", s)
+		}
+		l.Limit = d
+
+		parsed = append(parsed, l)
+	}
+	return parsed, nil
+}
+
+// appliesTo returns whether the limit applies to a job with the given
+// environment, which has the tags it was run with as
+// BUILDKITE_AGENT_META_DATA_<TAG>
+func (l JobRuntimeLimit) appliesTo(env map[string]string) bool {
+	if l.Tag == "" {
+		return true
+	}
+	key := "BUILDKITE_AGENT_META_DATA_" + strings.ToUpper(strings.ReplaceAll(l.Tag, "-", "_"))
+	value, ok := env[key]
+	return ok && value == l.Value
+}
+
+// jobRuntimeLimit returns the limit for a job, or 0 if it has none. Limits
+// for tags take precedence over those for every job, and the shortest limit
+// wins if there's more than one.
+func jobRuntimeLimit(limits []JobRuntimeLimit, env map[string]string) time.Duration {
+	var tagged, untagged time.Duration
+	for _, l := range limits {
+		if !l.appliesTo(env) {
+			continue
+		}
+		limit := &untagged
+		if l.Tag != "" {
+			limit = &tagged
+		}
+		if *limit == 0 || l.Limit < *limit {
+			*limit = l.Limit
+		}
+	}
+
+	if tagged > 0 {
+		return tagged
+	}
+	return untagged
+}
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseJobRuntimeLimits(t *testing.T) {
+	limits, err := ParseJobRuntimeLimits([]string{"6h", "queue=deploy:30m", "os=linux:with:colons:1h"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []JobRuntimeLimit{
+		{Limit: 6 * time.Hour},
+		{Tag: "queue", Value: "deploy", Limit: 30 * time.Minute},
+		{Tag: "os", Value: "linux:with:colons", Limit: time.Hour},
+	}, limits)
+
+	for _, invalid := range []string{"forever", "queue=deploy:soon", "deploy:30m", "0s", "queue=deploy:-1h"} {
+		_, err := ParseJobRuntimeLimits([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestJobRuntimeLimit(t *testing.T) {
+	limits := []JobRuntimeLimit{
+		{Limit: 6 * time.Hour},
+		{Tag: "queue", Value: "deploy", Limit: 30 * time.Minute},
+		{Tag: "docker-arch", Value: "arm64", Limit: time.Hour},
+		{Tag: "queue", Value: "deploy", Limit: 45 * time.Minute},
+	}
+
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		want time.Duration
+	}{
+		{"untagged", map[string]string{"BUILDKITE_AGENT_META_DATA_QUEUE": "default"}, 6 * time.Hour},
+		{"tagged", map[string]string{"BUILDKITE_AGENT_META_DATA_QUEUE": "deploy"}, 30 * time.Minute},
+		{"dashed tag", map[string]string{"BUILDKITE_AGENT_META_DATA_DOCKER_ARCH": "arm64"}, time.Hour},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, jobRuntimeLimit(limits, tc.env))
+		})
+	}
+
+	assert.Equal(t, time.Duration(0), jobRuntimeLimit(limits[1:2], map[string]string{}))
+	assert.Equal(t, time.Duration(0), jobRuntimeLimit(nil, map[string]string{}))
+}
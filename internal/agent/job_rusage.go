@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// rusageJobUsage returns what the process used, including the processes it
+// waited for, as reported when it exited
+func rusageJobUsage(state *os.ProcessState) (JobUsage, bool) {
+	if state == nil {
+		return JobUsage{}, false
+	}
+	ru, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return JobUsage{}, false
+	}
+
+	usage := JobUsage{
+		Source: "rusage",
+		CPUSeconds: float64(ru.Utime.Sec+ru.Stime.Sec) +
+			float64(ru.Utime.Usec+ru.Stime.Usec)/1e6,
+		PeakRSSBytes: int64(ru.Maxrss),
+	}
+
+	// macOS reports the peak RSS in bytes, and everything else in kilobytes
+	if runtime.GOOS != "darwin" {
+		usage.PeakRSSBytes *= 1024
+	}
+
+	// Linux reports IO as 512 byte blocks. Other platforms count IO
+	// operations, not their size.
+	if runtime.GOOS == "linux" {
+		usage.DiskReadBytes = int64(ru.Inblock) * 512
+		usage.DiskWriteBytes = int64(ru.Oublock) * 512
+	}
+
+	return usage, true
+}
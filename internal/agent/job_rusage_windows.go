@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package agent
+
+import "os"
+
+// rusageJobUsage isn't supported on Windows, which doesn't report the usage
+// of a process's children
+func rusageJobUsage(*os.ProcessState) (JobUsage, bool) {
+	return JobUsage{}, false
+}
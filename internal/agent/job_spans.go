@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/metrics"
+	"github.com/buildkite/agent/v3/internal/tracetools"
+	"github.com/buildkite/roko"
+)
+
+// The spans a job marked with buildkite-agent span are set as build
+// meta-data with this key and the job's ID, e.g. job-spans:0188a5d8-...
+const jobSpansMetaDataPrefix = "job-spans:"
+
+// How long to wait for the end of the job's output to be scanned for spans
+const jobSpansScanTimeout = 5 * time.Second
+
+// jobSpanTotal is how long a job spent in the spans with a name
+type jobSpanTotal struct {
+	Name    string  `json:"name"`
+	Count   int     `json:"count"`
+	Seconds float64 `json:"seconds"`
+
+	duration time.Duration
+}
+
+// jobSpans adds up the spans marked in a job's output
+type jobSpans struct {
+	mu      sync.Mutex
+	scanner *tracetools.UserSpanScanner
+	totals  []*jobSpanTotal
+
+	// Closed once all of the job's output has been scanned
+	scanned chan struct{}
+}
+
+func newJobSpans() *jobSpans {
+	return &jobSpans{
+		scanner: tracetools.NewUserSpanScanner(),
+		scanned: make(chan struct{}),
+	}
+}
+
+// Scan adds the spans a line of the job's output ends
+func (s *jobSpans) Scan(line string) {
+	// Most lines don't have any markers
+	if !strings.Contains(line, "\x1b_bk;span=") {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, span := range s.scanner.Scan(line) {
+		total := s.total(span.Name)
+		total.Count++
+		total.duration += span.Duration()
+	}
+}
+
+// total returns the total for spans with the name, in the order they first
+// ended
+func (s *jobSpans) total(name string) *jobSpanTotal {
+	for _, t := range s.totals {
+		if t.Name == name {
+			return t
+		}
+	}
+	t := &jobSpanTotal{Name: name}
+	s.totals = append(s.totals, t)
+	return t
+}
+
+// doneScanning is called once there's no more of the job's output to scan
+func (s *jobSpans) doneScanning() {
+	close(s.scanned)
+}
+
+// finish waits for the job's output to be scanned, and returns the totals
+// and the spans that weren't ended
+func (s *jobSpans) finish(ctx context.Context) ([]jobSpanTotal, []string) {
+	select {
+	case <-s.scanned:
+	case <-time.After(jobSpansScanTimeout):
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totals := make([]jobSpanTotal, 0, len(s.totals))
+	for _, t := range s.totals {
+		total := *t
+		total.Seconds = t.duration.Seconds()
+		totals = append(totals, total)
+	}
+	return totals, s.scanner.Open()
+}
+
+func (t jobSpanTotal) String() string {
+	s := t.Name + " " + t.duration.Round(time.Millisecond).String()
+	if t.Count > 1 {
+		s += fmt.Sprintf(" (%d times)", t.Count)
+	}
+	return s
+}
+
+// reportJobSpans adds how long the job's spans took to its log, metrics, and
+// build meta-data
+func (r *JobRunner) reportJobSpans(ctx context.Context) {
+	totals, open := r.spans.finish(ctx)
+	if len(open) > 0 {
+		fmt.Fprintf(r.output, "Spans that weren't ended: %s\n", strings.Join(open, ", "))
+	}
+	if len(totals) == 0 {
+		return
+	}
+
+	parts := make([]string, 0, len(totals))
+	for _, t := range totals {
+		parts = append(parts, t.String())
+		r.metrics.Timing("jobs.spans.duration", t.duration, metrics.Tags{"span": t.Name})
+	}
+	fmt.Fprintf(r.output, "Spans: %s\n", strings.Join(parts, ", "))
+
+	data, err := json.Marshal(totals)
+	if err != nil {
+		r.logger.Warn("[JobSpans] Couldn't encode spans: %v", err)
+		return
+	}
+
+	err = roko.NewRetrier(
+		roko.WithMaxAttempts(3),
+		roko.WithStrategy(roko.Constant(2*time.Second)),
+	).DoWithContext(ctx, func(*roko.Retrier) error {
+		_, err := r.apiClient.SetMetaData(ctx, r.job.ID, &api.MetaData{
+			Key:   jobSpansMetaDataPrefix + r.job.ID,
+			Value: string(data),
+		})
+		return err
+	})
+	if err != nil {
+		r.logger.Warn("[JobSpans] Couldn't set spans meta-data: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/tracetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobSpansAddsUpSpansWithTheSameName(t *testing.T) {
+	t.Parallel()
+
+	at := func(ms int64) time.Time { return time.UnixMilli(1690000000000 + ms) }
+
+	s := newJobSpans()
+	for i := int64(0); i < 3; i++ {
+		s.Scan(tracetools.UserSpanMarker("start", "test shard", at(i*1000)))
+		s.Scan("running tests")
+		s.Scan(tracetools.UserSpanMarker("end", "test shard", at(i*1000+500)))
+	}
+	s.Scan(tracetools.UserSpanMarker("start", "npm install", at(0)) + "npm install")
+	s.Scan(tracetools.UserSpanMarker("end", "npm install", at(61500)))
+	s.Scan(tracetools.UserSpanMarker("start", "webpack", at(62000)))
+	s.doneScanning()
+
+	totals, open := s.finish(context.Background())
+	assert.Equal(t, []string{"webpack"}, open)
+	assert.Len(t, totals, 2)
+	assert.Equal(t, "test shard 1.5s (3 times)", totals[0].String())
+	assert.Equal(t, 3, totals[0].Count)
+	assert.Equal(t, 1.5, totals[0].Seconds)
+	assert.Equal(t, "npm install 1m1.5s", totals[1].String())
+}
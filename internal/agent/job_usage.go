@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/roko"
+)
+
+// Jobs' resource usage is set as build meta-data with this key and the job's
+// ID, e.g. job-usage:0188a5d8-...
+const jobUsageMetaDataPrefix = "job-usage:"
+
+// JobUsage is what a job used while it ran, for working out what it cost.
+// Fields are 0 when they couldn't be measured.
+type JobUsage struct {
+	// How it was measured: cgroup, which includes everything the job
+	// started, or rusage, which only includes processes the job waited for
+	Source string `json:"source"`
+
+	CPUSeconds     float64 `json:"cpu_seconds"`
+	PeakRSSBytes   int64   `json:"peak_rss_bytes,omitempty"`
+	DiskReadBytes  int64   `json:"disk_read_bytes,omitempty"`
+	DiskWriteBytes int64   `json:"disk_write_bytes,omitempty"`
+
+	// Estimated from the CPU time, if enabled
+	Energy *JobEnergy `json:"energy,omitempty"`
+}
+
+func (u JobUsage) String() string {
+	parts := []string{fmt.Sprintf("CPU %.1fs", u.CPUSeconds)}
+	if u.PeakRSSBytes > 0 {
+		parts = append(parts, "peak memory "+formatBytes(u.PeakRSSBytes))
+	}
+	if u.DiskReadBytes > 0 || u.DiskWriteBytes > 0 {
+		parts = append(parts, fmt.Sprintf("disk read %s, written %s", formatBytes(u.DiskReadBytes), formatBytes(u.DiskWriteBytes)))
+	}
+	if u.Energy != nil {
+		parts = append(parts, "estimated energy "+u.Energy.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// measurableProcess is a job process that runs on this host, unlike the
+// Kubernetes runner's, so can be measured
+type measurableProcess interface {
+	Started() <-chan struct{}
+	Pid() int
+	ProcessState() *os.ProcessState
+}
+
+// jobUsageTracker measures what a job's process uses. Where it can, it puts
+// the process in its own cgroup, so that what it starts is measured even if
+// it isn't waited for. Otherwise the resource usage reported when the
+// process exits is used.
+type jobUsageTracker struct {
+	logger logger.Logger
+	cgroup *jobCgroup
+
+	mu      sync.Mutex
+	tracked bool
+}
+
+func newJobUsageTracker(l logger.Logger, jobID string) *jobUsageTracker {
+	t := &jobUsageTracker{logger: l}
+
+	cgroup, err := newJobCgroup(jobID)
+	if err != nil {
+		l.Debug("[JobUsage] Not measuring the job with a cgroup: %v", err)
+	} else {
+		t.cgroup = cgroup
+	}
+	return t
+}
+
+// track waits for the process to start, then adds it to the job's cgroup
+func (t *jobUsageTracker) track(ctx context.Context, wg *sync.WaitGroup, p measurableProcess) {
+	defer wg.Done()
+
+	select {
+	case <-p.Started():
+	case <-ctx.Done():
+		return
+	}
+
+	if t.cgroup == nil {
+		return
+	}
+	if err := t.cgroup.add(p.Pid()); err != nil {
+		t.logger.Debug("[JobUsage] Couldn't add the job to its cgroup: %v", err)
+		return
+	}
+
+	t.mu.Lock()
+	t.tracked = true
+	t.mu.Unlock()
+}
+
+// finish returns what the finished process used, and removes the job's cgroup
+func (t *jobUsageTracker) finish(state *os.ProcessState) (JobUsage, bool) {
+	usage, ok := rusageJobUsage(state)
+
+	t.mu.Lock()
+	tracked := t.tracked
+	t.mu.Unlock()
+
+	if t.cgroup != nil {
+		if tracked && t.cgroup.read(&usage) {
+			usage.Source = "cgroup"
+			ok = true
+		}
+		if err := t.cgroup.remove(); err != nil {
+			t.logger.Debug("[JobUsage] Couldn't remove the job's cgroup: %v", err)
+		}
+	}
+
+	return usage, ok
+}
+
+// reportJobUsage adds what the job used to its log, metrics, and build
+// meta-data
+func (r *JobRunner) reportJobUsage(ctx context.Context) {
+	if r.usage == nil {
+		return
+	}
+
+	usage, ok := r.usage.finish(r.process.(measurableProcess).ProcessState())
+	if !ok {
+		return
+	}
+
+	conf := r.conf.AgentConfiguration
+	if conf.JobEnergyCPUWatts > 0 {
+		energy := estimateJobEnergy(usage.CPUSeconds, conf.JobEnergyCPUWatts, conf.JobEnergyCarbonIntensity)
+		usage.Energy = &energy
+	}
+
+	fmt.Fprintf(r.output, "Resource usage: %s\n", usage)
+	r.metrics.Count("jobs.usage.cpu_milliseconds", int64(usage.CPUSeconds*1000))
+
+	if usage.Energy != nil {
+		r.metrics.Count("jobs.energy.milliwatt_hours", int64(usage.Energy.WattHours*1000))
+		r.metrics.Count("jobs.energy.carbon_milligrams", int64(usage.Energy.CarbonGrams*1000))
+
+		if conf.JobEnergyAnnotation {
+			r.annotateJobEnergy(ctx, *usage.Energy)
+		}
+	}
+
+	// The energy estimate can be on without resource usage reporting, which
+	// is all the meta-data is for
+	if !conf.JobResourceUsage {
+		return
+	}
+
+	data, err := json.Marshal(usage)
+	if err != nil {
+		r.logger.Warn("[JobUsage] Couldn't encode resource usage: %v", err)
+		return
+	}
+
+	err = roko.NewRetrier(
+		roko.WithMaxAttempts(3),
+		roko.WithStrategy(roko.Constant(2*time.Second)),
+	).DoWithContext(ctx, func(*roko.Retrier) error {
+		_, err := r.apiClient.SetMetaData(ctx, r.job.ID, &api.MetaData{
+			Key:   jobUsageMetaDataPrefix + r.job.ID,
+			Value: string(data),
+		})
+		return err
+	})
+	if err != nil {
+		r.logger.Warn("[JobUsage] Couldn't set resource usage meta-data: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/metrics"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/process"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobUsageString(t *testing.T) {
+	assert.Equal(t, "CPU 1.5s", JobUsage{CPUSeconds: 1.5}.String())
+
+	assert.Equal(t, "CPU 12.0s, peak memory 512.0 MiB, disk read 900 B, written 1.5 GiB", JobUsage{
+		CPUSeconds:     12,
+		PeakRSSBytes:   512 * 1024 * 1024,
+		DiskReadBytes:  900,
+		DiskWriteBytes: 3 * 512 * 1024 * 1024,
+	}.String())
+}
+
+// exitedProcess is a job process that's finished, for reporting its usage
+type exitedProcess struct {
+	jobAPI
+	state *os.ProcessState
+}
+
+func (p exitedProcess) Pid() int                       { return p.state.Pid() }
+func (p exitedProcess) ProcessState() *os.ProcessState { return p.state }
+
+func TestReportJobUsageOnlySetsMetaDataWithResourceUsageOn(t *testing.T) {
+	t.Parallel()
+
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	require.NoError(t, exited.Run())
+
+	for _, tc := range []struct {
+		name         string
+		conf         AgentConfiguration
+		wantMetaData int32
+	}{
+		{name: "resource usage", conf: AgentConfiguration{JobResourceUsage: true}, wantMetaData: 1},
+		{name: "energy estimate only", conf: AgentConfiguration{JobEnergyCPUWatts: 10}, wantMetaData: 0},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var metaData int32
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if req.URL.Path == "/jobs/usageuuid/data/set" {
+					atomic.AddInt32(&metaData, 1)
+					return
+				}
+				http.Error(rw, "Not found", http.StatusNotFound)
+			}))
+			defer server.Close()
+
+			r := &JobRunner{
+				logger:    logger.Discard,
+				job:       &api.Job{ID: "usageuuid"},
+				conf:      JobRunnerConfig{AgentConfiguration: tc.conf},
+				apiClient: api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"}),
+				metrics:   metrics.NewCollector(logger.Discard, metrics.CollectorConfig{}).Scope(metrics.Tags{}),
+				process:   exitedProcess{state: exited.ProcessState},
+				usage:     &jobUsageTracker{logger: logger.Discard},
+				output:    &process.Buffer{},
+			}
+
+			r.reportJobUsage(context.Background())
+			assert.Equal(t, tc.wantMetaData, atomic.LoadInt32(&metaData))
+		})
+	}
+}
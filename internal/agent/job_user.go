@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// jobUser is the throwaway user a job runs as with --job-ephemeral-user.
+// Everything the agent sets up for the job is kept in the user's home
+// directory, so it's all removed along with the user when the job finishes.
+type jobUser struct {
+	name string
+	uid  uint32
+	gid  uint32
+	home string
+}
+
+// The most characters of a job's ID a job user's name has, which with the
+// prefix keeps it within useradd's 32
+const jobUserIDLength = 20
+
+// jobUserName returns the name of the user to create for a job. Job IDs are
+// time ordered, so jobs created in the same millisecond share the start of
+// their IDs, and the name is made from the random end instead.
+func jobUserName(jobID string) string {
+	var id []rune
+	for _, c := range strings.ToLower(jobID) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			id = append(id, c)
+		}
+	}
+	if len(id) > jobUserIDLength {
+		id = id[len(id)-jobUserIDLength:]
+	}
+	return "buildkite-" + string(id)
+}
+
+func (u *jobUser) buildPath() string   { return filepath.Join(u.home, "builds") }
+func (u *jobUser) pluginsPath() string { return filepath.Join(u.home, "plugins") }
+func (u *jobUser) tempDir() string     { return filepath.Join(u.home, "tmp") }
+
+// startJobUser creates the job's user, with the directories it needs in its
+// home. If they can't be created, the user is removed again.
+func (r *JobRunner) startJobUser() error {
+	user, err := addJobUser(jobUserName(r.job.ID))
+	if err != nil {
+		return fmt.Errorf("Failed to create a user for the job: %w", err)
+	}
+	r.jobUser = user
+	r.logger.Debug("[JobRunner] Created user %s (%d) for the job", user.name, user.uid)
+
+	if err := user.makeHome(); err != nil {
+		r.removeJobUser()
+		return fmt.Errorf("Failed to set up the home directory of the job's user: %w", err)
+	}
+	return nil
+}
+
+// makeHome creates the directories the job needs in the user's home, and
+// gives them to the user
+func (u *jobUser) makeHome() error {
+	for _, dir := range []string{u.buildPath(), u.pluginsPath(), u.tempDir()} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	return u.chownHome()
+}
+
+// chownHome gives the user everything in its home directory, including the
+// files the agent created there for the job
+func (u *jobUser) chownHome() error {
+	return filepath.Walk(u.home, func(path string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, int(u.uid), int(u.gid))
+	})
+}
+
+// jobUserEnv points the job at the user's home directory for everything it
+// writes. Git mirrors are shared between jobs, so they aren't used.
+func (r *JobRunner) jobUserEnv(env map[string]string) {
+	if r.jobUser == nil {
+		return
+	}
+	u := r.jobUser
+	env["HOME"] = u.home
+	env["USER"] = u.name
+	env["LOGNAME"] = u.name
+	env["TMPDIR"] = u.tempDir()
+	env["BUILDKITE_BUILD_PATH"] = u.buildPath()
+	env["BUILDKITE_PLUGINS_PATH"] = u.pluginsPath()
+	env["BUILDKITE_GIT_MIRRORS_PATH"] = ""
+	env["BUILDKITE_PLUGINS_CACHE_PATH"] = ""
+}
+
+// removeJobUser kills whatever the job's user left running, and removes the
+// user along with its files
+func (r *JobRunner) removeJobUser() {
+	if r.jobUser == nil {
+		return
+	}
+	if err := removeJobUser(r.jobUser); err != nil {
+		r.logger.Warn("[JobRunner] Error removing the job's user %s: %v", r.jobUser.name, err)
+	} else {
+		r.logger.Debug("[JobRunner] Removed the job's user %s", r.jobUser.name)
+	}
+	r.jobUser = nil
+}
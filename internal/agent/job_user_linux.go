@@ -0,0 +1,135 @@
+//go:build linux
+// +build linux
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// addJobUser creates a user with a group and home directory of its own, with
+// useradd so it's done however the host manages its users
+func addJobUser(name string) (*jobUser, error) {
+	if out, err := exec.Command("useradd", "--create-home", "--user-group", "--comment", "Buildkite job", name).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("useradd: %v: %s", err, bytes.TrimSpace(out))
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &jobUser{name: name, uid: uint32(uid), gid: uint32(gid), home: u.HomeDir}, nil
+}
+
+// removeJobUser kills the user's processes, removes the files it owns in the
+// host's shared temporary directories, then removes the user and its home
+// directory
+func removeJobUser(u *jobUser) error {
+	if err := killUserProcesses(u.uid); err != nil {
+		return err
+	}
+
+	for _, dir := range []string{os.TempDir(), "/dev/shm"} {
+		removeOwnedFiles(dir, u.uid)
+	}
+
+	if out, err := exec.Command("userdel", "--remove", u.name).CombinedOutput(); err != nil {
+		return fmt.Errorf("userdel: %v: %s", err, bytes.TrimSpace(out))
+	}
+
+	// userdel leaves the home directory if it isn't where it expects
+	return os.RemoveAll(u.home)
+}
+
+// killUserProcesses kills every process running as uid, until there are
+// none left, as they can start more while they're being killed
+func killUserProcesses(uid uint32) error {
+	for i := 0; i < 50; i++ {
+		pids := userProcesses(uid)
+		if len(pids) == 0 {
+			return nil
+		}
+		for _, pid := range pids {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("processes are still running as %d after killing them", uid)
+}
+
+// userProcesses returns the processes whose real user is uid, other than
+// zombies, which have already exited
+func userProcesses(uid uint32) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		f, err := os.Open(filepath.Join("/proc", e.Name(), "status"))
+		if err != nil {
+			continue
+		}
+		var state string
+		var owner int64 = -1
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			key, value, _ := strings.Cut(scanner.Text(), ":")
+			fields := strings.Fields(value)
+			if len(fields) == 0 {
+				continue
+			}
+			switch key {
+			case "State":
+				state = fields[0]
+			case "Uid":
+				owner, _ = strconv.ParseInt(fields[0], 10, 64)
+			}
+		}
+		f.Close()
+		if owner == int64(uid) && state != "Z" {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// removeOwnedFiles removes the entries directly in dir that are owned by uid
+func removeOwnedFiles(dir string, uid uint32) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Uid == uid {
+			_ = os.RemoveAll(filepath.Join(dir, e.Name()))
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import "errors"
+
+func addJobUser(string) (*jobUser, error) {
+	return nil, errors.New("ephemeral job users are only supported on Linux")
+}
+
+func removeJobUser(*jobUser) error { return nil }
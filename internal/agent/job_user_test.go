@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/fakeapi"
+	"github.com/buildkite/agent/v3/internal/metrics"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobUserName(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "buildkite-4e4b9c6b1b0c0b8e7f10", jobUserName("0185F0AD-7C3A-4E4B-9C6B-1B0C0B8E7F10"))
+	assert.Equal(t, "buildkite-myjobid", jobUserName("my-job-id"))
+	assert.LessOrEqual(t, len(jobUserName("0185F0AD-7C3A-4E4B-9C6B-1B0C0B8E7F10")), 32)
+}
+
+func TestJobUserNamesAreUniqueForJobsCreatedTogether(t *testing.T) {
+	t.Parallel()
+
+	// The IDs share the millisecond they were created in
+	a := jobUserName("0185f0ad-7c3a-7e4b-9c6b-1b0c0b8e7f10")
+	b := jobUserName("0185f0ad-7c3a-7a21-8d3e-5f6a7b8c9d0e")
+	assert.NotEqual(t, a, b)
+}
+
+func TestJobRunsAsAnEphemeralUser(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ephemeral job users are only supported on Linux")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("creating users needs root")
+	}
+	if _, err := exec.LookPath("useradd"); err != nil {
+		t.Skip("useradd isn't installed")
+	}
+
+	ctx := context.Background()
+	server := fakeapi.NewServer(logger.Discard, fakeapi.Config{})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	jobID := server.AddJob(nil)
+	reg, _, err := api.NewClient(logger.Discard, api.Config{Endpoint: ts.URL, Token: "llamas"}).
+		Register(ctx, &api.AgentRegisterRequest{Name: "agent-1"})
+	require.NoError(t, err)
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: ts.URL, Token: reg.AccessToken})
+
+	// The bootstrap leaves a process running and a file in /dev/shm behind,
+	// which should go with the user
+	dir, err := os.MkdirTemp("", "job-user-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Chmod(dir, 0755))
+	script := filepath.Join(dir, "bootstrap")
+	require.NoError(t, os.WriteFile(script, []byte(`#!/bin/sh
+echo "user=$(id -un) home=$HOME tmp=$TMPDIR pwd=$(pwd)"
+touch "/dev/shm/$(id -un)"
+sleep 300 </dev/null >/dev/null 2>&1 &
+echo "pid=$!"
+`), 0755))
+
+	job, ok := server.Job(jobID)
+	require.True(t, ok)
+	runner, err := NewJobRunner(logger.Discard, metrics.NewCollector(logger.Discard, metrics.CollectorConfig{}).Scope(metrics.Tags{}),
+		reg, &api.Job{ID: jobID, Env: job.Env, ChunksMaxSizeBytes: 100 * 1024}, client, JobRunnerConfig{
+			AgentConfiguration: AgentConfiguration{
+				BootstrapScript:  script,
+				BuildPath:        dir,
+				JobEphemeralUser: true,
+			},
+		})
+	require.NoError(t, err)
+	require.NoError(t, runner.Run(ctx))
+
+	job, ok = server.Job(jobID)
+	require.True(t, ok)
+	assert.Equal(t, "0", job.ExitStatus, "job log: %s", job.Log)
+
+	name := jobUserName(jobID)
+	home := regexp.MustCompile(`home=(\S+)`).FindStringSubmatch(job.Log)
+	require.NotNil(t, home, "job log: %s", job.Log)
+	assert.Contains(t, job.Log, fmt.Sprintf("user=%s home=%s tmp=%s pwd=%s", name, home[1], filepath.Join(home[1], "tmp"), filepath.Join(home[1], "builds")))
+
+	_, err = user.Lookup(name)
+	assert.Error(t, err, "the job's user should have been removed")
+	assert.NoDirExists(t, home[1])
+	assert.NoFileExists(t, filepath.Join("/dev/shm", name))
+
+	pid := regexp.MustCompile(`pid=(\d+)`).FindStringSubmatch(job.Log)
+	require.NotNil(t, pid, "job log: %s", job.Log)
+	n, err := strconv.Atoi(pid[1])
+	require.NoError(t, err)
+	out, _ := exec.Command("ps", "-o", "stat=", "-p", strconv.Itoa(n)).Output()
+	assert.NotRegexp(t, `^[^Z]`, string(out), "the process the job left running should have been killed")
+}
+
+func TestJobUserIsRemovedWhenTheJobCantBeSetUp(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ephemeral job users are only supported on Linux")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("creating users needs root")
+	}
+	if _, err := exec.LookPath("useradd"); err != nil {
+		t.Skip("useradd isn't installed")
+	}
+
+	jobID := "job-user-setup-failure"
+	name := jobUserName(jobID)
+	u, err := addJobUser(name)
+	require.NoError(t, err, "creating a user to find its home")
+	home := u.home
+	require.NoError(t, removeJobUser(u))
+
+	// A bootstrap script that can't be split into arguments fails after the
+	// user has been created
+	_, err = NewJobRunner(logger.Discard, metrics.NewCollector(logger.Discard, metrics.CollectorConfig{}).Scope(metrics.Tags{}),
+		&api.AgentRegisterResponse{}, &api.Job{ID: jobID, ChunksMaxSizeBytes: 1024}, api.NewClient(logger.Discard, api.Config{Endpoint: "http://127.0.0.1:1/"}), JobRunnerConfig{
+			AgentConfiguration: AgentConfiguration{
+				BootstrapScript:  `"unterminated`,
+				BuildPath:        t.TempDir(),
+				JobEphemeralUser: true,
+			},
+		})
+	require.Error(t, err)
+
+	_, err = user.Lookup(name)
+	assert.Error(t, err, "the job's user should have been removed")
+	assert.NoDirExists(t, home)
+}
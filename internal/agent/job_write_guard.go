@@ -0,0 +1,270 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Pipelines can declare more paths their jobs are allowed to write to, like
+// caches shared between builds, with a comma separated list in
+// BUILDKITE_JOB_WRITE_ALLOW. The paths are added to the agent's
+// --job-write-allow ones before the watch on the job's writes starts, so
+// exporting the variable from a hook doesn't allow anything more.
+const jobWriteAllowEnv = "BUILDKITE_JOB_WRITE_ALLOW"
+
+// What's done when a job writes outside the paths it's allowed to
+const (
+	JobWriteGuardLog  = "log"
+	JobWriteGuardFail = "fail"
+)
+
+// The most paths a job wrote to outside of those allowed that are listed in
+// its log
+const maxReportedJobWrites = 20
+
+// Filesystems that aren't host state a job could leave behind, so aren't
+// watched
+var unwatchedFilesystems = map[string]bool{
+	"autofs": true, "binfmt_misc": true, "bpf": true, "cgroup": true, "cgroup2": true,
+	"configfs": true, "debugfs": true, "devpts": true, "devtmpfs": true, "efivarfs": true,
+	"fusectl": true, "hugetlbfs": true, "mqueue": true, "nsfs": true, "proc": true,
+	"pstore": true, "securityfs": true, "sysfs": true, "tracefs": true,
+}
+
+// writeEvent is a file that a process closed after writing to it
+type writeEvent struct {
+	pid  int
+	path string
+}
+
+// watchedMounts returns the mount points in the format of /proc/self/mounts
+// that a job could write host state to
+func watchedMounts(r io.Reader) []string {
+	seen := map[string]bool{}
+	var mounts []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || unwatchedFilesystems[fields[2]] {
+			continue
+		}
+		if options := "," + fields[3] + ","; strings.Contains(options, ",ro,") {
+			continue
+		}
+
+		// Spaces and the like in mount points are escaped as octal
+		mount := fields[1]
+		if unquoted, err := strconv.Unquote(`"` + strings.ReplaceAll(mount, `"`, `\"`) + `"`); err == nil {
+			mount = unquoted
+		}
+		if !seen[mount] {
+			seen[mount] = true
+			mounts = append(mounts, mount)
+		}
+	}
+	return mounts
+}
+
+// parentPID returns the parent process ID from the contents of a
+// /proc/<pid>/stat file. The command name is in parentheses and can itself
+// contain spaces and parentheses, so the fields are counted from the last ")".
+func parentPID(stat string) (int, bool) {
+	i := strings.LastIndexByte(stat, ')')
+	if i < 0 {
+		return 0, false
+	}
+	fields := strings.Fields(stat[i+1:])
+	if len(fields) < 2 {
+		return 0, false
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	return ppid, err == nil
+}
+
+// pathWithin returns whether path is dir or inside it
+func pathWithin(path, dir string) bool {
+	if dir == "" {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// jobWriteAllowlist returns the paths the job is allowed to write to: its
+// build directory, the directories the agent manages for it, the temporary
+// directory, --job-write-allow, and the pipeline's BUILDKITE_JOB_WRITE_ALLOW
+func (r *JobRunner) jobWriteAllowlist() []string {
+	conf := r.conf.AgentConfiguration
+	allow := []string{
+		conf.BuildPath,
+		conf.GitMirrorsPath,
+		conf.PluginsPath,
+		os.TempDir(),
+		"/dev",
+	}
+	if r.jobUser != nil {
+		allow = append(allow, r.jobUser.home)
+	}
+	allow = append(allow, conf.JobWriteAllow...)
+	for _, path := range strings.Split(r.job.Env[jobWriteAllowEnv], ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			allow = append(allow, path)
+		}
+	}
+
+	var cleaned []string
+	for _, path := range allow {
+		if path == "" {
+			continue
+		}
+		path = filepath.Clean(path)
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			cleaned = append(cleaned, resolved)
+		}
+		cleaned = append(cleaned, path)
+	}
+	return cleaned
+}
+
+// jobWriteGuard is the job's writes outside of the paths it's allowed to
+type jobWriteGuard struct {
+	watcher *writeWatcher
+	allow   []string
+
+	mu     sync.Mutex
+	writes map[string]bool
+}
+
+// startJobWriteGuard starts watching for files being written to, before the
+// job's process is started so nothing it writes is missed
+func (r *JobRunner) startJobWriteGuard() error {
+	watcher, err := newWriteWatcher()
+	if err != nil {
+		return fmt.Errorf("Failed to start watching the job's writes: %w", err)
+	}
+	r.writeGuard = &jobWriteGuard{
+		watcher: watcher,
+		allow:   r.jobWriteAllowlist(),
+		writes:  map[string]bool{},
+	}
+	return nil
+}
+
+// allowed returns whether a path can be written to by the job
+func (g *jobWriteGuard) allowed(path string) bool {
+	for _, dir := range g.allow {
+		if pathWithin(path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// record adds a path the job wrote to, returning whether it's the first time
+func (g *jobWriteGuard) record(path string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.writes[path] {
+		return false
+	}
+	g.writes[path] = true
+	return true
+}
+
+// paths returns the paths the job wrote to that it isn't allowed to, sorted
+func (g *jobWriteGuard) paths() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	paths := make([]string, 0, len(g.writes))
+	for path := range g.writes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// jobWriteGuardian records the files the job's processes write to outside of
+// the paths they're allowed to, and in fail mode, cancels the job the first
+// time they do, so builds can't quietly change state other jobs on the host
+// depend on. A write is only attributed to the job if the process that made
+// it is still running when it's seen, so is a descendant of the job's.
+func (r *JobRunner) jobWriteGuardian(ctx context.Context, wg *sync.WaitGroup, p measurableProcess) {
+	defer wg.Done()
+
+	guard := r.writeGuard
+	select {
+	case <-p.Started():
+	case <-ctx.Done():
+		return
+	}
+	jobPid := p.Pid()
+
+	for {
+		var event writeEvent
+		select {
+		case event = <-guard.watcher.events:
+		case <-ctx.Done():
+			return
+		case <-r.process.Done():
+			return
+		}
+
+		if guard.allowed(event.path) || !descendantOf(event.pid, jobPid) {
+			continue
+		}
+		if !guard.record(event.path) {
+			continue
+		}
+		r.logger.Warn("[JobRunner] Job %s wrote to %s, outside of the paths it's allowed to", r.job.ID, event.path)
+
+		if r.conf.AgentConfiguration.JobWriteGuard != JobWriteGuardFail {
+			continue
+		}
+		fmt.Fprintf(r.output, "This job wrote to %s, which is outside of its build directory and the paths it's allowed to write to, so it's being canceled. Write to the build directory instead, or allow the path with %s.\n",
+			event.path, jobWriteAllowEnv)
+		if err := r.Cancel(); err != nil {
+			r.logger.Error("Unexpected error canceling process that wrote outside of its allowed paths (job: %s) (err: %s)", r.job.ID, err)
+		}
+		return
+	}
+}
+
+// finishJobWriteGuard stops watching for writes, and adds those the job
+// wasn't allowed to make to its log
+func (r *JobRunner) finishJobWriteGuard() {
+	if r.writeGuard == nil {
+		return
+	}
+	guard := r.writeGuard
+	r.writeGuard = nil
+
+	if err := guard.watcher.close(); err != nil {
+		r.logger.Warn("[JobRunner] Couldn't stop watching the job's writes: %v", err)
+	}
+
+	paths := guard.paths()
+	if len(paths) == 0 {
+		return
+	}
+	r.metrics.Count("jobs.writes_outside_build_dir", int64(len(paths)))
+
+	fmt.Fprintf(r.output, "This job wrote to %d paths outside of its build directory and the paths it's allowed to write to, which can change the host for other jobs:\n", len(paths))
+	for i, path := range paths {
+		if i == maxReportedJobWrites {
+			fmt.Fprintf(r.output, "  ...and %d more\n", len(paths)-i)
+			break
+		}
+		fmt.Fprintf(r.output, "  %s\n", path)
+	}
+	fmt.Fprintf(r.output, "Paths like caches can be allowed with %s.\n", jobWriteAllowEnv)
+}
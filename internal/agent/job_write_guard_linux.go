@@ -0,0 +1,124 @@
+//go:build linux
+// +build linux
+
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// writeWatcher watches every writable mount on the host with fanotify for
+// files being closed after they're written to. It needs the agent to be
+// running as root, or with CAP_SYS_ADMIN.
+type writeWatcher struct {
+	file   *os.File
+	events chan writeEvent
+	done   sync.WaitGroup
+}
+
+func newWriteWatcher() (*writeWatcher, error) {
+	mounts, err := os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK, unix.O_RDONLY|unix.O_LARGEFILE|unix.O_CLOEXEC)
+	if err != nil {
+		if errors.Is(err, unix.EPERM) {
+			return nil, errors.New("watching the job's writes needs the agent to run as root or with CAP_SYS_ADMIN")
+		}
+		return nil, fmt.Errorf("fanotify_init: %w", err)
+	}
+
+	var marked int
+	for _, mount := range watchedMounts(bytes.NewReader(mounts)) {
+		if err := unix.FanotifyMark(fd, unix.FAN_MARK_ADD|unix.FAN_MARK_MOUNT, unix.FAN_CLOSE_WRITE, unix.AT_FDCWD, mount); err == nil {
+			marked++
+		}
+	}
+	if marked == 0 {
+		unix.Close(fd)
+		return nil, errors.New("none of the host's mounts could be watched")
+	}
+
+	// The fanotify file descriptor is non-blocking, so reads from it can be
+	// interrupted by closing it
+	w := &writeWatcher{
+		file:   os.NewFile(uintptr(fd), "fanotify"),
+		events: make(chan writeEvent, 256),
+	}
+	w.done.Add(1)
+	go w.read()
+	return w, nil
+}
+
+func (w *writeWatcher) read() {
+	defer w.done.Done()
+
+	self := os.Getpid()
+	buf := make([]byte, 4096)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for b := buf[:n]; len(b) >= unix.FAN_EVENT_METADATA_LEN; {
+			meta := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&b[0]))
+			if meta.Event_len < unix.FAN_EVENT_METADATA_LEN || int(meta.Event_len) > len(b) {
+				break
+			}
+			b = b[meta.Event_len:]
+
+			if meta.Fd < 0 {
+				continue
+			}
+			path, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(int(meta.Fd)))
+			unix.Close(int(meta.Fd))
+			if err != nil || int(meta.Pid) == self {
+				continue
+			}
+
+			// Rather than hold up the reads, drop writes if the job's
+			// making them faster than they can be checked
+			select {
+			case w.events <- writeEvent{pid: int(meta.Pid), path: path}:
+			default:
+			}
+		}
+	}
+}
+
+func (w *writeWatcher) close() error {
+	err := w.file.Close()
+	w.done.Wait()
+	return err
+}
+
+// descendantOf returns whether a running process is ancestor, or was started
+// by it or its descendants
+func descendantOf(pid, ancestor int) bool {
+	for i := 0; pid > 1 && i < 64; i++ {
+		if pid == ancestor {
+			return true
+		}
+		stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+		if err != nil {
+			return false
+		}
+		ppid, ok := parentPID(string(stat))
+		if !ok {
+			return false
+		}
+		pid = ppid
+	}
+	return pid == ancestor
+}
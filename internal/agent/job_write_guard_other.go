@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import "errors"
+
+// writeWatcher is only supported on Linux
+type writeWatcher struct {
+	events chan writeEvent
+}
+
+func newWriteWatcher() (*writeWatcher, error) {
+	return nil, errors.New("watching jobs' writes is only supported on Linux")
+}
+
+func (*writeWatcher) close() error { return nil }
+
+func descendantOf(int, int) bool { return false }
@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchedMounts(t *testing.T) {
+	mounts := `/dev/nvme0n1p2 / ext4 rw,relatime 0 0
+proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0
+sysfs /sys sysfs rw,nosuid,nodev,noexec,relatime 0 0
+tmpfs /tmp tmpfs rw,nosuid,nodev 0 0
+/dev/nvme0n1p3 /var/lib/build\040cache ext4 rw,relatime 0 0
+/dev/loop0 /snap/core/1 squashfs ro,nodev,relatime 0 0
+/dev/nvme0n1p2 / ext4 rw,relatime 0 0
+`
+	assert.Equal(t, []string{"/", "/tmp", "/var/lib/build cache"}, watchedMounts(strings.NewReader(mounts)))
+}
+
+func TestParentPID(t *testing.T) {
+	ppid, ok := parentPID("4242 (my (odd) command) S 17 4242 4242 0 -1 4194560")
+	assert.True(t, ok)
+	assert.Equal(t, 17, ppid)
+
+	_, ok = parentPID("4242 (truncated")
+	assert.False(t, ok)
+}
+
+func TestJobWriteGuardAllowed(t *testing.T) {
+	buildPath := t.TempDir()
+	r := &JobRunner{
+		conf: JobRunnerConfig{AgentConfiguration: AgentConfiguration{
+			BuildPath:     buildPath,
+			JobWriteAllow: []string{"/var/cache/apt"},
+		}},
+		job: &api.Job{Env: map[string]string{
+			"BUILDKITE_JOB_WRITE_ALLOW": "/opt/gradle-cache, /srv/shared/",
+		}},
+	}
+	guard := &jobWriteGuard{allow: r.jobWriteAllowlist()}
+
+	for _, path := range []string{
+		filepath.Join(buildPath, "my-agent", "acme", "web-app", "main.go"),
+		"/var/cache/apt/archives/git.deb",
+		"/opt/gradle-cache/modules.bin",
+		"/srv/shared",
+	} {
+		assert.True(t, guard.allowed(path), path)
+	}
+
+	for _, path := range []string{
+		"/etc/hosts",
+		"/opt/gradle-cache-2/modules.bin",
+		"/var/cache/apt-other",
+		"/usr/local/bin/tool",
+	} {
+		assert.False(t, guard.allowed(path), path)
+	}
+}
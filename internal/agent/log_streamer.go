@@ -8,8 +8,8 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"github.com/buildkite/agent/v3/internal/status"
 	"github.com/buildkite/agent/v3/logger"
-	"github.com/buildkite/agent/v3/status"
 )
 
 type LogStreamerConfig struct {
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/qri-io/jsonschema"
+)
+
+//go:embed pipeline_schema.json
+var pipelineSchemaJSON []byte
+
+var (
+	pipelineSchemaOnce sync.Once
+	pipelineSchema     *jsonschema.RootSchema
+	pipelineSchemaErr  error
+)
+
+// loadPipelineSchema parses the embedded step schema the first time it's
+// needed.
+func loadPipelineSchema() (*jsonschema.RootSchema, error) {
+	pipelineSchemaOnce.Do(func() {
+		pipelineSchema = &jsonschema.RootSchema{}
+		if err := json.Unmarshal(pipelineSchemaJSON, pipelineSchema); err != nil {
+			pipelineSchemaErr = fmt.Errorf("Couldn't load the pipeline schema: %w", err)
+		}
+	})
+	return pipelineSchema, pipelineSchemaErr
+}
+
+// PipelineSchemaError is returned by Validate when a pipeline doesn't match
+// the step schema. It has an error for each part of the pipeline that
+// doesn't.
+type PipelineSchemaError struct {
+	Errors []error
+}
+
+// Unwrap returns the errors contained in the PipelineSchemaError.
+func (e *PipelineSchemaError) Unwrap() []error {
+	return e.Errors
+}
+
+func (e *PipelineSchemaError) Error() string {
+	s := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, ", ")
+}
+
+// Validate checks the pipeline against the schema of the steps Buildkite
+// accepts, returning a *PipelineSchemaError if it doesn't match. It doesn't
+// check anything that's only known to Buildkite, such as whether the
+// pipelines that trigger steps refer to exist.
+func (p *PipelineParserResult) Validate() error {
+	schema, err := loadPipelineSchema()
+	if err != nil {
+		return err
+	}
+
+	j, err := p.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	valErrs, err := schema.ValidateBytes(j)
+	if err != nil {
+		return err
+	}
+	if len(valErrs) == 0 {
+		return nil
+	}
+
+	schemaErr := &PipelineSchemaError{Errors: make([]error, len(valErrs))}
+	for i, valErr := range valErrs {
+		schemaErr.Errors[i] = valErr
+	}
+	return schemaErr
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipelineParserResultValidate(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		pipeline string
+		wantErrs []string
+	}{
+		{
+			name: "valid steps",
+			pipeline: `env:
+  FOO: bar
+steps:
+  - command: make test
+    parallelism: 2
+    artifact_paths: [tmp/*.log]
+  - wait
+  - block: Release?
+  - group: Deploy
+    steps:
+      - trigger: deploy
+        async: true
+  - plugins:
+      - docker#v5.0.0:
+          image: golang`,
+		},
+		{
+			name:     "top-level array of steps",
+			pipeline: `[{"command": "make"}, "wait"]`,
+		},
+		{
+			name:     "no steps",
+			pipeline: "env:\n  A: b\n",
+			wantErrs: []string{`/: {"env":{"A":"b"}} "steps" value is required`},
+		},
+		{
+			name:     "unknown step string",
+			pipeline: "steps:\n  - wiat\n",
+			wantErrs: []string{`/steps/0: "wiat" should be one of ["wait", "waiter", "block", "input"]`},
+		},
+		{
+			name:     "wrong attribute type in a group",
+			pipeline: "steps:\n  - group: g\n    steps:\n      - command: make\n        parallelism: 0\n",
+			wantErrs: []string{`/steps/0/steps/0/parallelism: 0 must be greater than or equal to 1.000000`},
+		},
+		{
+			name:     "errors in several steps",
+			pipeline: "steps:\n  - command: make\n    timeout_in_minutes: soon\n  - command: make\n    env: [FOO=bar]\n",
+			wantErrs: []string{
+				`/steps/0/timeout_in_minutes: "soon" type should be integer`,
+				`/steps/1/env: ["FOO=bar"] type should be object`,
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			parser := PipelineParser{Pipeline: []byte(tc.pipeline)}
+			result, err := parser.Parse()
+			require.NoError(t, err)
+
+			err = result.Validate()
+			if len(tc.wantErrs) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			var schemaErr *PipelineSchemaError
+			require.True(t, errors.As(err, &schemaErr), "result.Validate() = %v, want a *PipelineSchemaError", err)
+
+			var got []string
+			for _, err := range schemaErr.Errors {
+				got = append(got, err.Error())
+			}
+			assert.Equal(t, tc.wantErrs, got)
+		})
+	}
+}
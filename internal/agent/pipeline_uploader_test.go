@@ -9,9 +9,9 @@ import (
 	"testing"
 	"time"
 
-	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
-	"github.com/buildkite/agent/v3/clicommand"
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/clicommand"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/stretchr/testify/assert"
 )
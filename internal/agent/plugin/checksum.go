@@ -0,0 +1,101 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const checksumPrefix = "sha256:"
+
+func validChecksum(checksum string) bool {
+	b, err := hex.DecodeString(strings.TrimPrefix(checksum, checksumPrefix))
+	return strings.HasPrefix(checksum, checksumPrefix) && err == nil && len(b) == sha256.Size
+}
+
+// Checksum returns the checksum of the plugin in dir, like sha256:<digest>,
+// which a plugin can be pinned to with plugin#v1.0.0@sha256:<digest>. It's
+// a SHA-256 of the path, kind (file or link), size and contents of each file
+// in order, so changing any of them changes it. The .git directory, empty
+// directories and file modes aren't included, so it's the same for any
+// checkout of the plugin's commit, on any platform.
+func Checksum(dir string) (string, error) {
+	type entry struct {
+		path string
+		abs  string
+		mode fs.FileMode
+	}
+	var entries []entry
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{path: filepath.ToSlash(rel), abs: path, mode: info.Mode()})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+
+	h := sha256.New()
+	for _, e := range entries {
+		var contents []byte
+		kind := "file"
+		switch {
+		case e.mode&fs.ModeSymlink != 0:
+			kind = "link"
+			target, err := os.Readlink(e.abs)
+			if err != nil {
+				return "", err
+			}
+			contents = []byte(filepath.ToSlash(target))
+		case e.mode.IsRegular():
+			contents, err = os.ReadFile(e.abs)
+			if err != nil {
+				return "", err
+			}
+		default:
+			return "", fmt.Errorf("%s isn't a file or a link", e.path)
+		}
+		fmt.Fprintf(h, "%s %d %s\x00", kind, len(contents), e.path)
+		h.Write(contents)
+	}
+	return checksumPrefix + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyChecksum returns an error if the plugin has a checksum and its files
+// in dir don't match it
+func (p *Plugin) VerifyChecksum(dir string) error {
+	if p.Checksum == "" {
+		return nil
+	}
+	got, err := Checksum(dir)
+	if err != nil {
+		return fmt.Errorf("Refusing to run plugin %s, couldn't checksum it: %w", p.Label(), err)
+	}
+	if got != p.Checksum {
+		return fmt.Errorf("Refusing to run plugin %s, its checksum is %s but it's pinned to %s", p.Label(), got, p.Checksum)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePluginFiles(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "hooks"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "hooks", "command"), []byte("#!/bin/bash\necho hello\n"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "plugin.yml"), []byte("name: Hello\n"), 0o644))
+	return dir
+}
+
+func TestChecksum(t *testing.T) {
+	t.Parallel()
+
+	dir := writePluginFiles(t)
+	want, err := Checksum(dir)
+	require.NoError(t, err)
+	assert.True(t, validChecksum(want), "Checksum(dir) = %q isn't a valid checksum", want)
+
+	// Another checkout of the same files has the same checksum, even with
+	// a .git directory and empty directories
+	other := writePluginFiles(t)
+	require.NoError(t, os.MkdirAll(filepath.Join(other, ".git", "refs"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(other, ".git", "HEAD"), []byte("ref: refs/heads/main\n"), 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join(other, "empty"), 0o755))
+
+	got, err := Checksum(other)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	// Changing a file changes it
+	require.NoError(t, os.WriteFile(filepath.Join(other, "hooks", "command"), []byte("#!/bin/bash\necho pwned\n"), 0o755))
+	got, err = Checksum(other)
+	require.NoError(t, err)
+	assert.NotEqual(t, want, got)
+}
+
+func TestChecksumIncludesPaths(t *testing.T) {
+	t.Parallel()
+
+	dir := writePluginFiles(t)
+	want, err := Checksum(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, os.Rename(filepath.Join(dir, "hooks", "command"), filepath.Join(dir, "hooks", "post-command")))
+	got, err := Checksum(dir)
+	require.NoError(t, err)
+	assert.NotEqual(t, want, got)
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	t.Parallel()
+
+	dir := writePluginFiles(t)
+	checksum, err := Checksum(dir)
+	require.NoError(t, err)
+
+	p := &Plugin{Location: "github.com/buildkite-plugins/hello", Version: "v1.0.0"}
+	assert.NoError(t, p.VerifyChecksum(dir), "unpinned plugins aren't verified")
+
+	p.Checksum = checksum
+	assert.NoError(t, p.VerifyChecksum(dir))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "plugin.yml"), []byte("name: Goodbye\n"), 0o644))
+	err = p.VerifyChecksum(dir)
+	assert.ErrorContains(t, err, "Refusing to run plugin github.com/buildkite-plugins/hello#v1.0.0")
+	assert.ErrorContains(t, err, "pinned to "+checksum)
+}
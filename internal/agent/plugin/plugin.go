@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"path"
 	"regexp"
 	"sort"
 	"strings"
@@ -40,6 +41,10 @@ type Plugin struct {
 	// Whether the plugin refers to a vendored path.
 	Vendored bool
 
+	// The checksum the plugin's files must match to be run, like
+	// sha256:<digest>, as Checksum returns.
+	Checksum string
+
 	// Configuration for the plugin.
 	Configuration map[string]any
 }
@@ -62,6 +67,17 @@ func CreatePlugin(location string, config map[string]any) (*Plugin, error) {
 		return nil, fmt.Errorf("Too many #'s in \"%s\"", location)
 	}
 
+	// The version can be followed by the plugin's checksum, like
+	// v1.0.0@sha256:<digest>, or be just the checksum
+	if strings.HasPrefix(plugin.Version, checksumPrefix) {
+		plugin.Version, plugin.Checksum = "", plugin.Version
+	} else if i := strings.LastIndex(plugin.Version, "@"+checksumPrefix); i >= 0 {
+		plugin.Version, plugin.Checksum = plugin.Version[:i], plugin.Version[i+1:]
+	}
+	if plugin.Checksum != "" && !validChecksum(plugin.Checksum) {
+		return nil, fmt.Errorf("Invalid checksum %q in \"%s\", expected sha256:<digest>", plugin.Checksum, location)
+	}
+
 	if u.User != nil {
 		plugin.Authentication = u.User.String()
 	}
@@ -143,6 +159,9 @@ func (p *Plugin) Name() string {
 	// for filepaths, we can get windows backslashes, so we normalize them
 	location := strings.Replace(p.Location, "\\", "/", -1)
 
+	// Vendored plugins' paths can end with a slash
+	location = strings.TrimRight(location, "/")
+
 	// Grab the last part of the location
 	parts := strings.Split(location, "/")
 	name := parts[len(parts)-1]
@@ -271,6 +290,42 @@ func (p *Plugin) ConfigurationToEnvironment() (env.Environment, error) {
 	return env.FromSlice(envSlice), nil
 }
 
+// Matches returns whether the plugin's location, or the location of one of
+// the directories it's in, matches a pattern like github.com/my-org/*, as
+// path.Match matches them. The scheme, credentials and version aren't part
+// of the location, so github.com/my-org/* matches
+// https://github.com/my-org/my-plugin#v1.0.0 and the plugins in its
+// subdirectories. Locations with . or .. in them never match, as they could
+// name a plugin outside the directory the pattern allows.
+func (p *Plugin) Matches(pattern string) bool {
+	if p.HasDotSegments() {
+		return false
+	}
+	location := p.Location
+	for {
+		if matched, _ := path.Match(pattern, location); matched {
+			return true
+		}
+		i := strings.LastIndex(location, "/")
+		if i <= 0 {
+			return false
+		}
+		location = location[:i]
+	}
+}
+
+// HasDotSegments returns whether the plugin's location has . or .. between
+// its slashes or backslashes, which git and curl resolve to somewhere other
+// than the location says
+func (p *Plugin) HasDotSegments() bool {
+	for _, part := range strings.FieldsFunc(p.Location, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == "." || part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
 // Label returns a pretty name for the plugin.
 func (p *Plugin) Label() string {
 	if p.Version == "" {
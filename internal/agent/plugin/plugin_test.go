@@ -96,6 +96,32 @@ func TestCreateFromJSON(t *testing.T) {
 				Configuration: map[string]any{},
 			}},
 		},
+		{
+			`["github.com/buildkite-plugins/docker-compose#v1.0.0@sha256:6f1ed002ab5595859014ebf0951522d9d4f1c0ec1a4b8ba1a1f1c8f1b3c2f0ab"]`,
+			[]*Plugin{{
+				Location:      "github.com/buildkite-plugins/docker-compose",
+				Version:       "v1.0.0",
+				Checksum:      "sha256:6f1ed002ab5595859014ebf0951522d9d4f1c0ec1a4b8ba1a1f1c8f1b3c2f0ab",
+				Configuration: map[string]any{},
+			}},
+		},
+		{
+			`["github.com/buildkite-plugins/docker-compose#sha256:6f1ed002ab5595859014ebf0951522d9d4f1c0ec1a4b8ba1a1f1c8f1b3c2f0ab"]`,
+			[]*Plugin{{
+				Location:      "github.com/buildkite-plugins/docker-compose",
+				Checksum:      "sha256:6f1ed002ab5595859014ebf0951522d9d4f1c0ec1a4b8ba1a1f1c8f1b3c2f0ab",
+				Configuration: map[string]any{},
+			}},
+		},
+		{
+			`[{"./.buildkite/plugins/llamas#sha256:6f1ed002ab5595859014ebf0951522d9d4f1c0ec1a4b8ba1a1f1c8f1b3c2f0ab":{}}]`,
+			[]*Plugin{{
+				Location:      "./.buildkite/plugins/llamas",
+				Vendored:      true,
+				Checksum:      "sha256:6f1ed002ab5595859014ebf0951522d9d4f1c0ec1a4b8ba1a1f1c8f1b3c2f0ab",
+				Configuration: map[string]any{},
+			}},
+		},
 	}
 
 	for _, tc := range tests {
@@ -134,6 +160,10 @@ func TestCreateFromJSONFailsOnParseErrors(t *testing.T) {
 			`["github.com/buildkite-plugins/ping#master#lololo"]`,
 			"Too many #'s in \"github.com/buildkite-plugins/ping#master#lololo\"",
 		},
+		{
+			`["github.com/buildkite-plugins/ping#v1.0.0@sha256:abc123"]`,
+			"Invalid checksum \"sha256:abc123\" in \"github.com/buildkite-plugins/ping#v1.0.0@sha256:abc123\", expected sha256:<digest>",
+		},
 	}
 
 	for _, tc := range tests {
@@ -200,6 +230,10 @@ func TestPluginNameParsedFromLocation(t *testing.T) {
 			location: ".buildkite/plugins/docker-compose",
 			wantName: "docker-compose",
 		},
+		{
+			location: "./.buildkite/plugins/docker-compose/",
+			wantName: "docker-compose",
+		},
 		{
 			location: "",
 			wantName: "",
@@ -262,6 +296,45 @@ func TestIdentifier(t *testing.T) {
 	}
 }
 
+func TestMatches(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		location, pattern string
+		want              bool
+	}{
+		{"github.com/buildkite-plugins/docker-compose-buildkite-plugin", "github.com/buildkite-plugins/*", true},
+		{"github.com/buildkite-plugins/docker-compose-buildkite-plugin", "github.com/buildkite-plugins/docker-compose-buildkite-plugin", true},
+		{"github.com/buildkite-plugins/docker-compose-buildkite-plugin", "github.com/my-org/*", false},
+		{"github.com/buildkite-plugins/docker-compose-buildkite-plugin", "github.com/*", true},
+		{"github.com/buildkite-plugins/docker-compose-buildkite-plugin", "*", true},
+		{"github.com/buildkite-plugins/docker-compose-buildkite-plugin", "gitlab.com/*", false},
+		{"github.com/my-org/plugins/docker/beta", "github.com/my-org/plugins", true},
+		{"github.com/my-org/plugins/docker/beta", "github.com/my-org/*/docker", true},
+		{"github.com/my-org-evil/plugin", "github.com/my-org*", true},
+		{"github.com/my-org-evil/plugin", "github.com/my-org/*", false},
+		{"gitlab.example.com/group/team/plugin.git", "*.example.com/group/*", true},
+		{"/var/lib/plugins/llamas", "/var/lib/plugins/*", true},
+		{"example.com/my-org/../evil/plugin", "example.com/my-org/*", false},
+		{"gitlab.com/my-org/../evil/plugin", "gitlab.com/my-org/*", false},
+		{"github.com/my-org/./plugin", "github.com/my-org/*", false},
+		{"github.com/my-org/plugin/..", "github.com/my-org/*", false},
+		{`/var/lib/plugins/..\evil`, "/var/lib/plugins/*", false},
+		{"github.com/my-org/plugin..name", "github.com/my-org/*", true},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.location+" "+tc.pattern, func(t *testing.T) {
+			t.Parallel()
+			plugin := &Plugin{Location: tc.location}
+			if got := plugin.Matches(tc.pattern); got != tc.want {
+				t.Errorf("Plugin(Location: %q).Matches(%q) = %t, want %t", tc.location, tc.pattern, got, tc.want)
+			}
+		})
+	}
+}
+
 func TestRepositoryAndSubdirectory(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,12 @@
+//go:build darwin
+// +build darwin
+
+package agent
+
+import "golang.org/x/sys/unix"
+
+// reflinkFile clones src to dst with clonefile, which APFS supports, sharing
+// their blocks until either is written to
+func reflinkFile(src, dst string) error {
+	return unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
+}
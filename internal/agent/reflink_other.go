@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package agent
+
+func reflinkFile(src, dst string) error {
+	return errReflinkUnsupported
+}
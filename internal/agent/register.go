@@ -9,8 +9,8 @@ import (
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/system"
 	"github.com/buildkite/agent/v3/logger"
-	"github.com/buildkite/agent/v3/system"
 	"github.com/buildkite/agent/v3/version"
 	"github.com/buildkite/roko"
 	"github.com/denisbrodbeck/machineid"
@@ -69,6 +69,17 @@ func Register(ctx context.Context, l logger.Logger, ac APIClient, req api.AgentR
 	l.Info("Successfully registered agent \"%s\" with tags [%s]", registered.Name,
 		strings.Join(registered.Tags, ", "))
 
+	if req.Attestation != nil {
+		switch registered.AttestationStatus {
+		case "":
+			l.Warn("Buildkite didn't say whether it verified this agent's %s attestation", req.Attestation.Type)
+		case "verified":
+			l.Info("Buildkite verified this agent's %s attestation", req.Attestation.Type)
+		default:
+			l.Warn("Buildkite's verification of this agent's %s attestation was %s", req.Attestation.Type, registered.AttestationStatus)
+		}
+	}
+
 	l.Debug("Ping interval: %ds", registered.PingInterval)
 	l.Debug("Job status interval: %ds", registered.JobStatusInterval)
 	l.Debug("Heartbeat interval: %ds", registered.HeartbeatInterval)
@@ -0,0 +1,181 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// What a template in an agent's name or tags is filled in with when it can't
+// be looked up
+const registrationTemplateUnknown = "unknown"
+
+var registrationEnvTemplateRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+type RegistrationTemplateConfig struct {
+	// The file the count of agents registered on this host is kept in
+	CounterPath string
+
+	// The agent's configuration file, whose git repository's commit is
+	// %config-sha
+	ConfigPath string
+}
+
+// RegistrationTemplate fills in the templates in agents' names and tags each
+// time one registers, so fleets can be grouped by how their hosts were built:
+//
+//	%counter     how many agents have registered on this host, kept in a file
+//	%image-id    the EC2 AMI or GCP image the host was booted from
+//	%config-sha  the commit of the git repository of the agent's config file
+//	${VAR}       the environment variable VAR
+//
+// Buildkite fills in %hostname, and %spawn is filled in for each spawned
+// agent, so they're left as they are.
+type RegistrationTemplate struct {
+	conf   RegistrationTemplateConfig
+	logger logger.Logger
+
+	imageID   func(context.Context) (string, error)
+	configSHA func(context.Context) (string, error)
+
+	// The image and config commit don't change, so they're only looked up
+	// the first time they're used
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func NewRegistrationTemplate(l logger.Logger, c RegistrationTemplateConfig) *RegistrationTemplate {
+	return &RegistrationTemplate{
+		conf:   c,
+		logger: l,
+		imageID: func(context.Context) (string, error) {
+			if metadata.OnGCE() {
+				image, err := metadata.Get("instance/image")
+				return path.Base(image), err
+			}
+			ids, err := EC2MetaData{}.GetPaths(map[string]string{"image-id": "ami-id"})
+			return ids["image-id"], err
+		},
+		configSHA: func(ctx context.Context) (string, error) {
+			if c.ConfigPath == "" {
+				return "", errors.New("there's no configuration file")
+			}
+			out, err := exec.CommandContext(ctx, "git", "-C", filepath.Dir(c.ConfigPath), "rev-parse", "--short", "HEAD").Output()
+			return strings.TrimSpace(string(out)), err
+		},
+		values: make(map[string]string),
+	}
+}
+
+// Expand returns an agent's name and tags with their templates filled in. The
+// counter is only counted up if one of them has %counter in it.
+func (t *RegistrationTemplate) Expand(ctx context.Context, name string, tags []string) (string, []string) {
+	templates := append([]string{name}, tags...)
+	if !strings.Contains(strings.Join(templates, "\n"), "%counter") {
+		return t.expand(ctx, name, ""), t.expandAll(ctx, tags, "")
+	}
+
+	counter, err := t.count()
+	if err != nil {
+		t.logger.Warn("Couldn't count this agent's registration for %%counter: %v", err)
+		counter = registrationTemplateUnknown
+	}
+	return t.expand(ctx, name, counter), t.expandAll(ctx, tags, counter)
+}
+
+func (t *RegistrationTemplate) expandAll(ctx context.Context, templates []string, counter string) []string {
+	if templates == nil {
+		return nil
+	}
+	expanded := make([]string, 0, len(templates))
+	for _, s := range templates {
+		expanded = append(expanded, t.expand(ctx, s, counter))
+	}
+	return expanded
+}
+
+func (t *RegistrationTemplate) expand(ctx context.Context, s, counter string) string {
+	s = registrationEnvTemplateRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		return os.Getenv(m[2 : len(m)-1])
+	})
+	if strings.Contains(s, "%counter") {
+		s = strings.ReplaceAll(s, "%counter", counter)
+	}
+	if strings.Contains(s, "%image-id") {
+		s = strings.ReplaceAll(s, "%image-id", t.value(ctx, "%image-id", t.imageID))
+	}
+	if strings.Contains(s, "%config-sha") {
+		s = strings.ReplaceAll(s, "%config-sha", t.value(ctx, "%config-sha", t.configSHA))
+	}
+	return s
+}
+
+// value returns what a template is filled in with, looking it up the first
+// time it's used
+func (t *RegistrationTemplate) value(ctx context.Context, template string, lookup func(context.Context) (string, error)) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if v, ok := t.values[template]; ok {
+		return v
+	}
+
+	v, err := lookup(ctx)
+	if err == nil && v == "" {
+		err = errors.New("it's empty")
+	}
+	if err != nil {
+		t.logger.Warn("Couldn't find the value of %s in the agent's name or tags: %v", template, err)
+		v = registrationTemplateUnknown
+	}
+	t.values[template] = v
+	return v
+}
+
+// count counts up the number of agents registered on this host, and returns
+// the new count
+func (t *RegistrationTemplate) count() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conf.CounterPath == "" {
+		return "", errors.New("there's no file to keep the count in")
+	}
+
+	n := 0
+	data, err := os.ReadFile(t.conf.CounterPath)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return "", err
+	default:
+		if n, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+			return "", err
+		}
+	}
+	n++
+
+	if err := os.MkdirAll(filepath.Dir(t.conf.CounterPath), 0o755); err != nil {
+		return "", err
+	}
+
+	// Written somewhere else first, so a crash never leaves half a count
+	tmp := t.conf.CounterPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(n)+"\n"), 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, t.conf.CounterPath); err != nil {
+		return "", err
+	}
+	return strconv.Itoa(n), nil
+}
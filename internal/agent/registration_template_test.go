@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistrationTemplateExpand(t *testing.T) {
+	t.Setenv("IMAGE_GENERATION", "gen-7")
+
+	ctx := context.Background()
+	counterPath := filepath.Join(t.TempDir(), "state", "counter")
+	lookups := 0
+
+	tmpl := NewRegistrationTemplate(logger.Discard, RegistrationTemplateConfig{CounterPath: counterPath})
+	tmpl.imageID = func(context.Context) (string, error) {
+		lookups++
+		return "ami-0abc", nil
+	}
+	tmpl.configSHA = func(context.Context) (string, error) {
+		return "", errors.New("not a git repository")
+	}
+
+	name, tags := tmpl.Expand(ctx, "%hostname-%spawn-%counter", []string{"queue=default", "image=%image-id", "generation=${IMAGE_GENERATION}", "config=%config-sha", "price=$5"})
+	assert.Equal(t, "%hostname-%spawn-1", name)
+	assert.Equal(t, []string{"queue=default", "image=ami-0abc", "generation=gen-7", "config=unknown", "price=$5"}, tags)
+
+	// The counter's counted up each time an agent registers, but the image is
+	// only looked up once
+	name, _ = tmpl.Expand(ctx, "%hostname-%spawn-%counter", []string{"image=%image-id"})
+	assert.Equal(t, "%hostname-%spawn-2", name)
+	assert.Equal(t, 1, lookups)
+
+	// The count is kept for the next time the agent starts
+	data, err := os.ReadFile(counterPath)
+	require.NoError(t, err)
+	assert.Equal(t, "2\n", string(data))
+
+	// And isn't counted up by names and tags that don't use it
+	name, tags = NewRegistrationTemplate(logger.Discard, RegistrationTemplateConfig{CounterPath: counterPath}).
+		Expand(ctx, "%hostname", nil)
+	assert.Equal(t, "%hostname", name)
+	assert.Nil(t, tags)
+
+	name, _ = NewRegistrationTemplate(logger.Discard, RegistrationTemplateConfig{CounterPath: counterPath}).
+		Expand(ctx, "agent-%counter", nil)
+	assert.Equal(t, "agent-3", name)
+}
@@ -0,0 +1,293 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/roko"
+)
+
+// ReleaseChecksumsName is the name of the file listing the SHA-256 checksums
+// of the files published to a release, in the format sha256sum reads
+const ReleaseChecksumsName = "SHA256SUMS"
+
+type ReleasePublisherConfig struct {
+	// The paths of the files to publish, separated by ArtifactPathDelimiter
+	Paths string
+
+	// Where to publish the files. One of github://owner/repo/tag,
+	// s3://bucket/path or an http:// or https:// URL
+	Target string
+
+	// The template for the path of each file in the target, like
+	// "{{.Version}}/{{.Name}}"
+	PathTemplate string
+
+	// A specific Content-Type to use for all files
+	ContentType string
+
+	// Whether to publish a list of the files' checksums along with them
+	Checksums bool
+
+	// The token and API URL to use with GitHub
+	GitHubToken  string
+	GitHubAPIURL string
+
+	// Headers to send with each request to an HTTP target
+	Headers []string
+
+	// What's known about the release, for templating paths
+	Release ReleaseInfo
+
+	// Whether to show HTTP debugging
+	DebugHTTP bool
+
+	// Whether to follow symbolic links when resolving globs
+	FollowSymlinks bool
+}
+
+// ReleaseInfo is what's known about a release, that the paths of its files
+// can be templated with
+type ReleaseInfo struct {
+	Version     string
+	Tag         string
+	Pipeline    string
+	Branch      string
+	Commit      string
+	BuildNumber string
+}
+
+// releasePathData is what the path of each published file is templated with
+type releasePathData struct {
+	ReleaseInfo
+
+	// The file's base name, like app.tar.gz
+	Name string
+
+	// The file's path relative to where it was found, like dist/app.tar.gz
+	Path string
+
+	// The first 7 characters of the commit
+	ShortCommit string
+}
+
+// ReleasePublisher publishes files to a release, like the assets of a GitHub
+// release or a directory of a bucket laid out by version
+type ReleasePublisher struct {
+	conf     ReleasePublisherConfig
+	template *template.Template
+	logger   logger.Logger
+}
+
+func NewReleasePublisher(l logger.Logger, c ReleasePublisherConfig) (*ReleasePublisher, error) {
+	if c.PathTemplate == "" {
+		c.PathTemplate = "{{.Name}}"
+	}
+	tmpl, err := template.New("path").Option("missingkey=error").Parse(c.PathTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid path template %q: %w", c.PathTemplate, err)
+	}
+
+	return &ReleasePublisher{
+		conf:     c,
+		template: tmpl,
+		logger:   l,
+	}, nil
+}
+
+// Publish uploads the files that match the paths to the target, along with
+// a list of their checksums
+func (p *ReleasePublisher) Publish(ctx context.Context) error {
+	// Find the files the same way they are for artifacts
+	files, err := NewArtifactUploader(p.logger, nil, ArtifactUploaderConfig{
+		Paths:          p.conf.Paths,
+		ContentType:    p.conf.ContentType,
+		FollowSymlinks: p.conf.FollowSymlinks,
+	}).Collect()
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("No files matched paths: %s", p.conf.Paths)
+	}
+
+	seen := map[string]string{}
+	for _, f := range files {
+		dest, err := p.releasePath(f.Path)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(p.conf.Target, "github://") && strings.Contains(dest, "/") {
+			return fmt.Errorf("GitHub release assets can't be in a directory, %q must be a file name", dest)
+		}
+		if other, ok := seen[dest]; ok {
+			return fmt.Errorf("%s and %s would both be published to %s", other, f.Path, dest)
+		}
+		if p.conf.Checksums && path.Base(dest) == ReleaseChecksumsName {
+			return fmt.Errorf("%s can't be published as %s, as that's the name of the checksums file", f.Path, dest)
+		}
+		seen[dest] = f.Path
+		f.Path = dest
+	}
+
+	if p.conf.Checksums {
+		sums, err := p.writeChecksums(files)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(filepath.Dir(sums.AbsolutePath))
+		files = append(files, sums)
+	}
+
+	uploader, err := p.uploader()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		p.logger.Info("Publishing %s (%d bytes) to %s", f.Path, f.FileSize, uploader.URL(f))
+		err := roko.NewRetrier(
+			roko.WithMaxAttempts(5),
+			roko.WithStrategy(roko.Constant(5*time.Second)),
+		).DoWithContext(ctx, func(r *roko.Retrier) error {
+			if err := uploader.Upload(f); err != nil {
+				p.logger.Warn("%s (%s)", err, r)
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to publish %s: %w", f.Path, err)
+		}
+	}
+
+	p.logger.Info("Published %d files to %s", len(files), p.conf.Target)
+	return nil
+}
+
+func (p *ReleasePublisher) uploader() (Uploader, error) {
+	switch {
+	case strings.HasPrefix(p.conf.Target, "github://"):
+		return NewGitHubReleaseUploader(p.logger, GitHubReleaseUploaderConfig{
+			Destination: p.conf.Target,
+			Token:       p.conf.GitHubToken,
+			APIURL:      p.conf.GitHubAPIURL,
+			DebugHTTP:   p.conf.DebugHTTP,
+		})
+	case strings.HasPrefix(p.conf.Target, "s3://"):
+		return NewS3Uploader(p.logger, S3UploaderConfig{
+			Destination: p.conf.Target,
+			DebugHTTP:   p.conf.DebugHTTP,
+		})
+	case strings.HasPrefix(p.conf.Target, "http://"), strings.HasPrefix(p.conf.Target, "https://"):
+		return NewHTTPUploader(p.logger, HTTPUploaderConfig{
+			Destination: p.conf.Target,
+			Headers:     p.conf.Headers,
+			DebugHTTP:   p.conf.DebugHTTP,
+		})
+	default:
+		return nil, fmt.Errorf("Invalid release target: '%v'. Only github://, s3://, http:// or https:// targets are allowed", p.conf.Target)
+	}
+}
+
+// releasePath returns where a file is published, from the path template
+func (p *ReleasePublisher) releasePath(filePath string) (string, error) {
+	filePath = filepath.ToSlash(filePath)
+	data := releasePathData{
+		ReleaseInfo: p.conf.Release,
+		Name:        path.Base(filePath),
+		Path:        filePath,
+		ShortCommit: p.conf.Release.Commit,
+	}
+	if len(data.ShortCommit) > 7 {
+		data.ShortCommit = data.ShortCommit[:7]
+	}
+
+	var b strings.Builder
+	if err := p.template.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("Failed to template the path of %s: %w", filePath, err)
+	}
+
+	// Missing values leave empty segments behind, which are dropped, but the
+	// path can't leave the target
+	dest := path.Clean("/" + b.String())
+	if dest == "/" || strings.Contains("/"+b.String()+"/", "/../") {
+		return "", fmt.Errorf("Invalid path %q for %s", b.String(), filePath)
+	}
+	return strings.TrimPrefix(dest, "/"), nil
+}
+
+// writeChecksums writes the list of the files' checksums to a temporary file,
+// published in the deepest directory they're all in. The files are listed by
+// their paths relative to it, so they can be checked with `sha256sum -c` once
+// downloaded.
+func (p *ReleasePublisher) writeChecksums(files []*api.Artifact) (*api.Artifact, error) {
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		paths = append(paths, f.Path)
+	}
+	dir := commonDir(paths)
+
+	sums := map[string]string{}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		name := f.Path
+		if dir != "." {
+			name = strings.TrimPrefix(name, dir+"/")
+		}
+		sums[name] = f.Sha256Sum
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var contents string
+	for _, name := range names {
+		contents += fmt.Sprintf("%s  %s\n", sums[name], name)
+	}
+
+	tmp, err := os.MkdirTemp("", "buildkite-release")
+	if err != nil {
+		return nil, err
+	}
+	absolutePath := filepath.Join(tmp, ReleaseChecksumsName)
+	if err := os.WriteFile(absolutePath, []byte(contents), 0o644); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	return &api.Artifact{
+		Path:         path.Join(dir, ReleaseChecksumsName),
+		AbsolutePath: absolutePath,
+		FileSize:     int64(len(contents)),
+		Sha256Sum:    fmt.Sprintf("%x", sha256.Sum256([]byte(contents))),
+		ContentType:  "text/plain",
+	}, nil
+}
+
+// commonDir returns the deepest directory that all the slash separated paths
+// are in, or "." if they don't share one
+func commonDir(paths []string) string {
+	dir := strings.Split(path.Dir(paths[0]), "/")
+	for _, p := range paths[1:] {
+		parts := strings.Split(path.Dir(p), "/")
+		n := 0
+		for n < len(dir) && n < len(parts) && dir[n] == parts[n] {
+			n++
+		}
+		dir = dir[:n]
+	}
+	if len(dir) == 0 {
+		return "."
+	}
+	return path.Join(dir...)
+}
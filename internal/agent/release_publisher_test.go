@@ -0,0 +1,233 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReleasePath(t *testing.T) {
+	t.Parallel()
+
+	release := ReleaseInfo{Version: "1.2.3", Tag: "v1.2.3", Pipeline: "app", Commit: "0123456789abcdef"}
+	for _, tc := range []struct {
+		template, path, want string
+	}{
+		{"", "dist/app.tar.gz", "app.tar.gz"},
+		{"{{.Version}}/{{.Name}}", "dist/app.tar.gz", "1.2.3/app.tar.gz"},
+		{"{{.Pipeline}}/{{.ShortCommit}}/{{.Path}}", "dist/app.tar.gz", "app/0123456/dist/app.tar.gz"},
+		{"{{.Branch}}/{{.Name}}", "app.tar.gz", "app.tar.gz"},
+	} {
+		p, err := NewReleasePublisher(logger.Discard, ReleasePublisherConfig{PathTemplate: tc.template, Release: release})
+		require.NoError(t, err)
+		got, err := p.releasePath(tc.path)
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, got, "template %q", tc.template)
+	}
+
+	for _, template := range []string{"../{{.Name}}", "{{.Nope}}", "/"} {
+		p, err := NewReleasePublisher(logger.Discard, ReleasePublisherConfig{PathTemplate: template, Release: release})
+		require.NoError(t, err)
+		_, err = p.releasePath("app.tar.gz")
+		assert.Error(t, err, "template %q", template)
+	}
+
+	_, err := NewReleasePublisher(logger.Discard, ReleasePublisherConfig{PathTemplate: "{{.Name"})
+	assert.Error(t, err)
+}
+
+func writeReleaseFiles(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.tar.gz"), []byte("llamas"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.zip"), []byte("alpacas"), 0o644))
+	return dir
+}
+
+func TestReleasePublisherHTTP(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	got := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != "PUT" || r.Header.Get("Authorization") != "Bearer xyz" || r.Header.Get("X-Checksum-SHA256") == "" {
+			http.Error(w, "nope", http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		got[r.URL.Path] = string(body)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	dir := writeReleaseFiles(t)
+	p, err := NewReleasePublisher(logger.Discard, ReleasePublisherConfig{
+		Paths:        filepath.Join(dir, "*"),
+		Target:       server.URL + "/releases/",
+		PathTemplate: "{{.Version}}/{{.Name}}",
+		Checksums:    true,
+		Headers:      []string{"Authorization: Bearer xyz"},
+		Release:      ReleaseInfo{Version: "1.2.3"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, p.Publish(context.Background()))
+
+	assert.Equal(t, map[string]string{
+		"/releases/1.2.3/app.tar.gz": "llamas",
+		"/releases/1.2.3/app.zip":    "alpacas",
+		"/releases/1.2.3/SHA256SUMS": "" +
+			"66f0d436b0469c570b3b8d7e11a681881d9a7bcd8b12d5c2db426015d3ddfd1c  app.tar.gz\n" +
+			"41cb98dceca45230d6af6d57ee85aad877cf11b0940fac51873017f8c9eb3191  app.zip\n",
+	}, got)
+}
+
+func TestReleasePublisherGitHub(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var assets []string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer xyz" {
+			http.Error(w, "nope", http.StatusUnauthorized)
+			return
+		}
+		release := map[string]any{
+			"id":         42,
+			"html_url":   "https://github.com/my-org/my-app/releases/tag/v1.2.3",
+			"upload_url": server.URL + "/uploads/42/assets{?name,label}",
+		}
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/repos/my-org/my-app/releases/tags/v1.2.3":
+			http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+		case r.Method == "POST" && r.URL.Path == "/repos/my-org/my-app/releases":
+			var body map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			if body["tag_name"] != "v1.2.3" {
+				http.Error(w, "bad tag", http.StatusUnprocessableEntity)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(release)
+		case r.Method == "GET" && r.URL.Path == "/repos/my-org/my-app/releases/42/assets":
+			fmt.Fprint(w, "[]")
+		case r.Method == "POST" && r.URL.Path == "/uploads/42/assets":
+			mu.Lock()
+			assets = append(assets, r.URL.Query().Get("name"))
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, "{}")
+		default:
+			http.Error(w, "unexpected "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	dir := writeReleaseFiles(t)
+	p, err := NewReleasePublisher(logger.Discard, ReleasePublisherConfig{
+		Paths:        filepath.Join(dir, "*"),
+		Target:       "github://my-org/my-app/v1.2.3",
+		GitHubToken:  "xyz",
+		GitHubAPIURL: server.URL,
+		Checksums:    true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, p.Publish(context.Background()))
+	assert.ElementsMatch(t, []string{"app.tar.gz", "app.zip", "SHA256SUMS"}, assets)
+
+	// Assets can't be in directories
+	p, err = NewReleasePublisher(logger.Discard, ReleasePublisherConfig{
+		Paths:        filepath.Join(dir, "app.zip"),
+		Target:       "github://my-org/my-app/v1.2.3",
+		PathTemplate: "v1/{{.Name}}",
+		GitHubToken:  "xyz",
+		GitHubAPIURL: server.URL,
+	})
+	require.NoError(t, err)
+	err = p.Publish(context.Background())
+	assert.True(t, err != nil && strings.Contains(err.Error(), "directory"), "err = %v", err)
+}
+
+func TestParseGitHubReleaseDestination(t *testing.T) {
+	t.Parallel()
+
+	repo, tag, err := ParseGitHubReleaseDestination("github://my-org/my-app/release/2023-04")
+	require.NoError(t, err)
+	assert.Equal(t, "my-org/my-app", repo)
+	assert.Equal(t, "release/2023-04", tag)
+
+	for _, dest := range []string{"github://my-org/my-app", "github://my-org//v1", "github://my-org/my-app/"} {
+		_, _, err := ParseGitHubReleaseDestination(dest)
+		assert.Error(t, err, dest)
+	}
+}
+
+func TestReleaseChecksumsAreRelativeToTheCommonDirectory(t *testing.T) {
+	t.Parallel()
+
+	p, err := NewReleasePublisher(logger.Discard, ReleasePublisherConfig{})
+	require.NoError(t, err)
+
+	sums, err := p.writeChecksums([]*api.Artifact{
+		{Path: "1.2.3/linux/app.tar.gz", Sha256Sum: "aaa"},
+		{Path: "1.2.3/darwin/app.tar.gz", Sha256Sum: "bbb"},
+		{Path: "1.2.3/app.zip", Sha256Sum: "ccc"},
+	})
+	require.NoError(t, err)
+	defer os.RemoveAll(filepath.Dir(sums.AbsolutePath))
+
+	assert.Equal(t, "1.2.3/SHA256SUMS", sums.Path)
+	contents, err := os.ReadFile(sums.AbsolutePath)
+	require.NoError(t, err)
+	assert.Equal(t, ""+
+		"ccc  app.zip\n"+
+		"bbb  darwin/app.tar.gz\n"+
+		"aaa  linux/app.tar.gz\n", string(contents))
+}
+
+func TestCommonDir(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		paths []string
+		want  string
+	}{
+		{[]string{"app.tar.gz"}, "."},
+		{[]string{"1.2.3/app.tar.gz", "1.2.3/app.zip"}, "1.2.3"},
+		{[]string{"1.2.3/linux/app", "1.2.3/darwin/app"}, "1.2.3"},
+		{[]string{"1.2.3/app", "1.2.4/app"}, "."},
+		{[]string{"a/bc/app", "a/b/app"}, "a"},
+		{[]string{"a/b/app", "app"}, "."},
+	} {
+		assert.Equal(t, tc.want, commonDir(tc.paths), "commonDir(%q)", tc.paths)
+	}
+}
+
+func TestReleasePublisherRefusesToPublishAChecksumsFile(t *testing.T) {
+	t.Parallel()
+
+	dir := writeReleaseFiles(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "SHA256SUMS"), []byte("forged"), 0o644))
+
+	p, err := NewReleasePublisher(logger.Discard, ReleasePublisherConfig{
+		Paths:     filepath.Join(dir, "*"),
+		Target:    "http://127.0.0.1:1/releases/",
+		Checksums: true,
+	})
+	require.NoError(t, err)
+	assert.ErrorContains(t, p.Publish(context.Background()), "that's the name of the checksums file")
+}
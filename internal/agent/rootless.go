@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The fewest subordinate IDs that container images can generally be run with
+const minSubordinateIDs = 65536
+
+// countSubordinateIDs returns how many subordinate IDs a user has in the
+// format of /etc/subuid and /etc/subgid, where each line is a user name or
+// ID, the first subordinate ID, and how many there are
+func countSubordinateIDs(r io.Reader, user string, id int) int {
+	var count int
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || (fields[0] != user && fields[0] != strconv.Itoa(id)) {
+			continue
+		}
+		if n, err := strconv.Atoi(fields[2]); err == nil {
+			count += n
+		}
+	}
+	return count
+}
+
+// kernelAtLeast returns whether a kernel release, like 5.15.0-91-generic, is
+// the version given or later
+func kernelAtLeast(release string, major, minor int) bool {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	gotMajor, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	minorDigits := parts[1]
+	if i := strings.IndexFunc(minorDigits, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		minorDigits = minorDigits[:i]
+	}
+	gotMinor, err := strconv.Atoi(minorDigits)
+	if err != nil {
+		return false
+	}
+	return gotMajor > major || (gotMajor == major && gotMinor >= minor)
+}
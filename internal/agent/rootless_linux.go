@@ -0,0 +1,142 @@
+//go:build linux
+// +build linux
+
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// CheckRootless checks the host for what running jobs rootless needs: user
+// namespaces the agent's user can create, subordinate IDs to map into them,
+// and the setuid helpers that map them. It also checks for cgroup v2 and
+// overlay filesystems in user namespaces, which rootless containers need to
+// limit resources and to run efficiently.
+func CheckRootless() []HostCheck {
+	return []HostCheck{
+		checkNotRoot(),
+		checkUserNamespaces(),
+		checkSubordinateIDs("/etc/subuid", "subordinate user IDs"),
+		checkSubordinateIDs("/etc/subgid", "subordinate group IDs"),
+		checkIDMapHelpers(),
+		checkCgroupV2(),
+		checkRootlessOverlay(),
+		checkUnshareMapAuto(),
+	}
+}
+
+func readSysctl(path string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(data)), true
+}
+
+func checkNotRoot() HostCheck {
+	c := HostCheck{Name: "not running as root", Required: true, OK: os.Geteuid() != 0}
+	if !c.OK {
+		c.Detail = "the agent is running as root, so jobs would too. Run it as an unprivileged user"
+	}
+	return c
+}
+
+func checkUserNamespaces() HostCheck {
+	c := HostCheck{Name: "unprivileged user namespaces", Required: true, OK: true}
+
+	if v, ok := readSysctl("/proc/sys/user/max_user_namespaces"); ok && v == "0" {
+		c.OK = false
+		c.Detail = "user.max_user_namespaces is 0, set it with sysctl -w user.max_user_namespaces=28633"
+		return c
+	}
+	// Debian and older Ubuntu kernels have their own switch
+	if v, ok := readSysctl("/proc/sys/kernel/unprivileged_userns_clone"); ok && v == "0" {
+		c.OK = false
+		c.Detail = "kernel.unprivileged_userns_clone is 0, set it with sysctl -w kernel.unprivileged_userns_clone=1"
+		return c
+	}
+	// Ubuntu 23.10 and later only let programs AppArmor allows create them
+	if v, ok := readSysctl("/proc/sys/kernel/apparmor_restrict_unprivileged_userns"); ok && v == "1" {
+		c.Detail = "kernel.apparmor_restrict_unprivileged_userns is 1, so only programs with an AppArmor profile that allows userns can create them"
+	}
+	return c
+}
+
+func checkSubordinateIDs(path, name string) HostCheck {
+	c := HostCheck{Name: name, Required: true}
+
+	u, err := user.Current()
+	if err != nil {
+		c.Detail = fmt.Sprintf("couldn't look up the agent's user: %v", err)
+		return c
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		c.Detail = fmt.Sprintf("couldn't read %s: %v", path, err)
+		return c
+	}
+
+	count := countSubordinateIDs(bytes.NewReader(data), u.Username, uid)
+	c.OK = count >= minSubordinateIDs
+	if c.OK {
+		c.Detail = fmt.Sprintf("%d in %s", count, path)
+	} else {
+		c.Detail = fmt.Sprintf("%s has %d for %s, but containers need at least %d. Add them with usermod --add-subuids and --add-subgids",
+			path, count, u.Username, minSubordinateIDs)
+	}
+	return c
+}
+
+func checkIDMapHelpers() HostCheck {
+	c := HostCheck{Name: "newuidmap and newgidmap", Required: true, OK: true}
+	for _, helper := range []string{"newuidmap", "newgidmap"} {
+		if _, err := exec.LookPath(helper); err != nil {
+			c.OK = false
+			c.Detail = helper + " isn't installed, it's in the uidmap package"
+		}
+	}
+	return c
+}
+
+func checkCgroupV2() HostCheck {
+	c := HostCheck{Name: "cgroup v2"}
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+		c.OK = true
+	} else {
+		c.Detail = "the host is using cgroup v1, so rootless containers can't have resource limits"
+	}
+	return c
+}
+
+func checkRootlessOverlay() HostCheck {
+	c := HostCheck{Name: "overlay filesystems in user namespaces"}
+	if release, ok := readSysctl("/proc/sys/kernel/osrelease"); ok && kernelAtLeast(release, 5, 11) {
+		c.OK = true
+		return c
+	}
+	if _, err := exec.LookPath("fuse-overlayfs"); err == nil {
+		c.OK = true
+		c.Detail = "using fuse-overlayfs"
+		return c
+	}
+	c.Detail = "the kernel is older than 5.11 and fuse-overlayfs isn't installed, so rootless containers will use the much slower vfs storage driver"
+	return c
+}
+
+func checkUnshareMapAuto() HostCheck {
+	c := HostCheck{Name: "unshare --map-auto"}
+	out, _ := exec.Command("unshare", "--help").CombinedOutput()
+	c.OK = bytes.Contains(out, []byte("--map-auto"))
+	if !c.OK {
+		c.Detail = "unshare is older than util-linux 2.38, so files that containers create in the build directory as other users can't be removed"
+	}
+	return c
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+// CheckRootless fails, as rootless jobs are only supported on Linux
+func CheckRootless() []HostCheck {
+	return []HostCheck{{
+		Name:     "Linux",
+		Required: true,
+		Detail:   "rootless jobs are only supported on Linux",
+	}}
+}
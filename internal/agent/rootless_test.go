@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountingSubordinateIDs(t *testing.T) {
+	t.Parallel()
+
+	subuid := strings.Join([]string{
+		"buildkite-agent:100000:65536",
+		"someone:165536:65536",
+		"1001:231072:1000",
+		"buildkite-agent:300000:not-a-number",
+		"malformed",
+		"",
+	}, "\n")
+
+	assert.Equal(t, 66536, countSubordinateIDs(strings.NewReader(subuid), "buildkite-agent", 1001))
+	assert.Equal(t, 65536, countSubordinateIDs(strings.NewReader(subuid), "someone", 1002))
+	assert.Equal(t, 0, countSubordinateIDs(strings.NewReader(subuid), "nobody", 65534))
+}
+
+func TestKernelAtLeast(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		release string
+		want    bool
+	}{
+		{"5.11.0", true},
+		{"5.15.0-91-generic", true},
+		{"6.1.0", true},
+		{"5.10.0-26-cloud-amd64", false},
+		{"4.19.0", false},
+		{"5.11-rc1", true},
+		{"garbage", false},
+	} {
+		assert.Equal(t, tc.want, kernelAtLeast(tc.release, 5, 11), tc.release)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -18,8 +19,14 @@ import (
 )
 
 const (
-	regionHintEnvVar = "BUILDKITE_S3_DEFAULT_REGION"
-	s3EndpointEnvVar = "BUILDKITE_S3_ENDPOINT"
+	regionHintEnvVar         = "BUILDKITE_S3_DEFAULT_REGION"
+	s3EndpointEnvVar         = "BUILDKITE_S3_ENDPOINT"
+	s3ForcePathStyleEnvVar   = "BUILDKITE_S3_FORCE_PATH_STYLE"
+	s3SkipRegionLookupEnvVar = "BUILDKITE_S3_SKIP_REGION_LOOKUP"
+
+	// The region used when it isn't configured or looked up. S3-compatible
+	// servers like MinIO use it when they're not configured with one.
+	s3FallbackRegion = "us-east-1"
 )
 
 type buildkiteEnvProvider struct {
@@ -84,24 +91,56 @@ func awsS3Session(region string, l logger.Logger) (*session.Session, error) {
 	if endpoint := os.Getenv(s3EndpointEnvVar); endpoint != "" {
 		l.Debug("S3 session Endpoint from %s: %q", s3EndpointEnvVar, endpoint)
 		sess.Config.Endpoint = aws.String(endpoint)
+	}
 
-		// Configure the S3 client to use path-style addressing instead of the
-		// default DNS-style “virtual hosted bucket addressing”. See:
-		// - https://docs.aws.amazon.com/sdk-for-go/api/aws/#Config.WithS3ForcePathStyle
-		// - https://github.com/aws/aws-sdk-go/blob/v1.44.181/aws/config.go#L118-L127
-		// This is useful for S3-compatible servers like MinIO when they're deployed
-		// without subdomain support.
-
-		// AWS CLI does this by default when a custom endpoint is specified [1] so
-		// we will too.
-		// [1]: https://github.com/aws/aws-cli/blob/2.9.18/awscli/botocore/args.py#L414-L417
-		l.Debug("S3 session S3ForcePathStyle=true because custom Endpoint specified")
+	forcePathStyle, err := s3ForcePathStyle()
+	if err != nil {
+		return nil, err
+	}
+	if forcePathStyle {
+		l.Debug("S3 session S3ForcePathStyle=true")
 		sess.Config.S3ForcePathStyle = aws.Bool(true)
 	}
 
 	return sess, nil
 }
 
+// s3ForcePathStyle returns whether the S3 client should use path-style
+// addressing (https://endpoint/bucket/key) instead of the default DNS-style
+// "virtual hosted bucket addressing" (https://bucket.endpoint/key). See:
+// - https://docs.aws.amazon.com/sdk-for-go/api/aws/#Config.WithS3ForcePathStyle
+// - https://github.com/aws/aws-sdk-go/blob/v1.44.181/aws/config.go#L118-L127
+// This is useful for S3-compatible servers like MinIO when they're deployed
+// without subdomain support.
+//
+// AWS CLI does this by default when a custom endpoint is specified [1] so
+// we will too, unless BUILDKITE_S3_FORCE_PATH_STYLE says otherwise.
+// [1]: https://github.com/aws/aws-cli/blob/2.9.18/awscli/botocore/args.py#L414-L417
+func s3ForcePathStyle() (bool, error) {
+	return s3BoolEnv(s3ForcePathStyleEnvVar, os.Getenv(s3EndpointEnvVar) != "")
+}
+
+// s3SkipRegionLookup returns whether the bucket's region should be used as
+// it's configured, rather than looked up. Looking it up needs the EC2
+// instance meta-data service and a bucket that knows its region, which
+// S3-compatible servers and air-gapped networks often don't have, so it's
+// skipped by default when there's a custom endpoint.
+func s3SkipRegionLookup() (bool, error) {
+	return s3BoolEnv(s3SkipRegionLookupEnvVar, os.Getenv(s3EndpointEnvVar) != "")
+}
+
+func s3BoolEnv(name string, defaultValue bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false, not %q", name, value)
+	}
+	return b, nil
+}
+
 func webIdentityRoleProvider(sess *session.Session) *stscreds.WebIdentityRoleProvider {
 	return stscreds.NewWebIdentityRoleProvider(
 		sts.New(sess),
@@ -114,9 +153,20 @@ func webIdentityRoleProvider(sess *session.Session) *stscreds.WebIdentityRolePro
 func NewS3Client(l logger.Logger, bucket string) (*s3.S3, error) {
 	var sess *session.Session
 
+	skipRegionLookup, err := s3SkipRegionLookup()
+	if err != nil {
+		return nil, err
+	}
+
 	regionHint := os.Getenv(regionHintEnvVar)
 	if regionHint != "" {
 		l.Debug("Using bucket region %q from environment variable %q", regionHint, regionHintEnvVar)
+	} else if skipRegionLookup {
+		l.Debug("Using bucket region %q, as it isn't set with %q and isn't being looked up", s3FallbackRegion, regionHintEnvVar)
+		regionHint = s3FallbackRegion
+	}
+
+	if regionHint != "" {
 		// If there is a region hint provided, we use it unconditionally
 		session, err := awsS3Session(regionHint, l)
 		if err != nil {
@@ -129,7 +179,7 @@ func NewS3Client(l logger.Logger, bucket string) (*s3.S3, error) {
 		// where the bucket lives.
 		region, err := awsRegion()
 		if err != nil {
-			region = "us-east-1"
+			region = s3FallbackRegion
 		}
 
 		l.Debug("Discovered current region as %q", region)
@@ -157,7 +207,7 @@ func NewS3Client(l logger.Logger, bucket string) (*s3.S3, error) {
 	s3client := s3.New(sess)
 
 	// Test the authentication by trying to list the first 0 objects in the bucket.
-	_, err := s3client.ListObjects(&s3.ListObjectsInput{
+	_, err = s3client.ListObjects(&s3.ListObjectsInput{
 		Bucket:  aws.String(bucket),
 		MaxKeys: aws.Int64(0),
 	})
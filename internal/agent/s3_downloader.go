@@ -3,6 +3,7 @@ package agent
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"time"
@@ -31,6 +32,10 @@ type S3DownloaderConfig struct {
 
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// If set, the downloaded file is streamed to this instead of being
+	// written to Path
+	Stream func(io.Reader) error
 }
 
 type S3Downloader struct {
@@ -70,6 +75,7 @@ func (d S3Downloader) Start(ctx context.Context) error {
 		Destination: d.conf.Destination,
 		Retries:     d.conf.Retries,
 		DebugHTTP:   d.conf.DebugHTTP,
+		Stream:      d.conf.Stream,
 	}).Start(ctx)
 }
 
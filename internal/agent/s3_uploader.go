@@ -0,0 +1,375 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/pool"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+const (
+	// S3's limits on multipart uploads' parts
+	s3MinPartSize = 5 << 20
+	s3MaxParts    = 10000
+)
+
+type S3UploaderConfig struct {
+	// The destination which includes the S3 bucket name and the path.
+	// For example, s3://my-bucket-name/foo/bar
+	Destination string
+
+	// Whether or not HTTP calls should be debugged
+	DebugHTTP bool
+
+	// Files larger than PartSize bytes are uploaded in parts, PartConcurrency
+	// at once. They default to DefaultUploadPartSize and
+	// DefaultUploadPartConcurrency.
+	PartSize        int64
+	PartConcurrency int
+}
+
+type S3Uploader struct {
+	// The s3 bucket path set from the destination
+	BucketPath string
+
+	// The s3 bucket name set from the destination
+	BucketName string
+
+	// The s3 client to use
+	client *s3.S3
+
+	// The configuration
+	conf S3UploaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+
+	// The multipart uploads that failed part way through, by key, so they
+	// can be resumed
+	mu         sync.Mutex
+	multiparts map[string]*s3MultipartUpload
+}
+
+// s3MultipartUpload is a multipart upload, and the ETags of the parts of it
+// that have been uploaded, by part number
+type s3MultipartUpload struct {
+	uploadID string
+	partSize int64
+	etags    map[int64]string
+}
+
+func NewS3Uploader(l logger.Logger, c S3UploaderConfig) (*S3Uploader, error) {
+	bucketName, bucketPath := ParseS3Destination(c.Destination)
+
+	// Initialize the s3 client, and authenticate it
+	s3Client, err := NewS3Client(l, bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.PartSize <= 0 {
+		c.PartSize = DefaultUploadPartSize
+	}
+	if c.PartSize < s3MinPartSize {
+		c.PartSize = s3MinPartSize
+	}
+	if c.PartConcurrency <= 0 {
+		c.PartConcurrency = DefaultUploadPartConcurrency
+	}
+
+	return &S3Uploader{
+		logger:     l,
+		conf:       c,
+		client:     s3Client,
+		BucketName: bucketName,
+		BucketPath: bucketPath,
+		multiparts: make(map[string]*s3MultipartUpload),
+	}, nil
+}
+
+func ParseS3Destination(destination string) (string, string) {
+	destinationWithNoTrailingSlash := strings.TrimSuffix(destination, "/")
+	destinationWithNoProtocol := strings.TrimPrefix(destinationWithNoTrailingSlash, "s3://")
+	parts := strings.Split(destinationWithNoProtocol, "/")
+	path := strings.Join(parts[1:], "/")
+	bucket := parts[0]
+	return bucket, path
+}
+
+func (u *S3Uploader) URL(artifact *api.Artifact) string {
+	baseUrl := s3BucketURL(u.BucketName)
+
+	if os.Getenv("BUILDKITE_S3_ACCESS_URL") != "" {
+		baseUrl = os.Getenv("BUILDKITE_S3_ACCESS_URL")
+	}
+
+	url, _ := url.Parse(baseUrl)
+
+	url.Path = strings.TrimSuffix(url.Path, "/") + "/" + strings.TrimPrefix(u.artifactPath(artifact), "/")
+
+	return url.String()
+}
+
+// s3BucketURL returns the URL of a bucket, at the custom endpoint if there
+// is one
+func s3BucketURL(bucket string) string {
+	endpoint := os.Getenv(s3EndpointEnvVar)
+	if endpoint == "" {
+		return "https://" + bucket + ".s3.amazonaws.com"
+	}
+
+	// Like the SDK, take endpoints without a scheme to be HTTPS
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return "https://" + bucket + ".s3.amazonaws.com"
+	}
+
+	if pathStyle, _ := s3ForcePathStyle(); pathStyle {
+		u.Path += "/" + bucket
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	return u.String()
+}
+
+func (u *S3Uploader) Upload(artifact *api.Artifact) error {
+	ctx := context.Background()
+
+	permission, err := u.resolvePermission()
+	if err != nil {
+		return err
+	}
+
+	// Open file from filesystem
+	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Upload the file to S3.
+	key := u.artifactPath(artifact)
+	u.logger.Debug("Uploading \"%s\" to bucket with permission `%s`", key, permission)
+
+	if info.Size() > u.conf.PartSize {
+		return u.uploadMultipart(ctx, f, info.Size(), key, artifact.ContentType, permission)
+	}
+
+	params := &s3.PutObjectInput{
+		Bucket:      aws.String(u.BucketName),
+		Key:         aws.String(key),
+		ContentType: aws.String(artifact.ContentType),
+		ACL:         aws.String(permission),
+		Body:        f,
+	}
+	// if enabled we assign the sse configuration
+	if u.serverSideEncryptionEnabled() {
+		params.ServerSideEncryption = aws.String("AES256")
+	}
+
+	_, err = u.client.PutObjectWithContext(ctx, params)
+	return err
+}
+
+// Abandon aborts the artifact's multipart upload, if it failed part way
+// through, so S3 doesn't keep its parts
+func (u *S3Uploader) Abandon(artifact *api.Artifact) {
+	key := u.artifactPath(artifact)
+
+	u.mu.Lock()
+	m := u.multiparts[key]
+	delete(u.multiparts, key)
+	u.mu.Unlock()
+
+	if m == nil {
+		return
+	}
+
+	_, err := u.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(u.BucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(m.uploadID),
+	})
+	if err != nil {
+		u.logger.Warn("Failed to abort the multipart upload of %q: %v", key, err)
+	}
+}
+
+// uploadMultipart uploads a file in parts, a few at once. If it fails, the
+// parts that were uploaded are kept, and only the rest are uploaded when
+// it's retried.
+func (u *S3Uploader) uploadMultipart(ctx context.Context, f *os.File, size int64, key, contentType, permission string) error {
+	m, err := u.multipart(ctx, size, key, contentType, permission)
+	if err != nil {
+		return err
+	}
+
+	count := (size + m.partSize - 1) / m.partSize
+	p := pool.New(u.conf.PartConcurrency)
+	var errs []error
+
+	for number := int64(1); number <= count; number++ {
+		number := number
+
+		p.Lock()
+		_, uploaded := m.etags[number]
+		p.Unlock()
+		if uploaded {
+			continue
+		}
+
+		p.Spawn(func() {
+			offset := (number - 1) * m.partSize
+			length := size - offset
+			if length > m.partSize {
+				length = m.partSize
+			}
+
+			out, err := u.client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+				Bucket:        aws.String(u.BucketName),
+				Key:           aws.String(key),
+				UploadId:      aws.String(m.uploadID),
+				PartNumber:    aws.Int64(number),
+				ContentLength: aws.Int64(length),
+				Body:          io.NewSectionReader(f, offset, length),
+			})
+
+			p.Lock()
+			defer p.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("part %d: %w", number, err))
+				return
+			}
+			m.etags[number] = aws.StringValue(out.ETag)
+		})
+	}
+	p.Wait()
+
+	if len(errs) > 0 {
+		// The upload's gone, so it has to be started again
+		var aerr awserr.Error
+		if errors.As(errs[0], &aerr) && aerr.Code() == s3.ErrCodeNoSuchUpload {
+			u.mu.Lock()
+			delete(u.multiparts, key)
+			u.mu.Unlock()
+		}
+		u.logger.Info("Uploaded %d of %d parts of %q, the rest will be uploaded if it's retried", len(m.etags), count, key)
+		return errs[0]
+	}
+
+	parts := make([]*s3.CompletedPart, 0, len(m.etags))
+	for number, etag := range m.etags {
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(number), ETag: aws.String(etag)})
+	}
+	sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+
+	_, err = u.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.BucketName),
+		Key:             aws.String(key),
+		UploadId:        aws.String(m.uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	delete(u.multiparts, key)
+	u.mu.Unlock()
+	return nil
+}
+
+// multipart returns the multipart upload of the key that failed part way
+// through, or starts a new one
+func (u *S3Uploader) multipart(ctx context.Context, size int64, key, contentType, permission string) (*s3MultipartUpload, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if m, ok := u.multiparts[key]; ok {
+		u.logger.Info("Resuming the upload of %q, which has %d parts uploaded", key, len(m.etags))
+		return m, nil
+	}
+
+	params := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(u.BucketName),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+		ACL:         aws.String(permission),
+	}
+	if u.serverSideEncryptionEnabled() {
+		params.ServerSideEncryption = aws.String("AES256")
+	}
+
+	out, err := u.client.CreateMultipartUploadWithContext(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Very large files need larger parts to fit in S3's limit on them
+	partSize := u.conf.PartSize
+	if min := (size + s3MaxParts - 1) / s3MaxParts; partSize < min {
+		partSize = min
+	}
+
+	m := &s3MultipartUpload{
+		uploadID: aws.StringValue(out.UploadId),
+		partSize: partSize,
+		etags:    make(map[int64]string),
+	}
+	u.multiparts[key] = m
+	return m, nil
+}
+
+func (u *S3Uploader) artifactPath(artifact *api.Artifact) string {
+	parts := []string{u.BucketPath, artifact.Path}
+
+	return strings.Join(parts, "/")
+}
+
+func (u *S3Uploader) resolvePermission() (string, error) {
+	permission := "public-read"
+	if os.Getenv("BUILDKITE_S3_ACL") != "" {
+		permission = os.Getenv("BUILDKITE_S3_ACL")
+	} else if os.Getenv("AWS_S3_ACL") != "" {
+		permission = os.Getenv("AWS_S3_ACL")
+	}
+
+	switch permission {
+	case "private", "public-read", "public-read-write", "authenticated-read", "bucket-owner-read", "bucket-owner-full-control":
+		return permission, nil
+	default:
+		return "", fmt.Errorf("Invalid S3 ACL value: `%s`", permission)
+	}
+}
+
+// is encryption at rest enabled for artifacts to satisfy basic security requirements
+func (u *S3Uploader) serverSideEncryptionEnabled() bool {
+	sse := os.Getenv("BUILDKITE_S3_SSE_ENABLED")
+	switch {
+	case strings.ToLower(sse) == "true":
+		return true
+	default:
+		return false
+	}
+}
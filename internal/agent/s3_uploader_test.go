@@ -0,0 +1,304 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseS3Destination(t *testing.T) {
+	for _, tc := range []struct {
+		dest, bucket, path string
+	}{
+		{
+			dest:   "s3://my-bucket-name/foo/bar",
+			bucket: "my-bucket-name",
+			path:   "foo/bar",
+		},
+		{
+			dest:   "s3://starts-with-an-s/and-this-is-its/folder",
+			bucket: "starts-with-an-s",
+			path:   "and-this-is-its/folder",
+		},
+		{
+			dest:   "s3://custom-s3-domain/folder/ends-with-a-slash/",
+			bucket: "custom-s3-domain",
+			path:   "folder/ends-with-a-slash",
+		},
+	} {
+		bucket, path := ParseS3Destination(tc.dest)
+		if bucket != tc.bucket || path != tc.path {
+			t.Errorf("ParseS3Destination(%q) = (%q, %q), want (%q, %q)", tc.dest, bucket, path, tc.bucket, tc.path)
+		}
+	}
+}
+
+func TestResolveServerSideEncryptionConfig(t *testing.T) {
+
+	assert := require.New(t)
+
+	for _, tc := range []struct {
+		ServerSideEncryptionConfig string
+		ExpectedResult             bool
+	}{
+		{"True", true},
+		{"falsE", false},
+		{"lol", false},
+	} {
+		uploader := &S3Uploader{}
+		os.Setenv("BUILDKITE_S3_SSE_ENABLED", tc.ServerSideEncryptionConfig)
+		config := uploader.serverSideEncryptionEnabled()
+
+		assert.Equal(tc.ExpectedResult, config)
+
+		os.Unsetenv("BUILDKITE_S3_SSE_ENABLED")
+	}
+}
+
+func TestResolvePermission(t *testing.T) {
+
+	assert := require.New(t)
+	for _, tc := range []struct {
+		Permission     string
+		ExpectedResult string
+		ShouldErr      bool
+	}{
+		{"", "public-read", false},
+		{"private", "private", false},
+		{"public-read", "public-read", false},
+		{"public-read-write", "public-read-write", false},
+		{"authenticated-read", "authenticated-read", false},
+		{"bucket-owner-read", "bucket-owner-read", false},
+		{"bucket-owner-full-control", "bucket-owner-full-control", false},
+		{"foo", "", true},
+	} {
+		uploader := &S3Uploader{}
+		os.Setenv("BUILDKITE_S3_ACL", tc.Permission)
+		config, err := uploader.resolvePermission()
+
+		// if it should error we just look at the error
+		if tc.ShouldErr {
+			assert.Error(err)
+		} else {
+			assert.Nil(err)
+			assert.Equal(tc.ExpectedResult, config)
+		}
+
+		os.Unsetenv("BUILDKITE_S3_ACL")
+	}
+}
+
+func TestS3UploaderURL(t *testing.T) {
+	for _, tc := range []struct {
+		name                              string
+		endpoint, forcePathStyle, baseURL string
+		bucketPath                        string
+		want                              string
+	}{
+		{
+			name:       "AWS",
+			bucketPath: "builds/1",
+			want:       "https://my-bucket.s3.amazonaws.com/builds/1/foo/bar.txt",
+		},
+		{
+			name:       "custom endpoint",
+			endpoint:   "http://minio.internal:9000",
+			bucketPath: "builds/1",
+			want:       "http://minio.internal:9000/my-bucket/builds/1/foo/bar.txt",
+		},
+		{
+			name:     "custom endpoint without a path",
+			endpoint: "minio.internal:9000/",
+			want:     "https://minio.internal:9000/my-bucket/foo/bar.txt",
+		},
+		{
+			name:           "custom endpoint with virtual hosted buckets",
+			endpoint:       "https://ceph.internal",
+			forcePathStyle: "false",
+			bucketPath:     "builds/1",
+			want:           "https://my-bucket.ceph.internal/builds/1/foo/bar.txt",
+		},
+		{
+			name:       "access URL",
+			endpoint:   "http://minio.internal:9000",
+			baseURL:    "https://artifacts.example.com/",
+			bucketPath: "builds/1",
+			want:       "https://artifacts.example.com/builds/1/foo/bar.txt",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(s3EndpointEnvVar, tc.endpoint)
+			t.Setenv(s3ForcePathStyleEnvVar, tc.forcePathStyle)
+			t.Setenv("BUILDKITE_S3_ACCESS_URL", tc.baseURL)
+
+			u := &S3Uploader{BucketName: "my-bucket", BucketPath: tc.bucketPath}
+			assert.Equal(t, tc.want, u.URL(&api.Artifact{Path: "foo/bar.txt"}))
+		})
+	}
+}
+
+func TestS3BoolEnv(t *testing.T) {
+	t.Setenv(s3EndpointEnvVar, "http://minio.internal:9000")
+	t.Setenv(s3SkipRegionLookupEnvVar, "")
+
+	skip, err := s3SkipRegionLookup()
+	require.NoError(t, err)
+	assert.True(t, skip)
+
+	t.Setenv(s3SkipRegionLookupEnvVar, "false")
+	skip, err = s3SkipRegionLookup()
+	require.NoError(t, err)
+	assert.False(t, skip)
+
+	t.Setenv(s3ForcePathStyleEnvVar, "llamas")
+	_, err = s3ForcePathStyle()
+	assert.EqualError(t, err, `BUILDKITE_S3_FORCE_PATH_STYLE must be true or false, not "llamas"`)
+}
+
+func TestS3UploaderWithCustomEndpoint(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	objects := make(map[string][]byte)
+
+	// Enough of an S3-compatible server, like MinIO, to upload to
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+
+		switch r.Method {
+		case "GET":
+			assert.Equal(t, "0", r.URL.Query().Get("max-keys"))
+			w.Header().Set("Content-Type", "application/xml")
+			io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><Name>my-bucket</Name><MaxKeys>0</MaxKeys><IsTruncated>false</IsTruncated></ListBucketResult>`)
+		case "PUT":
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			objects[r.URL.Path] = body
+		default:
+			http.Error(w, "", http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv(s3EndpointEnvVar, server.URL)
+	t.Setenv(s3ForcePathStyleEnvVar, "")
+	t.Setenv(s3SkipRegionLookupEnvVar, "")
+	t.Setenv(regionHintEnvVar, "")
+	t.Setenv("BUILDKITE_S3_ACCESS_KEY_ID", "minioadmin")
+	t.Setenv("BUILDKITE_S3_SECRET_ACCESS_KEY", "minioadmin")
+	t.Setenv("BUILDKITE_S3_ACL", "private")
+	t.Setenv("BUILDKITE_S3_ACCESS_URL", "")
+
+	uploader, err := NewS3Uploader(logger.Discard, S3UploaderConfig{
+		Destination: "s3://my-bucket/builds/1",
+	})
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "llamas.txt"), []byte("llamas"), 0o666))
+	artifact := &api.Artifact{
+		Path:         "llamas.txt",
+		AbsolutePath: filepath.Join(dir, "llamas.txt"),
+		ContentType:  "text/plain",
+	}
+	require.NoError(t, uploader.Upload(artifact))
+
+	// The bucket's in the path, and its region wasn't looked up
+	assert.Equal(t, []string{"GET /my-bucket", "PUT /my-bucket/builds/1/llamas.txt"}, requests)
+	assert.Equal(t, "llamas", string(objects["/my-bucket/builds/1/llamas.txt"]))
+	assert.Equal(t, server.URL+"/my-bucket/builds/1/llamas.txt", uploader.URL(artifact))
+}
+
+func TestS3UploaderResumesMultipartUploads(t *testing.T) {
+	var mu sync.Mutex
+	parts := make(map[string][]byte)
+	partPuts := 0
+	failPart := "2"
+	var object []byte
+
+	// Enough of S3's multipart uploads to upload in parts to
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		q := r.URL.Query()
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		switch {
+		case r.Method == "GET":
+			w.Header().Set("Content-Type", "application/xml")
+			io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><Name>my-bucket</Name><MaxKeys>0</MaxKeys><IsTruncated>false</IsTruncated></ListBucketResult>`)
+		case r.Method == "POST" && q.Has("uploads"):
+			io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><InitiateMultipartUploadResult><Bucket>my-bucket</Bucket><Key>large.txt</Key><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == "PUT" && q.Get("uploadId") == "upload-1":
+			if q.Get("partNumber") == failPart {
+				failPart = ""
+				http.Error(w, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`, http.StatusForbidden)
+				return
+			}
+			partPuts++
+			parts[q.Get("partNumber")] = body
+			w.Header().Set("ETag", `"etag-`+q.Get("partNumber")+`"`)
+		case r.Method == "POST" && q.Get("uploadId") == "upload-1":
+			var complete struct {
+				Parts []struct {
+					PartNumber string
+					ETag       string
+				} `xml:"Part"`
+			}
+			require.NoError(t, xml.Unmarshal(body, &complete))
+			object = nil
+			for _, p := range complete.Parts {
+				assert.Equal(t, `"etag-`+p.PartNumber+`"`, p.ETag)
+				object = append(object, parts[p.PartNumber]...)
+			}
+			io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><CompleteMultipartUploadResult><Bucket>my-bucket</Bucket><Key>large.txt</Key></CompleteMultipartUploadResult>`)
+		default:
+			http.Error(w, "", http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv(s3EndpointEnvVar, server.URL)
+	t.Setenv(s3ForcePathStyleEnvVar, "")
+	t.Setenv(s3SkipRegionLookupEnvVar, "")
+	t.Setenv(regionHintEnvVar, "")
+	t.Setenv("BUILDKITE_S3_ACCESS_KEY_ID", "minioadmin")
+	t.Setenv("BUILDKITE_S3_SECRET_ACCESS_KEY", "minioadmin")
+	t.Setenv("BUILDKITE_S3_ACL", "private")
+
+	uploader, err := NewS3Uploader(logger.Discard, S3UploaderConfig{
+		Destination:     "s3://my-bucket",
+		PartSize:        s3MinPartSize,
+		PartConcurrency: 2,
+	})
+	require.NoError(t, err)
+
+	large := writeArtifact(t, t.TempDir(), "large.txt", s3MinPartSize*2+1)
+
+	// The second part fails the first time it's uploaded
+	assert.Error(t, uploader.Upload(large))
+	assert.Equal(t, 2, partPuts)
+	assert.Nil(t, object)
+
+	// Only the part that failed is uploaded again
+	require.NoError(t, uploader.Upload(large))
+	assert.Equal(t, 3, partPuts)
+
+	want, err := os.ReadFile(large.AbsolutePath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(want, object))
+}
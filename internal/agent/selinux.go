@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/v3/internal/bootstrap"
+)
+
+// CheckSELinux checks that jobs can be given the SELinux label, if any, on
+// hosts where SELinux is enforcing, so a missing policy rule fails the agent
+// on start rather than its jobs with denials in the audit log
+func CheckSELinux(buildPath, label string) []HostCheck {
+	mode := bootstrap.SELinuxMode()
+	checks := []HostCheck{{Name: "SELinux", OK: true, Detail: mode}}
+	if mode == bootstrap.SELinuxDisabled {
+		return checks
+	}
+
+	if label == "" {
+		c := HostCheck{Name: "build directory SELinux label"}
+		current, err := bootstrap.SELinuxLabel(buildPath)
+		if err != nil {
+			current = "unknown"
+		}
+		c.OK = mode != bootstrap.SELinuxEnforcing
+		c.Detail = fmt.Sprintf("%s is labeled %s and no label is set for it, so containers that bind mount checkouts will be denied access unless they relabel them",
+			buildPath, current)
+		return append(checks, c)
+	}
+
+	return append(checks, checkSELinuxRelabel(buildPath, label))
+}
+
+// checkSELinuxRelabel labels a directory in the build path, as jobs will
+func checkSELinuxRelabel(buildPath, label string) HostCheck {
+	c := HostCheck{Name: "build directory SELinux label", Required: true}
+
+	if err := os.MkdirAll(buildPath, 0o777); err != nil {
+		c.Detail = err.Error()
+		return c
+	}
+	dir, err := os.MkdirTemp(buildPath, ".selinux-check-")
+	if err != nil {
+		c.Detail = err.Error()
+		return c
+	}
+	defer os.Remove(dir)
+
+	if err := bootstrap.LabelSELinux(dir, label); err != nil {
+		c.Detail = err.Error()
+		return c
+	}
+	if got, err := bootstrap.SELinuxLabel(dir); err != nil || got != label {
+		c.Detail = fmt.Sprintf("%s was labeled %s, but reads back as %q", dir, label, got)
+		return c
+	}
+
+	c.OK = true
+	c.Detail = label
+	return c
+}
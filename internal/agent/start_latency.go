@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/bootstrap"
+)
+
+// startLatencyPart is how long one part of starting a job took
+type startLatencyPart struct {
+	name     string
+	duration time.Duration
+}
+
+// startLatencyParts combines the parts of starting a job that the agent timed
+// with those the bootstrap reported, in roughly the order they happen
+func (r *JobRunner) startLatencyParts(timings *bootstrap.StartTimings) []startLatencyPart {
+	var parts []startLatencyPart
+
+	if !r.conf.AssignedAt.IsZero() && !r.conf.AcceptedAt.IsZero() {
+		parts = append(parts, startLatencyPart{"accept", r.conf.AcceptedAt.Sub(r.conf.AssignedAt)})
+	}
+
+	parts = append(parts, startLatencyPart{"env_build", r.envBuildDuration})
+
+	if timings == nil {
+		return parts
+	}
+
+	if !r.conf.AcceptedAt.IsZero() && !timings.BootstrapStartedAt.IsZero() {
+		parts = append(parts, startLatencyPart{"bootstrap_start", timings.BootstrapStartedAt.Sub(r.conf.AcceptedAt)})
+	}
+
+	names := make([]string, 0, len(timings.Durations))
+	for name := range timings.Durations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		parts = append(parts, startLatencyPart{name, timings.Durations[name]})
+	}
+
+	return parts
+}
+
+// reportStartLatency sends metrics and logs a summary of how long it took from
+// the job being assigned to this agent until its command started
+func (r *JobRunner) reportStartLatency() {
+	var timings *bootstrap.StartTimings
+	if r.startTimingsPath != "" {
+		var err error
+		if timings, err = bootstrap.ReadStartTimingsFile(r.startTimingsPath); err != nil {
+			r.logger.Debug("[JobRunner] No start timings from bootstrap: %v", err)
+		}
+	}
+
+	parts := r.startLatencyParts(timings)
+	for _, part := range parts {
+		r.metrics.Timing("jobs.start_latency."+part.name, part.duration)
+	}
+	if timings != nil && timings.StaleLocksBroken > 0 {
+		r.metrics.Count("jobs.start_latency.stale_locks_broken", int64(timings.StaleLocksBroken))
+	}
+
+	// Without knowing when the command started, there's no total
+	if timings == nil || timings.CommandStartedAt.IsZero() || r.conf.AssignedAt.IsZero() {
+		r.logger.Debug("[JobRunner] Job start latency: %s", formatStartLatencyParts(parts))
+		return
+	}
+
+	total := timings.CommandStartedAt.Sub(r.conf.AssignedAt)
+	r.metrics.Timing("jobs.start_latency.total", total)
+	r.logger.Info("Job %s took %v from assignment to running its command (%s)",
+		r.job.ID, total.Round(time.Millisecond), formatStartLatencyParts(parts))
+}
+
+func formatStartLatencyParts(parts []startLatencyPart) string {
+	s := make([]string, len(parts))
+	for i, part := range parts {
+		s[i] = fmt.Sprintf("%s=%v", part.name, part.duration.Round(time.Millisecond))
+	}
+	return strings.Join(s, " ")
+}
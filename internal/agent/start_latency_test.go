@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/bootstrap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartLatencyParts(t *testing.T) {
+	t.Parallel()
+
+	assignedAt := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	r := &JobRunner{
+		conf: JobRunnerConfig{
+			AssignedAt: assignedAt,
+			AcceptedAt: assignedAt.Add(300 * time.Millisecond),
+		},
+		envBuildDuration: 2 * time.Millisecond,
+	}
+
+	timings := &bootstrap.StartTimings{
+		BootstrapStartedAt: assignedAt.Add(500 * time.Millisecond),
+		Durations: map[string]time.Duration{
+			bootstrap.StartTimingKeyscan: time.Second,
+			bootstrap.StartTimingClone:   3 * time.Second,
+		},
+	}
+
+	parts := r.startLatencyParts(timings)
+
+	assert.Equal(t, []startLatencyPart{
+		{"accept", 300 * time.Millisecond},
+		{"env_build", 2 * time.Millisecond},
+		{"bootstrap_start", 200 * time.Millisecond},
+		{"clone", 3 * time.Second},
+		{"keyscan", time.Second},
+	}, parts)
+
+	assert.Equal(t, "accept=300ms env_build=2ms bootstrap_start=200ms clone=3s keyscan=1s", formatStartLatencyParts(parts))
+}
+
+func TestStartLatencyPartsWithoutAssignmentOrBootstrapTimings(t *testing.T) {
+	t.Parallel()
+
+	r := &JobRunner{envBuildDuration: time.Millisecond}
+
+	assert.Equal(t, []startLatencyPart{
+		{"env_build", time.Millisecond},
+	}, r.startLatencyParts(nil))
+}
@@ -26,6 +26,7 @@ type FetchTagsConfig struct {
 	TagsFromGCPMetaDataPaths  []string
 	TagsFromGCPLabels         bool
 	TagsFromHost              bool
+	TagsFromToolchains        bool
 	WaitForEC2TagsTimeout     time.Duration
 	WaitForEC2MetaDataTimeout time.Duration
 	WaitForECSMetaDataTimeout time.Duration
@@ -56,6 +57,7 @@ func FetchTags(ctx context.Context, l logger.Logger, conf FetchTagsConfig) []str
 		gcpLabels: func() (map[string]string, error) {
 			return GCPLabels{}.Get(ctx)
 		},
+		toolchains: DetectToolchains,
 	}
 	return f.Fetch(ctx, l, conf)
 }
@@ -68,6 +70,7 @@ type tagFetcher struct {
 	gcpMetaDataDefault func() (map[string]string, error)
 	gcpMetaDataPaths   func(map[string]string) (map[string]string, error)
 	gcpLabels          func() (map[string]string, error)
+	toolchains         func(context.Context) map[string]string
 }
 
 func (t *tagFetcher) Fetch(ctx context.Context, l logger.Logger, conf FetchTagsConfig) []string {
@@ -92,6 +95,12 @@ func (t *tagFetcher) Fetch(ctx context.Context, l logger.Logger, conf FetchTagsC
 		}
 	}
 
+	// Add the versions of common tools
+	if conf.TagsFromToolchains {
+		l.Info("Detecting toolchain versions...")
+		tags = append(tags, ToolchainTags(t.toolchains(ctx))...)
+	}
+
 	// Attempt to add the default EC2 meta-data tags
 	if conf.TagsFromEC2MetaData {
 		l.Info("Fetching EC2 meta-data...")
@@ -40,6 +40,21 @@ func TestFetchingTagsWithHostTags(t *testing.T) {
 	assert.Contains(t, tags, "os="+runtime.GOOS)
 }
 
+func TestFetchingTagsWithToolchainTags(t *testing.T) {
+	fetcher := &tagFetcher{
+		toolchains: func(context.Context) map[string]string {
+			return map[string]string{"git": "2.39.2"}
+		},
+	}
+
+	tags := fetcher.Fetch(context.Background(), logger.Discard, FetchTagsConfig{
+		Tags:               []string{"llamas"},
+		TagsFromToolchains: true,
+	})
+
+	assert.Equal(t, []string{"llamas", "toolchain:git=2.39.2"}, tags)
+}
+
 func TestFetchingTagsFromEC2(t *testing.T) {
 	fetcher := &tagFetcher{
 		ec2MetaDataDefault: func() (map[string]string, error) {
@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Toolchain tags are named like toolchain:git=2.39.2
+	toolchainTagPrefix = "toolchain:"
+
+	// How long to wait for a tool to print its version
+	toolchainTimeout = 10 * time.Second
+
+	// How often the versions of tools are checked against those the agent
+	// registered with
+	toolchainCheckInterval = time.Hour
+)
+
+// The first dotted version number in a tool's output, e.g. 2.39.2 from
+// "git version 2.39.2", or 1.21.0 from "go version go1.21.0 linux/amd64"
+var toolchainVersionRegexp = regexp.MustCompile(`\d+(?:\.\d+)+`)
+
+// A toolchain is a tool that agents are commonly targeted by, and how to find
+// out which version of it is installed
+type toolchain struct {
+	Name string
+	Args []string
+
+	// Only look for the tool on this platform
+	GOOS string
+}
+
+var toolchains = []toolchain{
+	{Name: "git", Args: []string{"git", "--version"}},
+	{Name: "docker", Args: []string{"docker", "--version"}},
+	{Name: "node", Args: []string{"node", "--version"}},
+	{Name: "go", Args: []string{"go", "version"}},
+	{Name: "python", Args: []string{"python3", "--version"}},
+	{Name: "xcode", Args: []string{"xcodebuild", "-version"}, GOOS: "darwin"},
+}
+
+// DetectToolchains returns the versions of the common tools that are
+// installed, keyed by the tool's name
+func DetectToolchains(ctx context.Context) map[string]string {
+	return detectToolchains(ctx, runtime.GOOS, func(ctx context.Context, args ...string) (string, error) {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			return "", err
+		}
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+		return string(out), err
+	})
+}
+
+func detectToolchains(ctx context.Context, goos string, run func(context.Context, ...string) (string, error)) map[string]string {
+	versions := map[string]string{}
+	for _, tc := range toolchains {
+		if tc.GOOS != "" && tc.GOOS != goos {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, toolchainTimeout)
+		out, err := run(ctx, tc.Args...)
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		if version := toolchainVersionRegexp.FindString(out); version != "" {
+			versions[tc.Name] = version
+		}
+	}
+	return versions
+}
+
+// ToolchainTags returns tags for the versions of tools, sorted by name
+func ToolchainTags(versions map[string]string) []string {
+	tags := make([]string, 0, len(versions))
+	for name, version := range versions {
+		tags = append(tags, fmt.Sprintf("%s%s=%s", toolchainTagPrefix, name, version))
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// toolchainsFromTags returns the versions of tools in toolchain tags
+func toolchainsFromTags(tags []string) map[string]string {
+	versions := map[string]string{}
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, toolchainTagPrefix) {
+			continue
+		}
+		if name, version, ok := strings.Cut(strings.TrimPrefix(tag, toolchainTagPrefix), "="); ok {
+			versions[name] = version
+		}
+	}
+	return versions
+}
+
+// toolchainChanges describes how the versions of tools have changed, e.g.
+// "git 2.39.2 -> 2.40.0", sorted by the tool's name
+func toolchainChanges(before, after map[string]string) []string {
+	names := map[string]bool{}
+	for name := range before {
+		names[name] = true
+	}
+	for name := range after {
+		names[name] = true
+	}
+
+	var changes []string
+	for name := range names {
+		was, is := before[name], after[name]
+		switch {
+		case was == is:
+			continue
+		case was == "":
+			changes = append(changes, fmt.Sprintf("%s %s was installed", name, is))
+		case is == "":
+			changes = append(changes, fmt.Sprintf("%s %s was removed", name, was))
+		default:
+			changes = append(changes, fmt.Sprintf("%s %s -> %s", name, was, is))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
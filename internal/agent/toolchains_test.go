@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectToolchains(t *testing.T) {
+	outputs := map[string]string{
+		"git":        "git version 2.39.2\n",
+		"docker":     "Docker version 24.0.5, build ced0996\n",
+		"node":       "v18.17.0\n",
+		"go":         "go version go1.21.0 linux/amd64\n",
+		"python3":    "Python 3.11.4\n",
+		"xcodebuild": "Xcode 15.0\nBuild version 15A240d\n",
+	}
+	run := func(_ context.Context, args ...string) (string, error) {
+		if out, ok := outputs[args[0]]; ok {
+			return out, nil
+		}
+		return "", errors.New("not found")
+	}
+
+	assert.Equal(t, map[string]string{
+		"git":    "2.39.2",
+		"docker": "24.0.5",
+		"node":   "18.17.0",
+		"go":     "1.21.0",
+		"python": "3.11.4",
+	}, detectToolchains(context.Background(), "linux", run))
+
+	assert.Equal(t, "15.0", detectToolchains(context.Background(), "darwin", run)["xcode"])
+
+	delete(outputs, "docker")
+	assert.NotContains(t, detectToolchains(context.Background(), "linux", run), "docker")
+}
+
+func TestToolchainTagsRoundTrip(t *testing.T) {
+	versions := map[string]string{"go": "1.21.0", "git": "2.39.2"}
+
+	tags := ToolchainTags(versions)
+	assert.Equal(t, []string{"toolchain:git=2.39.2", "toolchain:go=1.21.0"}, tags)
+	assert.Equal(t, versions, toolchainsFromTags(append([]string{"queue=default"}, tags...)))
+}
+
+func TestToolchainChanges(t *testing.T) {
+	changes := toolchainChanges(
+		map[string]string{"git": "2.39.2", "node": "18.17.0", "go": "1.21.0"},
+		map[string]string{"git": "2.40.0", "go": "1.21.0", "python": "3.11.4"},
+	)
+
+	assert.Equal(t, "git 2.39.2 -> 2.40.0, node 18.17.0 was removed, python 3.11.4 was installed", strings.Join(changes, ", "))
+}
@@ -0,0 +1,32 @@
+package agent
+
+import (
+	"github.com/buildkite/agent/v3/api"
+)
+
+const (
+	// Uploaders that can upload large artifacts in parts do so in parts of
+	// this size, this many at once, unless they're configured otherwise
+	DefaultUploadPartSize        = 8 << 20
+	DefaultUploadPartConcurrency = 4
+)
+
+type Uploader interface {
+	// The Artifact.URL property is populated with what ever is returned
+	// from this method prior to uploading.
+	URL(*api.Artifact) string
+
+	// The actual uploading of the file
+	Upload(*api.Artifact) error
+}
+
+// ResumableUploader is an Uploader that keeps the parts of an artifact it
+// uploaded when an upload fails, so uploading it again resumes where it
+// left off, rather than starting from the beginning.
+type ResumableUploader interface {
+	Uploader
+
+	// Abandon discards the parts of an artifact that's not going to be
+	// uploaded again
+	Abandon(*api.Artifact)
+}
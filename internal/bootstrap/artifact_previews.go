@@ -0,0 +1,293 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"  // To decode GIF artifacts
+	_ "image/jpeg" // To decode JPEG artifacts
+	"image/png"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// Where thumbnails are kept in the checkout until they're uploaded
+	artifactPreviewsDir = "buildkite-artifact-previews"
+
+	// The most images that get thumbnails, and HTML reports that are linked
+	maxArtifactPreviewImages  = 50
+	maxArtifactPreviewReports = 20
+
+	// Images larger than these aren't decoded to make thumbnails of
+	maxArtifactPreviewFileSize = 20 << 20
+	maxArtifactPreviewPixels   = 50_000_000
+
+	// Thumbnails fit in a square this size
+	artifactThumbnailSize = 400
+)
+
+// artifactPreview is an uploaded image and its thumbnail, or an HTML report
+type artifactPreview struct {
+	// The artifact's path, as it was uploaded
+	path string
+
+	// The thumbnail's path, or "" if the image is small enough to be shown
+	// as it is
+	thumbnail string
+}
+
+// uploadArtifactPreviews makes thumbnails of the images the job's uploaded,
+// uploads them, and annotates the build with them and links to any HTML
+// reports, so they can be glanced at without downloading them
+func (b *Bootstrap) uploadArtifactPreviews(ctx context.Context) {
+	wd := b.shell.Getwd()
+	files, err := filesMatching(wd, b.AutomaticArtifactUploadPaths)
+	if err != nil {
+		b.shell.Warningf("Couldn't find the artifacts to preview: %v", err)
+		return
+	}
+
+	dir := filepath.Join(wd, artifactPreviewsDir)
+	defer os.RemoveAll(dir)
+
+	var images, thumbnails []artifactPreview
+	for _, f := range files {
+		if !isPreviewableImage(f) {
+			continue
+		}
+		if len(images) == maxArtifactPreviewImages {
+			b.shell.Commentf("Only the first %d images have previews", maxArtifactPreviewImages)
+			break
+		}
+
+		preview := artifactPreview{path: filepath.ToSlash(f)}
+		thumbnail := filepath.Join(dir, f+".png")
+		made, err := writeThumbnail(filepath.Join(wd, f), thumbnail)
+		if err != nil {
+			b.shell.Warningf("Couldn't make a preview of %s: %v", f, err)
+			continue
+		}
+		if made {
+			rel, _ := filepath.Rel(wd, thumbnail)
+			preview.thumbnail = filepath.ToSlash(rel)
+			thumbnails = append(thumbnails, preview)
+		}
+		images = append(images, preview)
+	}
+
+	reports := htmlReports(files)
+	if len(images) == 0 && len(reports) == 0 {
+		return
+	}
+
+	b.shell.Headerf("Uploading artifact previews")
+
+	if len(thumbnails) > 0 {
+		paths := make([]string, 0, len(thumbnails))
+		for _, t := range thumbnails {
+			paths = append(paths, t.thumbnail)
+		}
+		args := []string{"artifact", "upload", strings.Join(paths, ";")}
+
+		// If blank, the upload destination is buildkite
+		if b.ArtifactUploadDestination != "" {
+			args = append(args, b.ArtifactUploadDestination)
+		}
+		if err := b.shell.Run(ctx, "buildkite-agent", args...); err != nil {
+			b.shell.Warningf("Failed to upload the artifact previews: %v", err)
+			return
+		}
+	}
+
+	label, _ := b.shell.Env.Get("BUILDKITE_LABEL")
+	err = b.shell.Run(ctx, "buildkite-agent", "annotate", "--style", "info", "--context", "artifact-previews-"+b.JobID, artifactPreviewsMarkdown(label, images, reports))
+	if err != nil {
+		b.shell.Warningf("Failed to annotate the build with the artifact previews: %v", err)
+	}
+}
+
+// isPreviewableImage returns whether a file is an image that can be decoded
+// to make a thumbnail of
+func isPreviewableImage(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+		return true
+	}
+	return false
+}
+
+// htmlReports returns the HTML files to link to. A report of many pages,
+// like a coverage report, is linked by its index.html, so the other HTML
+// files in the same directory as one aren't.
+func htmlReports(files []string) []artifactPreview {
+	indexes := make(map[string]bool)
+	var html []string
+	for _, f := range files {
+		f = filepath.ToSlash(f)
+		switch strings.ToLower(path.Ext(f)) {
+		case ".html", ".htm":
+			html = append(html, f)
+			if strings.EqualFold(path.Base(f), "index.html") {
+				indexes[path.Dir(f)] = true
+			}
+		}
+	}
+	sort.Strings(html)
+
+	var reports []artifactPreview
+	for _, f := range html {
+		if indexes[path.Dir(f)] && !strings.EqualFold(path.Base(f), "index.html") {
+			continue
+		}
+		reports = append(reports, artifactPreview{path: f})
+	}
+	return reports
+}
+
+// writeThumbnail writes a PNG thumbnail of the image at src to dst, and
+// returns whether it did. Images that are already small enough don't get
+// one.
+func writeThumbnail(src, dst string) (bool, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() > maxArtifactPreviewFileSize {
+		return false, fmt.Errorf("it's larger than %d MiB", maxArtifactPreviewFileSize>>20)
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	// Check how large it is before decoding it, as a small file can be a
+	// very large image
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return false, err
+	}
+	if config.Width*config.Height > maxArtifactPreviewPixels {
+		return false, fmt.Errorf("it's %dx%d, larger than can be previewed", config.Width, config.Height)
+	}
+	if config.Width <= artifactThumbnailSize && config.Height <= artifactThumbnailSize {
+		return false, nil
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return false, err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return false, err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return false, err
+	}
+	if err := png.Encode(out, thumbnail(img, artifactThumbnailSize)); err != nil {
+		out.Close()
+		return false, err
+	}
+	return true, out.Close()
+}
+
+// thumbnail scales an image down to fit in a size by size square, keeping
+// its aspect ratio, by averaging the pixels each of the thumbnail's covers
+func thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	tw, th := size, size
+	if w > h {
+		th = h * size / w
+	} else {
+		tw = w * size / h
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, tw, th))
+	for ty := 0; ty < th; ty++ {
+		y0, y1 := bounds.Min.Y+ty*h/th, bounds.Min.Y+(ty+1)*h/th
+		for tx := 0; tx < tw; tx++ {
+			x0, x1 := bounds.Min.X+tx*w/tw, bounds.Min.X+(tx+1)*w/tw
+
+			// Each of the thumbnail's pixels covers at least one of the image's
+			if y1 == y0 {
+				y1++
+			}
+			if x1 == x0 {
+				x1++
+			}
+
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					b += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(tx, ty, color.NRGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(b / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+// artifactPreviewsMarkdown shows the thumbnails, linked to their images, and
+// links to the HTML reports, which are all artifacts
+func artifactPreviewsMarkdown(label string, images, reports []artifactPreview) string {
+	var b strings.Builder
+	if label == "" {
+		label = "The job"
+	}
+	fmt.Fprintf(&b, "**%s** uploaded:\n\n", label)
+
+	for _, i := range images {
+		src := i.thumbnail
+		if src == "" {
+			src = i.path
+		}
+		fmt.Fprintf(&b, "<a href=\"artifact://%s\"><img src=\"artifact://%s\" alt=\"%s\" height=\"200\"></a>\n", artifactURLPath(i.path), artifactURLPath(src), path.Base(i.path))
+	}
+	if len(images) > 0 {
+		b.WriteString("\n")
+	}
+
+	for n, r := range reports {
+		if n == maxArtifactPreviewReports {
+			fmt.Fprintf(&b, "- and %d more HTML files\n", len(reports)-n)
+			break
+		}
+		fmt.Fprintf(&b, "- :page_facing_up: [%s](artifact://%s)\n", r.path, artifactURLPath(r.path))
+	}
+	return b.String()
+}
+
+// artifactURLPath escapes the spaces in an artifact's path for an
+// artifact:// link
+func artifactURLPath(p string) string {
+	return strings.ReplaceAll(p, " ", "%20")
+}
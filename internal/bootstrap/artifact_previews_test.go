@@ -0,0 +1,124 @@
+package bootstrap
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThumbnailKeepsAspectRatio(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		width, height int
+		want          image.Point
+	}{
+		{width: 800, height: 400, want: image.Pt(400, 200)},
+		{width: 300, height: 900, want: image.Pt(133, 400)},
+		{width: 1000, height: 1000, want: image.Pt(400, 400)},
+		{width: 4000, height: 2, want: image.Pt(400, 1)},
+	} {
+		img := image.NewNRGBA(image.Rect(0, 0, tc.width, tc.height))
+		got := thumbnail(img, 400).Bounds().Size()
+		assert.Equal(t, tc.want, got, "thumbnail of %dx%d", tc.width, tc.height)
+	}
+}
+
+func TestThumbnailAveragesPixels(t *testing.T) {
+	t.Parallel()
+
+	// Alternate black and white columns should average out to grey
+	img := image.NewNRGBA(image.Rect(0, 0, 800, 800))
+	for y := 0; y < 800; y++ {
+		for x := 0; x < 800; x += 2 {
+			img.SetNRGBA(x, y, color.NRGBA{A: 0xff})
+			img.SetNRGBA(x+1, y, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+		}
+	}
+
+	got := thumbnail(img, 400).(*image.NRGBA).NRGBAAt(10, 10)
+	assert.Equal(t, color.NRGBA{R: 0x7f, G: 0x7f, B: 0x7f, A: 0xff}, got)
+}
+
+func TestWriteThumbnail(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for name, size := range map[string]int{"large.png": 1200, "small.png": 200} {
+		f, err := os.Create(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.NoError(t, png.Encode(f, image.NewGray(image.Rect(0, 0, size, size/2))))
+		require.NoError(t, f.Close())
+	}
+
+	dst := filepath.Join(dir, "previews", "large.png.png")
+	made, err := writeThumbnail(filepath.Join(dir, "large.png"), dst)
+	require.NoError(t, err)
+	assert.True(t, made)
+
+	f, err := os.Open(dst)
+	require.NoError(t, err)
+	defer f.Close()
+	config, err := png.DecodeConfig(f)
+	require.NoError(t, err)
+	assert.Equal(t, 400, config.Width)
+	assert.Equal(t, 200, config.Height)
+
+	// Small images are shown as they are
+	made, err = writeThumbnail(filepath.Join(dir, "small.png"), filepath.Join(dir, "previews", "small.png.png"))
+	require.NoError(t, err)
+	assert.False(t, made)
+	assert.NoFileExists(t, filepath.Join(dir, "previews", "small.png.png"))
+
+	// And files that aren't images are errors
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "fake.png"), []byte("llamas"), 0o600))
+	_, err = writeThumbnail(filepath.Join(dir, "fake.png"), filepath.Join(dir, "previews", "fake.png.png"))
+	assert.Error(t, err)
+}
+
+func TestHTMLReportsAreLinkedByTheirIndex(t *testing.T) {
+	t.Parallel()
+
+	got := htmlReports([]string{
+		"coverage/index.html",
+		"coverage/src/main.go.html",
+		"coverage/other.html",
+		"results.html",
+		"docs/Page.HTM",
+		"plot.png",
+	})
+
+	assert.Equal(t, []artifactPreview{
+		{path: "coverage/index.html"},
+		{path: "coverage/src/main.go.html"},
+		{path: "docs/Page.HTM"},
+		{path: "results.html"},
+	}, got)
+}
+
+func TestArtifactPreviewsMarkdown(t *testing.T) {
+	t.Parallel()
+
+	images := []artifactPreview{
+		{path: "plots/large plot.png", thumbnail: "buildkite-artifact-previews/plots/large plot.png.png"},
+		{path: "plots/small.png"},
+	}
+	reports := []artifactPreview{{path: "coverage/index.html"}}
+
+	assert.Equal(t, "**:chart: Plots** uploaded:\n\n"+
+		`<a href="artifact://plots/large%20plot.png"><img src="artifact://buildkite-artifact-previews/plots/large%20plot.png.png" alt="large plot.png" height="200"></a>`+"\n"+
+		`<a href="artifact://plots/small.png"><img src="artifact://plots/small.png" alt="small.png" height="200"></a>`+"\n"+
+		"\n"+
+		"- :page_facing_up: [coverage/index.html](artifact://coverage/index.html)\n",
+		artifactPreviewsMarkdown(":chart: Plots", images, reports))
+
+	assert.Equal(t, "**The job** uploaded:\n\n"+
+		"- :page_facing_up: [coverage/index.html](artifact://coverage/index.html)\n",
+		artifactPreviewsMarkdown("", nil, reports))
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package bootstrap
+
+import (
+	"os"
+	"syscall"
+)
+
+// backgroundProcessSysProcAttr puts a process that runs alongside the job, like
+// a virtual display, in a process group of its own, so anything it starts is
+// stopped with it, and where it can, has it killed if the bootstrap dies
+// without stopping it
+func backgroundProcessSysProcAttr() *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{Setpgid: true}
+	setParentDeathSignal(attr)
+	return attr
+}
+
+// signalBackgroundProcess terminates, or kills, a background process's group
+func signalBackgroundProcess(p *os.Process, kill bool) error {
+	sig := syscall.SIGTERM
+	if kill {
+		sig = syscall.SIGKILL
+	}
+	return syscall.Kill(-p.Pid, sig)
+}
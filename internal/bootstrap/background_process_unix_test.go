@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+package bootstrap
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestSignalingBackgroundProcessStopsItsGroup(t *testing.T) {
+	t.Parallel()
+
+	// The shell waits on a child, which has to be signaled too for it to exit
+	cmd := exec.Command("/bin/sh", "-c", "sleep 60 & wait")
+	cmd.SysProcAttr = backgroundProcessSysProcAttr()
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("cmd.Start() error = %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(done)
+	}()
+
+	// Give the shell a moment to start sleeping
+	time.Sleep(100 * time.Millisecond)
+	if err := signalBackgroundProcess(cmd.Process, false); err != nil {
+		t.Fatalf("signalBackgroundProcess(p, false) error = %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		_ = signalBackgroundProcess(cmd.Process, true)
+		t.Fatal("the background process didn't stop after it was signaled")
+	}
+}
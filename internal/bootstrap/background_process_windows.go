@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package bootstrap
+
+import (
+	"os"
+	"syscall"
+)
+
+func backgroundProcessSysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+// signalBackgroundProcess kills a background process, which is as gentle as
+// it gets where there aren't process groups
+func signalBackgroundProcess(p *os.Process, kill bool) error {
+	return p.Kill()
+}
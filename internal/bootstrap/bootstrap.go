@@ -17,16 +17,17 @@ import (
 	"strings"
 	"time"
 
-	"github.com/buildkite/agent/v3/agent/plugin"
-	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/agent/v3/env"
-	"github.com/buildkite/agent/v3/experiments"
-	"github.com/buildkite/agent/v3/hook"
-	"github.com/buildkite/agent/v3/kubernetes"
+	"github.com/buildkite/agent/v3/internal/agent/plugin"
+	"github.com/buildkite/agent/v3/internal/experiments"
+	"github.com/buildkite/agent/v3/internal/hook"
+	"github.com/buildkite/agent/v3/internal/kubernetes"
+	"github.com/buildkite/agent/v3/internal/lock"
+	"github.com/buildkite/agent/v3/internal/redaction"
+	"github.com/buildkite/agent/v3/internal/tracetools"
+	"github.com/buildkite/agent/v3/internal/utils"
 	"github.com/buildkite/agent/v3/process"
-	"github.com/buildkite/agent/v3/redaction"
-	"github.com/buildkite/agent/v3/tracetools"
-	"github.com/buildkite/agent/v3/utils"
+	"github.com/buildkite/agent/v3/shell"
 	"github.com/buildkite/roko"
 	"github.com/buildkite/shellwords"
 )
@@ -52,6 +53,24 @@ type Bootstrap struct {
 	// Directories to clean up at end of bootstrap
 	cleanupDirs []string
 
+	// How long each part of starting the job took
+	startTimings *StartTimings
+
+	// A filesystem mounted over the checkout, destroyed at end of bootstrap
+	buildDirMount buildDirMount
+
+	// A virtual display for the job, stopped at end of bootstrap
+	virtualDisplay *virtualDisplay
+
+	// An emulator or simulator for the command, shut down after it
+	device device
+
+	// A Docker daemon for the job, stopped at end of bootstrap
+	dockerDaemon *dockerDaemon
+
+	// A lock on the checkout directory, so no other job uses it at once
+	checkoutLock *lock.Lock
+
 	// A channel to track cancellation
 	cancelCh chan struct{}
 }
@@ -59,8 +78,9 @@ type Bootstrap struct {
 // New returns a new Bootstrap instance
 func New(conf Config) *Bootstrap {
 	return &Bootstrap{
-		Config:   conf,
-		cancelCh: make(chan struct{}),
+		Config:       conf,
+		cancelCh:     make(chan struct{}),
+		startTimings: newStartTimings(),
 	}
 }
 
@@ -78,7 +98,32 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 		b.shell.PTY = b.Config.RunInPty
 		b.shell.Debug = b.Config.Debug
 		b.shell.InterruptSignal = b.Config.CancelSignal
+		b.shell.SignalGracePeriod = b.Config.SignalGracePeriod
+
+		// Commands' output is written as records too, a line at a time
+		if b.Config.LogFormat == "json" {
+			b.shell.Logger = &shell.JSONLogger{Writer: os.Stderr}
+			streamer := shell.NewLoggerStreamer(b.shell.Logger)
+			defer streamer.Close()
+			b.shell.Writer = streamer
+		} else if b.Config.LineMetadata {
+			// The bootstrap's comments, warnings and errors are tagged with
+			// their level, alongside the lines its commands' are tagged with
+			b.shell.Logger = &shell.WriterLogger{Writer: os.Stderr, Ansi: true, TagLevels: true}
+		}
 	}
+	b.shell.TagLines = b.Config.LineMetadata
+	b.shell.LockWaited = b.startTimings.lockWaited
+	b.shell.CommandTimeout = b.Config.CommandTimeout
+
+	// Set the umask before anything's made, so it applies to the job's files
+	// and processes as well as the bootstrap's
+	if b.Config.Umask != 0 {
+		if err := setUmask(b.Config.Umask); err != nil {
+			b.shell.Warningf("Couldn't set the umask to %04o: %v", b.Config.Umask, err)
+		}
+	}
+
 	if experiments.IsEnabled("kubernetes-exec") {
 		kubernetesClient := &kubernetes.Client{}
 		if err := b.startKubernetesClient(ctx, kubernetesClient); err != nil {
@@ -96,6 +141,13 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 	defer stopper()
 	defer func() { span.FinishWithError(err) }()
 
+	// Spans the job marks in its output are added to its trace
+	if b.Config.TracingBackend != tracetools.BackendNone {
+		spans := newUserSpanWriter(ctx, b.shell.Writer, b.Config.TracingBackend)
+		b.shell.Writer = spans
+		defer spans.Close()
+	}
+
 	// Listen for cancellation
 	go func() {
 		select {
@@ -108,6 +160,26 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 		}
 	}()
 
+	// Let the agent know how long it took to get the job started
+	if b.Config.StartTimingsFile != "" {
+		defer func() {
+			if err := b.startTimings.writeFile(b.Config.StartTimingsFile); err != nil {
+				b.shell.Warningf("Failed to write start timings: %v", err)
+			}
+		}()
+	}
+
+	// Hold the checkout directory until everything's done with it
+	defer b.unlockCheckoutDir()
+
+	// Destroy any mounted build directory once everything else is done with it
+	defer b.closeBuildDirMount(ctx)
+
+	// Likewise stop any virtual display and Docker daemon, so none are left
+	// running
+	defer b.stopManagedVirtualDisplay()
+	defer b.stopDockerDaemon()
+
 	// Tear down the environment (and fire pre-exit hook) before we exit
 	defer func() {
 		if err = b.tearDown(ctx); err != nil {
@@ -124,6 +196,14 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 		return shell.GetExitCode(err)
 	}
 
+	// A parallel job that doesn't know which share of the step's work is its
+	// own shouldn't run any of it
+	parallel, err := parseParallelJob(b.shell.Env)
+	if err != nil {
+		b.shell.Errorf("Error with the parallel job: %v", err)
+		return shell.GetExitCode(err)
+	}
+
 	var includePhase = func(phase string) bool {
 		if len(b.Phases) == 0 {
 			return true
@@ -136,19 +216,42 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 		return false
 	}
 
+	// Only the bootstrap that checks out the job holds its checkout directory
+	if includePhase("checkout") {
+		if err = b.lockCheckoutDir(); err != nil {
+			b.shell.Errorf("Error locking the checkout directory: %v", err)
+			return shell.GetExitCode(err)
+		}
+	}
+
+	if err = b.startManagedVirtualDisplay(ctx); err != nil {
+		b.shell.Errorf("Error starting virtual display: %v", err)
+		return shell.GetExitCode(err)
+	}
+
+	if err = b.startDockerDaemon(ctx); err != nil {
+		b.shell.Errorf("Error starting Docker daemon: %v", err)
+		return shell.GetExitCode(err)
+	}
+	b.useRootlessDockerHost()
+
 	// Execute the bootstrap phases in order
 	var phaseErr error
 
 	if includePhase("plugin") {
+		b.startPhase(PhasePlugin)
 		phaseErr = b.preparePlugins()
 
 		if phaseErr == nil {
 			phaseErr = b.PluginPhase(ctx)
 		}
+		b.endPhase(PhasePlugin, phaseErr)
 	}
 
 	if phaseErr == nil && includePhase("checkout") {
+		b.startPhase(PhaseCheckout)
 		phaseErr = b.CheckoutPhase(ctx)
+		b.endPhase(PhaseCheckout, phaseErr)
 	} else {
 		checkoutDir, exists := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
 		if exists {
@@ -157,12 +260,27 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 	}
 
 	if phaseErr == nil && includePhase("plugin") {
+		b.startPhase(PhaseVendoredPlugin)
 		phaseErr = b.VendoredPluginPhase(ctx)
+		b.endPhase(PhaseVendoredPlugin, phaseErr)
 	}
 
 	if phaseErr == nil && includePhase("command") {
 		var commandErr error
+		b.startPhase(PhaseCommand)
+		commandStarted := time.Now()
 		phaseErr, commandErr = b.CommandPhase(ctx)
+		if phaseErr != nil {
+			b.endPhase(PhaseCommand, phaseErr)
+		} else {
+			b.endPhase(PhaseCommand, commandErr)
+		}
+
+		// Only a parallel job that finished its share of the work says how
+		// long that work takes
+		if phaseErr == nil && commandErr == nil && b.ParallelSkewThreshold > 0 {
+			b.recordParallelJobDuration(ctx, parallel, time.Since(commandStarted))
+		}
 		/*
 			Five possible states at this point:
 
@@ -187,8 +305,19 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 			span.RecordError(commandErr)
 		}
 
+		// Bundle up the paths needed to look into a failure, which successful
+		// jobs don't need
+		if commandErr != nil || phaseErr != nil {
+			if err := b.uploadFailureBundle(ctx); err != nil {
+				b.shell.Warningf("Failed to upload the failure bundle: %v", err)
+			}
+		}
+
 		// Only upload artifacts as part of the command phase
-		if err = b.artifactPhase(ctx); err != nil {
+		b.startPhase(PhaseArtifacts)
+		err = b.artifactPhase(ctx)
+		b.endPhase(PhaseArtifacts, err)
+		if err != nil {
 			b.shell.Errorf("%v", err)
 
 			if commandErr != nil {
@@ -224,6 +353,14 @@ func (b *Bootstrap) Cancel() error {
 	return nil
 }
 
+// setOutputSource sets what the output of the commands run is tagged as being
+// from, and returns a func that sets it back
+func (b *Bootstrap) setOutputSource(source string) func() {
+	previous := b.shell.Source
+	b.shell.Source = source
+	return func() { b.shell.Source = previous }
+}
+
 type HookConfig struct {
 	Name           string
 	Scope          string
@@ -280,6 +417,11 @@ func (b *Bootstrap) executeHook(ctx context.Context, hookCfg HookConfig) error {
 
 	b.shell.Headerf("Running %s hook", hookName)
 
+	if err = b.verifyHookChecksum(hookCfg); err != nil {
+		b.shell.Errorf("%v", err)
+		return err
+	}
+
 	redactors := b.setupRedactors()
 	defer redactors.Flush()
 
@@ -310,8 +452,19 @@ func (b *Bootstrap) executeHook(ctx context.Context, hookCfg HookConfig) error {
 		b.shell.Promptf("%s", process.FormatCommand(cleanHookPath, []string{}))
 	}
 
+	// Tell the hook where it can write its environment changes to
+	hookEnv := hookCfg.Env.Copy()
+	hookEnv.Set(hook.EnvFileEnv, script.EnvFile())
+
 	// Run the wrapper script
-	if err = b.shell.RunScript(ctx, script.Path(), hookCfg.Env); err != nil {
+	source := "hook:" + hookCfg.Scope + ":" + hookCfg.Name
+	if hookCfg.PluginName != "" {
+		source = "plugin:" + hookCfg.PluginName + ":" + hookCfg.Name
+	}
+	restoreSource := b.setOutputSource(source)
+	err = b.shell.RunScript(ctx, script.Path(), hookEnv)
+	restoreSource()
+	if err != nil {
 		exitCode := shell.GetExitCode(err)
 		b.shell.Env.Set("BUILDKITE_LAST_HOOK_EXIT_STATUS", fmt.Sprintf("%d", exitCode))
 
@@ -337,8 +490,9 @@ func (b *Bootstrap) executeHook(ctx context.Context, hookCfg HookConfig) error {
 		switch err.(type) {
 		case *hook.HookExitError:
 			// ...because the hook called exit(), tsk we ignore any changes
-			// since we can't discern them but continue on with the job
-			break
+			// since we can't discern them but continue on with the job. Any
+			// it wrote to its env file are still applied.
+			b.applyEnvironmentChanges(changes, redactors)
 		default:
 			// ...because something else happened, report it and stop the job
 			return fmt.Errorf("Failed to get environment: %w", err)
@@ -417,15 +571,22 @@ func (b *Bootstrap) hasGlobalHook(name string) bool {
 	return err == nil
 }
 
+// findHook returns the absolute path to the named hook in dir, and counts the
+// time spent looking towards the job's start timings
+func (b *Bootstrap) findHook(dir, name string) (string, error) {
+	defer b.startTimings.track(StartTimingHookDiscovery)()
+	return hook.Find(dir, name)
+}
+
 // Returns the absolute path to a global hook, or os.ErrNotExist if none is found
 func (b *Bootstrap) globalHookPath(name string) (string, error) {
-	return hook.Find(b.HooksPath, name)
+	return b.findHook(b.HooksPath, name)
 }
 
 // Executes a global hook if one exists
 func (b *Bootstrap) executeGlobalHook(ctx context.Context, name string) error {
 	if !b.hasGlobalHook(name) {
-		return nil
+		return b.verifyHookNotMissing("global", name)
 	}
 	p, err := b.globalHookPath(name)
 	if err != nil {
@@ -441,7 +602,7 @@ func (b *Bootstrap) executeGlobalHook(ctx context.Context, name string) error {
 // Returns the absolute path to a local hook, or os.ErrNotExist if none is found
 func (b *Bootstrap) localHookPath(name string) (string, error) {
 	dir := filepath.Join(b.shell.Getwd(), ".buildkite", "hooks")
-	return hook.Find(dir, name)
+	return b.findHook(dir, name)
 }
 
 func (b *Bootstrap) hasLocalHook(name string) bool {
@@ -452,7 +613,7 @@ func (b *Bootstrap) hasLocalHook(name string) bool {
 // Executes a local hook
 func (b *Bootstrap) executeLocalHook(ctx context.Context, name string) error {
 	if !b.hasLocalHook(name) {
-		return nil
+		return b.verifyHookNotMissing("local", name)
 	}
 
 	localHookPath, err := b.localHookPath(name)
@@ -490,6 +651,21 @@ func dirForRepository(repository string) string {
 	return badCharsPattern.ReplaceAllString(repository, "-")
 }
 
+// keyscanRepositoryHost adds the repository's host to known_hosts, and counts
+// the time it takes towards the job's start timings. With strict host key
+// checking, the host is never added, and it's an error for it to be unknown.
+func (b *Bootstrap) keyscanRepositoryHost(ctx context.Context, repository string) error {
+	if b.SSHStrictHostChecking {
+		return verifyRepositoryHostIsKnown(ctx, b.shell, repository)
+	}
+	if !b.SSHKeyscan {
+		return nil
+	}
+	defer b.startTimings.track(StartTimingKeyscan)()
+	addRepositoryHostToSSHKnownHosts(ctx, b.shell, repository)
+	return nil
+}
+
 // Given a repository, it will add the host to the set of SSH known_hosts on the machine
 func addRepositoryHostToSSHKnownHosts(ctx context.Context, sh *shell.Shell, repository string) {
 	if utils.FileExists(repository) {
@@ -508,6 +684,20 @@ func addRepositoryHostToSSHKnownHosts(ctx context.Context, sh *shell.Shell, repo
 	}
 }
 
+// verifyRepositoryHostIsKnown returns an error listing the fingerprints of
+// the repository host's keys if it isn't in the SSH known_hosts
+func verifyRepositoryHostIsKnown(ctx context.Context, sh *shell.Shell, repository string) error {
+	if utils.FileExists(repository) {
+		return nil
+	}
+
+	knownHosts, err := findKnownHosts(sh)
+	if err != nil {
+		return fmt.Errorf("Failed to find SSH known_hosts file: %w", err)
+	}
+	return knownHosts.VerifyFromRepository(ctx, repository)
+}
+
 // setUp is run before all the phases run. It's responsible for initializing the
 // bootstrap environment
 func (b *Bootstrap) setUp(ctx context.Context) error {
@@ -531,8 +721,7 @@ func (b *Bootstrap) setUp(ctx context.Context) error {
 		if b.BuildPath == "" {
 			return fmt.Errorf("Must set either a BUILDKITE_BUILD_PATH or a BUILDKITE_BUILD_CHECKOUT_PATH")
 		}
-		b.shell.Env.Set("BUILDKITE_BUILD_CHECKOUT_PATH",
-			filepath.Join(b.BuildPath, dirForAgentName(b.AgentName), b.OrganizationSlug, b.PipelineSlug))
+		b.shell.Env.Set("BUILDKITE_BUILD_CHECKOUT_PATH", filepath.Join(b.BuildPath, b.checkoutDir()))
 	}
 
 	// The job runner sets BUILDKITE_IGNORED_ENV with any keys that were ignored
@@ -550,6 +739,18 @@ func (b *Bootstrap) setUp(ctx context.Context) error {
 		b.shell.Printf("^^^ +++")
 	}
 
+	// The job runner sets BUILDKITE_AGENT_HOST_DRIFT with how the host differs
+	// from the agent's baseline, one difference per line, which is often why
+	// a build only fails on some agents
+	if drift, exists := b.shell.Env.Get("BUILDKITE_AGENT_HOST_DRIFT"); exists {
+		fingerprint, _ := b.shell.Env.Get("BUILDKITE_AGENT_HOST_FINGERPRINT")
+		b.shell.Headerf("Host %s has drifted from its baseline", fingerprint)
+
+		for _, line := range strings.Split(drift, "\n") {
+			b.shell.Warningf("%s", line)
+		}
+	}
+
 	if b.Debug {
 		b.shell.Headerf("Buildkite environment variables")
 		for _, e := range b.shell.Env.ToSlice() {
@@ -561,6 +762,10 @@ func (b *Bootstrap) setUp(ctx context.Context) error {
 		}
 	}
 
+	if err = b.createSELinuxTempDir(); err != nil {
+		return err
+	}
+
 	// Disable any interactive Git/SSH prompting
 	b.shell.Env.Set("GIT_TERMINAL_PROMPT", "0")
 
@@ -639,9 +844,50 @@ func (b *Bootstrap) preparePlugins() error {
 		b.shell.Commentf("Parsed %d plugins", len(b.plugins))
 	}
 
+	for _, p := range b.plugins {
+		if err := b.checkPluginAllowed(p); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// checkPluginAllowed returns an error if the agent's --allowed-plugins or
+// --denied-plugins don't let the plugin run. Vendored plugins, like
+// ./my-plugin, come with the repository being built rather than being fetched,
+// so they're always allowed, and no pattern has to match them.
+func (b *Bootstrap) checkPluginAllowed(p *plugin.Plugin) error {
+	if p.Vendored {
+		return nil
+	}
+	if len(b.Config.DeniedPlugins) == 0 && len(b.Config.AllowedPlugins) == 0 {
+		return nil
+	}
+
+	// Locations like example.com/allowed/../denied/plugin are fetched from
+	// wherever they resolve to, so they can't be matched against either list
+	if p.HasDotSegments() {
+		return fmt.Errorf("Plugin %s can't be checked against this agent's `--allowed-plugins` or `--denied-plugins`, as its location has . or .. in it", p.Label())
+	}
+
+	for _, pattern := range b.Config.DeniedPlugins {
+		if p.Matches(pattern) {
+			return fmt.Errorf("Plugin %s has been denied on this agent by `--denied-plugins %s`", p.Label(), pattern)
+		}
+	}
+
+	if len(b.Config.AllowedPlugins) == 0 {
+		return nil
+	}
+	for _, pattern := range b.Config.AllowedPlugins {
+		if p.Matches(pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Plugin %s isn't allowed on this agent, only plugins matching `--allowed-plugins %s` are", p.Label(), strings.Join(b.Config.AllowedPlugins, ","))
+}
+
 func (b *Bootstrap) validatePluginCheckout(checkout *pluginCheckout) error {
 	if !b.Config.PluginValidation {
 		return nil
@@ -699,7 +945,9 @@ func (b *Bootstrap) PluginPhase(ctx context.Context) error {
 			continue
 		}
 
+		stopTiming := b.startTimings.track(StartTimingPluginFetch)
 		checkout, err := b.checkoutPlugin(ctx, p)
+		stopTiming()
 		if err != nil {
 			return fmt.Errorf("Failed to checkout plugin %s: %w", p.Name(), err)
 		}
@@ -745,16 +993,27 @@ func (b *Bootstrap) VendoredPluginPhase(ctx context.Context) error {
 			return fmt.Errorf("Vendored plugin path %s doesn't exist", p.Location)
 		}
 
+		// Also make sure that plugin is within this repository
+		// checkout and isn't elsewhere on the system, including through a
+		// symlink in the repository.
+		if !isWithinDir(pluginLocation, checkoutPath) {
+			return fmt.Errorf("Vendored plugin paths must be within the checked-out repository")
+		}
+
+		if info, err := os.Stat(pluginLocation); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf("Vendored plugin path %s isn't a directory", p.Location)
+		}
+
 		checkout := &pluginCheckout{
 			Plugin:      p,
 			CheckoutDir: pluginLocation,
 			HooksDir:    filepath.Join(pluginLocation, "hooks"),
 		}
 
-		// Also make sure that plugin is within this repository
-		// checkout and isn't elsewhere on the system.
-		if !strings.HasPrefix(pluginLocation, checkoutPath+string(os.PathSeparator)) {
-			return fmt.Errorf("Vendored plugin paths must be within the checked-out repository")
+		if err := p.VerifyChecksum(pluginLocation); err != nil {
+			return err
 		}
 
 		err = b.validatePluginCheckout(checkout)
@@ -772,10 +1031,24 @@ func (b *Bootstrap) VendoredPluginPhase(ctx context.Context) error {
 	return b.executePluginHook(ctx, "environment", vendoredCheckouts)
 }
 
+// isWithinDir returns whether path is inside dir once any symlinks in
+// either are followed
+func isWithinDir(path, dir string) bool {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
 // Executes a named hook on plugins that have it
 func (b *Bootstrap) executePluginHook(ctx context.Context, name string, checkouts []*pluginCheckout) error {
 	for _, p := range checkouts {
-		hookPath, err := hook.Find(p.HooksDir, name)
+		hookPath, err := b.findHook(p.HooksDir, name)
 		if errors.Is(err, os.ErrNotExist) {
 			continue // this plugin does not implement this hook
 		} else if err != nil {
@@ -807,7 +1080,7 @@ func (b *Bootstrap) executePluginHook(ctx context.Context, name string, checkout
 // If any plugin has a hook by this name
 func (b *Bootstrap) hasPluginHook(name string) bool {
 	for _, p := range b.pluginCheckouts {
-		if _, err := hook.Find(p.HooksDir, name); err == nil {
+		if _, err := b.findHook(p.HooksDir, name); err == nil {
 			return true
 		}
 	}
@@ -816,6 +1089,12 @@ func (b *Bootstrap) hasPluginHook(name string) bool {
 
 // Checkout a given plugin to the plugins directory and return that directory
 func (b *Bootstrap) checkoutPlugin(ctx context.Context, p *plugin.Plugin) (*pluginCheckout, error) {
+	// Plugins can be shared between jobs from the cache, unless they're
+	// meant to be cloned fresh for each
+	if b.Config.PluginsCachePath != "" && !b.Config.PluginsAlwaysCloneFresh {
+		return b.checkoutCachedPlugin(ctx, p)
+	}
+
 	// Make sure we have a plugin path before trying to do anything
 	if b.PluginsPath == "" {
 		return nil, fmt.Errorf("Can't checkout plugin without a `plugins-path`")
@@ -828,8 +1107,8 @@ func (b *Bootstrap) checkoutPlugin(ctx context.Context, p *plugin.Plugin) (*plug
 	}
 
 	// Ensure the plugin directory exists, otherwise we can't create the lock
-	// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
-	if err := os.MkdirAll(b.PluginsPath, 0777); err != nil {
+	// Actual file permissions will be reduced by umask
+	if err := os.MkdirAll(b.PluginsPath, b.directoryMode()); err != nil {
 		return nil, err
 	}
 
@@ -883,7 +1162,18 @@ func (b *Bootstrap) checkoutPlugin(ctx context.Context, p *plugin.Plugin) (*plug
 			b.shell.Commentf("Plugin %q already checked out (%s)", p.Label(), strings.TrimSpace(headCommit))
 		}
 
-		return checkout, nil
+		// A tag can be moved to another commit, so an existing checkout
+		// that doesn't match the plugin's checksum is cloned again
+		// rather than trusted
+		err = p.VerifyChecksum(pluginDirectory)
+		if err == nil {
+			return checkout, nil
+		}
+		b.shell.Warningf("%v, removing it to clone it again", err)
+		if err := os.RemoveAll(pluginDirectory); err != nil {
+			b.shell.Errorf("Oh no, something went wrong removing %s", pluginDirectory)
+			return nil, err
+		}
 	}
 
 	b.shell.Commentf("Plugin \"%s\" will be checked out to \"%s\"", p.Location, pluginDirectory)
@@ -893,8 +1183,8 @@ func (b *Bootstrap) checkoutPlugin(ctx context.Context, p *plugin.Plugin) (*plug
 		return nil, err
 	}
 
-	if b.SSHKeyscan {
-		addRepositoryHostToSSHKnownHosts(ctx, b.shell, repo)
+	if err := b.keyscanRepositoryHost(ctx, repo); err != nil {
+		return nil, err
 	}
 
 	// Make the directory
@@ -903,11 +1193,32 @@ func (b *Bootstrap) checkoutPlugin(ctx context.Context, p *plugin.Plugin) (*plug
 		return nil, err
 	}
 
+	if err := b.clonePlugin(ctx, p, repo, tempDir); err != nil {
+		return nil, err
+	}
+
+	if err := p.VerifyChecksum(tempDir); err != nil {
+		os.RemoveAll(tempDir)
+		return nil, err
+	}
+
+	b.shell.Commentf("Moving temporary plugin directory to final location")
+	err = os.Rename(tempDir, pluginDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	return checkout, nil
+}
+
+// clonePlugin clones the plugin's repository into dir, which must be empty,
+// and checks out its version
+func (b *Bootstrap) clonePlugin(ctx context.Context, p *plugin.Plugin, repo, dir string) error {
 	// Switch to the plugin directory
 	b.shell.Commentf("Switching to the temporary plugin directory")
 	previousWd := b.shell.Getwd()
-	if err := b.shell.Chdir(tempDir); err != nil {
-		return nil, err
+	if err := b.shell.Chdir(dir); err != nil {
+		return err
 	}
 	// Switch back to the previous working directory
 	defer b.shell.Chdir(previousWd)
@@ -921,34 +1232,25 @@ func (b *Bootstrap) checkoutPlugin(ctx context.Context, p *plugin.Plugin) (*plug
 	args = append(args, "--", repo, ".")
 
 	// Plugin clones shouldn't use custom GitCloneFlags
-	err = roko.NewRetrier(
-		roko.WithMaxAttempts(3),
-		roko.WithStrategy(roko.Constant(2*time.Second)),
-	).DoWithContext(ctx, func(r *roko.Retrier) error {
+	err := b.retry(ctx, b.retryPolicy(b.PluginCloneRetries), "Plugin clone", func() error {
 		return b.shell.Run(ctx, "git", args...)
 	})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Switch to the version if we need to
 	if p.Version != "" {
 		b.shell.Commentf("Checking out `%s`", p.Version)
-		if err = b.shell.Run(ctx, "git", "checkout", "-f", p.Version); err != nil {
-			return nil, err
+		if err := b.shell.Run(ctx, "git", "checkout", "-f", p.Version); err != nil {
+			return err
 		}
 	}
 
-	b.shell.Commentf("Moving temporary plugin directory to final location")
-	err = os.Rename(tempDir, pluginDirectory)
-	if err != nil {
-		return nil, err
-	}
-
-	return checkout, nil
+	return nil
 }
 
-func (b *Bootstrap) removeCheckoutDir() error {
+func (b *Bootstrap) removeCheckoutDir(ctx context.Context) error {
 	checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
 
 	// on windows, sometimes removing large dirs can fail for various reasons
@@ -956,7 +1258,13 @@ func (b *Bootstrap) removeCheckoutDir() error {
 	// see https://github.com/golang/go/issues/20841
 	for i := 0; i < 10; i++ {
 		b.shell.Commentf("Removing %s", checkoutPath)
-		if err := os.RemoveAll(checkoutPath); err != nil {
+		err := os.RemoveAll(checkoutPath)
+		if err != nil && b.Rootless {
+			// Rootless containers can leave files the user doesn't own
+			b.shell.Commentf("Removing %s in a user namespace", checkoutPath)
+			err = b.removeAllInUserNamespace(ctx, checkoutPath)
+		}
+		if err != nil {
 			b.shell.Errorf("Failed to remove \"%s\" (%s)", checkoutPath, err)
 		} else {
 			if _, err := os.Stat(checkoutPath); os.IsNotExist(err) {
@@ -977,12 +1285,16 @@ func (b *Bootstrap) createCheckoutDir() error {
 
 	if !utils.FileExists(checkoutPath) {
 		b.shell.Commentf("Creating \"%s\"", checkoutPath)
-		// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
-		if err := os.MkdirAll(checkoutPath, 0777); err != nil {
+		// Actual file permissions will be reduced by umask
+		if err := os.MkdirAll(checkoutPath, b.directoryMode()); err != nil {
 			return err
 		}
 	}
 
+	if err := b.labelBuildDir(checkoutPath); err != nil {
+		return err
+	}
+
 	if b.shell.Getwd() != checkoutPath {
 		if err := b.shell.Chdir(checkoutPath); err != nil {
 			return err
@@ -1010,7 +1322,7 @@ func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
 	// Remove the checkout directory if BUILDKITE_CLEAN_CHECKOUT is present
 	if b.CleanCheckout {
 		b.shell.Headerf("Cleaning pipeline checkout")
-		if err = b.removeCheckoutDir(); err != nil {
+		if err = b.removeCheckoutDir(ctx); err != nil {
 			return err
 		}
 	}
@@ -1030,6 +1342,11 @@ func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
 		b.cleanupDirs = append(b.cleanupDirs, buildDir)
 	}
 
+	// Mount an ephemeral encrypted volume or tmpfs over the build directory if required
+	if err = b.mountBuildDir(ctx); err != nil {
+		return err
+	}
+
 	// Make sure the build directory exists
 	if err := b.createCheckoutDir(); err != nil {
 		return err
@@ -1046,11 +1363,13 @@ func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
 			return err
 		}
 	default:
+		if err := b.verifyHookNotMissing("global", "checkout"); err != nil {
+			return err
+		}
 		if b.Config.Repository != "" {
-			err := roko.NewRetrier(
-				roko.WithMaxAttempts(3),
-				roko.WithStrategy(roko.Constant(2*time.Second)),
-			).DoWithContext(ctx, func(r *roko.Retrier) error {
+			stopTiming := b.startTimings.track(StartTimingClone)
+			policy := b.retryPolicy(b.CheckoutRetries)
+			err := policy.retrier().DoWithContext(ctx, func(r *roko.Retrier) error {
 				err := b.defaultCheckoutPhase(ctx)
 				if err == nil {
 					return nil
@@ -1065,6 +1384,10 @@ func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
 					b.shell.Warningf("Checkout was cancelled")
 					r.Break()
 
+				case !policy.retryable(err):
+					b.shell.Warningf("Checkout failed! %s (not retrying, as it didn't fail with an exit status that's retried)", err)
+					r.Break()
+
 				default:
 					b.shell.Warningf("Checkout failed! %s (%s)", err, r)
 
@@ -1087,7 +1410,7 @@ func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
 					// This removes the checkout dir, which means the next checkout
 					// will be a lot slower (clone vs fetch), but hopefully will
 					// allow the agent to self-heal
-					_ = b.removeCheckoutDir()
+					_ = b.removeCheckoutDir(ctx)
 
 					// Now make sure the build directory exists again before we try
 					// to checkout again, or proceed and run hooks which presume the
@@ -1100,6 +1423,7 @@ func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
 
 				return err
 			})
+			stopTiming()
 			if err != nil {
 				return err
 			}
@@ -1137,6 +1461,14 @@ func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
 		}
 	}
 
+	if err := b.scanCheckoutForSecrets(ctx); err != nil {
+		return err
+	}
+
+	if err := b.runPolicyScanner(ctx); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -1167,8 +1499,8 @@ func (b *Bootstrap) updateGitMirror(ctx context.Context, repository string) (str
 	// Create the mirrors path if it doesn't exist
 	if baseDir := filepath.Dir(mirrorDir); !utils.FileExists(baseDir) {
 		b.shell.Commentf("Creating \"%s\"", baseDir)
-		// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
-		if err := os.MkdirAll(baseDir, 0777); err != nil {
+		// Actual file permissions will be reduced by umask
+		if err := os.MkdirAll(baseDir, b.directoryMode()); err != nil {
 			return "", err
 		}
 	}
@@ -1288,15 +1620,19 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 	var err error
 	defer func() { span.FinishWithError(err) }()
 
-	if b.SSHKeyscan {
-		addRepositoryHostToSSHKnownHosts(ctx, b.shell, b.Repository)
+	if err = b.keyscanRepositoryHost(ctx, b.Repository); err != nil {
+		return err
 	}
 
 	var mirrorDir string
 
 	// If we can, get a mirror of the git repository to use for reference later
-	if experiments.IsEnabled(`git-mirrors`) && b.Config.GitMirrorsPath != "" && b.Config.Repository != "" {
-		b.shell.Commentf("Using git-mirrors experiment 🧪")
+	if b.usingGitMirrors() && b.Config.Repository != "" {
+		if b.GitCheckoutStrategy == CheckoutStrategyMirror {
+			b.shell.Commentf("Cloning with reference to a mirror of the repository")
+		} else {
+			b.shell.Commentf("Using git-mirrors experiment 🧪")
+		}
 		span.AddAttributes(map[string]string{"checkout.is_using_git_mirrors": "true"})
 		mirrorDir, err = b.getOrUpdateMirrorDir(ctx, b.Repository)
 		if err != nil {
@@ -1311,9 +1647,26 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		return err
 	}
 
-	gitCloneFlags := b.GitCloneFlags
-	if mirrorDir != "" {
-		gitCloneFlags += fmt.Sprintf(" --reference %q", mirrorDir)
+	// With Git LFS, files aren't downloaded as they're checked out, they're
+	// all pulled once the checkout's done
+	restoreGitLFSSmudge := func() {}
+	if b.GitLFS {
+		if restoreGitLFSSmudge, err = b.skipGitLFSSmudge(ctx); err != nil {
+			return err
+		}
+		defer restoreGitLFSSmudge()
+	}
+
+	gitCloneFlags, gitFetchFlags := b.checkoutGitFlags(mirrorDir)
+
+	// Line endings and long paths are set as the repository's cloned, so
+	// they apply to the files it first checks out too
+	checkoutConfig, err := b.gitCheckoutConfig()
+	if err != nil {
+		return err
+	}
+	for _, c := range checkoutConfig {
+		gitCloneFlags += " --config " + c
 	}
 
 	// Does the git directory exist?
@@ -1341,7 +1694,13 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		return err
 	}
 
-	gitFetchFlags := b.GitFetchFlags
+	if err := b.sparseCheckout(ctx); err != nil {
+		return err
+	}
+
+	if err := b.applyGitCheckoutConfig(ctx, checkoutConfig); err != nil {
+		return err
+	}
 
 	// If a refspec is provided then use it instead.
 	// For example, `refs/not/a/head`
@@ -1402,6 +1761,16 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		}
 	}
 
+	if b.GitLFS {
+		restoreGitLFSSmudge()
+		if err := b.installGitLFS(ctx); err != nil {
+			return err
+		}
+		if err := b.pullGitLFS(ctx); err != nil {
+			return err
+		}
+	}
+
 	var gitSubmodules bool
 	if !b.GitSubmodules && hasGitSubmodules(b.shell) {
 		b.shell.Warningf("This repository has submodules, but submodules are disabled at an agent level")
@@ -1424,17 +1793,25 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		for _, config := range b.GitSubmoduleCloneConfig {
 			args = append(args, "-c", config)
 		}
+		// Submodules on other hosts are cloned with their own SSH settings
+		restoreSubmoduleSSH, err := b.withSubmoduleSSH()
+		if err != nil {
+			return err
+		}
+		defer restoreSubmoduleSSH()
+
 		// Checking for submodule repositories
 		submoduleRepos, err := gitEnumerateSubmoduleURLs(ctx, b.shell)
 		if err != nil {
 			b.shell.Warningf("Failed to enumerate git submodules: %v", err)
 		} else {
-			mirrorSubmodules := experiments.IsEnabled(`git-mirrors`) && b.Config.GitMirrorsPath != ""
+			mirrorSubmodules := b.usingGitMirrors()
 			for _, repository := range submoduleRepos {
+				repository = resolveSubmoduleURL(b.Repository, repository)
 				submoduleArgs := append([]string(nil), args...)
 				// submodules might need their fingerprints verified too
-				if b.SSHKeyscan {
-					addRepositoryHostToSSHKnownHosts(ctx, b.shell, repository)
+				if err := b.keyscanRepositoryHost(ctx, repository); err != nil {
+					return err
 				}
 				if mirrorSubmodules {
 					mirrorDir, err := b.getOrUpdateMirrorDir(ctx, repository)
@@ -1491,7 +1868,10 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		}
 	}
 
-	if _, hasToken := b.shell.Env.Get("BUILDKITE_AGENT_ACCESS_TOKEN"); !hasToken {
+	// Without a token, the agent can send it for us through the job API
+	_, hasToken := b.shell.Env.Get("BUILDKITE_AGENT_ACCESS_TOKEN")
+	_, hasJobAPI := b.shell.Env.Get("BUILDKITE_AGENT_JOB_API_SOCKET")
+	if !hasToken && !hasJobAPI {
 		b.shell.Warningf("Skipping sending Git information to Buildkite as $BUILDKITE_AGENT_ACCESS_TOKEN is missing")
 		return nil
 	}
@@ -1561,6 +1941,12 @@ func (b *Bootstrap) runPreCommandHooks(ctx context.Context) error {
 
 // runCommand runs the command and adds tracing spans.
 func (b *Bootstrap) runCommand(ctx context.Context) error {
+	b.startTimings.commandStarted()
+
+	// However it's run, the job's command is limited by the job's timeout,
+	// rather than each command's
+	ctx = shell.WithCommandTimeout(ctx, 0)
+
 	var err error
 	// There can only be one command hook, so we check them in order of plugin, local
 	switch {
@@ -1571,6 +1957,12 @@ func (b *Bootstrap) runCommand(ctx context.Context) error {
 	case b.hasGlobalHook("command"):
 		err = b.executeGlobalHook(ctx, "command")
 	default:
+		if err = b.verifyHookNotMissing("global", "command"); err != nil {
+			return err
+		}
+		if err = b.verifyHookNotMissing("local", "command"); err != nil {
+			return err
+		}
 		err = b.defaultCommandPhase(ctx)
 	}
 	return err
@@ -1600,13 +1992,25 @@ func (b *Bootstrap) CommandPhase(ctx context.Context) (error, error) {
 	span, ctx := tracetools.StartSpanFromContext(ctx, "command", b.Config.TracingBackend)
 	var err error
 	defer func() { span.FinishWithError(err) }()
+
+	// Boot the device the command tests on, if any, so the hooks can use it too
+	if err := b.bootDevice(ctx); err != nil {
+		return err, nil
+	}
+	defer b.shutdownDevice()
+
 	// Run pre-command hooks
 	if err := b.runPreCommandHooks(ctx); err != nil {
 		return err, nil
 	}
 
-	// Run the actual command
+	// Run the actual command, recording the screen if it's a UI test
+	recorder := b.startScreenRecording(ctx)
 	commandExitError := b.runCommand(ctx)
+	b.finishScreenRecording(ctx, recorder, commandExitError != nil)
+	if commandExitError != nil {
+		b.uploadDeviceLogs(ctx)
+	}
 	var realCommandError error
 
 	// If the command returned an exit that wasn't a `exec.ExitError`
@@ -1689,9 +2093,19 @@ func (b *Bootstrap) defaultCommandPhase(ctx context.Context) error {
 		return fmt.Errorf("No shell set for bootstrap")
 	}
 
+	// A step's list of commands can be run separately, rather than as one
+	// script, so each is timed and has an exit status of its own
+	isCmdExe := strings.ToUpper(filepath.Base(shell[0])) == "CMD.EXE"
+	if b.SeparateCommands && !commandIsScript && !isCmdExe {
+		if commands := splitCommands(b.Command); len(commands) > 1 {
+			err = b.runSeparateCommands(ctx, shell, commands)
+			return err
+		}
+	}
+
 	// Windows CMD.EXE is horrible and can't handle newline delimited commands. We write
 	// a batch script so that it works, but we don't like it
-	if strings.ToUpper(filepath.Base(shell[0])) == "CMD.EXE" {
+	if isCmdExe {
 		batchScript, err := b.writeBatchScript(b.Command)
 		if err != nil {
 			return err
@@ -1750,6 +2164,17 @@ func (b *Bootstrap) defaultCommandPhase(ctx context.Context) error {
 	} else {
 		b.shell.Headerf("Running commands")
 		cmdToExec = b.Command
+
+		// The command can be run through a shim, so it has the same shell
+		// options and locale whichever shell and bash version the agent has
+		if b.CommandShim && isPosixShell(shell) {
+			shimmed, removeShim, err := b.shimCommand(b.Command)
+			if err != nil {
+				return err
+			}
+			defer removeShim()
+			cmdToExec = shimmed
+		}
 	}
 
 	// Support deprecated BUILDKITE_DOCKER* env vars
@@ -1777,11 +2202,20 @@ func (b *Bootstrap) defaultCommandPhase(ctx context.Context) error {
 
 	if b.Debug {
 		b.shell.Promptf("%s", process.FormatCommand(cmd[0], cmd[1:]))
+	} else if b.CommandShim && !commandIsScript {
+		b.shell.Promptf("%s", b.Command)
 	} else {
 		b.shell.Promptf("%s", cmdToExec)
 	}
 
+	if b.Interactive {
+		err = b.shell.RunInteractive(ctx, cmd[0], cmd[1:]...)
+		return err
+	}
+
+	restoreSource := b.setOutputSource("command")
 	err = b.shell.RunWithoutPrompt(ctx, cmd[0], cmd[1:]...)
+	restoreSource()
 	return err
 }
 
@@ -1877,11 +2311,21 @@ func (b *Bootstrap) artifactPhase(ctx context.Context) error {
 		return err
 	}
 
+	// Scan the artifacts before they're uploaded, so any secrets don't leak
+	err = b.scanArtifactsForSecrets(ctx)
+	if err != nil {
+		return err
+	}
+
 	err = b.uploadArtifacts(ctx)
 	if err != nil {
 		return err
 	}
 
+	if b.ArtifactPreviews {
+		b.uploadArtifactPreviews(ctx)
+	}
+
 	err = b.postArtifactHooks(ctx)
 	if err != nil {
 		return err
@@ -1925,7 +2369,10 @@ func (b *Bootstrap) uploadArtifacts(ctx context.Context) error {
 		args = append(args, b.ArtifactUploadDestination)
 	}
 
-	if err = b.shell.Run(ctx, "buildkite-agent", args...); err != nil {
+	err = b.retry(ctx, b.retryPolicy(b.ArtifactUploadRetries), "Artifact upload", func() error {
+		return b.shell.Run(ctx, "buildkite-agent", args...)
+	})
+	if err != nil {
 		return err
 	}
 
@@ -2007,6 +2454,13 @@ func (b *Bootstrap) setupRedactors() redaction.RedactorMux {
 			shellLoggerRedactor = redactor
 		}
 	}
+	var shellJSONLogger *shell.JSONLogger
+	if logger, ok := b.shell.Logger.(*shell.JSONLogger); ok {
+		shellJSONLogger = logger
+		if redactor, ok := logger.Writer.(*redaction.Redactor); ok {
+			shellLoggerRedactor = redactor
+		}
+	}
 	if redactor := shellLoggerRedactor; redactor != nil {
 		redactor.Reset(valuesToRedact)
 		mux = append(mux, redactor)
@@ -2016,6 +2470,10 @@ func (b *Bootstrap) setupRedactors() redaction.RedactorMux {
 		redactor := redaction.NewRedactor(b.shell.Writer, "[REDACTED]", valuesToRedact)
 		shellWriterLogger.Writer = redactor
 		mux = append(mux, redactor)
+	} else if shellJSONLogger != nil {
+		redactor := redaction.NewRedactor(shellJSONLogger.Writer, "[REDACTED]", valuesToRedact)
+		shellJSONLogger.Writer = redactor
+		mux = append(mux, redactor)
 	}
 
 	return mux
@@ -2048,8 +2506,9 @@ func (b *Bootstrap) startKubernetesClient(ctx context.Context, kubernetesClient
 		writer := io.MultiWriter(os.Stdout, kubernetesClient)
 		b.shell.Writer = writer
 		b.shell.Logger = &shell.WriterLogger{
-			Writer: writer,
-			Ansi:   true,
+			Writer:    writer,
+			Ansi:      true,
+			TagLevels: b.Config.LineMetadata,
 		}
 		return nil
 	})
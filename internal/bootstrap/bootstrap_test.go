@@ -4,9 +4,10 @@ import (
 	"context"
 	"testing"
 
-	"github.com/buildkite/agent/v3/bootstrap/shell"
-	"github.com/buildkite/agent/v3/redaction"
-	"github.com/buildkite/agent/v3/tracetools"
+	"github.com/buildkite/agent/v3/internal/agent/plugin"
+	"github.com/buildkite/agent/v3/internal/redaction"
+	"github.com/buildkite/agent/v3/internal/tracetools"
+	"github.com/buildkite/agent/v3/shell"
 	"github.com/opentracing/opentracing-go"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/opentracer"
@@ -120,3 +121,40 @@ func TestStartTracing_Datadog(t *testing.T) {
 	assert.Equal(t, spanImpl.Span, opentracing.SpanFromContext(ctx))
 	stopper()
 }
+
+func TestCheckPluginAllowed(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name            string
+		location        string
+		allowed, denied []string
+		wantErr         bool
+	}{
+		{name: "no lists", location: "example.com/evil/../evil/plugin.git"},
+		{name: "denied", location: "example.com/evil/plugin.git", denied: []string{"example.com/evil/*"}, wantErr: true},
+		{name: "denied with dot segments", location: "example.com/evil/../evil/plugin.git", denied: []string{"example.com/evil/*"}, wantErr: true},
+		{name: "denied with a dot segment", location: "example.com/./evil/plugin.git", denied: []string{"example.com/evil/*"}, wantErr: true},
+		{name: "not denied", location: "example.com/good/plugin.git", denied: []string{"example.com/evil/*"}},
+		{name: "allowed", location: "example.com/good/plugin.git", allowed: []string{"example.com/good/*"}},
+		{name: "allowed with dot segments", location: "example.com/good/../evil/plugin.git", allowed: []string{"example.com/good/*"}, wantErr: true},
+		{name: "not allowed", location: "example.com/evil/plugin.git", allowed: []string{"example.com/good/*"}, wantErr: true},
+		{name: "vendored with an allowlist", location: "./.buildkite/plugins/llamas", allowed: []string{"example.com/good/*"}},
+		{name: "vendored with a denylist", location: "./.buildkite/plugins/llamas", denied: []string{"*"}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p, err := plugin.CreatePlugin(tc.location, nil)
+			if err != nil {
+				t.Fatalf("plugin.CreatePlugin(%q) error = %v", tc.location, err)
+			}
+
+			b := &Bootstrap{Config: Config{AllowedPlugins: tc.allowed, DeniedPlugins: tc.denied}}
+			if err := b.checkPluginAllowed(p); (err != nil) != tc.wantErr {
+				t.Errorf("b.checkPluginAllowed(%q) error = %v, want error %t", tc.location, err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package bootstrap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/agent/v3/internal/lock"
+)
+
+// BuildPathLayoutHashed names checkout directories by queue and a hash of
+// the worker and pipeline, rather than by agent name, organization and
+// pipeline
+const BuildPathLayoutHashed = "hashed"
+
+// hashedCheckoutDir returns a checkout directory, relative to the build
+// path, like default/my-pipeline-0123456789ab. The hash is of the agent's
+// name and spawn index, so each worker has a checkout of its own, and of the
+// organization and pipeline, so it's stable from job to job.
+func hashedCheckoutDir(queue, agentName string, spawnIndex int, org, pipeline string) string {
+	if queue == "" {
+		queue = "default"
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{agentName, strconv.Itoa(spawnIndex), org, pipeline}, "\x00")))
+	return filepath.Join(dirForAgentName(queue), dirForRepository(pipeline)+"-"+hex.EncodeToString(sum[:6]))
+}
+
+// CheckoutDir returns the directory a job is checked out in, relative to the
+// build path, for the build path layout. The agent uses it to find the
+// directory while the bootstrap's running the job.
+func CheckoutDir(layout, queue, agentName string, spawnIndex int, org, pipeline string) string {
+	if layout == BuildPathLayoutHashed {
+		return hashedCheckoutDir(queue, agentName, spawnIndex, org, pipeline)
+	}
+	return filepath.Join(dirForAgentName(agentName), org, pipeline)
+}
+
+// checkoutDir returns the checkout directory for the job, relative to the
+// build path
+func (b *Bootstrap) checkoutDir() string {
+	queue, _ := b.shell.Env.Get("BUILDKITE_AGENT_META_DATA_QUEUE")
+	return CheckoutDir(b.BuildPathLayout, queue, b.AgentName, b.SpawnIndex, b.OrganizationSlug, b.PipelineSlug)
+}
+
+// directoryMode is the permissions the bootstrap makes directories with,
+// before the umask is applied
+func (b *Bootstrap) directoryMode() os.FileMode {
+	if b.Config.DirectoryMode != 0 {
+		return b.Config.DirectoryMode
+	}
+	return 0777
+}
+
+// lockCheckoutDir locks the checkout directory for as long as the job runs,
+// refusing to run the job if another holds it. The lock's released when the
+// bootstrap exits, even if it's killed, so a held lock means another job is
+// still running there.
+func (b *Bootstrap) lockCheckoutDir() error {
+	checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
+	if checkoutPath == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(checkoutPath), b.directoryMode()); err != nil {
+		return err
+	}
+
+	l, err := lock.TryAcquire(checkoutPath+".lock", lock.Exclusive)
+	if errors.Is(err, lock.ErrLocked) {
+		return fmt.Errorf("Another job on this host is still using %s, so this one can't run there until it finishes", checkoutPath)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to lock %s: %w", checkoutPath, err)
+	}
+	b.checkoutLock = l
+	return nil
+}
+
+// unlockCheckoutDir releases the lock taken by lockCheckoutDir, if any
+func (b *Bootstrap) unlockCheckoutDir() {
+	if b.checkoutLock == nil {
+		return
+	}
+	if err := b.checkoutLock.Unlock(); err != nil {
+		b.shell.Warningf("Failed to unlock the checkout directory: %v", err)
+	}
+	b.checkoutLock = nil
+}
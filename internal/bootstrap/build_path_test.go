@@ -0,0 +1,52 @@
+package bootstrap
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashedCheckoutDir(t *testing.T) {
+	t.Parallel()
+
+	dir := hashedCheckoutDir("deploy", "my-agent-1", 1, "acme", "web-app")
+	assert.Equal(t, "deploy", filepath.Dir(dir))
+	assert.Regexp(t, `^web-app-[0-9a-f]{12}$`, filepath.Base(dir))
+
+	// It's stable from job to job
+	assert.Equal(t, dir, hashedCheckoutDir("deploy", "my-agent-1", 1, "acme", "web-app"))
+
+	// But each worker, organization and pipeline has its own
+	assert.NotEqual(t, dir, hashedCheckoutDir("deploy", "my-agent-1", 2, "acme", "web-app"))
+	assert.NotEqual(t, dir, hashedCheckoutDir("deploy", "my-agent-2", 1, "acme", "web-app"))
+	assert.NotEqual(t, dir, hashedCheckoutDir("deploy", "my-agent-1", 1, "other", "web-app"))
+
+	assert.Equal(t, "default", filepath.Dir(hashedCheckoutDir("", "my-agent-1", 1, "acme", "web-app")))
+	assert.Equal(t, "linux-arm64", filepath.Dir(hashedCheckoutDir("linux/arm64", "my-agent-1", 1, "acme", "web-app")))
+}
+
+func TestLockingCheckoutDirRefusesWhileAnotherJobHoldsIt(t *testing.T) {
+	t.Parallel()
+
+	checkoutPath := filepath.Join(t.TempDir(), "my-agent", "acme", "web-app")
+
+	newBootstrap := func() *Bootstrap {
+		sh := shell.NewTestShell(t)
+		sh.Env.Set("BUILDKITE_BUILD_CHECKOUT_PATH", checkoutPath)
+		return &Bootstrap{shell: sh}
+	}
+
+	first, second := newBootstrap(), newBootstrap()
+	require.NoError(t, first.lockCheckoutDir())
+
+	err := second.lockCheckoutDir()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Another job on this host is still using "+checkoutPath)
+
+	first.unlockCheckoutDir()
+	require.NoError(t, second.lockCheckoutDir())
+	second.unlockCheckoutDir()
+}
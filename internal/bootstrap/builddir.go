@@ -0,0 +1,38 @@
+package bootstrap
+
+import (
+	"context"
+
+	"github.com/buildkite/agent/v3/shell"
+)
+
+// buildDirMount is a filesystem mounted over the checkout directory for the
+// lifetime of a single job
+type buildDirMount interface {
+	// Close unmounts the filesystem and releases anything backing it
+	Close(ctx context.Context, sh *shell.Shell)
+}
+
+// mountBuildDir mounts whichever filesystem the agent has been configured to
+// put the checkout directory on, if any
+func (b *Bootstrap) mountBuildDir(ctx context.Context) error {
+	switch {
+	case b.Config.BuildDirEncryption != "":
+		return b.mountEncryptedBuildDir(ctx)
+	case b.Config.BuildDirTmpfs:
+		return b.mountTmpfsBuildDir(ctx)
+	case b.Config.BuildDirOverlayPath != "":
+		return b.mountOverlayBuildDir(ctx)
+	default:
+		return nil
+	}
+}
+
+// closeBuildDirMount unmounts the filesystem mounted by mountBuildDir, if any
+func (b *Bootstrap) closeBuildDirMount(ctx context.Context) {
+	if b.buildDirMount == nil {
+		return
+	}
+	b.buildDirMount.Close(ctx, b.shell)
+	b.buildDirMount = nil
+}
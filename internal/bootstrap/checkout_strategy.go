@@ -0,0 +1,53 @@
+package bootstrap
+
+import (
+	"fmt"
+
+	"github.com/buildkite/agent/v3/internal/experiments"
+)
+
+// How the repository is checked out. A full clone has all of its history, a
+// shallow clone only the last GitShallowDepth commits, and a mirror clone
+// borrows the objects of a mirror in GitMirrorsPath that's shared between
+// jobs and kept up to date, with --reference.
+const (
+	CheckoutStrategyFull    = "full"
+	CheckoutStrategyShallow = "shallow"
+	CheckoutStrategyMirror  = "mirror"
+)
+
+// usingGitMirrors returns whether repositories are cloned with reference to
+// a mirror, with the mirror strategy or the git-mirrors experiment
+func (b *Bootstrap) usingGitMirrors() bool {
+	if b.Config.GitMirrorsPath == "" {
+		return false
+	}
+	return b.GitCheckoutStrategy == CheckoutStrategyMirror || experiments.IsEnabled(`git-mirrors`)
+}
+
+// checkoutGitFlags returns the flags to clone and fetch the repository with
+// for the checkout strategy and sparse checkout
+func (b *Bootstrap) checkoutGitFlags(mirrorDir string) (cloneFlags, fetchFlags string) {
+	cloneFlags, fetchFlags = b.GitCloneFlags, b.GitFetchFlags
+
+	switch {
+	case mirrorDir != "":
+		cloneFlags += fmt.Sprintf(" --reference %q", mirrorDir)
+
+	case b.GitCheckoutStrategy == CheckoutStrategyShallow:
+		depth := b.GitShallowDepth
+		if depth < 1 {
+			depth = 1
+		}
+		cloneFlags += fmt.Sprintf(" --depth %d", depth)
+		fetchFlags += fmt.Sprintf(" --depth %d", depth)
+	}
+
+	// The sparse checkout is set up once it's cloned, so nothing's checked
+	// out until then
+	if len(b.GitSparseCheckoutPaths) > 0 {
+		cloneFlags += " --no-checkout"
+	}
+
+	return cloneFlags, fetchFlags
+}
@@ -0,0 +1,94 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/buildkite/shellwords"
+)
+
+// Shell options are names like pipefail, which are written into the shim as is
+var shellOptionRegexp = regexp.MustCompile(`^[a-z]+$`)
+
+// Locales are names like C.UTF-8 or en_US.UTF-8
+var localeRegexp = regexp.MustCompile(`^[A-Za-z0-9_.@-]+$`)
+
+// commandShim returns a bash script that runs command with the same shell
+// options, IFS and locale whatever the agent's shell and environment are, and
+// that reports the line of the command that failed. The command starts on the
+// line after the shim's own, which is taken off the line that's reported.
+func commandShim(command string, options []string, locale string) (string, error) {
+	lines := []string{
+		"#!/usr/bin/env bash",
+		"# Written by the buildkite-agent to run the step's command",
+	}
+
+	for _, option := range options {
+		if !shellOptionRegexp.MatchString(option) {
+			return "", fmt.Errorf("Invalid shell option %q for the command shim", option)
+		}
+		lines = append(lines, "set -o "+option)
+	}
+	if len(options) > 0 {
+		// So functions and subshells fail the same way as the command
+		lines = append(lines, "set -o errtrace")
+	}
+
+	lines = append(lines, `IFS=$' \t\n'`)
+
+	if locale != "" {
+		if !localeRegexp.MatchString(locale) {
+			return "", fmt.Errorf("Invalid locale %q for the command shim", locale)
+		}
+		lines = append(lines, fmt.Sprintf("export LANG=%s LC_ALL=%s", locale, locale))
+	}
+
+	offset := len(lines) + 1
+	lines = append(lines,
+		fmt.Sprintf(`trap 'echo "The command failed with status $? on line $((LINENO - %d)): $BASH_COMMAND" >&2' ERR`, offset),
+		command,
+	)
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// writeCommandShim writes the command shim for command to a temporary file,
+// returning its path
+func (b *Bootstrap) writeCommandShim(command string) (string, error) {
+	contents, err := commandShim(command, b.CommandShimShellOptions, b.CommandShimLocale)
+	if err != nil {
+		return "", err
+	}
+
+	shimFile, err := shell.TempFileWithExtension("buildkite-command.sh")
+	if err != nil {
+		return "", err
+	}
+	defer shimFile.Close()
+
+	if _, err := shimFile.WriteString(contents); err != nil {
+		os.Remove(shimFile.Name())
+		return "", err
+	}
+	return shimFile.Name(), shimFile.Close()
+}
+
+// shimCommand writes the command shim for command, returning how to run it
+// with the shell and a func to remove it once it's been run
+func (b *Bootstrap) shimCommand(command string) (string, func(), error) {
+	shimPath, err := b.writeCommandShim(command)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to write the command shim: %w", err)
+	}
+	if b.Debug {
+		contents, err := os.ReadFile(shimPath)
+		if err != nil {
+			os.Remove(shimPath)
+			return "", nil, err
+		}
+		b.shell.Commentf("Wrote command shim %s\n%s", shimPath, contents)
+	}
+	return "bash " + shellwords.Quote(shimPath), func() { os.Remove(shimPath) }, nil
+}
@@ -0,0 +1,54 @@
+package bootstrap
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandShim(t *testing.T) {
+	t.Parallel()
+
+	shim, err := commandShim("echo hello", []string{"errexit", "pipefail"}, "C.UTF-8")
+	assert.NoError(t, err)
+	assert.Equal(t, `#!/usr/bin/env bash
+# Written by the buildkite-agent to run the step's command
+set -o errexit
+set -o pipefail
+set -o errtrace
+IFS=$' \t\n'
+export LANG=C.UTF-8 LC_ALL=C.UTF-8
+trap 'echo "The command failed with status $? on line $((LINENO - 8)): $BASH_COMMAND" >&2' ERR
+echo hello
+`, shim)
+
+	_, err = commandShim("echo hello", []string{"errexit; rm -rf /"}, "")
+	assert.Error(t, err)
+
+	_, err = commandShim("echo hello", nil, "C.UTF-8; rm -rf /")
+	assert.Error(t, err)
+}
+
+func TestCommandShimReportsFailingLine(t *testing.T) {
+	t.Parallel()
+
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash isn't installed")
+	}
+
+	shim, err := commandShim("echo first\nfalse | true\necho \"$UNSET_IN_SHIM\"\necho never", []string{"errexit", "nounset", "pipefail"}, "")
+	assert.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "shim.sh")
+	if err := os.WriteFile(path, []byte(shim), 0o600); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", path, err)
+	}
+
+	out, err := exec.Command(bash, path).CombinedOutput()
+	assert.Error(t, err)
+	assert.Equal(t, "first\nThe command failed with status 1 on line 2: true\n", string(out))
+}
@@ -0,0 +1,388 @@
+package bootstrap
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	"log"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/process"
+)
+
+// Config provides the configuration for the Bootstrap. Some of the keys are
+// read from the environment after hooks are run, so we use struct tags to provide
+// that mapping along with some reflection. It's a little bit magical but it's
+// less work to maintain in the long run.
+//
+// To add a new config option that is mapped from an environment variable, add a
+// struct tag, then don't forget to add a corresponding CLI flag over in the
+// clicommand/bootstrap.go(BootstrapConfig) struct, otherwise it won't work.
+
+type Config struct {
+	// The command to run
+	Command string
+
+	// The ID of the job being run
+	JobID string
+
+	// If the bootstrap is in debug mode
+	Debug bool
+
+	// The repository that needs to be cloned
+	Repository string `env:"BUILDKITE_REPO"`
+
+	// The commit being built
+	Commit string
+
+	// The branch of the commit
+	Branch string
+
+	// The tag of the job commit
+	Tag string
+
+	// Optional refspec to override git fetch
+	RefSpec string `env:"BUILDKITE_REFSPEC"`
+
+	// Plugin definition for the job
+	Plugins string
+
+	// Should git submodules be checked out
+	GitSubmodules bool
+
+	// If the commit was part of a pull request, this will container the PR number
+	PullRequest string
+
+	// The provider of the pipeline
+	PipelineProvider string
+
+	// Slug of the current organization
+	OrganizationSlug string
+
+	// Slug of the current pipeline
+	PipelineSlug string
+
+	// Name of the agent running the bootstrap
+	AgentName string
+
+	// Name of the queue the agent belongs to, if tagged
+	Queue string
+
+	// Should the bootstrap remove an existing checkout before running the job
+	CleanCheckout bool `env:"BUILDKITE_CLEAN_CHECKOUT"`
+
+	// Flags to pass to "git checkout" command
+	GitCheckoutFlags string `env:"BUILDKITE_GIT_CHECKOUT_FLAGS"`
+
+	// Flags to pass to "git clone" command
+	GitCloneFlags string `env:"BUILDKITE_GIT_CLONE_FLAGS"`
+
+	// Flags to pass to "git fetch" command
+	GitFetchFlags string `env:"BUILDKITE_GIT_FETCH_FLAGS"`
+
+	// Flags to pass to "git clone" command for mirroring
+	GitCloneMirrorFlags string
+
+	// Flags to pass to "git clean" command
+	GitCleanFlags string `env:"BUILDKITE_GIT_CLEAN_FLAGS"`
+
+	// Config key=value pairs to pass to "git" when submodule init commands are invoked
+	GitSubmoduleCloneConfig []string `env:"BUILDKITE_GIT_SUBMODULE_CLONE_CONFIG" normalize:"list"`
+
+	// host=path pairs of the SSH key to clone submodules from each host with
+	GitSubmoduleSSHKeys []string `env:"BUILDKITE_GIT_SUBMODULE_SSH_KEYS" normalize:"list"`
+
+	// The only paths of the repository to check out, with git sparse-checkout
+	GitSparseCheckoutPaths []string `env:"BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS" normalize:"list"`
+
+	// The core.autocrlf and core.eol to check out the repository with, and
+	// whether to set core.longpaths
+	GitAutoCRLF  string `env:"BUILDKITE_GIT_AUTOCRLF"`
+	GitEOL       string `env:"BUILDKITE_GIT_EOL"`
+	GitLongPaths bool   `env:"BUILDKITE_GIT_LONG_PATHS"`
+
+	// Whether or not to run the hooks/commands in a PTY
+	RunInPty bool
+
+	// Are arbitrary commands allowed to be executed
+	CommandEval bool
+
+	// Are plugins enabled?
+	PluginsEnabled bool
+
+	// Should we always force a fresh clone of plugins, even if we have a local checkout?
+	PluginsAlwaysCloneFresh bool `env:"BUILDKITE_PLUGINS_ALWAYS_CLONE_FRESH"`
+
+	// Whether to validate plugin configuration
+	PluginValidation bool
+
+	// Patterns of the plugin locations that are allowed and denied, as
+	// plugin.Matches matches them
+	AllowedPlugins []string
+	DeniedPlugins  []string
+
+	// Are local hooks enabled?
+	LocalHooksEnabled bool
+
+	// Path where the builds will be run
+	BuildPath string
+
+	// How checkout directories in the build path are named, either by agent
+	// name, organization and pipeline, or "hashed"
+	BuildPathLayout string
+
+	// The index of the agent's worker, when it's spawned more than one
+	SpawnIndex int
+
+	// Whether to mark the start and end of each phase in the job log
+	PhaseMarkers bool
+
+	// Whether to tag each line of the job's output with the stream and
+	// process it's from, for the agent to take out into a separate record
+	LineMetadata bool
+
+	// The format of the bootstrap's output, text or json
+	LogFormat string
+
+	// The umask of the bootstrap, and so of the job's processes and the files
+	// they make, like 0027, or 0 to leave it as it is
+	Umask os.FileMode
+
+	// The permissions the bootstrap makes directories like the build and
+	// plugins directories with, before the umask, or 0 for 0777
+	DirectoryMode os.FileMode
+
+	// The longest each command the bootstrap runs, like git fetch or a hook,
+	// can take before it's killed, or 0 for no limit. The job's command
+	// isn't limited, as the job's timeout is.
+	CommandTimeout time.Duration
+
+	// Whether to run each line of the command on its own, and whether to run
+	// the rest after one fails, "fail-fast" or "continue"
+	SeparateCommands     bool
+	CommandFailurePolicy string
+
+	// Whether to run commands through a bash shim that sets these shell
+	// options, a standard IFS and this locale, and reports the failing line
+	CommandShim             bool
+	CommandShimShellOptions []string
+	CommandShimLocale       string
+
+	// How much longer than the mean, as a percentage, the slowest of a step's
+	// parallel jobs can take before the build is annotated suggesting they're
+	// rebalanced, or 0 to not record how long they take
+	ParallelSkewThreshold int
+
+	// Whether to run the command attached to the terminal the bootstrap was
+	// started from, when a job's being run locally
+	Interactive bool
+
+	// How to encrypt the build directory, if at all. Only "luks" is supported
+	BuildDirEncryption string
+
+	// Size of the encrypted build directory volume, e.g. 10G
+	BuildDirEncryptionSize string
+
+	// Should the build directory be a tmpfs
+	BuildDirTmpfs bool
+
+	// Maximum size of the tmpfs build directory, e.g. 2G
+	BuildDirTmpfsSize string
+
+	// Path where golden checkouts for copy-on-write build directories are stored
+	BuildDirOverlayPath string
+
+	// Seconds before a golden checkout is replaced with a fresh one
+	BuildDirOverlayRefresh int
+
+	// The SELinux label to give the checkout and the job's temporary
+	// directory, if any
+	BuildDirSELinuxLabel string
+
+	// Path where the repository mirrors are stored
+	GitMirrorsPath string
+
+	// Seconds to wait before allowing git mirror clone lock to be acquired
+	GitMirrorsLockTimeout int
+
+	// Skip updating the Git mirror before using it
+	GitMirrorsSkipUpdate bool `env:"BUILDKITE_GIT_MIRRORS_SKIP_UPDATE"`
+
+	// Path to the buildkite-agent binary
+	BinPath string
+
+	// Path to the global hooks
+	HooksPath string
+
+	// Path to the checksums that global and repository hooks must match
+	HookChecksumsPath string
+
+	// Path to the plugins directory
+	PluginsPath string
+
+	// Path to the directory where plugin checkouts shared between jobs are
+	// cached
+	PluginsCachePath string
+
+	// Whether to scan the changes being built and the artifacts for secrets,
+	// and what to do if they're found: "annotate" or "fail"
+	SecretScan string
+
+	// Path to a file of rules to scan for secrets with, as well as the
+	// default ones
+	SecretScanRulesPath string
+
+	// Path to a program to check the changed dependency manifests against
+	// policy with after checkout
+	PolicyScannerPath string
+
+	// Paths to automatically upload as artifacts when the build finishes
+	AutomaticArtifactUploadPaths string `env:"BUILDKITE_ARTIFACT_PATHS"`
+
+	// Whether to annotate the build with thumbnails of the images uploaded,
+	// and links to HTML reports
+	ArtifactPreviews bool `env:"BUILDKITE_ARTIFACT_PREVIEWS"`
+
+	// Whether to give the job a Docker daemon of its own, in a "dind"
+	// container or as a "rootless" dockerd
+	DockerDaemon string
+
+	// The image of the Docker-in-Docker container
+	DockerDaemonImage string
+
+	// Whether the agent's running jobs rootless
+	Rootless bool
+
+	// Whether to start an "xvfb" or "wayland" display for the job
+	VirtualDisplay string `env:"BUILDKITE_VIRTUAL_DISPLAY"`
+
+	// The size of the virtual display, like 1920x1080
+	VirtualDisplaySize string `env:"BUILDKITE_VIRTUAL_DISPLAY_SIZE"`
+
+	// An Android emulator or iOS simulator to boot before the command, like
+	// "android:Pixel_7_API_34" or "ios:iPhone 15"
+	Device string `env:"BUILDKITE_DEVICE"`
+
+	// How many seconds the device gets to boot
+	DeviceBootTimeout int
+
+	// Whether to record a "video" of the screen while the command runs, or
+	// take a "screenshot" when it fails, for jobs that run UI tests
+	ScreenRecording string `env:"BUILDKITE_SCREEN_RECORDING"`
+
+	// Paths to screenshots the command saves, to upload if it fails
+	ScreenshotPaths string `env:"BUILDKITE_SCREENSHOT_PATHS"`
+
+	// Paths to bundle up and upload as an artifact if the job fails
+	FailureBundlePaths string `env:"BUILDKITE_FAILURE_BUNDLE_PATHS"`
+
+	// The most bytes of files to put in the failure bundle
+	FailureBundleMaxSize int64
+
+	// A custom destination to upload artifacts to (for example, s3://...)
+	ArtifactUploadDestination string `env:"BUILDKITE_ARTIFACT_UPLOAD_DESTINATION"`
+
+	// How the repository is checked out: "full", "shallow" or "mirror", and
+	// how many commits a shallow clone has
+	GitCheckoutStrategy string
+	GitShallowDepth     int
+
+	// Whether to pull Git LFS files once the repository's checked out, and
+	// comma separated patterns of the only files to pull, and those not to
+	GitLFS        bool
+	GitLFSInclude string
+	GitLFSExclude string
+
+	// How many times to retry the checkout, cloning a plugin, and uploading
+	// artifacts when they fail, as they often only fail for a moment
+	CheckoutRetries       int
+	PluginCloneRetries    int
+	ArtifactUploadRetries int
+
+	// How to wait before retrying them: constant or exponential backoff from
+	// RetryDelay, up to a second longer with RetryJitter, and only for these
+	// exit statuses if there are any
+	RetryBackoff      string
+	RetryDelay        time.Duration
+	RetryJitter       bool
+	RetryOnExitStatus []int
+
+	// Whether ssh-keyscan is run on ssh hosts before checkout
+	SSHKeyscan bool
+
+	// Whether to fail checkouts from ssh hosts that aren't already in
+	// known_hosts, rather than adding them
+	SSHStrictHostChecking bool
+
+	// The shell used to execute commands
+	Shell string
+
+	// Phases to execute, defaults to all phases
+	Phases []string
+
+	// What signal to use for command cancellation
+	CancelSignal process.Signal
+
+	// How long commands are given to exit after they're cancelled, before
+	// they and any processes they started are killed
+	SignalGracePeriod time.Duration
+
+	// List of environment variable globs to redact from job output
+	RedactedVars []string
+
+	// Backend to use for tracing. If an empty string, no tracing will occur.
+	TracingBackend string
+
+	// Service name to use when reporting traces.
+	TracingServiceName string
+
+	// Path to write how long each part of starting the job took
+	StartTimingsFile string
+}
+
+// ReadFromEnvironment reads configuration from the Environment, returns a map
+// of the env keys that changed and the new values
+func (c *Config) ReadFromEnvironment(environ env.Environment) map[string]string {
+	changed := map[string]string{}
+
+	// Use reflection for the type and values
+	fields := reflect.TypeOf(*c)
+	values := reflect.ValueOf(c).Elem()
+
+	// Iterate over all available fields and read the tag value
+	for i := 0; i < fields.NumField(); i++ {
+		f := fields.Field(i)
+		v := values.Field(i)
+
+		// Find struct fields with env tag
+		if tag := f.Tag.Get("env"); tag != "" && environ.Exists(tag) {
+			newStr, _ := environ.Get(tag)
+
+			switch v.Kind() {
+			case reflect.String:
+				if newStr == v.String() {
+					break
+				}
+				v.SetString(newStr)
+				changed[tag] = newStr
+			case reflect.Bool:
+				newBool, err := strconv.ParseBool(newStr)
+				if err != nil {
+					log.Printf("warning: cannot parse %s=%s as bool, ignoring", tag, newStr)
+					break
+				}
+				if newBool == v.Bool() {
+					break
+				}
+				v.SetBool(newBool)
+				changed[tag] = newStr
+			default:
+				log.Printf("warning: bootstrap.Config.ReadFromEnvironment does not support %v for %s", v.Kind(), tag)
+			}
+		}
+	}
+
+	return changed
+}
@@ -0,0 +1,339 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Where device logs are kept in the checkout until they're uploaded
+	deviceLogsDir = "buildkite-device-logs"
+
+	// How long a device gets to boot, unless the job says otherwise
+	defaultDeviceBootTimeout = 5 * time.Minute
+
+	// How long an emulator gets to shut down before it's killed
+	deviceShutdownTimeout = 30 * time.Second
+)
+
+// device is an Android emulator or iOS simulator that's booted for the
+// command to run tests on
+type device interface {
+	// boot boots the device, returning once it's ready
+	boot(ctx context.Context) error
+
+	// env is the environment that points the job at the device
+	env() map[string]string
+
+	// saveLogs writes the device's logs to files in dir
+	saveLogs(ctx context.Context, dir string) error
+
+	// shutdown shuts the device down and removes anything boot created
+	shutdown(ctx context.Context)
+}
+
+// parseDevice parses a device like "android:Pixel_7_API_34", the name of an
+// Android virtual device, or "ios:iPhone 15" or "ios:iPhone 15,iOS-17-2", a
+// simulator device type and, optionally, its runtime
+func (b *Bootstrap) parseDevice(spec string) (device, error) {
+	platform, name, _ := strings.Cut(spec, ":")
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("invalid device %q, expected one like android:<avd> or ios:<device type>", spec)
+	}
+
+	switch platform {
+	case "android":
+		return &androidEmulator{b: b, avd: name}, nil
+	case "ios":
+		deviceType, runtime, _ := strings.Cut(name, ",")
+		return &iosSimulator{
+			b:          b,
+			name:       "buildkite-" + b.JobID,
+			deviceType: strings.TrimSpace(deviceType),
+			runtime:    strings.TrimSpace(runtime),
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid device %q, expected one like android:<avd> or ios:<device type>", spec)
+	}
+}
+
+// bootDevice boots the device the job's asked for, if any, and points the job
+// at it
+func (b *Bootstrap) bootDevice(ctx context.Context) error {
+	if b.Device == "" {
+		return nil
+	}
+
+	d, err := b.parseDevice(b.Device)
+	if err != nil {
+		return err
+	}
+
+	timeout := defaultDeviceBootTimeout
+	if b.DeviceBootTimeout > 0 {
+		timeout = time.Duration(b.DeviceBootTimeout) * time.Second
+	}
+	bootCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	b.shell.Headerf("Booting %s", b.Device)
+	if err := d.boot(bootCtx); err != nil {
+		d.shutdown(context.Background())
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("Timed out after %v waiting for %s to boot", timeout, b.Device)
+		}
+		return fmt.Errorf("Failed to boot %s: %w", b.Device, err)
+	}
+	b.device = d
+
+	for k, v := range d.env() {
+		b.shell.Commentf("%s=%s", k, v)
+		b.shell.Env.Set(k, v)
+	}
+	return nil
+}
+
+// uploadDeviceLogs uploads the device's logs, so a failure can be looked into
+func (b *Bootstrap) uploadDeviceLogs(ctx context.Context) {
+	if b.device == nil {
+		return
+	}
+
+	b.shell.Headerf("Uploading device logs")
+	dir := filepath.Join(b.shell.Getwd(), deviceLogsDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		b.shell.Warningf("Failed to save the device logs: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	if err := b.device.saveLogs(ctx, dir); err != nil {
+		b.shell.Warningf("Failed to save the device logs: %v", err)
+		return
+	}
+
+	args := []string{"artifact", "upload", deviceLogsDir + "/*"}
+
+	// If blank, the upload destination is buildkite
+	if b.ArtifactUploadDestination != "" {
+		args = append(args, b.ArtifactUploadDestination)
+	}
+	if err := b.shell.Run(ctx, "buildkite-agent", args...); err != nil {
+		b.shell.Warningf("Failed to upload the device logs: %v", err)
+	}
+}
+
+// shutdownDevice shuts down the device booted by bootDevice, if any. It
+// doesn't take a context, so a device is shut down even if the job's been
+// cancelled.
+func (b *Bootstrap) shutdownDevice() {
+	if b.device == nil {
+		return
+	}
+	ctx := context.Background()
+
+	b.shell.Headerf("Shutting down %s", b.Device)
+	b.device.shutdown(ctx)
+	for k := range b.device.env() {
+		b.shell.Env.Remove(k)
+	}
+	b.device = nil
+}
+
+// androidEmulator is an emulator started from an Android virtual device
+type androidEmulator struct {
+	b    *Bootstrap
+	avd  string
+	port int
+	cmd  *exec.Cmd
+	done chan struct{}
+
+	// What the emulator outputs, which is kept out of the job's log
+	log *os.File
+}
+
+func (e *androidEmulator) serial() string {
+	return fmt.Sprintf("emulator-%d", e.port)
+}
+
+// freeEmulatorPort returns the console port of an emulator that isn't
+// running. Each emulator uses its console port and the one after it for adb.
+func freeEmulatorPort() (int, error) {
+	for port := 5554; port < 5682; port += 2 {
+		free := true
+		for _, p := range []int{port, port + 1} {
+			l, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(p))
+			if err != nil {
+				free = false
+				break
+			}
+			l.Close()
+		}
+		if free {
+			return port, nil
+		}
+	}
+	return 0, errors.New("no free emulator ports between 5554 and 5681")
+}
+
+func (e *androidEmulator) boot(ctx context.Context) error {
+	var err error
+	if e.port, err = freeEmulatorPort(); err != nil {
+		return err
+	}
+
+	args := []string{"-avd", e.avd, "-port", strconv.Itoa(e.port),
+		"-no-window", "-no-audio", "-no-boot-anim", "-no-snapshot-save"}
+	e.b.shell.Promptf("emulator %s", strings.Join(args, " "))
+
+	if e.log, err = os.CreateTemp("", "buildkite-emulator-*.log"); err != nil {
+		return err
+	}
+
+	e.cmd = exec.Command("emulator", args...)
+	e.cmd.Env = e.b.shell.Env.ToSlice()
+	e.cmd.Stdout = e.log
+	e.cmd.Stderr = e.log
+	e.cmd.SysProcAttr = backgroundProcessSysProcAttr()
+	if err := e.cmd.Start(); err != nil {
+		e.cmd = nil
+		return err
+	}
+	e.done = make(chan struct{})
+	go func() {
+		_ = e.cmd.Wait()
+		close(e.done)
+	}()
+
+	if err := e.b.shell.Run(ctx, "adb", "-s", e.serial(), "wait-for-device"); err != nil {
+		return err
+	}
+
+	for {
+		booted, _ := e.b.shell.RunAndCapture(ctx, "adb", "-s", e.serial(), "shell", "getprop", "sys.boot_completed")
+		if booted == "1" {
+			e.b.shell.Commentf("%s has booted", e.serial())
+			return nil
+		}
+
+		select {
+		case <-e.done:
+			return errors.New("the emulator exited before it booted")
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func (e *androidEmulator) env() map[string]string {
+	return map[string]string{
+		"ANDROID_SERIAL":            e.serial(),
+		"BUILDKITE_DEVICE_ID":       e.serial(),
+		"BUILDKITE_DEVICE_PLATFORM": "android",
+	}
+}
+
+func (e *androidEmulator) saveLogs(ctx context.Context, dir string) error {
+	if e.log != nil {
+		if output, err := os.ReadFile(e.log.Name()); err == nil {
+			_ = os.WriteFile(filepath.Join(dir, "emulator.log"), output, 0o644)
+		}
+	}
+
+	logcat, err := e.b.shell.RunAndCapture(ctx, "adb", "-s", e.serial(), "logcat", "-d", "-v", "threadtime")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "logcat.txt"), []byte(logcat+"\n"), 0o644)
+}
+
+func (e *androidEmulator) shutdown(ctx context.Context) {
+	if e.log != nil {
+		e.log.Close()
+		os.Remove(e.log.Name())
+		e.log = nil
+	}
+	if e.cmd == nil {
+		return
+	}
+
+	if err := e.b.shell.Run(ctx, "adb", "-s", e.serial(), "emu", "kill"); err != nil {
+		_ = signalBackgroundProcess(e.cmd.Process, false)
+	}
+	select {
+	case <-e.done:
+	case <-time.After(deviceShutdownTimeout):
+		e.b.shell.Warningf("The emulator didn't shut down in %v, killing it", deviceShutdownTimeout)
+		_ = signalBackgroundProcess(e.cmd.Process, true)
+		<-e.done
+	}
+	e.cmd = nil
+}
+
+// iosSimulator is a simulator created for the job, so it starts out clean
+type iosSimulator struct {
+	b          *Bootstrap
+	name       string
+	deviceType string
+	runtime    string
+	udid       string
+}
+
+func (s *iosSimulator) boot(ctx context.Context) error {
+	args := []string{"simctl", "create", s.name, s.deviceType}
+	if s.runtime != "" {
+		args = append(args, s.runtime)
+	}
+
+	udid, err := s.b.shell.RunAndCapture(ctx, "xcrun", args...)
+	if err != nil {
+		return err
+	}
+	s.udid = udid
+	s.b.shell.Commentf("Created simulator %s", s.udid)
+
+	if err := s.b.shell.Run(ctx, "xcrun", "simctl", "boot", s.udid); err != nil {
+		return err
+	}
+
+	// bootstatus waits until the simulator has finished booting
+	return s.b.shell.Run(ctx, "xcrun", "simctl", "bootstatus", s.udid)
+}
+
+func (s *iosSimulator) env() map[string]string {
+	return map[string]string{
+		"BUILDKITE_DEVICE_ID":       s.udid,
+		"BUILDKITE_DEVICE_PLATFORM": "ios",
+	}
+}
+
+func (s *iosSimulator) saveLogs(ctx context.Context, dir string) error {
+	logs, err := s.b.shell.RunAndCapture(ctx, "xcrun", "simctl", "spawn", s.udid, "log", "show", "--style", "compact", "--last", "1h")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "simulator.log"), []byte(logs+"\n"), 0o644)
+}
+
+func (s *iosSimulator) shutdown(ctx context.Context) {
+	if s.udid == "" {
+		return
+	}
+
+	// The simulator's deleted whether or not it shuts down cleanly
+	_ = s.b.shell.Run(ctx, "xcrun", "simctl", "shutdown", s.udid)
+	if err := s.b.shell.Run(ctx, "xcrun", "simctl", "delete", s.udid); err != nil {
+		s.b.shell.Warningf("Failed to delete simulator %s: %v", s.udid, err)
+	}
+	s.udid = ""
+}
@@ -0,0 +1,64 @@
+package bootstrap
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/buildkite/bintest/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDevice(t *testing.T) {
+	t.Parallel()
+
+	b := &Bootstrap{Config: Config{JobID: "my-job"}}
+
+	d, err := b.parseDevice("android:Pixel_7_API_34")
+	require.NoError(t, err)
+	assert.Equal(t, "Pixel_7_API_34", d.(*androidEmulator).avd)
+
+	d, err = b.parseDevice("ios:iPhone 15, iOS-17-2")
+	require.NoError(t, err)
+	sim := d.(*iosSimulator)
+	assert.Equal(t, "buildkite-my-job", sim.name)
+	assert.Equal(t, "iPhone 15", sim.deviceType)
+	assert.Equal(t, "iOS-17-2", sim.runtime)
+
+	for _, spec := range []string{"android:", "ios", "windows-phone:Lumia 950"} {
+		_, err := b.parseDevice(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestBootingAndShuttingDownSimulator(t *testing.T) {
+	t.Parallel()
+
+	xcrun, err := bintest.NewMock("xcrun")
+	require.NoError(t, err)
+	defer xcrun.CheckAndClose(t)
+
+	xcrun.Expect("simctl", "create", "buildkite-my-job", "iPhone 15").AndWriteToStdout("SIM-UDID\n").AndExitWith(0)
+	xcrun.Expect("simctl", "boot", "SIM-UDID").AndExitWith(0)
+	xcrun.Expect("simctl", "bootstatus", "SIM-UDID").AndExitWith(0)
+	xcrun.Expect("simctl", "shutdown", "SIM-UDID").AndExitWith(0)
+	xcrun.Expect("simctl", "delete", "SIM-UDID").AndExitWith(0)
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Set("PATH", filepath.Dir(xcrun.Path))
+
+	b := &Bootstrap{
+		Config: Config{JobID: "my-job", Device: "ios:iPhone 15"},
+		shell:  sh,
+	}
+
+	require.NoError(t, b.bootDevice(context.Background()))
+	id, _ := sh.Env.Get("BUILDKITE_DEVICE_ID")
+	assert.Equal(t, "SIM-UDID", id)
+
+	b.shutdownDevice()
+	assert.Nil(t, b.device)
+	assert.False(t, sh.Env.Exists("BUILDKITE_DEVICE_ID"))
+}
@@ -0,0 +1,194 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/buildkite/agent/v3/process"
+)
+
+const (
+	// The image of the Docker-in-Docker container, unless another's given
+	defaultDockerDaemonImage = "docker:dind"
+
+	// How long a job's Docker daemon gets to start, and to stop before it's
+	// killed
+	dockerDaemonStartTimeout = time.Minute
+	dockerDaemonStopTimeout  = 10 * time.Second
+)
+
+// dockerDaemon is a Docker daemon of the job's own, so it can't see or
+// remove the containers of other jobs on the same host
+type dockerDaemon struct {
+	kind string
+
+	// The directory with the daemon's socket, and for rootless ones, its data
+	dir string
+
+	// The name of the Docker-in-Docker container
+	container string
+
+	// The rootless daemon process
+	cmd  *exec.Cmd
+	done chan struct{}
+
+	// The DOCKER_HOST from before, which the container is removed with
+	previousHost       string
+	previousHostExists bool
+}
+
+func (d *dockerDaemon) host() string {
+	return "unix://" + filepath.Join(d.dir, "docker.sock")
+}
+
+// startDockerDaemon starts the Docker daemon the agent's configured to give
+// each job, if any, and points the job at it with DOCKER_HOST
+func (b *Bootstrap) startDockerDaemon(ctx context.Context) error {
+	if b.DockerDaemon == "" {
+		return nil
+	}
+
+	b.shell.Headerf("Starting a Docker daemon for the job")
+
+	dir, err := os.MkdirTemp("", "buildkite-docker-")
+	if err != nil {
+		return err
+	}
+	d := &dockerDaemon{kind: b.DockerDaemon, dir: dir}
+	d.previousHost, d.previousHostExists = b.shell.Env.Get("DOCKER_HOST")
+	b.dockerDaemon = d
+
+	switch d.kind {
+	case "dind":
+		err = b.startDindContainer(ctx, d)
+	case "rootless":
+		err = b.startRootlessDockerd(d)
+	default:
+		err = fmt.Errorf("unknown Docker daemon %q, expected dind or rootless", d.kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := b.waitForDockerDaemon(ctx, d); err != nil {
+		return err
+	}
+
+	b.shell.Commentf("DOCKER_HOST=%s", d.host())
+	b.shell.Env.Set("DOCKER_HOST", d.host())
+	return nil
+}
+
+// startDindContainer starts a Docker-in-Docker container with its socket in
+// the daemon's directory. The checkout is mounted at the same path, so the
+// job can bind mount it into its containers.
+func (b *Bootstrap) startDindContainer(ctx context.Context, d *dockerDaemon) error {
+	image := b.DockerDaemonImage
+	if image == "" {
+		image = defaultDockerDaemonImage
+	}
+	d.container = "buildkite-docker-" + b.JobID
+
+	args := []string{"run", "--detach", "--privileged", "--name", d.container,
+		"--volume", d.dir + ":/var/run/buildkite-docker"}
+	if checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH"); checkoutPath != "" {
+		args = append(args, "--volume", checkoutPath+":"+checkoutPath)
+	}
+	args = append(args, image, "--host=unix:///var/run/buildkite-docker/docker.sock")
+
+	// The container's started with the agent's daemon, not the job's
+	return b.shell.Run(ctx, "docker", args...)
+}
+
+// startRootlessDockerd starts a rootless dockerd with its socket, data and
+// state all in the daemon's directory
+func (b *Bootstrap) startRootlessDockerd(d *dockerDaemon) error {
+	args := []string{
+		"--host", d.host(),
+		"--data-root", filepath.Join(d.dir, "data"),
+		"--exec-root", filepath.Join(d.dir, "exec"),
+		"--pidfile", filepath.Join(d.dir, "docker.pid"),
+	}
+	b.shell.Promptf("%s", process.FormatCommand("dockerd-rootless.sh", args))
+
+	d.cmd = exec.Command("dockerd-rootless.sh", args...)
+	d.cmd.Env = append(b.shell.Env.ToSlice(), "XDG_RUNTIME_DIR="+d.dir)
+	d.cmd.Stdout = b.shell.Writer
+	d.cmd.Stderr = b.shell.Writer
+	d.cmd.SysProcAttr = backgroundProcessSysProcAttr()
+	if err := d.cmd.Start(); err != nil {
+		d.cmd = nil
+		return fmt.Errorf("Failed to start a rootless Docker daemon: %w", err)
+	}
+
+	d.done = make(chan struct{})
+	go func() {
+		_ = d.cmd.Wait()
+		close(d.done)
+	}()
+	return nil
+}
+
+func (b *Bootstrap) waitForDockerDaemon(ctx context.Context, d *dockerDaemon) error {
+	timeout := time.After(dockerDaemonStartTimeout)
+	for {
+		version, err := b.shell.RunAndCapture(ctx, "docker", "--host", d.host(), "version", "--format", "{{.Server.Version}}")
+		if err == nil {
+			b.shell.Commentf("Docker %s is ready", version)
+			return nil
+		}
+
+		select {
+		case <-d.done:
+			return errors.New("The Docker daemon exited before it was ready")
+		case <-timeout:
+			return fmt.Errorf("Timed out after %v waiting for the Docker daemon to start", dockerDaemonStartTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// stopDockerDaemon stops the job's Docker daemon, and removes it and
+// everything the job created with it
+func (b *Bootstrap) stopDockerDaemon() {
+	d := b.dockerDaemon
+	if d == nil {
+		return
+	}
+	b.dockerDaemon = nil
+	if d.previousHostExists {
+		b.shell.Env.Set("DOCKER_HOST", d.previousHost)
+	} else {
+		b.shell.Env.Remove("DOCKER_HOST")
+	}
+
+	// The job may have been cancelled, but its daemon still needs stopping
+	ctx := context.Background()
+
+	if d.container != "" {
+		if err := b.shell.Run(ctx, "docker", "rm", "--force", "--volumes", d.container); err != nil {
+			b.shell.Warningf("Failed to remove the job's Docker daemon: %v", err)
+		}
+	}
+
+	if d.cmd != nil {
+		_ = signalBackgroundProcess(d.cmd.Process, false)
+		select {
+		case <-d.done:
+		case <-time.After(dockerDaemonStopTimeout):
+			_ = signalBackgroundProcess(d.cmd.Process, true)
+			<-d.done
+		}
+	}
+
+	if err := os.RemoveAll(d.dir); err != nil {
+		b.shell.Warningf("Failed to remove the job's Docker daemon directory: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package bootstrap
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/buildkite/bintest/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartingAndStoppingDindDockerDaemon(t *testing.T) {
+	t.Parallel()
+
+	docker, err := bintest.NewMock("docker")
+	require.NoError(t, err)
+	defer docker.CheckAndClose(t)
+
+	checkoutPath := t.TempDir()
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Set("PATH", filepath.Dir(docker.Path))
+	sh.Env.Set("BUILDKITE_BUILD_CHECKOUT_PATH", checkoutPath)
+	sh.Env.Set("DOCKER_HOST", "tcp://agent-docker:2375")
+
+	b := &Bootstrap{
+		Config: Config{JobID: "my-job", DockerDaemon: "dind", DockerDaemonImage: "docker:24-dind"},
+		shell:  sh,
+	}
+
+	docker.Expect("run", "--detach", "--privileged", "--name", "buildkite-docker-my-job",
+		bintest.MatchAny(), bintest.MatchAny(),
+		"--volume", checkoutPath+":"+checkoutPath,
+		"docker:24-dind", "--host=unix:///var/run/buildkite-docker/docker.sock").AndExitWith(0)
+	docker.Expect("--host", bintest.MatchAny(), "version", "--format", "{{.Server.Version}}").AndWriteToStdout("24.0.7").AndExitWith(0)
+	docker.Expect("rm", "--force", "--volumes", "buildkite-docker-my-job").AndExitWith(0)
+
+	require.NoError(t, b.startDockerDaemon(context.Background()))
+	dir := b.dockerDaemon.dir
+	host, _ := sh.Env.Get("DOCKER_HOST")
+	assert.Equal(t, "unix://"+filepath.Join(dir, "docker.sock"), host)
+
+	b.stopDockerDaemon()
+	host, _ = sh.Env.Get("DOCKER_HOST")
+	assert.Equal(t, "tcp://agent-docker:2375", host)
+	assert.NoDirExists(t, dir)
+}
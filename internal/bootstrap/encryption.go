@@ -0,0 +1,129 @@
+package bootstrap
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/buildkite/agent/v3/shell"
+)
+
+const (
+	// BuildDirEncryptionLUKS places the checkout on a LUKS volume backed by a
+	// sparse loopback file
+	BuildDirEncryptionLUKS = "luks"
+)
+
+// encryptedBuildDir is an ephemeral encrypted filesystem mounted over the
+// checkout directory for the duration of a single job. The key is generated
+// when the volume is created and is only ever held in memory, so once the
+// volume has been closed its contents are unrecoverable.
+type encryptedBuildDir struct {
+	imagePath  string
+	mapperName string
+	mountPath  string
+}
+
+// ValidateBuildDirEncryption returns an error if the given build directory
+// encryption mode isn't supported on this platform
+func ValidateBuildDirEncryption(mode string) error {
+	switch mode {
+	case "":
+		return nil
+	case BuildDirEncryptionLUKS:
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("Build directory encryption %q is only supported on linux", mode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown build directory encryption %q, valid options are: %q", mode, BuildDirEncryptionLUKS)
+	}
+}
+
+// mountEncryptedBuildDir creates a fresh LUKS volume and mounts it at the
+// current checkout path. Anything already in the checkout path is hidden
+// until the volume is unmounted at the end of the job.
+func (b *Bootstrap) mountEncryptedBuildDir(ctx context.Context) error {
+	if err := ValidateBuildDirEncryption(b.Config.BuildDirEncryption); err != nil {
+		return err
+	}
+
+	checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
+
+	name := b.Config.JobID
+	if name == "" {
+		name = fmt.Sprintf("%d", os.Getpid())
+	}
+
+	dir := &encryptedBuildDir{
+		imagePath:  checkoutPath + ".luks",
+		mapperName: "buildkite-" + name,
+		mountPath:  checkoutPath,
+	}
+
+	b.shell.Commentf("Creating %s encrypted volume for %s", b.Config.BuildDirEncryptionSize, checkoutPath)
+
+	if err := os.MkdirAll(checkoutPath, b.directoryMode()); err != nil {
+		return err
+	}
+
+	// Track the volume straight away, so a partially created volume still gets
+	// cleaned up at the end of the job
+	b.buildDirMount = dir
+
+	if err := b.shell.Run(ctx, "truncate", "--size", b.Config.BuildDirEncryptionSize, dir.imagePath); err != nil {
+		return fmt.Errorf("Failed to create encrypted volume image: %w", err)
+	}
+
+	key := make([]byte, 64)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("Failed to generate encryption key: %w", err)
+	}
+
+	if err := b.shell.WithStdin(bytes.NewReader(key)).Run(ctx, "cryptsetup", "luksFormat",
+		"--batch-mode", "--type", "luks2", "--key-file", "-", dir.imagePath); err != nil {
+		return fmt.Errorf("Failed to format encrypted volume: %w", err)
+	}
+
+	if err := b.shell.WithStdin(bytes.NewReader(key)).Run(ctx, "cryptsetup", "open",
+		"--type", "luks2", "--key-file", "-", dir.imagePath, dir.mapperName); err != nil {
+		return fmt.Errorf("Failed to open encrypted volume: %w", err)
+	}
+
+	if err := b.shell.Run(ctx, "mkfs.ext4", "-q", "-m", "0", dir.devicePath()); err != nil {
+		return fmt.Errorf("Failed to create filesystem on encrypted volume: %w", err)
+	}
+
+	if err := b.shell.Run(ctx, "mount", dir.devicePath(), dir.mountPath); err != nil {
+		return fmt.Errorf("Failed to mount encrypted volume: %w", err)
+	}
+
+	return nil
+}
+
+// Close unmounts and destroys the encrypted volume. Failures are reported as
+// warnings, as there's nothing more useful the job can do about them.
+func (d *encryptedBuildDir) Close(ctx context.Context, sh *shell.Shell) {
+	sh.Commentf("Destroying encrypted volume for %s", d.mountPath)
+
+	if err := sh.Run(ctx, "umount", d.mountPath); err != nil {
+		sh.Warningf("Failed to unmount encrypted volume: %v", err)
+	}
+
+	if _, err := os.Stat(d.devicePath()); err == nil {
+		if err := sh.Run(ctx, "cryptsetup", "close", d.mapperName); err != nil {
+			sh.Warningf("Failed to close encrypted volume: %v", err)
+		}
+	}
+
+	if err := os.Remove(d.imagePath); err != nil && !os.IsNotExist(err) {
+		sh.Warningf("Failed to remove encrypted volume image %s: %v", d.imagePath, err)
+	}
+}
+
+func (d *encryptedBuildDir) devicePath() string {
+	return "/dev/mapper/" + d.mapperName
+}
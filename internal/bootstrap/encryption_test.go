@@ -0,0 +1,88 @@
+package bootstrap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/buildkite/bintest/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBuildDirEncryption(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, ValidateBuildDirEncryption(""))
+	assert.Error(t, ValidateBuildDirEncryption("rot13"))
+
+	if runtime.GOOS == "linux" {
+		assert.NoError(t, ValidateBuildDirEncryption("luks"))
+	} else {
+		assert.Error(t, ValidateBuildDirEncryption("luks"))
+	}
+}
+
+func TestMountingAndClosingEncryptedBuildDir(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("build directory encryption is only supported on linux")
+	}
+
+	checkoutPath := filepath.Join(t.TempDir(), "my-pipeline")
+	imagePath := checkoutPath + ".luks"
+
+	var paths []string
+	mock := func(name string) *bintest.Mock {
+		m, err := bintest.NewMock(name)
+		if err != nil {
+			t.Fatalf("bintest.NewMock(%s) error = %v", name, err)
+		}
+		paths = append(paths, filepath.Dir(m.Path))
+		return m
+	}
+
+	truncate := mock("truncate")
+	defer truncate.CheckAndClose(t)
+	cryptsetup := mock("cryptsetup")
+	defer cryptsetup.CheckAndClose(t)
+	mkfs := mock("mkfs.ext4")
+	defer mkfs.CheckAndClose(t)
+	mount := mock("mount")
+	defer mount.CheckAndClose(t)
+	umount := mock("umount")
+	defer umount.CheckAndClose(t)
+
+	truncate.Expect("--size", "1G", imagePath).AndExitWith(0)
+	cryptsetup.Expect("luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "-", imagePath).AndExitWith(0)
+	cryptsetup.Expect("open", "--type", "luks2", "--key-file", "-", imagePath, "buildkite-my-job").AndExitWith(0)
+	mkfs.Expect("-q", "-m", "0", "/dev/mapper/buildkite-my-job").AndExitWith(0)
+	mount.Expect("/dev/mapper/buildkite-my-job", checkoutPath).AndExitWith(0)
+	umount.Expect(checkoutPath).AndExitWith(0)
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Set("PATH", strings.Join(paths, string(os.PathListSeparator)))
+	sh.Env.Set("BUILDKITE_BUILD_CHECKOUT_PATH", checkoutPath)
+
+	b := &Bootstrap{
+		Config: Config{
+			JobID:                  "my-job",
+			BuildDirEncryption:     "luks",
+			BuildDirEncryptionSize: "1G",
+		},
+		shell: sh,
+	}
+
+	if err := b.mountEncryptedBuildDir(context.Background()); err != nil {
+		t.Fatalf("b.mountEncryptedBuildDir(ctx) error = %v", err)
+	}
+
+	assert.DirExists(t, checkoutPath)
+
+	b.closeBuildDirMount(context.Background())
+	assert.Nil(t, b.buildDirMount)
+}
@@ -0,0 +1,186 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	zglob "github.com/mattn/go-zglob"
+)
+
+// filesMatching returns the regular files under dir that match the
+// semicolon separated patterns, relative to dir. A pattern that matches a
+// directory matches everything in it.
+func filesMatching(dir, patterns string) ([]string, error) {
+	seen := map[string]bool{}
+	var files []string
+
+	add := func(path string, info fs.FileInfo) {
+		if !info.Mode().IsRegular() {
+			return
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return
+		}
+		if !seen[rel] {
+			seen[rel] = true
+			files = append(files, rel)
+		}
+	}
+
+	for _, pattern := range strings.Split(patterns, ";") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		matches, err := zglob.Glob(pattern)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+
+		for _, match := range matches {
+			info, err := os.Lstat(match)
+			if err != nil {
+				continue
+			}
+			if !info.IsDir() {
+				add(match, info)
+				continue
+			}
+			err = filepath.Walk(match, func(path string, info fs.FileInfo, err error) error {
+				if err == nil {
+					add(path, info)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// writeFailureBundle writes the files under dir to w as a gzipped tarball,
+// leaving out any that would take the total size of the files over maxSize,
+// and returns the ones that were left out
+func writeFailureBundle(w io.Writer, dir string, files []string, maxSize int64) ([]string, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	var total int64
+	var skipped []string
+	for _, name := range files {
+		path := filepath.Join(dir, name)
+		info, err := os.Lstat(path)
+		if err != nil {
+			skipped = append(skipped, name)
+			continue
+		}
+		if maxSize > 0 && total+info.Size() > maxSize {
+			skipped = append(skipped, name)
+			continue
+		}
+
+		if err := addToFailureBundle(tw, path, filepath.ToSlash(name), info); err != nil {
+			return nil, err
+		}
+		total += info.Size()
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return skipped, gz.Close()
+}
+
+func addToFailureBundle(tw *tar.Writer, path, name string, info fs.FileInfo) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	// Copy exactly the size in the header, in case the file's still being
+	// written to
+	_, err = io.CopyN(tw, f, info.Size())
+	return err
+}
+
+// uploadFailureBundle bundles up the paths of the checkout set with
+// BUILDKITE_FAILURE_BUNDLE_PATHS and uploads them as an artifact, so a
+// failure can be looked into without reproducing it
+func (b *Bootstrap) uploadFailureBundle(ctx context.Context) error {
+	if b.FailureBundlePaths == "" {
+		return nil
+	}
+
+	b.shell.Headerf("Uploading a failure bundle")
+
+	wd := b.shell.Getwd()
+	files, err := filesMatching(wd, b.FailureBundlePaths)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		b.shell.Commentf("No files match %s", b.FailureBundlePaths)
+		return nil
+	}
+
+	name := "failure-bundle-" + b.JobID + ".tar.gz"
+	path := filepath.Join(wd, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	skipped, err := writeFailureBundle(f, wd, files, b.FailureBundleMaxSize)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write the failure bundle: %w", err)
+	}
+
+	b.shell.Commentf("Bundled %d of %d files", len(files)-len(skipped), len(files))
+	if len(skipped) > 0 {
+		b.shell.Warningf("Left %d files out of the failure bundle to keep it under %d bytes",
+			len(skipped), b.FailureBundleMaxSize)
+	}
+
+	args := []string{"artifact", "upload", name}
+
+	// If blank, the upload destination is buildkite
+	if b.ArtifactUploadDestination != "" {
+		args = append(args, b.ArtifactUploadDestination)
+	}
+
+	return b.shell.Run(ctx, "buildkite-agent", args...)
+}
@@ -0,0 +1,65 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailureBundle(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"logs/test.log":         "FAIL: TestLlamas",
+		"logs/nested/debug.log": "alpacas",
+		"tmp/core.1234":         "0123456789",
+		"tmp/other":             "not bundled",
+		"main.go":               "package main",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o644))
+	}
+
+	files, err := filesMatching(dir, "logs; tmp/core.*;missing/**/*")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.FromSlash("logs/nested/debug.log"),
+		filepath.FromSlash("logs/test.log"),
+		filepath.FromSlash("tmp/core.1234"),
+	}, files)
+
+	// The core dump would take the bundle over 30 bytes, so it's left out
+	var buf bytes.Buffer
+	skipped, err := writeFailureBundle(&buf, dir, files, 30)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.FromSlash("tmp/core.1234")}, skipped)
+
+	gz, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+
+	bundled := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		contents, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		bundled[header.Name] = string(contents)
+	}
+	assert.Equal(t, map[string]string{
+		"logs/nested/debug.log": "alpacas",
+		"logs/test.log":         "FAIL: TestLlamas",
+	}, bundled)
+}
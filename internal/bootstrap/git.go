@@ -11,7 +11,7 @@ import (
 	"regexp"
 	"strings"
 
-	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/shell"
 	"github.com/buildkite/shellwords"
 )
 
@@ -31,6 +31,10 @@ type gitError struct {
 	Type int
 }
 
+func (e *gitError) Unwrap() error {
+	return e.error
+}
+
 type shellRunner interface {
 	Run(context.Context, string, ...string) error
 }
@@ -0,0 +1,109 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// gitCheckoutConfigKeys are the git config keys pipelines can set for their
+// checkouts, in the order they're set
+var gitCheckoutConfigKeys = []string{"core.autocrlf", "core.eol", "core.longpaths"}
+
+// gitCheckoutConfig returns the git config, as key=value, that the pipeline
+// has asked for its checkout with BUILDKITE_GIT_AUTOCRLF, BUILDKITE_GIT_EOL
+// and BUILDKITE_GIT_LONG_PATHS. It's set in the checkout itself, so line
+// endings and long paths don't depend on the agent's global git config,
+// which matters most on Windows.
+func (b *Bootstrap) gitCheckoutConfig() ([]string, error) {
+	var config []string
+
+	switch b.GitAutoCRLF {
+	case "":
+	case "true", "false", "input":
+		config = append(config, "core.autocrlf="+b.GitAutoCRLF)
+	default:
+		return nil, fmt.Errorf("Invalid BUILDKITE_GIT_AUTOCRLF %q, expected true, false or input", b.GitAutoCRLF)
+	}
+
+	switch b.GitEOL {
+	case "":
+	case "lf", "crlf", "native":
+		config = append(config, "core.eol="+b.GitEOL)
+	default:
+		return nil, fmt.Errorf("Invalid BUILDKITE_GIT_EOL %q, expected lf, crlf or native", b.GitEOL)
+	}
+
+	if b.GitLongPaths {
+		config = append(config, "core.longpaths=true")
+	}
+
+	return config, nil
+}
+
+// applyGitCheckoutConfig sets the config in an existing checkout, and unsets
+// those it doesn't have that an earlier job set. If the line endings change,
+// the index is removed so every file is checked out again with them.
+func (b *Bootstrap) applyGitCheckoutConfig(ctx context.Context, config []string) error {
+	// Only a checkout with one of them set already needs to be looked at,
+	// which saves running git for the checkouts that don't use them
+	if len(config) == 0 && !gitConfigMentions(filepath.Join(b.shell.Getwd(), ".git", "config"), gitCheckoutConfigKeys) {
+		return nil
+	}
+
+	want := make(map[string]string)
+	for _, c := range config {
+		key, value, _ := strings.Cut(c, "=")
+		want[key] = value
+	}
+
+	lineEndingsChanged := false
+	for _, key := range gitCheckoutConfigKeys {
+		// git config exits with 1 for a key that isn't set
+		current, _ := b.shell.RunAndCapture(ctx, "git", "config", "--local", key)
+		value, ok := want[key]
+		if strings.TrimSpace(current) == value {
+			continue
+		}
+
+		if ok {
+			if err := b.shell.Run(ctx, "git", "config", "--local", key, value); err != nil {
+				return err
+			}
+		} else {
+			if err := b.shell.Run(ctx, "git", "config", "--local", "--unset", key); err != nil {
+				return err
+			}
+		}
+		if key != "core.longpaths" {
+			lineEndingsChanged = true
+		}
+	}
+
+	if lineEndingsChanged {
+		b.shell.Commentf("Line ending config has changed, so every file will be checked out again")
+		if err := os.Remove(filepath.Join(b.shell.Getwd(), ".git", "index")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// gitConfigMentions returns whether a git config file has any of the keys'
+// names in it
+func gitConfigMentions(path string, keys []string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	config := strings.ToLower(string(data))
+	for _, key := range keys {
+		if strings.Contains(config, key[strings.LastIndex(key, ".")+1:]) {
+			return true
+		}
+	}
+	return false
+}
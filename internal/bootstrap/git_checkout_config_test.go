@@ -0,0 +1,40 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitCheckoutConfig(t *testing.T) {
+	t.Parallel()
+
+	b := &Bootstrap{Config: Config{GitAutoCRLF: "input", GitEOL: "lf", GitLongPaths: true}}
+	config, err := b.gitCheckoutConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"core.autocrlf=input", "core.eol=lf", "core.longpaths=true"}, config)
+
+	config, err = (&Bootstrap{}).gitCheckoutConfig()
+	require.NoError(t, err)
+	assert.Empty(t, config)
+
+	_, err = (&Bootstrap{Config: Config{GitAutoCRLF: "yes"}}).gitCheckoutConfig()
+	assert.EqualError(t, err, `Invalid BUILDKITE_GIT_AUTOCRLF "yes", expected true, false or input`)
+
+	_, err = (&Bootstrap{Config: Config{GitEOL: "cr"}}).gitCheckoutConfig()
+	assert.EqualError(t, err, `Invalid BUILDKITE_GIT_EOL "cr", expected lf, crlf or native`)
+}
+
+func TestGitConfigMentions(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config")
+	require.NoError(t, os.WriteFile(path, []byte("[core]\n\tbare = false\n\tautoCRLF = true\n"), 0o600))
+
+	assert.True(t, gitConfigMentions(path, gitCheckoutConfigKeys))
+	assert.False(t, gitConfigMentions(path, []string{"core.longpaths"}))
+	assert.False(t, gitConfigMentions(filepath.Join(t.TempDir(), "missing"), gitCheckoutConfigKeys))
+}
@@ -0,0 +1,63 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+)
+
+// gitLFSPullArgs returns the arguments to pull the repository's Git LFS
+// files with, only those matching include and not exclude if they're given.
+// Both are comma separated lists of paths or patterns, like git lfs expects.
+func gitLFSPullArgs(include, exclude string) []string {
+	args := []string{"lfs", "pull"}
+	if include != "" {
+		args = append(args, "--include", include)
+	}
+	if exclude != "" {
+		args = append(args, "--exclude", exclude)
+	}
+	return args
+}
+
+// skipGitLFSSmudge stops Git LFS from downloading files one at a time as
+// they're checked out, until the returned func is first called. They're
+// pulled all at once afterwards by pullGitLFS instead.
+func (b *Bootstrap) skipGitLFSSmudge(ctx context.Context) (func(), error) {
+	if err := b.shell.Run(ctx, "git", "lfs", "version"); err != nil {
+		return nil, fmt.Errorf("Git LFS is enabled, but it isn't installed: %w", err)
+	}
+
+	previous, hadPrevious := b.shell.Env.Get("GIT_LFS_SKIP_SMUDGE")
+	b.shell.Env.Set("GIT_LFS_SKIP_SMUDGE", "1")
+
+	restored := false
+	return func() {
+		if restored {
+			return
+		}
+		restored = true
+		if hadPrevious {
+			b.shell.Env.Set("GIT_LFS_SKIP_SMUDGE", previous)
+		} else {
+			b.shell.Env.Remove("GIT_LFS_SKIP_SMUDGE")
+		}
+	}, nil
+}
+
+// installGitLFS sets up the Git LFS hooks and filters in the checkout, so
+// git commands run by the job handle LFS files too
+func (b *Bootstrap) installGitLFS(ctx context.Context) error {
+	if err := b.shell.Run(ctx, "git", "lfs", "install", "--local"); err != nil {
+		return fmt.Errorf("Failed to install Git LFS in the checkout: %w", err)
+	}
+	return nil
+}
+
+// pullGitLFS downloads the checked out commit's Git LFS files
+func (b *Bootstrap) pullGitLFS(ctx context.Context) error {
+	b.shell.Commentf("Pulling Git LFS files")
+	if err := b.shell.Run(ctx, "git", gitLFSPullArgs(b.GitLFSInclude, b.GitLFSExclude)...); err != nil {
+		return fmt.Errorf("Failed to pull Git LFS files: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package bootstrap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGitLFSPullArgs(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []string{"lfs", "pull"}, gitLFSPullArgs("", ""))
+	assert.Equal(t, []string{"lfs", "pull", "--include", "assets/**,*.psd"}, gitLFSPullArgs("assets/**,*.psd", ""))
+	assert.Equal(t, []string{"lfs", "pull", "--exclude", "videos/**"}, gitLFSPullArgs("", "videos/**"))
+	assert.Equal(t, []string{"lfs", "pull", "--include", "assets/**", "--exclude", "assets/raw/**"}, gitLFSPullArgs("assets/**", "assets/raw/**"))
+}
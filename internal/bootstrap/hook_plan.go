@@ -0,0 +1,218 @@
+package bootstrap
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/buildkite/agent/v3/internal/agent/plugin"
+	"github.com/buildkite/agent/v3/internal/hook"
+	"github.com/buildkite/agent/v3/internal/utils"
+)
+
+// PlannedHook is a hook that a job would run, in the order they'd be run
+type PlannedHook struct {
+	// The hook, e.g. pre-command
+	Name string `json:"name"`
+
+	// Where the hook comes from: global, local, plugin, or default for the
+	// agent's own checkout and command
+	Scope  string `json:"scope"`
+	Plugin string `json:"plugin,omitempty"`
+
+	Path   string `json:"path,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Anything that would affect whether the hook runs, e.g. that it doesn't
+	// match its recorded checksum
+	Note string `json:"note,omitempty"`
+}
+
+// planCheckout is a plugin's checkout, which may not exist yet
+type planCheckout struct {
+	plugin   *plugin.Plugin
+	hooksDir string
+	missing  bool
+}
+
+// PlanHooks returns the hooks a job would run with the config, in the order
+// the bootstrap would run them, without running anything. Plugins that
+// haven't been checked out yet are included with a note, as their hooks
+// can't be known. The repository's hooks are looked for in checkoutPath.
+func PlanHooks(cfg Config, checkoutPath string) ([]PlannedHook, error) {
+	b := &Bootstrap{Config: cfg}
+	p := &hookPlanner{b: b, checkoutPath: checkoutPath}
+
+	var plugins []*plugin.Plugin
+	if cfg.Plugins != "" {
+		var err error
+		if plugins, err = plugin.CreateFromJSON(cfg.Plugins); err != nil {
+			return nil, fmt.Errorf("Failed to parse a plugin definition: %w", err)
+		}
+	}
+
+	var checkouts, vendored []planCheckout
+	for _, pl := range plugins {
+		c, err := p.pluginCheckout(pl)
+		if err != nil {
+			return nil, err
+		}
+		if pl.Vendored {
+			vendored = append(vendored, c)
+		} else {
+			checkouts = append(checkouts, c)
+		}
+	}
+
+	// Plugins that aren't checked out are noted once, where they'd be
+	for _, c := range append(append([]planCheckout{}, checkouts...), vendored...) {
+		if c.missing {
+			p.add(PlannedHook{
+				Scope:  "plugin",
+				Plugin: c.plugin.Name(),
+				Note:   fmt.Sprintf("not checked out at %s yet, so its hooks aren't known", c.hooksDir),
+			})
+		}
+	}
+
+	// The order of the bootstrap's phases: set up, plugins, checkout,
+	// vendored plugins, command, artifacts, and tear down
+	p.global("environment")
+	p.plugins("environment", checkouts)
+
+	p.global("pre-checkout")
+	p.plugins("pre-checkout", checkouts)
+	p.replaceable("checkout", checkouts, false)
+	p.global("post-checkout")
+	p.local("post-checkout")
+	p.plugins("post-checkout", checkouts)
+
+	p.plugins("environment", vendored)
+	all := append(checkouts, vendored...)
+
+	for _, name := range []string{"pre-command", "command", "post-command", "pre-artifact", "post-artifact", "pre-exit"} {
+		if name == "command" {
+			p.replaceable("command", all, true)
+			continue
+		}
+		p.global(name)
+		p.local(name)
+		p.plugins(name, all)
+	}
+
+	for i := range p.hooks {
+		if (p.hooks[i].Name == "pre-artifact" || p.hooks[i].Name == "post-artifact") && p.hooks[i].Note == "" {
+			p.hooks[i].Note = "only runs if the job has artifact paths"
+		}
+	}
+
+	return p.hooks, nil
+}
+
+type hookPlanner struct {
+	b            *Bootstrap
+	checkoutPath string
+	hooks        []PlannedHook
+}
+
+func (p *hookPlanner) pluginCheckout(pl *plugin.Plugin) (planCheckout, error) {
+	var dir string
+	if pl.Vendored {
+		dir = filepath.Join(p.checkoutPath, pl.Location)
+	} else {
+		id, err := pl.Identifier()
+		if err != nil {
+			return planCheckout{}, err
+		}
+		dir = filepath.Join(p.b.PluginsPath, id)
+	}
+	return planCheckout{
+		plugin:   pl,
+		hooksDir: filepath.Join(dir, "hooks"),
+		missing:  !utils.FileExists(dir),
+	}, nil
+}
+
+func (p *hookPlanner) add(h PlannedHook) {
+	if h.Path != "" {
+		if sum, err := fileSHA256(h.Path); err == nil {
+			h.SHA256 = sum
+		}
+		if h.Note == "" {
+			if err := p.b.verifyHookChecksum(HookConfig{Scope: h.Scope, Name: h.Name, Path: h.Path}); err != nil {
+				h.Note = err.Error()
+			}
+		}
+	}
+	p.hooks = append(p.hooks, h)
+}
+
+func findHookIn(dir, name string) (string, bool) {
+	if dir == "" {
+		return "", false
+	}
+	path, err := hook.Find(dir, name)
+	if err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+func (p *hookPlanner) globalPath(name string) (string, bool) {
+	return findHookIn(p.b.HooksPath, name)
+}
+
+func (p *hookPlanner) localPath(name string) (string, bool) {
+	return findHookIn(filepath.Join(p.checkoutPath, ".buildkite", "hooks"), name)
+}
+
+func (p *hookPlanner) global(name string) {
+	if path, ok := p.globalPath(name); ok {
+		p.add(PlannedHook{Name: name, Scope: "global", Path: path})
+	}
+}
+
+func (p *hookPlanner) local(name string) {
+	path, ok := p.localPath(name)
+	if !ok {
+		return
+	}
+	h := PlannedHook{Name: name, Scope: "local", Path: path}
+	if !p.b.LocalHooksEnabled {
+		h.Note = "local hooks are disabled, so the job would fail here"
+	}
+	p.add(h)
+}
+
+func (p *hookPlanner) plugins(name string, checkouts []planCheckout) bool {
+	found := false
+	for _, c := range checkouts {
+		if c.missing {
+			continue
+		}
+		if path, ok := findHookIn(c.hooksDir, name); ok {
+			p.add(PlannedHook{Name: name, Scope: "plugin", Plugin: c.plugin.Name(), Path: path})
+			found = true
+		}
+	}
+	return found
+}
+
+// replaceable plans hooks that replace the bootstrap's own behaviour, of
+// which only the first to exist runs: plugins', then the repository's (if
+// it can have one), then the global hook
+func (p *hookPlanner) replaceable(name string, checkouts []planCheckout, withLocal bool) {
+	if p.plugins(name, checkouts) {
+		return
+	}
+	if withLocal {
+		if _, ok := p.localPath(name); ok {
+			p.local(name)
+			return
+		}
+	}
+	if _, ok := p.globalPath(name); ok {
+		p.global(name)
+		return
+	}
+	p.hooks = append(p.hooks, PlannedHook{Name: name, Scope: "default", Note: "the agent's built-in " + name})
+}
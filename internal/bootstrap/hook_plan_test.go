@@ -0,0 +1,65 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanHooks(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeHook := func(path string) {
+		t.Helper()
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"), 0755))
+	}
+
+	hooksPath := filepath.Join(dir, "hooks")
+	pluginsPath := filepath.Join(dir, "plugins")
+	checkoutPath := filepath.Join(dir, "checkout")
+
+	writeHook(filepath.Join(hooksPath, "environment"))
+	writeHook(filepath.Join(hooksPath, "command"))
+	writeHook(filepath.Join(hooksPath, "pre-exit"))
+	writeHook(filepath.Join(checkoutPath, ".buildkite", "hooks", "pre-command"))
+	writeHook(filepath.Join(checkoutPath, ".buildkite", "hooks", "command"))
+	writeHook(filepath.Join(pluginsPath, "docker-v5-0-0", "hooks", "command"))
+	writeHook(filepath.Join(pluginsPath, "docker-v5-0-0", "hooks", "pre-exit"))
+	writeHook(filepath.Join(checkoutPath, "my-plugin", "hooks", "pre-command"))
+
+	hooks, err := PlanHooks(Config{
+		HooksPath:         hooksPath,
+		PluginsPath:       pluginsPath,
+		LocalHooksEnabled: true,
+		Plugins:           `[{"docker#v5.0.0":{"image":"alpine"}},"./my-plugin","cache#v1.0.0"]`,
+	}, checkoutPath)
+	require.NoError(t, err)
+
+	var got []string
+	for _, h := range hooks {
+		entry := h.Scope + " " + h.Name
+		if h.Plugin != "" {
+			entry = h.Scope + " " + h.Plugin + " " + h.Name
+		}
+		got = append(got, entry)
+	}
+
+	assert.Equal(t, []string{
+		"plugin cache ",
+		"global environment",
+		"default checkout",
+		"local pre-command",
+		"plugin my-plugin pre-command",
+		"plugin docker command",
+		"global pre-exit",
+		"plugin docker pre-exit",
+	}, got)
+
+	assert.Len(t, hooks[1].SHA256, 64)
+	assert.Contains(t, hooks[0].Note, "not checked out")
+}
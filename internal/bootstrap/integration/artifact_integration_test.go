@@ -1,6 +1,8 @@
 package integration
 
 import (
+	"image"
+	"image/png"
 	"os"
 	"path/filepath"
 	"testing"
@@ -104,3 +106,71 @@ func TestArtifactsUploadAfterCommandHookFails(t *testing.T) {
 
 	tester.CheckMocks(t)
 }
+
+func TestArtifactPreviewsUploadedAfterArtifacts(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	// Write a large and a small image, and a report of a couple of pages, in
+	// the command hook
+	tester.ExpectGlobalHook("command").Once().AndCallFunc(func(c *bintest.Call) {
+		writePNG(t, filepath.Join(c.Dir, "plots", "large.png"), 800, 600)
+		writePNG(t, filepath.Join(c.Dir, "plots", "small.png"), 100, 100)
+		for _, page := range []string{"index.html", "other.html"} {
+			if err := os.MkdirAll(filepath.Join(c.Dir, "report"), 0o700); err != nil {
+				t.Fatalf("os.MkdirAll(report, 0o700) = %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(c.Dir, "report", page), []byte("<p>llamas</p>"), 0o600); err != nil {
+				t.Fatalf("os.WriteFile(%s, <p>llamas</p>, 0o600) = %v", page, err)
+			}
+		}
+		c.Exit(0)
+	})
+
+	agent := tester.MockAgent(t)
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+	agent.
+		Expect("artifact", "upload", "plots/*.png;report/*.html").
+		AndExitWith(0)
+	agent.
+		Expect("artifact", "upload", "buildkite-artifact-previews/plots/large.png.png").
+		AndExitWith(0)
+	agent.
+		Expect("annotate", "--style", "info", "--context", "artifact-previews-1111-1111-1111-1111", bintest.MatchPattern(
+			`(?s)<img src="artifact://buildkite-artifact-previews/plots/large.png.png".*`+
+				`<img src="artifact://plots/small.png".*`+
+				`\[report/index.html\]\(artifact://report/index.html\)`,
+		)).
+		AndExitWith(0)
+
+	tester.RunAndCheck(t, "BUILDKITE_ARTIFACT_PATHS=plots/*.png;report/*.html", "BUILDKITE_ARTIFACT_PREVIEWS=true")
+
+	if _, err := os.Stat(filepath.Join(tester.CheckoutDir(), "buildkite-artifact-previews")); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(buildkite-artifact-previews) error = %v, want the previews to be removed once uploaded", err)
+	}
+}
+
+// writePNG writes a blank PNG image of the size
+func writePNG(t *testing.T, name string, width, height int) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		t.Fatalf("os.MkdirAll(%q, 0o700) = %v", filepath.Dir(name), err)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("os.Create(%q) error = %v", name, err)
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatalf("png.Encode(%q) = %v", name, err)
+	}
+}
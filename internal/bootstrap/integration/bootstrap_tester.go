@@ -18,7 +18,7 @@ import (
 	"testing"
 
 	"github.com/buildkite/agent/v3/env"
-	"github.com/buildkite/agent/v3/experiments"
+	"github.com/buildkite/agent/v3/internal/experiments"
 
 	"github.com/buildkite/bintest/v3"
 )
@@ -183,7 +183,11 @@ func (b *BootstrapTester) MockAgent(t *testing.T) *bintest.Mock {
 	agent.Expect("env", "dump").
 		Min(0).
 		Max(bintest.InfiniteTimes).
-		AndCallFunc(mockEnvAsJSONOnStdout(b))
+		AndCallFunc(mockEnvOnStdout(b))
+	agent.Expect("env", "dump", "--format", "null-delimited").
+		Min(0).
+		Max(bintest.InfiniteTimes).
+		AndCallFunc(mockEnvOnStdout(b))
 
 	return agent
 }
@@ -360,7 +364,7 @@ func (b *BootstrapTester) Close() error {
 	return nil
 }
 
-func mockEnvAsJSONOnStdout(b *BootstrapTester) func(c *bintest.Call) {
+func mockEnvOnStdout(b *BootstrapTester) func(c *bintest.Call) {
 	return func(c *bintest.Call) {
 		envMap := map[string]string{}
 
@@ -374,6 +378,12 @@ func mockEnvAsJSONOnStdout(b *BootstrapTester) func(c *bintest.Call) {
 			envMap[k] = v
 		}
 
+		if len(c.Args) > 2 {
+			c.Stdout.Write(env.Environment(envMap).ToNullDelimited())
+			c.Exit(0)
+			return
+		}
+
 		envJSON, err := json.Marshal(envMap)
 		if err != nil {
 			fmt.Println("Failed to marshal env map in mocked agent call:", err)
@@ -4,13 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync/atomic"
 	"testing"
 
-	"github.com/buildkite/agent/v3/experiments"
+	"github.com/buildkite/agent/v3/internal/experiments"
 	"github.com/buildkite/bintest/v3"
 )
 
@@ -393,6 +394,367 @@ func TestCheckingOutShallowCloneOfLocalGitProject(t *testing.T) {
 	tester.RunAndCheck(t, env...)
 }
 
+func TestCheckingOutWithShallowCheckoutStrategy(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	env := []string{
+		"BUILDKITE_GIT_CHECKOUT_STRATEGY=shallow",
+		"BUILDKITE_GIT_SHALLOW_DEPTH=5",
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLONE_MIRROR_FLAGS=--bare",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// But assert which ones are called. The git-mirrors experiment takes
+	// precedence over the strategy.
+	if experiments.IsEnabled("git-mirrors") {
+		git.ExpectAll([][]any{
+			{"clone", "--mirror", "--bare", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
+			{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, "."},
+			{"clean", "-fdq"},
+			{"fetch", "-v", "--", "origin", "master"},
+			{"checkout", "-f", "FETCH_HEAD"},
+			{"clean", "-fdq"},
+			{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+		})
+	} else {
+		git.ExpectAll([][]any{
+			{"clone", "-v", "--depth", "5", "--", tester.Repo.Path, "."},
+			{"clean", "-fdq"},
+			{"fetch", "-v", "--depth", "5", "--", "origin", "master"},
+			{"checkout", "-f", "FETCH_HEAD"},
+			{"clean", "-fdq"},
+			{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+		})
+	}
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestCheckingOutWithMirrorCheckoutStrategy(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	// The strategy doesn't need the git-mirrors experiment
+	gitMirrorsDir := t.TempDir()
+	env := []string{
+		"BUILDKITE_GIT_CHECKOUT_STRATEGY=mirror",
+		"BUILDKITE_GIT_MIRRORS_PATH=" + gitMirrorsDir,
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLONE_MIRROR_FLAGS=--bare",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// But assert which ones are called
+	git.ExpectAll([][]any{
+		{"clone", "--mirror", "--bare", "--", tester.Repo.Path, matchSubDir(gitMirrorsDir)},
+		{"clone", "-v", "--reference", matchSubDir(gitMirrorsDir), "--", tester.Repo.Path, "."},
+		{"clean", "-fdq"},
+		{"fetch", "-v", "--", "origin", "master"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"clean", "-fdq"},
+		{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+	})
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestCheckingOutWithGitLFS(t *testing.T) {
+	t.Parallel()
+
+	// The mirror is cloned first with the experiment, which isn't what this
+	// is testing
+	if experiments.IsEnabled("git-mirrors") {
+		t.Skip()
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	env := []string{
+		"BUILDKITE_GIT_LFS=true",
+		"BUILDKITE_GIT_LFS_INCLUDE=assets/**",
+		"BUILDKITE_GIT_LFS_EXCLUDE=assets/video/**",
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+	}
+
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatalf("exec.LookPath(git) error = %v", err)
+	}
+
+	// Git LFS mightn't be installed, so its commands are mocked, and the
+	// checkout mustn't download LFS files as it goes
+	passthrough := func(skipSmudge string) func(*bintest.Call) {
+		return func(c *bintest.Call) {
+			if got := c.GetEnv("GIT_LFS_SKIP_SMUDGE"); got != skipSmudge {
+				t.Errorf("git %s: GIT_LFS_SKIP_SMUDGE = %q, want %q", strings.Join(c.Args, " "), got, skipSmudge)
+			}
+			c.Passthrough(realGit)
+		}
+	}
+
+	git := tester.MustMock(t, "git")
+	git.Expect("lfs", "version").AndExitWith(0)
+	git.Expect("clone", "-v", "--", tester.Repo.Path, ".").AndCallFunc(passthrough("1"))
+	git.Expect("clean", "-fdq").Exactly(2).AndCallFunc(func(c *bintest.Call) { c.Passthrough(realGit) })
+	git.Expect("fetch", "-v", "--", "origin", "master").AndCallFunc(passthrough("1"))
+	git.Expect("checkout", "-f", "FETCH_HEAD").AndCallFunc(passthrough("1"))
+	git.Expect("lfs", "install", "--local").AndExitWith(0)
+	git.Expect("lfs", "pull", "--include", "assets/**", "--exclude", "assets/video/**").AndExitWith(0)
+	git.Expect("--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--").AndCallFunc(passthrough(""))
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestCheckingOutWithSparseCheckoutPaths(t *testing.T) {
+	t.Parallel()
+
+	// The mirror is cloned first with the experiment, which isn't what this
+	// is testing
+	if experiments.IsEnabled("git-mirrors") {
+		t.Skip()
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	for _, dir := range []string{"llamas", "alpacas"} {
+		if err := os.Mkdir(filepath.Join(tester.Repo.Path, dir), 0o700); err != nil {
+			t.Fatalf("os.Mkdir(%q) error = %v", dir, err)
+		}
+		path := filepath.Join(dir, dir+".txt")
+		if err := os.WriteFile(filepath.Join(tester.Repo.Path, path), []byte(dir), 0o600); err != nil {
+			t.Fatalf("os.WriteFile(%q) error = %v", path, err)
+		}
+		if err := tester.Repo.Add(path); err != nil {
+			t.Fatalf("tester.Repo.Add(%q) error = %v", path, err)
+		}
+	}
+	if err := tester.Repo.Commit("Add llamas and alpacas"); err != nil {
+		t.Fatalf("tester.Repo.Commit() error = %v", err)
+	}
+
+	env := []string{
+		"BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS=llamas",
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	git.ExpectAll([][]any{
+		{"clone", "-v", "--no-checkout", "--", tester.Repo.Path, "."},
+		{"clean", "-fdq"},
+		{"sparse-checkout", "set", "--", "llamas"},
+		{"fetch", "-v", "--", "origin", "master"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"clean", "-fdq"},
+		{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+	})
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+
+	for path, want := range map[string]bool{
+		"test.txt":            true,
+		"llamas/llamas.txt":   true,
+		"alpacas/alpacas.txt": false,
+	} {
+		_, err := os.Stat(filepath.Join(tester.CheckoutDir(), path))
+		if got := err == nil; got != want {
+			t.Errorf("%s checked out = %t, want %t", path, got, want)
+		}
+	}
+}
+
+func TestCheckingOutWithLineEndingConfig(t *testing.T) {
+	t.Parallel()
+
+	// The mirror is cloned first with the experiment, which isn't what this
+	// is testing
+	if experiments.IsEnabled("git-mirrors") {
+		t.Skip()
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	commitLines(t, tester.Repo)
+
+	env := []string{
+		"BUILDKITE_GIT_AUTOCRLF=true",
+		"BUILDKITE_GIT_LONG_PATHS=true",
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	git.ExpectAll([][]any{
+		{"clone", "-v", "--config", "core.autocrlf=true", "--config", "core.longpaths=true", "--", tester.Repo.Path, "."},
+		{"clean", "-fdq"},
+		{"config", "--local", "core.autocrlf"},
+		{"config", "--local", "core.eol"},
+		{"config", "--local", "core.longpaths"},
+		{"fetch", "-v", "--", "origin", "master"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"clean", "-fdq"},
+		{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+	})
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+
+	checkLines(t, filepath.Join(tester.CheckoutDir(), "lines.txt"), "one\r\ntwo\r\n")
+}
+
+func TestCheckingOutUnsetsLineEndingConfigFromEarlierJobs(t *testing.T) {
+	t.Parallel()
+
+	if experiments.IsEnabled("git-mirrors") {
+		t.Skip()
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	commitLines(t, tester.Repo)
+
+	// An earlier job checked the repository out with CRLF line endings
+	out, err := tester.Repo.Execute("clone", "-v", "--config", "core.autocrlf=true", "--", tester.Repo.Path, tester.CheckoutDir())
+	if err != nil {
+		t.Fatalf("tester.Repo.Execute(clone) error = %v\nout = %s", err, out)
+	}
+	checkLines(t, filepath.Join(tester.CheckoutDir(), "lines.txt"), "one\r\ntwo\r\n")
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+	}
+
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	git.ExpectAll([][]any{
+		{"remote", "set-url", "origin", tester.Repo.Path},
+		{"clean", "-fdq"},
+		{"config", "--local", "core.autocrlf"},
+		{"config", "--local", "--unset", "core.autocrlf"},
+		{"config", "--local", "core.eol"},
+		{"config", "--local", "core.longpaths"},
+		{"fetch", "-v", "--", "origin", "master"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"clean", "-fdq"},
+		{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+	})
+
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+
+	checkLines(t, filepath.Join(tester.CheckoutDir(), "lines.txt"), "one\ntwo\n")
+}
+
+// commitLines commits lines.txt to the repository, with LF line endings
+func commitLines(t *testing.T, repo *gitRepository) {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(repo.Path, "lines.txt"), []byte("one\ntwo\n"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile(lines.txt) error = %v", err)
+	}
+	if err := repo.Add("lines.txt"); err != nil {
+		t.Fatalf("repo.Add(lines.txt) error = %v", err)
+	}
+	if err := repo.Commit("Add lines"); err != nil {
+		t.Fatalf("repo.Commit() error = %v", err)
+	}
+}
+
+func checkLines(t *testing.T, path, want string) {
+	t.Helper()
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q) error = %v", path, err)
+	}
+	if string(got) != want {
+		t.Errorf("os.ReadFile(%q) = %q, want %q", path, got, want)
+	}
+}
+
 func TestCheckingOutSetsCorrectGitMetadataAndSendsItToBuildkite(t *testing.T) {
 	t.Parallel()
 
@@ -628,6 +990,63 @@ func TestCheckoutRetriesOnCloneFailure(t *testing.T) {
 	tester.RunAndCheck(t)
 }
 
+func TestCheckoutIsNotRetriedWithoutCheckoutRetries(t *testing.T) {
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	var cloneCounter int32
+
+	git := tester.MustMock(t, "git").PassthroughToLocalCommand().Before(func(i bintest.Invocation) error {
+		if i.Args[0] == "clone" {
+			if atomic.AddInt32(&cloneCounter, 1) == 1 {
+				return errors.New("Sunspots have caused git clone to fail")
+			}
+		}
+		return nil
+	})
+	git.Expect().AtLeastOnce().WithAnyArguments()
+
+	if err := tester.Run(t, "BUILDKITE_CHECKOUT_RETRIES=0"); err == nil {
+		t.Fatalf("tester.Run(t) = %v, want non-nil error", err)
+	}
+	if got := atomic.LoadInt32(&cloneCounter); got != 1 {
+		t.Errorf("git clone was run %d times, want 1", got)
+	}
+}
+
+func TestCheckoutIsOnlyRetriedOnRetryableExitStatuses(t *testing.T) {
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	var cloneCounter int32
+
+	git := tester.MustMock(t, "git").PassthroughToLocalCommand().Before(func(i bintest.Invocation) error {
+		if i.Args[0] == "clone" {
+			if atomic.AddInt32(&cloneCounter, 1) == 1 {
+				return errors.New("Sunspots have caused git clone to fail")
+			}
+		}
+		return nil
+	})
+	git.Expect().AtLeastOnce().WithAnyArguments()
+
+	if err := tester.Run(t, "BUILDKITE_BOOTSTRAP_RETRY_ON_EXIT_STATUS=128"); err == nil {
+		t.Fatalf("tester.Run(t) = %v, want non-nil error", err)
+	}
+	if !strings.Contains(tester.Output, "not retrying, as it didn't fail with an exit status that's retried") {
+		t.Errorf("tester.Output %q doesn't say the checkout wasn't retried", tester.Output)
+	}
+	if got := atomic.LoadInt32(&cloneCounter); got != 1 {
+		t.Errorf("git clone was run %d times, want 1", got)
+	}
+}
+
 func TestCheckoutDoesNotRetryOnHookFailure(t *testing.T) {
 	tester, err := NewBootstrapTester()
 	if err != nil {
@@ -1,7 +1,10 @@
 package integration
 
 import (
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/buildkite/bintest/v3"
@@ -70,3 +73,54 @@ func TestPreExitHooksRunsAfterCommandFails(t *testing.T) {
 
 	tester.CheckMocks(t)
 }
+
+func TestCommandRunsWithTheJobUmask(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no umask")
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	agent := tester.MockAgent(t)
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+
+	tester.RunAndCheck(t,
+		"BUILDKITE_COMMAND=umask > umask.txt",
+		"BUILDKITE_JOB_UMASK=0027",
+		"BUILDKITE_JOB_DIRECTORY_MODE=0770",
+	)
+
+	got, err := os.ReadFile(filepath.Join(tester.CheckoutDir(), "umask.txt"))
+	if err != nil {
+		t.Fatalf("os.ReadFile(umask.txt) error = %v", err)
+	}
+	if got, want := strings.TrimSpace(string(got)), "0027"; got != want {
+		t.Errorf("the command's umask = %q, want %q", got, want)
+	}
+
+	info, err := os.Stat(filepath.Join(tester.CheckoutDir(), "umask.txt"))
+	if err != nil {
+		t.Fatalf("os.Stat(umask.txt) error = %v", err)
+	}
+	if got, want := info.Mode().Perm(), os.FileMode(0640); got != want {
+		t.Errorf("the command's file's permissions = %v, want %v", got, want)
+	}
+
+	info, err = os.Stat(tester.CheckoutDir())
+	if err != nil {
+		t.Fatalf("os.Stat(tester.CheckoutDir()) error = %v", err)
+	}
+	if got, want := info.Mode().Perm(), os.FileMode(0750); got != want {
+		t.Errorf("the checkout directory's permissions = %v, want %v", got, want)
+	}
+
+	tester.CheckMocks(t)
+}
@@ -3,6 +3,7 @@ package integration
 import (
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -10,7 +11,7 @@ import (
 	"testing"
 	"time"
 
-	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/shell"
 	"github.com/buildkite/bintest/v3"
 )
 
@@ -61,6 +62,45 @@ func TestEnvironmentVariablesPassBetweenHooks(t *testing.T) {
 	tester.RunAndCheck(t, "MY_CUSTOM_ENV=1")
 }
 
+func TestExportedFunctionsAndMultiLineValuesPassBetweenHooks(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("The hooks are bash scripts")
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	for hook, script := range map[string]string{
+		"environment": "#!/bin/bash\n" +
+			"greet() { echo \"hello, $1\"; }\n" +
+			"export -f greet\n" +
+			"export LLAMAS=$'first=\"1\"\\nsecond=\\'2\\''\n",
+		"command": "#!/bin/bash\ngreet llamas\necho \"$LLAMAS\"\n",
+	} {
+		if err := os.WriteFile(filepath.Join(tester.HooksDir, hook), []byte(script), 0700); err != nil {
+			t.Fatalf("os.WriteFile(%q, script, 0700) = %v", hook, err)
+		}
+	}
+
+	git := tester.MustMock(t, "git").PassthroughToLocalCommand()
+	git.Expect().AtLeastOnce().WithAnyArguments()
+
+	tester.RunAndCheck(t)
+
+	// The command runs in a PTY, which ends lines with \r\n
+	output := strings.ReplaceAll(tester.Output, "\r\n", "\n")
+	for _, want := range []string{"hello, llamas", "first=\"1\"\nsecond='2'"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("tester.Output %q doesn't contain %q", tester.Output, want)
+		}
+	}
+}
+
 func TestHooksCanUnsetEnvironmentVariables(t *testing.T) {
 	t.Parallel()
 
@@ -452,6 +492,102 @@ func TestExitCodesPropagateOutFromGlobalHooks(t *testing.T) {
 	}
 }
 
+func TestHooksAreKilledAfterTheCommandTimeout(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("The hooks are bash scripts")
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	// The job's command can take longer than the timeout, and the hook
+	// after it can't
+	for hook, script := range map[string]string{
+		"command":      "#!/bin/bash\nsleep 2\n",
+		"post-command": "#!/bin/bash\nsleep 30\n",
+	} {
+		if err := os.WriteFile(filepath.Join(tester.HooksDir, hook), []byte(script), 0700); err != nil {
+			t.Fatalf("os.WriteFile(%q, script, 0700) = %v", hook, err)
+		}
+	}
+
+	git := tester.MustMock(t, "git").PassthroughToLocalCommand()
+	git.Expect().AtLeastOnce().WithAnyArguments()
+
+	started := time.Now()
+	err = tester.Run(t, "BUILDKITE_COMMAND_PHASE_TIMEOUT=1s")
+	if err == nil {
+		t.Fatalf("tester.Run(t) = %v, want non-nil error", err)
+	}
+	if took := time.Since(started); took > 20*time.Second {
+		t.Errorf("the job took %v, want the post-command hook to have been killed", took)
+	}
+	if !strings.Contains(tester.Output, "was killed after taking longer than 1s") {
+		t.Errorf("tester.Output %q doesn't contain the timeout error", tester.Output)
+	}
+
+	tester.CheckMocks(t)
+}
+
+func TestCancelKillsWhatTheCommandStarted(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The command is a bash script")
+	}
+
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	// Neither the command nor what it starts exit when they're interrupted
+	pidFile := filepath.Join(t.TempDir(), "sleep.pid")
+	command := fmt.Sprintf("trap '' TERM; sleep 30 & echo $! > %s; wait", pidFile)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	started := time.Now()
+	go func() {
+		defer wg.Done()
+		if err := tester.Run(t, "BUILDKITE_COMMAND="+command, "BUILDKITE_SIGNAL_GRACE_PERIOD_SECONDS=1"); err == nil {
+			t.Errorf("tester.Run(t, BUILDKITE_COMMAND=%q) = %v, want non-nil error", command, err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+	tester.Cancel()
+	wg.Wait()
+
+	if took := time.Since(started); took > 20*time.Second {
+		t.Errorf("the job took %v, want the command to have been killed after the grace period", took)
+	}
+
+	pid, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q) error = %v", pidFile, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		// Once it's orphaned, it's left to init to reap
+		stat, err := exec.Command("ps", "-o", "stat=", "-p", strings.TrimSpace(string(pid))).Output()
+		if err != nil || strings.HasPrefix(strings.TrimSpace(string(stat)), "Z") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the command's background process %s is still running after the job was cancelled", pid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
 func TestPreExitHooksFireAfterCancel(t *testing.T) {
 	// TODO: Why is this test skipped on windows and darwin?
 	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
@@ -5,8 +5,8 @@ import (
 	"os"
 	"testing"
 
-	"github.com/buildkite/agent/v3/clicommand"
-	"github.com/buildkite/agent/v3/experiments"
+	"github.com/buildkite/agent/v3/internal/clicommand"
+	"github.com/buildkite/agent/v3/internal/experiments"
 	"github.com/buildkite/agent/v3/version"
 	"github.com/buildkite/bintest/v3"
 	"github.com/urfave/cli"
@@ -10,7 +10,8 @@ import (
 	"strings"
 	"testing"
 
-	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/internal/agent/plugin"
+	"github.com/buildkite/agent/v3/shell"
 	"github.com/buildkite/bintest/v3"
 )
 
@@ -484,6 +485,363 @@ func TestModifiedPluginWithForcePull(t *testing.T) {
 	tester2.RunAndCheck(t, env...)
 }
 
+func TestPluginsPinnedToChecksums(t *testing.T) {
+	t.Parallel()
+
+	hooks := map[string][]string{
+		"environment": {
+			"#!/bin/bash",
+			"export LLAMAS_ROCK=absolutely",
+		},
+	}
+	if runtime.GOOS == "windows" {
+		hooks = map[string][]string{
+			"environment.bat": {
+				"@echo off",
+				"set LLAMAS_ROCK=absolutely",
+			},
+		}
+	}
+
+	p := createTestPlugin(t, hooks)
+	checksum, err := plugin.Checksum(p.Path)
+	if err != nil {
+		t.Fatalf("plugin.Checksum(%q) error = %v", p.Path, err)
+	}
+
+	t.Run("matching checksum", func(t *testing.T) {
+		tester, err := NewBootstrapTester()
+		if err != nil {
+			t.Fatalf("NewBootstrapTester() error = %v", err)
+		}
+		defer tester.Close()
+
+		pinned := &testPlugin{p.gitRepository, strings.TrimSpace(p.versionTag) + "@" + checksum}
+		json, err := pinned.ToJSON()
+		if err != nil {
+			t.Fatalf("testPlugin.ToJSON() error = %v", err)
+		}
+
+		tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+			if err := bintest.ExpectEnv(t, c.Env, "LLAMAS_ROCK=absolutely"); err != nil {
+				fmt.Fprintf(c.Stderr, "%v\n", err)
+				c.Exit(1)
+			} else {
+				c.Exit(0)
+			}
+		})
+
+		tester.RunAndCheck(t, "BUILDKITE_PLUGINS="+json)
+	})
+
+	t.Run("moved version", func(t *testing.T) {
+		tester, err := NewBootstrapTester()
+		if err != nil {
+			t.Fatalf("NewBootstrapTester() error = %v", err)
+		}
+		defer tester.Close()
+
+		// The plugin's version now points at different files, as if its
+		// tag had been moved
+		modifyTestPlugin(t, map[string][]string{"post-command": {"#!/bin/bash", "echo pwned"}}, p)
+		commitHash, err := p.RevParse("HEAD")
+		if err != nil {
+			t.Fatalf(`repo.RevParse("HEAD") error = %v`, err)
+		}
+
+		pinned := &testPlugin{p.gitRepository, strings.TrimSpace(commitHash) + "@" + checksum}
+		json, err := pinned.ToJSON()
+		if err != nil {
+			t.Fatalf("testPlugin.ToJSON() error = %v", err)
+		}
+
+		if err := tester.Run(t, "BUILDKITE_PLUGINS="+json); err == nil {
+			t.Fatalf("tester.Run(t) = %v, want non-nil error", err)
+		}
+		if !strings.Contains(tester.Output, "Refusing to run plugin") {
+			t.Errorf("tester.Output = %q, want it to contain %q", tester.Output, "Refusing to run plugin")
+		}
+
+		tester.CheckMocks(t)
+	})
+}
+
+func TestPluginsAllowedAndDeniedByTheAgent(t *testing.T) {
+	t.Parallel()
+
+	hooks := map[string][]string{
+		"environment": {
+			"#!/bin/bash",
+			"export LLAMAS_ROCK=absolutely",
+		},
+	}
+	if runtime.GOOS == "windows" {
+		hooks = map[string][]string{
+			"environment.bat": {
+				"@echo off",
+				"set LLAMAS_ROCK=absolutely",
+			},
+		}
+	}
+
+	p := createTestPlugin(t, hooks)
+	json, err := p.ToJSON()
+	if err != nil {
+		t.Fatalf("testPlugin.ToJSON() error = %v", err)
+	}
+	location := "/" + strings.TrimPrefix(filepath.ToSlash(p.Path), "/")
+	parent := location[:strings.LastIndex(location, "/")]
+
+	t.Run("allowed", func(t *testing.T) {
+		tester, err := NewBootstrapTester()
+		if err != nil {
+			t.Fatalf("NewBootstrapTester() error = %v", err)
+		}
+		defer tester.Close()
+
+		tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+			if err := bintest.ExpectEnv(t, c.Env, "LLAMAS_ROCK=absolutely"); err != nil {
+				fmt.Fprintf(c.Stderr, "%v\n", err)
+				c.Exit(1)
+			} else {
+				c.Exit(0)
+			}
+		})
+
+		tester.RunAndCheck(t,
+			"BUILDKITE_PLUGINS="+json,
+			"BUILDKITE_ALLOWED_PLUGINS=github.com/buildkite-plugins/*,"+parent+"/*",
+		)
+	})
+
+	for _, tc := range []struct {
+		name string
+		env  []string
+		want string
+	}{
+		{
+			name: "not allowed",
+			env:  []string{"BUILDKITE_ALLOWED_PLUGINS=github.com/buildkite-plugins/*"},
+			want: "isn't allowed on this agent",
+		},
+		{
+			name: "denied",
+			env:  []string{"BUILDKITE_ALLOWED_PLUGINS=" + parent + "/*", "BUILDKITE_DENIED_PLUGINS=" + location},
+			want: "has been denied on this agent",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tester, err := NewBootstrapTester()
+			if err != nil {
+				t.Fatalf("NewBootstrapTester() error = %v", err)
+			}
+			defer tester.Close()
+
+			if err := tester.Run(t, append(tc.env, "BUILDKITE_PLUGINS="+json)...); err == nil {
+				t.Fatalf("tester.Run(t) = %v, want non-nil error", err)
+			}
+			if !strings.Contains(tester.Output, tc.want) {
+				t.Errorf("tester.Output = %q, want it to contain %q", tester.Output, tc.want)
+			}
+
+			tester.CheckMocks(t)
+		})
+	}
+}
+
+func TestPluginsCachedBetweenJobs(t *testing.T) {
+	t.Parallel()
+
+	pluginHooks := func(version string) map[string][]string {
+		if runtime.GOOS == "windows" {
+			return map[string][]string{
+				"environment.bat": {
+					"@echo off",
+					"set PLUGIN_VERSION=" + version,
+				},
+			}
+		}
+		return map[string][]string{
+			"environment": {
+				"#!/bin/bash",
+				"export PLUGIN_VERSION=" + version,
+			},
+		}
+	}
+
+	p := createTestPlugin(t, pluginHooks("one"))
+	if err := p.CreateBranch("cached"); err != nil {
+		t.Fatalf(`repo.CreateBranch("cached") = %v`, err)
+	}
+	p.versionTag = "cached"
+
+	json, err := p.ToJSON()
+	if err != nil {
+		t.Fatalf("testPlugin.ToJSON() error = %v", err)
+	}
+	cacheDir := t.TempDir()
+
+	runJob := func(t *testing.T, wantVersion, wantOutput string) {
+		t.Helper()
+
+		tester, err := NewBootstrapTester()
+		if err != nil {
+			t.Fatalf("NewBootstrapTester() error = %v", err)
+		}
+		defer tester.Close()
+
+		tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+			if err := bintest.ExpectEnv(t, c.Env, "PLUGIN_VERSION="+wantVersion); err != nil {
+				fmt.Fprintf(c.Stderr, "%v\n", err)
+				c.Exit(1)
+			} else {
+				c.Exit(0)
+			}
+		})
+
+		tester.RunAndCheck(t, "BUILDKITE_PLUGINS="+json, "BUILDKITE_PLUGINS_CACHE_PATH="+cacheDir)
+
+		if !strings.Contains(tester.Output, wantOutput) {
+			t.Errorf("tester.Output = %q, want it to contain %q", tester.Output, wantOutput)
+		}
+	}
+
+	// The first job clones the plugin into the cache, and the next uses it
+	runJob(t, "one", "isn't in the plugins cache")
+	runJob(t, "one", "from the plugins cache")
+
+	// Until its branch moves
+	modifyTestPlugin(t, pluginHooks("two"), p)
+	runJob(t, "two", "isn't in the plugins cache")
+	runJob(t, "two", "from the plugins cache")
+
+	entries, err := filepath.Glob(filepath.Join(cacheDir, "*-cached-*"))
+	if err != nil {
+		t.Fatalf("filepath.Glob() error = %v", err)
+	}
+	if got, want := len(entries), 2; got != want {
+		t.Errorf("len(plugins cache entries) = %d, want %d: %v", got, want, entries)
+	}
+}
+
+func TestRunningVendoredPlugins(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	hooks := map[string][]string{
+		"environment": {
+			"#!/bin/bash",
+			"export LLAMAS_MOOD=$BUILDKITE_PLUGIN_LLAMAS_MOOD",
+		},
+	}
+	if runtime.GOOS == "windows" {
+		hooks = map[string][]string{
+			"environment.bat": {
+				"@echo off",
+				"set LLAMAS_MOOD=%BUILDKITE_PLUGIN_LLAMAS_MOOD%",
+			},
+		}
+	}
+	commitVendoredPlugin(t, tester.Repo, ".buildkite/plugins/llamas", hooks)
+
+	// Vendored plugins run from the checkout, without being cloned
+	env := []string{
+		`BUILDKITE_PLUGINS=[{"./.buildkite/plugins/llamas/":{"mood":"happy"}}]`,
+	}
+
+	tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+		if err := bintest.ExpectEnv(t, c.Env, "LLAMAS_MOOD=happy"); err != nil {
+			fmt.Fprintf(c.Stderr, "%v\n", err)
+			c.Exit(1)
+		} else {
+			c.Exit(0)
+		}
+	})
+
+	tester.RunAndCheck(t, env...)
+
+	if entries, _ := os.ReadDir(tester.PluginsDir); len(entries) > 0 {
+		t.Errorf("os.ReadDir(tester.PluginsDir) = %v, want vendored plugins not to be checked out there", entries)
+	}
+}
+
+func TestVendoredPluginsMustBeInTheCheckout(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need extra privileges on Windows")
+	}
+
+	// A plugin elsewhere on the agent
+	outside := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(outside, "hooks"), 0o700); err != nil {
+		t.Fatalf("os.MkdirAll(hooks, 0o700) = %v", err)
+	}
+
+	for _, location := range []string{"./.buildkite/plugins/escape", "../../../.."} {
+		location := location
+		t.Run(location, func(t *testing.T) {
+			t.Parallel()
+
+			tester, err := NewBootstrapTester()
+			if err != nil {
+				t.Fatalf("NewBootstrapTester() error = %v", err)
+			}
+			defer tester.Close()
+
+			// Symlinked to from the repository
+			if err := os.MkdirAll(filepath.Join(tester.Repo.Path, ".buildkite", "plugins"), 0o700); err != nil {
+				t.Fatalf("os.MkdirAll(.buildkite/plugins, 0o700) = %v", err)
+			}
+			if err := os.Symlink(outside, filepath.Join(tester.Repo.Path, ".buildkite", "plugins", "escape")); err != nil {
+				t.Fatalf("os.Symlink() = %v", err)
+			}
+			if err := tester.Repo.Add(".buildkite/plugins/escape"); err != nil {
+				t.Fatalf("tester.Repo.Add(.buildkite/plugins/escape) = %v", err)
+			}
+			if err := tester.Repo.Commit("Add a symlinked plugin"); err != nil {
+				t.Fatalf("tester.Repo.Commit() = %v", err)
+			}
+
+			if err := tester.Run(t, `BUILDKITE_PLUGINS=[{"`+location+`":{}}]`); err == nil {
+				t.Fatalf("tester.Run(BUILDKITE_PLUGINS=[%s]) = %v, want non-nil error", location, err)
+			}
+			if want := "Vendored plugin paths must be within the checked-out repository"; !strings.Contains(tester.Output, want) {
+				t.Errorf("tester.Output = %q, want it to contain %q", tester.Output, want)
+			}
+		})
+	}
+}
+
+// commitVendoredPlugin commits a plugin with the hooks to a directory in the
+// repository
+func commitVendoredPlugin(t *testing.T, repo *gitRepository, dir string, hooks map[string][]string) {
+	t.Helper()
+
+	hooksDir := filepath.Join(repo.Path, filepath.FromSlash(dir), "hooks")
+	if err := os.MkdirAll(hooksDir, 0o700); err != nil {
+		t.Fatalf("os.MkdirAll(%q, 0o700) = %v", hooksDir, err)
+	}
+	for hook, lines := range hooks {
+		data := []byte(strings.Join(lines, "\n"))
+		if err := os.WriteFile(filepath.Join(hooksDir, hook), data, 0o700); err != nil {
+			t.Fatalf("os.WriteFile(%q) = %v", hook, err)
+		}
+	}
+	if err := repo.Add(filepath.Join(repo.Path, filepath.FromSlash(dir))); err != nil {
+		t.Fatalf("repo.Add(%q) = %v", dir, err)
+	}
+	if err := repo.Commit("Add a vendored plugin"); err != nil {
+		t.Fatalf("repo.Commit() = %v", err)
+	}
+}
+
 type testPlugin struct {
 	*gitRepository
 
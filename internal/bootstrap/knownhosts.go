@@ -0,0 +1,299 @@
+package bootstrap
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/shell"
+	homedir "github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type knownHosts struct {
+	Shell *shell.Shell
+	Path  string
+}
+
+func findKnownHosts(sh *shell.Shell) (*knownHosts, error) {
+	userHomePath, err := homedir.Dir()
+	if err != nil {
+		return nil, fmt.Errorf("Could not find the current users home directory (%s)", err)
+	}
+
+	// Construct paths to the known_hosts file
+	sshDirectory := filepath.Join(userHomePath, ".ssh")
+	knownHostPath := filepath.Join(sshDirectory, "known_hosts")
+
+	// Ensure ssh directory exists
+	if err := os.MkdirAll(sshDirectory, 0700); err != nil {
+		return nil, err
+	}
+
+	// Ensure file exists
+	if _, err := os.Stat(knownHostPath); err != nil {
+		f, err := os.OpenFile(knownHostPath, os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("create %q: %w", knownHostPath, err)
+		}
+		if err = f.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &knownHosts{Shell: sh, Path: knownHostPath}, nil
+}
+
+// Contains returns whether the known_hosts file already trusts host, which
+// can have a port, so it doesn't need to be keyscanned
+func (kh *knownHosts) Contains(host string) (bool, error) {
+	file, err := os.Open(kh.Path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	// Hosts on ports other than 22 are written as [host]:port
+	normalized := knownhosts.Normalize(host)
+
+	// The knownhosts package only matches a host along with its key, which we
+	// don't have yet, so lines are matched by host here.
+	//
+	// known_host format is defined at https://man.openbsd.org/sshd#SSH_KNOWN_HOSTS_FILE_FORMAT
+	// A basic example is:
+	// # Comments allowed at start of line
+	// closenet,...,192.0.2.53 1024 37 159...93 closenet.example.net
+	// cvs.example.net,192.0.2.10 ssh-rsa AAAA1234.....=
+	// # A hashed hostname
+	// |1|JfKTdBh7rNbXkVAQCRp4OQoPfmI=|USECr3SWf1JUPsms5AqfD5QfxkM= ssh-rsa
+	// AAAA1234.....=
+	// # A revoked key
+	// @revoked * ssh-rsa AAAAB5W...
+	// # A CA key, accepted for any host in *.mydomain.com or *.mydomain.org
+	// @cert-authority *.mydomain.org,*.mydomain.com ssh-rsa AAAAB5W...
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		// A revoked key doesn't make a host trusted, but a CA key does for
+		// the hosts it's for
+		if strings.HasPrefix(fields[0], "@") {
+			if fields[0] != "@cert-authority" {
+				continue
+			}
+			fields = fields[1:]
+		}
+
+		// Hosts, key type and key, with anything after that a comment
+		if len(fields) < 3 {
+			continue
+		}
+		if knownHostsLineMatches(fields[0], normalized) {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// knownHostsLineMatches returns whether the comma separated host patterns of
+// a known_hosts line match a normalized host. A hashed pattern is matched by
+// hashing the host with its salt, the other patterns can have * and ?
+// wildcards, and a pattern starting with ! stops the line matching the hosts
+// it matches.
+func knownHostsLineMatches(patterns, host string) bool {
+	if strings.HasPrefix(patterns, "|") {
+		return knownHostsHashMatches(patterns, host)
+	}
+
+	var matched bool
+	for _, pattern := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		if !wildcardMatch(strings.ToLower(pattern), strings.ToLower(host)) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// knownHostsHashMatches returns whether a hashed host, written by OpenSSH with
+// HashKnownHosts as |1|base64 salt|base64 HMAC-SHA1 of the host, is host
+func knownHostsHashMatches(hashed, host string) bool {
+	parts := strings.Split(hashed, "|")
+	if len(parts) != 4 || parts[0] != "" || parts[1] != "1" {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// wildcardMatch returns whether s matches pattern, where * matches any run of
+// characters and ? any one character
+func wildcardMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+func (kh *knownHosts) Add(ctx context.Context, host string) error {
+	// Use a lockfile to prevent parallel processes stepping on each other
+	lock, err := kh.Shell.LockFile(ctx, kh.Path+".lock", time.Second*30)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Unlock(); err != nil {
+			kh.Shell.Warningf("Failed to release known_hosts file lock: %#v", err)
+		}
+	}()
+
+	// If the keygen output already contains the host, we can skip!
+	if contains, _ := kh.Contains(host); contains {
+		kh.Shell.Commentf("Host %q already in list of known hosts at \"%s\"", host, kh.Path)
+		return nil
+	}
+
+	// Scan the key and then write it to the known_host file
+	keyscanOutput, err := sshKeyScan(ctx, kh.Shell, host)
+	if err != nil {
+		return fmt.Errorf("Could not  `ssh-keyscan`: %w", err)
+	}
+
+	kh.Shell.Commentf("Added host %q to known hosts at \"%s\"", host, kh.Path)
+
+	// Try and open the existing hostfile in (append_only) mode
+	f, err := os.OpenFile(kh.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Could not open %q for appending: %w", kh.Path, err)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(f, "%s\n", keyscanOutput); err != nil {
+		return fmt.Errorf("Could not write to %q: %w", kh.Path, err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Could not close %q: %w", kh.Path, err)
+	}
+	return nil
+}
+
+// AddFromRepository takes a git repo url, extracts the host and adds it
+func (kh *knownHosts) AddFromRepository(ctx context.Context, repository string) error {
+	u, err := parseGittableURL(repository)
+	if err != nil {
+		kh.Shell.Warningf("Could not parse %q as a URL - skipping adding host to SSH known_hosts", repository)
+		return err
+	}
+
+	// We only need to keyscan ssh repository urls
+	if u.Scheme != "ssh" {
+		return nil
+	}
+
+	host := resolveGitHost(ctx, kh.Shell, u.Host)
+
+	if err := kh.Add(ctx, host); err != nil {
+		return fmt.Errorf("Failed to add %q to known_hosts file %q: %w", host, u, err)
+	}
+
+	return nil
+}
+
+// VerifyFromRepository takes a git repo url, and returns an error if its
+// host isn't already known. The error lists the fingerprints of the keys the
+// host has, so they can be checked and added to known_hosts out of band.
+func (kh *knownHosts) VerifyFromRepository(ctx context.Context, repository string) error {
+	u, err := parseGittableURL(repository)
+	if err != nil {
+		return fmt.Errorf("Could not parse %q as a URL to check its host is known: %w", repository, err)
+	}
+
+	// Only ssh repository urls have host keys
+	if u.Scheme != "ssh" {
+		return nil
+	}
+
+	host := resolveGitHost(ctx, kh.Shell, u.Host)
+
+	contains, err := kh.Contains(host)
+	if err != nil {
+		return fmt.Errorf("Could not read known_hosts file %q: %w", kh.Path, err)
+	}
+	if contains {
+		return nil
+	}
+
+	msg := fmt.Sprintf("Host %q isn't in the known hosts at %q, and strict SSH host key checking is on, so it won't be trusted on first use.", host, kh.Path)
+
+	keys, err := sshKeyScan(ctx, kh.Shell, host)
+	if err != nil {
+		return fmt.Errorf("%s Its keys couldn't be scanned either: %w", msg, err)
+	}
+	fingerprints := sshKeyFingerprints(keys)
+	if len(fingerprints) == 0 {
+		return fmt.Errorf("%s It didn't send any keys when scanned", msg)
+	}
+	return fmt.Errorf("%s Once you've checked they're its keys, add them to the known hosts. It sent these keys:\n%s",
+		msg, strings.Join(fingerprints, "\n"))
+}
+
+// sshKeyFingerprints returns the type and SHA256 fingerprint of each key in
+// known_hosts lines, like those from sshKeyScan
+func sshKeyFingerprints(knownHostsLines string) []string {
+	var fingerprints []string
+	rest := []byte(knownHostsLines)
+	for len(rest) > 0 {
+		var key ssh.PublicKey
+		var err error
+		_, _, key, _, rest, err = ssh.ParseKnownHosts(rest)
+		if err != nil {
+			break
+		}
+		fingerprints = append(fingerprints, fmt.Sprintf("  %s %s", key.Type(), ssh.FingerprintSHA256(key)))
+	}
+	return fingerprints
+}
@@ -0,0 +1,198 @@
+package bootstrap
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestAddingToKnownHosts(t *testing.T) {
+	t.Parallel()
+
+	// Start a fake SSH server for ssh-keyscan to poke at.
+	// It will generate its own host key.
+	// This uses ':0' to pick an ephemeral port to listen on.
+	svr := &ssh.Server{
+		Addr:    "localhost:0",
+		Version: "Fake SSH Server v0.1",
+	}
+	ln, err := net.Listen("tcp", svr.Addr)
+	if err != nil {
+		t.Fatalf("net.Listen(tcp, %q) error = %v", svr.Addr, err)
+	}
+	go svr.Serve(ln)
+	defer svr.Close()
+
+	hostAddr := ln.Addr().String()
+	repoURL := fmt.Sprintf("ssh://git@%s/var/cache/git/project.git", hostAddr)
+	t.Logf("Fake SSH server listening at address %s", hostAddr)
+
+	// Create a new empty known-hosts file to add to.
+	f, err := os.CreateTemp("", "known-hosts")
+	if err != nil {
+		t.Fatalf(`os.CreateTemp("", "known-hosts") error = %v`, err)
+	}
+	defer os.RemoveAll(f.Name())
+	if err := f.Close(); err != nil {
+		t.Fatalf("f.Close() = %v", err)
+	}
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Set("PATH", os.Getenv("PATH"))
+	kh := knownHosts{
+		Shell: sh,
+		Path:  f.Name(),
+	}
+
+	// The file should not contain this host
+	exists, err := kh.Contains(hostAddr)
+	if err != nil {
+		t.Errorf("kh.Contains(%q) error = %v", hostAddr, err)
+	}
+	if got, want := exists, false; got != want {
+		t.Errorf("kh.Contains(%q) = %t, want %t", hostAddr, got, want)
+	}
+
+	// Add the host - this resolves any SSH client configuration
+	// (in case the URL contains an alias), and runs ssh-keyscan to get its key.
+	if err := kh.AddFromRepository(context.Background(), repoURL); err != nil {
+		t.Errorf("kh.AddFromRespository(%q) = %v", repoURL, err)
+	}
+
+	// The file should now contain the host key
+	exists, err = kh.Contains(hostAddr)
+	if err != nil {
+		t.Errorf("kh.Contains(%q) error = %v", hostAddr, err)
+	}
+	if got, want := exists, true; got != want {
+		t.Errorf("kh.Contains(%q) = %t, want %t", hostAddr, got, want)
+	}
+}
+
+func TestKnownHostsContains(t *testing.T) {
+	t.Parallel()
+
+	lines := []string{
+		"# github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+		"",
+		"github.com,140.82.112.3 ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+		"[git.example.com]:2222 ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQ== keyscanned on build-1",
+		knownhosts.HashHostname("hashed.example.com") + " ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTY= a comment",
+		knownhosts.HashHostname("[hashed.example.com]:7999") + "\tssh-ed25519   AAAAC3NzaC1lZDI1NTE5",
+		"@cert-authority *.ca.example.com,!untrusted.ca.example.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5 ca",
+		"@revoked revoked.example.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5",
+		"gitlab.com ssh-ed25519",
+	}
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", path, err)
+	}
+	kh := knownHosts{Shell: shell.NewTestShell(t), Path: path}
+
+	for _, test := range []struct {
+		host string
+		want bool
+	}{
+		{host: "github.com", want: true},
+		{host: "GitHub.com", want: true},
+		{host: "github.com:22", want: true},
+		{host: "140.82.112.3", want: true},
+		{host: "github.com:2222", want: false},
+		{host: "git.example.com:2222", want: true},
+		{host: "git.example.com", want: false},
+		{host: "hashed.example.com", want: true},
+		{host: "hashed.example.com:7999", want: true},
+		{host: "hashed.example.com:2222", want: false},
+		{host: "git.ca.example.com", want: true},
+		{host: "untrusted.ca.example.com", want: false},
+		{host: "revoked.example.com", want: false},
+		{host: "gitlab.com", want: false},
+		{host: "bitbucket.org", want: false},
+	} {
+		got, err := kh.Contains(test.host)
+		if err != nil {
+			t.Errorf("kh.Contains(%q) error = %v", test.host, err)
+		}
+		if got != test.want {
+			t.Errorf("kh.Contains(%q) = %t, want %t", test.host, got, test.want)
+		}
+	}
+}
+
+func TestVerifyFromRepository(t *testing.T) {
+	t.Parallel()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() error = %v", err)
+	}
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("gossh.NewSignerFromKey() error = %v", err)
+	}
+
+	svr := &ssh.Server{Version: "Fake SSH Server v0.1"}
+	svr.AddHostKey(signer)
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen(tcp, localhost:0) error = %v", err)
+	}
+	go svr.Serve(ln)
+	defer svr.Close()
+
+	hostAddr := ln.Addr().String()
+	repoURL := fmt.Sprintf("ssh://git@%s/var/cache/git/project.git", hostAddr)
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Set("PATH", os.Getenv("PATH"))
+	kh := knownHosts{
+		Shell: sh,
+		Path:  filepath.Join(t.TempDir(), "known_hosts"),
+	}
+	if err := os.WriteFile(kh.Path, nil, 0o600); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", kh.Path, err)
+	}
+
+	// The host isn't known, so it's an error listing the key it has
+	err = kh.VerifyFromRepository(context.Background(), repoURL)
+	if err == nil {
+		t.Fatalf("kh.VerifyFromRepository(%q) error = nil, want an error", repoURL)
+	}
+	if want := "ssh-ed25519 " + gossh.FingerprintSHA256(signer.PublicKey()); !strings.Contains(err.Error(), want) {
+		t.Errorf("kh.VerifyFromRepository(%q) error = %v, want it to contain %q", repoURL, err, want)
+	}
+
+	// It isn't added to the known hosts
+	contents, err := os.ReadFile(kh.Path)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q) error = %v", kh.Path, err)
+	}
+	if len(contents) != 0 {
+		t.Errorf("known_hosts = %q, want it empty", contents)
+	}
+
+	// Once it's added out of band, it's known
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostAddr)}, signer.PublicKey())
+	if err := os.WriteFile(kh.Path, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", kh.Path, err)
+	}
+	if err := kh.VerifyFromRepository(context.Background(), repoURL); err != nil {
+		t.Errorf("kh.VerifyFromRepository(%q) error = %v", repoURL, err)
+	}
+
+	// Only ssh hosts have keys to check
+	if err := kh.VerifyFromRepository(context.Background(), "https://github.com/buildkite/agent.git"); err != nil {
+		t.Errorf("kh.VerifyFromRepository(https://github.com/buildkite/agent.git) error = %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/shell"
+)
+
+// overlayBuildDir is a copy-on-write overlayfs mounted over the checkout
+// directory for the duration of a single job. The lower layer is a golden
+// checkout of the repository that is shared between jobs and never written to,
+// and the upper layer holds everything the job changes.
+type overlayBuildDir struct {
+	mountPath   string
+	scratchPath string
+}
+
+// mountOverlayBuildDir mounts an overlayfs at the current checkout path, using
+// the latest golden checkout of the repository as the lower layer. The normal
+// checkout then only has to fetch and check out whatever has changed since the
+// golden checkout was made.
+func (b *Bootstrap) mountOverlayBuildDir(ctx context.Context) error {
+	if runtime.GOOS != "linux" {
+		return errors.New("Overlay build directories are only supported on linux")
+	}
+
+	// Without a repository there's nothing to put in a golden checkout
+	if b.Config.Repository == "" {
+		return nil
+	}
+
+	// Hold the lock on the golden checkouts until the overlay is mounted, so
+	// the one we're using can't be removed out from under us
+	golden, lock, err := b.getOrUpdateGoldenCheckout(ctx)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
+
+	dir := &overlayBuildDir{
+		mountPath:   checkoutPath,
+		scratchPath: checkoutPath + ".overlay",
+	}
+
+	// Anything left over in the scratch dir is from a job that didn't get to
+	// clean up after itself
+	if err := os.RemoveAll(dir.scratchPath); err != nil {
+		return err
+	}
+
+	for _, d := range []string{dir.upperPath(), dir.workPath(), dir.mountPath} {
+		if err := os.MkdirAll(d, b.directoryMode()); err != nil {
+			return err
+		}
+	}
+
+	b.shell.Commentf("Mounting copy-on-write workspace over %s", golden)
+
+	b.buildDirMount = dir
+
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", golden, dir.upperPath(), dir.workPath())
+	if err := b.shell.Run(ctx, "mount", "-t", "overlay", "-o", opts, "buildkite-overlay", dir.mountPath); err != nil {
+		return fmt.Errorf("Failed to mount overlay build directory: %w", err)
+	}
+
+	return nil
+}
+
+// getOrUpdateGoldenCheckout returns the path to the latest golden checkout of
+// the repository, making a new one if there isn't one or the latest is older
+// than the refresh interval. The returned lock must be unlocked by the caller.
+//
+// Golden checkouts are never updated in place, because changing the lower layer
+// of a mounted overlayfs is undefined behaviour. Instead each refresh is a new
+// generation in its own directory, and generations that are no longer the
+// latest get removed once no overlay is using them.
+func (b *Bootstrap) getOrUpdateGoldenCheckout(ctx context.Context) (string, shell.LockFile, error) {
+	repoDir := filepath.Join(b.Config.BuildDirOverlayPath, dirForRepository(b.Config.Repository))
+	if err := os.MkdirAll(repoDir, b.directoryMode()); err != nil {
+		return "", nil, err
+	}
+
+	lockTimeout := time.Second * time.Duration(b.GitMirrorsLockTimeout)
+
+	lock, err := b.shell.LockFile(ctx, repoDir+".lock", lockTimeout)
+	if err != nil {
+		return "", nil, err
+	}
+
+	entries, err := os.ReadDir(repoDir)
+	if err != nil {
+		lock.Unlock()
+		return "", nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+
+	now := time.Now()
+	refresh := time.Second * time.Duration(b.Config.BuildDirOverlayRefresh)
+
+	latest, createdAt := latestGoldenGeneration(names)
+	if latest == "" || now.Sub(createdAt) > refresh {
+		generation := strconv.FormatInt(now.Unix(), 10)
+		generationDir := filepath.Join(repoDir, generation)
+
+		if err := b.keyscanRepositoryHost(ctx, b.Repository); err != nil {
+			lock.Unlock()
+			return "", nil, err
+		}
+
+		b.shell.Commentf("Creating golden checkout of the repository in %q", generationDir)
+		if err := gitClone(ctx, b.shell, b.GitCloneFlags, b.Repository, generationDir); err != nil {
+			if rmErr := os.RemoveAll(generationDir); rmErr != nil {
+				b.shell.Warningf("Failed to remove %q: %v", generationDir, rmErr)
+			}
+			if latest == "" {
+				lock.Unlock()
+				return "", nil, err
+			}
+			b.shell.Warningf("Failed to refresh golden checkout, using the existing one: %v", err)
+		} else {
+			latest = generation
+		}
+	}
+
+	b.removeUnusedGoldenGenerations(repoDir, names, latest)
+
+	return filepath.Join(repoDir, latest), lock, nil
+}
+
+// removeUnusedGoldenGenerations removes golden checkouts other than the latest
+// that aren't the lower layer of any mounted overlay
+func (b *Bootstrap) removeUnusedGoldenGenerations(repoDir string, names []string, latest string) {
+	mounts, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		b.shell.Warningf("Failed to read mounts, not removing old golden checkouts: %v", err)
+		return
+	}
+
+	inUse := map[string]bool{}
+	for _, dir := range overlayLowerDirs(string(mounts)) {
+		inUse[dir] = true
+	}
+
+	for _, name := range names {
+		dir := filepath.Join(repoDir, name)
+		if name == latest || inUse[dir] {
+			continue
+		}
+		b.shell.Commentf("Removing unused golden checkout %q", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			b.shell.Warningf("Failed to remove %q: %v", dir, err)
+		}
+	}
+}
+
+// latestGoldenGeneration returns the newest of the generation directory names,
+// which are unix timestamps, and when it was created. Names that aren't
+// timestamps are ignored.
+func latestGoldenGeneration(names []string) (string, time.Time) {
+	var generations []int64
+	for _, name := range names {
+		if ts, err := strconv.ParseInt(name, 10, 64); err == nil {
+			generations = append(generations, ts)
+		}
+	}
+
+	if len(generations) == 0 {
+		return "", time.Time{}
+	}
+
+	sort.Slice(generations, func(i, j int) bool { return generations[i] < generations[j] })
+	latest := generations[len(generations)-1]
+
+	return strconv.FormatInt(latest, 10), time.Unix(latest, 0)
+}
+
+// overlayLowerDirs returns the lower directories of all the overlay mounts in
+// the given /proc/mounts content
+func overlayLowerDirs(mounts string) []string {
+	var dirs []string
+	for _, line := range strings.Split(mounts, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[2] != "overlay" {
+			continue
+		}
+		for _, opt := range strings.Split(fields[3], ",") {
+			if lower := strings.TrimPrefix(opt, "lowerdir="); lower != opt {
+				dirs = append(dirs, strings.Split(lower, ":")...)
+			}
+		}
+	}
+	return dirs
+}
+
+// Close unmounts the overlay and throws away everything the job wrote
+func (d *overlayBuildDir) Close(ctx context.Context, sh *shell.Shell) {
+	sh.Commentf("Unmounting copy-on-write workspace %s", d.mountPath)
+
+	if err := sh.Run(ctx, "umount", d.mountPath); err != nil {
+		sh.Warningf("Failed to unmount overlay build directory: %v", err)
+		return
+	}
+
+	if err := os.RemoveAll(d.scratchPath); err != nil {
+		sh.Warningf("Failed to remove %q: %v", d.scratchPath, err)
+	}
+}
+
+func (d *overlayBuildDir) upperPath() string {
+	return filepath.Join(d.scratchPath, "upper")
+}
+
+func (d *overlayBuildDir) workPath() string {
+	return filepath.Join(d.scratchPath, "work")
+}
@@ -0,0 +1,62 @@
+package bootstrap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatestGoldenGeneration(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name      string
+		names     []string
+		latest    string
+		createdAt time.Time
+	}{
+		{
+			name:   "no generations",
+			names:  nil,
+			latest: "",
+		},
+		{
+			name:      "picks the newest",
+			names:     []string{"1600000000", "1700000000", "1650000000"},
+			latest:    "1700000000",
+			createdAt: time.Unix(1700000000, 0),
+		},
+		{
+			name:      "ignores other directories",
+			names:     []string{"lost+found", "1600000000"},
+			latest:    "1600000000",
+			createdAt: time.Unix(1600000000, 0),
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			latest, createdAt := latestGoldenGeneration(test.names)
+			assert.Equal(t, test.latest, latest)
+			assert.Equal(t, test.createdAt, createdAt)
+		})
+	}
+}
+
+func TestOverlayLowerDirs(t *testing.T) {
+	t.Parallel()
+
+	mounts := `sysfs /sys sysfs rw,nosuid,nodev,noexec,relatime 0 0
+/dev/nvme0n1p1 / ext4 rw,relatime 0 0
+buildkite-overlay /var/lib/buildkite-agent/builds/agent/org/pipeline overlay rw,relatime,lowerdir=/var/lib/buildkite-agent/golden/repo/1700000000,upperdir=/u,workdir=/w 0 0
+overlay /var/lib/docker/overlay2/abc/merged overlay rw,relatime,lowerdir=/l1:/l2,upperdir=/u,workdir=/w 0 0
+`
+
+	assert.Equal(t, []string{
+		"/var/lib/buildkite-agent/golden/repo/1700000000",
+		"/l1",
+		"/l2",
+	}, overlayLowerDirs(mounts))
+}
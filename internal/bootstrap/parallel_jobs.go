@@ -0,0 +1,137 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/env"
+)
+
+// parallelJob is which of a step's parallel jobs this is
+type parallelJob struct {
+	Index int
+	Count int
+}
+
+// parseParallelJob returns which of a step's parallel jobs this is, from
+// BUILDKITE_PARALLEL_JOB, which is 0 for the first, and
+// BUILDKITE_PARALLEL_JOB_COUNT. It returns nil if the step isn't parallel,
+// and an error if they don't make sense, so a job isn't run with the wrong
+// share of the step's work.
+func parseParallelJob(environ env.Environment) (*parallelJob, error) {
+	indexStr, hasIndex := environ.Get("BUILDKITE_PARALLEL_JOB")
+	countStr, hasCount := environ.Get("BUILDKITE_PARALLEL_JOB_COUNT")
+	if !hasIndex && !hasCount {
+		return nil, nil
+	}
+	if !hasIndex || !hasCount {
+		return nil, fmt.Errorf("BUILDKITE_PARALLEL_JOB and BUILDKITE_PARALLEL_JOB_COUNT must both be set for parallel jobs")
+	}
+
+	index, err := strconv.Atoi(strings.TrimSpace(indexStr))
+	if err != nil {
+		return nil, fmt.Errorf("BUILDKITE_PARALLEL_JOB %q isn't a number", indexStr)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(countStr))
+	if err != nil {
+		return nil, fmt.Errorf("BUILDKITE_PARALLEL_JOB_COUNT %q isn't a number", countStr)
+	}
+	if count < 1 {
+		return nil, fmt.Errorf("BUILDKITE_PARALLEL_JOB_COUNT must be at least 1, not %d", count)
+	}
+	if index < 0 || index >= count {
+		return nil, fmt.Errorf("BUILDKITE_PARALLEL_JOB must be from 0 to %d for %d parallel jobs, not %d", count-1, count, index)
+	}
+	return &parallelJob{Index: index, Count: count}, nil
+}
+
+// parallelSkew returns the index of the slowest of a step's parallel jobs,
+// and how many times longer than the mean it took
+func parallelSkew(durations []time.Duration) (slowest int, ratio float64) {
+	var total time.Duration
+	for i, d := range durations {
+		total += d
+		if d > durations[slowest] {
+			slowest = i
+		}
+	}
+	if total == 0 {
+		return slowest, 1
+	}
+	mean := float64(total) / float64(len(durations))
+	return slowest, float64(durations[slowest]) / mean
+}
+
+// parallelSkewMarkdown is the annotation suggesting a step's parallel jobs
+// be rebalanced
+func parallelSkewMarkdown(label string, durations []time.Duration, slowest int, ratio float64) string {
+	var md strings.Builder
+	if label == "" {
+		label = "A parallel step"
+	}
+	fmt.Fprintf(&md, "**%s** has parallel jobs that took very different times. Job %d of %d took %.1f× as long as the average, so the step took longer than it needed to. ",
+		label, slowest+1, len(durations), ratio)
+	md.WriteString("Splitting its work between the jobs by how long each part takes, rather than by count, would even them out.\n\n")
+	md.WriteString("| Job | BUILDKITE_PARALLEL_JOB | Command duration |\n| --- | --- | --- |\n")
+	for i, d := range durations {
+		fmt.Fprintf(&md, "| %d | %d | %v |\n", i+1, i, d.Round(time.Second))
+	}
+	return md.String()
+}
+
+// The build meta-data key the command duration of a step's parallel job is
+// recorded under
+func parallelDurationKey(stepID string, index int) string {
+	return fmt.Sprintf("buildkite:parallel:%s:%d:duration_ms", stepID, index)
+}
+
+// recordParallelJobDuration records how long this parallel job's command
+// took in the build's meta-data. Once all of the step's jobs have, the last
+// of them annotates the build if the slowest took more than
+// ParallelSkewThreshold percent longer than the mean, suggesting the jobs be
+// rebalanced.
+func (b *Bootstrap) recordParallelJobDuration(ctx context.Context, job *parallelJob, took time.Duration) {
+	stepID, _ := b.shell.Env.Get("BUILDKITE_STEP_ID")
+	if job == nil || job.Count < 2 || stepID == "" {
+		return
+	}
+
+	ms := strconv.FormatInt(took.Milliseconds(), 10)
+	if err := b.shell.Run(ctx, "buildkite-agent", "meta-data", "set", parallelDurationKey(stepID, job.Index), ms); err != nil {
+		b.shell.Warningf("Failed to record how long the parallel job took: %v", err)
+		return
+	}
+
+	durations := make([]time.Duration, job.Count)
+	for i := range durations {
+		if i == job.Index {
+			durations[i] = took
+			continue
+		}
+		// Until the other jobs have finished, they can't be compared
+		out, err := b.shell.RunAndCapture(ctx, "buildkite-agent", "meta-data", "get", parallelDurationKey(stepID, i))
+		if err != nil {
+			return
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+		if err != nil {
+			return
+		}
+		durations[i] = time.Duration(n) * time.Millisecond
+	}
+
+	slowest, ratio := parallelSkew(durations)
+	if ratio <= 1+float64(b.ParallelSkewThreshold)/100 {
+		return
+	}
+
+	label, _ := b.shell.Env.Get("BUILDKITE_LABEL")
+	err := b.shell.Run(ctx, "buildkite-agent", "annotate", "--style", "warning", "--context", "parallel-skew-"+stepID,
+		parallelSkewMarkdown(label, durations, slowest, ratio))
+	if err != nil {
+		b.shell.Warningf("Failed to annotate the build with the parallel jobs' durations: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package bootstrap
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseParallelJob(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name    string
+		environ []string
+		want    *parallelJob
+		wantErr string
+	}{
+		{
+			name:    "not parallel",
+			environ: []string{},
+		},
+		{
+			name:    "first of three",
+			environ: []string{"BUILDKITE_PARALLEL_JOB=0", "BUILDKITE_PARALLEL_JOB_COUNT=3"},
+			want:    &parallelJob{Index: 0, Count: 3},
+		},
+		{
+			name:    "last of three",
+			environ: []string{"BUILDKITE_PARALLEL_JOB=2", "BUILDKITE_PARALLEL_JOB_COUNT=3"},
+			want:    &parallelJob{Index: 2, Count: 3},
+		},
+		{
+			name:    "missing count",
+			environ: []string{"BUILDKITE_PARALLEL_JOB=1"},
+			wantErr: "must both be set",
+		},
+		{
+			name:    "missing index",
+			environ: []string{"BUILDKITE_PARALLEL_JOB_COUNT=4"},
+			wantErr: "must both be set",
+		},
+		{
+			name:    "index isn't a number",
+			environ: []string{"BUILDKITE_PARALLEL_JOB=one", "BUILDKITE_PARALLEL_JOB_COUNT=4"},
+			wantErr: `BUILDKITE_PARALLEL_JOB "one" isn't a number`,
+		},
+		{
+			name:    "no jobs",
+			environ: []string{"BUILDKITE_PARALLEL_JOB=0", "BUILDKITE_PARALLEL_JOB_COUNT=0"},
+			wantErr: "must be at least 1",
+		},
+		{
+			name:    "index counted from one",
+			environ: []string{"BUILDKITE_PARALLEL_JOB=4", "BUILDKITE_PARALLEL_JOB_COUNT=4"},
+			wantErr: "must be from 0 to 3 for 4 parallel jobs, not 4",
+		},
+		{
+			name:    "negative index",
+			environ: []string{"BUILDKITE_PARALLEL_JOB=-1", "BUILDKITE_PARALLEL_JOB_COUNT=4"},
+			wantErr: "not -1",
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseParallelJob(env.FromSlice(test.environ))
+			if test.wantErr != "" {
+				assert.ErrorContains(t, err, test.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestParallelSkew(t *testing.T) {
+	t.Parallel()
+
+	slowest, ratio := parallelSkew([]time.Duration{time.Minute, 3 * time.Minute, time.Minute, time.Minute})
+	assert.Equal(t, 1, slowest)
+	assert.InDelta(t, 2.0, ratio, 0.001)
+
+	slowest, ratio = parallelSkew([]time.Duration{time.Minute, time.Minute})
+	assert.Equal(t, 0, slowest)
+	assert.InDelta(t, 1.0, ratio, 0.001)
+
+	_, ratio = parallelSkew([]time.Duration{0, 0})
+	assert.InDelta(t, 1.0, ratio, 0.001)
+}
+
+func TestParallelSkewMarkdown(t *testing.T) {
+	t.Parallel()
+
+	md := parallelSkewMarkdown(":rspec: Specs", []time.Duration{time.Minute, 3 * time.Minute, time.Minute, time.Minute}, 1, 2)
+	assert.True(t, strings.HasPrefix(md, "**:rspec: Specs** has parallel jobs"), md)
+	assert.Contains(t, md, "Job 2 of 4 took 2.0× as long as the average")
+	assert.Contains(t, md, "| 2 | 1 | 3m0s |\n")
+	assert.Contains(t, md, "| 4 | 3 | 1m0s |\n")
+}
@@ -0,0 +1,11 @@
+//go:build linux
+// +build linux
+
+package bootstrap
+
+import "syscall"
+
+// setParentDeathSignal has the process killed when the bootstrap dies
+func setParentDeathSignal(attr *syscall.SysProcAttr) {
+	attr.Pdeathsig = syscall.SIGKILL
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package bootstrap
+
+import "syscall"
+
+// setParentDeathSignal does nothing, as only Linux lets a parent death signal
+// be set before the process starts. FreeBSD's procctl can only be called by
+// the process itself, so background processes outlive a bootstrap that dies
+// without stopping them.
+func setParentDeathSignal(attr *syscall.SysProcAttr) {}
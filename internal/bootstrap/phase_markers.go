@@ -0,0 +1,121 @@
+package bootstrap
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/buildkite/agent/v3/shell"
+)
+
+// Names of the phases that are marked in the job log. They're the phases of
+// BUILDKITE_BOOTSTRAP_PHASES, with plugins vendored in the repository and the
+// artifact upload marked separately. When a step's commands are run
+// separately, each is also marked within the command phase as command_1,
+// command_2 and so on.
+const (
+	PhasePlugin         = "plugin"
+	PhaseCheckout       = "checkout"
+	PhaseVendoredPlugin = "vendored_plugin"
+	PhaseCommand        = "command"
+	PhaseArtifacts      = "artifacts"
+)
+
+// Whether a PhaseMarker is at the start or end of its phase
+const (
+	PhaseMarkerStart = "start"
+	PhaseMarkerEnd   = "end"
+)
+
+// PhaseMarker marks the start or end of one of the bootstrap's phases in a
+// job's log. It's written on a line of its own as an APC escape sequence,
+// like the ansi-timestamps experiment's timestamps, which terminals don't
+// show:
+//
+//	\x1b_bk;phase=checkout;event=end;t=1700000000123;status=0\x07
+//
+// The time is in milliseconds since the Unix epoch, and the status is only
+// on end markers, where it's 0 if the phase succeeded.
+type PhaseMarker struct {
+	Phase  string
+	Event  string
+	Time   time.Time
+	Status int
+}
+
+var phaseMarkerRegexp = regexp.MustCompile(`\x1b_bk;phase=([a-z0-9_]+);event=(start|end);t=(\d+)(?:;status=(-?\d+))?\x07`)
+
+func (m PhaseMarker) String() string {
+	s := fmt.Sprintf("\x1b_bk;phase=%s;event=%s;t=%d", m.Phase, m.Event, m.Time.UnixMilli())
+	if m.Event == PhaseMarkerEnd {
+		s += fmt.Sprintf(";status=%d", m.Status)
+	}
+	return s + "\x07"
+}
+
+// ParsePhaseMarkers returns the phase markers in a job log, in the order
+// they're in it
+func ParsePhaseMarkers(log []byte) []PhaseMarker {
+	var markers []PhaseMarker
+	for _, m := range phaseMarkerRegexp.FindAllSubmatch(log, -1) {
+		ms, err := strconv.ParseInt(string(m[3]), 10, 64)
+		if err != nil {
+			continue
+		}
+		marker := PhaseMarker{
+			Phase: string(m[1]),
+			Event: string(m[2]),
+			Time:  time.UnixMilli(ms),
+		}
+		if len(m[4]) > 0 {
+			marker.Status, _ = strconv.Atoi(string(m[4]))
+		}
+		markers = append(markers, marker)
+	}
+	return markers
+}
+
+// PhaseDurations returns how long each phase took from its markers, adding
+// together phases that ran more than once. A phase that was started but not
+// ended, because the job was killed, isn't included.
+func PhaseDurations(markers []PhaseMarker) map[string]time.Duration {
+	durations := map[string]time.Duration{}
+	started := map[string]time.Time{}
+	for _, m := range markers {
+		switch m.Event {
+		case PhaseMarkerStart:
+			started[m.Phase] = m.Time
+		case PhaseMarkerEnd:
+			if start, ok := started[m.Phase]; ok {
+				durations[m.Phase] += m.Time.Sub(start)
+				delete(started, m.Phase)
+			}
+		}
+	}
+	return durations
+}
+
+// startPhase marks the start of a phase in the job log, if the job's asked
+// for phase markers or its log is JSON
+func (b *Bootstrap) startPhase(phase string) {
+	if jl, ok := b.shell.Logger.(*shell.JSONLogger); ok {
+		jl.StartPhase(phase)
+	}
+	if !b.PhaseMarkers {
+		return
+	}
+	b.shell.Printf("%s", PhaseMarker{Phase: phase, Event: PhaseMarkerStart, Time: time.Now()})
+}
+
+// endPhase marks the end of a phase in the job log, with the exit status of
+// err, if the job's asked for phase markers or its log is JSON
+func (b *Bootstrap) endPhase(phase string, err error) {
+	if jl, ok := b.shell.Logger.(*shell.JSONLogger); ok {
+		jl.EndPhase(phase, shell.GetExitCode(err))
+	}
+	if !b.PhaseMarkers {
+		return
+	}
+	b.shell.Printf("%s", PhaseMarker{Phase: phase, Event: PhaseMarkerEnd, Time: time.Now(), Status: shell.GetExitCode(err)})
+}
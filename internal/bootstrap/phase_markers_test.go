@@ -0,0 +1,69 @@
+package bootstrap
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPhaseMarkerString(t *testing.T) {
+	t.Parallel()
+
+	at := time.UnixMilli(1700000000123)
+	assert.Equal(t, "\x1b_bk;phase=checkout;event=start;t=1700000000123\x07",
+		PhaseMarker{Phase: PhaseCheckout, Event: PhaseMarkerStart, Time: at}.String())
+	assert.Equal(t, "\x1b_bk;phase=command;event=end;t=1700000000123;status=2\x07",
+		PhaseMarker{Phase: PhaseCommand, Event: PhaseMarkerEnd, Time: at, Status: 2}.String())
+}
+
+func TestParsePhaseMarkersAndDurations(t *testing.T) {
+	t.Parallel()
+
+	log := []byte("\x1b_bk;t=1700000000000\x07~~~ Preparing plugins\n" +
+		"\x1b_bk;phase=plugin;event=start;t=1700000000000\x07\n" +
+		"\x1b_bk;phase=plugin;event=end;t=1700000001500;status=0\x07\n" +
+		"\x1b_bk;phase=checkout;event=start;t=1700000002000\x07\n" +
+		"Cloning into '.'...\n" +
+		"\x1b_bk;phase=checkout;event=end;t=1700000012000;status=0\x07\n" +
+		"\x1b_bk;phase=command;event=start;t=1700000012000\x07\n" +
+		"\x1b_bk;phase=command;event=end;t=1700000042000;status=1\x07\n" +
+		"\x1b_bk;phase=artifacts;event=start;t=1700000042000\x07\n")
+
+	markers := ParsePhaseMarkers(log)
+	assert.Len(t, markers, 7)
+	assert.Equal(t, PhaseMarker{Phase: PhaseCommand, Event: PhaseMarkerEnd, Time: time.UnixMilli(1700000042000), Status: 1}, markers[5])
+
+	// The artifact upload never finished, so it isn't timed
+	assert.Equal(t, map[string]time.Duration{
+		PhasePlugin:   1500 * time.Millisecond,
+		PhaseCheckout: 10 * time.Second,
+		PhaseCommand:  30 * time.Second,
+	}, PhaseDurations(markers))
+}
+
+func TestPhaseMarkersOnlyWrittenWhenEnabled(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	sh := shell.NewTestShell(t)
+	sh.Logger = &shell.WriterLogger{Writer: &buf}
+
+	b := &Bootstrap{shell: sh}
+	b.startPhase(PhaseCheckout)
+	b.endPhase(PhaseCheckout, nil)
+	assert.Empty(t, buf.String())
+
+	b.PhaseMarkers = true
+	b.startPhase(PhaseCheckout)
+	b.endPhase(PhaseCheckout, &shell.ExitError{Code: 128, Message: "git clone failed"})
+
+	markers := ParsePhaseMarkers(buf.Bytes())
+	if assert.Len(t, markers, 2) {
+		assert.Equal(t, PhaseMarkerStart, markers[0].Event)
+		assert.Equal(t, PhaseMarkerEnd, markers[1].Event)
+		assert.Equal(t, 128, markers[1].Status)
+	}
+}
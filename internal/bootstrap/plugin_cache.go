@@ -0,0 +1,193 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/agent/plugin"
+	"github.com/buildkite/agent/v3/internal/utils"
+)
+
+var (
+	fullCommitRE  = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+	shortCommitRE = regexp.MustCompile(`^[0-9a-f]{7,}$`)
+)
+
+// checkoutCachedPlugin returns a checkout of the plugin from the plugins
+// cache, cloning it into the cache first if it doesn't have the commit the
+// plugin's version points to. Each entry in the cache is a checkout of one
+// commit that isn't changed once it's there, so jobs running at the same
+// time can use the same one, and a branch or a tag is only cloned again
+// when it's moved to another commit.
+func (b *Bootstrap) checkoutCachedPlugin(ctx context.Context, p *plugin.Plugin) (*pluginCheckout, error) {
+	id, err := p.Identifier()
+	if err != nil {
+		return nil, err
+	}
+
+	// Actual file permissions will be reduced by umask
+	if err := os.MkdirAll(b.PluginsCachePath, b.directoryMode()); err != nil {
+		return nil, err
+	}
+
+	repo, err := p.Repository()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.keyscanRepositoryHost(ctx, repo); err != nil {
+		return nil, err
+	}
+
+	commit := b.resolvePluginVersion(ctx, repo, p.Version)
+	if dir := b.cachedPluginDir(id, p.Version, commit); dir != "" {
+		return b.useCachedPlugin(p, dir)
+	}
+
+	// Lock the plugin while it's cloned, so jobs that need it at the same
+	// time wait for this one to finish rather than cloning it too
+	lock, err := b.shell.LockFile(ctx, filepath.Join(b.PluginsCachePath, id+".lock"), time.Minute*5)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	// Check again now we have the lock, in case another job cloned it
+	if dir := b.cachedPluginDir(id, p.Version, commit); dir != "" {
+		return b.useCachedPlugin(p, dir)
+	}
+
+	b.shell.Commentf("Plugin %q isn't in the plugins cache, so it will be cloned into it", p.Label())
+
+	tempDir, err := os.MkdirTemp(b.PluginsCachePath, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.clonePlugin(ctx, p, repo, tempDir); err != nil {
+		os.RemoveAll(tempDir)
+		return nil, err
+	}
+
+	// The version may have moved since it was resolved, so the entry is for
+	// the commit that was checked out
+	head, err := gitRevParseInWorkingDirectory(ctx, b.shell, tempDir, "HEAD")
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, err
+	}
+	dir := cachedPluginPath(b.PluginsCachePath, id, strings.TrimSpace(head))
+	if utils.FileExists(dir) {
+		os.RemoveAll(tempDir)
+		return b.useCachedPlugin(p, dir)
+	}
+
+	if err := p.VerifyChecksum(tempDir); err != nil {
+		os.RemoveAll(tempDir)
+		return nil, err
+	}
+
+	b.shell.Commentf("Moving temporary plugin directory into the plugins cache")
+	if err := os.Rename(tempDir, dir); err != nil {
+		os.RemoveAll(tempDir)
+		return nil, err
+	}
+
+	return &pluginCheckout{
+		Plugin:      p,
+		CheckoutDir: dir,
+		HooksDir:    filepath.Join(dir, "hooks"),
+	}, nil
+}
+
+// resolvePluginVersion returns the commit a plugin's version points to in
+// its repository, or "" if it can't be found without cloning it, like when
+// the version is an abbreviated commit
+func (b *Bootstrap) resolvePluginVersion(ctx context.Context, repo, version string) string {
+	if fullCommitRE.MatchString(version) {
+		return version
+	}
+
+	// A tag's peeled ref is the commit an annotated tag points to, and tags
+	// come before branches as they do for git checkout
+	refs := []string{"HEAD"}
+	if version != "" {
+		refs = []string{"refs/tags/" + version + "^{}", "refs/tags/" + version, "refs/heads/" + version}
+	}
+
+	out, err := b.shell.RunAndCapture(ctx, "git", append([]string{"ls-remote", "--", repo}, refs...)...)
+	if err != nil {
+		b.shell.Warningf("Couldn't find the commit plugin version %q is at: %v", version, err)
+		return ""
+	}
+
+	commits := parseLsRemote(out)
+	for _, ref := range refs {
+		if commit, ok := commits[ref]; ok {
+			return commit
+		}
+	}
+	return ""
+}
+
+// parseLsRemote returns the commit of each ref in the output of git
+// ls-remote
+func parseLsRemote(out string) map[string]string {
+	commits := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		commit, ref, ok := strings.Cut(strings.TrimSpace(line), "\t")
+		if ok {
+			commits[ref] = commit
+		}
+	}
+	return commits
+}
+
+// cachedPluginDir returns the plugins cache entry for the commit, or for an
+// abbreviated commit given as the version, or "" if there isn't one
+func (b *Bootstrap) cachedPluginDir(id, version, commit string) string {
+	if commit != "" {
+		if dir := cachedPluginPath(b.PluginsCachePath, id, commit); utils.FileExists(dir) {
+			return dir
+		}
+		return ""
+	}
+
+	if shortCommitRE.MatchString(version) {
+		// IDs are only letters, numbers and hyphens, so they can't have any
+		// glob patterns in them
+		matches, _ := filepath.Glob(cachedPluginPath(b.PluginsCachePath, id, version) + "*")
+		if len(matches) == 1 {
+			return matches[0]
+		}
+	}
+	return ""
+}
+
+// useCachedPlugin returns a checkout of a plugin in the plugins cache
+func (b *Bootstrap) useCachedPlugin(p *plugin.Plugin, dir string) (*pluginCheckout, error) {
+	b.shell.Commentf("Using plugin %q from the plugins cache (%s)", p.Label(), filepath.Base(dir))
+
+	// Jobs share the cache, so one that's changed an entry shouldn't be able
+	// to change the plugins of others that are pinned
+	if err := p.VerifyChecksum(dir); err != nil {
+		return nil, err
+	}
+
+	return &pluginCheckout{
+		Plugin:      p,
+		CheckoutDir: dir,
+		HooksDir:    filepath.Join(dir, "hooks"),
+	}, nil
+}
+
+// cachedPluginPath returns where the plugin with the id is cached for a
+// commit
+func cachedPluginPath(cachePath, id, commit string) string {
+	return filepath.Join(cachePath, fmt.Sprintf("%s-%s", id, commit))
+}
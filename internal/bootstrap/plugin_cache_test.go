@@ -0,0 +1,49 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLsRemote(t *testing.T) {
+	t.Parallel()
+
+	out := "7d4a84a86ee726f0264ac9a33678d4a8e02af342\trefs/tags/v1\n" +
+		"e7b2abc7955c8c4bfccca4ca8c331dd610dc3cf8\trefs/tags/v1^{}\n" +
+		"9f2c1e3a0b7d4c5e6f708192a3b4c5d6e7f80912\trefs/heads/v1\n"
+
+	assert.Equal(t, map[string]string{
+		"refs/tags/v1":    "7d4a84a86ee726f0264ac9a33678d4a8e02af342",
+		"refs/tags/v1^{}": "e7b2abc7955c8c4bfccca4ca8c331dd610dc3cf8",
+		"refs/heads/v1":   "9f2c1e3a0b7d4c5e6f708192a3b4c5d6e7f80912",
+	}, parseLsRemote(out))
+	assert.Empty(t, parseLsRemote(""))
+}
+
+func TestCachedPluginDir(t *testing.T) {
+	t.Parallel()
+
+	cacheDir := t.TempDir()
+	b := &Bootstrap{Config: Config{PluginsCachePath: cacheDir}}
+
+	const (
+		id     = "github-com-my-org-my-plugin-e7b2abc"
+		commit = "e7b2abc7955c8c4bfccca4ca8c331dd610dc3cf8"
+	)
+	entry := cachedPluginPath(cacheDir, id, commit)
+	require.NoError(t, os.MkdirAll(entry, 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(cacheDir, id+"123456"), 0o755))
+
+	assert.Equal(t, entry, b.cachedPluginDir(id, "main", commit))
+	assert.Equal(t, "", b.cachedPluginDir(id, "main", "7d4a84a86ee726f0264ac9a33678d4a8e02af342"))
+
+	// Abbreviated commits can't be resolved without a clone, but can be
+	// found in the cache
+	assert.Equal(t, entry, b.cachedPluginDir(id, "e7b2abc", ""))
+	assert.Equal(t, "", b.cachedPluginDir(id, "7d4a84a", ""))
+	assert.Equal(t, "", b.cachedPluginDir(id, "main", ""))
+}
@@ -0,0 +1,261 @@
+package bootstrap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The most findings listed in the policy scan's annotation
+const maxAnnotatedPolicyFindings = 50
+
+// policyManifestEcosystems are the dependency manifests and lockfiles that
+// are given to the policy scanner when they change, and their ecosystems
+var policyManifestEcosystems = map[string]string{
+	"go.mod":                   "go",
+	"go.sum":                   "go",
+	"package.json":             "npm",
+	"package-lock.json":        "npm",
+	"npm-shrinkwrap.json":      "npm",
+	"yarn.lock":                "npm",
+	"pnpm-lock.yaml":           "npm",
+	"requirements.txt":         "pypi",
+	"Pipfile":                  "pypi",
+	"Pipfile.lock":             "pypi",
+	"pyproject.toml":           "pypi",
+	"poetry.lock":              "pypi",
+	"setup.py":                 "pypi",
+	"setup.cfg":                "pypi",
+	"Gemfile":                  "rubygems",
+	"Gemfile.lock":             "rubygems",
+	"Cargo.toml":               "cargo",
+	"Cargo.lock":               "cargo",
+	"pom.xml":                  "maven",
+	"build.gradle":             "maven",
+	"build.gradle.kts":         "maven",
+	"gradle.lockfile":          "maven",
+	"composer.json":            "packagist",
+	"composer.lock":            "packagist",
+	"packages.config":          "nuget",
+	"packages.lock.json":       "nuget",
+	"Directory.Packages.props": "nuget",
+	"mix.exs":                  "hex",
+	"mix.lock":                 "hex",
+	"Podfile":                  "cocoapods",
+	"Podfile.lock":             "cocoapods",
+	"Package.swift":            "swift",
+	"Package.resolved":         "swift",
+	"pubspec.yaml":             "pub",
+	"pubspec.lock":             "pub",
+}
+
+// policyManifestEcosystem returns the ecosystem of a dependency manifest, or
+// "" if the file isn't one
+func policyManifestEcosystem(name string) string {
+	base := path.Base(name)
+	if eco, ok := policyManifestEcosystems[base]; ok {
+		return eco
+	}
+	switch {
+	case strings.HasPrefix(base, "requirements") && strings.HasSuffix(base, ".txt"):
+		return "pypi"
+	case strings.HasSuffix(base, ".gemspec"):
+		return "rubygems"
+	case strings.HasSuffix(base, ".csproj"), strings.HasSuffix(base, ".fsproj"), strings.HasSuffix(base, ".vbproj"):
+		return "nuget"
+	}
+	return ""
+}
+
+// policyManifest is a dependency manifest that's changed
+type policyManifest struct {
+	Path      string `json:"path"`
+	Ecosystem string `json:"ecosystem"`
+	Status    string `json:"status"`
+}
+
+// policyScanInput is what the policy scanner is given on stdin
+type policyScanInput struct {
+	Repository   string           `json:"repository"`
+	Commit       string           `json:"commit"`
+	Branch       string           `json:"branch"`
+	PullRequest  string           `json:"pull_request"`
+	BaseBranch   string           `json:"base_branch"`
+	CheckoutPath string           `json:"checkout_path"`
+	Manifests    []policyManifest `json:"manifests"`
+}
+
+// changedPolicyManifests returns the dependency manifests in the output of
+// git diff --name-status
+func changedPolicyManifests(nameStatus string) []policyManifest {
+	statuses := map[byte]string{'A': "added", 'M': "modified", 'D': "deleted", 'T': "modified"}
+
+	var manifests []policyManifest
+	for _, line := range strings.Split(nameStatus, "\n") {
+		status, name, ok := strings.Cut(strings.TrimSpace(line), "\t")
+		if !ok || status == "" || statuses[status[0]] == "" {
+			continue
+		}
+		if eco := policyManifestEcosystem(name); eco != "" {
+			manifests = append(manifests, policyManifest{Path: name, Ecosystem: eco, Status: statuses[status[0]]})
+		}
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].Path < manifests[j].Path })
+	return manifests
+}
+
+// policyFinding is a dependency that breaks, or nearly breaks, a policy
+type policyFinding struct {
+	Manifest string `json:"manifest"`
+	Package  string `json:"package"`
+	Version  string `json:"version"`
+	License  string `json:"license"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// policyVerdict is what the policy scanner writes to the file in
+// $BUILDKITE_POLICY_VERDICT_PATH
+type policyVerdict struct {
+	Verdict  string          `json:"verdict"`
+	Summary  string          `json:"summary"`
+	Findings []policyFinding `json:"findings"`
+}
+
+func parsePolicyVerdict(data []byte) (policyVerdict, error) {
+	var v policyVerdict
+	if err := json.Unmarshal(data, &v); err != nil {
+		return v, fmt.Errorf("Failed to parse the policy scanner's verdict: %w", err)
+	}
+	v.Verdict = strings.ToLower(strings.TrimSpace(v.Verdict))
+	switch v.Verdict {
+	case "pass", "warn", "fail":
+		return v, nil
+	default:
+		return v, fmt.Errorf("Invalid policy scanner verdict %q, expected pass, warn or fail", v.Verdict)
+	}
+}
+
+// style is the annotation style for the verdict
+func (v policyVerdict) style() string {
+	switch v.Verdict {
+	case "fail":
+		return "error"
+	case "warn":
+		return "warning"
+	default:
+		return "success"
+	}
+}
+
+func (v policyVerdict) markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "### Dependency policy: %s\n\n", v.Verdict)
+	if v.Summary != "" {
+		fmt.Fprintf(&b, "%s\n\n", v.Summary)
+	}
+	if len(v.Findings) > 0 {
+		b.WriteString("| Severity | Manifest | Package | License | |\n| --- | --- | --- | --- | --- |\n")
+		for i, f := range v.Findings {
+			if i == maxAnnotatedPolicyFindings {
+				fmt.Fprintf(&b, "| | | …and %d more | | |\n", len(v.Findings)-i)
+				break
+			}
+			pkg := f.Package
+			if f.Version != "" {
+				pkg += "@" + f.Version
+			}
+			fmt.Fprintf(&b, "| %s | `%s` | `%s` | %s | %s |\n", f.Severity, f.Manifest, pkg, f.License, f.Message)
+		}
+	}
+	return b.String()
+}
+
+// runPolicyScanner runs the policy scanner on the dependency manifests the
+// changes being built touch, annotating the build with its verdict, and
+// failing the job if the verdict is to
+func (b *Bootstrap) runPolicyScanner(ctx context.Context) error {
+	if b.PolicyScannerPath == "" || b.Repository == "" {
+		return nil
+	}
+
+	b.shell.Headerf("Checking dependencies against policy")
+
+	nameStatus, err := b.changesBeingBuilt(ctx, "--name-status", "--no-renames")
+	if err != nil {
+		return fmt.Errorf("Failed to find the changed dependency manifests: %w", err)
+	}
+
+	manifests := changedPolicyManifests(nameStatus)
+	if len(manifests) == 0 {
+		b.shell.Commentf("No dependency manifests have changed")
+		return nil
+	}
+
+	base, _ := b.shell.Env.Get("BUILDKITE_PULL_REQUEST_BASE_BRANCH")
+	input, err := json.Marshal(policyScanInput{
+		Repository:   b.Repository,
+		Commit:       b.Commit,
+		Branch:       b.Branch,
+		PullRequest:  b.PullRequest,
+		BaseBranch:   base,
+		CheckoutPath: b.shell.Getwd(),
+		Manifests:    manifests,
+	})
+	if err != nil {
+		return err
+	}
+
+	verdictFile, err := os.CreateTemp("", "buildkite-policy-verdict-*.json")
+	if err != nil {
+		return err
+	}
+	verdictFile.Close()
+	defer os.Remove(verdictFile.Name())
+
+	b.shell.Env.Set("BUILDKITE_POLICY_VERDICT_PATH", verdictFile.Name())
+	defer b.shell.Env.Remove("BUILDKITE_POLICY_VERDICT_PATH")
+
+	if err := b.shell.WithStdin(bytes.NewReader(input)).Run(ctx, b.PolicyScannerPath); err != nil {
+		return fmt.Errorf("The policy scanner failed: %w", err)
+	}
+
+	data, err := os.ReadFile(verdictFile.Name())
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return errors.New("The policy scanner didn't write a verdict to $BUILDKITE_POLICY_VERDICT_PATH")
+	}
+
+	verdict, err := parsePolicyVerdict(data)
+	if err != nil {
+		return err
+	}
+
+	b.shell.Commentf("Dependency policy verdict: %s", verdict.Verdict)
+	for _, f := range verdict.Findings {
+		b.shell.Warningf("%s: %s %s (%s): %s", f.Manifest, f.Package, f.Version, f.License, f.Message)
+	}
+
+	if verdict.Verdict != "pass" || len(verdict.Findings) > 0 {
+		err := b.shell.Run(ctx, "buildkite-agent", "annotate", "--style", verdict.style(), "--context", "policy-scan", verdict.markdown())
+		if err != nil {
+			b.shell.Warningf("Failed to annotate the build with the policy verdict: %v", err)
+		}
+	}
+
+	if verdict.Verdict == "fail" {
+		if verdict.Summary != "" {
+			return fmt.Errorf("The dependencies failed the policy check: %s", verdict.Summary)
+		}
+		return errors.New("The dependencies failed the policy check")
+	}
+	return nil
+}
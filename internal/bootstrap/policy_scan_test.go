@@ -0,0 +1,54 @@
+package bootstrap
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangedPolicyManifests(t *testing.T) {
+	t.Parallel()
+
+	nameStatus := strings.Join([]string{
+		"M\tgo.mod",
+		"M\tgo.sum",
+		"A\tweb/package.json",
+		"A\tweb/src/index.js",
+		"D\tlegacy/requirements-dev.txt",
+		"M\tREADME.md",
+		"A\tsrc/App/App.csproj",
+	}, "\n")
+
+	assert.Equal(t, []policyManifest{
+		{Path: "go.mod", Ecosystem: "go", Status: "modified"},
+		{Path: "go.sum", Ecosystem: "go", Status: "modified"},
+		{Path: "legacy/requirements-dev.txt", Ecosystem: "pypi", Status: "deleted"},
+		{Path: "src/App/App.csproj", Ecosystem: "nuget", Status: "added"},
+		{Path: "web/package.json", Ecosystem: "npm", Status: "added"},
+	}, changedPolicyManifests(nameStatus))
+
+	assert.Empty(t, changedPolicyManifests("M\tmain.go\n"))
+}
+
+func TestParsePolicyVerdict(t *testing.T) {
+	t.Parallel()
+
+	v, err := parsePolicyVerdict([]byte(`{
+		"verdict": "WARN",
+		"summary": "1 dependency needs review",
+		"findings": [
+			{"manifest": "go.mod", "package": "example.com/lib", "version": "v1.2.0", "license": "LGPL-3.0", "severity": "warn", "message": "Needs legal review"}
+		]
+	}`))
+	require.NoError(t, err)
+	assert.Equal(t, "warn", v.Verdict)
+	assert.Equal(t, "warning", v.style())
+	assert.Contains(t, v.markdown(), "| warn | `go.mod` | `example.com/lib@v1.2.0` | LGPL-3.0 | Needs legal review |")
+
+	for _, data := range []string{`{"verdict": "maybe"}`, `{}`, `not json`} {
+		_, err := parsePolicyVerdict([]byte(data))
+		assert.Error(t, err, data)
+	}
+}
@@ -0,0 +1,100 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/buildkite/roko"
+)
+
+// retryPolicy is how the bootstrap retries the parts of a job that can fail
+// for a moment, like fetching from a git server or uploading artifacts
+type retryPolicy struct {
+	// How many times to try again after the first attempt fails
+	Retries int
+
+	// How long to wait between attempts: constant waits Delay each time, and
+	// exponential waits Delay to the power of the number of attempts so far
+	Backoff string
+	Delay   time.Duration
+
+	// Whether to wait up to a second longer, so jobs that failed together
+	// don't all try again together
+	Jitter bool
+
+	// Only failures with these exit statuses are retried, or any failure if
+	// there aren't any
+	RetryOn map[int]bool
+}
+
+// retryPolicy returns the policy for retrying a phase with its own limit on
+// retries, and the job's backoff
+func (b *Bootstrap) retryPolicy(retries int) retryPolicy {
+	policy := retryPolicy{
+		Retries: retries,
+		Backoff: b.RetryBackoff,
+		Delay:   b.RetryDelay,
+		Jitter:  b.RetryJitter,
+		RetryOn: map[int]bool{},
+	}
+	for _, status := range b.RetryOnExitStatus {
+		policy.RetryOn[status] = true
+	}
+	return policy
+}
+
+func (p retryPolicy) retrier() *roko.Retrier {
+	strategy := roko.WithStrategy(roko.Constant(p.Delay))
+	if p.Backoff == "exponential" {
+		strategy = roko.WithStrategy(roko.Exponential(p.Delay, 0))
+	}
+
+	jitter := func(*roko.Retrier) {}
+	if p.Jitter {
+		jitter = roko.WithJitter()
+	}
+
+	retries := p.Retries
+	if retries < 0 {
+		retries = 0
+	}
+	return roko.NewRetrier(
+		roko.WithMaxAttempts(retries+1),
+		strategy,
+		jitter,
+	)
+}
+
+// retryable returns whether an attempt that failed with err can be tried
+// again. Attempts that were interrupted or cancelled never are.
+func (p retryPolicy) retryable(err error) bool {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return false
+	case shell.IsExitError(err) && shell.GetExitCode(err) == -1:
+		return false
+	case len(p.RetryOn) == 0:
+		return true
+	default:
+		return shell.IsExitError(err) && p.RetryOn[shell.GetExitCode(err)]
+	}
+}
+
+// retry runs fn until it succeeds, the policy's retries run out, or it fails
+// in a way that can't be retried, warning about each failure with what
+func (b *Bootstrap) retry(ctx context.Context, policy retryPolicy, what string, fn func() error) error {
+	return policy.retrier().DoWithContext(ctx, func(r *roko.Retrier) error {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !policy.retryable(err) {
+			r.Break()
+			return err
+		}
+		b.shell.Warningf("%s failed! %s (%s)", what, err, r)
+		return err
+	})
+}
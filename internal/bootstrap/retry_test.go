@@ -0,0 +1,63 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	t.Parallel()
+
+	anyFailure := retryPolicy{}
+	assert.True(t, anyFailure.retryable(errors.New("Sunspots")))
+	assert.True(t, anyFailure.retryable(&shell.ExitError{Code: 128}))
+	assert.True(t, anyFailure.retryable(&gitError{error: &shell.ExitError{Code: 128}, Type: gitErrorFetch}))
+	assert.False(t, anyFailure.retryable(&shell.ExitError{Code: -1}))
+	assert.False(t, anyFailure.retryable(fmt.Errorf("fetching: %w", context.Canceled)))
+
+	only128 := retryPolicy{RetryOn: map[int]bool{128: true}}
+	assert.True(t, only128.retryable(&shell.ExitError{Code: 128}))
+	assert.True(t, only128.retryable(&gitError{error: &shell.ExitError{Code: 128}, Type: gitErrorFetch}))
+	assert.False(t, only128.retryable(&shell.ExitError{Code: 1}))
+	assert.False(t, only128.retryable(errors.New("Sunspots")))
+}
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	b := &Bootstrap{shell: shell.NewTestShell(t)}
+	policy := retryPolicy{Retries: 2, Backoff: "constant", Delay: time.Millisecond, RetryOn: map[int]bool{75: true}}
+
+	attempts := 0
+	err := b.retry(context.Background(), policy, "Upload", func() error {
+		attempts++
+		if attempts < 3 {
+			return &shell.ExitError{Code: 75}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = b.retry(context.Background(), policy, "Upload", func() error {
+		attempts++
+		return &shell.ExitError{Code: 75}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, attempts, "it should give up after its retries")
+
+	attempts = 0
+	err = b.retry(context.Background(), policy, "Upload", func() error {
+		attempts++
+		return &shell.ExitError{Code: 1}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts, "it shouldn't retry exit statuses that aren't retryable")
+}
@@ -0,0 +1,34 @@
+package bootstrap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+)
+
+// useRootlessDockerHost points a rootless job at the user's rootless Docker
+// daemon, if it's running and the job hasn't been given another
+func (b *Bootstrap) useRootlessDockerHost() {
+	if !b.Rootless || b.DockerDaemon != "" || b.shell.Env.Exists("DOCKER_HOST") {
+		return
+	}
+
+	runtimeDir, _ := b.shell.Env.Get("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return
+	}
+	socket := filepath.Join(runtimeDir, "docker.sock")
+	if _, err := os.Stat(socket); err != nil {
+		return
+	}
+
+	b.shell.Commentf("DOCKER_HOST=unix://%s", socket)
+	b.shell.Env.Set("DOCKER_HOST", "unix://"+socket)
+}
+
+// removeAllInUserNamespace removes path from inside a user namespace with
+// the user's subordinate IDs mapped, as rootless containers leave files in
+// bind mounted directories owned by IDs the user can only act as in one
+func (b *Bootstrap) removeAllInUserNamespace(ctx context.Context, path string) error {
+	return b.shell.Run(ctx, "unshare", "--map-root-user", "--map-auto", "rm", "-rf", "--", path)
+}
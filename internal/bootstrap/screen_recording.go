@@ -0,0 +1,251 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// Where the recording and screenshot are kept in the checkout until
+	// they're uploaded
+	screenRecordingDir = "buildkite-screen-recording"
+
+	// How long ffmpeg gets to finish writing the recording
+	screenRecordingStopTimeout = 10 * time.Second
+)
+
+// screenRecorder records the display while the command runs, starting a
+// virtual one with Xvfb if there isn't one
+type screenRecorder struct {
+	dir     string
+	display string
+
+	// The size of the display, if it's known
+	size string
+
+	xvfb        *virtualDisplay
+	ffmpeg      *exec.Cmd
+	ffmpegStdin io.WriteCloser
+	log         *os.File
+}
+
+// screenCaptureArgs are the ffmpeg arguments to capture the display with
+func screenCaptureArgs(goos, display, size string) []string {
+	switch goos {
+	case "windows":
+		return []string{"-f", "gdigrab", "-framerate", "10", "-i", "desktop"}
+	case "darwin":
+		return []string{"-f", "avfoundation", "-framerate", "10", "-capture_cursor", "1", "-i", "Capture screen 0"}
+	default:
+		args := []string{"-f", "x11grab", "-framerate", "10"}
+		if size != "" {
+			args = append(args, "-video_size", size)
+		}
+		return append(args, "-i", display)
+	}
+}
+
+// startScreenRecording starts recording the display if the job's asked for
+// it, returning nil if it hasn't or recording couldn't be started
+func (b *Bootstrap) startScreenRecording(ctx context.Context) *screenRecorder {
+	switch b.ScreenRecording {
+	case "":
+		return nil
+	case "video", "screenshot":
+	default:
+		b.shell.Warningf("Unknown screen recording mode %q, expected video or screenshot", b.ScreenRecording)
+		return nil
+	}
+
+	r, err := b.newScreenRecorder(ctx)
+	if err != nil {
+		b.shell.Warningf("Couldn't start recording the screen: %v", err)
+		if r != nil {
+			r.stop()
+			os.RemoveAll(r.dir)
+		}
+		return nil
+	}
+	return r
+}
+
+func (b *Bootstrap) newScreenRecorder(ctx context.Context) (*screenRecorder, error) {
+	r := &screenRecorder{dir: filepath.Join(b.shell.Getwd(), screenRecordingDir)}
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	var err error
+	r.log, err = os.Create(filepath.Join(r.dir, "screen-recording.log"))
+	if err != nil {
+		return r, err
+	}
+
+	r.display, _ = b.shell.Env.Get("DISPLAY")
+	if b.virtualDisplay != nil {
+		r.size = b.virtualDisplay.size
+	}
+	if r.display == "" && runtime.GOOS != "windows" && runtime.GOOS != "darwin" {
+		if r.xvfb, err = startVirtualDisplay(ctx, "xvfb", defaultVirtualDisplaySize, r.log); err != nil {
+			return r, err
+		}
+		r.display, r.size = r.xvfb.env["DISPLAY"], r.xvfb.size
+		b.shell.Commentf("Started a virtual display on %s", r.display)
+		b.shell.Env.Set("DISPLAY", r.display)
+	}
+
+	if b.ScreenRecording != "video" {
+		return r, nil
+	}
+
+	b.shell.Commentf("Recording the screen")
+	args := append([]string{"-hide_banner", "-loglevel", "warning", "-y"}, screenCaptureArgs(runtime.GOOS, r.display, r.size)...)
+	args = append(args, "-codec:v", "libx264", "-preset", "ultrafast", "-pix_fmt", "yuv420p", filepath.Join(r.dir, "screen-recording.mp4"))
+
+	r.ffmpeg = exec.CommandContext(ctx, "ffmpeg", args...)
+	r.ffmpeg.Env = b.shell.Env.ToSlice()
+	r.ffmpeg.Stdout = r.log
+	r.ffmpeg.Stderr = r.log
+	if r.ffmpegStdin, err = r.ffmpeg.StdinPipe(); err != nil {
+		return r, err
+	}
+	if err := r.ffmpeg.Start(); err != nil {
+		r.ffmpeg = nil
+		return r, fmt.Errorf("Failed to start ffmpeg: %w", err)
+	}
+	return r, nil
+}
+
+// screenshot saves what's on the display to screenshot.png
+func (r *screenRecorder) screenshot(ctx context.Context) error {
+	args := append([]string{"-hide_banner", "-loglevel", "warning", "-y"}, screenCaptureArgs(runtime.GOOS, r.display, r.size)...)
+	args = append(args, "-frames:v", "1", filepath.Join(r.dir, "screenshot.png"))
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Env = append(os.Environ(), "DISPLAY="+r.display)
+	cmd.Stdout = r.log
+	cmd.Stderr = r.log
+	return cmd.Run()
+}
+
+// stop stops recording, giving ffmpeg a chance to finish writing the video
+func (r *screenRecorder) stop() {
+	if r.ffmpeg != nil {
+		// ffmpeg stops recording cleanly when it's sent a q
+		_, _ = io.WriteString(r.ffmpegStdin, "q")
+		_ = r.ffmpegStdin.Close()
+
+		done := make(chan struct{})
+		go func() {
+			_ = r.ffmpeg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(screenRecordingStopTimeout):
+			_ = r.ffmpeg.Process.Kill()
+			<-done
+		}
+	}
+
+	if r.xvfb != nil {
+		r.xvfb.stop()
+	}
+
+	if r.log != nil {
+		_ = r.log.Close()
+	}
+}
+
+// finishScreenRecording stops recording, and if the command failed, uploads
+// the recording and any screenshots and annotates the build with them
+func (b *Bootstrap) finishScreenRecording(ctx context.Context, r *screenRecorder, failed bool) {
+	if r != nil {
+		if failed && b.ScreenRecording == "screenshot" {
+			if err := r.screenshot(ctx); err != nil {
+				b.shell.Warningf("Couldn't take a screenshot: %v", err)
+			}
+		}
+		r.stop()
+		defer os.RemoveAll(r.dir)
+
+		if r.xvfb != nil {
+			b.shell.Env.Remove("DISPLAY")
+		}
+	}
+
+	if !failed || (r == nil && b.ScreenshotPaths == "") {
+		return
+	}
+
+	wd := b.shell.Getwd()
+	patterns := b.ScreenshotPaths
+	if r != nil {
+		patterns += ";" + path.Join(screenRecordingDir, "*.mp4") + ";" + path.Join(screenRecordingDir, "*.png")
+	}
+	files, err := filesMatching(wd, patterns)
+	if err != nil {
+		b.shell.Warningf("Couldn't find the screenshots: %v", err)
+		return
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	b.shell.Headerf("Uploading screen recordings and screenshots")
+	for i, f := range files {
+		files[i] = filepath.ToSlash(f)
+	}
+
+	args := []string{"artifact", "upload", strings.Join(files, ";")}
+
+	// If blank, the upload destination is buildkite
+	if b.ArtifactUploadDestination != "" {
+		args = append(args, b.ArtifactUploadDestination)
+	}
+	if err := b.shell.Run(ctx, "buildkite-agent", args...); err != nil {
+		b.shell.Warningf("Failed to upload the screen recordings: %v", err)
+		return
+	}
+
+	label, _ := b.shell.Env.Get("BUILDKITE_LABEL")
+	err = b.shell.Run(ctx, "buildkite-agent", "annotate", "--style", "error", "--context", "screen-recording-"+b.JobID, screenGalleryMarkdown(label, files))
+	if err != nil {
+		b.shell.Warningf("Failed to annotate the build with the screen recordings: %v", err)
+	}
+}
+
+// screenGalleryMarkdown links to the videos and shows the images, which
+// are artifacts
+func screenGalleryMarkdown(label string, files []string) string {
+	var b strings.Builder
+	if label == "" {
+		label = "The job"
+	}
+	fmt.Fprintf(&b, "**%s** failed. What was on the screen:\n\n", label)
+
+	for _, f := range files {
+		switch strings.ToLower(path.Ext(f)) {
+		case ".mp4", ".webm", ".mov":
+			fmt.Fprintf(&b, "- :movie_camera: [%s](artifact://%s)\n", path.Base(f), strings.ReplaceAll(f, " ", "%20"))
+		}
+	}
+	b.WriteString("\n")
+
+	for _, f := range files {
+		switch strings.ToLower(path.Ext(f)) {
+		case ".png", ".jpg", ".jpeg", ".gif":
+			u := strings.ReplaceAll(f, " ", "%20")
+			fmt.Fprintf(&b, "<a href=\"artifact://%s\"><img src=\"artifact://%s\" alt=\"%s\" height=\"200\"></a>\n", u, u, path.Base(f))
+		}
+	}
+	return b.String()
+}
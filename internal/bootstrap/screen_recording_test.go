@@ -0,0 +1,27 @@
+package bootstrap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScreenCaptureArgs(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []string{"-f", "x11grab", "-framerate", "10", "-video_size", "1920x1080", "-i", ":99"}, screenCaptureArgs("linux", ":99", "1920x1080"))
+	assert.Equal(t, []string{"-f", "x11grab", "-framerate", "10", "-i", ":0"}, screenCaptureArgs("linux", ":0", ""))
+	assert.Equal(t, []string{"-f", "gdigrab", "-framerate", "10", "-i", "desktop"}, screenCaptureArgs("windows", "", ""))
+}
+
+func TestScreenGalleryMarkdown(t *testing.T) {
+	t.Parallel()
+
+	got := screenGalleryMarkdown(":selenium: UI tests", []string{
+		"buildkite-screen-recording/screen-recording.mp4",
+		"tmp/screenshots/login failed.png",
+	})
+	assert.Equal(t, "**:selenium: UI tests** failed. What was on the screen:\n\n"+
+		"- :movie_camera: [screen-recording.mp4](artifact://buildkite-screen-recording/screen-recording.mp4)\n\n"+
+		"<a href=\"artifact://tmp/screenshots/login%20failed.png\"><img src=\"artifact://tmp/screenshots/login%20failed.png\" alt=\"login failed.png\" height=\"200\"></a>\n", got)
+}
@@ -0,0 +1,327 @@
+package bootstrap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	zglob "github.com/mattn/go-zglob"
+)
+
+const (
+	// Files bigger than this aren't scanned for secrets
+	maxSecretScanFileSize = 10 * 1024 * 1024
+
+	// The most findings listed in the annotation
+	maxAnnotatedSecretFindings = 50
+)
+
+// secretRule is a pattern that a credential matches
+type secretRule struct {
+	ID      string
+	Pattern *regexp.Regexp
+}
+
+// defaultSecretRules are the credentials that are always scanned for, unless
+// a rules file replaces them
+var defaultSecretRules = []secretRule{
+	{"aws-access-key-id", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"github-token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	{"github-fine-grained-token", regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{80,}\b`)},
+	{"gitlab-token", regexp.MustCompile(`\bglpat-[A-Za-z0-9_\-]{20,}\b`)},
+	{"slack-token", regexp.MustCompile(`\bxox[abposr]-[0-9A-Za-z\-]{10,}\b`)},
+	{"google-api-key", regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}\b`)},
+	{"stripe-secret-key", regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{24,}\b`)},
+	{"buildkite-api-token", regexp.MustCompile(`\bbkua_[0-9a-f]{40}\b`)},
+	{"private-key", regexp.MustCompile(`-----BEGIN ((RSA|DSA|EC|OPENSSH|PGP|ENCRYPTED) )?PRIVATE KEY( BLOCK)?-----`)},
+}
+
+// loadSecretRules reads the rules to scan with. Each line of the file is a
+// rule's ID and the regular expression it matches, separated by whitespace,
+// e.g.
+//
+//	# Our internal API tokens
+//	acme-api-token  \bacme_[0-9a-f]{32}\b
+//
+// The rules are added to the default ones, replacing any with the same ID. A
+// line of just "!<id>" removes a rule, and "!default" removes all of the
+// default ones.
+func loadSecretRules(path string) ([]secretRule, error) {
+	rules := append([]secretRule{}, defaultSecretRules...)
+	if path == "" {
+		return rules, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	remove := func(id string) {
+		kept := rules[:0]
+		for _, r := range rules {
+			if r.ID != id && (id != "default" || !isDefaultSecretRule(r)) {
+				kept = append(kept, r)
+			}
+		}
+		rules = kept
+	}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "!") {
+			remove(strings.TrimPrefix(line, "!"))
+			continue
+		}
+
+		id, pattern, ok := strings.Cut(line, " ")
+		if !ok {
+			id, pattern, ok = strings.Cut(line, "\t")
+		}
+		pattern = strings.TrimSpace(pattern)
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("%s:%d: expected a rule's ID and its regular expression", path, n)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		remove(id)
+		rules = append(rules, secretRule{ID: id, Pattern: re})
+	}
+	return rules, scanner.Err()
+}
+
+func isDefaultSecretRule(r secretRule) bool {
+	for _, d := range defaultSecretRules {
+		if d.ID == r.ID && d.Pattern == r.Pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// secretFinding is a line that matches a rule
+type secretFinding struct {
+	Rule  string
+	Path  string
+	Line  int
+	Match string
+}
+
+// String describes the finding without giving away the secret
+func (f secretFinding) String() string {
+	return fmt.Sprintf("%s:%d: %s (%s)", f.Path, f.Line, f.Rule, redactSecret(f.Match))
+}
+
+// redactSecret shows just enough of a secret to find it
+func redactSecret(s string) string {
+	if len(s) <= 8 {
+		return strings.Repeat("*", len(s))
+	}
+	return s[:4] + strings.Repeat("*", 8)
+}
+
+func scanLineForSecrets(rules []secretRule, path string, n int, line string) []secretFinding {
+	var findings []secretFinding
+	for _, r := range rules {
+		if m := r.Pattern.FindString(line); m != "" {
+			findings = append(findings, secretFinding{Rule: r.ID, Path: path, Line: n, Match: m})
+		}
+	}
+	return findings
+}
+
+// scanFileForSecrets scans each line of a file, skipping files that are too
+// big or look binary
+func scanFileForSecrets(rules []secretRule, path, name string) ([]secretFinding, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() || info.Size() > maxSecretScanFileSize {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	if head, _ := r.Peek(8000); bytes.IndexByte(head, 0) >= 0 {
+		return nil, nil
+	}
+
+	var findings []secretFinding
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxSecretScanFileSize)
+	for n := 1; scanner.Scan(); n++ {
+		findings = append(findings, scanLineForSecrets(rules, name, n, scanner.Text())...)
+	}
+	return findings, scanner.Err()
+}
+
+// scanDiffForSecrets scans the lines a unified diff adds
+func scanDiffForSecrets(rules []secretRule, diff io.Reader) ([]secretFinding, error) {
+	var findings []secretFinding
+	var path string
+	var n int
+
+	scanner := bufio.NewScanner(diff)
+	scanner.Buffer(nil, maxSecretScanFileSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			path = strings.TrimPrefix(strings.TrimPrefix(line, "+++ "), "b/")
+		case strings.HasPrefix(line, "@@ "):
+			// @@ -a,b +c,d @@, where c is the line the hunk starts at
+			fields := strings.Fields(line)
+			if len(fields) > 2 {
+				start, _, _ := strings.Cut(strings.TrimPrefix(fields[2], "+"), ",")
+				n, _ = strconv.Atoi(start)
+			}
+		case strings.HasPrefix(line, "+"):
+			findings = append(findings, scanLineForSecrets(rules, path, n, line[1:])...)
+			n++
+		case strings.HasPrefix(line, " "):
+			n++
+		}
+	}
+	return findings, scanner.Err()
+}
+
+// scanCheckoutForSecrets scans the changes being built for secrets
+func (b *Bootstrap) scanCheckoutForSecrets(ctx context.Context) error {
+	if b.SecretScan == "" || b.Repository == "" {
+		return nil
+	}
+
+	b.shell.Headerf("Scanning the changes for secrets")
+	rules, err := loadSecretRules(b.SecretScanRulesPath)
+	if err != nil {
+		return fmt.Errorf("Failed to load secret scanning rules: %w", err)
+	}
+
+	diff, err := b.changesBeingBuilt(ctx, "--no-color", "--no-ext-diff", "-U0")
+	if err != nil {
+		b.shell.Warningf("Couldn't get the changes to scan for secrets: %v", err)
+		return nil
+	}
+
+	findings, err := scanDiffForSecrets(rules, strings.NewReader(diff))
+	if err != nil {
+		return err
+	}
+	return b.reportSecrets(ctx, "the changes being built", findings)
+}
+
+// changesBeingBuilt runs git to show the changes being built with the
+// options given: those of the pull request if it's one and its base branch has
+// been fetched, or otherwise those of the commit
+func (b *Bootstrap) changesBeingBuilt(ctx context.Context, opts ...string) (string, error) {
+	base, _ := b.shell.Env.Get("BUILDKITE_PULL_REQUEST_BASE_BRANCH")
+	if b.PullRequest != "false" && base != "" {
+		if _, err := b.shell.RunAndCapture(ctx, "git", "rev-parse", "--verify", "--quiet", "origin/"+base); err == nil {
+			b.shell.Commentf("Using the changes since origin/%s", base)
+			args := append(append([]string{"diff"}, opts...), "origin/"+base+"...HEAD")
+			return b.shell.RunAndCapture(ctx, "git", args...)
+		}
+	}
+
+	args := append(append([]string{"show", "--format="}, opts...), "--first-parent", "HEAD")
+	return b.shell.RunAndCapture(ctx, "git", args...)
+}
+
+// scanArtifactsForSecrets scans the files that are about to be uploaded as
+// artifacts
+func (b *Bootstrap) scanArtifactsForSecrets(ctx context.Context) error {
+	if b.SecretScan == "" {
+		return nil
+	}
+
+	b.shell.Headerf("Scanning artifacts for secrets")
+	rules, err := loadSecretRules(b.SecretScanRulesPath)
+	if err != nil {
+		return fmt.Errorf("Failed to load secret scanning rules: %w", err)
+	}
+
+	wd := b.shell.Getwd()
+	seen := map[string]bool{}
+	var findings []secretFinding
+	for _, pattern := range strings.Split(b.AutomaticArtifactUploadPaths, ";") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(wd, pattern)
+		}
+
+		files, err := zglob.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if seen[file] {
+				continue
+			}
+			seen[file] = true
+
+			name, err := filepath.Rel(wd, file)
+			if err != nil {
+				name = file
+			}
+			found, err := scanFileForSecrets(rules, file, filepath.ToSlash(name))
+			if err != nil {
+				b.shell.Warningf("Couldn't scan %s for secrets: %v", name, err)
+				continue
+			}
+			findings = append(findings, found...)
+		}
+	}
+
+	return b.reportSecrets(ctx, "the artifacts", findings)
+}
+
+// reportSecrets logs what was found and annotates the build with it, and
+// returns an error to fail the job if secret scanning is set to
+func (b *Bootstrap) reportSecrets(ctx context.Context, where string, findings []secretFinding) error {
+	if len(findings) == 0 {
+		b.shell.Commentf("No secrets found in %s", where)
+		return nil
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Found %d possible secrets in %s:\n\n", len(findings), where)
+	for i, f := range findings {
+		b.shell.Errorf("Possible secret in %s", f)
+		if i < maxAnnotatedSecretFindings {
+			fmt.Fprintf(&body, "- `%s`\n", f)
+		}
+	}
+	if len(findings) > maxAnnotatedSecretFindings {
+		fmt.Fprintf(&body, "- …and %d more\n", len(findings)-maxAnnotatedSecretFindings)
+	}
+
+	err := b.shell.Run(ctx, "buildkite-agent", "annotate", "--style", "error", "--context", "secret-scan", "--append", body.String())
+	if err != nil {
+		b.shell.Warningf("Failed to annotate the build with the secrets found: %v", err)
+	}
+
+	if b.SecretScan == "fail" {
+		return fmt.Errorf("Found %d possible secrets in %s", len(findings), where)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package bootstrap
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// What SELinux is doing on the host, as returned by SELinuxMode
+const (
+	SELinuxEnforcing  = "enforcing"
+	SELinuxPermissive = "permissive"
+	SELinuxDisabled   = "disabled"
+)
+
+// selinuxType returns the type of a label like
+// system_u:object_r:container_file_t:s0, which is what policy mostly cares
+// about
+func selinuxType(label string) string {
+	fields := strings.SplitN(label, ":", 4)
+	if len(fields) < 3 {
+		return ""
+	}
+	return fields[2]
+}
+
+// relabelSELinux labels root and everything in it, skipping what's already
+// labeled so a checkout from a previous job is quick to relabel
+func relabelSELinux(root, label string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if current, _ := SELinuxLabel(path); current == label {
+			return nil
+		}
+		return LabelSELinux(path, label)
+	})
+}
+
+// labelBuildDir labels the checkout with the agent's SELinux label, if it
+// has one. Files created in it afterwards take on its label.
+func (b *Bootstrap) labelBuildDir(path string) error {
+	if b.BuildDirSELinuxLabel == "" || SELinuxMode() == SELinuxDisabled {
+		return nil
+	}
+	if current, _ := SELinuxLabel(path); current == b.BuildDirSELinuxLabel {
+		return nil
+	}
+
+	b.shell.Commentf("Labeling %s %s", path, b.BuildDirSELinuxLabel)
+	return relabelSELinux(path, b.BuildDirSELinuxLabel)
+}
+
+// createSELinuxTempDir gives the job a temporary directory with the agent's
+// SELinux label, as files in the shared one are labeled for the host and
+// containers can't read them
+func (b *Bootstrap) createSELinuxTempDir() error {
+	if b.BuildDirSELinuxLabel == "" || SELinuxMode() == SELinuxDisabled {
+		return nil
+	}
+
+	dir, err := os.MkdirTemp("", "buildkite-tmp-"+b.JobID+"-")
+	if err != nil {
+		return err
+	}
+	b.cleanupDirs = append(b.cleanupDirs, dir)
+
+	if err := LabelSELinux(dir, b.BuildDirSELinuxLabel); err != nil {
+		return err
+	}
+	b.shell.Env.Set("TMPDIR", dir)
+	return nil
+}
@@ -0,0 +1,66 @@
+//go:build linux
+// +build linux
+
+package bootstrap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// The extended attribute SELinux keeps a file's label in
+const selinuxXattr = "security.selinux"
+
+// SELinuxMode returns whether SELinux is enforcing, permissive or disabled
+func SELinuxMode() string {
+	enforce, err := os.ReadFile("/sys/fs/selinux/enforce")
+	switch {
+	case err != nil:
+		return SELinuxDisabled
+	case bytes.HasPrefix(enforce, []byte("1")):
+		return SELinuxEnforcing
+	default:
+		return SELinuxPermissive
+	}
+}
+
+// SELinuxLabel returns the SELinux label of a file, without following
+// symlinks
+func SELinuxLabel(path string) (string, error) {
+	buf := make([]byte, 256)
+	for {
+		n, err := unix.Lgetxattr(path, selinuxXattr, buf)
+		if errors.Is(err, unix.ERANGE) {
+			buf = make([]byte, len(buf)*2)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(bytes.TrimRight(buf[:n], "\x00")), nil
+	}
+}
+
+// LabelSELinux sets the SELinux label of a file, without following
+// symlinks. Its errors say why the label couldn't be set, rather than
+// leaving jobs to fail later with denials in the audit log.
+func LabelSELinux(path, label string) error {
+	err := unix.Lsetxattr(path, selinuxXattr, []byte(label), 0)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.EPERM), errors.Is(err, unix.EACCES):
+		return fmt.Errorf("SELinux policy doesn't let the agent label %s %s. Allow the agent's domain to relabelfrom its label and relabelto %s, or choose another label: %w",
+			path, label, selinuxType(label), err)
+	case errors.Is(err, unix.EINVAL):
+		return fmt.Errorf("%q isn't an SELinux label this host's policy knows about: %w", label, err)
+	case errors.Is(err, unix.ENOTSUP):
+		return fmt.Errorf("The filesystem %s is on doesn't support SELinux labels, mount it with -o context=%q instead: %w", path, label, err)
+	default:
+		return fmt.Errorf("Failed to label %s %s: %w", path, label, err)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package bootstrap
+
+import "errors"
+
+var errSELinuxUnsupported = errors.New("SELinux is only supported on Linux")
+
+// SELinuxMode returns disabled, as there's no SELinux off Linux
+func SELinuxMode() string {
+	return SELinuxDisabled
+}
+
+// SELinuxLabel fails, as there's no SELinux off Linux
+func SELinuxLabel(path string) (string, error) {
+	return "", errSELinuxUnsupported
+}
+
+// LabelSELinux fails, as there's no SELinux off Linux
+func LabelSELinux(path, label string) error {
+	return errSELinuxUnsupported
+}
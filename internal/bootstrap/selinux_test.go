@@ -0,0 +1,25 @@
+package bootstrap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSELinuxType(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "container_file_t", selinuxType("system_u:object_r:container_file_t:s0"))
+	assert.Equal(t, "container_file_t", selinuxType("system_u:object_r:container_file_t:s0:c1,c2"))
+	assert.Equal(t, "user_tmp_t", selinuxType("unconfined_u:object_r:user_tmp_t"))
+	assert.Equal(t, "", selinuxType("container_file_t"))
+}
+
+func TestLabelingBuildDirWithoutALabel(t *testing.T) {
+	t.Parallel()
+
+	b := &Bootstrap{}
+	assert.NoError(t, b.labelBuildDir(t.TempDir()))
+	assert.NoError(t, b.createSELinuxTempDir())
+	assert.Empty(t, b.cleanupDirs)
+}
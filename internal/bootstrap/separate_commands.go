@@ -0,0 +1,138 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/process"
+	"github.com/buildkite/agent/v3/shell"
+)
+
+// What's done when one of a step's separate commands fails
+const (
+	CommandFailurePolicyFailFast = "fail-fast"
+	CommandFailurePolicyContinue = "continue"
+)
+
+// splitCommands splits a step's command into the commands it's made of.
+// Buildkite joins a step's list of commands with newlines, so each line is a
+// command, unless it ends with a backslash to continue onto the next.
+func splitCommands(command string) []string {
+	var commands []string
+	var current strings.Builder
+	for _, line := range strings.Split(strings.ReplaceAll(command, "\r\n", "\n"), "\n") {
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(line)
+			current.WriteString("\n")
+			continue
+		}
+		current.WriteString(line)
+		if c := current.String(); strings.TrimSpace(c) != "" {
+			commands = append(commands, c)
+		}
+		current.Reset()
+	}
+	if c := strings.TrimSuffix(current.String(), "\n"); strings.TrimSpace(c) != "" {
+		commands = append(commands, c)
+	}
+	return commands
+}
+
+// commandResult is how one of a step's separate commands went
+type commandResult struct {
+	command    string
+	ran        bool
+	exitStatus int
+	duration   time.Duration
+}
+
+// runSeparateCommands runs each of a step's commands on its own, in its own
+// log group, and with its own timing and exit status. After one fails, the
+// rest are only run if the failure policy is to continue. The error is that
+// of the first command to fail.
+func (b *Bootstrap) runSeparateCommands(ctx context.Context, shellArgs []string, commands []string) error {
+	redactors := b.setupRedactors()
+	defer redactors.Flush()
+
+	results := make([]commandResult, len(commands))
+	var firstErr error
+	for i, command := range commands {
+		results[i].command = command
+
+		// Commands that were interrupted, because the job was canceled,
+		// always stop the rest from running
+		if firstErr != nil && (b.CommandFailurePolicy != CommandFailurePolicyContinue || shell.IsExitSignaled(firstErr)) {
+			continue
+		}
+
+		b.shell.Headerf("Running command %d of %d", i+1, len(commands))
+
+		cmdToExec := command
+		removeShim := func() {}
+		if b.CommandShim && isPosixShell(shellArgs) {
+			shimmed, remove, err := b.shimCommand(command)
+			if err != nil {
+				return err
+			}
+			cmdToExec, removeShim = shimmed, remove
+		}
+		if isPosixShell(shellArgs) {
+			cmdToExec = fmt.Sprintf("trap 'kill -- $$' INT TERM QUIT; %s", cmdToExec)
+		}
+		args := append(append([]string{}, shellArgs[1:]...), cmdToExec)
+		if b.Debug {
+			b.shell.Promptf("%s", process.FormatCommand(shellArgs[0], args))
+		} else {
+			b.shell.Promptf("%s", command)
+		}
+
+		phase := fmt.Sprintf("%s_%d", PhaseCommand, i+1)
+		b.startPhase(phase)
+		restoreSource := b.setOutputSource(fmt.Sprintf("command:%d", i+1))
+		startedAt := time.Now()
+		var err error
+		if b.Interactive {
+			err = b.shell.RunInteractive(ctx, shellArgs[0], args...)
+		} else {
+			err = b.shell.RunWithoutPrompt(ctx, shellArgs[0], args...)
+		}
+		results[i].duration = time.Since(startedAt)
+		restoreSource()
+		removeShim()
+		b.endPhase(phase, err)
+
+		results[i].ran = true
+		results[i].exitStatus = shell.GetExitCode(err)
+		if err != nil {
+			b.shell.Errorf("Command %d of %d exited with status %d", i+1, len(commands), results[i].exitStatus)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	b.reportSeparateCommands(results)
+	return firstErr
+}
+
+// reportSeparateCommands adds how each command went to the log, and makes
+// their exit statuses available to the hooks after the command as a comma
+// separated BUILDKITE_COMMAND_EXIT_STATUSES. Commands that didn't run have
+// no exit status.
+func (b *Bootstrap) reportSeparateCommands(results []commandResult) {
+	b.shell.Headerf("Command summary")
+
+	statuses := make([]string, len(results))
+	for i, r := range results {
+		firstLine, _, _ := strings.Cut(r.command, "\n")
+		if !r.ran {
+			b.shell.Printf("%d. %s: didn't run", i+1, firstLine)
+			continue
+		}
+		statuses[i] = fmt.Sprintf("%d", r.exitStatus)
+		b.shell.Printf("%d. %s: exited with status %d in %v", i+1, firstLine, r.exitStatus, r.duration.Round(10*time.Millisecond))
+	}
+	b.shell.Env.Set("BUILDKITE_COMMAND_EXIT_STATUSES", strings.Join(statuses, ","))
+}
@@ -0,0 +1,92 @@
+package bootstrap
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitCommands(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name    string
+		command string
+		want    []string
+	}{
+		{
+			name:    "single command",
+			command: "make test",
+			want:    []string{"make test"},
+		},
+		{
+			name:    "one per line",
+			command: "make deps\nmake test\r\nmake lint",
+			want:    []string{"make deps", "make test", "make lint"},
+		},
+		{
+			name:    "blank lines",
+			command: "\nmake deps\n\n  \nmake test\n",
+			want:    []string{"make deps", "make test"},
+		},
+		{
+			name:    "continued lines",
+			command: "docker run \\\n  --rm \\\n  alpine true\necho done",
+			want:    []string{"docker run \\\n  --rm \\\n  alpine true", "echo done"},
+		},
+		{
+			name:    "continued last line",
+			command: "echo hello \\",
+			want:    []string{"echo hello \\"},
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, test.want, splitCommands(test.command))
+		})
+	}
+}
+
+func TestRunSeparateCommandsFailurePolicy(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("separate commands aren't run under cmd.exe")
+	}
+
+	commands := []string{"exit 0", "exit 3", "exit 0"}
+
+	for _, test := range []struct {
+		policy   string
+		statuses string
+	}{
+		{policy: CommandFailurePolicyFailFast, statuses: "0,3,"},
+		{policy: CommandFailurePolicyContinue, statuses: "0,3,0"},
+	} {
+		test := test
+		t.Run(test.policy, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			sh := shell.NewTestShell(t)
+			sh.Logger = &shell.WriterLogger{Writer: &buf}
+
+			b := &Bootstrap{
+				Config: Config{CommandFailurePolicy: test.policy},
+				shell:  sh,
+			}
+
+			err := b.runSeparateCommands(context.Background(), []string{"/bin/sh", "-c"}, commands)
+			assert.Equal(t, 3, shell.GetExitCode(err))
+
+			statuses, _ := sh.Env.Get("BUILDKITE_COMMAND_EXIT_STATUSES")
+			assert.Equal(t, test.statuses, statuses)
+			assert.Contains(t, buf.String(), "Command 2 of 3 exited with status 3")
+		})
+	}
+}
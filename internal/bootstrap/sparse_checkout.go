@@ -0,0 +1,29 @@
+package bootstrap
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/internal/utils"
+)
+
+// sparseCheckout checks out only GitSparseCheckoutPaths of the repository,
+// or all of it again if a previous job in the checkout only wanted some
+func (b *Bootstrap) sparseCheckout(ctx context.Context) error {
+	if len(b.GitSparseCheckoutPaths) == 0 {
+		if !utils.FileExists(filepath.Join(b.shell.Getwd(), ".git", "info", "sparse-checkout")) {
+			return nil
+		}
+		sparse, _ := b.shell.RunAndCapture(ctx, "git", "config", "--bool", "core.sparseCheckout")
+		if strings.TrimSpace(sparse) != "true" {
+			return nil
+		}
+		b.shell.Commentf("Checking out all of the repository again")
+		return b.shell.Run(ctx, "git", "sparse-checkout", "disable")
+	}
+
+	b.shell.Commentf("Checking out only %s", strings.Join(b.GitSparseCheckoutPaths, ", "))
+	args := append([]string{"sparse-checkout", "set", "--"}, b.GitSparseCheckoutPaths...)
+	return b.shell.Run(ctx, "git", args...)
+}
@@ -0,0 +1,192 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/buildkite/roko"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	sshKeyscanRetryInterval = 2 * time.Second
+
+	// How long to wait for a host to send each of its keys, like
+	// ssh-keyscan's default timeout
+	sshKeyscanTimeout = 5 * time.Second
+
+	// The host keys are scanned without ssh-keyscan if possible, which isn't
+	// on minimal containers or Windows images
+	nativeSSHKeyScan = scanHostKeys
+)
+
+// The host key algorithms scanned for each type of key a host can have. RSA
+// keys can be negotiated with SHA-2 signatures, or SHA-1 for older servers.
+var sshKeyscanAlgorithms = [][]string{
+	{ssh.KeyAlgoED25519},
+	{ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521},
+	{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA},
+}
+
+// errHostKeyScanned stops the SSH handshake once the host's key is known
+var errHostKeyScanned = errors.New("host key scanned")
+
+// sshKeyScan returns the known_hosts lines for the keys of host, which can
+// have a port. They're scanned natively, with ssh-keyscan as a fallback.
+func sshKeyScan(ctx context.Context, sh *shell.Shell, host string) (string, error) {
+	keys, err := nativeSSHKeyScan(ctx, host)
+	if err == nil {
+		return keys, nil
+	}
+	sh.Warningf("Couldn't scan the host keys of %q (%v), trying ssh-keyscan instead", host, err)
+
+	toolsDir, err := findPathToSSHTools(ctx, sh)
+	if err != nil {
+		return "", err
+	}
+
+	sshKeyScanPath := filepath.Join(toolsDir, "ssh-keyscan")
+	hostParts := strings.Split(host, ":")
+	sshKeyScanOutput := ""
+
+	err = roko.NewRetrier(
+		roko.WithMaxAttempts(3),
+		roko.WithStrategy(roko.Constant(sshKeyscanRetryInterval)),
+	).DoWithContext(ctx, func(r *roko.Retrier) error {
+		// `ssh-keyscan` needs `-p` when scanning a host with a port
+		var sshKeyScanCommand string
+		if len(hostParts) == 2 {
+			sshKeyScanCommand = fmt.Sprintf("ssh-keyscan -p %q %q", hostParts[1], hostParts[0])
+			sshKeyScanOutput, err = sh.RunAndCapture(ctx, sshKeyScanPath, "-p", hostParts[1], hostParts[0])
+		} else {
+			sshKeyScanCommand = fmt.Sprintf("ssh-keyscan %q", host)
+			sshKeyScanOutput, err = sh.RunAndCapture(ctx, sshKeyScanPath, host)
+		}
+
+		if err != nil {
+			keyScanError := fmt.Errorf("`%s` failed", sshKeyScanCommand)
+			sh.Warningf("%s (%s)", keyScanError, r)
+			return keyScanError
+		}
+		if strings.TrimSpace(sshKeyScanOutput) == "" {
+			// Older versions of ssh-keyscan would exit 0 but not
+			// return anything, and we've observed newer versions
+			// of ssh-keyscan - just sometimes return no data
+			// (maybe networking related?). In any case, no
+			// response, means an error.
+			keyScanError := fmt.Errorf("`%s` returned nothing", sshKeyScanCommand)
+			sh.Warningf("%s (%s)", keyScanError, r)
+			return keyScanError
+		}
+
+		return nil
+	})
+
+	return sshKeyScanOutput, err
+}
+
+// scanHostKeys connects to host, which can have a port, once for each type
+// of host key, and returns its keys as known_hosts lines in the format of
+// ssh-keyscan's output. Hosts on a port other than 22 are written as
+// [host]:port. It only fails if none of the host's keys could be scanned.
+func scanHostKeys(ctx context.Context, host string) (string, error) {
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(host, "22")
+	}
+
+	var lines []string
+	var lastErr error
+	seen := map[string]bool{}
+	for _, algorithms := range sshKeyscanAlgorithms {
+		key, err := scanHostKey(ctx, addr, algorithms)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if marshaled := string(key.Marshal()); !seen[marshaled] {
+			seen[marshaled] = true
+			lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(addr)}, key))
+		}
+	}
+
+	if len(lines) == 0 {
+		return "", fmt.Errorf("No host keys scanned: %w", lastErr)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// scanHostKey starts an SSH handshake with addr, negotiating one of the host
+// key algorithms given, and returns the host key it sends
+func scanHostKey(ctx context.Context, addr string, algorithms []string) (ssh.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, sshKeyscanTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	var hostKey ssh.PublicKey
+	_, _, _, err = ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:              "buildkite-agent",
+		HostKeyAlgorithms: algorithms,
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errHostKeyScanned
+		},
+	})
+	if hostKey != nil {
+		return hostKey, nil
+	}
+	if err == nil {
+		err = errors.New("the host didn't send a key")
+	}
+	return nil, err
+}
+
+// On Windows, there are many horrible different versions of the ssh tools. Our
+// preference is the one bundled with git for windows which is generally MinGW.
+// Often this isn't in the path, so we go looking for it specifically.
+//
+// Some more details on the relative paths at
+// https://stackoverflow.com/a/11771907
+func findPathToSSHTools(ctx context.Context, sh *shell.Shell) (string, error) {
+	sshKeyscan, err := sh.AbsolutePath("ssh-keyscan")
+	if err == nil {
+		return filepath.Dir(sshKeyscan), nil
+	}
+
+	if runtime.GOOS == "windows" {
+		execPath, _ := sh.RunAndCapture(ctx, "git", "--exec-path")
+		if len(execPath) > 0 {
+			for _, path := range []string{
+				filepath.Join(execPath, "..", "..", "..", "usr", "bin", "ssh-keygen.exe"),
+				filepath.Join(execPath, "..", "..", "bin", "ssh-keygen.exe"),
+			} {
+				if _, err := os.Stat(path); err == nil {
+					return filepath.Dir(path), nil
+				}
+			}
+		}
+	}
+
+	return "", fmt.Errorf("Unable to find ssh-keyscan: %v", err)
+}
@@ -2,17 +2,88 @@ package bootstrap
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/shell"
 	"github.com/buildkite/bintest/v3"
+	"github.com/gliderlabs/ssh"
 	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func init() {
 	sshKeyscanRetryInterval = time.Millisecond
+
+	// The ssh-keyscan tests shouldn't scan real hosts natively first
+	nativeSSHKeyScan = func(context.Context, string) (string, error) {
+		return "", errors.New("not scanned natively in tests")
+	}
+}
+
+func TestScanHostKeys(t *testing.T) {
+	t.Parallel()
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() error = %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey() error = %v", err)
+	}
+
+	svr := &ssh.Server{Version: "Fake SSH Server v0.1"}
+	var signers []gossh.Signer
+	for _, key := range []any{ed25519Key, rsaKey} {
+		signer, err := gossh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatalf("gossh.NewSignerFromKey(%T) error = %v", key, err)
+		}
+		svr.AddHostKey(signer)
+		signers = append(signers, signer)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(tcp, 127.0.0.1:0) error = %v", err)
+	}
+	go svr.Serve(ln)
+	defer svr.Close()
+
+	hostAddr := ln.Addr().String()
+	keys, err := scanHostKeys(context.Background(), hostAddr)
+	if err != nil {
+		t.Fatalf("scanHostKeys(%q) error = %v", hostAddr, err)
+	}
+
+	// Hosts on ports other than 22 are written as [host]:port
+	host := "[" + strings.Replace(hostAddr, ":", "]:", 1)
+	assert.Equal(t, strings.Join([]string{
+		knownhosts.Line([]string{host}, signers[0].PublicKey()),
+		knownhosts.Line([]string{host}, signers[1].PublicKey()),
+	}, "\n"), keys)
+}
+
+func TestScanHostKeysFailsWithoutAHost(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(tcp, 127.0.0.1:0) error = %v", err)
+	}
+	hostAddr := ln.Addr().String()
+	ln.Close()
+
+	_, err = scanHostKeys(context.Background(), hostAddr)
+	assert.Error(t, err)
 }
 
 func TestFindingSSHTools(t *testing.T) {
@@ -0,0 +1,17 @@
+//go:build !windows && !openbsd
+// +build !windows,!openbsd
+
+package bootstrap
+
+import "golang.org/x/sys/unix"
+
+// diskSpace returns the bytes available to unprivileged users and the total
+// size of the filesystem containing path
+func diskSpace(path string) (avail, total uint64, err error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	// The fields' types differ between platforms
+	return uint64(stat.Bavail) * uint64(stat.Bsize), uint64(stat.Blocks) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,16 @@
+//go:build openbsd
+// +build openbsd
+
+package bootstrap
+
+import "golang.org/x/sys/unix"
+
+// diskSpace returns the bytes available to unprivileged users and the total
+// size of the filesystem containing path
+func diskSpace(path string) (avail, total uint64, err error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return uint64(stat.F_bavail) * uint64(stat.F_bsize), stat.F_blocks * uint64(stat.F_bsize), nil
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package bootstrap
+
+import "errors"
+
+// diskSpace returns an error on Windows
+func diskSpace(path string) (avail, total uint64, err error) {
+	return 0, 0, errors.New("platform and architecture is not supported")
+}
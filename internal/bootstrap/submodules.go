@@ -0,0 +1,134 @@
+package bootstrap
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/buildkite/shellwords"
+)
+
+// resolveSubmoduleURL returns the URL of a submodule that's relative to its
+// superproject's, like ../other.git, resolved against the superproject's
+// repository, the way git does
+func resolveSubmoduleURL(superproject, submodule string) string {
+	if !strings.HasPrefix(submodule, "./") && !strings.HasPrefix(submodule, "../") {
+		return submodule
+	}
+
+	switch {
+	case hasSchemePattern.MatchString(superproject):
+		u, err := url.Parse(superproject)
+		if err != nil {
+			return submodule
+		}
+		u.Path = path.Join(u.Path, submodule)
+		return u.String()
+
+	case scpLikeURLPattern.MatchString(superproject) && !filepath.IsAbs(superproject):
+		matched := scpLikeURLPattern.FindStringSubmatch(superproject)
+		return fmt.Sprintf("%s%s:%s", matched[1], matched[2], path.Join(matched[3], submodule))
+
+	default:
+		return filepath.Join(superproject, filepath.FromSlash(submodule))
+	}
+}
+
+// parseSubmoduleSSHKeys parses GitSubmoduleSSHKeys, which are host=path
+// pairs of the SSH key to clone submodules from each host with
+func parseSubmoduleSSHKeys(pairs []string) (map[string]string, error) {
+	keys := map[string]string{}
+	for _, pair := range pairs {
+		host, key, ok := strings.Cut(pair, "=")
+		host, key = strings.TrimSpace(host), strings.TrimSpace(key)
+		if !ok || host == "" || key == "" {
+			return nil, fmt.Errorf("Invalid submodule SSH key %q, expected host=path", pair)
+		}
+		if strings.ContainsAny(host, " \t\n\"") || strings.ContainsAny(key, "\n\"") {
+			return nil, fmt.Errorf("Invalid submodule SSH key %q", pair)
+		}
+		keys[host] = key
+	}
+	return keys, nil
+}
+
+// submoduleSSHConfig returns an SSH config that uses the key for each host,
+// and only that key, falling back on the user's and system's config
+func submoduleSSHConfig(keys map[string]string) string {
+	var hosts []string
+	for host := range keys {
+		hosts = append(hosts, host)
+	}
+	// Sorted so the config is the same each time
+	sort.Strings(hosts)
+
+	var config strings.Builder
+	config.WriteString("# Written by the buildkite-agent to clone submodules\n")
+	for _, host := range hosts {
+		fmt.Fprintf(&config, "Host %s\n  IdentityFile \"%s\"\n  IdentitiesOnly yes\n\n", host, keys[host])
+	}
+	config.WriteString("Host *\n  Include ~/.ssh/config\n  Include /etc/ssh/ssh_config\n")
+	return config.String()
+}
+
+// withSubmoduleSSH sets GIT_SSH_COMMAND for cloning submodules until the
+// returned func is called. Submodules of submodules aren't known about until
+// their superproject's cloned, so they can't be keyscanned beforehand. With
+// ssh-keyscan, ssh accepts the keys of hosts it doesn't know yet instead, and
+// with strict host checking it fails rather than asking. Hosts with a
+// GitSubmoduleSSHKeys key are cloned from with it.
+func (b *Bootstrap) withSubmoduleSSH() (func(), error) {
+	// GIT_SSH_COMMAND would take precedence over a GIT_SSH the job has set
+	previous, hasSSHCommand := b.shell.Env.Get("GIT_SSH_COMMAND")
+	if _, hasSSH := b.shell.Env.Get("GIT_SSH"); hasSSH && !hasSSHCommand {
+		return func() {}, nil
+	}
+	sshCommand := previous
+	if !hasSSHCommand {
+		sshCommand = "ssh"
+	}
+
+	switch {
+	case b.SSHStrictHostChecking:
+		sshCommand += " -o BatchMode=yes"
+	case b.SSHKeyscan:
+		sshCommand += " -o StrictHostKeyChecking=accept-new"
+	}
+
+	keys, err := parseSubmoduleSSHKeys(b.GitSubmoduleSSHKeys)
+	if err != nil {
+		return nil, err
+	}
+	var configPath string
+	if len(keys) > 0 {
+		configFile, err := shell.TempFileWithExtension("buildkite-submodule-ssh-config")
+		if err != nil {
+			return nil, err
+		}
+		_, err = configFile.WriteString(submoduleSSHConfig(keys))
+		configFile.Close()
+		if err != nil {
+			os.Remove(configFile.Name())
+			return nil, err
+		}
+		configPath = configFile.Name()
+		sshCommand += " -F " + shellwords.Quote(configPath)
+	}
+
+	b.shell.Env.Set("GIT_SSH_COMMAND", sshCommand)
+	return func() {
+		if hasSSHCommand {
+			b.shell.Env.Set("GIT_SSH_COMMAND", previous)
+		} else {
+			b.shell.Env.Remove("GIT_SSH_COMMAND")
+		}
+		if configPath != "" {
+			os.Remove(configPath)
+		}
+	}, nil
+}
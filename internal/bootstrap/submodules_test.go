@@ -0,0 +1,125 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSubmoduleURL(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		superproject, submodule, want string
+	}{
+		{"git@github.com:buildkite/agent.git", "git@gitlab.com:buildkite/other.git", "git@gitlab.com:buildkite/other.git"},
+		{"git@github.com:buildkite/agent.git", "../other.git", "git@github.com:buildkite/other.git"},
+		{"git@github.com:buildkite/agent.git", "../../elsewhere/other.git", "git@github.com:elsewhere/other.git"},
+		{"git@github.com:buildkite/agent.git", "./vendor/lib.git", "git@github.com:buildkite/agent.git/vendor/lib.git"},
+		{"https://github.com/buildkite/agent.git", "../other.git", "https://github.com/buildkite/other.git"},
+		{"ssh://git@example.com:2222/buildkite/agent.git", "../other.git", "ssh://git@example.com:2222/buildkite/other.git"},
+	} {
+		assert.Equal(t, test.want, resolveSubmoduleURL(test.superproject, test.submodule), "%s + %s", test.superproject, test.submodule)
+	}
+
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, "/repos/other.git", resolveSubmoduleURL("/repos/agent.git", "../other.git"))
+	}
+}
+
+func TestParseSubmoduleSSHKeys(t *testing.T) {
+	t.Parallel()
+
+	keys, err := parseSubmoduleSSHKeys([]string{"github.com=/keys/github", " gitlab.com = /keys/gitlab "})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"github.com": "/keys/github", "gitlab.com": "/keys/gitlab"}, keys)
+
+	for _, invalid := range []string{"github.com", "=/keys/github", "github.com=", "git hub.com=/keys/github", `github.com=/keys/"github`} {
+		_, err := parseSubmoduleSSHKeys([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestSubmoduleSSHConfig(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "# Written by the buildkite-agent to clone submodules\n"+
+		"Host github.com\n  IdentityFile \"/keys/github\"\n  IdentitiesOnly yes\n\n"+
+		"Host gitlab.com\n  IdentityFile \"/keys/gitlab\"\n  IdentitiesOnly yes\n\n"+
+		"Host *\n  Include ~/.ssh/config\n  Include /etc/ssh/ssh_config\n",
+		submoduleSSHConfig(map[string]string{"gitlab.com": "/keys/gitlab", "github.com": "/keys/github"}))
+}
+
+func TestWithSubmoduleSSH(t *testing.T) {
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Remove("GIT_SSH")
+	sh.Env.Remove("GIT_SSH_COMMAND")
+
+	b := &Bootstrap{
+		Config: Config{
+			SSHKeyscan:          true,
+			GitSubmoduleSSHKeys: []string{"gitlab.com=/keys/gitlab"},
+		},
+		shell: sh,
+	}
+
+	restore, err := b.withSubmoduleSSH()
+	require.NoError(t, err)
+
+	sshCommand, _ := sh.Env.Get("GIT_SSH_COMMAND")
+	assert.True(t, strings.HasPrefix(sshCommand, "ssh -o StrictHostKeyChecking=accept-new -F "), sshCommand)
+
+	configPath := strings.Trim(strings.TrimPrefix(sshCommand, "ssh -o StrictHostKeyChecking=accept-new -F "), "'")
+	config, err := os.ReadFile(configPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(config), "Host gitlab.com\n  IdentityFile \"/keys/gitlab\"")
+
+	restore()
+
+	assert.False(t, sh.Env.Exists("GIT_SSH_COMMAND"))
+	_, err = os.Stat(configPath)
+	assert.True(t, os.IsNotExist(err), "the SSH config should have been removed")
+}
+
+func TestWithSubmoduleSSHKeepsTheJobsSSHCommand(t *testing.T) {
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Set("GIT_SSH_COMMAND", "ssh -i /keys/deploy")
+
+	b := &Bootstrap{Config: Config{SSHStrictHostChecking: true}, shell: sh}
+
+	restore, err := b.withSubmoduleSSH()
+	require.NoError(t, err)
+
+	sshCommand, _ := sh.Env.Get("GIT_SSH_COMMAND")
+	assert.Equal(t, "ssh -i /keys/deploy -o BatchMode=yes", sshCommand)
+
+	restore()
+
+	sshCommand, _ = sh.Env.Get("GIT_SSH_COMMAND")
+	assert.Equal(t, "ssh -i /keys/deploy", sshCommand)
+}
+
+func TestWithSubmoduleSSHLeavesGitSSHAlone(t *testing.T) {
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Remove("GIT_SSH_COMMAND")
+	sh.Env.Set("GIT_SSH", filepath.Join("bin", "my-ssh"))
+
+	b := &Bootstrap{Config: Config{SSHKeyscan: true}, shell: sh}
+
+	restore, err := b.withSubmoduleSSH()
+	require.NoError(t, err)
+	assert.False(t, sh.Env.Exists("GIT_SSH_COMMAND"))
+	restore()
+}
@@ -0,0 +1,119 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/shell"
+)
+
+// Names of the parts of starting a job that the bootstrap times. They can
+// overlap, e.g. the clone includes any ssh-keyscan done as part of it.
+const (
+	StartTimingHookDiscovery = "hook_discovery"
+	StartTimingKeyscan       = "keyscan"
+	StartTimingClone         = "clone"
+	StartTimingPluginFetch   = "plugin_fetch"
+	StartTimingLockWait      = "lock_wait"
+)
+
+// StartTimings records how long the bootstrap spent on each part of getting a
+// job started, up until the job's command was run. It's written to a file so
+// the agent can report it alongside its own timings.
+type StartTimings struct {
+	// Total time spent on each part, keyed by one of the StartTiming* names
+	Durations map[string]time.Duration `json:"durations"`
+
+	// When the bootstrap started and when the command was run. The command
+	// time is zero if the job never got that far.
+	BootstrapStartedAt time.Time `json:"bootstrap_started_at"`
+	CommandStartedAt   time.Time `json:"command_started_at"`
+
+	// How many stale lock files, left by processes that weren't running any
+	// more, were broken to get the job started
+	StaleLocksBroken int `json:"stale_locks_broken,omitempty"`
+
+	mu sync.Mutex
+}
+
+func newStartTimings() *StartTimings {
+	return &StartTimings{
+		Durations:          map[string]time.Duration{},
+		BootstrapStartedAt: time.Now(),
+	}
+}
+
+// track starts timing the named part, and returns a func that stops it. Time
+// spent after the command has started isn't counted.
+func (t *StartTimings) track(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if !t.CommandStartedAt.IsZero() {
+			return
+		}
+		t.Durations[name] += time.Since(start)
+	}
+}
+
+// lockWaited adds the time spent waiting for a lock. Like track, locks waited
+// for after the command has started aren't counted.
+func (t *StartTimings) lockWaited(w shell.LockWait) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.CommandStartedAt.IsZero() {
+		return
+	}
+	t.Durations[StartTimingLockWait] += w.Duration
+	t.StaleLocksBroken += w.StaleBroken
+}
+
+// commandStarted marks the point at which the job's command is run
+func (t *StartTimings) commandStarted() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.CommandStartedAt.IsZero() {
+		t.CommandStartedAt = time.Now()
+	}
+}
+
+// writeFile writes the timings as JSON to path
+func (t *StartTimings) writeFile(path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// ReadStartTimingsFile reads timings written by a bootstrap
+func ReadStartTimingsFile(path string) (*StartTimings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var t StartTimings
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
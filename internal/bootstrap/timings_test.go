@@ -0,0 +1,75 @@
+package bootstrap
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartTimingsStopCountingOnceCommandStarts(t *testing.T) {
+	t.Parallel()
+
+	timings := newStartTimings()
+
+	stop := timings.track(StartTimingClone)
+	time.Sleep(time.Millisecond)
+	stop()
+
+	before := timings.Durations[StartTimingClone]
+	assert.Greater(t, before, time.Duration(0))
+
+	timings.commandStarted()
+
+	stop = timings.track(StartTimingClone)
+	stop()
+	assert.Equal(t, before, timings.Durations[StartTimingClone])
+}
+
+func TestStartTimingsRoundTripThroughFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "timings.json")
+
+	timings := newStartTimings()
+	timings.Durations[StartTimingKeyscan] = 1500 * time.Millisecond
+	timings.commandStarted()
+
+	if err := timings.writeFile(path); err != nil {
+		t.Fatalf("timings.writeFile(%q) error = %v", path, err)
+	}
+
+	read, err := ReadStartTimingsFile(path)
+	if err != nil {
+		t.Fatalf("ReadStartTimingsFile(%q) error = %v", path, err)
+	}
+
+	assert.Equal(t, timings.Durations, read.Durations)
+	assert.True(t, timings.CommandStartedAt.Equal(read.CommandStartedAt))
+	assert.True(t, timings.BootstrapStartedAt.Equal(read.BootstrapStartedAt))
+}
+
+func TestNilStartTimingsAreIgnored(t *testing.T) {
+	t.Parallel()
+
+	var timings *StartTimings
+	timings.track(StartTimingClone)()
+	timings.commandStarted()
+}
+
+func TestStartTimingsAddLockWaits(t *testing.T) {
+	t.Parallel()
+
+	timings := newStartTimings()
+	timings.lockWaited(shell.LockWait{Duration: time.Second, Acquired: true, StaleBroken: 1})
+	timings.lockWaited(shell.LockWait{Duration: 2 * time.Second, Acquired: true})
+	assert.Equal(t, 3*time.Second, timings.Durations[StartTimingLockWait])
+	assert.Equal(t, 1, timings.StaleLocksBroken)
+
+	timings.commandStarted()
+	timings.lockWaited(shell.LockWait{Duration: time.Second, StaleBroken: 1})
+	assert.Equal(t, 3*time.Second, timings.Durations[StartTimingLockWait])
+	assert.Equal(t, 1, timings.StaleLocksBroken)
+}
@@ -0,0 +1,81 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/buildkite/agent/v3/shell"
+)
+
+// A tmpfs build directory with less than this fraction of its space left at
+// the end of a job is considered to have overflowed
+const tmpfsFullThreshold = 0.01
+
+// tmpfsBuildDir is a size-capped, RAM-backed filesystem mounted over the
+// checkout directory for the duration of a single job
+type tmpfsBuildDir struct {
+	mountPath string
+	size      string
+}
+
+// mountTmpfsBuildDir mounts a fresh tmpfs at the current checkout path
+func (b *Bootstrap) mountTmpfsBuildDir(ctx context.Context) error {
+	if runtime.GOOS != "linux" {
+		return errors.New("tmpfs build directories are only supported on linux")
+	}
+
+	checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
+
+	b.shell.Commentf("Mounting %s tmpfs for %s", b.Config.BuildDirTmpfsSize, checkoutPath)
+
+	if err := os.MkdirAll(checkoutPath, b.directoryMode()); err != nil {
+		return err
+	}
+
+	// The mount's root has the mode of the build directory
+	mode := os.FileMode(0755)
+	if b.Config.DirectoryMode != 0 {
+		mode = b.Config.DirectoryMode
+	}
+
+	if err := b.shell.Run(ctx, "mount", "-t", "tmpfs",
+		"-o", fmt.Sprintf("size=%s,mode=%04o", b.Config.BuildDirTmpfsSize, mode),
+		"buildkite-tmpfs", checkoutPath); err != nil {
+		return fmt.Errorf("Failed to mount tmpfs build directory: %w", err)
+	}
+
+	b.buildDirMount = &tmpfsBuildDir{
+		mountPath: checkoutPath,
+		size:      b.Config.BuildDirTmpfsSize,
+	}
+
+	return nil
+}
+
+// Close unmounts the tmpfs, first checking whether the job ran out of space
+// on it. A full tmpfs shows up as a grab bag of "No space left on device"
+// errors from whatever happened to be writing at the time, so we call it out.
+func (d *tmpfsBuildDir) Close(ctx context.Context, sh *shell.Shell) {
+	if d.full() {
+		sh.Errorf("The tmpfs build directory %s ran out of space (limit %s). "+
+			"Increase the agent's build-dir-tmpfs-size, or run this pipeline on agents without tmpfs build directories.",
+			d.mountPath, d.size)
+	}
+
+	sh.Commentf("Unmounting tmpfs for %s", d.mountPath)
+
+	if err := sh.Run(ctx, "umount", d.mountPath); err != nil {
+		sh.Warningf("Failed to unmount tmpfs build directory: %v", err)
+	}
+}
+
+func (d *tmpfsBuildDir) full() bool {
+	avail, total, err := diskSpace(d.mountPath)
+	if err != nil || total == 0 {
+		return false
+	}
+	return float64(avail)/float64(total) < tmpfsFullThreshold
+}
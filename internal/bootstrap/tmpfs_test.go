@@ -0,0 +1,64 @@
+package bootstrap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/buildkite/bintest/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountingAndClosingTmpfsBuildDir(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("tmpfs build directories are only supported on linux")
+	}
+
+	checkoutPath := filepath.Join(t.TempDir(), "my-pipeline")
+
+	mount, err := bintest.NewMock("mount")
+	if err != nil {
+		t.Fatalf("bintest.NewMock(mount) error = %v", err)
+	}
+	defer mount.CheckAndClose(t)
+
+	umount, err := bintest.NewMock("umount")
+	if err != nil {
+		t.Fatalf("bintest.NewMock(umount) error = %v", err)
+	}
+	defer umount.CheckAndClose(t)
+
+	mount.Expect("-t", "tmpfs", "-o", "size=512M,mode=0755", "buildkite-tmpfs", checkoutPath).AndExitWith(0)
+	umount.Expect(checkoutPath).AndExitWith(0)
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Set("PATH", filepath.Dir(mount.Path)+string(os.PathListSeparator)+filepath.Dir(umount.Path))
+	sh.Env.Set("BUILDKITE_BUILD_CHECKOUT_PATH", checkoutPath)
+
+	b := &Bootstrap{
+		Config: Config{
+			BuildDirTmpfs:     true,
+			BuildDirTmpfsSize: "512M",
+		},
+		shell: sh,
+	}
+
+	if err := b.mountBuildDir(context.Background()); err != nil {
+		t.Fatalf("b.mountBuildDir(ctx) error = %v", err)
+	}
+
+	assert.DirExists(t, checkoutPath)
+	assert.IsType(t, &tmpfsBuildDir{}, b.buildDirMount)
+
+	// The mock mount doesn't really mount anything, so this is the temp dir's
+	// filesystem, which hopefully isn't full
+	assert.False(t, b.buildDirMount.(*tmpfsBuildDir).full())
+
+	b.closeBuildDirMount(context.Background())
+	assert.Nil(t, b.buildDirMount)
+}
@@ -7,7 +7,7 @@ import (
 	"strconv"
 
 	"github.com/buildkite/agent/v3/env"
-	"github.com/buildkite/agent/v3/tracetools"
+	"github.com/buildkite/agent/v3/internal/tracetools"
 	"github.com/buildkite/agent/v3/version"
 	"github.com/opentracing/opentracing-go"
 	"go.opentelemetry.io/contrib/propagators/aws/xray"
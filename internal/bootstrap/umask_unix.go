@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package bootstrap
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// setUmask sets the umask of the bootstrap, which the processes it starts
+// inherit
+func setUmask(mask os.FileMode) error {
+	unix.Umask(int(mask))
+	return nil
+}
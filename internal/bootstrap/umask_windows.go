@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package bootstrap
+
+import (
+	"errors"
+	"os"
+)
+
+// setUmask returns an error on Windows, which has no umask
+func setUmask(mask os.FileMode) error {
+	return errors.New("umasks aren't supported on Windows")
+}
@@ -0,0 +1,78 @@
+package bootstrap
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/buildkite/agent/v3/internal/tracetools"
+)
+
+// Lines longer than this are only scanned for spans from their end
+const maxUserSpanLineLength = 64 * 1024
+
+// userSpanWriter adds the spans marked in the job's output with
+// buildkite-agent span to the job's trace, as the output's written
+type userSpanWriter struct {
+	w       io.Writer
+	ctx     context.Context
+	backend string
+	scanner *tracetools.UserSpanScanner
+
+	// The line being written. Stdout and stderr can be written at once.
+	mu   sync.Mutex
+	line []byte
+}
+
+func newUserSpanWriter(ctx context.Context, w io.Writer, backend string) *userSpanWriter {
+	return &userSpanWriter{
+		w:       w,
+		ctx:     ctx,
+		backend: backend,
+		scanner: tracetools.NewUserSpanScanner(),
+	}
+}
+
+func (u *userSpanWriter) Write(p []byte) (int, error) {
+	n, err := u.w.Write(p)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for rest := p[:n]; len(rest) > 0; {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			u.line = append(u.line, rest...)
+			break
+		}
+		u.line = append(u.line, rest[:i]...)
+		u.scan()
+		rest = rest[i+1:]
+	}
+
+	// Markers are short, so only the end of a long line needs keeping
+	if len(u.line) > maxUserSpanLineLength {
+		u.line = append(u.line[:0], u.line[len(u.line)-1024:]...)
+	}
+
+	return n, err
+}
+
+// Close scans the last line, if it wasn't ended with a newline
+func (u *userSpanWriter) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if len(u.line) > 0 {
+		u.scan()
+	}
+	return nil
+}
+
+func (u *userSpanWriter) scan() {
+	for _, span := range u.scanner.Scan(string(u.line)) {
+		tracetools.RecordUserSpan(u.ctx, span, u.backend)
+	}
+	u.line = u.line[:0]
+}
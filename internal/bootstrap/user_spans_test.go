@@ -0,0 +1,53 @@
+package bootstrap
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/tracetools"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestUserSpanWriterAddsSpansToTheTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	start := time.UnixMilli(1690000000000)
+	output := tracetools.UserSpanMarker("start", "npm install", start) + "added 1203 packages\n" +
+		tracetools.UserSpanMarker("end", "npm install", start.Add(time.Minute)) +
+		tracetools.UserSpanMarker("start", "webpack", start.Add(time.Minute)) + "compiled\r\n" +
+		tracetools.UserSpanMarker("end", "webpack", start.Add(2*time.Minute))
+
+	var out bytes.Buffer
+	w := newUserSpanWriter(context.Background(), &out, tracetools.BackendOpenTelemetry)
+
+	// The output's written in pieces that split the markers
+	for i := 0; i < len(output); i += 7 {
+		end := i + 7
+		if end > len(output) {
+			end = len(output)
+		}
+		_, err := w.Write([]byte(output[i:end]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	// It's all written through
+	assert.Equal(t, output, out.String())
+
+	ended := recorder.Ended()
+	require.Len(t, ended, 2)
+	assert.Equal(t, "npm install", ended[0].Name())
+	assert.Equal(t, time.Minute, ended[0].EndTime().Sub(ended[0].StartTime()))
+	assert.Equal(t, "webpack", ended[1].Name())
+	assert.Equal(t, start.Add(2*time.Minute), ended[1].EndTime())
+}
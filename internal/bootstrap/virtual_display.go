@@ -0,0 +1,219 @@
+package bootstrap
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// The size of a virtual display, unless another's asked for
+	defaultVirtualDisplaySize = "1920x1080"
+
+	// How long a virtual display gets to start, and to stop before it's killed
+	virtualDisplayStartTimeout = 10 * time.Second
+	virtualDisplayStopTimeout  = 5 * time.Second
+)
+
+// virtualDisplay is an Xvfb or headless Wayland display that lives as long as
+// a job
+type virtualDisplay struct {
+	kind string
+	size string
+	cmd  *exec.Cmd
+	done chan struct{}
+
+	// The variables that point the job at the display
+	env map[string]string
+
+	// The runtime directory a Wayland compositor puts its socket in
+	runtimeDir string
+}
+
+// parseVirtualDisplaySize checks a size like 1920x1080
+func parseVirtualDisplaySize(size string) (width, height string, err error) {
+	width, height, ok := strings.Cut(size, "x")
+	if !ok || strings.Trim(width, "0123456789") != "" || strings.Trim(height, "0123456789") != "" || width == "" || height == "" {
+		return "", "", fmt.Errorf("invalid virtual display size %q, expected one like 1920x1080", size)
+	}
+	return width, height, nil
+}
+
+// startVirtualDisplay starts an "xvfb" or "wayland" display, returning once
+// it's ready for clients
+func startVirtualDisplay(ctx context.Context, kind, size string, log io.Writer) (*virtualDisplay, error) {
+	width, height, err := parseVirtualDisplaySize(size)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &virtualDisplay{kind: kind, size: size, done: make(chan struct{})}
+	switch kind {
+	case "xvfb":
+		err = d.startXvfb(ctx, log)
+	case "wayland":
+		err = d.startWeston(ctx, width, height, log)
+	default:
+		err = fmt.Errorf("unknown virtual display %q, expected xvfb or wayland", kind)
+	}
+	if err != nil {
+		d.stop()
+		return nil, err
+	}
+	return d, nil
+}
+
+// startXvfb starts Xvfb on whichever display is free, which it writes to the
+// -displayfd pipe once it's ready, so jobs on the same host don't race
+func (d *virtualDisplay) startXvfb(ctx context.Context, log io.Writer) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	d.cmd = exec.Command("Xvfb", "-displayfd", "3", "-screen", "0", d.size+"x24", "-nolisten", "tcp")
+	d.cmd.ExtraFiles = []*os.File{w}
+	err = d.start(log)
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to start Xvfb: %w", err)
+	}
+
+	display := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(r).ReadString('\n')
+		display <- strings.TrimSpace(line)
+	}()
+
+	select {
+	case n := <-display:
+		if n == "" {
+			return errors.New("Xvfb exited before it was ready")
+		}
+		d.env = map[string]string{"DISPLAY": ":" + n}
+		return nil
+	case <-d.done:
+		return errors.New("Xvfb exited before it was ready")
+	case <-time.After(virtualDisplayStartTimeout):
+		return errors.New("Timed out waiting for Xvfb to start")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startWeston starts a headless Weston compositor with its socket in a
+// runtime directory of its own
+func (d *virtualDisplay) startWeston(ctx context.Context, width, height string, log io.Writer) error {
+	var err error
+	d.runtimeDir, err = os.MkdirTemp("", "buildkite-wayland-")
+	if err != nil {
+		return err
+	}
+	socket := filepath.Join(d.runtimeDir, "wayland-0")
+
+	d.cmd = exec.Command("weston", "--backend=headless-backend.so", "--socket=wayland-0",
+		"--width="+width, "--height="+height, "--idle-time=0")
+	d.cmd.Env = append(os.Environ(), "XDG_RUNTIME_DIR="+d.runtimeDir)
+	if err := d.start(log); err != nil {
+		return fmt.Errorf("Failed to start weston: %w", err)
+	}
+
+	timeout := time.After(virtualDisplayStartTimeout)
+	for {
+		if _, err := os.Stat(socket); err == nil {
+			// Clients find an absolute WAYLAND_DISPLAY without XDG_RUNTIME_DIR
+			d.env = map[string]string{"WAYLAND_DISPLAY": socket}
+			return nil
+		}
+
+		select {
+		case <-d.done:
+			return errors.New("weston exited before it was ready")
+		case <-timeout:
+			return errors.New("Timed out waiting for weston to start")
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (d *virtualDisplay) start(log io.Writer) error {
+	d.cmd.Stdout = log
+	d.cmd.Stderr = log
+	d.cmd.SysProcAttr = backgroundProcessSysProcAttr()
+	if err := d.cmd.Start(); err != nil {
+		d.cmd = nil
+		return err
+	}
+	go func() {
+		_ = d.cmd.Wait()
+		close(d.done)
+	}()
+	return nil
+}
+
+// stop stops the display and anything it started, killing them if they
+// don't stop in time
+func (d *virtualDisplay) stop() {
+	if d.cmd != nil {
+		_ = signalBackgroundProcess(d.cmd.Process, false)
+		select {
+		case <-d.done:
+		case <-time.After(virtualDisplayStopTimeout):
+			_ = signalBackgroundProcess(d.cmd.Process, true)
+			<-d.done
+		}
+		d.cmd = nil
+	}
+	if d.runtimeDir != "" {
+		_ = os.RemoveAll(d.runtimeDir)
+	}
+}
+
+// startManagedVirtualDisplay starts the virtual display the job's asked for,
+// if any, and points the job at it
+func (b *Bootstrap) startManagedVirtualDisplay(ctx context.Context) error {
+	if b.VirtualDisplay == "" {
+		return nil
+	}
+
+	size := b.VirtualDisplaySize
+	if size == "" {
+		size = defaultVirtualDisplaySize
+	}
+
+	b.shell.Headerf("Starting a virtual display")
+	d, err := startVirtualDisplay(ctx, b.VirtualDisplay, size, b.shell.Writer)
+	if err != nil {
+		return err
+	}
+	b.virtualDisplay = d
+
+	for k, v := range d.env {
+		b.shell.Commentf("%s=%s", k, v)
+		b.shell.Env.Set(k, v)
+	}
+	return nil
+}
+
+// stopManagedVirtualDisplay stops the display started by
+// startManagedVirtualDisplay, if any
+func (b *Bootstrap) stopManagedVirtualDisplay() {
+	if b.virtualDisplay == nil {
+		return
+	}
+	b.virtualDisplay.stop()
+	for k := range b.virtualDisplay.env {
+		b.shell.Env.Remove(k)
+	}
+	b.virtualDisplay = nil
+}
@@ -0,0 +1,51 @@
+package bootstrap
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVirtualDisplaySize(t *testing.T) {
+	t.Parallel()
+
+	width, height, err := parseVirtualDisplaySize("1280x720")
+	require.NoError(t, err)
+	assert.Equal(t, "1280", width)
+	assert.Equal(t, "720", height)
+
+	for _, size := range []string{"", "1280", "1280x", "x720", "1280x720x24", "wide x tall"} {
+		_, _, err := parseVirtualDisplaySize(size)
+		assert.Error(t, err, size)
+	}
+}
+
+func TestStartVirtualDisplayWithUnknownKind(t *testing.T) {
+	t.Parallel()
+
+	_, err := startVirtualDisplay(context.Background(), "x11", "1920x1080", io.Discard)
+	assert.Error(t, err)
+}
+
+func TestStartingAndStoppingXvfb(t *testing.T) {
+	t.Parallel()
+
+	if _, err := exec.LookPath("Xvfb"); err != nil {
+		t.Skip("Xvfb isn't installed")
+	}
+
+	d, err := startVirtualDisplay(context.Background(), "xvfb", "640x480", io.Discard)
+	require.NoError(t, err)
+	assert.Regexp(t, `^:\d+$`, d.env["DISPLAY"])
+
+	d.stop()
+	select {
+	case <-d.done:
+	default:
+		t.Fatal("Xvfb is still running")
+	}
+}
@@ -0,0 +1,1967 @@
+package clicommand
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/bootstrap"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/buildkite/agent/v3/internal/experiments"
+	"github.com/buildkite/agent/v3/internal/hook"
+	"github.com/buildkite/agent/v3/internal/locale"
+	"github.com/buildkite/agent/v3/internal/metrics"
+	"github.com/buildkite/agent/v3/internal/status"
+	"github.com/buildkite/agent/v3/internal/tracetools"
+	"github.com/buildkite/agent/v3/internal/utils"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/process"
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/buildkite/agent/v3/version"
+	"github.com/buildkite/shellwords"
+	"github.com/urfave/cli"
+	"golang.org/x/exp/maps"
+)
+
+const startDescription = `Usage:
+
+   buildkite-agent start [options...]
+
+Description:
+
+   When a job is ready to run it will call the "bootstrap-script"
+   and pass it all the environment variables required for the job to run.
+   This script is responsible for checking out the code, and running the
+   actual build script defined in the pipeline.
+
+   The agent will run any jobs within a PTY (pseudo terminal) if available.
+
+Example:
+
+   $ buildkite-agent start --token xxx`
+
+// Adding config requires changes in a few different spots
+// - The AgentStartConfig struct with a cli parameter
+// - As a flag in the AgentStartCommand (with matching env)
+// - Into an env to be passed to the bootstrap in agent/job_runner.go, createEnvironment()
+// - Into clicommand/bootstrap.go to read it from the env into the bootstrap config
+
+type AgentStartConfig struct {
+	Config                      string   `cli:"config"`
+	Name                        string   `cli:"name"`
+	Priority                    string   `cli:"priority"`
+	AcquireJob                  string   `cli:"acquire-job"`
+	DisconnectAfterJob          bool     `cli:"disconnect-after-job"`
+	DisconnectAfterIdleTimeout  int      `cli:"disconnect-after-idle-timeout"`
+	BootstrapScript             string   `cli:"bootstrap-script" normalize:"commandpath"`
+	CancelGracePeriod           int      `cli:"cancel-grace-period"`
+	SignalGracePeriodSeconds    int      `cli:"signal-grace-period-seconds"`
+	EnableJobLogTmpfile         bool     `cli:"enable-job-log-tmpfile"`
+	BuildPath                   string   `cli:"build-path" normalize:"filepath" validate:"required"`
+	BuildPathLayout             string   `cli:"build-path-layout"`
+	BuildDirEncryption          string   `cli:"build-dir-encryption"`
+	BuildDirEncryptionSize      string   `cli:"build-dir-encryption-size"`
+	BuildDirTmpfs               bool     `cli:"build-dir-tmpfs"`
+	BuildDirTmpfsSize           string   `cli:"build-dir-tmpfs-size"`
+	BuildDirOverlayPath         string   `cli:"build-dir-overlay-path" normalize:"filepath"`
+	BuildDirOverlayRefresh      int      `cli:"build-dir-overlay-refresh-interval"`
+	BuildDirSELinuxLabel        string   `cli:"build-dir-selinux-label"`
+	HooksPath                   string   `cli:"hooks-path" normalize:"filepath"`
+	HookChecksums               string   `cli:"hook-checksums" normalize:"filepath"`
+	SecretScan                  string   `cli:"secret-scan"`
+	SecretScanRules             string   `cli:"secret-scan-rules" normalize:"filepath"`
+	PolicyScanner               string   `cli:"policy-scanner" normalize:"filepath"`
+	FailureBundlePaths          string   `cli:"failure-bundle-paths"`
+	DockerDaemon                string   `cli:"docker-daemon"`
+	DockerDaemonImage           string   `cli:"docker-daemon-image"`
+	JobRestrictedToken          bool     `cli:"job-restricted-token"`
+	Rootless                    bool     `cli:"rootless"`
+	VirtualDisplay              string   `cli:"virtual-display"`
+	VirtualDisplaySize          string   `cli:"virtual-display-size"`
+	FailureBundleMaxSize        string   `cli:"failure-bundle-max-size"`
+	PluginsPath                 string   `cli:"plugins-path" normalize:"filepath"`
+	PluginsCachePath            string   `cli:"plugins-cache-path" normalize:"filepath"`
+	Shell                       string   `cli:"shell"`
+	Tags                        []string `cli:"tags" normalize:"list"`
+	TagsFromEC2MetaData         bool     `cli:"tags-from-ec2-meta-data"`
+	TagsFromEC2MetaDataPaths    []string `cli:"tags-from-ec2-meta-data-paths" normalize:"list"`
+	TagsFromEC2Tags             bool     `cli:"tags-from-ec2-tags"`
+	TagsFromECSMetaData         bool     `cli:"tags-from-ecs-meta-data"`
+	TagsFromGCPMetaData         bool     `cli:"tags-from-gcp-meta-data"`
+	TagsFromGCPMetaDataPaths    []string `cli:"tags-from-gcp-meta-data-paths" normalize:"list"`
+	TagsFromGCPLabels           bool     `cli:"tags-from-gcp-labels"`
+	TagsFromHost                bool     `cli:"tags-from-host"`
+	TagsFromToolchains          bool     `cli:"tags-from-toolchains"`
+	RegistrationCounterPath     string   `cli:"registration-counter-path" normalize:"filepath"`
+	HostFingerprint             bool     `cli:"host-fingerprint"`
+	HostFingerprintBaseline     string   `cli:"host-fingerprint-baseline" normalize:"filepath"`
+	Attestation                 string   `cli:"attestation"`
+	AttestationTPMKey           string   `cli:"attestation-tpm-key" normalize:"filepath"`
+	MaxJobRuntime               []string `cli:"max-job-runtime" normalize:"list"`
+	BuildDirQuota               []string `cli:"build-dir-quota" normalize:"list"`
+	JobResourceUsage            bool     `cli:"job-resource-usage"`
+	JobEgressPolicy             bool     `cli:"job-egress-policy"`
+	JobEgressAllow              []string `cli:"job-egress-allow" normalize:"list"`
+	JobNetworkAudit             bool     `cli:"job-network-audit"`
+	JobWriteGuard               string   `cli:"job-write-guard"`
+	JobWriteAllow               []string `cli:"job-write-allow" normalize:"list"`
+	JobEphemeralUser            bool     `cli:"job-ephemeral-user"`
+	JobEnvSpillSize             string   `cli:"job-env-spill-size"`
+	JobEnergyEstimate           bool     `cli:"job-energy-estimate"`
+	JobEnergyCPUWatts           string   `cli:"job-energy-cpu-watts"`
+	JobEnergyCarbonIntensity    int      `cli:"job-energy-carbon-intensity"`
+	JobEnergyAnnotation         bool     `cli:"job-energy-annotation"`
+	WaitForEC2TagsTimeout       string   `cli:"wait-for-ec2-tags-timeout"`
+	WaitForEC2MetaDataTimeout   string   `cli:"wait-for-ec2-meta-data-timeout"`
+	WaitForECSMetaDataTimeout   string   `cli:"wait-for-ecs-meta-data-timeout"`
+	WaitForGCPLabelsTimeout     string   `cli:"wait-for-gcp-labels-timeout"`
+	GitCheckoutFlags            string   `cli:"git-checkout-flags"`
+	GitCloneFlags               string   `cli:"git-clone-flags"`
+	GitCloneMirrorFlags         string   `cli:"git-clone-mirror-flags"`
+	GitCleanFlags               string   `cli:"git-clean-flags"`
+	GitFetchFlags               string   `cli:"git-fetch-flags"`
+	GitCheckoutStrategy         string   `cli:"git-checkout-strategy"`
+	GitShallowDepth             int      `cli:"git-shallow-depth"`
+	GitLFS                      bool     `cli:"git-lfs"`
+	GitMirrorsPath              string   `cli:"git-mirrors-path" normalize:"filepath"`
+	GitMirrorsLockTimeout       int      `cli:"git-mirrors-lock-timeout"`
+	GitMirrorsSkipUpdate        bool     `cli:"git-mirrors-skip-update"`
+	NoGitSubmodules             bool     `cli:"no-git-submodules"`
+	NoSSHKeyscan                bool     `cli:"no-ssh-keyscan"`
+	SSHStrict                   bool     `cli:"ssh-strict"`
+	NoCommandEval               bool     `cli:"no-command-eval"`
+	NoLocalHooks                bool     `cli:"no-local-hooks"`
+	NoPlugins                   bool     `cli:"no-plugins"`
+	NoPluginValidation          bool     `cli:"no-plugin-validation"`
+	AllowedPlugins              []string `cli:"allowed-plugins" normalize:"list"`
+	DeniedPlugins               []string `cli:"denied-plugins" normalize:"list"`
+	NoPTY                       bool     `cli:"no-pty"`
+	NoFeatureReporting          bool     `cli:"no-feature-reporting"`
+	TimestampLines              bool     `cli:"timestamp-lines"`
+	CollapseProgressOutput      bool     `cli:"collapse-progress-output"`
+	JobOutputEncoding           string   `cli:"job-output-encoding"`
+	JobLogPhaseMarkers          bool     `cli:"job-log-phase-markers"`
+	JobLogLineMetadata          bool     `cli:"job-log-line-metadata"`
+	JobLogFormat                string   `cli:"job-log-format"`
+	JobUmask                    string   `cli:"job-umask"`
+	JobDirectoryMode            string   `cli:"job-directory-mode"`
+	JobLocale                   string   `cli:"job-locale"`
+	JobTimezone                 string   `cli:"job-timezone"`
+	JobEnv                      []string `cli:"job-env"`
+	ParallelSkewThreshold       int      `cli:"parallel-skew-threshold"`
+	HealthCheckAddr             string   `cli:"health-check-addr"`
+	BuildCacheAddr              string   `cli:"build-cache-addr"`
+	BuildCacheDestination       string   `cli:"build-cache-destination"`
+	ArtifactContentStore        string   `cli:"artifact-content-store" normalize:"filepath"`
+	ArtifactPreviews            bool     `cli:"artifact-previews"`
+	MetricsDatadog              bool     `cli:"metrics-datadog"`
+	MetricsDatadogHost          string   `cli:"metrics-datadog-host"`
+	MetricsDatadogDistributions bool     `cli:"metrics-datadog-distributions"`
+	TracingBackend              string   `cli:"tracing-backend"`
+	TracingServiceName          string   `cli:"tracing-service-name"`
+	Spawn                       int      `cli:"spawn"`
+	SpawnWithPriority           bool     `cli:"spawn-with-priority"`
+	LogFormat                   string   `cli:"log-format"`
+	Locale                      string   `cli:"locale"`
+	CancelSignal                string   `cli:"cancel-signal"`
+	RedactedVars                []string `cli:"redacted-vars" normalize:"list"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+
+	// API config
+	DebugHTTP         bool     `cli:"debug-http"`
+	DNSOverrides      []string `cli:"dns-override" normalize:"list"`
+	DNSResolver       string   `cli:"dns-resolver"`
+	HTTPDebug         string   `cli:"http-debug" normalize:"filepath"`
+	HTTPDebugDuration string   `cli:"http-debug-duration"`
+	Token             string   `cli:"token" validate:"required"`
+	Endpoint          string   `cli:"endpoint" validate:"required"`
+	NoHTTP2           bool     `cli:"no-http2"`
+
+	// Deprecated
+	NoSSHFingerprintVerification bool     `cli:"no-automatic-ssh-fingerprint-verification" deprecated-and-renamed-to:"NoSSHKeyscan"`
+	MetaData                     []string `cli:"meta-data" deprecated-and-renamed-to:"Tags"`
+	MetaDataEC2                  bool     `cli:"meta-data-ec2" deprecated-and-renamed-to:"TagsFromEC2"`
+	MetaDataEC2Tags              bool     `cli:"meta-data-ec2-tags" deprecated-and-renamed-to:"TagsFromEC2Tags"`
+	MetaDataGCP                  bool     `cli:"meta-data-gcp" deprecated-and-renamed-to:"TagsFromGCP"`
+	TagsFromEC2                  bool     `cli:"tags-from-ec2" deprecated-and-renamed-to:"TagsFromEC2MetaData"`
+	TagsFromGCP                  bool     `cli:"tags-from-gcp" deprecated-and-renamed-to:"TagsFromGCPMetaData"`
+	DisconnectAfterJobTimeout    int      `cli:"disconnect-after-job-timeout" deprecated:"Use disconnect-after-idle-timeout instead"`
+}
+
+func (asc AgentStartConfig) Features() []string {
+	if asc.NoFeatureReporting {
+		return []string{}
+	}
+
+	features := make([]string, 0, 8)
+
+	if asc.GitMirrorsPath != "" {
+		features = append(features, "git-mirrors")
+	}
+
+	if asc.AcquireJob != "" {
+		features = append(features, "acquire-job")
+	}
+
+	if asc.BuildDirEncryption != "" {
+		features = append(features, "build-dir-encryption")
+	}
+
+	if asc.BuildDirTmpfs {
+		features = append(features, "build-dir-tmpfs")
+	}
+
+	if asc.BuildDirOverlayPath != "" {
+		features = append(features, "build-dir-overlay")
+	}
+
+	if asc.TracingBackend == tracetools.BackendDatadog {
+		features = append(features, "datadog-tracing")
+	}
+
+	if asc.TracingBackend == tracetools.BackendOpenTelemetry {
+		features = append(features, "opentelemetry-tracing")
+	}
+
+	if asc.DisconnectAfterJob {
+		features = append(features, "disconnect-after-job")
+	}
+
+	if asc.DisconnectAfterIdleTimeout != 0 {
+		features = append(features, "disconnect-after-idle")
+	}
+
+	if asc.NoPlugins {
+		features = append(features, "no-plugins")
+	}
+
+	if asc.NoCommandEval {
+		features = append(features, "no-script-eval")
+	}
+
+	for _, exp := range experiments.Enabled() {
+		features = append(features, fmt.Sprintf("experiment-%s", exp))
+	}
+
+	return features
+}
+
+func DefaultShell() string {
+	// https://github.com/golang/go/blob/master/src/go/build/syslist.go#L7
+	switch runtime.GOOS {
+	case "windows":
+		return `C:\Windows\System32\CMD.exe /S /C`
+	case "freebsd", "openbsd":
+		return "/usr/local/bin/bash -e -c"
+	case "netbsd":
+		return "/usr/pkg/bin/bash -e -c"
+	default:
+		return "/bin/bash -e -c"
+	}
+}
+
+func DefaultConfigFilePaths() (paths []string) {
+	// Toggle beetwen windows and *nix paths
+	if runtime.GOOS == "windows" {
+		paths = []string{
+			"C:\\buildkite-agent\\buildkite-agent.cfg",
+			"$USERPROFILE\\AppData\\Local\\buildkite-agent\\buildkite-agent.cfg",
+			"$USERPROFILE\\AppData\\Local\\BuildkiteAgent\\buildkite-agent.cfg",
+		}
+	} else {
+		paths = []string{
+			"$HOME/.buildkite-agent/buildkite-agent.cfg",
+		}
+
+		// For Apple Silicon Macs, prioritise the `/opt/homebrew` path over `/usr/local`
+		if runtime.GOOS == "darwin" && runtime.GOARCH == "arm64" {
+			paths = append(paths, "/opt/homebrew/etc/buildkite-agent/buildkite-agent.cfg")
+		}
+
+		paths = append(paths, "/usr/local/etc/buildkite-agent/buildkite-agent.cfg", "/etc/buildkite-agent/buildkite-agent.cfg")
+	}
+
+	// Also check to see if there's a buildkite-agent.cfg in the folder
+	// that the binary is running in.
+	exePath, err := os.Executable()
+	if err == nil {
+		pathToBinary, err := filepath.Abs(filepath.Dir(exePath))
+		if err == nil {
+			pathToRelativeConfig := filepath.Join(pathToBinary, "buildkite-agent.cfg")
+			paths = append([]string{pathToRelativeConfig}, paths...)
+		}
+	}
+
+	return
+}
+
+var AgentStartCommand = cli.Command{
+	Name:        "start",
+	Usage:       "Starts a Buildkite agent",
+	Description: startDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "Path to a configuration file",
+			EnvVar: "BUILDKITE_AGENT_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "name",
+			Value:  "",
+			Usage:  "The name of the agent",
+			EnvVar: "BUILDKITE_AGENT_NAME",
+		},
+		cli.StringFlag{
+			Name:   "priority",
+			Value:  "",
+			Usage:  "The priority of the agent (higher priorities are assigned work first)",
+			EnvVar: "BUILDKITE_AGENT_PRIORITY",
+		},
+		cli.StringFlag{
+			Name:   "acquire-job",
+			Value:  "",
+			Usage:  "Start this agent and only run the specified job, disconnecting after it's finished",
+			EnvVar: "BUILDKITE_AGENT_ACQUIRE_JOB",
+		},
+		cli.BoolFlag{
+			Name:   "disconnect-after-job",
+			Usage:  "Disconnect the agent after running exactly one job. When used in conjunction with the ′--spawn′ flag, each worker booted will run exactly one job",
+			EnvVar: "BUILDKITE_AGENT_DISCONNECT_AFTER_JOB",
+		},
+		cli.IntFlag{
+			Name:   "disconnect-after-idle-timeout",
+			Value:  0,
+			Usage:  "The maximum idle time in seconds to wait for a job before disconnecting. The default of 0 means no timeout",
+			EnvVar: "BUILDKITE_AGENT_DISCONNECT_AFTER_IDLE_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "cancel-grace-period",
+			Value:  10,
+			Usage:  "The number of seconds a canceled or timed out job is given to gracefully terminate and upload its artifacts",
+			EnvVar: "BUILDKITE_CANCEL_GRACE_PERIOD",
+		},
+		cli.IntFlag{
+			Name:   "signal-grace-period-seconds",
+			Value:  -1,
+			Usage:  "The number of seconds a canceled job's hooks and command are given to exit before they and any processes they started are killed. It has to be less than --cancel-grace-period, and the default of -1 means one second less",
+			EnvVar: "BUILDKITE_SIGNAL_GRACE_PERIOD_SECONDS",
+		},
+		cli.BoolFlag{
+			Name:   "enable-job-log-tmpfile",
+			Usage:  "Store the job logs in a temporary file ′BUILDKITE_JOB_LOG_TMPFILE′ that is accessible during the job and removed at the end of the job",
+			EnvVar: "BUILDKITE_ENABLE_JOB_LOG_TMPFILE",
+		},
+		cli.StringFlag{
+			Name:   "shell",
+			Value:  DefaultShell(),
+			Usage:  "The shell command used to interpret build commands, e.g /bin/bash -e -c",
+			EnvVar: "BUILDKITE_SHELL",
+		},
+		cli.StringSliceFlag{
+			Name:   "tags",
+			Value:  &cli.StringSlice{},
+			Usage:  "A comma-separated list of tags for the agent (for example, \"linux\" or \"mac,xcode=8\"). Tags and the agent's name can have ${VAR} environment variables, %counter, %image-id and %config-sha in them, which are filled in when the agent registers",
+			EnvVar: "BUILDKITE_AGENT_TAGS",
+		},
+		cli.BoolFlag{
+			Name:   "tags-from-host",
+			Usage:  "Include tags from the host (hostname, machine-id, os)",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_HOST",
+		},
+		cli.BoolFlag{
+			Name:   "tags-from-toolchains",
+			Usage:  "Include tags for the versions of installed tools (git, docker, node, go, python and xcode), and warn when they change",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_TOOLCHAINS",
+		},
+		cli.StringFlag{
+			Name:   "registration-counter-path",
+			Value:  "",
+			Usage:  "Path to the file that counts the agents registered on this host, for %counter in the agent's name and tags. Defaults to a file in the build path",
+			EnvVar: "BUILDKITE_AGENT_REGISTRATION_COUNTER_PATH",
+		},
+		cli.BoolFlag{
+			Name:   "host-fingerprint",
+			Usage:  "Fingerprint the host (OS, kernel, tool versions and kernel settings) at startup, and pass it to jobs as BUILDKITE_AGENT_HOST_FINGERPRINT",
+			EnvVar: "BUILDKITE_HOST_FINGERPRINT",
+		},
+		cli.StringFlag{
+			Name:   "host-fingerprint-baseline",
+			Value:  "",
+			Usage:  "Path to a host fingerprint to warn about differences from. If it doesn't exist, this host's fingerprint is written to it",
+			EnvVar: "BUILDKITE_AGENT_HOST_FINGERPRINT_BASELINE",
+		},
+		cli.StringFlag{
+			Name:   "attestation",
+			Value:  "",
+			Usage:  "Register with signed evidence of this host, so Buildkite can check it's sanctioned hardware or an image before it runs jobs: the EC2 instance identity document (aws), a GCP instance identity token (gcp), or a TPM quote of how the host booted (tpm). Whether it was verified is given to jobs and hooks as BUILDKITE_AGENT_ATTESTATION",
+			EnvVar: "BUILDKITE_AGENT_ATTESTATION",
+		},
+		cli.StringFlag{
+			Name:   "attestation-tpm-key",
+			Value:  "",
+			Usage:  "Path to the context of the TPM attestation key that signs quotes with --attestation tpm, as made by tpm2_createak. Needs tpm2-tools",
+			EnvVar: "BUILDKITE_AGENT_ATTESTATION_TPM_KEY",
+		},
+		cli.StringSliceFlag{
+			Name:   "max-job-runtime",
+			Value:  &cli.StringSlice{},
+			Usage:  "The longest a job can run before the agent cancels it, like 6h, regardless of its timeout in Buildkite. Prefix with a tag to only apply it to jobs run with that tag, like queue=deploy:30m",
+			EnvVar: "BUILDKITE_AGENT_MAX_JOB_RUNTIME",
+		},
+		cli.StringSliceFlag{
+			Name:   "build-dir-quota",
+			Value:  &cli.StringSlice{},
+			Usage:  "The most disk space a pipeline's build directory can use, like 20GB. Jobs that use more are canceled. Prefix with a pipeline slug to only apply it to that pipeline, like my-pipeline=100GB",
+			EnvVar: "BUILDKITE_AGENT_BUILD_DIR_QUOTA",
+		},
+		cli.BoolFlag{
+			Name:   "job-resource-usage",
+			Usage:  "Measure the CPU time, peak memory and disk IO of each job, and set them as the build meta-data job-usage:<job id>. On Linux, jobs are put in their own cgroup to measure everything they start",
+			EnvVar: "BUILDKITE_AGENT_JOB_RESOURCE_USAGE",
+		},
+		cli.BoolFlag{
+			Name:   "job-egress-policy",
+			Usage:  "Run each job in its own network namespace that only allows connections to the Buildkite API, the job's repository, --job-egress-allow, and the pipeline's BUILDKITE_JOB_EGRESS_ALLOW. Blocked connections are logged. Linux only, and needs the agent to run as root with ip, nft and setpriv installed",
+			EnvVar: "BUILDKITE_AGENT_JOB_EGRESS_POLICY",
+		},
+		cli.StringSliceFlag{
+			Name:   "job-egress-allow",
+			Value:  &cli.StringSlice{},
+			Usage:  "CIDRs, IP addresses and domains that jobs are allowed to connect to with --job-egress-policy. Domains are resolved when each job starts",
+			EnvVar: "BUILDKITE_AGENT_JOB_EGRESS_ALLOW",
+		},
+		cli.BoolFlag{
+			Name:   "job-network-audit",
+			Usage:  "Run an HTTP proxy for each job that records the DNS lookups, HTTP hosts and TLS server names of the requests made through it, and upload them as the job artifact network-audit.json. Only sees processes that use HTTP_PROXY and HTTPS_PROXY",
+			EnvVar: "BUILDKITE_AGENT_JOB_NETWORK_AUDIT",
+		},
+		cli.StringFlag{
+			Name:   "job-write-guard",
+			Value:  "",
+			Usage:  "Watch for jobs writing to files outside of their build directory, the temporary directory, --job-write-allow and the pipeline's BUILDKITE_JOB_WRITE_ALLOW, and either log them (log) or cancel the job (fail). Linux only, and needs the agent to run as root",
+			EnvVar: "BUILDKITE_AGENT_JOB_WRITE_GUARD",
+		},
+		cli.StringSliceFlag{
+			Name:   "job-write-allow",
+			Value:  &cli.StringSlice{},
+			Usage:  "More paths, like shared caches, that jobs are allowed to write to with --job-write-guard",
+			EnvVar: "BUILDKITE_AGENT_JOB_WRITE_ALLOW",
+		},
+		cli.BoolFlag{
+			Name:   "job-ephemeral-user",
+			Usage:  "Create a user for each job to run as, with the job's build directory, plugins and temporary files in its home directory, and remove the user, everything it left running and the files it owns when the job finishes, so jobs can't see or change what earlier jobs left behind. Git mirrors aren't used, and jobs can't use the agent's SSH keys or credentials. Linux only, and needs the agent to run as root",
+			EnvVar: "BUILDKITE_AGENT_JOB_EPHEMERAL_USER",
+		},
+		cli.StringFlag{
+			Name:   "job-env-spill-size",
+			Value:  "",
+			Usage:  "Move job environment variables larger than this, like 64KB, into files so they don't make the job's environment too large to start. Each is replaced with <NAME>_FILE, the path to its file",
+			EnvVar: "BUILDKITE_AGENT_JOB_ENV_SPILL_SIZE",
+		},
+		cli.BoolFlag{
+			Name:   "job-energy-estimate",
+			Usage:  "Estimate the energy each job used and the carbon emitted generating it from its CPU time, and include them in its resource usage and metrics",
+			EnvVar: "BUILDKITE_AGENT_JOB_ENERGY_ESTIMATE",
+		},
+		cli.StringFlag{
+			Name:   "job-energy-cpu-watts",
+			Value:  "",
+			Usage:  "The watts one busy CPU draws, for estimating jobs' energy. Defaults to a figure for the EC2 or GCP instance type if it's in the agent's tags, otherwise 3.5",
+			EnvVar: "BUILDKITE_AGENT_JOB_ENERGY_CPU_WATTS",
+		},
+		cli.IntFlag{
+			Name:   "job-energy-carbon-intensity",
+			Value:  agent.DefaultCarbonIntensity,
+			Usage:  "The grams of CO2 equivalent emitted generating a kWh of electricity where the agent runs, for estimating jobs' carbon emissions",
+			EnvVar: "BUILDKITE_AGENT_JOB_ENERGY_CARBON_INTENSITY",
+		},
+		cli.BoolFlag{
+			Name:   "job-energy-annotation",
+			Usage:  "Add each job's energy estimate to a build annotation",
+			EnvVar: "BUILDKITE_AGENT_JOB_ENERGY_ANNOTATION",
+		},
+		cli.StringSliceFlag{
+			Name:   "tags-from-ec2-meta-data",
+			Value:  &cli.StringSlice{},
+			Usage:  "Include the default set of host EC2 meta-data as tags (instance-id, instance-type, ami-id, and instance-life-cycle)",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_EC2_META_DATA",
+		},
+		cli.StringSliceFlag{
+			Name:   "tags-from-ec2-meta-data-paths",
+			Value:  &cli.StringSlice{},
+			Usage:  "Include additional tags fetched from EC2 meta-data using tag & path suffix pairs, e.g \"tag_name=path/to/value\"",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_EC2_META_DATA_PATHS",
+		},
+		cli.BoolFlag{
+			Name:   "tags-from-ec2-tags",
+			Usage:  "Include the host's EC2 tags as tags",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_EC2_TAGS",
+		},
+		cli.BoolFlag{
+			Name:   "tags-from-ecs-meta-data",
+			Usage:  "Include the host's ECS meta-data as tags (container-name, image, and task-arn)",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_ECS_META_DATA",
+		},
+		cli.StringSliceFlag{
+			Name:   "tags-from-gcp-meta-data",
+			Value:  &cli.StringSlice{},
+			Usage:  "Include the default set of host Google Cloud instance meta-data as tags (instance-id, machine-type, preemptible, project-id, region, and zone)",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_GCP_META_DATA",
+		},
+		cli.StringSliceFlag{
+			Name:   "tags-from-gcp-meta-data-paths",
+			Value:  &cli.StringSlice{},
+			Usage:  "Include additional tags fetched from Google Cloud instance meta-data using tag & path suffix pairs, e.g \"tag_name=path/to/value\"",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_GCP_META_DATA_PATHS",
+		},
+		cli.BoolFlag{
+			Name:   "tags-from-gcp-labels",
+			Usage:  "Include the host's Google Cloud instance labels as tags",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_GCP_LABELS",
+		},
+		cli.DurationFlag{
+			Name:   "wait-for-ec2-tags-timeout",
+			Usage:  "The amount of time to wait for tags from EC2 before proceeding",
+			EnvVar: "BUILDKITE_AGENT_WAIT_FOR_EC2_TAGS_TIMEOUT",
+			Value:  time.Second * 10,
+		},
+		cli.DurationFlag{
+			Name:   "wait-for-ec2-meta-data-timeout",
+			Usage:  "The amount of time to wait for meta-data from EC2 before proceeding",
+			EnvVar: "BUILDKITE_AGENT_WAIT_FOR_EC2_META_DATA_TIMEOUT",
+			Value:  time.Second * 10,
+		},
+		cli.DurationFlag{
+			Name:   "wait-for-ecs-meta-data-timeout",
+			Usage:  "The amount of time to wait for meta-data from ECS before proceeding",
+			EnvVar: "BUILDKITE_AGENT_WAIT_FOR_ECS_META_DATA_TIMEOUT",
+			Value:  time.Second * 10,
+		},
+		cli.DurationFlag{
+			Name:   "wait-for-gcp-labels-timeout",
+			Usage:  "The amount of time to wait for labels from GCP before proceeding",
+			EnvVar: "BUILDKITE_AGENT_WAIT_FOR_GCP_LABELS_TIMEOUT",
+			Value:  time.Second * 10,
+		},
+		cli.StringFlag{
+			Name:   "git-checkout-flags",
+			Value:  "-f",
+			Usage:  "Flags to pass to \"git checkout\" command",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_FLAGS",
+		},
+		cli.StringFlag{
+			Name:   "git-clone-flags",
+			Value:  "-v",
+			Usage:  "Flags to pass to the \"git clone\" command",
+			EnvVar: "BUILDKITE_GIT_CLONE_FLAGS",
+		},
+		cli.StringFlag{
+			Name:   "git-clean-flags",
+			Value:  "-ffxdq",
+			Usage:  "Flags to pass to \"git clean\" command",
+			EnvVar: "BUILDKITE_GIT_CLEAN_FLAGS",
+			// -ff: delete files and directories, including untracked nested git repositories
+			// -x: don't use .gitignore rules
+			// -d: recurse into untracked directories
+			// -q: quiet, only report errors
+		},
+		cli.StringFlag{
+			Name:   "git-fetch-flags",
+			Value:  "-v --prune",
+			Usage:  "Flags to pass to \"git fetch\" command",
+			EnvVar: "BUILDKITE_GIT_FETCH_FLAGS",
+		},
+		cli.StringFlag{
+			Name:   "git-clone-mirror-flags",
+			Value:  "-v",
+			Usage:  "Flags to pass to the \"git clone\" command when used for mirroring",
+			EnvVar: "BUILDKITE_GIT_CLONE_MIRROR_FLAGS",
+		},
+		cli.StringFlag{
+			Name:   "git-checkout-strategy",
+			Value:  "full",
+			Usage:  "How to clone repositories, unless a pipeline sets BUILDKITE_GIT_CHECKOUT_STRATEGY: full, shallow with --git-shallow-depth commits of history, or mirror to clone with reference to a mirror in --git-mirrors-path that's shared between jobs and kept up to date",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_STRATEGY",
+		},
+		cli.IntFlag{
+			Name:   "git-shallow-depth",
+			Value:  1,
+			Usage:  "How many commits of history to clone and fetch with --git-checkout-strategy shallow",
+			EnvVar: "BUILDKITE_GIT_SHALLOW_DEPTH",
+		},
+		cli.BoolFlag{
+			Name:   "git-lfs",
+			Usage:  "Pull repositories' Git LFS files all at once after they're checked out. Pipelines can choose which with BUILDKITE_GIT_LFS_INCLUDE and BUILDKITE_GIT_LFS_EXCLUDE",
+			EnvVar: "BUILDKITE_GIT_LFS",
+		},
+		cli.StringFlag{
+			Name:   "git-mirrors-path",
+			Value:  "",
+			Usage:  "Path to where mirrors of git repositories are stored",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_PATH",
+		},
+		cli.IntFlag{
+			Name:   "git-mirrors-lock-timeout",
+			Value:  300,
+			Usage:  "Seconds to lock a git mirror during clone, should exceed your longest checkout",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "git-mirrors-skip-update",
+			Usage:  "Skip updating the Git mirror",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_SKIP_UPDATE",
+		},
+		cli.StringFlag{
+			Name:   "bootstrap-script",
+			Value:  "",
+			Usage:  "The command that is executed for bootstrapping a job, defaults to the bootstrap sub-command of this binary",
+			EnvVar: "BUILDKITE_BOOTSTRAP_SCRIPT_PATH",
+		},
+		cli.StringFlag{
+			Name:   "build-path",
+			Value:  "",
+			Usage:  "Path to where the builds will run from",
+			EnvVar: "BUILDKITE_BUILD_PATH",
+		},
+		cli.StringFlag{
+			Name:   "build-path-layout",
+			Value:  "",
+			Usage:  "How checkout directories in the build path are named. By default they're <agent name>/<organization>/<pipeline>. With \"hashed\", they're <queue>/<pipeline>-<hash>, with a hash of the agent's name, spawn index, organization and pipeline, so each worker on each queue has its own. Either way, a job won't run in a directory another job is still using",
+			EnvVar: "BUILDKITE_BUILD_PATH_LAYOUT",
+		},
+		cli.StringFlag{
+			Name:   "build-dir-encryption",
+			Value:  "",
+			Usage:  "Check out each job onto an ephemeral encrypted volume that is destroyed when the job finishes. Only \"luks\" is supported, and the agent must run as root",
+			EnvVar: "BUILDKITE_BUILD_DIR_ENCRYPTION",
+		},
+		cli.StringFlag{
+			Name:   "build-dir-encryption-size",
+			Value:  "10G",
+			Usage:  "Size of each job's encrypted build directory volume",
+			EnvVar: "BUILDKITE_BUILD_DIR_ENCRYPTION_SIZE",
+		},
+		cli.BoolFlag{
+			Name:   "build-dir-tmpfs",
+			Usage:  "Check out each job onto a RAM-backed tmpfs that is unmounted when the job finishes. Linux only, and the agent must run as root",
+			EnvVar: "BUILDKITE_BUILD_DIR_TMPFS",
+		},
+		cli.StringFlag{
+			Name:   "build-dir-tmpfs-size",
+			Value:  "2G",
+			Usage:  "Maximum size of each job's tmpfs build directory. Jobs that write more than this will fail",
+			EnvVar: "BUILDKITE_BUILD_DIR_TMPFS_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "build-dir-overlay-path",
+			Value:  "",
+			Usage:  "Path to where golden checkouts of each repository are stored. When set, each job is checked out onto a copy-on-write overlay of the golden checkout. Linux only, and the agent must run as root",
+			EnvVar: "BUILDKITE_BUILD_DIR_OVERLAY_PATH",
+		},
+		cli.IntFlag{
+			Name:   "build-dir-overlay-refresh-interval",
+			Value:  3600,
+			Usage:  "Seconds before a golden checkout is replaced with a fresh clone",
+			EnvVar: "BUILDKITE_BUILD_DIR_OVERLAY_REFRESH_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "build-dir-selinux-label",
+			Value:  "",
+			Usage:  "The SELinux label to give checkouts and each job's temporary directory on hosts with SELinux, like system_u:object_r:container_file_t:s0 so containers can bind mount them. The agent checks on start that it can set it",
+			EnvVar: "BUILDKITE_BUILD_DIR_SELINUX_LABEL",
+		},
+		cli.StringFlag{
+			Name:   "hooks-path",
+			Value:  "",
+			Usage:  "Directory where the hook scripts are found",
+			EnvVar: "BUILDKITE_HOOKS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "hook-checksums",
+			Value:  "",
+			Usage:  "Path to a file of SHA-256 checksums, in the format sha256sum writes, that global and repository hooks must match to be run. Hooks are named like global/pre-command or repository/<pipeline slug>/pre-command",
+			EnvVar: "BUILDKITE_HOOK_CHECKSUMS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "secret-scan",
+			Value:  "",
+			Usage:  "Scan the changes each job builds and its artifacts for secrets like API tokens and private keys, and either \"annotate\" the build or \"fail\" the job if any are found. Off by default",
+			EnvVar: "BUILDKITE_SECRET_SCAN",
+		},
+		cli.StringFlag{
+			Name:   "secret-scan-rules",
+			Value:  "",
+			Usage:  "Path to a file of extra rules for --secret-scan, each a line of an ID and a regular expression. \"!<id>\" removes a rule, and \"!default\" removes the default ones",
+			EnvVar: "BUILDKITE_SECRET_SCAN_RULES_PATH",
+		},
+		cli.StringFlag{
+			Name:   "policy-scanner",
+			Value:  "",
+			Usage:  "Path to a program that checks the dependency manifests each job changes against policy, such as allowed licenses. It's given the changed manifests as JSON on stdin, and writes a verdict of pass, warn or fail as JSON to $BUILDKITE_POLICY_VERDICT_PATH",
+			EnvVar: "BUILDKITE_POLICY_SCANNER",
+		},
+		cli.StringFlag{
+			Name:   "failure-bundle-paths",
+			Value:  "",
+			Usage:  "Paths of the checkout to bundle up and upload as an artifact when a job fails, separated by semicolons, like \"logs/**/*;tmp/core.*\". A job can set its own with BUILDKITE_FAILURE_BUNDLE_PATHS. Jobs that pass don't upload one",
+			EnvVar: "BUILDKITE_FAILURE_BUNDLE_PATHS",
+		},
+		cli.StringFlag{
+			Name:   "docker-daemon",
+			Value:  "",
+			Usage:  "Give each job a Docker daemon of its own, so jobs can't see or remove each other's containers. Either \"dind\", a privileged Docker-in-Docker container, or \"rootless\", a rootless dockerd. DOCKER_HOST points the job at it",
+			EnvVar: "BUILDKITE_DOCKER_DAEMON",
+		},
+		cli.StringFlag{
+			Name:   "docker-daemon-image",
+			Value:  "docker:dind",
+			Usage:  "The image of each job's Docker-in-Docker container, with --docker-daemon dind",
+			EnvVar: "BUILDKITE_DOCKER_DAEMON_IMAGE",
+		},
+		cli.BoolFlag{
+			Name:   "job-restricted-token",
+			Usage:  "Run jobs with a restricted token, without administrator rights or privileges and at medium integrity, and label the agent's configuration file high integrity so jobs can't read it. Windows only, and the agent must be elevated or a service",
+			EnvVar: "BUILDKITE_JOB_RESTRICTED_TOKEN",
+		},
+		cli.BoolFlag{
+			Name:   "rootless",
+			Usage:  "Run jobs rootless. The agent checks on start that it isn't root and that the host has what rootless containers need, points jobs at the user's rootless Docker daemon, and removes build directories with files owned by subordinate IDs in a user namespace",
+			EnvVar: "BUILDKITE_ROOTLESS",
+		},
+		cli.StringFlag{
+			Name:   "virtual-display",
+			Value:  "",
+			Usage:  "Start an \"xvfb\" or headless \"wayland\" display for each job, exporting DISPLAY or WAYLAND_DISPLAY, and stop it when the job finishes. A job can set its own with BUILDKITE_VIRTUAL_DISPLAY",
+			EnvVar: "BUILDKITE_VIRTUAL_DISPLAY",
+		},
+		cli.StringFlag{
+			Name:   "virtual-display-size",
+			Value:  "1920x1080",
+			Usage:  "The size of the virtual display started for each job",
+			EnvVar: "BUILDKITE_VIRTUAL_DISPLAY_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "failure-bundle-max-size",
+			Value:  "100MB",
+			Usage:  "The most bytes of files to put in a failure bundle. Files that would take it over are left out",
+			EnvVar: "BUILDKITE_FAILURE_BUNDLE_MAX_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "plugins-path",
+			Value:  "",
+			Usage:  "Directory where the plugins are saved to",
+			EnvVar: "BUILDKITE_PLUGINS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "plugins-cache-path",
+			Value:  "",
+			Usage:  "Directory to cache plugin checkouts in, shared between the jobs of every agent on the host that uses it. Each plugin version is checked out once for the commit it points to, and only fetched again when that changes. Not used with --job-ephemeral-user",
+			EnvVar: "BUILDKITE_PLUGINS_CACHE_PATH",
+		},
+		cli.BoolFlag{
+			Name:   "timestamp-lines",
+			Usage:  "Prepend timestamps on each line of output.",
+			EnvVar: "BUILDKITE_TIMESTAMP_LINES",
+		},
+		cli.BoolFlag{
+			Name:   "collapse-progress-output",
+			Usage:  "Collapse lines of job output that are rewritten with carriage returns, like progress bars, into a snapshot every 10 seconds and their final state",
+			EnvVar: "BUILDKITE_COLLAPSE_PROGRESS_OUTPUT",
+		},
+		cli.StringFlag{
+			Name:   "job-output-encoding",
+			Value:  "",
+			Usage:  "The encoding of job output to convert to UTF-8, like windows-1252 or cp437. Use \"auto\" to convert only the output that isn't already UTF-8, or \"utf-8\" to replace invalid bytes. By default, output is passed on as is",
+			EnvVar: "BUILDKITE_JOB_OUTPUT_ENCODING",
+		},
+		cli.BoolFlag{
+			Name:   "job-log-phase-markers",
+			Usage:  "Mark the start and end of the plugin, checkout, command and artifact upload phases in job logs with APC escape sequences like \x1b_bk;phase=checkout;event=end;t=<ms>;status=0\x07, so UIs and log processors can fold and time them. Pipelines can also ask for them with BUILDKITE_JOB_LOG_PHASE_MARKERS",
+			EnvVar: "BUILDKITE_AGENT_JOB_LOG_PHASE_MARKERS",
+		},
+		cli.BoolFlag{
+			Name:   "job-log-line-metadata",
+			Usage:  "Record which stream, stdout or stderr, and which hook, plugin or command each line of job output came from, and the level of the bootstrap's comments, warnings and errors, and upload it as the job artifact log-line-metadata.json. Levels are also left in the log for it to be styled and filtered by. Streams are only told apart with --no-pty",
+			EnvVar: "BUILDKITE_AGENT_JOB_LOG_LINE_METADATA",
+		},
+		cli.StringFlag{
+			Name:   "job-log-format",
+			Value:  "text",
+			Usage:  "The format of the bootstrap's own output in job logs, text or json. With json, each line is a JSON record of its phase, time, and for commands their exit status and duration, for ingesting into log aggregators. Pipelines can also ask for it with BUILDKITE_JOB_LOG_FORMAT",
+			EnvVar: "BUILDKITE_AGENT_JOB_LOG_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "job-umask",
+			Value:  "",
+			Usage:  "The umask for jobs' hooks and commands, and the files they and the bootstrap make, in octal like 0027. Jobs can't change it. By default, it's the agent's own",
+			EnvVar: "BUILDKITE_AGENT_JOB_UMASK",
+		},
+		cli.StringFlag{
+			Name:   "job-directory-mode",
+			Value:  "",
+			Usage:  "The permissions the bootstrap makes directories like the build and plugins directories with, in octal like 0750, before the umask is applied. Jobs can't change it. By default, it's 0777",
+			EnvVar: "BUILDKITE_AGENT_JOB_DIRECTORY_MODE",
+		},
+		cli.StringFlag{
+			Name:   "job-locale",
+			Value:  "",
+			Usage:  "The locale jobs run with, like C.UTF-8 or en_US.UTF-8, set as LANG and LC_ALL so sorting and formatting don't vary between agents. Pipelines that set LANG or any LC_ variable keep their own. By default, jobs get the agent's",
+			EnvVar: "BUILDKITE_AGENT_JOB_LOCALE",
+		},
+		cli.StringFlag{
+			Name:   "job-timezone",
+			Value:  "",
+			Usage:  "The timezone jobs run in, like UTC or Australia/Melbourne, set as TZ. Pipelines that set TZ keep their own. By default, jobs get the agent's",
+			EnvVar: "BUILDKITE_AGENT_JOB_TIMEZONE",
+		},
+		cli.StringSliceFlag{
+			Name:   "job-env",
+			Value:  &cli.StringSlice{},
+			Usage:  "An environment variable to set for every job, given as KEY=value, so jobs get the same one on every agent. Pipelines that set it keep their own. Can be given multiple times",
+			EnvVar: "BUILDKITE_AGENT_JOB_ENV",
+		},
+		cli.IntFlag{
+			Name:   "parallel-skew-threshold",
+			Value:  0,
+			Usage:  "Record how long each of a parallel step's jobs takes in the build's meta-data, and annotate the build suggesting they're rebalanced if the slowest takes more than this percentage longer than the average. Pipelines can also set BUILDKITE_PARALLEL_SKEW_THRESHOLD. 0 doesn't record them",
+			EnvVar: "BUILDKITE_AGENT_PARALLEL_SKEW_THRESHOLD",
+		},
+		cli.StringFlag{
+			Name:   "health-check-addr",
+			Usage:  "Start an HTTP server on this addr:port that returns whether the agent is healthy, disabled by default",
+			EnvVar: "BUILDKITE_AGENT_HEALTH_CHECK_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "build-cache-addr",
+			Usage:  "Start a remote build cache server for Bazel and Gradle on this addr:port, like localhost:9092, and give jobs its URL in BUILDKITE_BUILD_CACHE_URL. Disabled by default",
+			EnvVar: "BUILDKITE_AGENT_BUILD_CACHE_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "build-cache-destination",
+			Usage:  "Where the build cache server keeps its entries, an S3 path like s3://my-bucket/build-cache or a local directory",
+			EnvVar: "BUILDKITE_AGENT_BUILD_CACHE_DESTINATION",
+		},
+		cli.StringFlag{
+			Name:   "artifact-content-store",
+			Value:  "",
+			Usage:  "A directory to keep downloaded artifacts in by their digest, so jobs on this host link them from there instead of downloading them again",
+			EnvVar: "BUILDKITE_AGENT_ARTIFACT_CONTENT_STORE",
+		},
+		cli.BoolFlag{
+			Name:   "artifact-previews",
+			Usage:  "Annotate builds with thumbnails of the images jobs upload as artifacts, and links to the HTML reports they upload. Pipelines can turn this on or off with BUILDKITE_ARTIFACT_PREVIEWS",
+			EnvVar: "BUILDKITE_AGENT_ARTIFACT_PREVIEWS",
+		},
+		cli.BoolFlag{
+			Name:   "no-pty",
+			Usage:  "Do not run jobs within a pseudo terminal",
+			EnvVar: "BUILDKITE_NO_PTY",
+		},
+		cli.BoolFlag{
+			Name:   "no-ssh-keyscan",
+			Usage:  "Don't automatically run ssh-keyscan before checkout",
+			EnvVar: "BUILDKITE_NO_SSH_KEYSCAN",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-strict",
+			Usage:  "Fail the checkout of repositories and plugins from SSH hosts that aren't already in known_hosts, rather than trusting them on first use",
+			EnvVar: "BUILDKITE_SSH_STRICT_HOST_CHECKING",
+		},
+		cli.BoolFlag{
+			Name:   "no-command-eval",
+			Usage:  "Don't allow this agent to run arbitrary console commands, including plugins",
+			EnvVar: "BUILDKITE_NO_COMMAND_EVAL",
+		},
+		cli.BoolFlag{
+			Name:   "no-plugins",
+			Usage:  "Don't allow this agent to load plugins",
+			EnvVar: "BUILDKITE_NO_PLUGINS",
+		},
+		cli.BoolTFlag{
+			Name:   "no-plugin-validation",
+			Usage:  "Don't validate plugin configuration and requirements",
+			EnvVar: "BUILDKITE_NO_PLUGIN_VALIDATION",
+		},
+		cli.StringSliceFlag{
+			Name:   "allowed-plugins",
+			Value:  &cli.StringSlice{},
+			Usage:  "Only let jobs run plugins from locations matching these patterns, like github.com/buildkite-plugins/* or github.com/my-org/*, which also match the plugins in subdirectories of a match. Vendored plugins are always allowed. By default, any plugin can be run",
+			EnvVar: "BUILDKITE_ALLOWED_PLUGINS",
+		},
+		cli.StringSliceFlag{
+			Name:   "denied-plugins",
+			Value:  &cli.StringSlice{},
+			Usage:  "Don't let jobs run plugins from locations matching these patterns, even if --allowed-plugins allows them",
+			EnvVar: "BUILDKITE_DENIED_PLUGINS",
+		},
+		cli.BoolFlag{
+			Name:   "no-local-hooks",
+			Usage:  "Don't allow local hooks to be run from checked out repositories",
+			EnvVar: "BUILDKITE_NO_LOCAL_HOOKS",
+		},
+		cli.BoolFlag{
+			Name:   "no-git-submodules",
+			Usage:  "Don't automatically checkout git submodules",
+			EnvVar: "BUILDKITE_NO_GIT_SUBMODULES,BUILDKITE_DISABLE_GIT_SUBMODULES",
+		},
+		cli.BoolFlag{
+			Name:   "metrics-datadog",
+			Usage:  "Send metrics to DogStatsD for Datadog",
+			EnvVar: "BUILDKITE_METRICS_DATADOG",
+		},
+		cli.BoolFlag{
+			Name:   "no-feature-reporting",
+			Usage:  "Disables sending a list of enabled features back to the Buildkite mothership. We use this information to measure feature usage, but if you're not comfortable sharing that information then that's totally okay :)",
+			EnvVar: "BUILDKITE_AGENT_NO_FEATURE_REPORTING",
+		},
+		cli.StringFlag{
+			Name:   "metrics-datadog-host",
+			Usage:  "The dogstatsd instance to send metrics to using udp",
+			EnvVar: "BUILDKITE_METRICS_DATADOG_HOST",
+			Value:  "127.0.0.1:8125",
+		},
+		cli.BoolFlag{
+			Name:   "metrics-datadog-distributions",
+			Usage:  "Use Datadog Distributions for Timing metrics",
+			EnvVar: "BUILDKITE_METRICS_DATADOG_DISTRIBUTIONS",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Usage:  "The format to use for the logger output",
+			EnvVar: "BUILDKITE_LOG_FORMAT",
+			Value:  "text",
+		},
+		cli.StringFlag{
+			Name:   "locale",
+			Usage:  "The language to log the agent's most common messages in, en or ja, or system to take it from LC_ALL, LC_MESSAGES or LANG. What jobs log isn't translated",
+			EnvVar: "BUILDKITE_AGENT_LOCALE",
+		},
+		cli.IntFlag{
+			Name:   "spawn",
+			Usage:  "The number of agents to spawn in parallel",
+			Value:  1,
+			EnvVar: "BUILDKITE_AGENT_SPAWN",
+		},
+		cli.BoolFlag{
+			Name:   "spawn-with-priority",
+			Usage:  "Assign priorities to every spawned agent (when using --spawn) equal to the agent's index",
+			EnvVar: "BUILDKITE_AGENT_SPAWN_WITH_PRIORITY",
+		},
+		cli.StringFlag{
+			Name:   "cancel-signal",
+			Usage:  "The signal to use for cancellation",
+			EnvVar: "BUILDKITE_CANCEL_SIGNAL",
+			Value:  "SIGTERM",
+		},
+		cli.StringFlag{
+			Name:   "tracing-backend",
+			Usage:  `Enable tracing for build jobs by specifying a backend, "datadog" or "opentelemetry"`,
+			EnvVar: "BUILDKITE_TRACING_BACKEND",
+			Value:  "",
+		},
+		cli.StringFlag{
+			Name:   "tracing-service-name",
+			Usage:  "Service name to use when reporting traces.",
+			EnvVar: "BUILDKITE_TRACING_SERVICE_NAME",
+			Value:  "buildkite-agent",
+		},
+
+		// API Flags
+		AgentRegisterTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+		DNSOverridesFlag,
+		DNSResolverFlag,
+		cli.StringFlag{
+			Name:   "http-debug",
+			Value:  "",
+			Usage:  "Record the agent's API requests and responses, with tokens and --redacted-vars redacted, to this file. A path ending in .har is written as an HTTP archive, anything else as rotated JSON lines",
+			EnvVar: "BUILDKITE_AGENT_HTTP_DEBUG",
+		},
+		cli.StringFlag{
+			Name:   "http-debug-duration",
+			Value:  "10m",
+			Usage:  "How long to record API requests and responses for when --http-debug is set",
+			EnvVar: "BUILDKITE_AGENT_HTTP_DEBUG_DURATION",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+		RedactedVars,
+
+		// Deprecated flags which will be removed in v4
+		cli.StringSliceFlag{
+			Name:   "meta-data",
+			Value:  &cli.StringSlice{},
+			Hidden: true,
+			EnvVar: "BUILDKITE_AGENT_META_DATA",
+		},
+		cli.BoolFlag{
+			Name:   "meta-data-ec2",
+			Hidden: true,
+			EnvVar: "BUILDKITE_AGENT_META_DATA_EC2",
+		},
+		cli.BoolFlag{
+			Name:   "meta-data-ec2-tags",
+			Hidden: true,
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_EC2_TAGS",
+		},
+		cli.BoolFlag{
+			Name:   "meta-data-gcp",
+			Hidden: true,
+			EnvVar: "BUILDKITE_AGENT_META_DATA_GCP",
+		},
+		cli.BoolFlag{
+			Name:   "no-automatic-ssh-fingerprint-verification",
+			Hidden: true,
+			EnvVar: "BUILDKITE_NO_AUTOMATIC_SSH_FINGERPRINT_VERIFICATION",
+		},
+		cli.BoolFlag{
+			Name:   "tags-from-ec2",
+			Usage:  "Include the host's EC2 meta-data as tags (instance-id, instance-type, and ami-id)",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_EC2",
+		},
+		cli.BoolFlag{
+			Name:   "tags-from-gcp",
+			Usage:  "Include the host's Google Cloud instance meta-data as tags (instance-id, machine-type, preemptible, project-id, region, and zone)",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_GCP",
+		},
+		cli.IntFlag{
+			Name:   "disconnect-after-job-timeout",
+			Hidden: true,
+			Usage:  "When --disconnect-after-job is specified, the number of seconds to wait for a job before shutting down",
+			EnvVar: "BUILDKITE_AGENT_DISCONNECT_AFTER_JOB_TIMEOUT",
+		},
+	},
+	Action: func(c *cli.Context) {
+		ctx := context.Background()
+
+		// The configuration will be loaded into this struct
+		cfg := AgentStartConfig{}
+
+		// Setup the config loader. You'll see that we also path paths to
+		// potential config files. The loader will use the first one it finds.
+		loader := cliconfig.Loader{
+			CLI:                    c,
+			Config:                 &cfg,
+			DefaultConfigFilePaths: DefaultConfigFilePaths(),
+		}
+
+		// Load the configuration
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(cfg)
+
+		// Show warnings now we have a logger
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		// Translate what's logged from here on, if it's been asked for
+		catalog, err := locale.Lookup(cfg.Locale)
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+		l = locale.NewLogger(l, catalog)
+
+		// Remove any config env from the environment to prevent them propagating to bootstrap
+		err = UnsetConfigFromEnvironment(c)
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		// Check if git-mirrors are enabled
+		if experiments.IsEnabled("git-mirrors") {
+			if cfg.GitMirrorsPath == "" {
+				l.Fatal("Must provide a git-mirrors-path in your configuration for git-mirrors experiment")
+			}
+		}
+
+		if cfg.BuildCacheAddr != "" && cfg.BuildCacheDestination == "" {
+			l.Fatal("Must provide a --build-cache-destination for the build cache server")
+		}
+
+		if cfg.ParallelSkewThreshold < 0 {
+			l.Fatal("The --parallel-skew-threshold must be a percentage of at least 0, not %d", cfg.ParallelSkewThreshold)
+		}
+
+		switch cfg.GitCheckoutStrategy {
+		case bootstrap.CheckoutStrategyFull, bootstrap.CheckoutStrategyShallow:
+		case bootstrap.CheckoutStrategyMirror:
+			if cfg.GitMirrorsPath == "" {
+				l.Fatal("Must provide a git-mirrors-path in your configuration for --git-checkout-strategy mirror")
+			}
+		default:
+			l.Fatal("Invalid --git-checkout-strategy %q, expected full, shallow or mirror", cfg.GitCheckoutStrategy)
+		}
+		if cfg.GitShallowDepth < 1 {
+			l.Fatal("--git-shallow-depth must be at least 1")
+		}
+
+		// Force some settings if on Windows (these aren't supported yet)
+		if runtime.GOOS == "windows" {
+			cfg.NoPTY = true
+		}
+
+		// Set a useful default for the bootstrap script
+		if cfg.BootstrapScript == "" {
+			exePath, err := os.Executable()
+			if err != nil {
+				l.Fatal("Unable to find executable path for bootstrap")
+			}
+			cfg.BootstrapScript = fmt.Sprintf("%s bootstrap", shellwords.Quote(exePath))
+		}
+
+		isSetNoPlugins := c.IsSet("no-plugins")
+		if loader.File != nil {
+			if _, exists := loader.File.Config["no-plugins"]; exists {
+				isSetNoPlugins = true
+			}
+		}
+
+		// Show a warning if plugins are enabled by no-command-eval or no-local-hooks is set
+		if isSetNoPlugins && !cfg.NoPlugins {
+			msg := "Plugins have been specifically enabled, despite %s being enabled. " +
+				"Plugins can execute arbitrary hooks and commands, make sure you are " +
+				"whitelisting your plugins in " +
+				"your environment hook."
+
+			switch {
+			case cfg.NoCommandEval:
+				l.Warn(msg, "no-command-eval")
+			case cfg.NoLocalHooks:
+				l.Warn(msg, "no-local-hooks")
+			}
+		}
+
+		// Turning off command eval or local hooks will also turn off plugins unless
+		// `--no-plugins=false` is provided specifically
+		if (cfg.NoCommandEval || cfg.NoLocalHooks) && !isSetNoPlugins {
+			cfg.NoPlugins = true
+		}
+
+		// Guess the shell if none is provided
+		if cfg.Shell == "" {
+			cfg.Shell = DefaultShell()
+		}
+
+		// Handle deprecated DisconnectAfterJobTimeout
+		if cfg.DisconnectAfterJobTimeout > 0 {
+			cfg.DisconnectAfterIdleTimeout = cfg.DisconnectAfterJobTimeout
+		}
+
+		var ec2TagTimeout time.Duration
+		if t := cfg.WaitForEC2TagsTimeout; t != "" {
+			var err error
+			ec2TagTimeout, err = time.ParseDuration(t)
+			if err != nil {
+				l.Fatal("Failed to parse ec2 tag timeout: %v", err)
+			}
+		}
+
+		var ec2MetaDataTimeout time.Duration
+		if t := cfg.WaitForEC2MetaDataTimeout; t != "" {
+			var err error
+			ec2MetaDataTimeout, err = time.ParseDuration(t)
+			if err != nil {
+				l.Fatal("Failed to parse ec2 meta-data timeout: %v", err)
+			}
+		}
+
+		var ecsMetaDataTimeout time.Duration
+		if t := cfg.WaitForECSMetaDataTimeout; t != "" {
+			var err error
+			ecsMetaDataTimeout, err = time.ParseDuration(t)
+			if err != nil {
+				l.Fatal("Failed to parse ecs meta-data timeout: %v", err)
+			}
+		}
+
+		var gcpLabelsTimeout time.Duration
+		if t := cfg.WaitForGCPLabelsTimeout; t != "" {
+			var err error
+			gcpLabelsTimeout, err = time.ParseDuration(t)
+			if err != nil {
+				l.Fatal("Failed to parse gcp labels timeout: %v", err)
+			}
+		}
+
+		mc := metrics.NewCollector(l, metrics.CollectorConfig{
+			Datadog:              cfg.MetricsDatadog,
+			DatadogHost:          cfg.MetricsDatadogHost,
+			DatadogDistributions: cfg.MetricsDatadogDistributions,
+		})
+
+		// Sense check supported tracing backends, we don't want bootstrapped jobs to silently have no tracing
+		if _, has := tracetools.ValidTracingBackends[cfg.TracingBackend]; !has {
+			l.Fatal("The given tracing backend %q is not supported. Valid backends are: %q", cfg.TracingBackend, maps.Keys(tracetools.ValidTracingBackends))
+		}
+
+		// Likewise, a job shouldn't silently run on an unencrypted build directory
+		if err := bootstrap.ValidateBuildDirEncryption(cfg.BuildDirEncryption); err != nil {
+			l.Fatal("%v", err)
+		}
+
+		buildDirMounts := 0
+		for _, enabled := range []bool{cfg.BuildDirEncryption != "", cfg.BuildDirTmpfs, cfg.BuildDirOverlayPath != ""} {
+			if enabled {
+				buildDirMounts++
+			}
+		}
+		if buildDirMounts > 1 {
+			l.Fatal("Only one of build-dir-encryption, build-dir-tmpfs and build-dir-overlay-path can be used")
+		}
+
+		if (cfg.BuildDirTmpfs || cfg.BuildDirOverlayPath != "") && runtime.GOOS != "linux" {
+			l.Fatal("build-dir-tmpfs and build-dir-overlay-path are only supported on linux")
+		}
+
+		// Jobs are given the URL of the build cache server, if there is one
+		var buildCacheURL string
+		if cfg.BuildCacheAddr != "" {
+			buildCacheURL = agent.BuildCacheURL(cfg.BuildCacheAddr)
+		}
+
+		// AgentConfiguration is the runtime configuration for an agent
+		// Whatever the job's left running has to be killed before the agent
+		// kills the bootstrap, which is the only thing that can find them
+		signalGracePeriodSeconds := cfg.SignalGracePeriodSeconds
+		if signalGracePeriodSeconds < 0 {
+			signalGracePeriodSeconds = cfg.CancelGracePeriod - 1
+		}
+		if signalGracePeriodSeconds < 0 {
+			signalGracePeriodSeconds = 0
+		}
+		if signalGracePeriodSeconds > 0 && signalGracePeriodSeconds >= cfg.CancelGracePeriod {
+			l.Fatal("--signal-grace-period-seconds (%d) has to be less than --cancel-grace-period (%d)", signalGracePeriodSeconds, cfg.CancelGracePeriod)
+		}
+
+		agentConf := agent.AgentConfiguration{
+			BootstrapScript:            cfg.BootstrapScript,
+			BuildPath:                  cfg.BuildPath,
+			BuildPathLayout:            cfg.BuildPathLayout,
+			BuildDirEncryption:         cfg.BuildDirEncryption,
+			BuildDirEncryptionSize:     cfg.BuildDirEncryptionSize,
+			BuildDirTmpfs:              cfg.BuildDirTmpfs,
+			BuildDirTmpfsSize:          cfg.BuildDirTmpfsSize,
+			BuildDirOverlayPath:        cfg.BuildDirOverlayPath,
+			BuildDirOverlayRefresh:     cfg.BuildDirOverlayRefresh,
+			BuildDirSELinuxLabel:       cfg.BuildDirSELinuxLabel,
+			GitCheckoutStrategy:        cfg.GitCheckoutStrategy,
+			GitShallowDepth:            cfg.GitShallowDepth,
+			GitLFS:                     cfg.GitLFS,
+			GitMirrorsPath:             cfg.GitMirrorsPath,
+			GitMirrorsLockTimeout:      cfg.GitMirrorsLockTimeout,
+			GitMirrorsSkipUpdate:       cfg.GitMirrorsSkipUpdate,
+			HooksPath:                  cfg.HooksPath,
+			HookChecksumsPath:          cfg.HookChecksums,
+			SecretScan:                 cfg.SecretScan,
+			SecretScanRulesPath:        cfg.SecretScanRules,
+			PolicyScannerPath:          cfg.PolicyScanner,
+			FailureBundlePaths:         cfg.FailureBundlePaths,
+			DockerDaemon:               cfg.DockerDaemon,
+			DockerDaemonImage:          cfg.DockerDaemonImage,
+			Rootless:                   cfg.Rootless,
+			JobRestrictedToken:         cfg.JobRestrictedToken,
+			VirtualDisplay:             cfg.VirtualDisplay,
+			VirtualDisplaySize:         cfg.VirtualDisplaySize,
+			PluginsPath:                cfg.PluginsPath,
+			PluginsCachePath:           cfg.PluginsCachePath,
+			GitCheckoutFlags:           cfg.GitCheckoutFlags,
+			GitCloneFlags:              cfg.GitCloneFlags,
+			GitCloneMirrorFlags:        cfg.GitCloneMirrorFlags,
+			GitCleanFlags:              cfg.GitCleanFlags,
+			GitFetchFlags:              cfg.GitFetchFlags,
+			GitSubmodules:              !cfg.NoGitSubmodules,
+			SSHKeyscan:                 !cfg.NoSSHKeyscan,
+			SSHStrictHostChecking:      cfg.SSHStrict,
+			CommandEval:                !cfg.NoCommandEval,
+			PluginsEnabled:             !cfg.NoPlugins,
+			PluginValidation:           !cfg.NoPluginValidation,
+			AllowedPlugins:             cfg.AllowedPlugins,
+			DeniedPlugins:              cfg.DeniedPlugins,
+			LocalHooksEnabled:          !cfg.NoLocalHooks,
+			RunInPty:                   !cfg.NoPTY,
+			TimestampLines:             cfg.TimestampLines,
+			CollapseProgressOutput:     cfg.CollapseProgressOutput,
+			JobOutputEncoding:          cfg.JobOutputEncoding,
+			JobLogPhaseMarkers:         cfg.JobLogPhaseMarkers,
+			JobLogLineMetadata:         cfg.JobLogLineMetadata,
+			JobLogFormat:               cfg.JobLogFormat,
+			JobUmask:                   cfg.JobUmask,
+			JobDirectoryMode:           cfg.JobDirectoryMode,
+			JobLocale:                  cfg.JobLocale,
+			JobTimezone:                cfg.JobTimezone,
+			JobEnv:                     cfg.JobEnv,
+			ParallelSkewThreshold:      cfg.ParallelSkewThreshold,
+			BuildCacheURL:              buildCacheURL,
+			ArtifactContentStore:       cfg.ArtifactContentStore,
+			ArtifactPreviews:           cfg.ArtifactPreviews,
+			DisconnectAfterJob:         cfg.DisconnectAfterJob,
+			DisconnectAfterIdleTimeout: cfg.DisconnectAfterIdleTimeout,
+			CancelGracePeriod:          cfg.CancelGracePeriod,
+			SignalGracePeriodSeconds:   signalGracePeriodSeconds,
+			EnableJobLogTmpfile:        cfg.EnableJobLogTmpfile,
+			Shell:                      cfg.Shell,
+			RedactedVars:               cfg.RedactedVars,
+			AcquireJob:                 cfg.AcquireJob,
+			TracingBackend:             cfg.TracingBackend,
+			TracingServiceName:         cfg.TracingServiceName,
+			DNSOverrides:               cfg.DNSOverrides,
+			DNSResolver:                cfg.DNSResolver,
+			TagsFromToolchains:         cfg.TagsFromToolchains,
+			JobResourceUsage:           cfg.JobResourceUsage,
+			JobEnergyCarbonIntensity:   cfg.JobEnergyCarbonIntensity,
+			JobEnergyAnnotation:        cfg.JobEnergyAnnotation,
+			JobEgressPolicy:            cfg.JobEgressPolicy,
+			JobNetworkAudit:            cfg.JobNetworkAudit,
+			JobWriteGuard:              cfg.JobWriteGuard,
+			JobWriteAllow:              cfg.JobWriteAllow,
+			JobEphemeralUser:           cfg.JobEphemeralUser,
+		}
+
+		if loader.File != nil {
+			agentConf.ConfigPath = loader.File.Path
+		}
+
+		if cfg.LogFormat == "text" {
+			welcomeMessage :=
+				"\n" +
+					"%s   _           _ _     _ _    _ _                                _\n" +
+					"  | |         (_) |   | | |  (_) |                              | |\n" +
+					"  | |__  _   _ _| | __| | | ___| |_ ___    __ _  __ _  ___ _ __ | |_\n" +
+					"  | '_ \\| | | | | |/ _` | |/ / | __/ _ \\  / _` |/ _` |/ _ \\ '_ \\| __|\n" +
+					"  | |_) | |_| | | | (_| |   <| | ||  __/ | (_| | (_| |  __/ | | | |_\n" +
+					"  |_.__/ \\__,_|_|_|\\__,_|_|\\_\\_|\\__\\___|  \\__,_|\\__, |\\___|_| |_|\\__|\n" +
+					"                                                 __/ |\n" +
+					" https://buildkite.com/agent                    |___/\n%s\n"
+
+			if !cfg.NoColor {
+				fmt.Fprintf(os.Stderr, welcomeMessage, "\x1b[38;5;48m", "\x1b[0m")
+			} else {
+				fmt.Fprintf(os.Stderr, welcomeMessage, "", "")
+			}
+		}
+
+		l.Notice("Starting buildkite-agent v%s with PID: %s", version.Version(), fmt.Sprintf("%d", os.Getpid()))
+		l.Notice("The agent source code can be found here: https://github.com/buildkite/agent")
+		l.Notice("For questions and support, email us at: hello@buildkite.com")
+
+		if agentConf.ConfigPath != "" {
+			l.WithFields(logger.StringField(`path`, agentConf.ConfigPath)).Info("Configuration loaded")
+		}
+
+		l.Debug("Bootstrap command: %s", agentConf.BootstrapScript)
+		l.Debug("Build path: %s", agentConf.BuildPath)
+		l.Debug("Hooks directory: %s", agentConf.HooksPath)
+		l.Debug("Plugins directory: %s", agentConf.PluginsPath)
+
+		agentConf.MaxJobRuntimes, err = agent.ParseJobRuntimeLimits(cfg.MaxJobRuntime)
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		agentConf.BuildDirQuotas, err = agent.ParseBuildDirQuotas(cfg.BuildDirQuota)
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		if cfg.JobEnvSpillSize != "" {
+			agentConf.JobEnvSpillSize, err = agent.ParseByteSize(cfg.JobEnvSpillSize)
+			if err != nil {
+				l.Fatal("Invalid --job-env-spill-size %q: %s", cfg.JobEnvSpillSize, err)
+			}
+		}
+
+		if cfg.FailureBundleMaxSize != "" {
+			agentConf.FailureBundleMaxSize, err = agent.ParseByteSize(cfg.FailureBundleMaxSize)
+			if err != nil {
+				l.Fatal("Invalid --failure-bundle-max-size %q: %s", cfg.FailureBundleMaxSize, err)
+			}
+		}
+
+		switch cfg.BuildPathLayout {
+		case "", bootstrap.BuildPathLayoutHashed:
+		default:
+			l.Fatal("Invalid --build-path-layout %q, expected hashed", cfg.BuildPathLayout)
+		}
+
+		switch cfg.DockerDaemon {
+		case "", "dind", "rootless":
+		default:
+			l.Fatal("Invalid --docker-daemon %q, expected dind or rootless", cfg.DockerDaemon)
+		}
+
+		if cfg.Rootless {
+			// These all need root, for mounts, dm-crypt or network namespaces
+			switch {
+			case cfg.BuildDirEncryption != "":
+				l.Fatal("--build-dir-encryption can't be used with --rootless")
+			case cfg.BuildDirTmpfs:
+				l.Fatal("--build-dir-tmpfs can't be used with --rootless")
+			case cfg.BuildDirOverlayPath != "":
+				l.Fatal("--build-dir-overlay-path can't be used with --rootless")
+			case cfg.JobEgressPolicy:
+				l.Fatal("--job-egress-policy can't be used with --rootless")
+			case cfg.JobWriteGuard != "":
+				l.Fatal("--job-write-guard can't be used with --rootless")
+			case cfg.DockerDaemon == "dind":
+				l.Fatal("--docker-daemon dind needs a privileged container, use --docker-daemon rootless with --rootless")
+			}
+
+			if !logHostChecks(l, "Rootless", agent.CheckRootless()) {
+				l.Fatal("This host can't run jobs rootless, see the errors above")
+			}
+		}
+
+		if cfg.JobRestrictedToken {
+			if err := agent.ProtectFromRestrictedJobs(agentConf.ConfigPath); err != nil {
+				l.Fatal("%s", err)
+			}
+			if agentConf.ConfigPath != "" {
+				l.Info("Labeled %s high integrity, so jobs can't read it", agentConf.ConfigPath)
+			}
+		}
+
+		if !logHostChecks(l, "SELinux", agent.CheckSELinux(cfg.BuildPath, cfg.BuildDirSELinuxLabel)) {
+			l.Fatal("Jobs can't be given the SELinux label %s, see the errors above", cfg.BuildDirSELinuxLabel)
+		}
+
+		switch cfg.VirtualDisplay {
+		case "", "xvfb", "wayland":
+		default:
+			l.Fatal("Invalid --virtual-display %q, expected xvfb or wayland", cfg.VirtualDisplay)
+		}
+
+		switch cfg.SecretScan {
+		case "", "annotate", "fail":
+		default:
+			l.Fatal("Invalid --secret-scan %q, expected annotate or fail", cfg.SecretScan)
+		}
+
+		if cfg.JobLogFormat != "text" && cfg.JobLogFormat != "json" {
+			l.Fatal("Unknown --job-log-format %q, try text or json", cfg.JobLogFormat)
+		}
+
+		if _, err := parseFileMode(cfg.JobUmask); err != nil {
+			l.Fatal("Invalid --job-umask %q: %v", cfg.JobUmask, err)
+		}
+
+		if _, err := parseFileMode(cfg.JobDirectoryMode); err != nil {
+			l.Fatal("Invalid --job-directory-mode %q: %v", cfg.JobDirectoryMode, err)
+		}
+
+		for _, pattern := range append(cfg.AllowedPlugins, cfg.DeniedPlugins...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				l.Fatal("Invalid plugin pattern %q: %v", pattern, err)
+			}
+		}
+
+		if cfg.JobTimezone != "" {
+			if _, err := time.LoadLocation(cfg.JobTimezone); err != nil {
+				l.Fatal("Invalid --job-timezone %q: %v", cfg.JobTimezone, err)
+			}
+		}
+
+		for _, e := range cfg.JobEnv {
+			if k, _, ok := strings.Cut(e, "="); !ok || k == "" {
+				l.Fatal("Invalid --job-env %q, expected KEY=value", e)
+			}
+		}
+
+		if cfg.JobOutputEncoding != "" {
+			if _, err := process.NewOutputTranscoder(io.Discard, cfg.JobOutputEncoding); err != nil {
+				l.Fatal("Invalid --job-output-encoding: %s", err)
+			}
+		}
+
+		agentConf.JobEgressAllow, err = agent.ParseEgressAllowlist(cfg.JobEgressAllow)
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+		if cfg.JobEgressPolicy && runtime.GOOS != "linux" {
+			l.Fatal("Job egress policies are only supported on Linux")
+		}
+		if cfg.JobEgressPolicy && cfg.JobNetworkAudit {
+			// The proxy runs outside the job's network namespace, so would
+			// let the job around its egress policy
+			l.Fatal("--job-network-audit can't be used with --job-egress-policy")
+		}
+
+		switch cfg.JobWriteGuard {
+		case "":
+		case agent.JobWriteGuardLog, agent.JobWriteGuardFail:
+			if runtime.GOOS != "linux" {
+				l.Fatal("--job-write-guard is only supported on Linux")
+			}
+		default:
+			l.Fatal("Invalid --job-write-guard %q, expected log or fail", cfg.JobWriteGuard)
+		}
+
+		if cfg.JobEphemeralUser {
+			// The bootstrap runs as the job's user, so can't do what needs
+			// root
+			switch {
+			case runtime.GOOS != "linux":
+				l.Fatal("--job-ephemeral-user is only supported on Linux")
+			case os.Geteuid() != 0:
+				l.Fatal("--job-ephemeral-user needs the agent to run as root")
+			case cfg.JobEgressPolicy:
+				l.Fatal("--job-ephemeral-user can't be used with --job-egress-policy")
+			case cfg.BuildDirEncryption != "":
+				l.Fatal("--job-ephemeral-user can't be used with --build-dir-encryption")
+			case cfg.BuildDirTmpfs:
+				l.Fatal("--job-ephemeral-user can't be used with --build-dir-tmpfs")
+			case cfg.BuildDirOverlayPath != "":
+				l.Fatal("--job-ephemeral-user can't be used with --build-dir-overlay-path")
+			}
+		}
+
+		switch cfg.Attestation {
+		case "", agent.AttestationAWS, agent.AttestationGCP:
+		case agent.AttestationTPM:
+			if cfg.AttestationTPMKey == "" {
+				l.Fatal("--attestation tpm needs --attestation-tpm-key")
+			}
+		default:
+			l.Fatal("Invalid --attestation %q, expected aws, gcp or tpm", cfg.Attestation)
+		}
+
+		if cfg.HostFingerprint || cfg.HostFingerprintBaseline != "" {
+			fingerprint := agent.FingerprintHost(ctx)
+			agentConf.HostFingerprint = fingerprint.Hash()
+			l.Info("Host fingerprint is %s (%s, kernel %s)", agentConf.HostFingerprint, fingerprint.OS, fingerprint.Kernel)
+
+			if cfg.HostFingerprintBaseline != "" {
+				baseline, err := agent.LoadHostFingerprint(cfg.HostFingerprintBaseline)
+				switch {
+				case os.IsNotExist(err):
+					if err := agent.WriteHostFingerprint(cfg.HostFingerprintBaseline, fingerprint); err != nil {
+						l.Fatal("Failed to write host fingerprint baseline: %v", err)
+					}
+					l.Info("Wrote this host's fingerprint to %s as the baseline", cfg.HostFingerprintBaseline)
+
+				case err != nil:
+					l.Fatal("Failed to load host fingerprint baseline: %v", err)
+
+				default:
+					agentConf.HostFingerprintDrift = fingerprint.Diff(baseline)
+					if len(agentConf.HostFingerprintDrift) > 0 {
+						l.Warn("This host has drifted from the baseline in %s: %s",
+							cfg.HostFingerprintBaseline, strings.Join(agentConf.HostFingerprintDrift, ", "))
+					}
+				}
+			}
+		}
+
+		if !agentConf.SSHKeyscan {
+			l.Info("Automatic ssh-keyscan has been disabled")
+		}
+
+		if agentConf.SSHStrictHostChecking {
+			l.Info("Strict SSH host key checking is on, so unknown hosts won't be added to known_hosts")
+		}
+
+		if !agentConf.CommandEval {
+			l.Info("Evaluating console commands has been disabled")
+		}
+
+		if !agentConf.PluginsEnabled {
+			l.Info("Plugins have been disabled")
+		}
+
+		if !agentConf.RunInPty {
+			l.Info("Running builds within a pseudoterminal (PTY) has been disabled")
+		}
+
+		if agentConf.DisconnectAfterJob {
+			l.Info("Agents will disconnect after a job run has completed")
+		}
+
+		if agentConf.DisconnectAfterIdleTimeout > 0 {
+			l.Info("Agents will disconnect after %d seconds of inactivity", agentConf.DisconnectAfterIdleTimeout)
+		}
+
+		cancelSig, err := process.ParseSignal(cfg.CancelSignal)
+		if err != nil {
+			l.Fatal("Failed to parse cancel-signal: %v", err)
+		}
+
+		// confirm the BuildPath is exists. The bootstrap is going to write to it when a job executes,
+		// so we may as well check that'll work now and fail early if it's a problem
+		if !utils.FileExists(agentConf.BuildPath) {
+			l.Info("Build Path doesn't exist, creating it (%s)", agentConf.BuildPath)
+			// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+			if err := os.MkdirAll(agentConf.BuildPath, 0777); err != nil {
+				l.Fatal("Failed to create builds path: %v", err)
+			}
+		}
+
+		apiConf := loadAPIClientConfig(cfg, "Token")
+
+		// Record API traffic for a while, if asked to
+		if cfg.HTTPDebug != "" {
+			duration, err := time.ParseDuration(cfg.HTTPDebugDuration)
+			if err != nil {
+				l.Fatal("Failed to parse http debug duration: %v", err)
+			}
+
+			capture, err := api.NewHTTPCapture(cfg.HTTPDebug, duration, cfg.RedactedVars)
+			if err != nil {
+				l.Fatal("%v", err)
+			}
+			defer capture.Close()
+
+			l.Info("Recording API requests and responses to %s for %v", cfg.HTTPDebug, duration)
+			apiConf.HTTPCapture = capture
+		}
+
+		// Create the API client
+		client := api.NewClient(l, apiConf)
+
+		// The registration request for all agents
+		registerReq := api.AgentRegisterRequest{
+			Name:              cfg.Name,
+			Priority:          cfg.Priority,
+			ScriptEvalEnabled: !cfg.NoCommandEval,
+			Tags: agent.FetchTags(ctx, l, agent.FetchTagsConfig{
+				Tags:                      cfg.Tags,
+				TagsFromEC2MetaData:       (cfg.TagsFromEC2MetaData || cfg.TagsFromEC2),
+				TagsFromEC2MetaDataPaths:  cfg.TagsFromEC2MetaDataPaths,
+				TagsFromEC2Tags:           cfg.TagsFromEC2Tags,
+				TagsFromECSMetaData:       cfg.TagsFromECSMetaData,
+				TagsFromGCPMetaData:       (cfg.TagsFromGCPMetaData || cfg.TagsFromGCP),
+				TagsFromGCPMetaDataPaths:  cfg.TagsFromGCPMetaDataPaths,
+				TagsFromGCPLabels:         cfg.TagsFromGCPLabels,
+				TagsFromHost:              cfg.TagsFromHost,
+				TagsFromToolchains:        cfg.TagsFromToolchains,
+				WaitForEC2TagsTimeout:     ec2TagTimeout,
+				WaitForEC2MetaDataTimeout: ec2MetaDataTimeout,
+				WaitForECSMetaDataTimeout: ecsMetaDataTimeout,
+				WaitForGCPLabelsTimeout:   gcpLabelsTimeout,
+			}),
+			// We only want this agent to be ingored in Buildkite
+			// dispatches if it's being booted to acquire a
+			// specific job.
+			IgnoreInDispatches: cfg.AcquireJob != "",
+			Features:           cfg.Features(),
+		}
+
+		// Attest to this host once, as the evidence is the same for every
+		// agent on it
+		if cfg.Attestation != "" {
+			attestation, err := agent.Attest(ctx, agent.AttestationConfig{
+				Type:     cfg.Attestation,
+				Audience: cfg.Endpoint,
+				TPMKey:   cfg.AttestationTPMKey,
+			})
+			if err != nil {
+				l.Fatal("Failed to attest to this host: %v", err)
+			}
+			registerReq.Attestation = attestation
+		}
+
+		if cfg.JobEnergyEstimate {
+			agentConf.JobEnergyCPUWatts = agent.DefaultCPUWatts
+			instanceType := agent.InstanceTypeFromTags(registerReq.Tags)
+
+			switch {
+			case cfg.JobEnergyCPUWatts != "":
+				watts, err := strconv.ParseFloat(cfg.JobEnergyCPUWatts, 64)
+				if err != nil || watts <= 0 {
+					l.Fatal("Invalid job-energy-cpu-watts %q, it must be a number more than 0", cfg.JobEnergyCPUWatts)
+				}
+				agentConf.JobEnergyCPUWatts = watts
+
+			case instanceType != "":
+				if watts, ok := agent.CPUWattsForInstanceType(instanceType); ok {
+					agentConf.JobEnergyCPUWatts = watts
+				} else {
+					l.Warn("Don't know how much power a %s CPU draws, assuming %.1f W. Set it with --job-energy-cpu-watts", instanceType, agentConf.JobEnergyCPUWatts)
+				}
+			}
+
+			l.Info("Estimating jobs' energy with %.1f W per CPU and %d gCO2e/kWh", agentConf.JobEnergyCPUWatts, agentConf.JobEnergyCarbonIntensity)
+		}
+
+		// Spawning multiple agents doesn't work if the agent is being
+		// booted in acquisition mode
+		if cfg.Spawn > 1 && cfg.AcquireJob != "" {
+			l.Fatal("You can't spawn multiple agents and acquire a job at the same time")
+		}
+
+		var workers []*agent.AgentWorker
+
+		// Names and tags are templated anew for each agent that registers
+		counterPath := cfg.RegistrationCounterPath
+		if counterPath == "" {
+			counterPath = filepath.Join(cfg.BuildPath, ".registration-counter")
+		}
+		registrationTemplate := agent.NewRegistrationTemplate(l, agent.RegistrationTemplateConfig{
+			CounterPath: counterPath,
+			ConfigPath:  agentConf.ConfigPath,
+		})
+		baseTags := registerReq.Tags
+
+		// The workers share what they've run, for jobs' affinity hints
+		jobHistory := agent.NewJobHistory()
+
+		for i := 1; i <= cfg.Spawn; i++ {
+			if cfg.Spawn == 1 {
+				l.Info("Registering agent with Buildkite...")
+			} else {
+				l.Info("Registering agent %d of %d with Buildkite...", i, cfg.Spawn)
+			}
+
+			// Handle per-spawn name interpolation, replacing %spawn with the spawn index
+			name, tags := registrationTemplate.Expand(ctx, cfg.Name, baseTags)
+			registerReq.Name = strings.ReplaceAll(name, "%spawn", strconv.Itoa(i))
+			registerReq.Tags = tags
+
+			if cfg.SpawnWithPriority {
+				l.Info("Assigning priority %s for agent %d", strconv.Itoa(i), i)
+				registerReq.Priority = strconv.Itoa(i)
+			}
+
+			// Register the agent with the buildkite API
+			ag, err := agent.Register(ctx, l, client, registerReq)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+
+			// Create an agent worker to run the agent
+			workers = append(workers,
+				agent.NewAgentWorker(
+					l.WithFields(logger.StringField("agent", ag.Name)), ag, mc, client, agent.AgentWorkerConfig{
+						AgentConfiguration: agentConf,
+						CancelSignal:       cancelSig,
+						Debug:              cfg.Debug,
+						DebugHTTP:          cfg.DebugHTTP,
+						SpawnIndex:         i,
+						JobHistory:         jobHistory,
+					}))
+		}
+
+		// Setup the agent pool that spawns agent workers
+		pool := agent.NewAgentPool(workers)
+
+		// Agent-wide shutdown hook. Once per agent, for all workers on the agent.
+		defer agentShutdownHook(l, cfg)
+
+		// Once the shutdown hook has been setup, trigger the startup hook.
+		if err := agentStartupHook(l, cfg); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		// Handle process signals
+		signals := handlePoolSignals(ctx, l, pool)
+		defer close(signals)
+
+		l.Info("Starting %d Agent(s)", cfg.Spawn)
+		l.Info("You can press Ctrl-C to stop the agents")
+
+		// Determine the health check listening address and port for this agent
+		if cfg.HealthCheckAddr != "" {
+			http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+				l.Info("%s %s", r.Method, r.URL.Path)
+				if r.URL.Path != "/" {
+					http.NotFound(w, r)
+				} else {
+					fmt.Fprintf(w, "OK: Buildkite agent is running")
+				}
+			})
+
+			if experiments.IsEnabled("inbuilt-status-page") {
+				http.HandleFunc("/status", status.Handle)
+			}
+
+			go func() {
+				_, setStatus, done := status.AddSimpleItem(ctx, "Health check server")
+				defer done()
+				setStatus("👂 Listening")
+
+				l.Notice("Starting HTTP health check server on %v", cfg.HealthCheckAddr)
+				err := http.ListenAndServe(cfg.HealthCheckAddr, nil)
+				if err != nil {
+					l.Error("Could not start health check server: %v", err)
+				}
+			}()
+		}
+
+		if cfg.BuildCacheAddr != "" {
+			store, err := agent.NewBuildCacheStore(l, cfg.BuildCacheDestination)
+			if err != nil {
+				l.Fatal("Could not set up the build cache: %v", err)
+			}
+			server := &http.Server{
+				Addr:    cfg.BuildCacheAddr,
+				Handler: agent.NewBuildCacheServer(l, store),
+			}
+
+			go func() {
+				_, setStatus, done := status.AddSimpleItem(ctx, "Build cache server")
+				defer done()
+				setStatus("👂 Listening")
+
+				l.Notice("Starting build cache server on %v, backed by %s", cfg.BuildCacheAddr, cfg.BuildCacheDestination)
+				if err := server.ListenAndServe(); err != nil {
+					l.Error("Could not start build cache server: %v", err)
+				}
+			}()
+		}
+
+		// Start the agent pool
+		if err := pool.Start(ctx); err != nil {
+			l.Fatal("%s", err)
+		}
+	},
+}
+
+func handlePoolSignals(ctx context.Context, l logger.Logger, pool *agent.AgentPool) chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt,
+		syscall.SIGHUP,
+		syscall.SIGTERM,
+		syscall.SIGINT,
+		syscall.SIGQUIT)
+
+	go func() {
+		_, setStatus, done := status.AddSimpleItem(ctx, "Handle Pool Signals")
+		defer done()
+		setStatus("⏳ Waiting for a signal")
+
+		var interruptCount int
+
+		for sig := range signals {
+			l.Debug("Received signal `%v`", sig)
+			setStatus(fmt.Sprintf("Recieved signal `%v`", sig))
+
+			switch sig {
+			case syscall.SIGQUIT:
+				l.Debug("Received signal `%s`", sig.String())
+				pool.Stop(false)
+			case syscall.SIGTERM, syscall.SIGINT:
+				l.Debug("Received signal `%s`", sig.String())
+				if interruptCount == 0 {
+					interruptCount++
+					l.Info("Received CTRL-C, send again to forcefully kill the agent(s)")
+					pool.Stop(true)
+				} else {
+					l.Info("Forcefully stopping running jobs and stopping the agent(s)")
+					pool.Stop(false)
+				}
+			default:
+				l.Debug("Ignoring signal `%s`", sig.String())
+			}
+		}
+	}()
+
+	return signals
+}
+
+func agentStartupHook(log logger.Logger, cfg AgentStartConfig) error {
+	return agentLifecycleHook("agent-startup", log, cfg)
+}
+func agentShutdownHook(log logger.Logger, cfg AgentStartConfig) {
+	_ = agentLifecycleHook("agent-shutdown", log, cfg)
+}
+
+// agentLifecycleHook looks for a hook script in the hooks path
+// and executes it if found. Output (stdout + stderr) is streamed into the main
+// agent logger. Exit status failure is logged and returned for the caller to handle
+func agentLifecycleHook(hookName string, log logger.Logger, cfg AgentStartConfig) error {
+	// search for hook (including .bat & .ps1 files on Windows)
+	p, err := hook.Find(cfg.HooksPath, hookName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Error finding %q hook: %v", hookName, err)
+			return err
+		}
+		return nil
+	}
+	sh, err := shell.New()
+	if err != nil {
+		log.Error("creating shell for %q hook: %v", hookName, err)
+		return err
+	}
+
+	// pipe from hook output to logger
+	r, w := io.Pipe()
+	sh.Logger = &shell.WriterLogger{Writer: w, Ansi: !cfg.NoColor} // for Promptf
+	sh.Writer = w                                                  // for stdout+stderr
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		scan := bufio.NewScanner(r) // log each line separately
+		log = log.WithFields(logger.StringField("hook", hookName))
+		for scan.Scan() {
+			log.Info(scan.Text())
+		}
+	}()
+
+	// run hook
+	sh.Promptf("%s", p)
+	if err = sh.RunScript(context.Background(), p, nil); err != nil {
+		log.Error("%q hook: %v", hookName, err)
+		return err
+	}
+	w.Close() // goroutine scans until pipe is closed
+
+	// wait for hook to finish and output to flush to logger
+	wg.Wait()
+	return nil
+}
+
+// logHostChecks logs the results of checking the host, returning false if
+// anything jobs need is missing
+func logHostChecks(l logger.Logger, prefix string, checks []agent.HostCheck) bool {
+	ok := true
+	for _, check := range checks {
+		switch {
+		case check.OK:
+			l.Debug("%s: %s: ok %s", prefix, check.Name, check.Detail)
+		case check.Required:
+			ok = false
+			l.Error("%s: %s: %s", prefix, check.Name, check.Detail)
+		default:
+			l.Warn("%s: %s: %s", prefix, check.Name, check.Detail)
+		}
+	}
+	return ok
+}
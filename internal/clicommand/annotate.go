@@ -8,9 +8,10 @@ import (
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
-	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/buildkite/agent/v3/internal/jobapi"
+	"github.com/buildkite/agent/v3/internal/stdin"
 	"github.com/buildkite/agent/v3/logger"
-	"github.com/buildkite/agent/v3/stdin"
 	"github.com/buildkite/roko"
 	"github.com/urfave/cli"
 )
@@ -69,10 +70,13 @@ type AnnotateConfig struct {
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP        bool     `cli:"debug-http"`
+	DNSOverrides     []string `cli:"dns-override" normalize:"list"`
+	DNSResolver      string   `cli:"dns-resolver"`
+	AgentAccessToken string   `cli:"agent-access-token" validate:"required-without:JobAPISocket"`
+	Endpoint         string   `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool     `cli:"no-http2"`
+	JobAPISocket     string   `cli:"job-api-socket"`
 }
 
 var AnnotateCommand = cli.Command{
@@ -107,6 +111,9 @@ var AnnotateCommand = cli.Command{
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		DNSOverridesFlag,
+		DNSResolverFlag,
+		JobAPISocketFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -166,9 +173,6 @@ func annotate(ctx context.Context, cfg AnnotateConfig, l logger.Logger) error {
 		return fmt.Errorf("Annotation body size (%dB) exceeds maximum (%dB)", bodySize, maxBodySize)
 	}
 
-	// Create the API client
-	client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
-
 	// Create the annotation we'll send to the Buildkite API
 	annotation := &api.Annotation{
 		Body:    body,
@@ -177,6 +181,17 @@ func annotate(ctx context.Context, cfg AnnotateConfig, l logger.Logger) error {
 		Append:  cfg.Append,
 	}
 
+	// Queue it up with the agent running the job, if there is one
+	if cfg.JobAPISocket != "" {
+		if err := jobapi.NewClient(cfg.JobAPISocket).Annotate(ctx, annotation); err != nil {
+			return fmt.Errorf("Failed to annotate build: %w", err)
+		}
+		return nil
+	}
+
+	// Create the API client
+	client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
+
 	// Retry the annotation a few times before giving up
 	err := roko.NewRetrier(
 		roko.WithMaxAttempts(5),
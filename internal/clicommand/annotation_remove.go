@@ -7,7 +7,8 @@ import (
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
-	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/buildkite/agent/v3/internal/jobapi"
 	"github.com/buildkite/roko"
 	"github.com/urfave/cli"
 )
@@ -40,10 +41,13 @@ type AnnotationRemoveConfig struct {
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP        bool     `cli:"debug-http"`
+	DNSOverrides     []string `cli:"dns-override" normalize:"list"`
+	DNSResolver      string   `cli:"dns-resolver"`
+	AgentAccessToken string   `cli:"agent-access-token" validate:"required-without:JobAPISocket"`
+	Endpoint         string   `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool     `cli:"no-http2"`
+	JobAPISocket     string   `cli:"job-api-socket"`
 }
 
 var AnnotationRemoveCommand = cli.Command{
@@ -69,6 +73,9 @@ var AnnotationRemoveCommand = cli.Command{
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		DNSOverridesFlag,
+		DNSResolverFlag,
+		JobAPISocketFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -101,6 +108,13 @@ var AnnotationRemoveCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
+		// Make sure any annotations queued up by this job have been made first
+		if cfg.JobAPISocket != "" {
+			if err := jobapi.NewClient(cfg.JobAPISocket).Flush(ctx); err != nil {
+				l.Warn("Failed to send queued job API calls: %v", err)
+			}
+		}
+
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
 
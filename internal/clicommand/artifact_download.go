@@ -5,9 +5,9 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
-	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
 	"github.com/urfave/cli"
 )
 
@@ -24,6 +24,10 @@ Description:
    using a wild card as the built-in shell path globbing will expand the wild
    card and break the query.
 
+   A query can have several paths separated by ';'. Paths starting with '!'
+   exclude the artifacts the others match, and '{a,b}' matches either of a or
+   b, the same as they do for artifact uploads.
+
    If the last path component of <destination> matches the first path component
    of your <query>, the last component of <destination> is dropped from the
    final path. For example, a query of 'app/logs/*' with a destination of
@@ -34,6 +38,10 @@ Description:
    <destination> of '.' to always create a directory hierarchy matching the
    artifact paths.
 
+   Downloaded artifacts are checked against the SHA-256 checksum they were
+   uploaded with, and downloaded again if they don't match. An artifact that
+   still doesn't match after a few downloads is removed, and the download fails.
+
 Example:
 
    $ buildkite-agent artifact download "pkg/*.tar.gz" . --build xxx
@@ -46,7 +54,24 @@ Example:
 
    $ buildkite-agent artifact download "pkg/*.tar.gz" . --step "tests" --build xxx
 
-   You can also use the step's jobs id (provided by the environment variable $BUILDKITE_JOB_ID)`
+   You can also use the step's jobs id (provided by the environment variable $BUILDKITE_JOB_ID)
+
+   With --content-store, artifacts that have been downloaded on this host before are linked
+   from the store instead, with a reflink where the filesystem supports them, or copied
+   where it doesn't.
+
+   Artifacts uploaded with --compress are downloaded as they were uploaded, with a .gz or
+   .zst extension, unless --decompress is given, when they're decompressed to the paths
+   they were uploaded from. Query for them with their extension, or a wildcard:
+
+   $ buildkite-agent artifact download "coverage.tar.zst;reports/*.xml.*" . --decompress --build xxx
+
+   With --extract, tar archives are unpacked into the directory they'd be downloaded to as
+   they're downloaded, so there's only ever the one copy of what's in them on disk. They're
+   checked against their checksum once they're unpacked, and downloaded again if they don't
+   match:
+
+   $ buildkite-agent artifact download "cache/node_modules.tar.zst" . --extract --build xxx`
 
 type ArtifactDownloadConfig struct {
 	Query              string `cli:"arg:0" label:"artifact search query" validate:"required"`
@@ -54,6 +79,9 @@ type ArtifactDownloadConfig struct {
 	Step               string `cli:"step"`
 	Build              string `cli:"build" validate:"required"`
 	IncludeRetriedJobs bool   `cli:"include-retried-jobs"`
+	ContentStore       string `cli:"content-store" normalize:"filepath"`
+	Decompress         bool   `cli:"decompress"`
+	Extract            bool   `cli:"extract"`
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
@@ -63,10 +91,13 @@ type ArtifactDownloadConfig struct {
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP        bool     `cli:"debug-http"`
+	DNSOverrides     []string `cli:"dns-override" normalize:"list"`
+	DNSResolver      string   `cli:"dns-resolver"`
+	AgentAccessToken string   `cli:"agent-access-token" validate:"required-without:JobAPISocket"`
+	Endpoint         string   `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool     `cli:"no-http2"`
+	JobAPISocket     string   `cli:"job-api-socket"`
 }
 
 var ArtifactDownloadCommand = cli.Command{
@@ -90,12 +121,31 @@ var ArtifactDownloadCommand = cli.Command{
 			EnvVar: "BUILDKITE_AGENT_INCLUDE_RETRIED_JOBS",
 			Usage:  "Include artifacts from retried jobs in the search",
 		},
+		cli.StringFlag{
+			Name:   "content-store",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_CONTENT_STORE",
+			Usage:  "A directory of artifacts by their digest, shared between jobs, to reflink or copy artifacts from instead of downloading them again",
+		},
+		cli.BoolFlag{
+			Name:   "decompress",
+			EnvVar: "BUILDKITE_ARTIFACT_DECOMPRESS",
+			Usage:  "Decompress artifacts that were uploaded with --compress, and unpack directories that were archived",
+		},
+		cli.BoolFlag{
+			Name:   "extract",
+			EnvVar: "BUILDKITE_ARTIFACT_EXTRACT",
+			Usage:  "Unpack .tar, .tar.gz, .tgz, .tar.zst and .tzst artifacts as they're downloaded, without writing the archives to disk",
+		},
 
 		// API Flags
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		DNSOverridesFlag,
+		DNSResolverFlag,
+		JobAPISocketFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -138,6 +188,9 @@ var ArtifactDownloadCommand = cli.Command{
 			BuildID:            cfg.Build,
 			Step:               cfg.Step,
 			IncludeRetriedJobs: cfg.IncludeRetriedJobs,
+			ContentStorePath:   cfg.ContentStore,
+			Decompress:         cfg.Decompress,
+			Extract:            cfg.Extract,
 			DebugHTTP:          cfg.DebugHTTP,
 		})
 
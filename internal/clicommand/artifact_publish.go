@@ -0,0 +1,225 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/urfave/cli"
+)
+
+const publishHelpDescription = `Usage:
+
+   buildkite-agent artifact publish [options] <pattern> <target>
+
+Description:
+
+   Publishes files to a release, so deploy steps don't each have to upload
+   them themselves. The target is one of:
+
+   - github://owner/repo/tag, to upload them as the assets of a GitHub
+     release, creating it if it doesn't exist
+   - s3://bucket/path, to upload them to an S3 bucket, using the same
+     configuration as artifacts
+   - an http:// or https:// URL, to PUT each one to its path under it, with
+     its SHA-256 checksum in the X-Checksum-SHA256 header
+
+   Where each file is published is set by --path, a template with the
+   file's {{.Name}} and {{.Path}}, and the release's {{.Version}}, {{.Tag}},
+   {{.Pipeline}}, {{.Branch}}, {{.Commit}}, {{.ShortCommit}} and
+   {{.BuildNumber}}. The version is the tag without a leading "v" unless it's
+   given with --version.
+
+   A SHA256SUMS file listing the checksums of the files is published next to
+   them, unless --no-checksums is given.
+
+   You need to ensure that the paths are surrounded by quotes otherwise the
+   built-in shell path globbing will provide the files, which is currently not
+   supported.
+
+Example:
+
+   $ buildkite-agent artifact publish "dist/*.tar.gz" github://my-org/my-app/v1.2.3
+   $ buildkite-agent artifact publish "dist/*" s3://my-releases/my-app --path "{{.Version}}/{{.Name}}"
+   $ buildkite-agent artifact publish "pkg/**/*.deb" https://releases.example.com/my-app \
+       --path "{{.Branch}}/{{.BuildNumber}}/{{.Path}}" --header "Authorization: Bearer $TOKEN"`
+
+type ArtifactPublishConfig struct {
+	Paths        string   `cli:"arg:0" label:"publish paths" validate:"required"`
+	Target       string   `cli:"arg:1" label:"target" validate:"required"`
+	PathTemplate string   `cli:"path"`
+	ContentType  string   `cli:"content-type"`
+	NoChecksums  bool     `cli:"no-checksums"`
+	GitHubToken  string   `cli:"github-token"`
+	GitHubAPIURL string   `cli:"github-api-url"`
+	Headers      []string `cli:"header" normalize:"list"`
+	Version      string   `cli:"version"`
+	Tag          string   `cli:"tag"`
+	Pipeline     string   `cli:"pipeline"`
+	Branch       string   `cli:"branch"`
+	Commit       string   `cli:"commit"`
+	BuildNumber  string   `cli:"build-number"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+
+	// API config
+	DebugHTTP bool `cli:"debug-http"`
+
+	// Uploader flags
+	FollowSymlinks bool `cli:"follow-symlinks"`
+}
+
+var ArtifactPublishCommand = cli.Command{
+	Name:        "publish",
+	Usage:       "Publishes files to a GitHub release, S3 bucket or HTTP server",
+	Description: publishHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "path",
+			Value:  "{{.Name}}",
+			Usage:  "The template for where each file is published under the target",
+			EnvVar: "BUILDKITE_PUBLISH_PATH",
+		},
+		cli.StringFlag{
+			Name:   "content-type",
+			Value:  "",
+			Usage:  "A specific Content-Type to set for the files (otherwise detected)",
+			EnvVar: "BUILDKITE_PUBLISH_CONTENT_TYPE",
+		},
+		cli.BoolFlag{
+			Name:   "no-checksums",
+			Usage:  "Don't publish a SHA256SUMS file with the checksums of the files",
+			EnvVar: "BUILDKITE_PUBLISH_NO_CHECKSUMS",
+		},
+		cli.StringFlag{
+			Name:   "github-token",
+			Value:  "",
+			Usage:  "The token to create GitHub releases and upload their assets with",
+			EnvVar: "BUILDKITE_PUBLISH_GITHUB_TOKEN,GITHUB_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "github-api-url",
+			Value:  "https://api.github.com",
+			Usage:  "The URL of the GitHub API, for GitHub Enterprise",
+			EnvVar: "BUILDKITE_PUBLISH_GITHUB_API_URL",
+		},
+		cli.StringSliceFlag{
+			Name:   "header",
+			Value:  &cli.StringSlice{},
+			Usage:  "A header to send with each request to an http:// or https:// target, like \"Authorization: Bearer xyz\"",
+			EnvVar: "BUILDKITE_PUBLISH_HEADERS",
+		},
+		cli.StringFlag{
+			Name:   "version",
+			Value:  "",
+			Usage:  "The version being released. Defaults to the tag without a leading \"v\"",
+			EnvVar: "BUILDKITE_PUBLISH_VERSION",
+		},
+		cli.StringFlag{
+			Name:   "tag",
+			Value:  "",
+			Usage:  "The tag being released",
+			EnvVar: "BUILDKITE_TAG",
+		},
+		cli.StringFlag{
+			Name:   "pipeline",
+			Value:  "",
+			Usage:  "The slug of the pipeline being released",
+			EnvVar: "BUILDKITE_PIPELINE_SLUG",
+		},
+		cli.StringFlag{
+			Name:   "branch",
+			Value:  "",
+			Usage:  "The branch being released",
+			EnvVar: "BUILDKITE_BRANCH",
+		},
+		cli.StringFlag{
+			Name:   "commit",
+			Value:  "",
+			Usage:  "The commit being released",
+			EnvVar: "BUILDKITE_COMMIT",
+		},
+		cli.StringFlag{
+			Name:   "build-number",
+			Value:  "",
+			Usage:  "The number of the build being released",
+			EnvVar: "BUILDKITE_BUILD_NUMBER",
+		},
+
+		// API Flags
+		DebugHTTPFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+		FollowSymlinksFlag,
+	},
+	Action: func(c *cli.Context) {
+		ctx := context.Background()
+
+		// The configuration will be loaded into this struct
+		cfg := ArtifactPublishConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		version := cfg.Version
+		if version == "" {
+			version = strings.TrimPrefix(cfg.Tag, "v")
+		}
+
+		publisher, err := agent.NewReleasePublisher(l, agent.ReleasePublisherConfig{
+			Paths:        cfg.Paths,
+			Target:       cfg.Target,
+			PathTemplate: cfg.PathTemplate,
+			ContentType:  cfg.ContentType,
+			Checksums:    !cfg.NoChecksums,
+			GitHubToken:  cfg.GitHubToken,
+			GitHubAPIURL: cfg.GitHubAPIURL,
+			Headers:      cfg.Headers,
+			Release: agent.ReleaseInfo{
+				Version:     version,
+				Tag:         cfg.Tag,
+				Pipeline:    cfg.Pipeline,
+				Branch:      cfg.Branch,
+				Commit:      cfg.Commit,
+				BuildNumber: cfg.BuildNumber,
+			},
+			DebugHTTP:      cfg.DebugHTTP,
+			FollowSymlinks: cfg.FollowSymlinks,
+		})
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		if err := publisher.Publish(ctx); err != nil {
+			l.Fatal("Failed to publish: %s", err)
+		}
+	},
+}
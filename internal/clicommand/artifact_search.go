@@ -8,9 +8,9 @@ import (
 	"strings"
 	"time"
 
-	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
-	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
 	"github.com/urfave/cli"
 )
 
@@ -62,10 +62,13 @@ type ArtifactSearchConfig struct {
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP        bool     `cli:"debug-http"`
+	DNSOverrides     []string `cli:"dns-override" normalize:"list"`
+	DNSResolver      string   `cli:"dns-resolver"`
+	AgentAccessToken string   `cli:"agent-access-token" validate:"required-without:JobAPISocket"`
+	Endpoint         string   `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool     `cli:"no-http2"`
+	JobAPISocket     string   `cli:"job-api-socket"`
 }
 
 var ArtifactSearchCommand = cli.Command{
@@ -127,6 +130,9 @@ Format specifiers:
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		DNSOverridesFlag,
+		DNSResolverFlag,
+		JobAPISocketFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -0,0 +1,238 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/urfave/cli"
+)
+
+const uploadHelpDescription = `Usage:
+
+   buildkite-agent artifact upload [options] <pattern> [destination]
+
+Description:
+
+   Uploads files to a job as artifacts.
+
+   You need to ensure that the paths are surrounded by quotes otherwise the
+   built-in shell path globbing will provide the files, which is currently not
+   supported.
+
+   Paths are separated by ';', and can have '*', '?', '[abc]', '**' for any
+   number of directories, and '{a,b}' for either of a or b in them. Paths
+   starting with '!' exclude the files the others match. Artifact downloads
+   match paths the same way.
+
+   You can specify an alternate destination on Amazon S3, Google Cloud Storage,
+   Artifactory or Azure Blob Storage as per the examples below. This may be specified in the
+   'destination' argument, or in the 'BUILDKITE_ARTIFACT_UPLOAD_DESTINATION'
+   environment variable.  Otherwise, artifacts are uploaded to a
+   Buildkite-managed Amazon S3 bucket, where they’re retained for six months.
+
+Example:
+
+   $ buildkite-agent artifact upload "log/**/*.log"
+
+   $ buildkite-agent artifact upload "dist/**/*.{js,css};!dist/**/*.map"
+
+   You can also upload directly to Amazon S3 if you'd like to host your own artifacts:
+
+   $ export BUILDKITE_S3_ACCESS_KEY_ID=xxx
+   $ export BUILDKITE_S3_SECRET_ACCESS_KEY=yyy
+   $ export BUILDKITE_S3_DEFAULT_REGION=eu-central-1 # default is us-east-1
+   $ export BUILDKITE_S3_ACL=private # default is public-read
+   $ buildkite-agent artifact upload "log/**/*.log" s3://name-of-your-s3-bucket/$BUILDKITE_JOB_ID
+
+   You can use Amazon IAM assumed roles by specifying the session token:
+
+   $ export BUILDKITE_S3_SESSION_TOKEN=zzz
+
+   Or upload to an S3-compatible store like MinIO or Ceph by setting its
+   endpoint. Buckets are then addressed by path, and aren't asked for their
+   region, unless you set BUILDKITE_S3_FORCE_PATH_STYLE=false or
+   BUILDKITE_S3_SKIP_REGION_LOOKUP=false:
+
+   $ export BUILDKITE_S3_ENDPOINT=https://minio.example.com:9000
+   $ buildkite-agent artifact upload "log/**/*.log" s3://name-of-your-bucket/$BUILDKITE_JOB_ID
+
+   Or upload directly to Google Cloud Storage:
+
+   $ export BUILDKITE_GS_ACL=private
+   $ buildkite-agent artifact upload "log/**/*.log" gs://name-of-your-gs-bucket/$BUILDKITE_JOB_ID
+
+   Or upload directly to Artifactory:
+
+   $ export BUILDKITE_ARTIFACTORY_URL=http://my-artifactory-instance.com/artifactory
+   $ export BUILDKITE_ARTIFACTORY_USER=carol-danvers
+   $ export BUILDKITE_ARTIFACTORY_PASSWORD=xxx
+   $ buildkite-agent artifact upload "log/**/*.log" rt://name-of-your-artifactory-repo/$BUILDKITE_JOB_ID
+
+   Or upload directly to Azure Blob Storage, with a SAS token or the agent's
+   Azure AD service principal, workload identity or managed identity:
+
+   $ export BUILDKITE_AZURE_BLOB_SAS_TOKEN=sv=...
+   $ buildkite-agent artifact upload "log/**/*.log" azblob://name-of-your-storage-account/name-of-your-container/$BUILDKITE_JOB_ID
+
+   Artifacts can be compressed with gzip or zstd (which needs the zstd command)
+   before they're uploaded, which adds .gz or .zst to their paths. Directories
+   named by a path without wildcards are archived into a single .tar.gz or
+   .tar.zst artifact, rather than skipped. Download them with --decompress to
+   get back what was uploaded:
+
+   $ buildkite-agent artifact upload --compress zstd "coverage;reports/*.xml"
+
+   Large artifacts uploaded to Amazon S3 or Azure Blob Storage are uploaded in
+   parts, a few at once. If an upload fails, only the parts that weren't
+   uploaded are uploaded when it's retried:
+
+   $ buildkite-agent artifact upload --upload-part-size 64 --upload-part-concurrency 8 "dist/*.tar.gz" s3://name-of-your-s3-bucket/$BUILDKITE_JOB_ID`
+
+var FollowSymlinksFlag = cli.BoolFlag{
+	Name:   "follow-symlinks",
+	Usage:  "Follow symbolic links while resolving globs",
+	EnvVar: "BUILDKITE_AGENT_ARTIFACT_SYMLINKS",
+}
+
+type ArtifactUploadConfig struct {
+	UploadPaths string `cli:"arg:0" label:"upload paths" validate:"required"`
+	Destination string `cli:"arg:1" label:"destination" env:"BUILDKITE_ARTIFACT_UPLOAD_DESTINATION"`
+	Job         string `cli:"job" validate:"required"`
+	ContentType string `cli:"content-type"`
+	Compress    string `cli:"compress"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+
+	// API config
+	DebugHTTP        bool     `cli:"debug-http"`
+	DNSOverrides     []string `cli:"dns-override" normalize:"list"`
+	DNSResolver      string   `cli:"dns-resolver"`
+	AgentAccessToken string   `cli:"agent-access-token" validate:"required-without:JobAPISocket"`
+	Endpoint         string   `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool     `cli:"no-http2"`
+	JobAPISocket     string   `cli:"job-api-socket"`
+
+	// Uploader flags
+	FollowSymlinks        bool `cli:"follow-symlinks"`
+	UploadPartSize        int  `cli:"upload-part-size"`
+	UploadPartConcurrency int  `cli:"upload-part-concurrency"`
+}
+
+var ArtifactUploadCommand = cli.Command{
+	Name:        "upload",
+	Usage:       "Uploads files to a job as artifacts",
+	Description: uploadHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job should the artifacts be uploaded to",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+		cli.StringFlag{
+			Name:   "content-type",
+			Value:  "",
+			Usage:  "A specific Content-Type to set for the artifacts (otherwise detected)",
+			EnvVar: "BUILDKITE_ARTIFACT_CONTENT_TYPE",
+		},
+		cli.StringFlag{
+			Name:   "compress",
+			Value:  "",
+			Usage:  "Compress artifacts with gzip or zstd before they're uploaded, archiving directories named by path into one artifact each",
+			EnvVar: "BUILDKITE_ARTIFACT_COMPRESS",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+		DNSOverridesFlag,
+		DNSResolverFlag,
+		JobAPISocketFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+		FollowSymlinksFlag,
+		cli.IntFlag{
+			Name:   "upload-part-size",
+			Value:  agent.DefaultUploadPartSize >> 20,
+			Usage:  "The size in MiB of the parts large artifacts are uploaded to s3:// and azblob:// destinations in",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_PART_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "upload-part-concurrency",
+			Value:  agent.DefaultUploadPartConcurrency,
+			Usage:  "How many parts of a large artifact to upload to s3:// and azblob:// destinations at once",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_PART_CONCURRENCY",
+		},
+	},
+	Action: func(c *cli.Context) {
+		ctx := context.Background()
+
+		// The configuration will be loaded into this struct
+		cfg := ArtifactUploadConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		if cfg.Compress != "" && !agent.ValidArtifactCompression(cfg.Compress) {
+			l.Fatal("--compress must be gzip or zstd, not %q", cfg.Compress)
+		}
+		if cfg.UploadPartSize < 1 {
+			l.Fatal("--upload-part-size must be at least 1 MiB")
+		}
+		if cfg.UploadPartConcurrency < 1 {
+			l.Fatal("--upload-part-concurrency must be at least 1")
+		}
+
+		// Create the API client
+		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
+
+		// Setup the uploader
+		uploader := agent.NewArtifactUploader(l, client, agent.ArtifactUploaderConfig{
+			JobID:           cfg.Job,
+			Paths:           cfg.UploadPaths,
+			Destination:     cfg.Destination,
+			ContentType:     cfg.ContentType,
+			DebugHTTP:       cfg.DebugHTTP,
+			FollowSymlinks:  cfg.FollowSymlinks,
+			PartSize:        int64(cfg.UploadPartSize) << 20,
+			PartConcurrency: cfg.UploadPartConcurrency,
+			Compression:     cfg.Compress,
+		})
+
+		// Upload the artifacts
+		if err := uploader.Upload(ctx); err != nil {
+			l.Fatal("Failed to upload artifacts: %s", err)
+		}
+	},
+}
@@ -0,0 +1,392 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/urfave/cli"
+)
+
+const badgeHelpDescription = `Usage:
+
+   buildkite-agent badge <destination> [options...]
+
+Description:
+
+   Writes the status of the job as a badge, for dashboards that can't reach
+   Buildkite to show it. Run it in a pre-exit hook to write the badge once the
+   job's command has finished.
+
+   The destination is a local directory, or an S3 bucket and path like
+   s3://my-bucket/badges. A JSON and an SVG badge are written to it, in a
+   directory for the pipeline named after the branch, like
+   my-pipeline/main.json and my-pipeline/main.svg, replacing any that are
+   already there. Use --name to name them something else.
+
+   The status is passed if the command exited with 0, failed if it didn't, and
+   running if it hasn't finished. Use --status to give it yourself.
+
+   Badges are uploaded to S3 using the same configuration as artifacts, like
+   BUILDKITE_S3_ACL.
+
+Example:
+
+   $ buildkite-agent badge /var/www/badges
+   $ buildkite-agent badge s3://my-bucket/badges --format svg
+   $ buildkite-agent badge /var/www/badges --name "deploy/production" --status passed`
+
+type BadgeConfig struct {
+	Destination string   `cli:"arg:0" label:"destination" validate:"required"`
+	Name        string   `cli:"name"`
+	Format      []string `cli:"format" normalize:"list"`
+	Label       string   `cli:"label"`
+	Status      string   `cli:"status"`
+	ExitStatus  string   `cli:"exit-status"`
+	Pipeline    string   `cli:"pipeline"`
+	Branch      string   `cli:"branch"`
+	Commit      string   `cli:"commit"`
+	BuildNumber string   `cli:"build-number"`
+	BuildURL    string   `cli:"build-url"`
+	Job         string   `cli:"job"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+
+	// API config
+	DebugHTTP bool `cli:"debug-http"`
+}
+
+var BadgeCommand = cli.Command{
+	Name:        "badge",
+	Usage:       "Write the status of the job as a JSON and SVG badge",
+	Description: badgeHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "name",
+			Value:  "",
+			Usage:  "The path of the badge in the destination, without an extension. Defaults to the pipeline's slug and the branch, like my-pipeline/main",
+			EnvVar: "BUILDKITE_BADGE_NAME",
+		},
+		cli.StringSliceFlag{
+			Name:   "format",
+			Value:  &cli.StringSlice{},
+			Usage:  "Which badges to write, json or svg. Defaults to both",
+			EnvVar: "BUILDKITE_BADGE_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "label",
+			Value:  "build",
+			Usage:  "The text on the left of the SVG badge",
+			EnvVar: "BUILDKITE_BADGE_LABEL",
+		},
+		cli.StringFlag{
+			Name:   "status",
+			Value:  "",
+			Usage:  "The status to show (′passed′, ′failed′ or ′running′). Defaults to the status of the job's command",
+			EnvVar: "BUILDKITE_BADGE_STATUS",
+		},
+		cli.StringFlag{
+			Name:   "exit-status",
+			Value:  "",
+			Usage:  "The exit status of the job's command",
+			EnvVar: "BUILDKITE_COMMAND_EXIT_STATUS",
+		},
+		cli.StringFlag{
+			Name:   "pipeline",
+			Value:  "",
+			Usage:  "The slug of the job's pipeline",
+			EnvVar: "BUILDKITE_PIPELINE_SLUG",
+		},
+		cli.StringFlag{
+			Name:   "branch",
+			Value:  "",
+			Usage:  "The branch being built",
+			EnvVar: "BUILDKITE_BRANCH",
+		},
+		cli.StringFlag{
+			Name:   "commit",
+			Value:  "",
+			Usage:  "The commit being built",
+			EnvVar: "BUILDKITE_COMMIT",
+		},
+		cli.StringFlag{
+			Name:   "build-number",
+			Value:  "",
+			Usage:  "The number of the job's build",
+			EnvVar: "BUILDKITE_BUILD_NUMBER",
+		},
+		cli.StringFlag{
+			Name:   "build-url",
+			Value:  "",
+			Usage:  "The URL of the job's build",
+			EnvVar: "BUILDKITE_BUILD_URL",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job the badge is for",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+
+		// API Flags
+		DebugHTTPFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := BadgeConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		b, err := cfg.badge(time.Now())
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		files, err := b.render(cfg.Format)
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		if strings.HasPrefix(cfg.Destination, "s3://") {
+			err = uploadBadges(l, cfg, files)
+		} else {
+			err = writeFiles(cfg.Destination, files)
+		}
+		if err != nil {
+			l.Fatal("Failed to write badge: %v", err)
+		}
+
+		for _, name := range sortedFileNames(files) {
+			l.Info("Wrote %s badge to %s", b.Status, path.Join(cfg.Destination, name))
+		}
+	},
+}
+
+// badge is the status of a job, as written to a JSON badge
+type badge struct {
+	Name        string    `json:"-"`
+	Label       string    `json:"label"`
+	Status      string    `json:"status"`
+	Message     string    `json:"message"`
+	Color       string    `json:"color"`
+	ExitStatus  string    `json:"exit_status,omitempty"`
+	Pipeline    string    `json:"pipeline,omitempty"`
+	Branch      string    `json:"branch,omitempty"`
+	Commit      string    `json:"commit,omitempty"`
+	BuildNumber string    `json:"build_number,omitempty"`
+	BuildURL    string    `json:"build_url,omitempty"`
+	Job         string    `json:"job,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// The message and color shown for each status
+var badgeStatuses = map[string]struct{ message, color string }{
+	"passed":  {"passing", "#44cc11"},
+	"failed":  {"failing", "#e05d44"},
+	"running": {"running", "#007ec6"},
+}
+
+func (cfg BadgeConfig) badge(now time.Time) (badge, error) {
+	status := cfg.Status
+	if status == "" {
+		switch cfg.ExitStatus {
+		case "":
+			status = "running"
+		case "0":
+			status = "passed"
+		default:
+			status = "failed"
+		}
+	}
+	style, ok := badgeStatuses[status]
+	if !ok {
+		return badge{}, fmt.Errorf("Invalid --status %q, expected passed, failed or running", status)
+	}
+
+	name := cfg.Name
+	if name == "" {
+		if cfg.Pipeline == "" || cfg.Branch == "" {
+			return badge{}, fmt.Errorf("Missing the pipeline or branch to name the badge after, use --name to name it")
+		}
+		// Keep branches like feature/foo from being nested
+		name = cfg.Pipeline + "/" + strings.ReplaceAll(cfg.Branch, "/", "-")
+	}
+	name = strings.Trim(path.Clean("/"+filepath.ToSlash(name)), "/")
+	if name == "" {
+		return badge{}, fmt.Errorf("Invalid --name %q", cfg.Name)
+	}
+
+	return badge{
+		Name:        name,
+		Label:       cfg.Label,
+		Status:      status,
+		Message:     style.message,
+		Color:       style.color,
+		ExitStatus:  cfg.ExitStatus,
+		Pipeline:    cfg.Pipeline,
+		Branch:      cfg.Branch,
+		Commit:      cfg.Commit,
+		BuildNumber: cfg.BuildNumber,
+		BuildURL:    cfg.BuildURL,
+		Job:         cfg.Job,
+		UpdatedAt:   now.UTC(),
+	}, nil
+}
+
+// render returns the badge in each of the formats, by the path to write it to
+func (b badge) render(formats []string) (map[string][]byte, error) {
+	if len(formats) == 0 {
+		formats = []string{"json", "svg"}
+	}
+
+	files := map[string][]byte{}
+	for _, format := range formats {
+		switch format {
+		case "json":
+			data, err := json.MarshalIndent(b, "", "  ")
+			if err != nil {
+				return nil, err
+			}
+			files[b.Name+".json"] = append(data, '\n')
+		case "svg":
+			files[b.Name+".svg"] = []byte(b.svg())
+		default:
+			return nil, fmt.Errorf("Invalid --format %q, expected json or svg", format)
+		}
+	}
+	return files, nil
+}
+
+// svg draws the badge in the flat style of most badges, with the label on
+// the left and the message on the right
+func (b badge) svg() string {
+	// Verdana 11px is about 7px a character
+	labelWidth := utf8.RuneCountInString(b.Label)*7 + 10
+	messageWidth := utf8.RuneCountInString(b.Message)*7 + 10
+	width := labelWidth + messageWidth
+	label, message := html.EscapeString(b.Label), html.EscapeString(b.Message)
+
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">
+  <title>%[4]s: %[5]s</title>
+  <rect width="%[2]d" height="20" fill="#555"/>
+  <rect x="%[2]d" width="%[3]d" height="20" fill="%[6]s"/>
+  <g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+    <text x="%[7]d" y="14">%[4]s</text>
+    <text x="%[8]d" y="14">%[5]s</text>
+  </g>
+</svg>
+`, width, labelWidth, messageWidth, label, message, b.Color, labelWidth/2, labelWidth+messageWidth/2)
+}
+
+func sortedFileNames(files map[string][]byte) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeFiles writes files, like badges, to a local directory. Each is
+// written to a temporary file first, so dashboards never read half of one.
+func writeFiles(dir string, files map[string][]byte) error {
+	for _, name := range sortedFileNames(files) {
+		dest := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+			return err
+		}
+
+		f, err := os.CreateTemp(filepath.Dir(dest), ".buildkite-*")
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(files[name])
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Chmod(f.Name(), 0o644)
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), dest)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadBadges uploads the badges to S3, as if they were artifacts
+func uploadBadges(l logger.Logger, cfg BadgeConfig, files map[string][]byte) error {
+	uploader, err := agent.NewS3Uploader(l, agent.S3UploaderConfig{
+		Destination: cfg.Destination,
+		DebugHTTP:   cfg.DebugHTTP,
+	})
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "buildkite-badge")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := writeFiles(dir, files); err != nil {
+		return err
+	}
+
+	contentTypes := map[string]string{".json": "application/json", ".svg": "image/svg+xml"}
+	for _, name := range sortedFileNames(files) {
+		err := uploader.Upload(&api.Artifact{
+			Path:         name,
+			AbsolutePath: filepath.Join(dir, filepath.FromSlash(name)),
+			ContentType:  contentTypes[path.Ext(name)],
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBadgeStatus(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		cfg  BadgeConfig
+		want string
+	}{
+		{BadgeConfig{ExitStatus: "0"}, "passed"},
+		{BadgeConfig{ExitStatus: "2"}, "failed"},
+		{BadgeConfig{}, "running"},
+		{BadgeConfig{ExitStatus: "1", Status: "passed"}, "passed"},
+	} {
+		tc.cfg.Pipeline, tc.cfg.Branch = "llamas", "feature/wool"
+		b, err := tc.cfg.badge(now)
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, b.Status, "%+v", tc.cfg)
+		assert.Equal(t, "llamas/feature-wool", b.Name)
+	}
+
+	for _, cfg := range []BadgeConfig{
+		{Status: "skipped", Name: "llamas"},
+		{ExitStatus: "0"},
+		{ExitStatus: "0", Name: "/../"},
+	} {
+		_, err := cfg.badge(now)
+		assert.Error(t, err, "%+v", cfg)
+	}
+}
+
+func TestWriteBadges(t *testing.T) {
+	t.Parallel()
+
+	b, err := BadgeConfig{
+		Name:       "../deploy/production",
+		Label:      "deploy <prod>",
+		ExitStatus: "1",
+		Commit:     "abc123",
+	}.badge(time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+
+	files, err := b.render(nil)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, writeFiles(dir, files))
+
+	data, err := os.ReadFile(filepath.Join(dir, "deploy", "production.json"))
+	require.NoError(t, err)
+	var got map[string]any
+	require.NoError(t, json.Unmarshal(data, &got))
+	assert.Equal(t, map[string]any{
+		"label":       "deploy <prod>",
+		"status":      "failed",
+		"message":     "failing",
+		"color":       "#e05d44",
+		"exit_status": "1",
+		"commit":      "abc123",
+		"updated_at":  "2023-04-01T12:00:00Z",
+	}, got)
+
+	svg, err := os.ReadFile(filepath.Join(dir, "deploy", "production.svg"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(svg), "<svg "), string(svg))
+	assert.Contains(t, string(svg), ">deploy &lt;prod&gt;</text>")
+	assert.Contains(t, string(svg), ">failing</text>")
+
+	_, err = b.render([]string{"png"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,333 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/buildkite/shellwords"
+	"github.com/urfave/cli"
+)
+
+const benchHelpDescription = `Usage:
+
+   buildkite-agent bench [options...]
+
+Description:
+
+   Benchmarks the host by running synthetic jobs through the agent's job
+   runner and bootstrap, the same as real jobs, against a mock of the Agent
+   API rather than Buildkite. Use it to check a host can run as many jobs at
+   once as it'll be given before rolling it out.
+
+   Each job writes --output-bytes of log output, no faster than --output-rate
+   bytes a second, and uploads --artifacts artifacts of --artifact-size bytes.
+   Jobs check out a small repository to --build-path, with the hooks in
+   --hooks-path, so the host's disk and its own hooks are benchmarked too.
+   Settings are read from the agent's configuration file if there is one.
+
+   When the jobs have all finished, it reports how long they took, and how
+   much log output and artifacts the host could send. It exits with a status
+   of 1 if any of the jobs failed.
+
+Example:
+
+   $ buildkite-agent bench --jobs 50 --concurrency 8 --output-bytes 10485760 --artifacts 5`
+
+type BenchConfig struct {
+	Config           string `cli:"config"`
+	Jobs             int    `cli:"jobs"`
+	Concurrency      int    `cli:"concurrency"`
+	OutputBytes      int    `cli:"output-bytes"`
+	OutputRate       int    `cli:"output-rate"`
+	Artifacts        int    `cli:"artifacts"`
+	ArtifactSize     int    `cli:"artifact-size"`
+	BootstrapScript  string `cli:"bootstrap-script" normalize:"commandpath"`
+	BuildPath        string `cli:"build-path" normalize:"filepath"`
+	HooksPath        string `cli:"hooks-path" normalize:"filepath"`
+	PluginsPath      string `cli:"plugins-path" normalize:"filepath"`
+	GitCheckoutFlags string `cli:"git-checkout-flags"`
+	GitCloneFlags    string `cli:"git-clone-flags"`
+	GitCleanFlags    string `cli:"git-clean-flags"`
+	GitFetchFlags    string `cli:"git-fetch-flags"`
+	Shell            string `cli:"shell"`
+	NoPTY            bool   `cli:"no-pty"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var BenchCommand = cli.Command{
+	Name:        "bench",
+	Usage:       "Benchmark the host by running synthetic jobs",
+	Description: benchHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "Path to the agent's configuration file, to read the build, hooks and plugins paths from",
+			EnvVar: "BUILDKITE_AGENT_CONFIG",
+		},
+		cli.IntFlag{
+			Name:   "jobs",
+			Value:  10,
+			Usage:  "How many synthetic jobs to run",
+			EnvVar: "BUILDKITE_BENCH_JOBS",
+		},
+		cli.IntFlag{
+			Name:   "concurrency",
+			Value:  1,
+			Usage:  "How many of the jobs to run at once, like the agent's --spawn",
+			EnvVar: "BUILDKITE_BENCH_CONCURRENCY",
+		},
+		cli.IntFlag{
+			Name:   "output-bytes",
+			Value:  1024 * 1024,
+			Usage:  "How many bytes of log output each job writes",
+			EnvVar: "BUILDKITE_BENCH_OUTPUT_BYTES",
+		},
+		cli.IntFlag{
+			Name:   "output-rate",
+			Value:  0,
+			Usage:  "How many bytes of log output each job writes a second, or 0 for as many as it can",
+			EnvVar: "BUILDKITE_BENCH_OUTPUT_RATE",
+		},
+		cli.IntFlag{
+			Name:   "artifacts",
+			Value:  1,
+			Usage:  "How many artifacts each job uploads",
+			EnvVar: "BUILDKITE_BENCH_ARTIFACTS",
+		},
+		cli.IntFlag{
+			Name:   "artifact-size",
+			Value:  1024 * 1024,
+			Usage:  "How many bytes each artifact is",
+			EnvVar: "BUILDKITE_BENCH_ARTIFACT_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "bootstrap-script",
+			Value:  "",
+			Usage:  "The command that runs each job, which defaults to this agent's bootstrap",
+			EnvVar: "BUILDKITE_BOOTSTRAP_SCRIPT_PATH",
+		},
+		cli.StringFlag{
+			Name:   "build-path",
+			Value:  "",
+			Usage:  "Path to where the jobs will run from, which defaults to a temporary directory",
+			EnvVar: "BUILDKITE_BUILD_PATH",
+		},
+		cli.StringFlag{
+			Name:   "hooks-path",
+			Value:  "",
+			Usage:  "Directory where the hook scripts are found",
+			EnvVar: "BUILDKITE_HOOKS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "plugins-path",
+			Value:  "",
+			Usage:  "Directory where the plugins are saved to",
+			EnvVar: "BUILDKITE_PLUGINS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "git-checkout-flags",
+			Value:  "-f",
+			Usage:  "Flags to pass to \"git checkout\" command",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_FLAGS",
+		},
+		cli.StringFlag{
+			Name:   "git-clone-flags",
+			Value:  "-v",
+			Usage:  "Flags to pass to the \"git clone\" command",
+			EnvVar: "BUILDKITE_GIT_CLONE_FLAGS",
+		},
+		cli.StringFlag{
+			Name:   "git-clean-flags",
+			Value:  "-ffxdq",
+			Usage:  "Flags to pass to \"git clean\" command",
+			EnvVar: "BUILDKITE_GIT_CLEAN_FLAGS",
+		},
+		cli.StringFlag{
+			Name:   "git-fetch-flags",
+			Value:  "-v --prune",
+			Usage:  "Flags to pass to \"git fetch\" command",
+			EnvVar: "BUILDKITE_GIT_FETCH_FLAGS",
+		},
+		cli.StringFlag{
+			Name:   "shell",
+			Value:  DefaultShell(),
+			Usage:  "The shell command used to interpret build commands, e.g /bin/bash -e -c",
+			EnvVar: "BUILDKITE_SHELL",
+		},
+		cli.BoolFlag{
+			Name:   "no-pty",
+			Usage:  "Do not run jobs within a pseudo terminal",
+			EnvVar: "BUILDKITE_NO_PTY",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := BenchConfig{}
+
+		loader := cliconfig.Loader{
+			CLI:                    c,
+			Config:                 &cfg,
+			DefaultConfigFilePaths: DefaultConfigFilePaths(),
+		}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		if cfg.Jobs < 1 {
+			l.Fatal("--jobs must be at least 1")
+		}
+		if cfg.Concurrency < 1 {
+			l.Fatal("--concurrency must be at least 1")
+		}
+		if cfg.OutputBytes < 0 || cfg.OutputRate < 0 || cfg.Artifacts < 0 || cfg.ArtifactSize < 0 {
+			l.Fatal("--output-bytes, --output-rate, --artifacts and --artifact-size can't be negative")
+		}
+
+		exePath, err := os.Executable()
+		if err != nil {
+			l.Fatal("Unable to find executable path for bootstrap")
+		}
+		if cfg.BootstrapScript == "" {
+			cfg.BootstrapScript = fmt.Sprintf("%s bootstrap", shellwords.Quote(exePath))
+		}
+
+		if cfg.BuildPath == "" {
+			buildPath, err := os.MkdirTemp("", "buildkite-bench-")
+			if err != nil {
+				l.Fatal("Couldn't create a build path: %v", err)
+			}
+			defer os.RemoveAll(buildPath)
+			cfg.BuildPath = buildPath
+		}
+
+		// Windows doesn't support PTYs
+		if runtime.GOOS == "windows" {
+			cfg.NoPTY = true
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		l.Info("Running %d synthetic jobs, %d at a time", cfg.Jobs, cfg.Concurrency)
+
+		report, err := agent.RunBench(ctx, l, agent.BenchConfig{
+			Jobs:        cfg.Jobs,
+			Concurrency: cfg.Concurrency,
+			Spec: agent.BenchJobSpec{
+				OutputBytes:   cfg.OutputBytes,
+				OutputRate:    cfg.OutputRate,
+				ArtifactCount: cfg.Artifacts,
+				ArtifactSize:  cfg.ArtifactSize,
+			},
+			JobCommand: fmt.Sprintf("%s bench-job", shellwords.Quote(exePath)),
+			AgentConfiguration: agent.AgentConfiguration{
+				BootstrapScript:   cfg.BootstrapScript,
+				BuildPath:         cfg.BuildPath,
+				HooksPath:         cfg.HooksPath,
+				PluginsPath:       cfg.PluginsPath,
+				GitCheckoutFlags:  cfg.GitCheckoutFlags,
+				GitCloneFlags:     cfg.GitCloneFlags,
+				GitCleanFlags:     cfg.GitCleanFlags,
+				GitFetchFlags:     cfg.GitFetchFlags,
+				Shell:             cfg.Shell,
+				CommandEval:       true,
+				PluginsEnabled:    true,
+				PluginValidation:  true,
+				LocalHooksEnabled: true,
+				RunInPty:          !cfg.NoPTY,
+				JobResourceUsage:  true,
+			},
+		})
+		if err != nil {
+			l.Fatal("Benchmark failed: %v", err)
+		}
+
+		if _, err := report.WriteTo(c.App.Writer); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		if report.FailedJobs > 0 {
+			done()
+			os.Exit(1)
+		}
+	},
+}
+
+type BenchJobConfig struct {
+	OutputBytes  int `cli:"output-bytes"`
+	OutputRate   int `cli:"output-rate"`
+	Artifacts    int `cli:"artifacts"`
+	ArtifactSize int `cli:"artifact-size"`
+}
+
+// BenchJobCommand is what the synthetic jobs run by bench run
+var BenchJobCommand = cli.Command{
+	Name:   "bench-job",
+	Usage:  "Do the work of one of bench's synthetic jobs",
+	Hidden: true,
+	Flags: []cli.Flag{
+		cli.IntFlag{Name: "output-bytes"},
+		cli.IntFlag{Name: "output-rate"},
+		cli.IntFlag{Name: "artifacts"},
+		cli.IntFlag{Name: "artifact-size"},
+	},
+	Action: func(c *cli.Context) {
+		cfg := BenchJobConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		if _, err := loader.Load(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+
+		dir, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+
+		spec := agent.BenchJobSpec{
+			OutputBytes:   cfg.OutputBytes,
+			OutputRate:    cfg.OutputRate,
+			ArtifactCount: cfg.Artifacts,
+			ArtifactSize:  cfg.ArtifactSize,
+		}
+		if err := spec.Generate(context.Background(), c.App.Writer, dir); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	},
+}
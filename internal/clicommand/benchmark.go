@@ -0,0 +1,671 @@
+package clicommand
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/urfave/cli"
+)
+
+// How many results of each benchmark are kept for a branch
+const maxBenchmarkHistory = 50
+
+const benchmarkUploadHelpDescription = `Usage:
+
+   buildkite-agent benchmark upload <results> [options...]
+
+Description:
+
+   Reads benchmark results, keeps them for the build's branch, and compares
+   them with the results kept for the branch its pull request is to be
+   merged into, or the pipeline's default branch. The build is annotated with
+   how much each benchmark has changed, and benchmarks that have got worse by
+   more than --threshold percent are called out as regressions.
+
+   Results can be the output of go test -bench, or the JSON JMH writes with
+   -rf json. Their format is worked out from what's in them, or can be given
+   with --format. Separate more than one file with a semicolon, or use a glob.
+   When a benchmark's run more than once, its median is used.
+
+   Results are kept in --store, which is an S3 path like
+   s3://my-bucket/benchmarks or a directory the pipeline's agents share, the
+   same as the build cache's destination. Each benchmark is compared with the
+   median of the last --history results of the target branch, so one noisy
+   build doesn't make every change look like a regression.
+
+   The number of regressions is kept in the benchmark-<context>-regressions
+   meta-data key. With --fail-on-regression, the command exits with a status
+   of 1 when there are any.
+
+Example:
+
+   $ go test -run '^$' -bench . ./... | tee bench.txt
+   $ buildkite-agent benchmark upload bench.txt --store s3://my-bucket/benchmarks
+   $ buildkite-agent benchmark upload "build/jmh/*.json" --threshold 5 --fail-on-regression`
+
+type BenchmarkUploadConfig struct {
+	Results          string `cli:"arg:0" label:"benchmark results" validate:"required"`
+	Format           string `cli:"format"`
+	Context          string `cli:"context"`
+	Store            string `cli:"store"`
+	Threshold        int    `cli:"threshold"`
+	History          int    `cli:"history"`
+	FailOnRegression bool   `cli:"fail-on-regression"`
+	Pipeline         string `cli:"pipeline"`
+	Branch           string `cli:"branch"`
+	TargetBranch     string `cli:"target-branch"`
+	DefaultBranch    string `cli:"default-branch"`
+	Commit           string `cli:"commit"`
+	BuildNumber      string `cli:"build-number"`
+	Job              string `cli:"job" validate:"required"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+
+	// API config
+	DebugHTTP        bool     `cli:"debug-http"`
+	DNSOverrides     []string `cli:"dns-override" normalize:"list"`
+	DNSResolver      string   `cli:"dns-resolver"`
+	AgentAccessToken string   `cli:"agent-access-token" validate:"required-without:JobAPISocket"`
+	Endpoint         string   `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool     `cli:"no-http2"`
+	JobAPISocket     string   `cli:"job-api-socket"`
+}
+
+var BenchmarkUploadCommand = cli.Command{
+	Name:        "upload",
+	Usage:       "Keeps benchmark results and annotates the build with how they've changed",
+	Description: benchmarkUploadHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "format",
+			Value:  "",
+			Usage:  "The format of the results: go or jmh. Defaults to working it out from each file",
+			EnvVar: "BUILDKITE_BENCHMARK_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "context",
+			Value:  "default",
+			Usage:  "Which of the build's benchmarks these are, like the name of the project they're for",
+			EnvVar: "BUILDKITE_BENCHMARK_CONTEXT",
+		},
+		cli.StringFlag{
+			Name:   "store",
+			Value:  "",
+			Usage:  "An S3 path like s3://my-bucket/benchmarks, or a directory, to keep each branch's results in",
+			EnvVar: "BUILDKITE_BENCHMARK_STORE",
+		},
+		cli.IntFlag{
+			Name:   "threshold",
+			Value:  10,
+			Usage:  "How many percent worse a benchmark can get before it's a regression",
+			EnvVar: "BUILDKITE_BENCHMARK_THRESHOLD",
+		},
+		cli.IntFlag{
+			Name:   "history",
+			Value:  5,
+			Usage:  "How many of the target branch's latest results to compare with",
+			EnvVar: "BUILDKITE_BENCHMARK_HISTORY",
+		},
+		cli.BoolFlag{
+			Name:   "fail-on-regression",
+			Usage:  "Exit with a status of 1 if any benchmark has regressed",
+			EnvVar: "BUILDKITE_BENCHMARK_FAIL_ON_REGRESSION",
+		},
+		cli.StringFlag{
+			Name:   "pipeline",
+			Value:  "",
+			Usage:  "The slug of the job's pipeline",
+			EnvVar: "BUILDKITE_PIPELINE_SLUG",
+		},
+		cli.StringFlag{
+			Name:   "branch",
+			Value:  "",
+			Usage:  "The branch being built",
+			EnvVar: "BUILDKITE_BRANCH",
+		},
+		cli.StringFlag{
+			Name:   "target-branch",
+			Value:  "",
+			Usage:  "The branch to compare the results with, which defaults to the one the pull request is to be merged into",
+			EnvVar: "BUILDKITE_PULL_REQUEST_BASE_BRANCH",
+		},
+		cli.StringFlag{
+			Name:   "default-branch",
+			Value:  "",
+			Usage:  "The branch to compare the results with when the build isn't for a pull request",
+			EnvVar: "BUILDKITE_PIPELINE_DEFAULT_BRANCH",
+		},
+		cli.StringFlag{
+			Name:   "commit",
+			Value:  "",
+			Usage:  "The commit being built",
+			EnvVar: "BUILDKITE_COMMIT",
+		},
+		cli.StringFlag{
+			Name:   "build-number",
+			Value:  "",
+			Usage:  "The number of the job's build",
+			EnvVar: "BUILDKITE_BUILD_NUMBER",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job should the results be kept for",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+		DNSOverridesFlag,
+		DNSResolverFlag,
+		JobAPISocketFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		ctx := context.Background()
+
+		// The configuration will be loaded into this struct
+		cfg := BenchmarkUploadConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		if cfg.Threshold < 0 {
+			l.Fatal("--threshold must be 0 or more")
+		}
+		if cfg.History < 1 {
+			l.Fatal("--history must be 1 or more")
+		}
+
+		if err := uploadBenchmarks(ctx, cfg, l); err != nil {
+			l.Fatal("%s", err)
+		}
+	},
+}
+
+func uploadBenchmarks(ctx context.Context, cfg BenchmarkUploadConfig, l logger.Logger) error {
+	var results []benchmarkResult
+	for _, pattern := range strings.Split(cfg.Results, agent.ArtifactPathDelimiter) {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid results pattern %q: %w", pattern, err)
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("No benchmark results match %q", pattern)
+		}
+
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return fmt.Errorf("Failed to read benchmark results: %w", err)
+			}
+			parsed, err := parseBenchmarkResults(data, cfg.Format)
+			if err != nil {
+				return fmt.Errorf("Failed to parse benchmark results %s: %w", file, err)
+			}
+			l.Info("Read %d benchmark results from %s", len(parsed), file)
+			results = append(results, parsed...)
+		}
+	}
+	results = medianBenchmarkResults(results)
+	if len(results) == 0 {
+		return errors.New("There aren't any benchmark results")
+	}
+
+	// Not being able to keep or compare the results shouldn't fail the build
+	var baseline *benchmarkHistory
+	target := cfg.TargetBranch
+	if target == "" {
+		target = cfg.DefaultBranch
+	}
+	if cfg.Store != "" {
+		if cfg.Pipeline == "" || cfg.Branch == "" || target == "" {
+			l.Warn("Missing the pipeline or branches to keep and compare the benchmark results with")
+		} else if store, err := agent.NewBuildCacheStore(l, cfg.Store); err != nil {
+			l.Warn("Failed to open the benchmark store: %v", err)
+		} else {
+			baseline, err = loadBenchmarkHistory(ctx, store, benchmarkHistoryKey(cfg.Pipeline, cfg.Context, target))
+			if err != nil {
+				l.Warn("Failed to load the benchmark results of %s to compare with: %v", target, err)
+			} else if baseline == nil {
+				l.Info("There are no benchmark results of %s to compare with yet", target)
+			}
+
+			if err := saveBenchmarkResults(ctx, store, cfg, results); err != nil {
+				l.Warn("Failed to keep the benchmark results of %s: %v", cfg.Branch, err)
+			}
+		}
+	}
+
+	comparisons := compareBenchmarks(results, baseline, cfg.History, float64(cfg.Threshold))
+	regressions := 0
+	for _, c := range comparisons {
+		if c.Regressed {
+			regressions++
+			l.Warn("%s regressed by %s", c.Name, formatBenchmarkChange(c.Change))
+		}
+	}
+
+	client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
+	if err := setMetaData(ctx, l, client, cfg.Job, "benchmark-"+cfg.Context+"-regressions", strconv.Itoa(regressions)); err != nil {
+		return err
+	}
+
+	style := "success"
+	switch {
+	case regressions > 0 && cfg.FailOnRegression:
+		style = "error"
+	case regressions > 0:
+		style = "warning"
+	case baseline == nil:
+		style = "info"
+	}
+
+	err := annotate(ctx, AnnotateConfig{
+		Body:             benchmarkMarkdown(cfg.Context, target, cfg.Threshold, baseline != nil, comparisons),
+		Style:            style,
+		Context:          "benchmark-" + cfg.Context,
+		Job:              cfg.Job,
+		DebugHTTP:        cfg.DebugHTTP,
+		DNSOverrides:     cfg.DNSOverrides,
+		DNSResolver:      cfg.DNSResolver,
+		AgentAccessToken: cfg.AgentAccessToken,
+		Endpoint:         cfg.Endpoint,
+		NoHTTP2:          cfg.NoHTTP2,
+		JobAPISocket:     cfg.JobAPISocket,
+	}, l)
+	if err != nil {
+		return err
+	}
+
+	if regressions > 0 && cfg.FailOnRegression {
+		return fmt.Errorf("%d benchmarks regressed by more than %d%%", regressions, cfg.Threshold)
+	}
+	return nil
+}
+
+// benchmarkResult is a benchmark's measurement, like its ns/op
+type benchmarkResult struct {
+	Name           string
+	Value          float64
+	Unit           string
+	HigherIsBetter bool
+}
+
+func parseBenchmarkResults(data []byte, format string) ([]benchmarkResult, error) {
+	if format == "" {
+		format = detectBenchmarkFormat(data)
+	}
+
+	switch format {
+	case "go":
+		return parseGoBenchmarks(data)
+	case "jmh":
+		return parseJMHBenchmarks(data)
+	case "":
+		return nil, errors.New("It isn't go test -bench output or JMH JSON, use --format to say which it is")
+	default:
+		return nil, fmt.Errorf("Invalid format %q, expected go or jmh", format)
+	}
+}
+
+func detectBenchmarkFormat(data []byte) string {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(data, []byte("[")) && bytes.Contains(data, []byte(`"primaryMetric"`)):
+		return "jmh"
+	case bytes.HasPrefix(data, []byte("Benchmark")) || bytes.Contains(data, []byte("\nBenchmark")):
+		return "go"
+	}
+	return ""
+}
+
+// parseGoBenchmarks reads the benchmark format go test -bench writes, with
+// lines like
+// BenchmarkDecode-8   	  500000	      2456 ns/op	     512 B/op	       4 allocs/op
+// Only the first measurement of each benchmark, usually its ns/op, is used.
+// Names are prefixed by the package from the pkg: line before them.
+func parseGoBenchmarks(data []byte) ([]benchmarkResult, error) {
+	var results []benchmarkResult
+	pkg := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "pkg:") {
+			pkg = strings.TrimSpace(strings.TrimPrefix(line, "pkg:"))
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			continue
+		}
+
+		name := fields[0]
+		if pkg != "" {
+			name = pkg + "." + name
+		}
+		results = append(results, benchmarkResult{Name: name, Value: value, Unit: fields[3]})
+	}
+	return results, scanner.Err()
+}
+
+// jmhResult is the part of a JMH JSON result that's read
+type jmhResult struct {
+	Benchmark     string            `json:"benchmark"`
+	Mode          string            `json:"mode"`
+	Params        map[string]string `json:"params"`
+	PrimaryMetric struct {
+		Score     float64 `json:"score"`
+		ScoreUnit string  `json:"scoreUnit"`
+	} `json:"primaryMetric"`
+}
+
+// parseJMHBenchmarks reads the JSON JMH writes with -rf json. Benchmarks with
+// parameters are named with them, like com.example.MyBenchmark.decode{size=10}.
+// Throughput is better higher, and the other modes' times better lower.
+func parseJMHBenchmarks(data []byte) ([]benchmarkResult, error) {
+	var jmh []jmhResult
+	if err := json.Unmarshal(data, &jmh); err != nil {
+		return nil, err
+	}
+
+	results := make([]benchmarkResult, 0, len(jmh))
+	for _, r := range jmh {
+		name := r.Benchmark
+		if len(r.Params) > 0 {
+			params := make([]string, 0, len(r.Params))
+			for k, v := range r.Params {
+				params = append(params, k+"="+v)
+			}
+			sort.Strings(params)
+			name += "{" + strings.Join(params, ",") + "}"
+		}
+		results = append(results, benchmarkResult{
+			Name:           name,
+			Value:          r.PrimaryMetric.Score,
+			Unit:           r.PrimaryMetric.ScoreUnit,
+			HigherIsBetter: r.Mode == "thrpt",
+		})
+	}
+	return results, nil
+}
+
+// medianBenchmarkResults combines the results of benchmarks that were run
+// more than once, like with go test -count, into their median, and sorts
+// them by name
+func medianBenchmarkResults(results []benchmarkResult) []benchmarkResult {
+	values := make(map[string][]float64)
+	byName := make(map[string]benchmarkResult)
+	for _, r := range results {
+		values[r.Name] = append(values[r.Name], r.Value)
+		byName[r.Name] = r
+	}
+
+	medians := make([]benchmarkResult, 0, len(byName))
+	for name, r := range byName {
+		r.Value = median(values[name])
+		medians = append(medians, r)
+	}
+	sort.Slice(medians, func(i, j int) bool { return medians[i].Name < medians[j].Name })
+	return medians
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// benchmarkPoint is a result of a benchmark in a branch's history
+type benchmarkPoint struct {
+	Value       float64 `json:"value"`
+	Unit        string  `json:"unit"`
+	Commit      string  `json:"commit,omitempty"`
+	BuildNumber string  `json:"build_number,omitempty"`
+}
+
+// benchmarkHistory is the latest results of each benchmark on a branch,
+// oldest first
+type benchmarkHistory struct {
+	Benchmarks map[string][]benchmarkPoint `json:"benchmarks"`
+}
+
+// benchmarkHistoryKey is where a branch's history is kept in the store, like
+// benchmarks/my-pipeline/default/main.json
+func benchmarkHistoryKey(pipeline, benchmarkContext, branch string) string {
+	// Keep branches like feature/foo from being nested
+	return "benchmarks/" + pipeline + "/" + benchmarkContext + "/" + strings.ReplaceAll(branch, "/", "-") + ".json"
+}
+
+// loadBenchmarkHistory returns the history in the store, or nil if there
+// isn't any
+func loadBenchmarkHistory(ctx context.Context, store agent.BuildCacheStore, key string) (*benchmarkHistory, error) {
+	r, err := store.Get(ctx, key)
+	if errors.Is(err, agent.ErrBuildCacheMiss) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var h benchmarkHistory
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, err
+	}
+	if h.Benchmarks == nil {
+		h.Benchmarks = make(map[string][]benchmarkPoint)
+	}
+	return &h, nil
+}
+
+// saveBenchmarkResults adds the results to the build's branch's history,
+// dropping the oldest once there are too many
+func saveBenchmarkResults(ctx context.Context, store agent.BuildCacheStore, cfg BenchmarkUploadConfig, results []benchmarkResult) error {
+	key := benchmarkHistoryKey(cfg.Pipeline, cfg.Context, cfg.Branch)
+	h, err := loadBenchmarkHistory(ctx, store, key)
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		h = &benchmarkHistory{Benchmarks: make(map[string][]benchmarkPoint)}
+	}
+
+	for _, r := range results {
+		points := append(h.Benchmarks[r.Name], benchmarkPoint{
+			Value:       r.Value,
+			Unit:        r.Unit,
+			Commit:      cfg.Commit,
+			BuildNumber: cfg.BuildNumber,
+		})
+		if len(points) > maxBenchmarkHistory {
+			points = points[len(points)-maxBenchmarkHistory:]
+		}
+		h.Benchmarks[r.Name] = points
+	}
+
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, key, bytes.NewReader(append(data, '\n')))
+}
+
+// benchmarkComparison is how a benchmark compares with the baseline, the
+// median of the target branch's latest results
+type benchmarkComparison struct {
+	benchmarkResult
+
+	// Whether there's a baseline with the same unit to compare with
+	HasBaseline bool
+	Baseline    float64
+
+	// The change from the baseline in percent, positive when it's better
+	Change    float64
+	Regressed bool
+}
+
+func compareBenchmarks(results []benchmarkResult, baseline *benchmarkHistory, history int, threshold float64) []benchmarkComparison {
+	comparisons := make([]benchmarkComparison, 0, len(results))
+	for _, r := range results {
+		c := benchmarkComparison{benchmarkResult: r}
+
+		var values []float64
+		if baseline != nil {
+			for _, p := range baseline.Benchmarks[r.Name] {
+				if p.Unit == r.Unit {
+					values = append(values, p.Value)
+				}
+			}
+		}
+		if len(values) > history {
+			values = values[len(values)-history:]
+		}
+
+		if base := median(values); len(values) > 0 && base != 0 {
+			c.HasBaseline = true
+			c.Baseline = base
+			c.Change = 100 * (r.Value - base) / math.Abs(base)
+			if !r.HigherIsBetter {
+				c.Change = -c.Change
+			}
+			c.Regressed = -c.Change > threshold
+		}
+		comparisons = append(comparisons, c)
+	}
+	return comparisons
+}
+
+// formatBenchmarkChange describes a change, like "12.3% better"
+func formatBenchmarkChange(change float64) string {
+	switch {
+	case change >= 0.05:
+		return fmt.Sprintf("%.1f%% better", change)
+	case change <= -0.05:
+		return fmt.Sprintf("%.1f%% worse", -change)
+	default:
+		return "no change"
+	}
+}
+
+func benchmarkMarkdown(benchmarkContext, target string, threshold int, hasBaseline bool, comparisons []benchmarkComparison) string {
+	var b strings.Builder
+	if benchmarkContext == "default" {
+		b.WriteString("### Benchmarks\n\n")
+	} else {
+		fmt.Fprintf(&b, "### Benchmarks: %s\n\n", benchmarkContext)
+	}
+
+	regressions := 0
+	for _, c := range comparisons {
+		if c.Regressed {
+			regressions++
+		}
+	}
+
+	switch {
+	case !hasBaseline:
+		fmt.Fprintf(&b, "There are no results of `%s` to compare %d benchmarks with yet.\n\n", target, len(comparisons))
+		b.WriteString("| Benchmark | Result |\n| --- | --- |\n")
+		for _, c := range comparisons {
+			fmt.Fprintf(&b, "| `%s` | %s |\n", c.Name, formatBenchmarkValue(c.Value, c.Unit))
+		}
+		return b.String()
+
+	case regressions > 0:
+		fmt.Fprintf(&b, "**%d of %d benchmarks** regressed by more than %d%% compared with `%s`.\n\n", regressions, len(comparisons), threshold, target)
+
+	default:
+		fmt.Fprintf(&b, "None of the %d benchmarks regressed by more than %d%% compared with `%s`.\n\n", len(comparisons), threshold, target)
+	}
+
+	// Regressions first, then the rest by name
+	sorted := append([]benchmarkComparison(nil), comparisons...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Regressed && !sorted[j].Regressed })
+
+	b.WriteString("| Benchmark | Result | Baseline | Change |\n| --- | --- | --- | --- |\n")
+	for _, c := range sorted {
+		baseline, change := "", "new"
+		if c.HasBaseline {
+			baseline = formatBenchmarkValue(c.Baseline, c.Unit)
+			change = formatBenchmarkChange(c.Change)
+		}
+		if c.Regressed {
+			change = ":warning: " + change
+		}
+		fmt.Fprintf(&b, "| `%s` | %s | %s | %s |\n", c.Name, formatBenchmarkValue(c.Value, c.Unit), baseline, change)
+	}
+	return b.String()
+}
+
+func formatBenchmarkValue(value float64, unit string) string {
+	if math.Abs(value) >= 100 {
+		return fmt.Sprintf("%.0f %s", value, unit)
+	}
+	return fmt.Sprintf("%.3g %s", value, unit)
+}
@@ -0,0 +1,159 @@
+package clicommand
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const goBenchmarkOutput = `goos: linux
+goarch: amd64
+pkg: github.com/org/repo/codec
+cpu: Intel(R) Xeon(R) CPU @ 2.20GHz
+BenchmarkDecode-8   	  500000	      2400 ns/op	     512 B/op	       4 allocs/op
+BenchmarkDecode-8   	  500000	      2600 ns/op	     512 B/op	       4 allocs/op
+BenchmarkDecode-8   	  500000	      2500 ns/op	     512 B/op	       4 allocs/op
+BenchmarkEncode-8   	 1000000	      1200 ns/op
+PASS
+ok  	github.com/org/repo/codec	5.123s
+`
+
+const jmhBenchmarkJSON = `[
+  {
+    "benchmark": "com.example.CodecBenchmark.decode",
+    "mode": "thrpt",
+    "params": {"size": "10", "format": "json"},
+    "primaryMetric": {"score": 1523.5, "scoreUnit": "ops/s"}
+  },
+  {
+    "benchmark": "com.example.CodecBenchmark.encode",
+    "mode": "avgt",
+    "primaryMetric": {"score": 0.25, "scoreUnit": "ms/op"}
+  }
+]`
+
+func TestParseBenchmarkResults(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "go", detectBenchmarkFormat([]byte(goBenchmarkOutput)))
+	assert.Equal(t, "jmh", detectBenchmarkFormat([]byte(jmhBenchmarkJSON)))
+	assert.Equal(t, "", detectBenchmarkFormat([]byte("llamas")))
+
+	results, err := parseBenchmarkResults([]byte(goBenchmarkOutput), "")
+	require.NoError(t, err)
+	assert.Equal(t, []benchmarkResult{
+		{Name: "github.com/org/repo/codec.BenchmarkDecode-8", Value: 2500, Unit: "ns/op"},
+		{Name: "github.com/org/repo/codec.BenchmarkEncode-8", Value: 1200, Unit: "ns/op"},
+	}, medianBenchmarkResults(results))
+
+	results, err = parseBenchmarkResults([]byte(jmhBenchmarkJSON), "")
+	require.NoError(t, err)
+	assert.Equal(t, []benchmarkResult{
+		{Name: "com.example.CodecBenchmark.decode{format=json,size=10}", Value: 1523.5, Unit: "ops/s", HigherIsBetter: true},
+		{Name: "com.example.CodecBenchmark.encode", Value: 0.25, Unit: "ms/op"},
+	}, results)
+
+	_, err = parseBenchmarkResults([]byte("llamas"), "")
+	assert.Error(t, err)
+	_, err = parseBenchmarkResults([]byte(goBenchmarkOutput), "criterion")
+	assert.Error(t, err)
+}
+
+func TestCompareBenchmarks(t *testing.T) {
+	t.Parallel()
+
+	baseline := &benchmarkHistory{Benchmarks: map[string][]benchmarkPoint{
+		// Only the latest 3 are compared with, and their median is 1000
+		"BenchmarkSlower": {{Value: 1, Unit: "ns/op"}, {Value: 900, Unit: "ns/op"}, {Value: 1000, Unit: "ns/op"}, {Value: 5000, Unit: "ns/op"}},
+		"BenchmarkFaster": {{Value: 1000, Unit: "ns/op"}},
+		"BenchmarkNoisy":  {{Value: 1000, Unit: "ns/op"}},
+		"Throughput":      {{Value: 100, Unit: "ops/s"}},
+		"ChangedUnit":     {{Value: 100, Unit: "ms/op"}},
+	}}
+	results := []benchmarkResult{
+		{Name: "BenchmarkSlower", Value: 1200, Unit: "ns/op"},
+		{Name: "BenchmarkFaster", Value: 500, Unit: "ns/op"},
+		{Name: "BenchmarkNoisy", Value: 1050, Unit: "ns/op"},
+		{Name: "Throughput", Value: 80, Unit: "ops/s", HigherIsBetter: true},
+		{Name: "ChangedUnit", Value: 100, Unit: "ns/op"},
+		{Name: "BenchmarkNew", Value: 1, Unit: "ns/op"},
+	}
+
+	got := compareBenchmarks(results, baseline, 3, 10)
+	require.Len(t, got, 6)
+
+	for _, want := range []struct {
+		hasBaseline bool
+		change      float64
+		regressed   bool
+	}{
+		{hasBaseline: true, change: -20, regressed: true},
+		{hasBaseline: true, change: 50},
+		{hasBaseline: true, change: -5},
+		{hasBaseline: true, change: -20, regressed: true},
+		{},
+		{},
+	} {
+		c := got[0]
+		got = got[1:]
+		assert.Equal(t, want.hasBaseline, c.HasBaseline, c.Name)
+		assert.InDelta(t, want.change, c.Change, 0.001, c.Name)
+		assert.Equal(t, want.regressed, c.Regressed, c.Name)
+	}
+}
+
+func TestBenchmarkMarkdown(t *testing.T) {
+	t.Parallel()
+
+	comparisons := []benchmarkComparison{
+		{benchmarkResult: benchmarkResult{Name: "BenchmarkA", Value: 2500, Unit: "ns/op"}, HasBaseline: true, Baseline: 2000, Change: -25, Regressed: true},
+		{benchmarkResult: benchmarkResult{Name: "BenchmarkB", Value: 0.25, Unit: "ms/op"}, HasBaseline: true, Baseline: 0.5, Change: 50},
+		{benchmarkResult: benchmarkResult{Name: "BenchmarkC", Value: 12, Unit: "ns/op"}},
+	}
+
+	assert.Equal(t, "### Benchmarks: codec\n\n"+
+		"**1 of 3 benchmarks** regressed by more than 10% compared with `main`.\n\n"+
+		"| Benchmark | Result | Baseline | Change |\n| --- | --- | --- | --- |\n"+
+		"| `BenchmarkA` | 2500 ns/op | 2000 ns/op | :warning: 25.0% worse |\n"+
+		"| `BenchmarkB` | 0.25 ms/op | 0.5 ms/op | 50.0% better |\n"+
+		"| `BenchmarkC` | 12 ns/op |  | new |\n",
+		benchmarkMarkdown("codec", "main", 10, true, comparisons))
+
+	assert.Equal(t, "### Benchmarks\n\n"+
+		"There are no results of `main` to compare 1 benchmarks with yet.\n\n"+
+		"| Benchmark | Result |\n| --- | --- |\n"+
+		"| `BenchmarkC` | 12 ns/op |\n",
+		benchmarkMarkdown("default", "main", 10, false, comparisons[2:]))
+}
+
+func TestBenchmarkHistoryIsKeptInTheStore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	store, err := agent.NewBuildCacheStore(logger.Discard, t.TempDir())
+	require.NoError(t, err)
+
+	key := benchmarkHistoryKey("my-pipeline", "default", "feature/llamas")
+	assert.Equal(t, "benchmarks/my-pipeline/default/feature-llamas.json", key)
+
+	h, err := loadBenchmarkHistory(ctx, store, key)
+	require.NoError(t, err)
+	assert.Nil(t, h)
+
+	cfg := BenchmarkUploadConfig{Pipeline: "my-pipeline", Context: "default", Branch: "feature/llamas", Commit: "abc123", BuildNumber: "build"}
+	for i := 0; i < maxBenchmarkHistory+2; i++ {
+		results := []benchmarkResult{{Name: "BenchmarkA", Value: float64(i), Unit: "ns/op"}}
+		require.NoError(t, saveBenchmarkResults(ctx, store, cfg, results))
+	}
+
+	h, err = loadBenchmarkHistory(ctx, store, key)
+	require.NoError(t, err)
+	points := h.Benchmarks["BenchmarkA"]
+	require.Len(t, points, maxBenchmarkHistory)
+	assert.Equal(t, benchmarkPoint{Value: 2, Unit: "ns/op", Commit: "abc123", BuildNumber: "build"}, points[0])
+	assert.Equal(t, float64(maxBenchmarkHistory+1), points[len(points)-1].Value)
+}
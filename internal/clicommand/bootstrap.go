@@ -0,0 +1,1085 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/bootstrap"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/buildkite/agent/v3/internal/experiments"
+	"github.com/buildkite/agent/v3/process"
+	"github.com/urfave/cli"
+	"golang.org/x/term"
+)
+
+const bootstrapHelpDescription = `Usage:
+
+   buildkite-agent bootstrap [options...]
+
+Description:
+
+   The bootstrap command executes a Buildkite job locally.
+
+   Generally the bootstrap command is run as a sub-process of the buildkite-agent to execute
+   a given job sent from buildkite.com, but you can also invoke the bootstrap manually.
+
+   Execution is broken down into phases. By default, the bootstrap runs a plugin phase which
+   sets up any plugins specified, then a checkout phase which pulls down your code and then a
+   command phase that executes the specified command in the created environment.
+
+   You can run only specific phases with the --phases flag.
+
+   The bootstrap is also responsible for executing hooks around the phases.
+   See https://buildkite.com/docs/agent/v3/hooks for more details.
+
+   When you're running a job locally, --interactive attaches the command to your
+   terminal, so debuggers and password prompts work. It's ignored unless the
+   bootstrap's stdin is a terminal, which it never is for jobs the agent runs.
+
+Example:
+
+   $ eval $(curl -s -H "Authorization: Bearer xxx" \
+     "https://api.buildkite.com/v2/organizations/[org]/pipelines/[proj]/builds/[build]/jobs/[job]/env.txt" | sed 's/^/export /')
+   $ buildkite-agent bootstrap --build-path builds`
+
+type BootstrapConfig struct {
+	Command                      string   `cli:"command"`
+	JobID                        string   `cli:"job" validate:"required"`
+	Repository                   string   `cli:"repository" validate:"required"`
+	Commit                       string   `cli:"commit" validate:"required"`
+	Branch                       string   `cli:"branch" validate:"required"`
+	Tag                          string   `cli:"tag"`
+	RefSpec                      string   `cli:"refspec"`
+	Plugins                      string   `cli:"plugins"`
+	PullRequest                  string   `cli:"pullrequest"`
+	GitSubmodules                bool     `cli:"git-submodules"`
+	SSHKeyscan                   bool     `cli:"ssh-keyscan"`
+	SSHStrictHostChecking        bool     `cli:"ssh-strict-host-checking"`
+	AgentName                    string   `cli:"agent" validate:"required"`
+	Queue                        string   `cli:"queue"`
+	OrganizationSlug             string   `cli:"organization" validate:"required"`
+	PipelineSlug                 string   `cli:"pipeline" validate:"required"`
+	PipelineProvider             string   `cli:"pipeline-provider" validate:"required"`
+	AutomaticArtifactUploadPaths string   `cli:"artifact-upload-paths"`
+	ArtifactUploadDestination    string   `cli:"artifact-upload-destination"`
+	ArtifactPreviews             bool     `cli:"artifact-previews"`
+	DockerDaemon                 string   `cli:"docker-daemon"`
+	DockerDaemonImage            string   `cli:"docker-daemon-image"`
+	Rootless                     bool     `cli:"rootless"`
+	VirtualDisplay               string   `cli:"virtual-display"`
+	VirtualDisplaySize           string   `cli:"virtual-display-size"`
+	Device                       string   `cli:"device"`
+	DeviceBootTimeout            int      `cli:"device-boot-timeout"`
+	ScreenRecording              string   `cli:"screen-recording"`
+	ScreenshotPaths              string   `cli:"screenshot-paths"`
+	FailureBundlePaths           string   `cli:"failure-bundle-paths"`
+	FailureBundleMaxSize         string   `cli:"failure-bundle-max-size"`
+	CleanCheckout                bool     `cli:"clean-checkout"`
+	GitCheckoutFlags             string   `cli:"git-checkout-flags"`
+	GitCloneFlags                string   `cli:"git-clone-flags"`
+	GitFetchFlags                string   `cli:"git-fetch-flags"`
+	GitCloneMirrorFlags          string   `cli:"git-clone-mirror-flags"`
+	GitCleanFlags                string   `cli:"git-clean-flags"`
+	GitCheckoutStrategy          string   `cli:"git-checkout-strategy"`
+	GitShallowDepth              int      `cli:"git-shallow-depth"`
+	GitLFS                       bool     `cli:"git-lfs"`
+	GitLFSInclude                string   `cli:"git-lfs-include"`
+	GitLFSExclude                string   `cli:"git-lfs-exclude"`
+	CheckoutRetries              int      `cli:"checkout-retries"`
+	PluginCloneRetries           int      `cli:"plugin-clone-retries"`
+	ArtifactUploadRetries        int      `cli:"artifact-upload-retries"`
+	RetryBackoff                 string   `cli:"retry-backoff"`
+	RetryDelay                   string   `cli:"retry-delay"`
+	RetryJitter                  bool     `cli:"retry-jitter"`
+	RetryOnExitStatus            []string `cli:"retry-on-exit-status" normalize:"list"`
+	GitMirrorsPath               string   `cli:"git-mirrors-path" normalize:"filepath"`
+	GitMirrorsLockTimeout        int      `cli:"git-mirrors-lock-timeout"`
+	GitMirrorsSkipUpdate         bool     `cli:"git-mirrors-skip-update"`
+	GitSubmoduleCloneConfig      []string `cli:"git-submodule-clone-config"`
+	GitSubmoduleSSHKeys          []string `cli:"git-submodule-ssh-keys" normalize:"list"`
+	GitSparseCheckoutPaths       []string `cli:"git-sparse-checkout-paths" normalize:"list"`
+	GitAutoCRLF                  string   `cli:"git-autocrlf"`
+	GitEOL                       string   `cli:"git-eol"`
+	GitLongPaths                 bool     `cli:"git-long-paths"`
+	BinPath                      string   `cli:"bin-path" normalize:"filepath"`
+	BuildPath                    string   `cli:"build-path" normalize:"filepath"`
+	BuildPathLayout              string   `cli:"build-path-layout"`
+	SpawnIndex                   int      `cli:"spawn-index"`
+	PhaseMarkers                 bool     `cli:"phase-markers"`
+	LineMetadata                 bool     `cli:"line-metadata"`
+	LogFormat                    string   `cli:"log-format"`
+	CommandTimeout               string   `cli:"command-timeout"`
+	Umask                        string   `cli:"umask"`
+	DirectoryMode                string   `cli:"directory-mode"`
+	SeparateCommands             bool     `cli:"separate-commands"`
+	CommandFailurePolicy         string   `cli:"command-failure-policy"`
+	CommandShim                  bool     `cli:"command-shim"`
+	CommandShimShellOptions      []string `cli:"command-shim-shell-options" normalize:"list"`
+	CommandShimLocale            string   `cli:"command-shim-locale"`
+	Interactive                  bool     `cli:"interactive"`
+	ParallelSkewThreshold        int      `cli:"parallel-skew-threshold"`
+	BuildDirEncryption           string   `cli:"build-dir-encryption"`
+	BuildDirEncryptionSize       string   `cli:"build-dir-encryption-size"`
+	BuildDirTmpfs                bool     `cli:"build-dir-tmpfs"`
+	BuildDirTmpfsSize            string   `cli:"build-dir-tmpfs-size"`
+	BuildDirOverlayPath          string   `cli:"build-dir-overlay-path" normalize:"filepath"`
+	BuildDirOverlayRefresh       int      `cli:"build-dir-overlay-refresh-interval"`
+	BuildDirSELinuxLabel         string   `cli:"build-dir-selinux-label"`
+	HooksPath                    string   `cli:"hooks-path" normalize:"filepath"`
+	HookChecksumsPath            string   `cli:"hook-checksums" normalize:"filepath"`
+	PluginsPath                  string   `cli:"plugins-path" normalize:"filepath"`
+	PluginsCachePath             string   `cli:"plugins-cache-path" normalize:"filepath"`
+	SecretScan                   string   `cli:"secret-scan"`
+	SecretScanRules              string   `cli:"secret-scan-rules" normalize:"filepath"`
+	PolicyScanner                string   `cli:"policy-scanner" normalize:"filepath"`
+	CommandEval                  bool     `cli:"command-eval"`
+	PluginsEnabled               bool     `cli:"plugins-enabled"`
+	PluginValidation             bool     `cli:"plugin-validation"`
+	AllowedPlugins               []string `cli:"allowed-plugins" normalize:"list"`
+	DeniedPlugins                []string `cli:"denied-plugins" normalize:"list"`
+	PluginsAlwaysCloneFresh      bool     `cli:"plugins-always-clone-fresh"`
+	LocalHooksEnabled            bool     `cli:"local-hooks-enabled"`
+	PTY                          bool     `cli:"pty"`
+	LogLevel                     string   `cli:"log-level"`
+	Debug                        bool     `cli:"debug"`
+	Shell                        string   `cli:"shell"`
+	Experiments                  []string `cli:"experiment" normalize:"list"`
+	Phases                       []string `cli:"phases" normalize:"list"`
+	Profile                      string   `cli:"profile"`
+	CancelSignal                 string   `cli:"cancel-signal"`
+	SignalGracePeriodSeconds     int      `cli:"signal-grace-period-seconds"`
+	RedactedVars                 []string `cli:"redacted-vars" normalize:"list"`
+	TracingBackend               string   `cli:"tracing-backend"`
+	TracingServiceName           string   `cli:"tracing-service-name"`
+	StartTimingsFile             string   `cli:"start-timings-file"`
+}
+
+var BootstrapCommand = cli.Command{
+	Name:        "bootstrap",
+	Usage:       "Run a Buildkite job locally",
+	Description: bootstrapHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "command",
+			Value:  "",
+			Usage:  "The command to run",
+			EnvVar: "BUILDKITE_COMMAND",
+		},
+		cli.BoolFlag{
+			Name:   "separate-commands",
+			Usage:  "Run each line of the command, which is how a step's list of commands is joined, as a command of its own with its own log group, timing and exit status. Lines ending in a backslash continue onto the next",
+			EnvVar: "BUILDKITE_SEPARATE_COMMANDS",
+		},
+		cli.StringFlag{
+			Name:   "command-failure-policy",
+			Value:  "fail-fast",
+			Usage:  "With --separate-commands, whether to stop after a command fails (fail-fast) or to run the rest (continue). Either way, the job fails with the first failed command's exit status",
+			EnvVar: "BUILDKITE_COMMAND_FAILURE_POLICY",
+		},
+		cli.BoolFlag{
+			Name:   "command-shim",
+			Usage:  "Run commands through a bash shim that sets the same shell options, IFS and locale whichever bash version the agent has, and reports the line of the command that failed. Scripts in the repository are run as they are",
+			EnvVar: "BUILDKITE_COMMAND_SHIM",
+		},
+		cli.StringSliceFlag{
+			Name:   "command-shim-shell-options",
+			Value:  &cli.StringSlice{"errexit", "nounset", "pipefail"},
+			Usage:  "With --command-shim, the shell options to set with ′set -o′",
+			EnvVar: "BUILDKITE_COMMAND_SHIM_SHELL_OPTIONS",
+		},
+		cli.StringFlag{
+			Name:   "command-shim-locale",
+			Value:  "C.UTF-8",
+			Usage:  "With --command-shim, the locale to set LANG and LC_ALL to, or empty to leave them as they are",
+			EnvVar: "BUILDKITE_COMMAND_SHIM_LOCALE",
+		},
+		cli.BoolFlag{
+			Name:   "interactive",
+			Usage:  "Run the command attached to the terminal, stdin included, when running a job locally. Its output isn't redacted or captured, and it's only run interactively if stdin is a terminal",
+			EnvVar: "BUILDKITE_BOOTSTRAP_INTERACTIVE",
+		},
+		cli.IntFlag{
+			Name:   "parallel-skew-threshold",
+			Value:  0,
+			Usage:  "Record how long each of a parallel step's jobs takes, and annotate the build if the slowest takes more than this percentage longer than the average. 0 doesn't record them",
+			EnvVar: "BUILDKITE_PARALLEL_SKEW_THRESHOLD",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "The ID of the job being run",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+		cli.StringFlag{
+			Name:   "repository",
+			Value:  "",
+			Usage:  "The repository to clone and run the job from",
+			EnvVar: "BUILDKITE_REPO",
+		},
+		cli.StringFlag{
+			Name:   "commit",
+			Value:  "",
+			Usage:  "The commit to checkout in the repository",
+			EnvVar: "BUILDKITE_COMMIT",
+		},
+		cli.StringFlag{
+			Name:   "branch",
+			Value:  "",
+			Usage:  "The branch the commit is in",
+			EnvVar: "BUILDKITE_BRANCH",
+		},
+		cli.StringFlag{
+			Name:   "tag",
+			Value:  "",
+			Usage:  "The tag the commit",
+			EnvVar: "BUILDKITE_TAG",
+		},
+		cli.StringFlag{
+			Name:   "refspec",
+			Value:  "",
+			Usage:  "Optional refspec to override git fetch",
+			EnvVar: "BUILDKITE_REFSPEC",
+		},
+		cli.StringFlag{
+			Name:   "plugins",
+			Value:  "",
+			Usage:  "The plugins for the job",
+			EnvVar: "BUILDKITE_PLUGINS",
+		},
+		cli.StringFlag{
+			Name:   "pullrequest",
+			Value:  "",
+			Usage:  "The number/id of the pull request this commit belonged to",
+			EnvVar: "BUILDKITE_PULL_REQUEST",
+		},
+		cli.StringFlag{
+			Name:   "agent",
+			Value:  "",
+			Usage:  "The name of the agent running the job",
+			EnvVar: "BUILDKITE_AGENT_NAME",
+		},
+		cli.StringFlag{
+			Name:   "queue",
+			Value:  "",
+			Usage:  "The name of the queue the agent belongs to, if tagged",
+			EnvVar: "BUILDKITE_AGENT_META_DATA_QUEUE",
+		},
+		cli.StringFlag{
+			Name:   "organization",
+			Value:  "",
+			Usage:  "The slug of the organization that the job is a part of",
+			EnvVar: "BUILDKITE_ORGANIZATION_SLUG",
+		},
+		cli.StringFlag{
+			Name:   "pipeline",
+			Value:  "",
+			Usage:  "The slug of the pipeline that the job is a part of",
+			EnvVar: "BUILDKITE_PIPELINE_SLUG",
+		},
+		cli.StringFlag{
+			Name:   "pipeline-provider",
+			Value:  "",
+			Usage:  "The id of the SCM provider that the repository is hosted on",
+			EnvVar: "BUILDKITE_PIPELINE_PROVIDER",
+		},
+		cli.StringFlag{
+			Name:   "artifact-upload-paths",
+			Value:  "",
+			Usage:  "Paths to files to automatically upload at the end of a job",
+			EnvVar: "BUILDKITE_ARTIFACT_PATHS",
+		},
+		cli.StringFlag{
+			Name:   "artifact-upload-destination",
+			Value:  "",
+			Usage:  "A custom location to upload artifact paths to (for example, s3://my-custom-bucket/and/prefix)",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_DESTINATION",
+		},
+		cli.BoolFlag{
+			Name:   "artifact-previews",
+			Usage:  "Annotate the build with thumbnails of the images the job uploads as artifacts, and links to the HTML reports it uploads",
+			EnvVar: "BUILDKITE_ARTIFACT_PREVIEWS",
+		},
+		cli.StringFlag{
+			Name:   "docker-daemon",
+			Value:  "",
+			Usage:  "Give the job a Docker daemon of its own, in a \"dind\" container or as a \"rootless\" dockerd, and point DOCKER_HOST at it",
+			EnvVar: "BUILDKITE_DOCKER_DAEMON",
+		},
+		cli.StringFlag{
+			Name:   "docker-daemon-image",
+			Value:  "docker:dind",
+			Usage:  "The image of the job's Docker-in-Docker container",
+			EnvVar: "BUILDKITE_DOCKER_DAEMON_IMAGE",
+		},
+		cli.BoolFlag{
+			Name:   "rootless",
+			Usage:  "Whether the job's running rootless",
+			EnvVar: "BUILDKITE_ROOTLESS",
+		},
+		cli.StringFlag{
+			Name:   "virtual-display",
+			Value:  "",
+			Usage:  "Start an \"xvfb\" or headless \"wayland\" display for the job, and stop it when the job finishes",
+			EnvVar: "BUILDKITE_VIRTUAL_DISPLAY",
+		},
+		cli.StringFlag{
+			Name:   "virtual-display-size",
+			Value:  "1920x1080",
+			Usage:  "The size of the virtual display",
+			EnvVar: "BUILDKITE_VIRTUAL_DISPLAY_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "device",
+			Value:  "",
+			Usage:  "An Android emulator or iOS simulator to boot before the command and shut down after it, like \"android:Pixel_7_API_34\" or \"ios:iPhone 15\"",
+			EnvVar: "BUILDKITE_DEVICE",
+		},
+		cli.IntFlag{
+			Name:   "device-boot-timeout",
+			Value:  300,
+			Usage:  "Seconds to wait for the device to boot",
+			EnvVar: "BUILDKITE_DEVICE_BOOT_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "screen-recording",
+			Value:  "",
+			Usage:  "Record a \"video\" of the screen while the command runs, or take a \"screenshot\" if it fails, and upload it if it fails",
+			EnvVar: "BUILDKITE_SCREEN_RECORDING",
+		},
+		cli.StringFlag{
+			Name:   "screenshot-paths",
+			Value:  "",
+			Usage:  "Paths to screenshots saved by the command, to upload and annotate the build with if it fails",
+			EnvVar: "BUILDKITE_SCREENSHOT_PATHS",
+		},
+		cli.StringFlag{
+			Name:   "failure-bundle-paths",
+			Value:  "",
+			Usage:  "Paths to bundle up and upload as an artifact if the job fails",
+			EnvVar: "BUILDKITE_FAILURE_BUNDLE_PATHS",
+		},
+		cli.StringFlag{
+			Name:   "failure-bundle-max-size",
+			Value:  "100MB",
+			Usage:  "The most bytes of files to put in the failure bundle",
+			EnvVar: "BUILDKITE_FAILURE_BUNDLE_MAX_SIZE",
+		},
+		cli.BoolFlag{
+			Name:   "clean-checkout",
+			Usage:  "Whether or not the bootstrap should remove the existing repository before running the command",
+			EnvVar: "BUILDKITE_CLEAN_CHECKOUT",
+		},
+		cli.StringFlag{
+			Name:   "git-checkout-flags",
+			Value:  "-f",
+			Usage:  "Flags to pass to \"git checkout\" command",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_FLAGS",
+		},
+		cli.StringFlag{
+			Name:   "git-clone-flags",
+			Value:  "-v",
+			Usage:  "Flags to pass to \"git clone\" command",
+			EnvVar: "BUILDKITE_GIT_CLONE_FLAGS",
+		},
+		cli.StringFlag{
+			Name:   "git-clone-mirror-flags",
+			Value:  "-v",
+			Usage:  "Flags to pass to \"git clone\" command when mirroring",
+			EnvVar: "BUILDKITE_GIT_CLONE_MIRROR_FLAGS",
+		},
+		cli.StringFlag{
+			Name:   "git-clean-flags",
+			Value:  "-ffxdq",
+			Usage:  "Flags to pass to \"git clean\" command",
+			EnvVar: "BUILDKITE_GIT_CLEAN_FLAGS",
+		},
+		cli.StringFlag{
+			Name:   "git-fetch-flags",
+			Value:  "",
+			Usage:  "Flags to pass to \"git fetch\" command",
+			EnvVar: "BUILDKITE_GIT_FETCH_FLAGS",
+		},
+		cli.StringSliceFlag{
+			Name:   "git-submodule-clone-config",
+			Value:  &cli.StringSlice{},
+			Usage:  "Comma separated key=value git config pairs applied before git submodule clone commands. For example, ′update --init′. If the config is needed to be applied to all git commands, supply it in a global git config file for the system that the agent runs in instead.",
+			EnvVar: "BUILDKITE_GIT_SUBMODULE_CLONE_CONFIG",
+		},
+		cli.StringSliceFlag{
+			Name:   "git-submodule-ssh-keys",
+			Value:  &cli.StringSlice{},
+			Usage:  "Comma separated host=path pairs of the SSH key to clone submodules from each host with, for submodules on other hosts than the repository",
+			EnvVar: "BUILDKITE_GIT_SUBMODULE_SSH_KEYS",
+		},
+		cli.StringSliceFlag{
+			Name:   "git-sparse-checkout-paths",
+			Value:  &cli.StringSlice{},
+			Usage:  "Comma separated directories of the repository to check out with git sparse-checkout, leaving out the rest of it",
+			EnvVar: "BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS",
+		},
+		cli.StringFlag{
+			Name:   "git-autocrlf",
+			Value:  "",
+			Usage:  "The core.autocrlf to check out the repository with, true, false or input. By default, it's git's global config",
+			EnvVar: "BUILDKITE_GIT_AUTOCRLF",
+		},
+		cli.StringFlag{
+			Name:   "git-eol",
+			Value:  "",
+			Usage:  "The core.eol to check out the repository with, lf, crlf or native. By default, it's git's global config",
+			EnvVar: "BUILDKITE_GIT_EOL",
+		},
+		cli.BoolFlag{
+			Name:   "git-long-paths",
+			Usage:  "Set core.longpaths in the checkout, so Git for Windows can check out paths longer than 260 characters",
+			EnvVar: "BUILDKITE_GIT_LONG_PATHS",
+		},
+		cli.StringFlag{
+			Name:   "git-checkout-strategy",
+			Value:  "full",
+			Usage:  "How to clone the repository: full, shallow with --git-shallow-depth commits of history, or mirror to clone with reference to a mirror in --git-mirrors-path that's shared between jobs and kept up to date",
+			EnvVar: "BUILDKITE_GIT_CHECKOUT_STRATEGY",
+		},
+		cli.IntFlag{
+			Name:   "git-shallow-depth",
+			Value:  1,
+			Usage:  "How many commits of history to clone and fetch with --git-checkout-strategy shallow",
+			EnvVar: "BUILDKITE_GIT_SHALLOW_DEPTH",
+		},
+		cli.BoolFlag{
+			Name:   "git-lfs",
+			Usage:  "Pull the repository's Git LFS files all at once after it's checked out, rather than one at a time as they're checked out",
+			EnvVar: "BUILDKITE_GIT_LFS",
+		},
+		cli.StringFlag{
+			Name:   "git-lfs-include",
+			Value:  "",
+			Usage:  "With --git-lfs, only pull the Git LFS files matching these comma separated paths or patterns",
+			EnvVar: "BUILDKITE_GIT_LFS_INCLUDE",
+		},
+		cli.StringFlag{
+			Name:   "git-lfs-exclude",
+			Value:  "",
+			Usage:  "With --git-lfs, don't pull the Git LFS files matching these comma separated paths or patterns",
+			EnvVar: "BUILDKITE_GIT_LFS_EXCLUDE",
+		},
+		cli.IntFlag{
+			Name:   "checkout-retries",
+			Value:  2,
+			Usage:  "How many times to retry the checkout if it fails",
+			EnvVar: "BUILDKITE_CHECKOUT_RETRIES",
+		},
+		cli.IntFlag{
+			Name:   "plugin-clone-retries",
+			Value:  2,
+			Usage:  "How many times to retry cloning a plugin if it fails",
+			EnvVar: "BUILDKITE_PLUGIN_CLONE_RETRIES",
+		},
+		cli.IntFlag{
+			Name:   "artifact-upload-retries",
+			Value:  0,
+			Usage:  "How many times to retry uploading the job's artifacts if it fails",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_RETRIES",
+		},
+		cli.StringFlag{
+			Name:   "retry-backoff",
+			Value:  "constant",
+			Usage:  "How to wait before retrying the checkout, a plugin clone or the artifact upload; constant waits --retry-delay each time, exponential waits --retry-delay to the power of the number of attempts so far",
+			EnvVar: "BUILDKITE_BOOTSTRAP_RETRY_BACKOFF",
+		},
+		cli.StringFlag{
+			Name:   "retry-delay",
+			Value:  "2s",
+			Usage:  "How long to wait before retrying, like 5s. It must be at least 1s for --retry-backoff exponential",
+			EnvVar: "BUILDKITE_BOOTSTRAP_RETRY_DELAY",
+		},
+		cli.BoolFlag{
+			Name:   "retry-jitter",
+			Usage:  "Wait up to a second longer before retrying, so jobs that failed together don't all retry together",
+			EnvVar: "BUILDKITE_BOOTSTRAP_RETRY_JITTER",
+		},
+		cli.StringSliceFlag{
+			Name:   "retry-on-exit-status",
+			Value:  &cli.StringSlice{},
+			Usage:  "Only retry the checkout, a plugin clone or the artifact upload if it fails with one of these exit statuses. By default, any failure is retried",
+			EnvVar: "BUILDKITE_BOOTSTRAP_RETRY_ON_EXIT_STATUS",
+		},
+		cli.StringFlag{
+			Name:   "git-mirrors-path",
+			Value:  "",
+			Usage:  "Path to where mirrors of git repositories are stored",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_PATH",
+		},
+		cli.IntFlag{
+			Name:   "git-mirrors-lock-timeout",
+			Value:  300,
+			Usage:  "Seconds to lock a git mirror during clone, should exceed your longest checkout",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "git-mirrors-skip-update",
+			Usage:  "Skip updating the Git mirror",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_SKIP_UPDATE",
+		},
+		cli.StringFlag{
+			Name:   "bin-path",
+			Value:  "",
+			Usage:  "Directory where the buildkite-agent binary lives",
+			EnvVar: "BUILDKITE_BIN_PATH",
+		},
+		cli.StringFlag{
+			Name:   "build-path",
+			Value:  "",
+			Usage:  "Directory where builds will be created",
+			EnvVar: "BUILDKITE_BUILD_PATH",
+		},
+		cli.StringFlag{
+			Name:   "build-path-layout",
+			Value:  "",
+			Usage:  "How the checkout directory in the build path is named, by agent name, organization and pipeline, or \"hashed\"",
+			EnvVar: "BUILDKITE_BUILD_PATH_LAYOUT",
+		},
+		cli.IntFlag{
+			Name:   "spawn-index",
+			Value:  0,
+			Usage:  "The index of the agent's worker that's running the job",
+			EnvVar: "BUILDKITE_AGENT_SPAWN_INDEX",
+		},
+		cli.BoolFlag{
+			Name:   "phase-markers",
+			Usage:  "Mark the start and end of each phase in the job log with an escape sequence, so log processors can fold them and time them",
+			EnvVar: "BUILDKITE_JOB_LOG_PHASE_MARKERS",
+		},
+		cli.BoolFlag{
+			Name:   "line-metadata",
+			Usage:  "Start each line of output from hooks, plugins and the command with an escape sequence of the stream and process it's from, for the agent to take out of the log, and each of the bootstrap's comments, warnings and errors with one of its level, which is left in",
+			EnvVar: "BUILDKITE_JOB_LOG_LINE_METADATA",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Value:  "text",
+			Usage:  "The format of the bootstrap's output, text or json, which writes each line as a JSON record with its phase and time, and the exit status and duration of commands",
+			EnvVar: "BUILDKITE_JOB_LOG_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "command-timeout",
+			Value:  "",
+			Usage:  "The longest each command the bootstrap runs, like git fetch or a hook, can take before it's killed, like 10m. The job's command isn't limited, as the job's timeout is. By default, commands aren't limited",
+			EnvVar: "BUILDKITE_COMMAND_PHASE_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "umask",
+			Value:  "",
+			Usage:  "The umask the bootstrap, the job's hooks and command, and the files they make have, in octal like 0027. By default, it's inherited from the agent",
+			EnvVar: "BUILDKITE_JOB_UMASK",
+		},
+		cli.StringFlag{
+			Name:   "directory-mode",
+			Value:  "",
+			Usage:  "The permissions the bootstrap makes directories like the build and plugins directories with, in octal like 0750, before the umask is applied. By default, it's 0777",
+			EnvVar: "BUILDKITE_JOB_DIRECTORY_MODE",
+		},
+		cli.StringFlag{
+			Name:   "build-dir-encryption",
+			Value:  "",
+			Usage:  "Check out the build onto an ephemeral encrypted volume that is destroyed when the job finishes. Only \"luks\" is supported",
+			EnvVar: "BUILDKITE_BUILD_DIR_ENCRYPTION",
+		},
+		cli.StringFlag{
+			Name:   "build-dir-encryption-size",
+			Value:  "10G",
+			Usage:  "Size of the encrypted build directory volume",
+			EnvVar: "BUILDKITE_BUILD_DIR_ENCRYPTION_SIZE",
+		},
+		cli.BoolFlag{
+			Name:   "build-dir-tmpfs",
+			Usage:  "Check out the build onto a tmpfs that is unmounted when the job finishes",
+			EnvVar: "BUILDKITE_BUILD_DIR_TMPFS",
+		},
+		cli.StringFlag{
+			Name:   "build-dir-tmpfs-size",
+			Value:  "2G",
+			Usage:  "Maximum size of the tmpfs build directory",
+			EnvVar: "BUILDKITE_BUILD_DIR_TMPFS_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "build-dir-overlay-path",
+			Value:  "",
+			Usage:  "Path to where golden checkouts are stored. When set, the build is checked out onto a copy-on-write overlay of the golden checkout",
+			EnvVar: "BUILDKITE_BUILD_DIR_OVERLAY_PATH",
+		},
+		cli.IntFlag{
+			Name:   "build-dir-overlay-refresh-interval",
+			Value:  3600,
+			Usage:  "Seconds before a golden checkout is replaced with a fresh clone",
+			EnvVar: "BUILDKITE_BUILD_DIR_OVERLAY_REFRESH_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "build-dir-selinux-label",
+			Value:  "",
+			Usage:  "The SELinux label to give the checkout and the job's temporary directory",
+			EnvVar: "BUILDKITE_BUILD_DIR_SELINUX_LABEL",
+		},
+		cli.StringFlag{
+			Name:   "hooks-path",
+			Value:  "",
+			Usage:  "Directory where the hook scripts are found",
+			EnvVar: "BUILDKITE_HOOKS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "hook-checksums",
+			Value:  "",
+			Usage:  "Path to a file of SHA-256 checksums that global and repository hooks must match to be run",
+			EnvVar: "BUILDKITE_HOOK_CHECKSUMS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "secret-scan",
+			Value:  "",
+			Usage:  "Scan the changes being built and the artifacts for secrets, and either \"annotate\" the build or \"fail\" the job if any are found",
+			EnvVar: "BUILDKITE_SECRET_SCAN",
+		},
+		cli.StringFlag{
+			Name:   "secret-scan-rules",
+			Value:  "",
+			Usage:  "Path to a file of rules to scan for secrets with, as well as the default ones",
+			EnvVar: "BUILDKITE_SECRET_SCAN_RULES_PATH",
+		},
+		cli.StringFlag{
+			Name:   "policy-scanner",
+			Value:  "",
+			Usage:  "Path to a program to check the changed dependency manifests against policy with after checkout",
+			EnvVar: "BUILDKITE_POLICY_SCANNER",
+		},
+		cli.StringFlag{
+			Name:   "plugins-path",
+			Value:  "",
+			Usage:  "Directory where the plugins are saved to",
+			EnvVar: "BUILDKITE_PLUGINS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "plugins-cache-path",
+			Value:  "",
+			Usage:  "Directory where plugin checkouts shared between jobs are cached",
+			EnvVar: "BUILDKITE_PLUGINS_CACHE_PATH",
+		},
+		cli.BoolTFlag{
+			Name:   "command-eval",
+			Usage:  "Allow running of arbitrary commands",
+			EnvVar: "BUILDKITE_COMMAND_EVAL",
+		},
+		cli.BoolTFlag{
+			Name:   "plugins-enabled",
+			Usage:  "Allow plugins to be run",
+			EnvVar: "BUILDKITE_PLUGINS_ENABLED",
+		},
+		cli.BoolFlag{
+			Name:   "plugin-validation",
+			Usage:  "Validate plugin configuration",
+			EnvVar: "BUILDKITE_PLUGIN_VALIDATION",
+		},
+		cli.StringSliceFlag{
+			Name:   "allowed-plugins",
+			Usage:  "Patterns of the plugin locations that are allowed to be run",
+			EnvVar: "BUILDKITE_ALLOWED_PLUGINS",
+		},
+		cli.StringSliceFlag{
+			Name:   "denied-plugins",
+			Usage:  "Patterns of the plugin locations that aren't allowed to be run",
+			EnvVar: "BUILDKITE_DENIED_PLUGINS",
+		},
+		cli.BoolFlag{
+			Name:   "plugins-always-clone-fresh",
+			Usage:  "Always make a new clone of plugin source, even if already present",
+			EnvVar: "BUILDKITE_PLUGINS_ALWAYS_CLONE_FRESH",
+		},
+		cli.BoolTFlag{
+			Name:   "local-hooks-enabled",
+			Usage:  "Allow local hooks to be run",
+			EnvVar: "BUILDKITE_LOCAL_HOOKS_ENABLED",
+		},
+		cli.BoolTFlag{
+			Name:   "ssh-keyscan",
+			Usage:  "Automatically run ssh-keyscan before checkout",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-strict-host-checking",
+			Usage:  "Fail checkouts from SSH hosts that aren't already in known_hosts, listing the fingerprints of their keys, rather than adding them with ssh-keyscan",
+			EnvVar: "BUILDKITE_SSH_STRICT_HOST_CHECKING",
+		},
+		cli.BoolTFlag{
+			Name:   "git-submodules",
+			Usage:  "Enable git submodules",
+			EnvVar: "BUILDKITE_GIT_SUBMODULES",
+		},
+		cli.BoolTFlag{
+			Name:   "pty",
+			Usage:  "Run jobs within a pseudo terminal",
+			EnvVar: "BUILDKITE_PTY",
+		},
+		cli.StringFlag{
+			Name:   "shell",
+			Usage:  "The shell to use to interpret build commands",
+			EnvVar: "BUILDKITE_SHELL",
+			Value:  DefaultShell(),
+		},
+		cli.StringSliceFlag{
+			Name:   "phases",
+			Usage:  "The specific phases to execute. The order they're defined is irrelevant.",
+			EnvVar: "BUILDKITE_BOOTSTRAP_PHASES",
+		},
+		cli.StringFlag{
+			Name:   "cancel-signal",
+			Usage:  "The signal to use for cancellation",
+			EnvVar: "BUILDKITE_CANCEL_SIGNAL",
+			Value:  "SIGTERM",
+		},
+		cli.IntFlag{
+			Name:   "signal-grace-period-seconds",
+			Usage:  "The number of seconds a cancelled command is given to exit before it and any processes it started are killed. The default of 0 leaves them running",
+			EnvVar: "BUILDKITE_SIGNAL_GRACE_PERIOD_SECONDS",
+		},
+		cli.StringSliceFlag{
+			Name:   "redacted-vars",
+			Usage:  "Pattern of environment variable names containing sensitive values",
+			EnvVar: "BUILDKITE_REDACTED_VARS",
+		},
+		cli.StringFlag{
+			Name:   "tracing-backend",
+			Usage:  "The name of the tracing backend to use.",
+			EnvVar: "BUILDKITE_TRACING_BACKEND",
+			Value:  "",
+		},
+		cli.StringFlag{
+			Name:   "tracing-service-name",
+			Usage:  "Service name to use when reporting traces.",
+			EnvVar: "BUILDKITE_TRACING_SERVICE_NAME",
+			Value:  "buildkite-agent",
+		},
+		cli.StringFlag{
+			Name:   "start-timings-file",
+			Value:  "",
+			Usage:  "Path to write a JSON breakdown of how long it took to get to running the command",
+			EnvVar: "BUILDKITE_START_TIMINGS_FILE",
+		},
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := BootstrapConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Enable experiments
+		for _, name := range cfg.Experiments {
+			experiments.Enable(name)
+		}
+
+		// Handle profiling flag
+		done := HandleProfileFlag(l, cfg)
+		defer done()
+
+		// Turn of PTY support if we're on Windows
+		runInPty := cfg.PTY
+		if runtime.GOOS == "windows" {
+			runInPty = false
+		}
+
+		// Only run the command interactively if there's someone at a terminal
+		// to interact with it, so jobs the agent runs never wait on input
+		interactive := cfg.Interactive
+		if interactive && !term.IsTerminal(int(os.Stdin.Fd())) {
+			l.Warn("Not running the command interactively, as stdin isn't a terminal")
+			interactive = false
+		}
+		if interactive {
+			runInPty = false
+		}
+
+		if cfg.ParallelSkewThreshold < 0 {
+			l.Fatal("The parallel skew threshold must be a percentage of at least 0, not %d", cfg.ParallelSkewThreshold)
+		}
+
+		if cfg.CheckoutRetries < 0 || cfg.PluginCloneRetries < 0 || cfg.ArtifactUploadRetries < 0 {
+			l.Fatal("--checkout-retries, --plugin-clone-retries and --artifact-upload-retries can't be negative")
+		}
+
+		retryDelay, err := time.ParseDuration(cfg.RetryDelay)
+		if err != nil || retryDelay < 0 {
+			l.Fatal("Invalid --retry-delay %q, expected a duration like 5s", cfg.RetryDelay)
+		}
+
+		switch cfg.RetryBackoff {
+		case "constant":
+		case "exponential":
+			if retryDelay < time.Second {
+				l.Fatal("--retry-delay must be at least 1s for --retry-backoff exponential")
+			}
+		default:
+			l.Fatal("Unknown --retry-backoff %q, expected constant or exponential", cfg.RetryBackoff)
+		}
+
+		var retryOnExitStatus []int
+		for _, s := range cfg.RetryOnExitStatus {
+			status, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				l.Fatal("Invalid --retry-on-exit-status %q, expected a number", s)
+			}
+			retryOnExitStatus = append(retryOnExitStatus, status)
+		}
+
+		var commandTimeout time.Duration
+		if cfg.CommandTimeout != "" {
+			commandTimeout, err = time.ParseDuration(cfg.CommandTimeout)
+			if err != nil || commandTimeout < 0 {
+				l.Fatal("Invalid --command-timeout %q, expected a duration like 10m", cfg.CommandTimeout)
+			}
+		}
+
+		umask, err := parseFileMode(cfg.Umask)
+		if err != nil {
+			l.Fatal("Invalid --umask %q: %v", cfg.Umask, err)
+		}
+		directoryMode, err := parseFileMode(cfg.DirectoryMode)
+		if err != nil {
+			l.Fatal("Invalid --directory-mode %q: %v", cfg.DirectoryMode, err)
+		}
+
+		// Validate phases
+		for _, phase := range cfg.Phases {
+			switch phase {
+			case "plugin", "checkout", "command":
+				// Valid phase
+			default:
+				l.Fatal("Invalid phase %q", phase)
+			}
+		}
+
+		switch cfg.GitCheckoutStrategy {
+		case "", bootstrap.CheckoutStrategyFull, bootstrap.CheckoutStrategyShallow:
+		case bootstrap.CheckoutStrategyMirror:
+			if cfg.GitMirrorsPath == "" {
+				l.Warn("--git-checkout-strategy mirror needs a --git-mirrors-path, so the repository will be cloned in full")
+			}
+		default:
+			l.Fatal("Invalid --git-checkout-strategy %q, expected full, shallow or mirror", cfg.GitCheckoutStrategy)
+		}
+		if cfg.GitShallowDepth < 1 {
+			l.Fatal("--git-shallow-depth must be at least 1")
+		}
+
+		switch cfg.CommandFailurePolicy {
+		case "", bootstrap.CommandFailurePolicyFailFast, bootstrap.CommandFailurePolicyContinue:
+		default:
+			l.Fatal("Invalid --command-failure-policy %q, expected fail-fast or continue", cfg.CommandFailurePolicy)
+		}
+
+		cancelSig, err := process.ParseSignal(cfg.CancelSignal)
+		if err != nil {
+			l.Fatal("Failed to parse cancel-signal: %v", err)
+		}
+
+		if cfg.SignalGracePeriodSeconds < 0 {
+			l.Fatal("Invalid --signal-grace-period-seconds %d, it can't be negative", cfg.SignalGracePeriodSeconds)
+		}
+
+		var failureBundleMaxSize int64
+		if cfg.FailureBundleMaxSize != "" {
+			failureBundleMaxSize, err = agent.ParseByteSize(cfg.FailureBundleMaxSize)
+			if err != nil {
+				l.Fatal("Invalid --failure-bundle-max-size %q: %s", cfg.FailureBundleMaxSize, err)
+			}
+		}
+
+		// Configure the bootstraper
+		bootstrap := bootstrap.New(bootstrap.Config{
+			AgentName:                    cfg.AgentName,
+			ArtifactUploadDestination:    cfg.ArtifactUploadDestination,
+			ArtifactPreviews:             cfg.ArtifactPreviews,
+			DockerDaemon:                 cfg.DockerDaemon,
+			DockerDaemonImage:            cfg.DockerDaemonImage,
+			Rootless:                     cfg.Rootless,
+			VirtualDisplay:               cfg.VirtualDisplay,
+			VirtualDisplaySize:           cfg.VirtualDisplaySize,
+			Device:                       cfg.Device,
+			DeviceBootTimeout:            cfg.DeviceBootTimeout,
+			ScreenRecording:              cfg.ScreenRecording,
+			ScreenshotPaths:              cfg.ScreenshotPaths,
+			FailureBundlePaths:           cfg.FailureBundlePaths,
+			FailureBundleMaxSize:         failureBundleMaxSize,
+			AutomaticArtifactUploadPaths: cfg.AutomaticArtifactUploadPaths,
+			BinPath:                      cfg.BinPath,
+			Branch:                       cfg.Branch,
+			BuildPath:                    cfg.BuildPath,
+			BuildPathLayout:              cfg.BuildPathLayout,
+			SpawnIndex:                   cfg.SpawnIndex,
+			PhaseMarkers:                 cfg.PhaseMarkers,
+			LineMetadata:                 cfg.LineMetadata,
+			LogFormat:                    cfg.LogFormat,
+			CommandTimeout:               commandTimeout,
+			Umask:                        umask,
+			DirectoryMode:                directoryMode,
+			SeparateCommands:             cfg.SeparateCommands,
+			CommandFailurePolicy:         cfg.CommandFailurePolicy,
+			CommandShim:                  cfg.CommandShim,
+			CommandShimShellOptions:      cfg.CommandShimShellOptions,
+			CommandShimLocale:            cfg.CommandShimLocale,
+			Interactive:                  interactive,
+			ParallelSkewThreshold:        cfg.ParallelSkewThreshold,
+			BuildDirEncryption:           cfg.BuildDirEncryption,
+			BuildDirEncryptionSize:       cfg.BuildDirEncryptionSize,
+			BuildDirTmpfs:                cfg.BuildDirTmpfs,
+			BuildDirTmpfsSize:            cfg.BuildDirTmpfsSize,
+			BuildDirOverlayPath:          cfg.BuildDirOverlayPath,
+			BuildDirOverlayRefresh:       cfg.BuildDirOverlayRefresh,
+			BuildDirSELinuxLabel:         cfg.BuildDirSELinuxLabel,
+			CancelSignal:                 cancelSig,
+			SignalGracePeriod:            time.Duration(cfg.SignalGracePeriodSeconds) * time.Second,
+			CleanCheckout:                cfg.CleanCheckout,
+			Command:                      cfg.Command,
+			CommandEval:                  cfg.CommandEval,
+			Commit:                       cfg.Commit,
+			Debug:                        cfg.Debug,
+			GitCheckoutFlags:             cfg.GitCheckoutFlags,
+			GitCleanFlags:                cfg.GitCleanFlags,
+			GitCloneFlags:                cfg.GitCloneFlags,
+			GitCloneMirrorFlags:          cfg.GitCloneMirrorFlags,
+			GitFetchFlags:                cfg.GitFetchFlags,
+			GitMirrorsLockTimeout:        cfg.GitMirrorsLockTimeout,
+			GitCheckoutStrategy:          cfg.GitCheckoutStrategy,
+			GitShallowDepth:              cfg.GitShallowDepth,
+			GitLFS:                       cfg.GitLFS,
+			GitLFSInclude:                cfg.GitLFSInclude,
+			GitLFSExclude:                cfg.GitLFSExclude,
+			CheckoutRetries:              cfg.CheckoutRetries,
+			PluginCloneRetries:           cfg.PluginCloneRetries,
+			ArtifactUploadRetries:        cfg.ArtifactUploadRetries,
+			RetryBackoff:                 cfg.RetryBackoff,
+			RetryDelay:                   retryDelay,
+			RetryJitter:                  cfg.RetryJitter,
+			RetryOnExitStatus:            retryOnExitStatus,
+			GitMirrorsPath:               cfg.GitMirrorsPath,
+			GitMirrorsSkipUpdate:         cfg.GitMirrorsSkipUpdate,
+			GitSubmodules:                cfg.GitSubmodules,
+			GitSubmoduleCloneConfig:      cfg.GitSubmoduleCloneConfig,
+			GitSubmoduleSSHKeys:          cfg.GitSubmoduleSSHKeys,
+			GitSparseCheckoutPaths:       cfg.GitSparseCheckoutPaths,
+			GitAutoCRLF:                  cfg.GitAutoCRLF,
+			GitEOL:                       cfg.GitEOL,
+			GitLongPaths:                 cfg.GitLongPaths,
+			HooksPath:                    cfg.HooksPath,
+			HookChecksumsPath:            cfg.HookChecksumsPath,
+			SecretScan:                   cfg.SecretScan,
+			SecretScanRulesPath:          cfg.SecretScanRules,
+			PolicyScannerPath:            cfg.PolicyScanner,
+			JobID:                        cfg.JobID,
+			LocalHooksEnabled:            cfg.LocalHooksEnabled,
+			OrganizationSlug:             cfg.OrganizationSlug,
+			Phases:                       cfg.Phases,
+			PipelineProvider:             cfg.PipelineProvider,
+			PipelineSlug:                 cfg.PipelineSlug,
+			PluginValidation:             cfg.PluginValidation,
+			AllowedPlugins:               cfg.AllowedPlugins,
+			DeniedPlugins:                cfg.DeniedPlugins,
+			Plugins:                      cfg.Plugins,
+			PluginsEnabled:               cfg.PluginsEnabled,
+			PluginsAlwaysCloneFresh:      cfg.PluginsAlwaysCloneFresh,
+			PluginsPath:                  cfg.PluginsPath,
+			PluginsCachePath:             cfg.PluginsCachePath,
+			PullRequest:                  cfg.PullRequest,
+			Queue:                        cfg.Queue,
+			RedactedVars:                 cfg.RedactedVars,
+			RefSpec:                      cfg.RefSpec,
+			Repository:                   cfg.Repository,
+			RunInPty:                     runInPty,
+			SSHKeyscan:                   cfg.SSHKeyscan,
+			SSHStrictHostChecking:        cfg.SSHStrictHostChecking,
+			Shell:                        cfg.Shell,
+			Tag:                          cfg.Tag,
+			TracingBackend:               cfg.TracingBackend,
+			TracingServiceName:           cfg.TracingServiceName,
+			StartTimingsFile:             cfg.StartTimingsFile,
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt,
+			syscall.SIGHUP,
+			syscall.SIGTERM,
+			syscall.SIGINT,
+			syscall.SIGQUIT)
+		defer signal.Stop(signals)
+
+		var (
+			cancelled bool
+			received  os.Signal
+			signalMu  sync.Mutex
+		)
+
+		// Listen for signals in the background and cancel the bootstrap
+		go func() {
+			sig := <-signals
+			signalMu.Lock()
+			defer signalMu.Unlock()
+
+			// Cancel the bootstrap
+			bootstrap.Cancel()
+
+			// Track the state and signal used
+			cancelled = true
+			received = sig
+
+			// Remove our signal handler so subsequent signals kill
+			signal.Stop(signals)
+		}()
+
+		// Run the bootstrap and get the exit code
+		exitCode := bootstrap.Run(ctx)
+
+		signalMu.Lock()
+		defer signalMu.Unlock()
+
+		// If cancelled and our child process returns a non-zero, we should terminate
+		// ourselves with the same signal so that our caller can detect and handle appropriately
+		if cancelled && runtime.GOOS != "windows" {
+			p, err := os.FindProcess(os.Getpid())
+			if err != nil {
+				l.Error("Failed to find current process: %v", err)
+			}
+
+			l.Debug("Terminating bootstrap after cancellation with %v", received)
+			err = p.Signal(received)
+			if err != nil {
+				l.Error("Failed to signal self: %v", err)
+			}
+		}
+
+		os.Exit(exitCode)
+	},
+}
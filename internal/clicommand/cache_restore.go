@@ -0,0 +1,128 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/urfave/cli"
+)
+
+const cacheRestoreHelpDescription = `Usage:
+
+   buildkite-agent cache restore [options] --key <key>
+
+Description:
+
+   Restores the files and directories saved to the cache store under a key
+   with 'cache save' into the current directory. Keys are templated the same
+   way as they are when they're saved.
+
+   If there isn't an entry under the key, each of the fallback keys is tried
+   in turn, usually less specific ones that an older entry might still be
+   useful under. The key that was restored is printed, and nothing is printed
+   if none of them were there. Either way the command succeeds, as a build can
+   carry on without its cache, as can one whose cache can't be downloaded.
+
+Example:
+
+   $ buildkite-agent cache restore \
+       --store s3://my-bucket/cache \
+       --key 'node/{{ .OS }}-{{ .Arch }}/{{ checksum "package-lock.json" }}' \
+       --fallback-keys 'node/{{ .OS }}-{{ .Arch }}/main'`
+
+type CacheRestoreConfig struct {
+	Key          string   `cli:"key" validate:"required"`
+	FallbackKeys []string `cli:"fallback-keys" normalize:"list"`
+	Store        string   `cli:"store" validate:"required"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+
+	// API config
+	DebugHTTP bool `cli:"debug-http"`
+}
+
+var CacheRestoreCommand = cli.Command{
+	Name:        "restore",
+	Usage:       "Restores files and directories from the cache",
+	Description: cacheRestoreHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "key",
+			Value: "",
+			Usage: "The key to restore the files from, which can be templated",
+		},
+		cli.StringSliceFlag{
+			Name:  "fallback-keys",
+			Value: &cli.StringSlice{},
+			Usage: "Keys to try in turn if there isn't an entry under --key",
+		},
+		cacheStoreFlag,
+
+		// API Flags
+		DebugHTTPFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		ctx := context.Background()
+
+		// The configuration will be loaded into this struct
+		cfg := CacheRestoreConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		cache, err := agent.NewCache(l, agent.CacheConfig{
+			Store:     cfg.Store,
+			DebugHTTP: cfg.DebugHTTP,
+		})
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		var keys []string
+		for _, key := range append([]string{cfg.Key}, cfg.FallbackKeys...) {
+			expanded, err := agent.ExpandCacheKey(key)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+			keys = append(keys, expanded)
+		}
+
+		restored, err := cache.Restore(ctx, keys)
+		if err != nil {
+			l.Fatal("Failed to restore from the cache: %s", err)
+		}
+		if restored != "" {
+			fmt.Println(restored)
+		}
+	},
+}
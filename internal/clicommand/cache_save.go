@@ -0,0 +1,144 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/urfave/cli"
+)
+
+const cacheSaveHelpDescription = `Usage:
+
+   buildkite-agent cache save [options] --key <key> <paths>
+
+Description:
+
+   Saves files and directories, like a build's dependencies, to the cache
+   store under a key, so later builds can restore them with 'cache restore'
+   instead of fetching or building them again. An entry that's already under
+   the key is replaced.
+
+   Paths are separated by ';', and are relative to the current directory,
+   which they have to be inside. Paths that don't exist are skipped.
+
+   The cache store is an s3://, gs://, rt:// or azblob:// path, set up the
+   same way as for artifact uploads to it. Entries are compressed tar
+   archives, with gzip by default, or zstd (which needs the zstd command).
+
+   Keys can be templated, usually with the checksum of the lockfiles the
+   cached files come from, so the key changes when they do:
+
+     {{ checksum "package-lock.json" }}  the SHA-256 checksum of the files
+                                         that match one or more glob patterns
+     {{ env "BUILDKITE_BRANCH" }}        the value of an environment variable
+     {{ .OS }} and {{ .Arch }}           like linux and amd64
+
+   Keys can have letters, numbers, and _ . + = - in them, and / to separate
+   their parts.
+
+Example:
+
+   $ buildkite-agent cache save \
+       --store s3://my-bucket/cache \
+       --key 'node/{{ .OS }}-{{ .Arch }}/{{ checksum "package-lock.json" }}' \
+       node_modules`
+
+type CacheSaveConfig struct {
+	Paths    string `cli:"arg:0" label:"cache paths" validate:"required"`
+	Key      string `cli:"key" validate:"required"`
+	Store    string `cli:"store" validate:"required"`
+	Compress string `cli:"compress"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+
+	// API config
+	DebugHTTP bool `cli:"debug-http"`
+}
+
+var cacheStoreFlag = cli.StringFlag{
+	Name:   "store",
+	Value:  "",
+	EnvVar: "BUILDKITE_CACHE_STORE",
+	Usage:  "Where the cache is kept, an s3://, gs://, rt:// or azblob:// path",
+}
+
+var CacheSaveCommand = cli.Command{
+	Name:        "save",
+	Usage:       "Saves files and directories to the cache under a key",
+	Description: cacheSaveHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "key",
+			Value: "",
+			Usage: "The key to save the files under, which can be templated",
+		},
+		cacheStoreFlag,
+		cli.StringFlag{
+			Name:   "compress",
+			Value:  agent.ArtifactCompressionGzip,
+			EnvVar: "BUILDKITE_CACHE_COMPRESS",
+			Usage:  "How to compress the cache entry, gzip or zstd",
+		},
+
+		// API Flags
+		DebugHTTPFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		ctx := context.Background()
+
+		// The configuration will be loaded into this struct
+		cfg := CacheSaveConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		cache, err := agent.NewCache(l, agent.CacheConfig{
+			Store:       cfg.Store,
+			Compression: cfg.Compress,
+			DebugHTTP:   cfg.DebugHTTP,
+		})
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		key, err := agent.ExpandCacheKey(cfg.Key)
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		if err := cache.Save(ctx, key, strings.Split(cfg.Paths, agent.ArtifactPathDelimiter)); err != nil {
+			l.Fatal("Failed to save to the cache: %s", err)
+		}
+	},
+}
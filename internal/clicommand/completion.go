@@ -0,0 +1,296 @@
+package clicommand
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+const completionHelpDescription = `Usage:
+
+   buildkite-agent completion <shell>
+
+Description:
+
+   Prints a script that completes buildkite-agent's commands and options in
+   the given shell, which is one of bash, zsh, fish or pwsh.
+
+Example:
+
+   $ buildkite-agent completion bash > /etc/bash_completion.d/buildkite-agent
+   $ buildkite-agent completion zsh > "${fpath[1]}/_buildkite-agent"
+   $ buildkite-agent completion fish > ~/.config/fish/completions/buildkite-agent.fish
+   $ buildkite-agent completion pwsh >> $PROFILE`
+
+var CompletionCommand = cli.Command{
+	Name:        "completion",
+	Usage:       "Print a shell completion script",
+	Description: completionHelpDescription,
+	Action: func(c *cli.Context) error {
+		shell := c.Args().First()
+
+		writers := map[string]func(io.Writer, []completionEntry){
+			"bash": writeBashCompletion,
+			"zsh":  writeZshCompletion,
+			"fish": writeFishCompletion,
+			"pwsh": writePwshCompletion,
+		}
+
+		write, ok := writers[shell]
+		if !ok {
+			return fmt.Errorf("Unknown shell %q, expected one of bash, zsh, fish or pwsh", shell)
+		}
+
+		write(c.App.Writer, completionEntries(c.App.Commands))
+		return nil
+	},
+}
+
+// completionWord is a command or option that can be completed
+type completionWord struct {
+	Name  string
+	Usage string
+}
+
+// completionEntry is what can come next after a command, e.g. after
+// "artifact", or after "artifact upload"
+type completionEntry struct {
+	Path        string
+	Subcommands []completionWord
+	Flags       []completionWord
+}
+
+// Words returns everything that can be completed, with flags as --name
+func (e completionEntry) Words() []string {
+	var words []string
+	for _, sub := range e.Subcommands {
+		words = append(words, sub.Name)
+	}
+	for _, flag := range e.Flags {
+		words = append(words, "--"+flag.Name)
+	}
+	return words
+}
+
+// completionEntries walks the command tree, returning an entry for each
+// command sorted by path, starting with the top level
+func completionEntries(commands []cli.Command) []completionEntry {
+	var entries []completionEntry
+
+	var walk func(path string, commands []cli.Command, flags []cli.Flag)
+	walk = func(path string, commands []cli.Command, flags []cli.Flag) {
+		entry := completionEntry{Path: path}
+
+		for _, cmd := range commands {
+			if cmd.Hidden {
+				continue
+			}
+			entry.Subcommands = append(entry.Subcommands, completionWord{Name: cmd.Name, Usage: cmd.Usage})
+			walk(strings.TrimSpace(path+" "+cmd.Name), cmd.Subcommands, cmd.Flags)
+		}
+
+		for _, flag := range flags {
+			if flagIsHidden(flag) {
+				continue
+			}
+			// A flag's name can include its short aliases, e.g. "debug, d"
+			name := strings.TrimSpace(strings.Split(flag.GetName(), ",")[0])
+			entry.Flags = append(entry.Flags, completionWord{Name: name, Usage: flagUsage(flag)})
+		}
+
+		entries = append(entries, entry)
+	}
+	walk("", commands, nil)
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+func flagIsHidden(flag cli.Flag) bool {
+	switch f := flag.(type) {
+	case cli.StringFlag:
+		return f.Hidden
+	case cli.StringSliceFlag:
+		return f.Hidden
+	case cli.BoolFlag:
+		return f.Hidden
+	case cli.BoolTFlag:
+		return f.Hidden
+	case cli.IntFlag:
+		return f.Hidden
+	case cli.DurationFlag:
+		return f.Hidden
+	}
+	return false
+}
+
+func flagUsage(flag cli.Flag) string {
+	switch f := flag.(type) {
+	case cli.StringFlag:
+		return f.Usage
+	case cli.StringSliceFlag:
+		return f.Usage
+	case cli.BoolFlag:
+		return f.Usage
+	case cli.BoolTFlag:
+		return f.Usage
+	case cli.IntFlag:
+		return f.Usage
+	case cli.DurationFlag:
+		return f.Usage
+	}
+	return ""
+}
+
+func completionPaths(entries []completionEntry) []string {
+	var paths []string
+	for _, e := range entries {
+		if e.Path != "" {
+			paths = append(paths, e.Path)
+		}
+	}
+	return paths
+}
+
+func writeBashCompletion(w io.Writer, entries []completionEntry) {
+	fmt.Fprint(w, `# bash completion for buildkite-agent
+
+_buildkite_agent() {
+  local cur cmdpath word words i
+  cur="${COMP_WORDS[COMP_CWORD]}"
+  cmdpath=""
+
+  # Find the command being run, skipping over options and their values
+  for ((i = 1; i < COMP_CWORD; i++)); do
+    word="${COMP_WORDS[i]}"
+    [[ "$word" == -* ]] && continue
+    case "${cmdpath:+$cmdpath }$word" in
+`)
+	for _, path := range completionPaths(entries) {
+		fmt.Fprintf(w, "      %q) cmdpath=\"${cmdpath:+$cmdpath }$word\" ;;\n", path)
+	}
+	fmt.Fprint(w, `    esac
+  done
+
+  case "$cmdpath" in
+`)
+	for _, e := range entries {
+		fmt.Fprintf(w, "    %q) words=%q ;;\n", e.Path, strings.Join(e.Words(), " "))
+	}
+	fmt.Fprint(w, `  esac
+
+  COMPREPLY=($(compgen -W "$words" -- "$cur"))
+}
+
+complete -o default -F _buildkite_agent buildkite-agent
+`)
+}
+
+func writeZshCompletion(w io.Writer, entries []completionEntry) {
+	fmt.Fprint(w, `#compdef buildkite-agent
+
+_buildkite_agent() {
+  local cmdpath="" word
+  local -a candidates
+
+  # Find the command being run, skipping over options and their values
+  for word in "${(@)words[2,CURRENT-1]}"; do
+    [[ "$word" == -* ]] && continue
+    case "${cmdpath:+$cmdpath }$word" in
+`)
+	for _, path := range completionPaths(entries) {
+		fmt.Fprintf(w, "      (%q) cmdpath=\"${cmdpath:+$cmdpath }$word\" ;;\n", path)
+	}
+	fmt.Fprint(w, `    esac
+  done
+
+  case "$cmdpath" in
+`)
+	for _, e := range entries {
+		fmt.Fprintf(w, "    (%q) candidates=(%s) ;;\n", e.Path, strings.Join(e.Words(), " "))
+	}
+	fmt.Fprint(w, `  esac
+
+  compadd -- "${candidates[@]}"
+}
+
+compdef _buildkite_agent buildkite-agent
+`)
+}
+
+func writeFishCompletion(w io.Writer, entries []completionEntry) {
+	fmt.Fprint(w, `# fish completion for buildkite-agent
+
+set -g __buildkite_agent_paths`)
+	for _, path := range completionPaths(entries) {
+		fmt.Fprintf(w, " %s", fishQuote(path))
+	}
+	fmt.Fprint(w, `
+
+# Whether the command being run is the given one, skipping over options and
+# their values
+function __buildkite_agent_at
+    set -l cmdpath ""
+    for word in (commandline -opc)[2..-1]
+        string match -q -- '-*' $word; and continue
+        set -l next (string trim -- "$cmdpath $word")
+        if contains -- $next $__buildkite_agent_paths
+            set cmdpath $next
+        end
+    end
+    test "$cmdpath" = "$argv[1]"
+end
+
+complete -c buildkite-agent -f
+`)
+	for _, e := range entries {
+		cond := fishQuote(`__buildkite_agent_at "` + e.Path + `"`)
+		for _, sub := range e.Subcommands {
+			fmt.Fprintf(w, "complete -c buildkite-agent -n %s -a %s -d %s\n", cond, sub.Name, fishQuote(sub.Usage))
+		}
+		for _, flag := range e.Flags {
+			fmt.Fprintf(w, "complete -c buildkite-agent -n %s -l %s -d %s\n", cond, flag.Name, fishQuote(flag.Usage))
+		}
+	}
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+func writePwshCompletion(w io.Writer, entries []completionEntry) {
+	fmt.Fprint(w, `# PowerShell completion for buildkite-agent
+
+Register-ArgumentCompleter -Native -CommandName buildkite-agent -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+
+    $completions = @{
+`)
+	for _, e := range entries {
+		words := make([]string, len(e.Words()))
+		for i, word := range e.Words() {
+			words[i] = "'" + word + "'"
+		}
+		fmt.Fprintf(w, "        '%s' = @(%s)\n", e.Path, strings.Join(words, ", "))
+	}
+	fmt.Fprint(w, `    }
+
+    # Find the command being run, skipping over options and their values
+    $cmdpath = ''
+    foreach ($element in $commandAst.CommandElements | Select-Object -Skip 1) {
+        if ($element.Extent.EndOffset -ge $cursorPosition) { break }
+        $word = $element.ToString()
+        if ($word.StartsWith('-')) { continue }
+        $next = ($cmdpath + ' ' + $word).Trim()
+        if ($completions.ContainsKey($next)) { $cmdpath = $next }
+    }
+
+    $completions[$cmdpath] | Where-Object { $_ -like "$wordToComplete*" } | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+    }
+}
+`)
+}
@@ -0,0 +1,681 @@
+package clicommand
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/urfave/cli"
+)
+
+// The most packages listed in a coverage annotation
+const maxAnnotatedCoveragePackages = 50
+
+const coverageUploadHelpDescription = `Usage:
+
+   buildkite-agent coverage upload <reports> [options...]
+
+Description:
+
+   Reads coverage reports, keeps the total coverage in the build's meta-data,
+   and annotates the build with it, broken down by package.
+
+   Reports can be lcov tracefiles, Cobertura XML, or Go cover profiles. Their
+   format is worked out from what's in them, or can be given with --format.
+   Separate more than one report with a semicolon, or use a glob, and their
+   coverage is combined.
+
+   The coverage is kept in the coverage-<context>-percent,
+   coverage-<context>-covered and coverage-<context>-total meta-data keys.
+   Use --context to tell apart the coverage of different parts of the build.
+
+   With --baseline-path, each build's coverage is saved there for its branch,
+   and compared with the last that was saved for the branch its pull request
+   is to be merged into, or the pipeline's default branch, so the annotation
+   shows how much the coverage has changed. The baseline path is a directory
+   the pipeline's agents share, or an S3 bucket and path like
+   s3://my-bucket/coverage, which uses the same configuration as artifacts.
+
+Example:
+
+   $ buildkite-agent coverage upload coverage/lcov.info
+   $ buildkite-agent coverage upload coverage.out --baseline-path s3://my-bucket/coverage
+   $ buildkite-agent coverage upload "reports/*.xml" --format cobertura --context backend`
+
+type CoverageUploadConfig struct {
+	Reports       string `cli:"arg:0" label:"coverage reports" validate:"required"`
+	Format        string `cli:"format"`
+	Context       string `cli:"context"`
+	BaselinePath  string `cli:"baseline-path"`
+	Pipeline      string `cli:"pipeline"`
+	Branch        string `cli:"branch"`
+	TargetBranch  string `cli:"target-branch"`
+	DefaultBranch string `cli:"default-branch"`
+	Commit        string `cli:"commit"`
+	BuildNumber   string `cli:"build-number"`
+	Job           string `cli:"job" validate:"required"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+
+	// API config
+	DebugHTTP        bool     `cli:"debug-http"`
+	DNSOverrides     []string `cli:"dns-override" normalize:"list"`
+	DNSResolver      string   `cli:"dns-resolver"`
+	AgentAccessToken string   `cli:"agent-access-token" validate:"required-without:JobAPISocket"`
+	Endpoint         string   `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool     `cli:"no-http2"`
+	JobAPISocket     string   `cli:"job-api-socket"`
+}
+
+var CoverageUploadCommand = cli.Command{
+	Name:        "upload",
+	Usage:       "Keeps the coverage from coverage reports and annotates the build with it",
+	Description: coverageUploadHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "format",
+			Value:  "",
+			Usage:  "The format of the reports: lcov, cobertura or go. Defaults to working it out from each report",
+			EnvVar: "BUILDKITE_COVERAGE_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "context",
+			Value:  "default",
+			Usage:  "Which of the build's coverage this is, like the name of the project it's for",
+			EnvVar: "BUILDKITE_COVERAGE_CONTEXT",
+		},
+		cli.StringFlag{
+			Name:   "baseline-path",
+			Value:  "",
+			Usage:  "A directory, or an S3 bucket and path like s3://my-bucket/coverage, to save each branch's coverage to and compare it with",
+			EnvVar: "BUILDKITE_COVERAGE_BASELINE_PATH",
+		},
+		cli.StringFlag{
+			Name:   "pipeline",
+			Value:  "",
+			Usage:  "The slug of the job's pipeline",
+			EnvVar: "BUILDKITE_PIPELINE_SLUG",
+		},
+		cli.StringFlag{
+			Name:   "branch",
+			Value:  "",
+			Usage:  "The branch being built",
+			EnvVar: "BUILDKITE_BRANCH",
+		},
+		cli.StringFlag{
+			Name:   "target-branch",
+			Value:  "",
+			Usage:  "The branch to compare the coverage with, which defaults to the one the pull request is to be merged into",
+			EnvVar: "BUILDKITE_PULL_REQUEST_BASE_BRANCH",
+		},
+		cli.StringFlag{
+			Name:   "default-branch",
+			Value:  "",
+			Usage:  "The branch to compare the coverage with when the build isn't for a pull request",
+			EnvVar: "BUILDKITE_PIPELINE_DEFAULT_BRANCH",
+		},
+		cli.StringFlag{
+			Name:   "commit",
+			Value:  "",
+			Usage:  "The commit being built",
+			EnvVar: "BUILDKITE_COMMIT",
+		},
+		cli.StringFlag{
+			Name:   "build-number",
+			Value:  "",
+			Usage:  "The number of the job's build",
+			EnvVar: "BUILDKITE_BUILD_NUMBER",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job should the coverage be kept for",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+		DNSOverridesFlag,
+		DNSResolverFlag,
+		JobAPISocketFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		ctx := context.Background()
+
+		// The configuration will be loaded into this struct
+		cfg := CoverageUploadConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		if err := uploadCoverage(ctx, cfg, l); err != nil {
+			l.Fatal("%s", err)
+		}
+	},
+}
+
+func uploadCoverage(ctx context.Context, cfg CoverageUploadConfig, l logger.Logger) error {
+	profile := newCoverageProfile()
+	for _, pattern := range strings.Split(cfg.Reports, agent.ArtifactPathDelimiter) {
+		reports, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid report pattern %q: %w", pattern, err)
+		}
+		if len(reports) == 0 {
+			return fmt.Errorf("No coverage reports match %q", pattern)
+		}
+
+		for _, report := range reports {
+			data, err := os.ReadFile(report)
+			if err != nil {
+				return fmt.Errorf("Failed to read coverage report: %w", err)
+			}
+			if err := profile.parse(data, cfg.Format); err != nil {
+				return fmt.Errorf("Failed to parse coverage report %s: %w", report, err)
+			}
+			l.Info("Read coverage report %s", report)
+		}
+	}
+
+	summary := profile.summarize()
+	summary.Branch = cfg.Branch
+	summary.Commit = cfg.Commit
+	summary.BuildNumber = cfg.BuildNumber
+	l.Info("Coverage: %s", summary.Totals)
+
+	client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
+	metaData := map[string]string{
+		"percent": fmt.Sprintf("%.2f", summary.Totals.percent()),
+		"covered": strconv.Itoa(summary.Totals.Covered),
+		"total":   strconv.Itoa(summary.Totals.Total),
+	}
+	for _, name := range []string{"percent", "covered", "total"} {
+		if err := setMetaData(ctx, l, client, cfg.Job, coverageMetaDataKey(cfg.Context, name), metaData[name]); err != nil {
+			return err
+		}
+	}
+
+	// Not being able to compare the coverage with the baseline shouldn't
+	// fail the build
+	var baseline *coverageSummary
+	if cfg.BaselinePath != "" {
+		target := cfg.TargetBranch
+		if target == "" {
+			target = cfg.DefaultBranch
+		}
+		if cfg.Pipeline == "" || target == "" {
+			l.Warn("Missing the pipeline or branch to compare the coverage with")
+		} else {
+			var err error
+			baseline, err = loadCoverageBaseline(ctx, l, cfg.BaselinePath, coverageBaselineName(cfg.Pipeline, cfg.Context, target))
+			if err != nil {
+				l.Warn("Failed to load the coverage of %s to compare with: %v", target, err)
+			} else if baseline == nil {
+				l.Info("There's no coverage of %s to compare with yet", target)
+			} else {
+				baseline.Branch = target
+			}
+		}
+
+		if cfg.Pipeline != "" && cfg.Branch != "" {
+			if err := saveCoverageBaseline(l, cfg.BaselinePath, coverageBaselineName(cfg.Pipeline, cfg.Context, cfg.Branch), summary); err != nil {
+				l.Warn("Failed to save the coverage of %s: %v", cfg.Branch, err)
+			}
+		}
+	}
+
+	return annotate(ctx, AnnotateConfig{
+		Body:             summary.markdown(cfg.Context, baseline),
+		Style:            summary.style(baseline),
+		Context:          "coverage-" + cfg.Context,
+		Job:              cfg.Job,
+		DebugHTTP:        cfg.DebugHTTP,
+		DNSOverrides:     cfg.DNSOverrides,
+		DNSResolver:      cfg.DNSResolver,
+		AgentAccessToken: cfg.AgentAccessToken,
+		Endpoint:         cfg.Endpoint,
+		NoHTTP2:          cfg.NoHTTP2,
+		JobAPISocket:     cfg.JobAPISocket,
+	}, l)
+}
+
+// coverageMetaDataKey is the build meta-data key for some of the coverage,
+// like coverage-backend-percent
+func coverageMetaDataKey(coverageContext, name string) string {
+	return "coverage-" + coverageContext + "-" + name
+}
+
+// coverageBlock is a line, or in a Go cover profile a block of statements,
+// and whether it's covered
+type coverageBlock struct {
+	Weight  int
+	Covered bool
+}
+
+// coverageProfile is what's covered in each file. Blocks that are in more
+// than one report are covered if they're covered in any of them.
+type coverageProfile struct {
+	// The unit of coverage, lines or statements
+	Unit string
+
+	// The blocks in each file, by their line or position
+	Files map[string]map[string]coverageBlock
+
+	// The package each file's in
+	Packages map[string]string
+}
+
+func newCoverageProfile() *coverageProfile {
+	return &coverageProfile{
+		Files:    make(map[string]map[string]coverageBlock),
+		Packages: make(map[string]string),
+	}
+}
+
+func (p *coverageProfile) add(pkg, file, key string, weight int, covered bool) {
+	if p.Files[file] == nil {
+		p.Files[file] = make(map[string]coverageBlock)
+		p.Packages[file] = pkg
+	}
+	b := p.Files[file][key]
+	if weight > b.Weight {
+		b.Weight = weight
+	}
+	b.Covered = b.Covered || covered
+	p.Files[file][key] = b
+}
+
+// parse adds the coverage in a report, in the format or the format it looks
+// like it's in
+func (p *coverageProfile) parse(data []byte, format string) error {
+	if format == "" {
+		format = detectCoverageFormat(data)
+	}
+
+	var unit string
+	var err error
+	switch format {
+	case "lcov":
+		unit, err = "lines", p.parseLcov(data)
+	case "cobertura":
+		unit, err = "lines", p.parseCobertura(data)
+	case "go":
+		unit, err = "statements", p.parseGoCoverProfile(data)
+	case "":
+		return errors.New("It isn't an lcov, Cobertura or Go coverage report, use --format to say which it is")
+	default:
+		return fmt.Errorf("Invalid format %q, expected lcov, cobertura or go", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if p.Unit != "" && p.Unit != unit {
+		return fmt.Errorf("Can't combine coverage of %s with coverage of %s", unit, p.Unit)
+	}
+	p.Unit = unit
+	return nil
+}
+
+func detectCoverageFormat(data []byte) string {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(data, []byte("mode:")):
+		return "go"
+	case bytes.HasPrefix(data, []byte("<")) && bytes.Contains(data, []byte("<coverage")):
+		return "cobertura"
+	case bytes.HasPrefix(data, []byte("TN:")) || bytes.HasPrefix(data, []byte("SF:")) || bytes.Contains(data, []byte("\nSF:")):
+		return "lcov"
+	}
+	return ""
+}
+
+// parseLcov adds the lines in an lcov tracefile, from its SF: and DA:
+// records
+func (p *coverageProfile) parseLcov(data []byte) error {
+	file := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "SF:"):
+			file = filepath.ToSlash(strings.TrimPrefix(line, "SF:"))
+
+		case strings.HasPrefix(line, "DA:"):
+			fields := strings.Split(strings.TrimPrefix(line, "DA:"), ",")
+			if file == "" || len(fields) < 2 {
+				return fmt.Errorf("line %d: invalid DA record %q", n, line)
+			}
+			hits, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return fmt.Errorf("line %d: invalid DA record %q", n, line)
+			}
+			p.add(path.Dir(file), file, fields[0], 1, hits > 0)
+
+		case line == "end_of_record":
+			file = ""
+		}
+	}
+	return scanner.Err()
+}
+
+// coberturaReport is the part of a Cobertura report that's read
+type coberturaReport struct {
+	XMLName  xml.Name `xml:"coverage"`
+	Packages []struct {
+		Name    string `xml:"name,attr"`
+		Classes []struct {
+			Filename string `xml:"filename,attr"`
+			Lines    []struct {
+				Number string  `xml:"number,attr"`
+				Hits   float64 `xml:"hits,attr"`
+			} `xml:"lines>line"`
+		} `xml:"classes>class"`
+	} `xml:"packages>package"`
+}
+
+// parseCobertura adds the lines of the classes in a Cobertura report, in the
+// packages the report has them in
+func (p *coverageProfile) parseCobertura(data []byte) error {
+	var report coberturaReport
+	if err := xml.Unmarshal(data, &report); err != nil {
+		return err
+	}
+
+	for _, pkg := range report.Packages {
+		for _, class := range pkg.Classes {
+			file := filepath.ToSlash(class.Filename)
+			name := pkg.Name
+			if name == "" {
+				name = path.Dir(file)
+			}
+			for _, line := range class.Lines {
+				p.add(name, file, line.Number, 1, line.Hits > 0)
+			}
+		}
+	}
+	return nil
+}
+
+// parseGoCoverProfile adds the blocks of statements in a profile written by
+// go test -coverprofile, which are lines like
+// github.com/org/repo/pkg/file.go:10.2,12.16 2 1
+func (p *coverageProfile) parseGoCoverProfile(data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Profiles that have been concatenated have more than one mode line
+		if line == "" || strings.HasPrefix(line, "mode:") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return fmt.Errorf("line %d: invalid block %q", n, line)
+		}
+		i := strings.LastIndex(fields[0], ":")
+		statements, err1 := strconv.Atoi(fields[1])
+		count, err2 := strconv.ParseInt(fields[2], 10, 64)
+		if i < 0 || err1 != nil || err2 != nil {
+			return fmt.Errorf("line %d: invalid block %q", n, line)
+		}
+
+		file := fields[0][:i]
+		p.add(path.Dir(file), file, fields[0][i+1:], statements, count > 0)
+	}
+	return scanner.Err()
+}
+
+// coverageTotals is how much of something is covered
+type coverageTotals struct {
+	Covered int `json:"covered"`
+	Total   int `json:"total"`
+}
+
+func (t coverageTotals) percent() float64 {
+	if t.Total == 0 {
+		return 0
+	}
+	return 100 * float64(t.Covered) / float64(t.Total)
+}
+
+func (t coverageTotals) String() string {
+	return fmt.Sprintf("%.2f%% (%d/%d)", t.percent(), t.Covered, t.Total)
+}
+
+// coverageSummary is the coverage of a build, as it's saved for its branch
+type coverageSummary struct {
+	Unit        string                    `json:"unit"`
+	Totals      coverageTotals            `json:"totals"`
+	Packages    map[string]coverageTotals `json:"packages"`
+	Branch      string                    `json:"branch,omitempty"`
+	Commit      string                    `json:"commit,omitempty"`
+	BuildNumber string                    `json:"build_number,omitempty"`
+}
+
+func (p *coverageProfile) summarize() coverageSummary {
+	s := coverageSummary{
+		Unit:     p.Unit,
+		Packages: make(map[string]coverageTotals),
+	}
+	for file, blocks := range p.Files {
+		pkg := s.Packages[p.Packages[file]]
+		for _, b := range blocks {
+			pkg.Total += b.Weight
+			if b.Covered {
+				pkg.Covered += b.Weight
+			}
+		}
+		s.Packages[p.Packages[file]] = pkg
+	}
+
+	for _, pkg := range s.Packages {
+		s.Totals.Covered += pkg.Covered
+		s.Totals.Total += pkg.Total
+	}
+	return s
+}
+
+// coverageDelta is the change in coverage since the baseline, in percentage
+// points
+func coverageDelta(t coverageTotals, baseline coverageTotals) string {
+	delta := t.percent() - baseline.percent()
+	switch {
+	case delta >= 0.005:
+		return fmt.Sprintf("+%.2f%%", delta)
+	case delta <= -0.005:
+		return fmt.Sprintf("%.2f%%", delta)
+	default:
+		return "±0.00%"
+	}
+}
+
+// style is the annotation style, which warns about coverage going down
+func (s coverageSummary) style(baseline *coverageSummary) string {
+	switch {
+	case baseline == nil:
+		return "info"
+	case s.Totals.percent()-baseline.Totals.percent() <= -0.005:
+		return "warning"
+	default:
+		return "success"
+	}
+}
+
+func (s coverageSummary) markdown(coverageContext string, baseline *coverageSummary) string {
+	var b strings.Builder
+	if coverageContext == "default" {
+		b.WriteString("### Coverage\n\n")
+	} else {
+		fmt.Fprintf(&b, "### Coverage: %s\n\n", coverageContext)
+	}
+
+	fmt.Fprintf(&b, "**%.2f%%** of %s covered (%d/%d)", s.Totals.percent(), s.Unit, s.Totals.Covered, s.Totals.Total)
+	if baseline != nil {
+		fmt.Fprintf(&b, ", **%s** from `%s` (%.2f%%)", coverageDelta(s.Totals, baseline.Totals), baseline.Branch, baseline.Totals.percent())
+	}
+	b.WriteString("\n\n")
+
+	names := make([]string, 0, len(s.Packages))
+	for name := range s.Packages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if baseline != nil {
+		b.WriteString("| Package | Coverage | Change |\n| --- | --- | --- |\n")
+	} else {
+		b.WriteString("| Package | Coverage |\n| --- | --- |\n")
+	}
+	for i, name := range names {
+		if i == maxAnnotatedCoveragePackages {
+			fmt.Fprintf(&b, "| …and %d more | |\n", len(names)-i)
+			break
+		}
+		pkg := s.Packages[name]
+		if baseline == nil {
+			fmt.Fprintf(&b, "| `%s` | %s |\n", name, pkg)
+			continue
+		}
+		change := "new"
+		if before, ok := baseline.Packages[name]; ok {
+			change = coverageDelta(pkg, before)
+		}
+		fmt.Fprintf(&b, "| `%s` | %s | %s |\n", name, pkg, change)
+	}
+	return b.String()
+}
+
+// coverageBaselineName is where a branch's coverage is saved in the
+// baseline path, like my-pipeline/default/main.json
+func coverageBaselineName(pipeline, coverageContext, branch string) string {
+	// Keep branches like feature/foo from being nested
+	return pipeline + "/" + coverageContext + "/" + strings.ReplaceAll(branch, "/", "-") + ".json"
+}
+
+// loadCoverageBaseline returns the coverage saved in the baseline path, or
+// nil if there isn't any
+func loadCoverageBaseline(ctx context.Context, l logger.Logger, baselinePath, name string) (*coverageSummary, error) {
+	var data []byte
+	if strings.HasPrefix(baselinePath, "s3://") {
+		bucket, prefix := agent.ParseS3Destination(baselinePath)
+		client, err := agent.NewS3Client(l, bucket)
+		if err != nil {
+			return nil, err
+		}
+		out, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(path.Join(prefix, name)),
+		})
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer out.Body.Close()
+		if data, err = io.ReadAll(out.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		data, err = os.ReadFile(filepath.Join(baselinePath, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var baseline coverageSummary
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return nil, err
+	}
+	return &baseline, nil
+}
+
+// saveCoverageBaseline saves the coverage to the baseline path
+func saveCoverageBaseline(l logger.Logger, baselinePath, name string, s coverageSummary) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	files := map[string][]byte{name: append(data, '\n')}
+
+	if !strings.HasPrefix(baselinePath, "s3://") {
+		return writeFiles(baselinePath, files)
+	}
+
+	uploader, err := agent.NewS3Uploader(l, agent.S3UploaderConfig{Destination: baselinePath})
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "buildkite-coverage")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := writeFiles(dir, files); err != nil {
+		return err
+	}
+	return uploader.Upload(&api.Artifact{
+		Path:         name,
+		AbsolutePath: filepath.Join(dir, filepath.FromSlash(name)),
+		ContentType:  "application/json",
+	})
+}
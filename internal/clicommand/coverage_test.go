@@ -0,0 +1,196 @@
+package clicommand
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const lcovTracefile = `TN:
+SF:src/app/main.js
+DA:1,1
+DA:2,0
+DA:3,4
+end_of_record
+SF:src/lib/util.js
+DA:1,0
+end_of_record
+`
+
+const coberturaXML = `<?xml version="1.0" ?>
+<!DOCTYPE coverage SYSTEM "http://cobertura.sourceforge.net/xml/coverage-04.dtd">
+<coverage line-rate="0.5" version="5.5">
+  <packages>
+    <package name="app">
+      <classes>
+        <class name="main.py" filename="app/main.py">
+          <lines>
+            <line number="1" hits="1"/>
+            <line number="2" hits="0"/>
+          </lines>
+        </class>
+      </classes>
+    </package>
+  </packages>
+</coverage>
+`
+
+const goCoverProfile = `mode: set
+github.com/org/repo/pkg/a.go:10.2,12.16 2 1
+github.com/org/repo/pkg/a.go:14.2,16.3 3 0
+github.com/org/repo/cmd/main.go:5.13,7.2 1 1
+`
+
+func TestDetectCoverageFormat(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "lcov", detectCoverageFormat([]byte(lcovTracefile)))
+	assert.Equal(t, "cobertura", detectCoverageFormat([]byte(coberturaXML)))
+	assert.Equal(t, "go", detectCoverageFormat([]byte(goCoverProfile)))
+	assert.Equal(t, "", detectCoverageFormat([]byte("llamas")))
+}
+
+func TestParseCoverageReports(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name, report string
+		unit         string
+		totals       coverageTotals
+		packages     map[string]coverageTotals
+	}{
+		{
+			name:   "lcov",
+			report: lcovTracefile,
+			unit:   "lines",
+			totals: coverageTotals{Covered: 2, Total: 4},
+			packages: map[string]coverageTotals{
+				"src/app": {Covered: 2, Total: 3},
+				"src/lib": {Covered: 0, Total: 1},
+			},
+		},
+		{
+			name:     "cobertura",
+			report:   coberturaXML,
+			unit:     "lines",
+			totals:   coverageTotals{Covered: 1, Total: 2},
+			packages: map[string]coverageTotals{"app": {Covered: 1, Total: 2}},
+		},
+		{
+			name:   "go",
+			report: goCoverProfile,
+			unit:   "statements",
+			totals: coverageTotals{Covered: 3, Total: 6},
+			packages: map[string]coverageTotals{
+				"github.com/org/repo/pkg": {Covered: 2, Total: 5},
+				"github.com/org/repo/cmd": {Covered: 1, Total: 1},
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := newCoverageProfile()
+			require.NoError(t, p.parse([]byte(tc.report), ""))
+			s := p.summarize()
+			assert.Equal(t, tc.unit, s.Unit)
+			assert.Equal(t, tc.totals, s.Totals)
+			assert.Equal(t, tc.packages, s.Packages)
+		})
+	}
+}
+
+func TestParseCoverageReportErrors(t *testing.T) {
+	t.Parallel()
+
+	p := newCoverageProfile()
+	assert.Error(t, p.parse([]byte("llamas"), ""))
+	assert.Error(t, p.parse([]byte(lcovTracefile), "clover"))
+	assert.Error(t, p.parse([]byte("mode: set\nllamas.go:1.1 1\n"), "go"))
+
+	// Lines and statements can't be added up
+	require.NoError(t, p.parse([]byte(lcovTracefile), "lcov"))
+	assert.Error(t, p.parse([]byte(goCoverProfile), "go"))
+}
+
+func TestCoverageReportsAreMerged(t *testing.T) {
+	t.Parallel()
+
+	// Lines covered by either report are covered
+	p := newCoverageProfile()
+	require.NoError(t, p.parse([]byte(lcovTracefile), ""))
+	require.NoError(t, p.parse([]byte("SF:src/app/main.js\nDA:2,1\nend_of_record\nSF:src/lib/util.js\nDA:2,0\nend_of_record\n"), ""))
+
+	s := p.summarize()
+	assert.Equal(t, coverageTotals{Covered: 3, Total: 5}, s.Totals)
+	assert.Equal(t, coverageTotals{Covered: 3, Total: 3}, s.Packages["src/app"])
+}
+
+func TestCoverageMarkdown(t *testing.T) {
+	t.Parallel()
+
+	s := coverageSummary{
+		Unit:   "lines",
+		Totals: coverageTotals{Covered: 3, Total: 4},
+		Packages: map[string]coverageTotals{
+			"app": {Covered: 2, Total: 2},
+			"lib": {Covered: 1, Total: 2},
+		},
+	}
+
+	assert.Equal(t, "### Coverage\n\n"+
+		"**75.00%** of lines covered (3/4)\n\n"+
+		"| Package | Coverage |\n| --- | --- |\n"+
+		"| `app` | 100.00% (2/2) |\n"+
+		"| `lib` | 50.00% (1/2) |\n",
+		s.markdown("default", nil))
+	assert.Equal(t, "info", s.style(nil))
+
+	baseline := &coverageSummary{
+		Branch:   "main",
+		Totals:   coverageTotals{Covered: 4, Total: 5},
+		Packages: map[string]coverageTotals{"app": {Covered: 4, Total: 5}},
+	}
+	assert.Equal(t, "### Coverage: backend\n\n"+
+		"**75.00%** of lines covered (3/4), **-5.00%** from `main` (80.00%)\n\n"+
+		"| Package | Coverage | Change |\n| --- | --- | --- |\n"+
+		"| `app` | 100.00% (2/2) | +20.00% |\n"+
+		"| `lib` | 50.00% (1/2) | new |\n",
+		s.markdown("backend", baseline))
+	assert.Equal(t, "warning", s.style(baseline))
+
+	baseline.Totals = coverageTotals{Covered: 3, Total: 4}
+	assert.Contains(t, s.markdown("default", baseline), "**±0.00%** from `main`")
+	assert.Equal(t, "success", s.style(baseline))
+}
+
+func TestCoverageBaselineRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	name := coverageBaselineName("my-pipeline", "default", "feature/llamas")
+	assert.Equal(t, "my-pipeline/default/feature-llamas.json", name)
+
+	got, err := loadCoverageBaseline(ctx, logger.Discard, dir, name)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	s := coverageSummary{
+		Unit:        "statements",
+		Totals:      coverageTotals{Covered: 1, Total: 2},
+		Packages:    map[string]coverageTotals{"pkg": {Covered: 1, Total: 2}},
+		Branch:      "feature/llamas",
+		Commit:      "abc123",
+		BuildNumber: "42",
+	}
+	require.NoError(t, saveCoverageBaseline(logger.Discard, dir, name, s))
+
+	got, err = loadCoverageBaseline(ctx, logger.Discard, dir, name)
+	require.NoError(t, err)
+	assert.Equal(t, &s, got)
+}
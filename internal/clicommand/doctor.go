@@ -0,0 +1,127 @@
+package clicommand
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/urfave/cli"
+)
+
+const doctorHelpDescription = `Usage:
+
+   buildkite-agent doctor [options...]
+
+Description:
+
+   Checks the host for what the agent's jobs need, and reports what's
+   missing and how to fix it. It runs the same checks the agent does when
+   it starts, so a host can be checked before an agent is started on it.
+
+   On hosts with SELinux, it checks whether the build directory can be
+   given the label set with --build-dir-selinux-label. With --rootless, it
+   checks that jobs can be run rootless.
+
+   It exits with a status of 1 if anything jobs need is missing.
+
+Example:
+
+   $ buildkite-agent doctor --build-path /var/lib/buildkite-agent/builds`
+
+type DoctorConfig struct {
+	Config               string `cli:"config"`
+	BuildPath            string `cli:"build-path" normalize:"filepath"`
+	BuildDirSELinuxLabel string `cli:"build-dir-selinux-label"`
+	Rootless             bool   `cli:"rootless"`
+}
+
+var DoctorCommand = cli.Command{
+	Name:        "doctor",
+	Usage:       "Check the host for what jobs need",
+	Description: doctorHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "Path to the agent's configuration file, to read what to check from",
+			EnvVar: "BUILDKITE_AGENT_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "build-path",
+			Value:  "",
+			Usage:  "Path to where the builds will run from",
+			EnvVar: "BUILDKITE_BUILD_PATH",
+		},
+		cli.StringFlag{
+			Name:   "build-dir-selinux-label",
+			Value:  "",
+			Usage:  "The SELinux label the agent gives checkouts",
+			EnvVar: "BUILDKITE_BUILD_DIR_SELINUX_LABEL",
+		},
+		cli.BoolFlag{
+			Name:   "rootless",
+			Usage:  "Check that jobs can be run rootless",
+			EnvVar: "BUILDKITE_ROOTLESS",
+		},
+	},
+	Action: func(c *cli.Context) {
+		cfg := DoctorConfig{}
+
+		loader := cliconfig.Loader{
+			CLI:                    c,
+			Config:                 &cfg,
+			DefaultConfigFilePaths: DefaultConfigFilePaths(),
+		}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err)
+			os.Exit(1)
+		}
+		for _, warning := range warnings {
+			fmt.Fprintf(os.Stderr, "%s\n", warning)
+		}
+
+		buildPath := cfg.BuildPath
+		if buildPath == "" {
+			buildPath = os.TempDir()
+		}
+
+		checks := agent.CheckSELinux(buildPath, cfg.BuildDirSELinuxLabel)
+		if cfg.Rootless {
+			checks = append(checks, agent.CheckRootless()...)
+		}
+
+		ok, err := writeHostChecks(c.App.Writer, checks)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+	},
+}
+
+// writeHostChecks writes a table of the results of checking the host,
+// returning false if anything jobs need is missing
+func writeHostChecks(w io.Writer, checks []agent.HostCheck) (bool, error) {
+	ok := true
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tDETAIL")
+	for _, check := range checks {
+		result := "ok"
+		switch {
+		case check.OK:
+		case check.Required:
+			ok = false
+			result = "missing"
+		default:
+			result = "warning"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", check.Name, result, check.Detail)
+	}
+	return ok, tw.Flush()
+}
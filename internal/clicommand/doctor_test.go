@@ -0,0 +1,31 @@
+package clicommand
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteHostChecks(t *testing.T) {
+	var buf bytes.Buffer
+	ok, err := writeHostChecks(&buf, []agent.HostCheck{
+		{Name: "SELinux", OK: true, Detail: "enforcing"},
+		{Name: "cgroup v2", Detail: "the host is using cgroup v1"},
+	})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "CHECK      RESULT   DETAIL\n"+
+		"SELinux    ok       enforcing\n"+
+		"cgroup v2  warning  the host is using cgroup v1\n", buf.String())
+
+	buf.Reset()
+	ok, err = writeHostChecks(&buf, []agent.HostCheck{
+		{Name: "newuidmap and newgidmap", Required: true, Detail: "newuidmap isn't installed"},
+	})
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Contains(t, buf.String(), "missing")
+}
@@ -17,6 +17,10 @@ Description:
    parsable by other programs. Used when executing hooks to discover changes
    that hooks make to the environment.
 
+   The null-delimited format prints each variable as KEY=VALUE followed by a
+   null byte, like 'env -0', which keeps values exactly as they are, even if
+   they aren't valid UTF-8.
+
 Example:
 
     $ buildkite-agent env dump --format json-pretty`
@@ -31,13 +35,22 @@ var EnvDumpCommand = cli.Command{
 	Flags: []cli.Flag{
 		cli.StringFlag{
 			Name:   "format",
-			Usage:  "Output format; json or json-pretty",
+			Usage:  "Output format; json, json-pretty or null-delimited",
 			EnvVar: "BUILDKITE_AGENT_ENV_DUMP_FORMAT",
 			Value:  "json",
 		},
 	},
 	Action: func(c *cli.Context) error {
 		envn := os.Environ()
+
+		if c.String("format") == "null-delimited" {
+			if _, err := c.App.Writer.Write(env.FromSlice(envn).ToNullDelimited()); err != nil {
+				fmt.Fprintf(c.App.ErrWriter, "Error writing environment: %v\n", err)
+				os.Exit(1)
+			}
+			return nil
+		}
+
 		envMap := make(map[string]string, len(envn))
 
 		for _, e := range envn {
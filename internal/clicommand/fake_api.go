@@ -0,0 +1,252 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/buildkite/agent/v3/internal/fakeapi"
+	"github.com/urfave/cli"
+)
+
+const fakeAPIHelpDescription = `Usage:
+
+   buildkite-agent fake-api [options...]
+
+Description:
+
+   Runs a fake of the Buildkite Agent API, which agents can be started
+   against to test hooks, plugins and changes to the agent's configuration
+   without a Buildkite organization.
+
+   Each --command is given as a job to the first agent that's free, checking
+   out --repository at --commit. Any --env is set on every job. Once all of the
+   jobs have finished, it prints their logs along with the meta-data,
+   annotations and artifacts they made, and exits with a status of 1 if any of
+   them failed. Without any commands, it runs until it's interrupted.
+
+   IDs and tokens are generated from --seed, so running the same jobs with
+   the same seed gives them the same IDs each time.
+
+Example:
+
+   $ buildkite-agent fake-api --command "make test" --env "LLAMAS=true"
+
+   And in another terminal:
+
+   $ buildkite-agent start --endpoint http://127.0.0.1:3330 --token fake --disconnect-after-job`
+
+type FakeAPIConfig struct {
+	Listen     string   `cli:"listen"`
+	Token      string   `cli:"token"`
+	Seed       int      `cli:"seed"`
+	Commands   []string `cli:"command" normalize:"list"`
+	Env        []string `cli:"env" normalize:"list"`
+	Repository string   `cli:"repository" normalize:"filepath"`
+	Commit     string   `cli:"commit"`
+	Branch     string   `cli:"branch"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var FakeAPICommand = cli.Command{
+	Name:        "fake-api",
+	Usage:       "Run a fake of the Agent API to test hooks and plugins against",
+	Description: fakeAPIHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "listen",
+			Value:  "127.0.0.1:3330",
+			Usage:  "The address to serve the fake API on",
+			EnvVar: "BUILDKITE_FAKE_API_LISTEN",
+		},
+		cli.StringFlag{
+			Name:   "token",
+			Value:  "fake",
+			Usage:  "The token agents have to register with, or empty to accept any",
+			EnvVar: "BUILDKITE_FAKE_API_TOKEN",
+		},
+		cli.IntFlag{
+			Name:   "seed",
+			Value:  0,
+			Usage:  "What the IDs and tokens the fake API hands out are generated from",
+			EnvVar: "BUILDKITE_FAKE_API_SEED",
+		},
+		cli.StringSliceFlag{
+			Name:   "command",
+			Value:  &cli.StringSlice{},
+			Usage:  "A command to run as a job, which can be given more than once to run more than one job",
+			EnvVar: "BUILDKITE_FAKE_API_COMMAND",
+		},
+		cli.StringSliceFlag{
+			Name:   "env",
+			Value:  &cli.StringSlice{},
+			Usage:  "An environment variable to set on each job, like KEY=VALUE",
+			EnvVar: "BUILDKITE_FAKE_API_ENV",
+		},
+		cli.StringFlag{
+			Name:   "repository",
+			Value:  "",
+			Usage:  "The git repository the jobs check out, which defaults to the current directory",
+			EnvVar: "BUILDKITE_FAKE_API_REPOSITORY",
+		},
+		cli.StringFlag{
+			Name:   "commit",
+			Value:  "HEAD",
+			Usage:  "The commit the jobs check out",
+			EnvVar: "BUILDKITE_FAKE_API_COMMIT",
+		},
+		cli.StringFlag{
+			Name:   "branch",
+			Value:  "",
+			Usage:  "The branch the jobs are for, which defaults to the repository's current branch",
+			EnvVar: "BUILDKITE_FAKE_API_BRANCH",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := FakeAPIConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		env := map[string]string{}
+		for _, kv := range cfg.Env {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				l.Fatal("--env %q should be like KEY=VALUE", kv)
+			}
+			env[k] = v
+		}
+
+		if cfg.Repository == "" {
+			wd, err := os.Getwd()
+			if err != nil {
+				l.Fatal("Couldn't find the current directory: %v", err)
+			}
+			cfg.Repository = wd
+		}
+
+		if cfg.Branch == "" {
+			cfg.Branch = "main"
+			out, err := exec.Command("git", "-C", cfg.Repository, "rev-parse", "--abbrev-ref", "HEAD").Output()
+			if branch := strings.TrimSpace(string(out)); err == nil && branch != "HEAD" {
+				cfg.Branch = branch
+			}
+		}
+
+		server := fakeapi.NewServer(l, fakeapi.Config{Token: cfg.Token, Seed: int64(cfg.Seed)})
+
+		var jobIDs []string
+		for _, command := range cfg.Commands {
+			jobEnv := map[string]string{
+				"BUILDKITE_REPO":    cfg.Repository,
+				"BUILDKITE_COMMIT":  cfg.Commit,
+				"BUILDKITE_BRANCH":  cfg.Branch,
+				"BUILDKITE_COMMAND": command,
+			}
+			for k, v := range env {
+				jobEnv[k] = v
+			}
+			jobIDs = append(jobIDs, server.AddJob(jobEnv))
+		}
+
+		listener, err := net.Listen("tcp", cfg.Listen)
+		if err != nil {
+			l.Fatal("Couldn't listen on %s: %v", cfg.Listen, err)
+		}
+		httpServer := &http.Server{Handler: server}
+		go func() { _ = httpServer.Serve(listener) }()
+		defer httpServer.Close()
+
+		endpoint := "http://" + listener.Addr().String()
+		l.Info("Serving a fake Agent API on %s with %d jobs", endpoint, len(jobIDs))
+		l.Info("Start an agent against it with: buildkite-agent start --endpoint %s --token %s --disconnect-after-job", endpoint, cfg.Token)
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		if len(jobIDs) == 0 {
+			<-ctx.Done()
+			return
+		}
+
+		failed := false
+		for _, id := range jobIDs {
+			job, err := server.WaitForJob(ctx, id)
+			if err != nil {
+				l.Fatal("Stopped waiting for job %s: %v", id, err)
+			}
+
+			fmt.Fprintf(c.App.Writer, "--- Job %s (%s) %s with exit status %s on %s\n", job.ID, job.Env["BUILDKITE_COMMAND"], job.State, job.ExitStatus, job.AgentName)
+			fmt.Fprint(c.App.Writer, job.Log)
+			if job.State != fakeapi.JobStateFinished || job.ExitStatus != "0" {
+				failed = true
+			}
+		}
+
+		if data := server.MetaData(server.BuildID()); len(data) > 0 {
+			fmt.Fprintln(c.App.Writer, "--- Meta-data")
+			for _, d := range data {
+				fmt.Fprintf(c.App.Writer, "%s=%s\n", d.Key, d.Value)
+			}
+		}
+
+		if annotations := server.Annotations(server.BuildID()); len(annotations) > 0 {
+			fmt.Fprintln(c.App.Writer, "--- Annotations")
+			for _, a := range annotations {
+				fmt.Fprintf(c.App.Writer, "%s (%s): %s\n", a.Context, a.Style, a.Body)
+			}
+		}
+
+		if artifacts := server.Artifacts(); len(artifacts) > 0 {
+			fmt.Fprintln(c.App.Writer, "--- Artifacts")
+			for _, a := range artifacts {
+				fmt.Fprintf(c.App.Writer, "%s (%s, %d bytes)\n", a.Path, a.State, len(a.Contents))
+			}
+		}
+
+		for _, request := range server.Unhandled() {
+			l.Warn("The fake API didn't handle %s", request)
+		}
+
+		if failed {
+			done()
+			os.Exit(1)
+		}
+	},
+}
@@ -3,12 +3,17 @@ package clicommand
 import (
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/buildkite/agent/v3/api"
-	"github.com/buildkite/agent/v3/experiments"
+	"github.com/buildkite/agent/v3/internal/experiments"
+	"github.com/buildkite/agent/v3/internal/jobapi"
+	"github.com/buildkite/agent/v3/internal/resolver"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/version"
 	"github.com/oleiade/reflections"
@@ -71,6 +76,27 @@ var DebugHTTPFlag = cli.BoolFlag{
 	EnvVar: "BUILDKITE_AGENT_DEBUG_HTTP",
 }
 
+var DNSOverridesFlag = cli.StringSliceFlag{
+	Name:   "dns-override",
+	Value:  &cli.StringSlice{},
+	Usage:  "Resolve a hostname to a fixed IP address when talking to the Agent API and artifact storage, given as hostname=ip",
+	EnvVar: "BUILDKITE_AGENT_DNS_OVERRIDES",
+}
+
+var DNSResolverFlag = cli.StringFlag{
+	Name:   "dns-resolver",
+	Value:  "",
+	Usage:  "Resolve hostnames for the Agent API and artifact storage using these nameservers (comma separated, e.g. 10.0.0.2,10.0.0.3:5353) or this DNS over HTTPS URL, instead of the system resolver",
+	EnvVar: "BUILDKITE_AGENT_DNS_RESOLVER",
+}
+
+var JobAPISocketFlag = cli.StringFlag{
+	Name:   "job-api-socket",
+	Value:  "",
+	Usage:  "Path to the socket of the agent running the job. When set, calls are made through the agent rather than sent straight to the Agent API",
+	EnvVar: "BUILDKITE_AGENT_JOB_API_SOCKET",
+}
+
 var NoColorFlag = cli.BoolFlag{
 	Name:   "no-color",
 	Usage:  "Don't show colors in logging",
@@ -171,10 +197,62 @@ func HandleGlobalFlags(l logger.Logger, cfg any) func() {
 		}
 	}
 
+	// Resolve hostnames differently for artifact storage. The API client is
+	// handled in loadAPIClientConfig.
+	dnsConf, err := loadDNSConfig(cfg)
+	if err != nil {
+		l.Fatal("%v", err)
+	}
+	if !dnsConf.IsZero() {
+		resolver.Install(dnsConf)
+	}
+
 	// Handle profiling flag
 	return HandleProfileFlag(l, cfg)
 }
 
+// loadDNSConfig returns how hostnames should be resolved, from the DNSOverrides
+// and DNSResolver config fields
+func loadDNSConfig(cfg any) (resolver.Config, error) {
+	var conf resolver.Config
+
+	if overrides, err := reflections.GetField(cfg, "DNSOverrides"); err == nil {
+		if entries, ok := overrides.([]string); ok {
+			hosts, err := resolver.ParseHosts(entries)
+			if err != nil {
+				return conf, err
+			}
+			conf.Hosts = hosts
+		}
+	}
+
+	if dnsResolver, err := reflections.GetField(cfg, "DNSResolver"); err == nil {
+		if s, ok := dnsResolver.(string); ok {
+			nameservers, dohURL, err := resolver.ParseResolver(s)
+			if err != nil {
+				return conf, err
+			}
+			conf.Nameservers = nameservers
+			conf.DoHURL = dohURL
+		}
+	}
+
+	return conf, nil
+}
+
+// parseFileMode parses permissions or a umask in octal, like 0750, or
+// returns 0 if it's empty
+func parseFileMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("expected permissions in octal, like 0750")
+	}
+	return os.FileMode(mode), nil
+}
+
 func handleLogLevelFlag(l logger.Logger, cfg any) error {
 	logLevel, err := reflections.GetField(cfg, "LogLevel")
 	if err != nil {
@@ -240,5 +318,22 @@ func loadAPIClientConfig(cfg any, tokenField string) api.Config {
 		conf.DisableHTTP2 = noHTTP2.(bool)
 	}
 
+	// Inside a job without an access token, the agent running the job makes
+	// calls for us
+	socket, err := reflections.GetField(cfg, "JobAPISocket")
+	if socket != "" && err == nil && conf.Token == "" {
+		conf.Endpoint = jobapi.AgentAPIEndpoint
+		conf.HTTPClient = jobapi.NewHTTPClient(socket.(string))
+		return conf
+	}
+
+	// This has already been validated in HandleGlobalFlags
+	if dnsConf, err := loadDNSConfig(cfg); err == nil && !dnsConf.IsZero() {
+		conf.DialContext = dnsConf.DialContext(&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		})
+	}
+
 	return conf
 }
@@ -0,0 +1,96 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/urfave/cli"
+)
+
+const groupCloseHelpDescription = `Usage:
+
+   buildkite-agent group close [name] [options...]
+
+Description:
+
+   Closes a group in the job's log opened with "buildkite-agent group open".
+   Without a name, the most recently opened group is closed. With one, that
+   group is closed, along with any groups still open inside it.
+
+   If the group is inside another, that group is shown again for the output
+   that follows.
+
+Example:
+
+   $ buildkite-agent group close
+   $ buildkite-agent group close "Tests"`
+
+type GroupCloseConfig struct {
+	Name string `cli:"arg:0" label:"group name"`
+	Job  string `cli:"job"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var GroupCloseCommand = cli.Command{
+	Name:        "close",
+	Usage:       "Close a group in the job's log",
+	Description: groupCloseHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job's log the group is in",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := GroupCloseConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		groups, err := loadLogGroups(logGroupsPath(cfg.Job))
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		if err := groups.close(c.App.Writer, cfg.Name, time.Now()); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		if err := groups.save(); err != nil {
+			l.Fatal("Failed to save the open groups: %s", err)
+		}
+	},
+}
@@ -0,0 +1,117 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/urfave/cli"
+)
+
+const groupOpenHelpDescription = `Usage:
+
+   buildkite-agent group open <name> [options...]
+
+Description:
+
+   Opens a named group in the job's log, which the output that follows goes
+   into until it's closed with "buildkite-agent group close". Groups are
+   collapsed unless --expanded is given.
+
+   Groups can be opened inside other groups. As the job's log only has one
+   level of groups, a nested group is shown with the names of the groups
+   it's inside, e.g. "Tests › Unit", and once it's closed, the group it was
+   inside is shown again for the output that follows.
+
+   With --timing, how long the group was open for is shown when it's closed.
+
+Example:
+
+   $ buildkite-agent group open "Tests" --timing
+   $ buildkite-agent group open "Unit" --expanded
+   $ make test
+   $ buildkite-agent group close "Unit"
+   $ buildkite-agent group close`
+
+type GroupOpenConfig struct {
+	Name     string `cli:"arg:0" label:"group name" validate:"required"`
+	Expanded bool   `cli:"expanded"`
+	Timing   bool   `cli:"timing"`
+	Job      string `cli:"job"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var GroupOpenCommand = cli.Command{
+	Name:        "open",
+	Usage:       "Open a named group in the job's log",
+	Description: groupOpenHelpDescription,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "expanded",
+			Usage: "Show the group's output expanded, rather than collapsed",
+		},
+		cli.BoolFlag{
+			Name:   "timing",
+			Usage:  "Show how long the group was open for when it's closed",
+			EnvVar: "BUILDKITE_GROUP_TIMING",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job's log the group is in",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := GroupOpenConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		groups, err := loadLogGroups(logGroupsPath(cfg.Job))
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		groups.open(c.App.Writer, logGroup{
+			Name:     cfg.Name,
+			Expanded: cfg.Expanded,
+			Timing:   cfg.Timing,
+			OpenedAt: time.Now(),
+		})
+
+		if err := groups.save(); err != nil {
+			l.Fatal("Failed to save the open groups: %s", err)
+		}
+	},
+}
@@ -0,0 +1,254 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/buildkite/agent/v3/internal/bootstrap"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+const hookAuditHelpDescription = `Usage:
+
+   buildkite-agent hook audit [options...]
+
+Description:
+
+   Reports the hooks a job would run, in the order they'd run, with where
+   each comes from (global, local to the repository, or a plugin), its path,
+   and its SHA-256 checksum. Nothing is run or checked out.
+
+   The job's plugins are read from a step definition with --step, which can
+   be a file with a single step, or a pipeline with the step chosen by --key.
+   Otherwise they're read from BUILDKITE_PLUGINS, so it can be run from
+   within a job too.
+
+   Plugins are looked for where the agent would have checked them out, so
+   the hooks of plugins it hasn't run yet can't be known, and are noted
+   instead. Repository hooks are looked for in --checkout-path.
+
+Example:
+
+   $ buildkite-agent hook audit --step .buildkite/pipeline.yml --key tests --checkout-path .`
+
+type HookAuditConfig struct {
+	Config        string `cli:"config"`
+	Step          string `cli:"step" normalize:"filepath"`
+	Key           string `cli:"key"`
+	Plugins       string `cli:"plugins"`
+	HooksPath     string `cli:"hooks-path" normalize:"filepath"`
+	PluginsPath   string `cli:"plugins-path" normalize:"filepath"`
+	CheckoutPath  string `cli:"checkout-path" normalize:"filepath"`
+	PipelineSlug  string `cli:"pipeline-slug"`
+	HookChecksums string `cli:"hook-checksums" normalize:"filepath"`
+	NoLocalHooks  bool   `cli:"no-local-hooks"`
+	Format        string `cli:"format"`
+}
+
+var HookAuditCommand = cli.Command{
+	Name:        "audit",
+	Usage:       "Report the hooks a job would run, without running them",
+	Description: hookAuditHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "Path to the agent's configuration file, to read its hooks and plugins paths from",
+			EnvVar: "BUILDKITE_AGENT_CONFIG",
+		},
+		cli.StringFlag{
+			Name:  "step",
+			Value: "",
+			Usage: "Path to a YAML or JSON step definition, or pipeline with --key, to read the job's plugins from",
+		},
+		cli.StringFlag{
+			Name:  "key",
+			Value: "",
+			Usage: "The key or label of the step in the pipeline given with --step",
+		},
+		cli.StringFlag{
+			Name:   "plugins",
+			Value:  "",
+			Usage:  "The job's plugins as JSON, if --step isn't given",
+			EnvVar: "BUILDKITE_PLUGINS",
+		},
+		cli.StringFlag{
+			Name:   "hooks-path",
+			Value:  "",
+			Usage:  "Directory where the hook scripts are found",
+			EnvVar: "BUILDKITE_HOOKS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "plugins-path",
+			Value:  "",
+			Usage:  "Directory where the plugins are saved to",
+			EnvVar: "BUILDKITE_PLUGINS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "checkout-path",
+			Value:  ".",
+			Usage:  "Where the repository is checked out, to find its hooks",
+			EnvVar: "BUILDKITE_BUILD_CHECKOUT_PATH",
+		},
+		cli.StringFlag{
+			Name:   "pipeline-slug",
+			Value:  "",
+			Usage:  "The pipeline's slug, to check its repository hooks against --hook-checksums",
+			EnvVar: "BUILDKITE_PIPELINE_SLUG",
+		},
+		cli.StringFlag{
+			Name:   "hook-checksums",
+			Value:  "",
+			Usage:  "Path to a file of SHA-256 checksums that global and repository hooks must match",
+			EnvVar: "BUILDKITE_HOOK_CHECKSUMS_PATH",
+		},
+		cli.BoolFlag{
+			Name:   "no-local-hooks",
+			Usage:  "Report that local hooks are disabled, as they are for agents started with --no-local-hooks",
+			EnvVar: "BUILDKITE_NO_LOCAL_HOOKS",
+		},
+		cli.StringFlag{
+			Name:   "format",
+			Value:  "text",
+			Usage:  "Output format; text or json",
+			EnvVar: "BUILDKITE_HOOK_AUDIT_FORMAT",
+		},
+	},
+	Action: func(c *cli.Context) {
+		cfg := HookAuditConfig{}
+
+		loader := cliconfig.Loader{
+			CLI:                    c,
+			Config:                 &cfg,
+			DefaultConfigFilePaths: DefaultConfigFilePaths(),
+		}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err)
+			os.Exit(1)
+		}
+		for _, warning := range warnings {
+			fmt.Fprintf(os.Stderr, "%s\n", warning)
+		}
+
+		plugins := cfg.Plugins
+		if cfg.Step != "" {
+			if plugins, err = stepPlugins(cfg.Step, cfg.Key); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
+		}
+
+		hooks, err := bootstrap.PlanHooks(bootstrap.Config{
+			HooksPath:         cfg.HooksPath,
+			PluginsPath:       cfg.PluginsPath,
+			Plugins:           plugins,
+			PipelineSlug:      cfg.PipelineSlug,
+			HookChecksumsPath: cfg.HookChecksums,
+			LocalHooksEnabled: !cfg.NoLocalHooks,
+		}, cfg.CheckoutPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+
+		switch cfg.Format {
+		case "json":
+			enc := json.NewEncoder(c.App.Writer)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(hooks)
+		case "text":
+			err = writeHookAudit(c.App.Writer, hooks)
+		default:
+			err = fmt.Errorf("Unknown format %q, expected text or json", cfg.Format)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// stepPlugins reads the plugins of a step from a step definition, or a
+// pipeline's step with the key or label, and returns them as JSON in the
+// form of BUILDKITE_PLUGINS
+func stepPlugins(path, key string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	var step struct {
+		Key     string           `yaml:"key"`
+		Label   string           `yaml:"label"`
+		Plugins any              `yaml:"plugins"`
+		Steps   []map[string]any `yaml:"steps"`
+	}
+	if err := yaml.Unmarshal(data, &step); err != nil {
+		return "", fmt.Errorf("Failed to parse %s: %w", path, err)
+	}
+
+	plugins := step.Plugins
+	if len(step.Steps) > 0 {
+		if key == "" {
+			return "", fmt.Errorf("%s is a pipeline, choose a step with --key", path)
+		}
+		found := false
+		for _, s := range step.Steps {
+			if s["key"] == key || s["label"] == key {
+				plugins, found = s["plugins"], true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("There's no step with the key or label %q in %s", key, path)
+		}
+	}
+
+	switch p := plugins.(type) {
+	case nil:
+		return "", nil
+	case map[string]any:
+		// Plugins can also be given as a map, which is run in the order of
+		// its keys here as the map's order isn't kept
+		names := make([]string, 0, len(p))
+		for name := range p {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		list := make([]any, 0, len(p))
+		for _, name := range names {
+			list = append(list, map[string]any{name: p[name]})
+		}
+		plugins = list
+	}
+
+	j, err := json.Marshal(plugins)
+	if err != nil {
+		return "", err
+	}
+	return string(j), nil
+}
+
+func writeHookAudit(w io.Writer, hooks []bootstrap.PlannedHook) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tHOOK\tSOURCE\tPATH\tSHA256\tNOTE")
+	for i, h := range hooks {
+		source := h.Scope
+		if h.Plugin != "" {
+			source += " " + h.Plugin
+		}
+		sum := h.SHA256
+		if len(sum) > 12 {
+			sum = sum[:12]
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", i+1, h.Name, source, h.Path, sum, h.Note)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,52 @@
+package clicommand
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStepPlugins(t *testing.T) {
+	dir := t.TempDir()
+
+	step := filepath.Join(dir, "step.yml")
+	require.NoError(t, os.WriteFile(step, []byte(`
+label: tests
+plugins:
+  - docker#v5.0.0:
+      image: alpine
+  - ./my-plugin
+`), 0644))
+
+	plugins, err := stepPlugins(step, "")
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"docker#v5.0.0":{"image":"alpine"}},"./my-plugin"]`, plugins)
+
+	pipeline := filepath.Join(dir, "pipeline.yml")
+	require.NoError(t, os.WriteFile(pipeline, []byte(`
+steps:
+  - label: lint
+    command: make lint
+  - key: tests
+    plugins:
+      docker#v5.0.0: {image: alpine}
+      cache#v1.0.0: ~
+`), 0644))
+
+	plugins, err = stepPlugins(pipeline, "tests")
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"cache#v1.0.0":null},{"docker#v5.0.0":{"image":"alpine"}}]`, plugins)
+
+	plugins, err = stepPlugins(pipeline, "lint")
+	require.NoError(t, err)
+	assert.Equal(t, "", plugins)
+
+	_, err = stepPlugins(pipeline, "")
+	assert.ErrorContains(t, err, "choose a step with --key")
+
+	_, err = stepPlugins(pipeline, "deploy")
+	assert.ErrorContains(t, err, `no step with the key or label "deploy"`)
+}
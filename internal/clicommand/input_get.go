@@ -0,0 +1,257 @@
+package clicommand
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/buildkite/agent/v3/internal/jobapi"
+	"github.com/buildkite/roko"
+	"github.com/urfave/cli"
+)
+
+const inputGetHelpDescription = `Usage:
+
+   buildkite-agent input get <key> [options...]
+
+Description:
+
+   Get the value of a field of a block or input step in the build, as JSON.
+
+   The values of fields are stored as the build's meta-data, with the key of
+   the field. Fields that let several options be selected have each value on
+   a line of its own, which --type list turns into an array.
+
+   The value is converted to JSON of the --type given: string, number,
+   boolean, list, or json for a value that's already JSON. If the field
+   hasn't been filled in, the --default is used instead, converted the same
+   way.
+
+Example:
+
+   $ buildkite-agent input get "release-name"
+   "Spring Release"
+   $ buildkite-agent input get "replicas" --type number --default 3
+   3
+   $ buildkite-agent input get "regions" --type list | jq -r '.[]'`
+
+// The types a field's value can be converted to
+const (
+	inputTypeString  = "string"
+	inputTypeNumber  = "number"
+	inputTypeBoolean = "boolean"
+	inputTypeList    = "list"
+	inputTypeJSON    = "json"
+)
+
+type InputGetConfig struct {
+	Key     string `cli:"arg:0" label:"field key" validate:"required"`
+	Type    string `cli:"type"`
+	Default string `cli:"default"`
+	Job     string `cli:"job" validate:"required"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+
+	// API config
+	DebugHTTP        bool     `cli:"debug-http"`
+	DNSOverrides     []string `cli:"dns-override" normalize:"list"`
+	DNSResolver      string   `cli:"dns-resolver"`
+	AgentAccessToken string   `cli:"agent-access-token" validate:"required-without:JobAPISocket"`
+	Endpoint         string   `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool     `cli:"no-http2"`
+	JobAPISocket     string   `cli:"job-api-socket"`
+}
+
+var InputGetCommand = cli.Command{
+	Name:        "get",
+	Usage:       "Get the value of a block or input step's field as JSON",
+	Description: inputGetHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "type",
+			Value: inputTypeString,
+			Usage: "The type to convert the value to: string, number, boolean, list or json",
+		},
+		cli.StringFlag{
+			Name:  "default",
+			Value: "",
+			Usage: "If the field hasn't been filled in, use this value instead",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job's build should the field be retrieved from",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+		DNSOverridesFlag,
+		DNSResolverFlag,
+		JobAPISocketFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		ctx := context.Background()
+
+		// The configuration will be loaded into this struct
+		cfg := InputGetConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		switch cfg.Type {
+		case inputTypeString, inputTypeNumber, inputTypeBoolean, inputTypeList, inputTypeJSON:
+		default:
+			l.Fatal("Unknown --type %q, expected string, number, boolean, list or json", cfg.Type)
+		}
+
+		// Make sure any meta-data queued up by this job has been set first
+		if cfg.JobAPISocket != "" {
+			if err := jobapi.NewClient(cfg.JobAPISocket).Flush(ctx); err != nil {
+				l.Warn("Failed to send queued job API calls: %v", err)
+			}
+		}
+
+		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
+
+		// Find the field's value in the build's meta-data
+		var metaData *api.MetaData
+		var resp *api.Response
+
+		err = roko.NewRetrier(
+			roko.WithMaxAttempts(10),
+			roko.WithStrategy(roko.Constant(5*time.Second)),
+		).DoWithContext(ctx, func(r *roko.Retrier) error {
+			metaData, resp, err = client.GetMetaData(ctx, cfg.Job, cfg.Key)
+			// Don't bother retrying if the response was one of these statuses
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+				r.Break()
+				return err
+			}
+			if err != nil {
+				l.Warn("%s (%s)", err, r)
+				return err
+			}
+			return nil
+		})
+
+		// Buildkite returns a 404 if the field hasn't been filled in. Like
+		// meta-data get, a blank default can be given with IsSet.
+		value := ""
+		switch {
+		case err == nil:
+			value = metaData.Value
+		case resp != nil && resp.StatusCode == 404:
+			if !c.IsSet("default") {
+				l.Fatal("The field `%s` hasn't been filled in, and there's no --default", cfg.Key)
+			}
+		default:
+			l.Fatal("Failed to get the field's value: %s", err)
+		}
+		if value == "" && c.IsSet("default") {
+			l.Info("The field `%s` hasn't been filled in, using the default %q", cfg.Key, cfg.Default)
+			value = cfg.Default
+		}
+
+		out, err := inputValueJSON(value, cfg.Type)
+		if err != nil {
+			l.Fatal("Failed to convert the field `%s` to a %s: %s", cfg.Key, cfg.Type, err)
+		}
+
+		// Output the value to STDOUT
+		fmt.Printf("%s\n", out)
+	},
+}
+
+// inputValueJSON converts the value of a field to JSON of the type given.
+// Multiple selections are stored one per line, so a list has a value per
+// line, ignoring blank lines.
+func inputValueJSON(value, inputType string) ([]byte, error) {
+	switch inputType {
+	case inputTypeString:
+		return json.Marshal(value)
+
+	case inputTypeNumber:
+		n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a number", value)
+		}
+		return json.Marshal(n)
+
+	case inputTypeBoolean:
+		b, err := parseInputBool(value)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(b)
+
+	case inputTypeList:
+		list := []string{}
+		for _, line := range strings.Split(strings.ReplaceAll(value, "\r\n", "\n"), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				list = append(list, line)
+			}
+		}
+		return json.Marshal(list)
+
+	case inputTypeJSON:
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, []byte(value)); err != nil {
+			return nil, fmt.Errorf("it isn't valid JSON: %v", err)
+		}
+		return buf.Bytes(), nil
+
+	default:
+		return nil, fmt.Errorf("Unknown --type %q, expected string, number, boolean, list or json", inputType)
+	}
+}
+
+// parseInputBool parses a boolean the ways it's likely to be written in a
+// field, or the values of a select field
+func parseInputBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "yes", "y", "on", "1":
+		return true, nil
+	case "false", "no", "n", "off", "0":
+		return false, nil
+	default:
+		return false, fmt.Errorf("%q isn't a boolean", value)
+	}
+}
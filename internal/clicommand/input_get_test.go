@@ -0,0 +1,43 @@
+package clicommand
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInputValueJSON(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		value, inputType, want string
+	}{
+		{value: "Spring Release", inputType: inputTypeString, want: `"Spring Release"`},
+		{value: "", inputType: inputTypeString, want: `""`},
+		{value: " 3\n", inputType: inputTypeNumber, want: `3`},
+		{value: "0.25", inputType: inputTypeNumber, want: `0.25`},
+		{value: "Yes", inputType: inputTypeBoolean, want: `true`},
+		{value: "false", inputType: inputTypeBoolean, want: `false`},
+		{value: "us-east-1\r\nap-southeast-2\n\n", inputType: inputTypeList, want: `["us-east-1","ap-southeast-2"]`},
+		{value: "", inputType: inputTypeList, want: `[]`},
+		{value: "{\n  \"replicas\": 3\n}", inputType: inputTypeJSON, want: `{"replicas":3}`},
+	} {
+		got, err := inputValueJSON(test.value, test.inputType)
+		if assert.NoError(t, err, "inputValueJSON(%q, %q)", test.value, test.inputType) {
+			assert.Equal(t, test.want, string(got), "inputValueJSON(%q, %q)", test.value, test.inputType)
+		}
+	}
+
+	for _, test := range []struct {
+		value, inputType string
+	}{
+		{value: "three", inputType: inputTypeNumber},
+		{value: "NaN", inputType: inputTypeNumber},
+		{value: "maybe", inputType: inputTypeBoolean},
+		{value: "{", inputType: inputTypeJSON},
+		{value: "1", inputType: "integer"},
+	} {
+		_, err := inputValueJSON(test.value, test.inputType)
+		assert.Error(t, err, "inputValueJSON(%q, %q)", test.value, test.inputType)
+	}
+}
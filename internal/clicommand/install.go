@@ -0,0 +1,442 @@
+package clicommand
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/urfave/cli"
+)
+
+const installHelpDescription = `Usage:
+
+   buildkite-agent install [options...]
+
+Description:
+
+   Sets up this host to run the agent: copies this binary into place,
+   creates the build, hooks and plugins directories, writes the config file
+   from the options given here, and writes a service definition that runs the
+   agent (a systemd unit on Linux, or a launchd plist on macOS).
+
+   It doesn't ask any questions, and can be run again with the same options
+   without changing anything, so it's suited to cloud-init user data and image
+   builds. Every option can also be given as an environment variable. Paths
+   that aren't given follow where the agent's packages install to.
+
+   Any other option of "buildkite-agent start" can be set in the config file
+   with --set, which can be given more than once.
+
+Example:
+
+   $ buildkite-agent install --token "xxx" --tags "queue=deploy" --set "spawn=2" --start`
+
+type InstallConfig struct {
+	Token       string   `cli:"token" validate:"required"`
+	Name        string   `cli:"name"`
+	Tags        []string `cli:"tags" normalize:"list"`
+	Set         []string `cli:"set"`
+	BinPath     string   `cli:"bin-path" normalize:"filepath"`
+	ConfigPath  string   `cli:"config-path" normalize:"filepath"`
+	BuildPath   string   `cli:"build-path" normalize:"filepath"`
+	HooksPath   string   `cli:"hooks-path" normalize:"filepath"`
+	PluginsPath string   `cli:"plugins-path" normalize:"filepath"`
+	ServicePath string   `cli:"service-path" normalize:"filepath"`
+	User        string   `cli:"user"`
+	NoService   bool     `cli:"no-service"`
+	Start       bool     `cli:"start"`
+}
+
+var InstallCommand = cli.Command{
+	Name:        "install",
+	Usage:       "Set up this host to run the agent as a service",
+	Description: installHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "token",
+			Value:  "",
+			Usage:  "The agent registration token",
+			EnvVar: "BUILDKITE_AGENT_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "name",
+			Value:  "%hostname-%spawn",
+			Usage:  "The name of the agent",
+			EnvVar: "BUILDKITE_AGENT_NAME",
+		},
+		cli.StringSliceFlag{
+			Name:   "tags",
+			Value:  &cli.StringSlice{},
+			Usage:  "A comma-separated list of tags for the agent",
+			EnvVar: "BUILDKITE_AGENT_TAGS",
+		},
+		cli.StringSliceFlag{
+			Name:   "set",
+			Value:  &cli.StringSlice{},
+			Usage:  "Set another start option in the config file, as name=value",
+			EnvVar: "BUILDKITE_AGENT_INSTALL_SET",
+		},
+		cli.StringFlag{
+			Name:   "bin-path",
+			Value:  "",
+			Usage:  "Where to copy this binary to (default is the platform's usual path)",
+			EnvVar: "BUILDKITE_AGENT_INSTALL_BIN_PATH",
+		},
+		cli.StringFlag{
+			Name:   "config-path",
+			Value:  "",
+			Usage:  "Where to write the config file (default is the platform's usual path)",
+			EnvVar: "BUILDKITE_AGENT_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "build-path",
+			Value:  "",
+			Usage:  "Path to where the builds will run from (default is the platform's usual path)",
+			EnvVar: "BUILDKITE_BUILD_PATH",
+		},
+		cli.StringFlag{
+			Name:   "hooks-path",
+			Value:  "",
+			Usage:  "Directory where the hook scripts are found (default is the platform's usual path)",
+			EnvVar: "BUILDKITE_HOOKS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "plugins-path",
+			Value:  "",
+			Usage:  "Directory where the plugins are saved to (default is the platform's usual path)",
+			EnvVar: "BUILDKITE_PLUGINS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "service-path",
+			Value:  "",
+			Usage:  "Where to write the service definition (default is the platform's usual path)",
+			EnvVar: "BUILDKITE_AGENT_INSTALL_SERVICE_PATH",
+		},
+		cli.StringFlag{
+			Name:   "user",
+			Value:  "",
+			Usage:  "The user to run the agent as, which owns the build and plugins directories",
+			EnvVar: "BUILDKITE_AGENT_INSTALL_USER",
+		},
+		cli.BoolFlag{
+			Name:   "no-service",
+			Usage:  "Don't write a service definition",
+			EnvVar: "BUILDKITE_AGENT_INSTALL_NO_SERVICE",
+		},
+		cli.BoolFlag{
+			Name:   "start",
+			Usage:  "Enable and start the service once it's installed",
+			EnvVar: "BUILDKITE_AGENT_INSTALL_START",
+		},
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := InstallConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Fprintf(c.App.ErrWriter, "%s\n", err)
+			os.Exit(1)
+		}
+		for _, warning := range warnings {
+			fmt.Fprintf(c.App.ErrWriter, "%s\n", warning)
+		}
+
+		home, _ := os.UserHomeDir()
+		layout := installLayout(cfg, defaultAgentLayout(runtime.GOOS, home))
+
+		if err := installAgent(cfg, layout, runtime.GOOS, c.App.Writer); err != nil {
+			fmt.Fprintf(c.App.ErrWriter, "%s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// installLayout returns the layout with the paths and user given as options
+// in place of the defaults
+func installLayout(cfg InstallConfig, layout agentLayout) agentLayout {
+	for _, override := range []struct {
+		value string
+		field *string
+	}{
+		{cfg.BinPath, &layout.BinPath},
+		{cfg.ConfigPath, &layout.ConfigPath},
+		{cfg.BuildPath, &layout.BuildPath},
+		{cfg.HooksPath, &layout.HooksPath},
+		{cfg.PluginsPath, &layout.PluginsPath},
+		{cfg.ServicePath, &layout.ServicePath},
+		{cfg.User, &layout.User},
+	} {
+		if override.value != "" {
+			*override.field = override.value
+		}
+	}
+	return layout
+}
+
+// installAgent puts everything the agent needs where the layout says, only
+// changing what's different from how it should be, and reports what it did
+// to out
+func installAgent(cfg InstallConfig, layout agentLayout, goos string, out io.Writer) error {
+	set := agentConfigOptions(cfg.Token, cfg.Name, cfg.Tags, layout)
+	for _, option := range cfg.Set {
+		name, value, ok := strings.Cut(option, "=")
+		if !ok || !isAgentStartOption(name) {
+			return fmt.Errorf("Invalid --set %q, expected an option of buildkite-agent start as name=value", option)
+		}
+		set[name] = value
+	}
+
+	owner, err := lookupOwner(layout.User)
+	if err != nil {
+		return err
+	}
+
+	report := func(status, path string) {
+		fmt.Fprintf(out, "%-9s %s\n", status, path)
+	}
+
+	binStatus := installUnchanged
+	if layout.BinPath != "" {
+		binStatus, err = installSelf(layout.BinPath)
+		if err != nil {
+			return fmt.Errorf("Installing binary to %s: %w", layout.BinPath, err)
+		}
+		report(binStatus, layout.BinPath)
+	}
+
+	// The agent checks out builds and plugins, so needs to own those, but only
+	// reads hooks
+	for _, dir := range []struct {
+		path  string
+		owned bool
+	}{
+		{layout.BuildPath, true},
+		{layout.HooksPath, false},
+		{layout.PluginsPath, true},
+	} {
+		status, err := installDir(dir.path)
+		if err != nil {
+			return fmt.Errorf("Creating %s: %w", dir.path, err)
+		}
+		if dir.owned {
+			if err := owner.chown(dir.path); err != nil {
+				return err
+			}
+		}
+		report(status, dir.path)
+	}
+
+	var config bytes.Buffer
+	if err := writeAgentConfig(&config, AgentStartCommand.Flags, set); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(layout.ConfigPath), 0755); err != nil {
+		return err
+	}
+	// The config file has the agent's token in it, so only the agent's user
+	// should be able to read it
+	configStatus, err := installFile(layout.ConfigPath, config.Bytes(), 0600)
+	if err != nil {
+		return fmt.Errorf("Writing %s: %w", layout.ConfigPath, err)
+	}
+	if err := owner.chown(layout.ConfigPath); err != nil {
+		return err
+	}
+	report(configStatus, layout.ConfigPath)
+
+	if cfg.NoService {
+		return nil
+	}
+
+	_, tmpl, ok := serviceUnit(goos)
+	if !ok {
+		fmt.Fprintf(out, "There's no service definition for %s, see https://buildkite.com/docs/agent/v3/windows for running the agent as a service\n", goos)
+		return nil
+	}
+
+	var unit bytes.Buffer
+	if err := tmpl.Execute(&unit, layout); err != nil {
+		return err
+	}
+	unitStatus, err := installFile(layout.ServicePath, unit.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("Writing %s: %w", layout.ServicePath, err)
+	}
+	report(unitStatus, layout.ServicePath)
+
+	if !cfg.Start {
+		return nil
+	}
+	// A running agent keeps using its old binary and config until it's restarted
+	agentChanged := binStatus != installUnchanged || configStatus != installUnchanged
+	return startService(goos, layout.ServicePath, unitStatus != installUnchanged, agentChanged, out)
+}
+
+const (
+	installCreated   = "Created"
+	installUpdated   = "Updated"
+	installUnchanged = "Unchanged"
+)
+
+func installDir(path string) (string, error) {
+	if info, err := os.Stat(path); err == nil {
+		if !info.IsDir() {
+			return "", fmt.Errorf("%s exists and isn't a directory", path)
+		}
+		return installUnchanged, nil
+	}
+	return installCreated, os.MkdirAll(path, 0755)
+}
+
+// installFile writes data to path unless it's already there. The file is
+// replaced with a rename, so nothing sees it half written.
+func installFile(path string, data []byte, perm os.FileMode) (string, error) {
+	status := installCreated
+	if existing, err := os.ReadFile(path); err == nil {
+		if bytes.Equal(existing, data) {
+			return installUnchanged, os.Chmod(path, perm)
+		}
+		status = installUpdated
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return "", err
+	}
+	return status, os.Rename(f.Name(), path)
+}
+
+// installSelf copies the running binary to path, unless it's already there
+func installSelf(path string) (string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if self, err = filepath.EvalSymlinks(self); err != nil {
+		return "", err
+	}
+	if target, err := filepath.EvalSymlinks(path); err == nil && target == self {
+		return installUnchanged, nil
+	}
+
+	data, err := os.ReadFile(self)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return installFile(path, data, 0755)
+}
+
+func isAgentStartOption(name string) bool {
+	for _, flag := range AgentStartCommand.Flags {
+		if strings.TrimSpace(strings.Split(flag.GetName(), ",")[0]) == name {
+			return name != "config"
+		}
+	}
+	return false
+}
+
+// installOwner is the user that files the agent writes to are given to, when
+// installing as root
+type installOwner struct {
+	uid, gid int
+	ok       bool
+}
+
+func lookupOwner(username string) (installOwner, error) {
+	if username == "" || runtime.GOOS == "windows" || os.Geteuid() != 0 {
+		return installOwner{}, nil
+	}
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		return installOwner{}, fmt.Errorf("Looking up user %s, which should be created before installing: %w", username, err)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return installOwner{}, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return installOwner{}, err
+	}
+	return installOwner{uid: uid, gid: gid, ok: true}, nil
+}
+
+func (o installOwner) chown(path string) error {
+	if !o.ok {
+		return nil
+	}
+	return os.Chown(path, o.uid, o.gid)
+}
+
+// startService enables and starts the service. If its definition or the
+// agent's binary or config changed, it's restarted so it runs with them.
+func startService(goos, servicePath string, unitChanged, agentChanged bool, out io.Writer) error {
+	for _, c := range startServiceCommands(goos, servicePath, unitChanged, agentChanged) {
+		fmt.Fprintf(out, "Running %s\n", strings.Join(c.args, " "))
+		cmd := exec.Command(c.args[0], c.args[1:]...)
+		cmd.Stdout = out
+		cmd.Stderr = out
+		if err := cmd.Run(); err != nil && !c.mayFail {
+			return fmt.Errorf("Running %s: %w", strings.Join(c.args, " "), err)
+		}
+	}
+	return nil
+}
+
+type serviceCommand struct {
+	args    []string
+	mayFail bool
+}
+
+func startServiceCommands(goos, servicePath string, unitChanged, agentChanged bool) []serviceCommand {
+	var commands []serviceCommand
+	switch goos {
+	case "linux":
+		name := filepath.Base(servicePath)
+		if unitChanged {
+			commands = append(commands, serviceCommand{args: []string{"systemctl", "daemon-reload"}})
+		}
+		if !unitChanged && !agentChanged {
+			return append(commands, serviceCommand{args: []string{"systemctl", "enable", "--now", name}})
+		}
+		// enable --now leaves a running service alone, so it's restarted
+		commands = append(commands,
+			serviceCommand{args: []string{"systemctl", "enable", name}},
+			serviceCommand{args: []string{"systemctl", "restart", name}},
+		)
+
+	case "darwin":
+		if unitChanged || agentChanged {
+			// Unloading a service that isn't loaded fails, which is fine
+			commands = append(commands, serviceCommand{args: []string{"launchctl", "unload", servicePath}, mayFail: true})
+		}
+		commands = append(commands, serviceCommand{args: []string{"launchctl", "load", "-w", servicePath}})
+	}
+	return commands
+}
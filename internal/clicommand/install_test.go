@@ -0,0 +1,131 @@
+package clicommand
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstallAgentIsIdempotent(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg := InstallConfig{
+		Token: "llamas",
+		Name:  "%hostname",
+		Tags:  []string{"queue=deploy"},
+		Set:   []string{"spawn=2"},
+	}
+	layout := installLayout(cfg, agentLayout{
+		ConfigPath:  filepath.Join(dir, "etc", "buildkite-agent.cfg"),
+		BuildPath:   filepath.Join(dir, "builds"),
+		HooksPath:   filepath.Join(dir, "hooks"),
+		PluginsPath: filepath.Join(dir, "plugins"),
+		ServicePath: filepath.Join(dir, "buildkite-agent.service"),
+	})
+
+	out := &bytes.Buffer{}
+	require.NoError(t, installAgent(cfg, layout, "linux", out))
+	assert.Equal(t, ""+
+		"Created   "+layout.BuildPath+"\n"+
+		"Created   "+layout.HooksPath+"\n"+
+		"Created   "+layout.PluginsPath+"\n"+
+		"Created   "+layout.ConfigPath+"\n"+
+		"Created   "+layout.ServicePath+"\n", out.String())
+
+	config, err := os.ReadFile(layout.ConfigPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(config), "\nspawn=2\n")
+	assert.Contains(t, string(config), "\ntags=\"queue=deploy\"\n")
+
+	out.Reset()
+	require.NoError(t, installAgent(cfg, layout, "linux", out))
+	assert.Equal(t, ""+
+		"Unchanged "+layout.BuildPath+"\n"+
+		"Unchanged "+layout.HooksPath+"\n"+
+		"Unchanged "+layout.PluginsPath+"\n"+
+		"Unchanged "+layout.ConfigPath+"\n"+
+		"Unchanged "+layout.ServicePath+"\n", out.String())
+
+	cfg.Tags = []string{"queue=build"}
+	out.Reset()
+	require.NoError(t, installAgent(cfg, layout, "linux", out))
+	assert.Contains(t, out.String(), "Updated   "+layout.ConfigPath+"\n")
+	assert.Contains(t, out.String(), "Unchanged "+layout.ServicePath+"\n")
+}
+
+func TestInstallAgentRejectsUnknownOptions(t *testing.T) {
+	cfg := InstallConfig{Token: "llamas", Set: []string{"llamas=true"}}
+
+	err := installAgent(cfg, agentLayout{}, "linux", &bytes.Buffer{})
+	assert.ErrorContains(t, err, `Invalid --set "llamas=true"`)
+}
+
+func TestStartServiceCommandsRestartWhenAgentChanges(t *testing.T) {
+	t.Parallel()
+
+	args := func(commands []serviceCommand) [][]string {
+		var got [][]string
+		for _, c := range commands {
+			got = append(got, c.args)
+		}
+		return got
+	}
+
+	for _, tc := range []struct {
+		name                      string
+		goos                      string
+		unitChanged, agentChanged bool
+		want                      [][]string
+	}{
+		{
+			name: "linux unchanged",
+			goos: "linux",
+			want: [][]string{{"systemctl", "enable", "--now", "buildkite-agent.service"}},
+		},
+		{
+			name:         "linux binary or config changed",
+			goos:         "linux",
+			agentChanged: true,
+			want: [][]string{
+				{"systemctl", "enable", "buildkite-agent.service"},
+				{"systemctl", "restart", "buildkite-agent.service"},
+			},
+		},
+		{
+			name:        "linux unit changed",
+			goos:        "linux",
+			unitChanged: true,
+			want: [][]string{
+				{"systemctl", "daemon-reload"},
+				{"systemctl", "enable", "buildkite-agent.service"},
+				{"systemctl", "restart", "buildkite-agent.service"},
+			},
+		},
+		{
+			name: "darwin unchanged",
+			goos: "darwin",
+			want: [][]string{{"launchctl", "load", "-w", "/etc/buildkite-agent.service"}},
+		},
+		{
+			name:         "darwin binary or config changed",
+			goos:         "darwin",
+			agentChanged: true,
+			want: [][]string{
+				{"launchctl", "unload", "/etc/buildkite-agent.service"},
+				{"launchctl", "load", "-w", "/etc/buildkite-agent.service"},
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := startServiceCommands(tc.goos, "/etc/buildkite-agent.service", tc.unitChanged, tc.agentChanged)
+			assert.Equal(t, tc.want, args(got))
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// logGroup is a group of a job's log output opened with `group open`
+type logGroup struct {
+	Name     string    `json:"name"`
+	Expanded bool      `json:"expanded,omitempty"`
+	Timing   bool      `json:"timing,omitempty"`
+	OpenedAt time.Time `json:"opened_at"`
+}
+
+// logGroups are the groups a job has open, outermost first. A job's log
+// only has one level of groups, so nested groups are shown as the names of
+// their parents and theirs, and their parent is shown again once they close.
+// They're kept in a file between commands.
+type logGroups struct {
+	path  string
+	Stack []logGroup `json:"stack"`
+}
+
+// logGroupsPath returns where a job's open groups are kept
+func logGroupsPath(jobID string) string {
+	if jobID == "" {
+		jobID = "local"
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("buildkite-log-groups-%s.json", jobID))
+}
+
+func loadLogGroups(path string) (*logGroups, error) {
+	groups := &logGroups{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return groups, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, groups); err != nil {
+		return nil, fmt.Errorf("Failed to read the open groups from %s: %w", path, err)
+	}
+	return groups, nil
+}
+
+func (g *logGroups) save() error {
+	if len(g.Stack) == 0 {
+		err := os.Remove(g.path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(g.path, data, 0600)
+}
+
+// header writes the header of the innermost open group
+func (g *logGroups) header(w io.Writer) {
+	if len(g.Stack) == 0 {
+		return
+	}
+	names := make([]string, 0, len(g.Stack))
+	for _, group := range g.Stack {
+		names = append(names, group.Name)
+	}
+	prefix := "---"
+	if g.Stack[len(g.Stack)-1].Expanded {
+		prefix = "+++"
+	}
+	fmt.Fprintf(w, "%s %s\n", prefix, strings.Join(names, " › "))
+}
+
+// open opens a group inside the innermost open group
+func (g *logGroups) open(w io.Writer, group logGroup) {
+	g.Stack = append(g.Stack, group)
+	g.header(w)
+}
+
+// close closes the named group, and any still open inside it, or the
+// innermost group if name is empty. The group it was in is shown again.
+func (g *logGroups) close(w io.Writer, name string, now time.Time) error {
+	if len(g.Stack) == 0 {
+		return fmt.Errorf("There are no open groups to close")
+	}
+
+	i := len(g.Stack) - 1
+	if name != "" {
+		for i >= 0 && g.Stack[i].Name != name {
+			i--
+		}
+		if i < 0 {
+			return fmt.Errorf("There's no open group named %q", name)
+		}
+	}
+
+	for j := len(g.Stack) - 1; j >= i; j-- {
+		if group := g.Stack[j]; group.Timing {
+			fmt.Fprintf(w, "⏱ %s took %s\n", group.Name, now.Sub(group.OpenedAt).Round(time.Millisecond))
+		}
+	}
+	g.Stack = g.Stack[:i]
+	g.header(w)
+	return nil
+}
@@ -0,0 +1,62 @@
+package clicommand
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogGroups(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "groups.json")
+	start := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	var out bytes.Buffer
+
+	// Each command loads and saves the groups, as separate runs would
+	reopen := func() *logGroups {
+		t.Helper()
+		groups, err := loadLogGroups(path)
+		require.NoError(t, err)
+		return groups
+	}
+
+	groups := reopen()
+	groups.open(&out, logGroup{Name: "Tests", Timing: true, OpenedAt: start})
+	require.NoError(t, groups.save())
+
+	groups = reopen()
+	groups.open(&out, logGroup{Name: "Unit", Expanded: true, OpenedAt: start.Add(time.Second)})
+	require.NoError(t, groups.save())
+
+	groups = reopen()
+	groups.open(&out, logGroup{Name: "Models", Timing: true, OpenedAt: start.Add(2 * time.Second)})
+	require.NoError(t, groups.save())
+
+	groups = reopen()
+	require.NoError(t, groups.close(&out, "", start.Add(3*time.Second)))
+	require.NoError(t, groups.save())
+
+	groups = reopen()
+	assert.EqualError(t, groups.close(&out, "Integration", start), `There's no open group named "Integration"`)
+	require.NoError(t, groups.close(&out, "Tests", start.Add(time.Minute)))
+	require.NoError(t, groups.save())
+
+	assert.Equal(t, `--- Tests
++++ Tests › Unit
+--- Tests › Unit › Models
+⏱ Models took 1s
++++ Tests › Unit
+⏱ Tests took 1m0s
+`, out.String())
+
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "the state file should be removed once no groups are open")
+
+	assert.EqualError(t, reopen().close(&out, "", start), "There are no open groups to close")
+}
@@ -3,6 +3,7 @@ package clicommand
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -12,13 +13,13 @@ import (
 	"strings"
 	"time"
 
-	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
-	"github.com/buildkite/agent/v3/bootstrap/shell"
-	"github.com/buildkite/agent/v3/cliconfig"
 	"github.com/buildkite/agent/v3/env"
-	"github.com/buildkite/agent/v3/redaction"
-	"github.com/buildkite/agent/v3/stdin"
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/buildkite/agent/v3/internal/redaction"
+	"github.com/buildkite/agent/v3/internal/stdin"
+	"github.com/buildkite/agent/v3/shell"
 	"github.com/urfave/cli"
 )
 
@@ -45,11 +46,17 @@ Description:
    You can also pipe build pipelines to the command allowing you to create
    scripts that generate dynamic pipelines.
 
+   With --dry-run, the pipeline is interpolated and checked against the
+   structure of Buildkite pipeline steps, then printed as JSON rather than
+   uploaded. It doesn't need a job or an agent access token, so it can be
+   used to check pipelines locally, or before they're merged.
+
 Example:
 
    $ buildkite-agent pipeline upload
    $ buildkite-agent pipeline upload my-custom-pipeline.yml
-   $ ./script/dynamic_step_generator | buildkite-agent pipeline upload`
+   $ ./script/dynamic_step_generator | buildkite-agent pipeline upload
+   $ buildkite-agent pipeline upload --dry-run .buildkite/pipeline.yml`
 
 type PipelineUploadConfig struct {
 	FilePath        string   `cli:"arg:0" label:"upload paths"`
@@ -68,10 +75,13 @@ type PipelineUploadConfig struct {
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP        bool     `cli:"debug-http"`
+	DNSOverrides     []string `cli:"dns-override" normalize:"list"`
+	DNSResolver      string   `cli:"dns-resolver"`
+	AgentAccessToken string   `cli:"agent-access-token"`
+	Endpoint         string   `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool     `cli:"no-http2"`
+	JobAPISocket     string   `cli:"job-api-socket"`
 }
 
 var PipelineUploadCommand = cli.Command{
@@ -92,7 +102,7 @@ var PipelineUploadCommand = cli.Command{
 		},
 		cli.BoolFlag{
 			Name:   "dry-run",
-			Usage:  "Rather than uploading the pipeline, it will be echoed to stdout",
+			Usage:  "Rather than uploading the pipeline, check it against the step schema and echo it to stdout",
 			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_DRY_RUN",
 		},
 		cli.BoolFlag{
@@ -111,6 +121,9 @@ var PipelineUploadCommand = cli.Command{
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		DNSOverridesFlag,
+		DNSResolverFlag,
+		JobAPISocketFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -273,8 +286,20 @@ var PipelineUploadCommand = cli.Command{
 			}
 		}
 
-		// In dry-run mode we just output the generated pipeline to stdout
+		// In dry-run mode we check the generated pipeline's structure and
+		// output it to stdout
 		if cfg.DryRun {
+			if err := result.Validate(); err != nil {
+				var schemaErr *agent.PipelineSchemaError
+				if !errors.As(err, &schemaErr) {
+					l.Fatal("Couldn't validate pipeline %q (%s)", src, err)
+				}
+				for _, err := range schemaErr.Errors {
+					l.Error("%s", err)
+				}
+				l.Fatal("Pipeline %q doesn't match the step schema", src)
+			}
+
 			enc := json.NewEncoder(os.Stdout)
 			enc.SetIndent("", "  ")
 
@@ -292,8 +317,9 @@ var PipelineUploadCommand = cli.Command{
 			l.Fatal("Missing job parameter. Usually this is set in the environment for a Buildkite job via BUILDKITE_JOB_ID.")
 		}
 
-		// Check we have an agent access token if not in dry run
-		if cfg.AgentAccessToken == "" {
+		// Check we have an agent access token, or an agent to make the calls
+		// for us, if not in dry run
+		if cfg.AgentAccessToken == "" && cfg.JobAPISocket == "" {
 			l.Fatal("Missing agent-access-token parameter. Usually this is set in the environment for a Buildkite job via BUILDKITE_AGENT_ACCESS_TOKEN.")
 		}
 
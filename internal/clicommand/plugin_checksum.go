@@ -0,0 +1,53 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/v3/internal/agent/plugin"
+	"github.com/urfave/cli"
+)
+
+const pluginChecksumHelpDescription = `Usage:
+  buildkite-agent plugin checksum [directory]
+
+Description:
+   Prints the checksum of the plugin checked out in the directory, or the
+   current directory if one isn't given. A plugin can be pinned to it in a
+   pipeline, and the agent will refuse to run the plugin if the files it
+   checks out don't match.
+
+   The .git directory isn't included, so any checkout of the same commit has
+   the same checksum.
+
+Example:
+
+    $ buildkite-agent plugin checksum ./docker-compose-buildkite-plugin
+    sha256:6f1ed002ab5595859014ebf0951522d9d4f1c0ec1a4b8ba1a1f1c8f1b3c2f0ab
+
+    # In pipeline.yml
+    plugins:
+      - docker-compose#v4.0.0@sha256:6f1ed002ab5595859014ebf0951522d9d4f1c0ec1a4b8ba1a1f1c8f1b3c2f0ab: ~`
+
+var PluginChecksumCommand = cli.Command{
+	Name:        "checksum",
+	Usage:       "Print the checksum of a plugin checkout to pin the plugin to",
+	Description: pluginChecksumHelpDescription,
+	Action: func(c *cli.Context) error {
+		dir := "."
+		if c.NArg() > 1 {
+			fmt.Fprintln(c.App.ErrWriter, "Too many arguments, expected a single directory")
+			os.Exit(1)
+		} else if c.NArg() == 1 {
+			dir = c.Args().First()
+		}
+
+		checksum, err := plugin.Checksum(dir)
+		if err != nil {
+			fmt.Fprintf(c.App.ErrWriter, "Error checksumming plugin: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(c.App.Writer, checksum)
+		return nil
+	},
+}
@@ -0,0 +1,329 @@
+package clicommand
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/buildkite/agent/v3/process"
+	"github.com/buildkite/roko"
+	"github.com/urfave/cli"
+)
+
+const runHelpDescription = `Usage:
+
+   buildkite-agent run [options...] [--] <command> [arguments...]
+
+Description:
+
+   Runs a command, and runs it again if it fails, waiting longer between each
+   attempt with --backoff exponential. Use it for the flaky parts of a step,
+   rather than a retry loop in the step's script.
+
+   The output of each attempt is put in its own group in the job's log. The
+   groups of failed attempts are collapsed, so the attempt that counted is
+   the one that's shown.
+
+   It exits with the command's exit status: 0 if an attempt succeeded, or the
+   last attempt's if they all failed. With --flaky-exit-status, it exits with
+   that status if the command only succeeded after being retried, so the step
+   can be soft failed to flag it as flaky. Commands that can't be started
+   aren't retried, and exit with 127 if they're not found.
+
+   Only the exit statuses in --retry-on-exit-status are retried, if given. A
+   command interrupted by the job being canceled isn't retried.
+
+Example:
+
+   $ buildkite-agent run --retries 3 --backoff exponential -- make integration-test
+   $ buildkite-agent run --retries 5 --delay 10s --retry-on-exit-status 75 ./deploy.sh`
+
+type RunConfig struct {
+	Retries           int      `cli:"retries"`
+	Backoff           string   `cli:"backoff"`
+	Delay             string   `cli:"delay"`
+	Jitter            bool     `cli:"jitter"`
+	RetryOnExitStatus []string `cli:"retry-on-exit-status" normalize:"list"`
+	FlakyExitStatus   int      `cli:"flaky-exit-status"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var RunCommand = cli.Command{
+	Name:        "run",
+	Usage:       "Run a command, retrying it with a backoff if it fails",
+	Description: runHelpDescription,
+	// Everything after the command is its own arguments
+	SkipArgReorder: true,
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:   "retries",
+			Value:  3,
+			Usage:  "How many times to retry the command after it first fails",
+			EnvVar: "BUILDKITE_RUN_RETRIES",
+		},
+		cli.StringFlag{
+			Name:   "backoff",
+			Value:  "constant",
+			Usage:  "How to wait between attempts; constant waits --delay each time, exponential waits --delay to the power of the number of attempts so far",
+			EnvVar: "BUILDKITE_RUN_BACKOFF",
+		},
+		cli.StringFlag{
+			Name:   "delay",
+			Value:  "5s",
+			Usage:  "How long to wait before retrying, like 30s. It must be at least 1s for --backoff exponential",
+			EnvVar: "BUILDKITE_RUN_DELAY",
+		},
+		cli.BoolFlag{
+			Name:   "jitter",
+			Usage:  "Wait up to a second longer between attempts, so many jobs retrying at once don't all retry at the same time",
+			EnvVar: "BUILDKITE_RUN_JITTER",
+		},
+		cli.StringSliceFlag{
+			Name:   "retry-on-exit-status",
+			Value:  &cli.StringSlice{},
+			Usage:  "Only retry the command if it exits with one of these statuses. By default, any failure is retried",
+			EnvVar: "BUILDKITE_RUN_RETRY_ON_EXIT_STATUS",
+		},
+		cli.IntFlag{
+			Name:   "flaky-exit-status",
+			Value:  0,
+			Usage:  "The status to exit with if the command succeeded, but only after being retried",
+			EnvVar: "BUILDKITE_RUN_FLAKY_EXIT_STATUS",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := RunConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		args := []string(c.Args())
+		if len(args) > 0 && args[0] == "--" {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			l.Fatal("Missing the command to run, e.g. buildkite-agent run --retries 3 -- make test")
+		}
+
+		opts, err := cfg.retryOptions()
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		// Stop retrying if the job's canceled, once the command has been
+		// told to stop too
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		exitStatus := runWithRetries(ctx, c.App.Writer, opts, args)
+
+		done()
+		os.Exit(exitStatus)
+	},
+}
+
+// retryOptions are how runWithRetries retries a command
+type retryOptions struct {
+	Attempts        int
+	Strategy        func() (roko.Strategy, string)
+	Jitter          bool
+	RetryOn         map[int]bool
+	FlakyExitStatus int
+}
+
+func (cfg RunConfig) retryOptions() (retryOptions, error) {
+	if cfg.Retries < 0 {
+		return retryOptions{}, fmt.Errorf("--retries can't be negative")
+	}
+
+	delay, err := time.ParseDuration(cfg.Delay)
+	if err != nil || delay < 0 {
+		return retryOptions{}, fmt.Errorf("Invalid --delay %q, expected a duration like 30s", cfg.Delay)
+	}
+
+	opts := retryOptions{
+		Attempts:        cfg.Retries + 1,
+		Jitter:          cfg.Jitter,
+		RetryOn:         map[int]bool{},
+		FlakyExitStatus: cfg.FlakyExitStatus,
+	}
+
+	switch cfg.Backoff {
+	case "constant":
+		opts.Strategy = func() (roko.Strategy, string) { return roko.Constant(delay) }
+	case "exponential":
+		if delay < time.Second {
+			return retryOptions{}, fmt.Errorf("--delay must be at least 1s for --backoff exponential")
+		}
+		opts.Strategy = func() (roko.Strategy, string) { return roko.Exponential(delay, 0) }
+	default:
+		return retryOptions{}, fmt.Errorf("Unknown --backoff %q, expected constant or exponential", cfg.Backoff)
+	}
+
+	for _, s := range cfg.RetryOnExitStatus {
+		status, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return retryOptions{}, fmt.Errorf("Invalid --retry-on-exit-status %q, expected a number", s)
+		}
+		opts.RetryOn[status] = true
+	}
+
+	return opts, nil
+}
+
+// attemptError is a failed attempt at running the command
+type attemptError struct {
+	status int
+	err    error
+}
+
+func (e *attemptError) Error() string {
+	return e.err.Error()
+}
+
+// runWithRetries runs the command until it succeeds or it runs out of
+// attempts, and returns the status to exit with
+func runWithRetries(ctx context.Context, out io.Writer, opts retryOptions, args []string) int {
+	command := process.FormatCommand(args[0], args[1:])
+
+	jitter := func(*roko.Retrier) {}
+	if opts.Jitter {
+		jitter = roko.WithJitter()
+	}
+	retrier := roko.NewRetrier(
+		roko.WithMaxAttempts(opts.Attempts),
+		roko.WithStrategy(opts.Strategy()),
+		jitter,
+	)
+
+	var statuses []string
+	err := retrier.DoWithContext(ctx, func(r *roko.Retrier) error {
+		attempt := r.AttemptCount() + 1
+		fmt.Fprintf(out, "--- :repeat: Running %s (attempt %d of %d)\n", command, attempt, opts.Attempts)
+
+		status, err := runAttempt(ctx, out, args)
+		if err == nil {
+			return nil
+		}
+		statuses = append(statuses, strconv.Itoa(status))
+		fmt.Fprintf(out, "Attempt %d failed: %v\n", attempt, err)
+
+		switch {
+		case errors.Is(ctx.Err(), context.Canceled):
+			fmt.Fprintln(out, "Not retrying, as the command was interrupted")
+			r.Break()
+		case status == 127 && errors.Is(err, exec.ErrNotFound):
+			r.Break()
+		case len(opts.RetryOn) > 0 && !opts.RetryOn[status]:
+			fmt.Fprintf(out, "Not retrying, as exit status %d isn't in --retry-on-exit-status\n", status)
+			r.Break()
+		case attempt < opts.Attempts:
+			fmt.Fprintf(out, "Retrying in %s\n", r.NextInterval().Round(time.Millisecond))
+		}
+		return &attemptError{status: status, err: err}
+	})
+
+	// Show the output of the attempt that counted
+	fmt.Fprintln(out, "^^^ +++")
+
+	if err == nil {
+		attempts := len(statuses) + 1
+		if attempts == 1 {
+			return 0
+		}
+		fmt.Fprintf(out, "Succeeded on attempt %d of %d, after failing with exit statuses %s\n",
+			attempts, opts.Attempts, strings.Join(statuses, ", "))
+		return opts.FlakyExitStatus
+	}
+
+	var attemptErr *attemptError
+	if !errors.As(err, &attemptErr) {
+		// Canceled while waiting to retry
+		fmt.Fprintf(out, "Not retrying %s: %v\n", command, err)
+		status, _ := strconv.Atoi(statuses[len(statuses)-1])
+		return status
+	}
+	if len(statuses) == 1 {
+		fmt.Fprintf(out, "Failed with exit status %s\n", statuses[0])
+	} else {
+		fmt.Fprintf(out, "Failed after %d attempts, with exit statuses %s\n", len(statuses), strings.Join(statuses, ", "))
+	}
+	return attemptErr.status
+}
+
+// runAttempt runs the command once, passing on signals to it, and returns
+// its exit status
+func runAttempt(ctx context.Context, out io.Writer, args []string) (int, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	if err := cmd.Start(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+			return 127, fmt.Errorf("%w: %v", exec.ErrNotFound, err)
+		}
+		return 1, err
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+		case <-waited:
+		}
+	}()
+	err := cmd.Wait()
+	close(waited)
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal()), fmt.Errorf("killed by %s", process.SignalString(ws.Signal()))
+		}
+		return exitErr.ExitCode(), fmt.Errorf("exited with status %d", exitErr.ExitCode())
+	}
+	if err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,94 @@
+package clicommand
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunRetryOptions(t *testing.T) {
+	t.Parallel()
+
+	opts, err := RunConfig{Retries: 2, Backoff: "exponential", Delay: "2s", RetryOnExitStatus: []string{"75", " 1"}}.retryOptions()
+	require.NoError(t, err)
+	assert.Equal(t, 3, opts.Attempts)
+	assert.Equal(t, map[int]bool{75: true, 1: true}, opts.RetryOn)
+	_, strategy := opts.Strategy()
+	assert.Equal(t, "exponential", strategy)
+
+	for _, cfg := range []RunConfig{
+		{Retries: -1, Backoff: "constant", Delay: "1s"},
+		{Backoff: "linear", Delay: "1s"},
+		{Backoff: "constant", Delay: "soon"},
+		{Backoff: "exponential", Delay: "500ms"},
+		{Backoff: "constant", Delay: "1s", RetryOnExitStatus: []string{"one"}},
+	} {
+		_, err := cfg.retryOptions()
+		assert.Error(t, err, "%+v", cfg)
+	}
+}
+
+func TestRunWithRetries(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands are shell scripts")
+	}
+	t.Parallel()
+
+	opts := func(retries int, retryOn ...int) retryOptions {
+		o, err := RunConfig{Retries: retries, Backoff: "constant", Delay: "0s", FlakyExitStatus: 42}.retryOptions()
+		require.NoError(t, err)
+		for _, s := range retryOn {
+			o.RetryOn[s] = true
+		}
+		return o
+	}
+
+	// Fails with the given statuses in turn, then succeeds
+	failing := func(statuses string) []string {
+		counter := filepath.Join(t.TempDir(), "attempts")
+		return []string{"/bin/sh", "-c", `
+			n=$(cat "$0" 2>/dev/null || echo 0); echo $((n + 1)) > "$0"
+			set -- $1
+			shift $n 2>/dev/null || exit 0
+			echo "attempt $((n + 1))"
+			exit ${1:-0}`, counter, statuses}
+	}
+
+	t.Run("succeeds first time", func(t *testing.T) {
+		var out bytes.Buffer
+		assert.Equal(t, 0, runWithRetries(context.Background(), &out, opts(3), failing("")))
+		assert.Contains(t, out.String(), "(attempt 1 of 4)")
+		assert.NotContains(t, out.String(), "attempt 2 of 4")
+	})
+
+	t.Run("succeeds after retries", func(t *testing.T) {
+		var out bytes.Buffer
+		assert.Equal(t, 42, runWithRetries(context.Background(), &out, opts(3), failing("1 2")))
+		assert.Contains(t, out.String(), "Attempt 1 failed: exited with status 1\n")
+		assert.Contains(t, out.String(), "Attempt 2 failed: exited with status 2\n")
+		assert.Contains(t, out.String(), "^^^ +++\nSucceeded on attempt 3 of 4, after failing with exit statuses 1, 2\n")
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		var out bytes.Buffer
+		assert.Equal(t, 3, runWithRetries(context.Background(), &out, opts(2), failing("1 2 3 4")))
+		assert.Contains(t, out.String(), "Failed after 3 attempts, with exit statuses 1, 2, 3\n")
+	})
+
+	t.Run("only retries some statuses", func(t *testing.T) {
+		var out bytes.Buffer
+		assert.Equal(t, 2, runWithRetries(context.Background(), &out, opts(3, 1), failing("1 2")))
+		assert.Contains(t, out.String(), "Not retrying, as exit status 2 isn't in --retry-on-exit-status\n")
+	})
+
+	t.Run("command not found", func(t *testing.T) {
+		var out bytes.Buffer
+		assert.Equal(t, 127, runWithRetries(context.Background(), &out, opts(3), []string{"/nonexistent/command"}))
+		assert.Contains(t, out.String(), "^^^ +++\nFailed with exit status 127\n")
+	})
+}
@@ -0,0 +1,390 @@
+package clicommand
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/urfave/cli"
+)
+
+const scaffoldHelpDescription = `Usage:
+
+   buildkite-agent scaffold [options...]
+
+Description:
+
+   Writes a configuration file for the agent, with every option described
+   and set to its default, along with a service definition that runs the
+   agent on this platform: a systemd unit on Linux, or a launchd plist on
+   macOS.
+
+   Options given here, like the token and tags, are set in the config file,
+   and the paths in both files follow where the agent's packages install to.
+   Existing files aren't replaced unless --force is given.
+
+Example:
+
+   $ buildkite-agent scaffold --token "xxx" --tags "queue=deploy" --output-dir /tmp/agent`
+
+// agentLayout is where the agent and the things it needs live on a host
+type agentLayout struct {
+	BinPath     string
+	ConfigPath  string
+	BuildPath   string
+	HooksPath   string
+	PluginsPath string
+	LogPath     string
+	ServicePath string
+	User        string
+}
+
+// defaultAgentLayout returns the layout the agent's packages and install
+// script use on the given platform
+func defaultAgentLayout(goos, home string) agentLayout {
+	switch goos {
+	case "darwin":
+		root := path.Join(home, ".buildkite-agent")
+		return agentLayout{
+			BinPath:     path.Join(root, "bin", "buildkite-agent"),
+			ConfigPath:  path.Join(root, "buildkite-agent.cfg"),
+			BuildPath:   path.Join(root, "builds"),
+			HooksPath:   path.Join(root, "hooks"),
+			PluginsPath: path.Join(root, "plugins"),
+			LogPath:     path.Join(root, "log", "buildkite-agent.log"),
+			ServicePath: "/Library/LaunchDaemons/com.buildkite.buildkite-agent.plist",
+			User:        path.Base(home),
+		}
+
+	case "windows":
+		return agentLayout{
+			BinPath:     `C:\buildkite-agent\bin\buildkite-agent.exe`,
+			ConfigPath:  `C:\buildkite-agent\buildkite-agent.cfg`,
+			BuildPath:   `C:\buildkite-agent\builds`,
+			HooksPath:   `C:\buildkite-agent\hooks`,
+			PluginsPath: `C:\buildkite-agent\plugins`,
+			LogPath:     `C:\buildkite-agent\buildkite-agent.log`,
+		}
+
+	default:
+		return agentLayout{
+			BinPath:     "/usr/bin/buildkite-agent",
+			ConfigPath:  "/etc/buildkite-agent/buildkite-agent.cfg",
+			BuildPath:   "/var/lib/buildkite-agent/builds",
+			HooksPath:   "/etc/buildkite-agent/hooks",
+			PluginsPath: "/etc/buildkite-agent/plugins",
+			ServicePath: "/etc/systemd/system/buildkite-agent.service",
+			User:        "buildkite-agent",
+		}
+	}
+}
+
+// writeAgentConfig writes a config file with every option of the start
+// command, described by its usage. Options in set are given that value, and
+// the rest are commented out with their default.
+func writeAgentConfig(w io.Writer, flags []cli.Flag, set map[string]string) error {
+	for _, flag := range flags {
+		name := strings.TrimSpace(strings.Split(flag.GetName(), ",")[0])
+		if name == "config" || flagIsHidden(flag) {
+			continue
+		}
+
+		value, ok := set[name]
+		if !ok {
+			value = flagDefault(flag)
+		}
+
+		line := name + "=" + configValue(flag, value)
+		if !ok {
+			line = "# " + line
+		}
+
+		if _, err := fmt.Fprintf(w, "# %s\n%s\n\n", flagUsage(flag), line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flagDefault returns a flag's default, as it would be written in a config
+// file
+func flagDefault(flag cli.Flag) string {
+	switch f := flag.(type) {
+	case cli.StringFlag:
+		return f.Value
+	case cli.StringSliceFlag:
+		if f.Value == nil {
+			return ""
+		}
+		return strings.Join(*f.Value, ",")
+	case cli.BoolFlag:
+		// Commented out, so it's an example of turning it on
+		return "true"
+	case cli.BoolTFlag:
+		return "false"
+	case cli.IntFlag:
+		return strconv.Itoa(f.Value)
+	case cli.DurationFlag:
+		return f.Value.String()
+	}
+	return ""
+}
+
+// configValue quotes strings, like the config files the agent is packaged
+// with
+func configValue(flag cli.Flag, value string) string {
+	switch flag.(type) {
+	case cli.BoolFlag, cli.BoolTFlag, cli.IntFlag:
+		return value
+	}
+	return `"` + value + `"`
+}
+
+var systemdUnitTemplate = template.Must(template.New("systemd").Parse(`[Unit]
+Description=Buildkite Agent
+Documentation=https://buildkite.com/agent
+After=syslog.target
+After=network.target
+
+[Service]
+Type=simple
+User={{.User}}
+Environment=HOME=/var/lib/buildkite-agent
+Environment=BUILDKITE_AGENT_CONFIG={{.ConfigPath}}
+ExecStart={{.BinPath}} start
+RestartSec=5
+Restart=on-failure
+RestartForceExitStatus=SIGPIPE
+TimeoutStartSec=10
+TimeoutStopSec=0
+KillMode=process
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+var launchdPlistTemplate = template.Must(template.New("launchd").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+  <dict>
+    <key>Label</key>
+    <string>com.buildkite.buildkite-agent</string>
+
+    <key>UserName</key>
+    <string>{{.User}}</string>
+
+    <key>ProgramArguments</key>
+    <array>
+      <string>{{.BinPath}}</string>
+      <string>start</string>
+    </array>
+
+    <key>KeepAlive</key>
+    <dict>
+      <key>SuccessfulExit</key>
+      <false/>
+    </dict>
+
+    <key>RunAtLoad</key>
+    <true/>
+
+    <key>ProcessType</key>
+    <string>Interactive</string>
+
+    <key>SessionCreate</key>
+    <true/>
+
+    <key>ThrottleInterval</key>
+    <integer>30</integer>
+
+    <key>StandardOutPath</key>
+    <string>{{.LogPath}}</string>
+
+    <key>StandardErrorPath</key>
+    <string>{{.LogPath}}</string>
+
+    <key>EnvironmentVariables</key>
+    <dict>
+      <key>PATH</key>
+      <string>/usr/bin:/bin:/usr/sbin:/sbin:/usr/local/bin</string>
+
+      <key>BUILDKITE_AGENT_CONFIG</key>
+      <string>{{.ConfigPath}}</string>
+    </dict>
+  </dict>
+</plist>
+`))
+
+// serviceUnit returns the file name and template for the service that runs
+// the agent on a platform, or false if there isn't one
+func serviceUnit(goos string) (string, *template.Template, bool) {
+	switch goos {
+	case "linux":
+		return "buildkite-agent.service", systemdUnitTemplate, true
+	case "darwin":
+		return "com.buildkite.buildkite-agent.plist", launchdPlistTemplate, true
+	}
+	return "", nil, false
+}
+
+type ScaffoldConfig struct {
+	OutputDir string   `cli:"output-dir" normalize:"filepath"`
+	Token     string   `cli:"token"`
+	Name      string   `cli:"name"`
+	Tags      []string `cli:"tags" normalize:"list"`
+	Platform  string   `cli:"platform"`
+	User      string   `cli:"user"`
+	Force     bool     `cli:"force"`
+}
+
+var ScaffoldCommand = cli.Command{
+	Name:        "scaffold",
+	Usage:       "Write a commented agent config file and service definition",
+	Description: scaffoldHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output-dir",
+			Value: ".",
+			Usage: "The directory to write the files to",
+		},
+		cli.StringFlag{
+			Name:   "token",
+			Value:  "xxx",
+			Usage:  "The agent registration token to put in the config file",
+			EnvVar: "BUILDKITE_AGENT_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "name",
+			Value:  "%hostname-%spawn",
+			Usage:  "The name of the agent to put in the config file",
+			EnvVar: "BUILDKITE_AGENT_NAME",
+		},
+		cli.StringSliceFlag{
+			Name:   "tags",
+			Value:  &cli.StringSlice{},
+			Usage:  "The tags to put in the config file",
+			EnvVar: "BUILDKITE_AGENT_TAGS",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Value: runtime.GOOS,
+			Usage: "The platform to write files for; linux, darwin or windows",
+		},
+		cli.StringFlag{
+			Name:  "user",
+			Value: "",
+			Usage: "The user the service runs the agent as (default is the platform's usual user)",
+		},
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "Replace files that already exist",
+		},
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := ScaffoldConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Fprintf(c.App.ErrWriter, "%s\n", err)
+			os.Exit(1)
+		}
+		for _, warning := range warnings {
+			fmt.Fprintf(c.App.ErrWriter, "%s\n", warning)
+		}
+
+		home, _ := os.UserHomeDir()
+		layout := defaultAgentLayout(cfg.Platform, home)
+		if cfg.User != "" {
+			layout.User = cfg.User
+		}
+
+		files, err := scaffoldAgent(cfg, layout)
+		if err != nil {
+			fmt.Fprintf(c.App.ErrWriter, "%s\n", err)
+			os.Exit(1)
+		}
+
+		for _, f := range files {
+			fmt.Fprintln(c.App.Writer, f)
+		}
+		if _, _, ok := serviceUnit(cfg.Platform); !ok {
+			fmt.Fprintf(c.App.Writer, "There's no service definition for %s, see https://buildkite.com/docs/agent/v3/windows for running the agent as a service\n", cfg.Platform)
+		}
+	},
+}
+
+// agentConfigOptions returns the options to set in the config file for an
+// agent with the given layout
+func agentConfigOptions(token, name string, tags []string, layout agentLayout) map[string]string {
+	set := map[string]string{
+		"token":        token,
+		"name":         name,
+		"build-path":   layout.BuildPath,
+		"hooks-path":   layout.HooksPath,
+		"plugins-path": layout.PluginsPath,
+	}
+	if len(tags) > 0 {
+		set["tags"] = strings.Join(tags, ",")
+	}
+	return set
+}
+
+// scaffoldAgent writes the config file and service definition, returning the
+// paths that were written
+func scaffoldAgent(cfg ScaffoldConfig, layout agentLayout) ([]string, error) {
+	set := agentConfigOptions(cfg.Token, cfg.Name, cfg.Tags, layout)
+
+	var written []string
+
+	configPath := filepath.Join(cfg.OutputDir, "buildkite-agent.cfg")
+	// The config file has the agent's token in it
+	if err := writeScaffoldFile(configPath, 0600, cfg.Force, func(w io.Writer) error {
+		return writeAgentConfig(w, AgentStartCommand.Flags, set)
+	}); err != nil {
+		return written, err
+	}
+	written = append(written, configPath)
+
+	name, tmpl, ok := serviceUnit(cfg.Platform)
+	if !ok {
+		return written, nil
+	}
+
+	unitPath := filepath.Join(cfg.OutputDir, name)
+	if err := writeScaffoldFile(unitPath, 0644, cfg.Force, func(w io.Writer) error {
+		return tmpl.Execute(w, layout)
+	}); err != nil {
+		return written, err
+	}
+	return append(written, unitPath), nil
+}
+
+func writeScaffoldFile(path string, perm os.FileMode, force bool, write func(io.Writer) error) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+
+	f, err := os.OpenFile(path, flags, perm)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists, use --force to replace it", path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,101 @@
+package clicommand
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli"
+)
+
+func TestScaffoldAgentWritesLoadableConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg := ScaffoldConfig{
+		OutputDir: dir,
+		Token:     "llamas",
+		Name:      "agent-%spawn",
+		Tags:      []string{"queue=deploy", "os=linux"},
+		Platform:  "linux",
+	}
+	layout := defaultAgentLayout("linux", "")
+
+	written, err := scaffoldAgent(cfg, layout)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "buildkite-agent.cfg"),
+		filepath.Join(dir, "buildkite-agent.service"),
+	}, written)
+
+	file := cliconfig.File{Path: written[0]}
+	require.NoError(t, file.Load())
+
+	// Only what was set is uncommented
+	assert.Equal(t, map[string]string{
+		"token":        "llamas",
+		"name":         "agent-%spawn",
+		"tags":         "queue=deploy,os=linux",
+		"build-path":   "/var/lib/buildkite-agent/builds",
+		"hooks-path":   "/etc/buildkite-agent/hooks",
+		"plugins-path": "/etc/buildkite-agent/plugins",
+	}, file.Config)
+
+	unit, err := os.ReadFile(written[1])
+	require.NoError(t, err)
+	assert.Contains(t, string(unit), "User=buildkite-agent\n")
+	assert.Contains(t, string(unit), "ExecStart=/usr/bin/buildkite-agent start\n")
+}
+
+func TestScaffoldAgentKeepsExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "buildkite-agent.cfg")
+	require.NoError(t, os.WriteFile(path, []byte("token=\"existing\"\n"), 0600))
+
+	cfg := ScaffoldConfig{OutputDir: dir, Token: "llamas", Platform: "windows"}
+
+	_, err := scaffoldAgent(cfg, defaultAgentLayout("windows", ""))
+	assert.ErrorContains(t, err, "already exists")
+
+	cfg.Force = true
+	written, err := scaffoldAgent(cfg, defaultAgentLayout("windows", ""))
+	require.NoError(t, err)
+
+	// There's no service definition on Windows
+	assert.Equal(t, []string{path}, written)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.True(t, strings.Contains(string(data), "\ntoken=\"llamas\"\n"))
+}
+
+func TestCompletionEntriesSkipHiddenCommandsAndFlags(t *testing.T) {
+	entries := completionEntries([]cli.Command{
+		{
+			Name: "artifact",
+			Subcommands: []cli.Command{
+				{Name: "upload", Flags: []cli.Flag{
+					cli.StringFlag{Name: "job"},
+					cli.BoolFlag{Name: "debug, d"},
+					cli.BoolFlag{Name: "secret", Hidden: true},
+				}},
+			},
+		},
+		{Name: "internal", Hidden: true},
+		ScaffoldCommand,
+	})
+
+	var paths []string
+	for _, e := range entries {
+		paths = append(paths, e.Path)
+	}
+	assert.Equal(t, []string{"", "artifact", "artifact upload", "scaffold"}, paths)
+
+	assert.Equal(t, []string{"artifact", "scaffold"}, entries[0].Words())
+	assert.Equal(t, []string{"upload"}, entries[1].Words())
+	assert.Equal(t, []string{"--job", "--debug"}, entries[2].Words())
+	assert.Contains(t, entries[3].Words(), "--output-dir")
+}
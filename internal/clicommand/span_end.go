@@ -0,0 +1,76 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/buildkite/agent/v3/internal/tracetools"
+	"github.com/urfave/cli"
+)
+
+const spanEndHelpDescription = `Usage:
+
+   buildkite-agent span end <name> [options...]
+
+Description:
+
+   Marks the end of a span of the job's time started with
+   "buildkite-agent span start". If more than one span with the name has
+   started, the latest of them is ended.
+
+Example:
+
+   $ buildkite-agent span end "npm install"`
+
+type SpanEndConfig struct {
+	Name string `cli:"arg:0" label:"span name" validate:"required"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var SpanEndCommand = cli.Command{
+	Name:        "end",
+	Usage:       "Mark the end of a span of the job's time",
+	Description: spanEndHelpDescription,
+	Flags: []cli.Flag{
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := SpanEndConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		// The marker isn't followed by a newline, so it doesn't leave a blank
+		// line in the log
+		fmt.Fprint(c.App.Writer, tracetools.UserSpanMarker("end", cfg.Name, time.Now()))
+	},
+}
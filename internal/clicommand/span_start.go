@@ -0,0 +1,87 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/buildkite/agent/v3/internal/tracetools"
+	"github.com/urfave/cli"
+)
+
+const spanStartHelpDescription = `Usage:
+
+   buildkite-agent span start <name> [options...]
+
+Description:
+
+   Marks the start of a named span of the job's time in its log, which ends
+   when "buildkite-agent span end" is run with the same name. The markers
+   aren't shown in the log.
+
+   When the job finishes, the agent adds how long each span took to the end
+   of the job's log, and to the job-spans:<job id> build meta-data key. If
+   the agent sends metrics to Datadog, each span's duration is sent as the
+   jobs.spans.duration metric, tagged with its name. If the job is traced,
+   each span is added to its trace.
+
+   Spans can be nested, and started more than once, such as in a loop, in
+   which case their durations are added up.
+
+Example:
+
+   $ buildkite-agent span start "npm install"
+   $ npm install
+   $ buildkite-agent span end "npm install"`
+
+type SpanStartConfig struct {
+	Name string `cli:"arg:0" label:"span name" validate:"required"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var SpanStartCommand = cli.Command{
+	Name:        "start",
+	Usage:       "Mark the start of a span of the job's time",
+	Description: spanStartHelpDescription,
+	Flags: []cli.Flag{
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := SpanStartConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		// The marker isn't followed by a newline, so it doesn't leave a blank
+		// line in the log
+		fmt.Fprint(c.App.Writer, tracetools.UserSpanMarker("start", cfg.Name, time.Now()))
+	},
+}
@@ -0,0 +1,240 @@
+package clicommand
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/urfave/cli"
+)
+
+const terraformWaitForApprovalHelpDescription = `Usage:
+
+   buildkite-agent terraform wait-for-approval [options...]
+
+Description:
+
+   Waits until a plan uploaded with buildkite-agent terraform upload-plan is
+   approved, so it can be applied, and fails if it's rejected or isn't
+   approved in time.
+
+   A plan is approved or rejected by setting the build's meta-data key
+   terraform-approval-<context>, or the one given with --key. It's approved if
+   the value is approved, approve, yes or true, and rejected otherwise. To
+   approve it from the Buildkite UI, add a field with the key to a block step
+   before the step that applies it, so unblocking the step sets it.
+
+   With --plan, it also checks that the plan file is the one that was
+   uploaded, so a plan that's changed since it was reviewed isn't applied.
+
+Example:
+
+   $ buildkite-agent terraform wait-for-approval --context production --plan tfplan && terraform apply tfplan`
+
+type TerraformWaitForApprovalConfig struct {
+	Context      string `cli:"context"`
+	Key          string `cli:"key"`
+	PlanFile     string `cli:"plan"`
+	Timeout      string `cli:"timeout"`
+	PollInterval string `cli:"poll-interval"`
+	Job          string `cli:"job" validate:"required"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+
+	// API config
+	DebugHTTP        bool     `cli:"debug-http"`
+	DNSOverrides     []string `cli:"dns-override" normalize:"list"`
+	DNSResolver      string   `cli:"dns-resolver"`
+	AgentAccessToken string   `cli:"agent-access-token" validate:"required-without:JobAPISocket"`
+	Endpoint         string   `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool     `cli:"no-http2"`
+	JobAPISocket     string   `cli:"job-api-socket"`
+}
+
+var TerraformWaitForApprovalCommand = cli.Command{
+	Name:        "wait-for-approval",
+	Usage:       "Waits until a terraform plan is approved before it's applied",
+	Description: terraformWaitForApprovalHelpDescription,
+	Flags: []cli.Flag{
+		TerraformContextFlag,
+		cli.StringFlag{
+			Name:   "key",
+			Value:  "",
+			Usage:  "The meta-data key that approves the plan. Defaults to terraform-approval-<context>",
+			EnvVar: "BUILDKITE_TERRAFORM_APPROVAL_KEY",
+		},
+		cli.StringFlag{
+			Name:   "plan",
+			Value:  "",
+			Usage:  "The plan file to check is the one that was uploaded",
+			EnvVar: "BUILDKITE_TERRAFORM_PLAN",
+		},
+		cli.StringFlag{
+			Name:   "timeout",
+			Value:  "1h",
+			Usage:  "How long to wait for the plan to be approved, or 0 to wait until the job times out",
+			EnvVar: "BUILDKITE_TERRAFORM_APPROVAL_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "poll-interval",
+			Value:  "15s",
+			Usage:  "How often to check whether the plan's been approved",
+			EnvVar: "BUILDKITE_TERRAFORM_APPROVAL_POLL_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job is waiting for approval",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+		DNSOverridesFlag,
+		DNSResolverFlag,
+		JobAPISocketFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		ctx := context.Background()
+
+		// The configuration will be loaded into this struct
+		cfg := TerraformWaitForApprovalConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil || timeout < 0 {
+			l.Fatal("Invalid --timeout %q, expected a duration like 1h", cfg.Timeout)
+		}
+		interval, err := time.ParseDuration(cfg.PollInterval)
+		if err != nil || interval <= 0 {
+			l.Fatal("Invalid --poll-interval %q, expected a duration like 15s", cfg.PollInterval)
+		}
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		key := cfg.Key
+		if key == "" {
+			key = "terraform-approval-" + cfg.Context
+		}
+
+		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
+		getMetaData := func(ctx context.Context, key string) (string, bool, error) {
+			metaData, resp, err := client.GetMetaData(ctx, cfg.Job, key)
+			if resp != nil && resp.StatusCode == 404 {
+				return "", false, nil
+			}
+			if err != nil {
+				return "", false, err
+			}
+			return metaData.Value, true, nil
+		}
+
+		if cfg.PlanFile != "" {
+			if err := checkTerraformPlan(ctx, cfg.PlanFile, cfg.Context, getMetaData); err != nil {
+				l.Fatal("%s", err)
+			}
+		}
+
+		l.Info("Waiting for the plan to be approved with the meta-data key %s", key)
+		if err := waitForTerraformApproval(ctx, l, key, interval, getMetaData); err != nil {
+			l.Fatal("%s", err)
+		}
+		l.Info("The plan was approved")
+	},
+}
+
+// metaDataGetter gets a build's meta-data, returning whether the key is set
+type metaDataGetter func(ctx context.Context, key string) (value string, ok bool, err error)
+
+var approvedTerraformValues = map[string]bool{"approved": true, "approve": true, "yes": true, "true": true}
+
+// waitForTerraformApproval waits until the key is set, returning an error if
+// it's set to anything but an approval
+func waitForTerraformApproval(ctx context.Context, l logger.Logger, key string, interval time.Duration, get metaDataGetter) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		value, ok, err := get(ctx, key)
+		switch {
+		case err != nil:
+			l.Warn("Failed to check whether the plan's been approved: %s", err)
+		case ok && approvedTerraformValues[strings.ToLower(strings.TrimSpace(value))]:
+			return nil
+		case ok:
+			return fmt.Errorf("The plan was rejected (%s is %q)", key, value)
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return errors.New("Timed out waiting for the plan to be approved")
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkTerraformPlan checks the plan file is the one that was uploaded
+func checkTerraformPlan(ctx context.Context, planFile, planContext string, get metaDataGetter) error {
+	plan, err := os.ReadFile(planFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read plan: %w", err)
+	}
+
+	key := terraformMetaDataKey(planContext, "sha256")
+	want, ok, err := get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("Failed to get the uploaded plan's checksum: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("No plan has been uploaded for %s, as %s isn't set", planContext, key)
+	}
+	if got := fmt.Sprintf("%x", sha256.Sum256(plan)); got != want {
+		return fmt.Errorf("%s isn't the plan that was uploaded, its checksum is %s rather than %s", planFile, got, want)
+	}
+	return nil
+}
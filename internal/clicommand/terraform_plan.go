@@ -0,0 +1,325 @@
+package clicommand
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/agent"
+	"github.com/buildkite/agent/v3/internal/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/roko"
+	"github.com/urfave/cli"
+)
+
+// The most changes listed in a plan's annotation
+const maxAnnotatedTerraformChanges = 100
+
+const terraformUploadPlanHelpDescription = `Usage:
+
+   buildkite-agent terraform upload-plan <plan file> [options...]
+
+Description:
+
+   Uploads a plan saved with terraform plan -out, so it can be reviewed and
+   approved before it's applied in a later step.
+
+   The plan file is uploaded as an artifact, along with the JSON that
+   terraform show -json outputs for it, and the build is annotated with a
+   summary of the changes. The plan's checksum is kept in the build's
+   meta-data, so buildkite-agent terraform wait-for-approval --plan can make
+   sure it's the same plan that's applied.
+
+   Plans can have sensitive values in them, so use an artifact upload
+   destination that only the people who can apply them can read.
+
+   Use --context to tell apart the plans of different workspaces in the same
+   build.
+
+Example:
+
+   $ terraform plan -out tfplan
+   $ buildkite-agent terraform upload-plan tfplan --context production`
+
+type TerraformUploadPlanConfig struct {
+	PlanFile  string `cli:"arg:0" label:"plan file" validate:"required"`
+	Context   string `cli:"context"`
+	Terraform string `cli:"terraform"`
+	Job       string `cli:"job" validate:"required"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+
+	// API config
+	DebugHTTP        bool     `cli:"debug-http"`
+	DNSOverrides     []string `cli:"dns-override" normalize:"list"`
+	DNSResolver      string   `cli:"dns-resolver"`
+	AgentAccessToken string   `cli:"agent-access-token" validate:"required-without:JobAPISocket"`
+	Endpoint         string   `cli:"endpoint" validate:"required"`
+	NoHTTP2          bool     `cli:"no-http2"`
+	JobAPISocket     string   `cli:"job-api-socket"`
+}
+
+var TerraformContextFlag = cli.StringFlag{
+	Name:   "context",
+	Value:  "default",
+	Usage:  "Which of the build's plans this is, like the name of its workspace",
+	EnvVar: "BUILDKITE_TERRAFORM_CONTEXT",
+}
+
+var TerraformUploadPlanCommand = cli.Command{
+	Name:        "upload-plan",
+	Usage:       "Uploads a terraform plan and annotates the build with its changes",
+	Description: terraformUploadPlanHelpDescription,
+	Flags: []cli.Flag{
+		TerraformContextFlag,
+		cli.StringFlag{
+			Name:   "terraform",
+			Value:  "terraform",
+			Usage:  "The terraform executable to read the plan with",
+			EnvVar: "BUILDKITE_TERRAFORM_BINARY",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job should the plan be uploaded to",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+		DNSOverridesFlag,
+		DNSResolverFlag,
+		JobAPISocketFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		ctx := context.Background()
+
+		// The configuration will be loaded into this struct
+		cfg := TerraformUploadPlanConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		if err := uploadTerraformPlan(ctx, cfg, l); err != nil {
+			l.Fatal("%s", err)
+		}
+	},
+}
+
+func uploadTerraformPlan(ctx context.Context, cfg TerraformUploadPlanConfig, l logger.Logger) error {
+	plan, err := os.ReadFile(cfg.PlanFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read plan: %w", err)
+	}
+
+	l.Info("Reading %s with %s show -json", cfg.PlanFile, cfg.Terraform)
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, cfg.Terraform, "show", "-json", cfg.PlanFile)
+	cmd.Stderr = &stderr
+	planJSON, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("Failed to read plan with %s show -json: %w\n%s", cfg.Terraform, err, stderr.String())
+	}
+
+	summary, err := summarizeTerraformPlan(bytes.NewReader(planJSON))
+	if err != nil {
+		return err
+	}
+	l.Info("Plan: %s", summary)
+
+	jsonFile := cfg.PlanFile + ".json"
+	if err := os.WriteFile(jsonFile, planJSON, 0o600); err != nil {
+		return err
+	}
+
+	client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
+
+	uploader := agent.NewArtifactUploader(l, client, agent.ArtifactUploaderConfig{
+		JobID: cfg.Job,
+		Paths: cfg.PlanFile + agent.ArtifactPathDelimiter + jsonFile,
+	})
+	if err := uploader.Upload(ctx); err != nil {
+		return fmt.Errorf("Failed to upload plan: %w", err)
+	}
+
+	sum := fmt.Sprintf("%x", sha256.Sum256(plan))
+	if err := setMetaData(ctx, l, client, cfg.Job, terraformMetaDataKey(cfg.Context, "sha256"), sum); err != nil {
+		return err
+	}
+	if err := setMetaData(ctx, l, client, cfg.Job, terraformMetaDataKey(cfg.Context, "summary"), summary.String()); err != nil {
+		return err
+	}
+
+	return annotate(ctx, AnnotateConfig{
+		Body:             summary.markdown(cfg.Context, cfg.PlanFile),
+		Style:            summary.style(),
+		Context:          "terraform-plan-" + cfg.Context,
+		Job:              cfg.Job,
+		DebugHTTP:        cfg.DebugHTTP,
+		DNSOverrides:     cfg.DNSOverrides,
+		DNSResolver:      cfg.DNSResolver,
+		AgentAccessToken: cfg.AgentAccessToken,
+		Endpoint:         cfg.Endpoint,
+		NoHTTP2:          cfg.NoHTTP2,
+		JobAPISocket:     cfg.JobAPISocket,
+	}, l)
+}
+
+// terraformMetaDataKey is the build meta-data key for something about a
+// plan, like terraform-plan-production-sha256
+func terraformMetaDataKey(planContext, name string) string {
+	return "terraform-plan-" + planContext + "-" + name
+}
+
+func setMetaData(ctx context.Context, l logger.Logger, client *api.Client, job, key, value string) error {
+	return roko.NewRetrier(
+		roko.WithMaxAttempts(10),
+		roko.WithStrategy(roko.Constant(5*time.Second)),
+	).DoWithContext(ctx, func(r *roko.Retrier) error {
+		resp, err := client.SetMetaData(ctx, job, &api.MetaData{Key: key, Value: value})
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+			r.Break()
+		}
+		if err != nil {
+			l.Warn("%s (%s)", err, r)
+			return fmt.Errorf("Failed to set meta-data %s: %w", key, err)
+		}
+		return nil
+	})
+}
+
+// terraformPlan is the part of the output of terraform show -json that's
+// summarized
+type terraformPlan struct {
+	ResourceChanges []struct {
+		Address string `json:"address"`
+		Change  struct {
+			Actions []string `json:"actions"`
+		} `json:"change"`
+	} `json:"resource_changes"`
+}
+
+// terraformChange is a change to a resource in a plan
+type terraformChange struct {
+	Action  string
+	Address string
+}
+
+// terraformPlanSummary counts the changes in a plan the way terraform does,
+// where a resource that's replaced is both added and destroyed
+type terraformPlanSummary struct {
+	Add, Change, Destroy int
+	Changes              []terraformChange
+}
+
+func summarizeTerraformPlan(r io.Reader) (terraformPlanSummary, error) {
+	var plan terraformPlan
+	if err := json.NewDecoder(r).Decode(&plan); err != nil {
+		return terraformPlanSummary{}, fmt.Errorf("Failed to parse plan JSON: %w", err)
+	}
+
+	var s terraformPlanSummary
+	for _, rc := range plan.ResourceChanges {
+		action := strings.Join(rc.Change.Actions, ",")
+		switch action {
+		case "create":
+			s.Add++
+		case "update":
+			s.Change++
+		case "delete":
+			s.Destroy++
+		case "delete,create", "create,delete":
+			s.Add++
+			s.Destroy++
+			action = "replace"
+		default:
+			// no-op and read don't change anything
+			continue
+		}
+		s.Changes = append(s.Changes, terraformChange{Action: action, Address: rc.Address})
+	}
+	return s, nil
+}
+
+func (s terraformPlanSummary) String() string {
+	if len(s.Changes) == 0 {
+		return "No changes."
+	}
+	return fmt.Sprintf("%d to add, %d to change, %d to destroy.", s.Add, s.Change, s.Destroy)
+}
+
+// style is the annotation style, which warns about plans that destroy things
+func (s terraformPlanSummary) style() string {
+	switch {
+	case s.Destroy > 0:
+		return "warning"
+	case len(s.Changes) == 0:
+		return "success"
+	default:
+		return "info"
+	}
+}
+
+var terraformActionEmoji = map[string]string{
+	"create":  ":heavy_plus_sign:",
+	"update":  ":pencil2:",
+	"delete":  ":heavy_minus_sign:",
+	"replace": ":recycle:",
+}
+
+func (s terraformPlanSummary) markdown(planContext, planFile string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "### Terraform plan: %s\n\n", planContext)
+	fmt.Fprintf(&b, "**Plan:** %s\n\n", s)
+	if len(s.Changes) > 0 {
+		b.WriteString("| Action | Resource |\n| --- | --- |\n")
+		for i, c := range s.Changes {
+			if i == maxAnnotatedTerraformChanges {
+				fmt.Fprintf(&b, "| | …and %d more |\n", len(s.Changes)-i)
+				break
+			}
+			fmt.Fprintf(&b, "| %s %s | `%s` |\n", terraformActionEmoji[c.Action], c.Action, c.Address)
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "The full plan is in the `%s` and `%s.json` artifacts.\n", planFile, planFile)
+	return b.String()
+}
@@ -0,0 +1,107 @@
+package clicommand
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const terraformPlanJSON = `{
+  "format_version": "1.1",
+  "resource_changes": [
+    {"address": "aws_instance.web", "change": {"actions": ["create"]}},
+    {"address": "aws_s3_bucket.logs", "change": {"actions": ["update"]}},
+    {"address": "aws_db_instance.main", "change": {"actions": ["delete", "create"]}},
+    {"address": "aws_iam_role.old", "change": {"actions": ["delete"]}},
+    {"address": "aws_vpc.main", "change": {"actions": ["no-op"]}},
+    {"address": "data.aws_ami.ubuntu", "change": {"actions": ["read"]}}
+  ]
+}`
+
+func TestSummarizeTerraformPlan(t *testing.T) {
+	t.Parallel()
+
+	s, err := summarizeTerraformPlan(strings.NewReader(terraformPlanJSON))
+	require.NoError(t, err)
+	assert.Equal(t, "2 to add, 1 to change, 2 to destroy.", s.String())
+	assert.Equal(t, "warning", s.style())
+	assert.Equal(t, []terraformChange{
+		{Action: "create", Address: "aws_instance.web"},
+		{Action: "update", Address: "aws_s3_bucket.logs"},
+		{Action: "replace", Address: "aws_db_instance.main"},
+		{Action: "delete", Address: "aws_iam_role.old"},
+	}, s.Changes)
+
+	md := s.markdown("production", "tfplan")
+	assert.Contains(t, md, "### Terraform plan: production\n")
+	assert.Contains(t, md, "| :recycle: replace | `aws_db_instance.main` |\n")
+	assert.Contains(t, md, "`tfplan` and `tfplan.json`")
+
+	s, err = summarizeTerraformPlan(strings.NewReader(`{"resource_changes": []}`))
+	require.NoError(t, err)
+	assert.Equal(t, "No changes.", s.String())
+	assert.Equal(t, "success", s.style())
+
+	_, err = summarizeTerraformPlan(strings.NewReader("Error: no plan"))
+	assert.Error(t, err)
+}
+
+func TestWaitForTerraformApproval(t *testing.T) {
+	t.Parallel()
+
+	// The value of the key on each poll, where "" is unset
+	getter := func(values ...string) metaDataGetter {
+		return func(ctx context.Context, key string) (string, bool, error) {
+			if key != "terraform-approval-production" {
+				return "", false, errors.New("wrong key " + key)
+			}
+			if len(values) == 0 {
+				return "", false, nil
+			}
+			value := values[0]
+			values = values[1:]
+			return value, value != "", nil
+		}
+	}
+
+	ctx := context.Background()
+	key := "terraform-approval-production"
+	assert.NoError(t, waitForTerraformApproval(ctx, logger.Discard, key, time.Millisecond, getter("", "", "Approved")))
+
+	err := waitForTerraformApproval(ctx, logger.Discard, key, time.Millisecond, getter("", "rejected"))
+	assert.EqualError(t, err, `The plan was rejected (terraform-approval-production is "rejected")`)
+
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	err = waitForTerraformApproval(ctx, logger.Discard, key, time.Millisecond, getter())
+	assert.EqualError(t, err, "Timed out waiting for the plan to be approved")
+}
+
+func TestCheckTerraformPlan(t *testing.T) {
+	t.Parallel()
+
+	plan := filepath.Join(t.TempDir(), "tfplan")
+	require.NoError(t, os.WriteFile(plan, []byte("llamas"), 0o600))
+
+	sums := map[string]string{
+		"terraform-plan-production-sha256": "66f0d436b0469c570b3b8d7e11a681881d9a7bcd8b12d5c2db426015d3ddfd1c",
+		"terraform-plan-staging-sha256":    "41cb98dceca45230d6af6d57ee85aad877cf11b0940fac51873017f8c9eb3191",
+	}
+	get := func(ctx context.Context, key string) (string, bool, error) {
+		value, ok := sums[key]
+		return value, ok, nil
+	}
+
+	ctx := context.Background()
+	assert.NoError(t, checkTerraformPlan(ctx, plan, "production", get))
+	assert.ErrorContains(t, checkTerraformPlan(ctx, plan, "staging", get), "isn't the plan that was uploaded")
+	assert.ErrorContains(t, checkTerraformPlan(ctx, plan, "dev", get), "No plan has been uploaded for dev")
+}
@@ -11,8 +11,8 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/buildkite/agent/v3/internal/utils"
 	"github.com/buildkite/agent/v3/logger"
-	"github.com/buildkite/agent/v3/utils"
 	"github.com/oleiade/reflections"
 	"github.com/urfave/cli"
 )
@@ -142,8 +142,12 @@ func (l *Loader) Load() (warnings []string, err error) {
 					fmt.Sprintf("The config option `%s` has been deprecated: %s", cliName, deprecationError))
 			}
 		}
+	}
 
-		// Perform validations
+	// Perform validations, once every field has been loaded, as a rule can
+	// depend on other fields
+	for _, fieldName := range fields {
+		cliName, _ := reflections.GetFieldTag(l.Config, fieldName, "cli")
 		validationRules, _ := reflections.GetFieldTag(l.Config, fieldName, "validate")
 		if validationRules != "" {
 			// Determine the label for the field
@@ -319,6 +323,13 @@ func (l Loader) validateField(fieldName string, label string, validationRules st
 			if l.fieldValueIsEmpty(fieldName) {
 				return l.Errorf("Missing %s.", label)
 			}
+		} else if strings.HasPrefix(rule, "required-without:") {
+			// Required, unless the other field is set instead
+			otherFieldName := strings.TrimPrefix(rule, "required-without:")
+			if l.fieldValueIsEmpty(fieldName) && l.fieldValueIsEmpty(otherFieldName) {
+				otherLabel, _ := reflections.GetFieldTag(l.Config, otherFieldName, "cli")
+				return l.Errorf("Missing %s (or %s).", label, otherLabel)
+			}
 		} else if rule == "file-exists" {
 			value, _ := reflections.GetField(l.Config, fieldName)
 
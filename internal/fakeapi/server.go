@@ -0,0 +1,825 @@
+// Package fakeapi provides a fake of the Buildkite Agent API, which agents
+// can be started against to test hooks, plugins and agent configuration
+// without a Buildkite organization. It hands out the jobs it's given to the
+// agents that register with it, and keeps everything they send back: job
+// logs, meta-data, artifacts, annotations and pipeline uploads.
+//
+// IDs and tokens are generated from a seed, so a test that gives it the same
+// seed and the same jobs sees the same IDs each time it's run.
+package fakeapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// The states of a job, from it being added to the server to it finishing
+const (
+	JobStateScheduled = "scheduled"
+	JobStateAssigned  = "assigned"
+	JobStateAccepted  = "accepted"
+	JobStateRunning   = "running"
+	JobStateCanceling = "canceling"
+	JobStateFinished  = "finished"
+	JobStateCanceled  = "canceled"
+)
+
+type Config struct {
+	// The registration token agents have to register with, or empty to let
+	// them register with any
+	Token string
+
+	// What the IDs and tokens the server hands out are generated from
+	Seed int64
+}
+
+// Job is a job the server was given, as it was when it was asked for
+type Job struct {
+	ID        string
+	BuildID   string
+	Env       map[string]string
+	State     string
+	AgentName string
+
+	ExitStatus   string
+	Signal       string
+	SignalReason string
+
+	// The job's log, put back together from the chunks the agent sent
+	Log string
+}
+
+// Artifact is an artifact a job uploaded
+type Artifact struct {
+	ID        string
+	JobID     string
+	Path      string
+	State     string
+	Sha1Sum   string
+	Sha256Sum string
+	Contents  []byte
+}
+
+// PipelineUpload is a pipeline a job uploaded
+type PipelineUpload struct {
+	JobID    string
+	Pipeline any
+	Replace  bool
+}
+
+type agent struct {
+	api.AgentRegisterResponse
+	jobID string
+}
+
+type job struct {
+	Job
+	chunks map[int]string
+
+	// The idempotency key the job was accepted with, so that a retried
+	// accept gets the same answer
+	acceptKey string
+}
+
+func (j *job) done() bool {
+	return j.State == JobStateFinished || j.State == JobStateCanceled
+}
+
+func (j *job) snapshot() Job {
+	snapshot := j.Job
+	snapshot.Env = map[string]string{}
+	for k, v := range j.Env {
+		snapshot.Env[k] = v
+	}
+
+	var sequences []int
+	for sequence := range j.chunks {
+		sequences = append(sequences, sequence)
+	}
+	sort.Ints(sequences)
+
+	var log strings.Builder
+	for _, sequence := range sequences {
+		log.WriteString(j.chunks[sequence])
+	}
+	snapshot.Log = log.String()
+	return snapshot
+}
+
+// Server is a fake of the Agent API
+type Server struct {
+	conf   Config
+	logger logger.Logger
+
+	mu          sync.Mutex
+	rng         *rand.Rand
+	buildID     string
+	agents      map[string]*agent
+	jobs        map[string]*job
+	jobOrder    []string
+	metaData    map[string]map[string]string
+	metaOrder   map[string][]string
+	artifacts   []*Artifact
+	uploads     map[string]*Artifact
+	annotations map[string][]api.Annotation
+	pipelines   []PipelineUpload
+	unhandled   []string
+
+	// Closed and replaced whenever a job changes state, to wake up those
+	// waiting on one
+	changed chan struct{}
+}
+
+func NewServer(l logger.Logger, conf Config) *Server {
+	s := &Server{
+		conf:        conf,
+		logger:      l,
+		rng:         rand.New(rand.NewSource(conf.Seed)),
+		agents:      map[string]*agent{},
+		jobs:        map[string]*job{},
+		metaData:    map[string]map[string]string{},
+		metaOrder:   map[string][]string{},
+		uploads:     map[string]*Artifact{},
+		annotations: map[string][]api.Annotation{},
+		changed:     make(chan struct{}),
+	}
+	s.buildID = s.newUUID()
+	return s
+}
+
+// newUUID returns a version 4 UUID from the server's seeded source
+func (s *Server) newUUID() string {
+	var b [16]byte
+	s.rng.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (s *Server) newToken() string {
+	var b [20]byte
+	s.rng.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// notify wakes up everyone waiting on a job. It must be called with the lock
+// held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// BuildID returns the ID of the build that jobs are part of, unless they
+// were added with their own BUILDKITE_BUILD_ID
+func (s *Server) BuildID() string {
+	return s.buildID
+}
+
+// AddJob adds a job to be run with env, which is given to the next agent that
+// pings the server, returning its ID. The job's ID, build ID and the pipeline
+// the bootstrap needs are set in env unless they're there already.
+func (s *Server) AddJob(env map[string]string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j := &job{
+		Job: Job{
+			ID:    s.newUUID(),
+			State: JobStateScheduled,
+			Env:   map[string]string{},
+		},
+		chunks: map[int]string{},
+	}
+	for k, v := range map[string]string{
+		"BUILDKITE_BUILD_ID":          s.buildID,
+		"BUILDKITE_JOB_ID":            j.ID,
+		"BUILDKITE_ORGANIZATION_SLUG": "fake",
+		"BUILDKITE_PIPELINE_SLUG":     "fake",
+		"BUILDKITE_PIPELINE_PROVIDER": "git",
+		"BUILDKITE_COMMIT":            "HEAD",
+		"BUILDKITE_BRANCH":            "main",
+	} {
+		j.Env[k] = v
+	}
+	for k, v := range env {
+		j.Env[k] = v
+	}
+	j.BuildID = j.Env["BUILDKITE_BUILD_ID"]
+
+	s.jobs[j.ID] = j
+	s.jobOrder = append(s.jobOrder, j.ID)
+	return j.ID
+}
+
+// CancelJob cancels a job, which the agent running it finds out about the
+// next time it checks on it
+func (s *Server) CancelJob(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	switch {
+	case !ok:
+		return fmt.Errorf("no job %q", id)
+	case j.done():
+		return fmt.Errorf("job %q has already finished", id)
+	case j.State == JobStateScheduled:
+		j.State = JobStateCanceled
+	default:
+		j.State = JobStateCanceling
+	}
+	s.notify()
+	return nil
+}
+
+// Job returns the job with id as it is now
+func (s *Server) Job(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return j.snapshot(), true
+}
+
+// Jobs returns all of the jobs, in the order they were added
+func (s *Server) Jobs() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]Job, 0, len(s.jobOrder))
+	for _, id := range s.jobOrder {
+		jobs = append(jobs, s.jobs[id].snapshot())
+	}
+	return jobs
+}
+
+// WaitForJob waits for the job with id to finish, or be canceled
+func (s *Server) WaitForJob(ctx context.Context, id string) (Job, error) {
+	for {
+		s.mu.Lock()
+		j, ok := s.jobs[id]
+		changed := s.changed
+		if !ok {
+			s.mu.Unlock()
+			return Job{}, fmt.Errorf("no job %q", id)
+		}
+		if j.done() {
+			snapshot := j.snapshot()
+			s.mu.Unlock()
+			return snapshot, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return Job{}, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// MetaData returns the meta-data the build's jobs set, in the order they
+// were first set
+func (s *Server) MetaData(buildID string) []api.MetaData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var data []api.MetaData
+	for _, key := range s.metaOrder[buildID] {
+		data = append(data, api.MetaData{Key: key, Value: s.metaData[buildID][key]})
+	}
+	return data
+}
+
+// Artifacts returns the artifacts jobs uploaded, in the order they were
+func (s *Server) Artifacts() []Artifact {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	artifacts := make([]Artifact, 0, len(s.artifacts))
+	for _, a := range s.artifacts {
+		artifacts = append(artifacts, *a)
+	}
+	return artifacts
+}
+
+// Annotations returns the build's annotations, in the order they were first
+// made
+func (s *Server) Annotations(buildID string) []api.Annotation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]api.Annotation(nil), s.annotations[buildID]...)
+}
+
+// Pipelines returns the pipelines jobs uploaded, in the order they were
+func (s *Server) Pipelines() []PipelineUpload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]PipelineUpload(nil), s.pipelines...)
+}
+
+// Unhandled returns the requests the server didn't know how to handle, as
+// the method and path, which usually means the fake is missing something the
+// agent needs
+func (s *Server) Unhandled() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.unhandled...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Agents may be given an endpoint with the API's version in it
+	route := strings.TrimPrefix(strings.Trim(r.URL.Path, "/"), "v3/")
+	parts := strings.Split(route, "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Uploads and downloads of artifacts aren't made with the agent's token
+	switch {
+	case len(parts) == 2 && parts[0] == "artifact-uploads" && r.Method == http.MethodPost:
+		s.uploadArtifact(w, r, parts[1])
+		return
+	case len(parts) == 2 && parts[0] == "artifacts" && r.Method == http.MethodGet:
+		s.downloadArtifact(w, parts[1])
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Token ")
+	if route == "register" && r.Method == http.MethodPost {
+		if s.conf.Token != "" && token != s.conf.Token {
+			http.Error(w, `{"message":"Invalid registration token"}`, http.StatusUnauthorized)
+			return
+		}
+		s.register(w, r)
+		return
+	}
+
+	ag, ok := s.agents[token]
+	if !ok {
+		http.Error(w, `{"message":"Invalid access token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case route == "connect" && r.Method == http.MethodPost,
+		route == "disconnect" && r.Method == http.MethodPost:
+		writeJSON(w, http.StatusOK, ag.AgentRegisterResponse)
+
+	case route == "heartbeat" && r.Method == http.MethodPost:
+		var heartbeat api.Heartbeat
+		_ = json.NewDecoder(r.Body).Decode(&heartbeat)
+		heartbeat.ReceivedAt = time.Now().Format(time.RFC3339Nano)
+		writeJSON(w, http.StatusOK, heartbeat)
+
+	case route == "ping" && r.Method == http.MethodGet:
+		s.ping(w, ag)
+
+	case len(parts) >= 2 && parts[0] == "jobs":
+		j, ok := s.jobs[parts[1]]
+		if !ok {
+			http.Error(w, `{"message":"No job found"}`, http.StatusNotFound)
+			return
+		}
+		s.serveJob(w, r, ag, j, strings.Join(parts[2:], "/"))
+
+	case len(parts) == 4 && parts[0] == "builds" && parts[2] == "artifacts" && parts[3] == "search" && r.Method == http.MethodGet:
+		s.searchArtifacts(w, r, parts[1])
+
+	default:
+		s.unhandle(w, r)
+	}
+}
+
+func (s *Server) unhandle(w http.ResponseWriter, r *http.Request) {
+	s.logger.Warn("[FakeAPI] Unhandled request %s %s", r.Method, r.URL.Path)
+	s.unhandled = append(s.unhandled, r.Method+" "+r.URL.Path)
+	http.Error(w, `{"message":"Not handled by the fake Agent API"}`, http.StatusNotFound)
+}
+
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	var req api.AgentRegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Buildkite names agents that don't have a name after their host
+	name := req.Name
+	if name == "" {
+		hostname := req.Hostname
+		if hostname == "" {
+			hostname = "agent"
+		}
+		name = fmt.Sprintf("%s-%d", hostname, len(s.agents)+1)
+	}
+
+	ag := &agent{AgentRegisterResponse: api.AgentRegisterResponse{
+		UUID:              s.newUUID(),
+		Name:              name,
+		AccessToken:       s.newToken(),
+		PingInterval:      1,
+		JobStatusInterval: 1,
+		HeartbeatInterval: 60,
+		Tags:              req.Tags,
+	}}
+	s.agents[ag.AccessToken] = ag
+	writeJSON(w, http.StatusOK, ag.AgentRegisterResponse)
+}
+
+// ping hands the next scheduled job to the agent, unless it's running one
+func (s *Server) ping(w http.ResponseWriter, ag *agent) {
+	ping := api.Ping{}
+
+	if current, ok := s.jobs[ag.jobID]; !ok || current.done() {
+		for _, id := range s.jobOrder {
+			j := s.jobs[id]
+			if j.State != JobStateScheduled {
+				continue
+			}
+			j.State = JobStateAssigned
+			j.AgentName = ag.Name
+			j.Env["BUILDKITE_AGENT_ID"] = ag.UUID
+			j.Env["BUILDKITE_AGENT_NAME"] = ag.Name
+			ag.jobID = j.ID
+			ping.Job = s.apiJob(j)
+			s.notify()
+			break
+		}
+	}
+
+	writeJSON(w, http.StatusOK, ping)
+}
+
+func (s *Server) apiJob(j *job) *api.Job {
+	return &api.Job{
+		ID:                 j.ID,
+		State:              j.State,
+		Env:                j.Env,
+		ChunksMaxSizeBytes: 100 * 1024,
+	}
+}
+
+func (s *Server) serveJob(w http.ResponseWriter, r *http.Request, ag *agent, j *job, action string) {
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, api.JobState{State: j.State})
+
+	case action == "accept" && r.Method == http.MethodPut,
+		action == "acquire" && r.Method == http.MethodPut:
+		key := r.Header.Get(api.IdempotencyKeyHeader)
+		if key != "" && key == j.acceptKey && ag.jobID == j.ID {
+			writeJSON(w, http.StatusOK, s.apiJob(j))
+			return
+		}
+		if action == "acquire" && j.State == JobStateScheduled {
+			j.AgentName = ag.Name
+			j.Env["BUILDKITE_AGENT_ID"] = ag.UUID
+			j.Env["BUILDKITE_AGENT_NAME"] = ag.Name
+			ag.jobID = j.ID
+		} else if j.State != JobStateAssigned || ag.jobID != j.ID {
+			http.Error(w, `{"message":"Job can't be accepted"}`, http.StatusUnprocessableEntity)
+			return
+		}
+		j.State = JobStateAccepted
+		j.acceptKey = key
+		s.notify()
+		writeJSON(w, http.StatusOK, s.apiJob(j))
+
+	case action == "start" && r.Method == http.MethodPut:
+		if j.State == JobStateAccepted {
+			j.State = JobStateRunning
+			s.notify()
+		}
+		writeJSON(w, http.StatusOK, api.JobState{State: j.State})
+
+	case action == "finish" && r.Method == http.MethodPut:
+		var finish api.Job
+		if err := json.NewDecoder(r.Body).Decode(&finish); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		j.ExitStatus = finish.ExitStatus
+		j.Signal = finish.Signal
+		j.SignalReason = finish.SignalReason
+		if j.State == JobStateCanceling {
+			j.State = JobStateCanceled
+		} else {
+			j.State = JobStateFinished
+		}
+		s.notify()
+		writeJSON(w, http.StatusOK, api.JobState{State: j.State})
+
+	case action == "chunks" && r.Method == http.MethodPost:
+		sequence, err := strconv.Atoi(r.URL.Query().Get("sequence"))
+		if err != nil {
+			http.Error(w, "Invalid sequence", http.StatusBadRequest)
+			return
+		}
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = gz
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		j.chunks[sequence] = string(data)
+		w.WriteHeader(http.StatusCreated)
+
+	case action == "header_times" && r.Method == http.MethodPost:
+		w.WriteHeader(http.StatusOK)
+
+	case strings.HasPrefix(action, "data/") && r.Method == http.MethodPost:
+		s.serveMetaData(w, r, j, strings.TrimPrefix(action, "data/"))
+
+	case action == "annotations" && r.Method == http.MethodPost:
+		var annotation api.Annotation
+		if err := json.NewDecoder(r.Body).Decode(&annotation); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.annotate(j.BuildID, annotation)
+		w.WriteHeader(http.StatusCreated)
+
+	case strings.HasPrefix(action, "annotations/") && r.Method == http.MethodDelete:
+		context := strings.TrimPrefix(action, "annotations/")
+		annotations := s.annotations[j.BuildID][:0]
+		for _, annotation := range s.annotations[j.BuildID] {
+			if annotation.Context != context {
+				annotations = append(annotations, annotation)
+			}
+		}
+		s.annotations[j.BuildID] = annotations
+		w.WriteHeader(http.StatusOK)
+
+	case action == "pipelines" && r.Method == http.MethodPost:
+		var change api.PipelineChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.pipelines = append(s.pipelines, PipelineUpload{JobID: j.ID, Pipeline: change.Pipeline, Replace: change.Replace})
+		w.WriteHeader(http.StatusCreated)
+
+	case action == "artifacts" && r.Method == http.MethodPost:
+		s.createArtifacts(w, r, j)
+
+	case action == "artifacts" && r.Method == http.MethodPut:
+		var update api.ArtifactBatchUpdateRequest
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, u := range update.Artifacts {
+			if a := s.artifact(j.ID, u.ID); a != nil {
+				a.State = u.State
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		s.unhandle(w, r)
+	}
+}
+
+func (s *Server) annotate(buildID string, annotation api.Annotation) {
+	if annotation.Context == "" {
+		annotation.Context = "default"
+	}
+	for i, existing := range s.annotations[buildID] {
+		if existing.Context != annotation.Context {
+			continue
+		}
+		if annotation.Append {
+			annotation.Body = existing.Body + annotation.Body
+		}
+		if annotation.Style == "" {
+			annotation.Style = existing.Style
+		}
+		annotation.Append = false
+		s.annotations[buildID][i] = annotation
+		return
+	}
+	annotation.Append = false
+	s.annotations[buildID] = append(s.annotations[buildID], annotation)
+}
+
+func (s *Server) serveMetaData(w http.ResponseWriter, r *http.Request, j *job, action string) {
+	var req api.MetaData
+	if action != "keys" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	data := s.metaData[j.BuildID]
+	switch action {
+	case "set":
+		if data == nil {
+			data = map[string]string{}
+			s.metaData[j.BuildID] = data
+		}
+		if _, exists := data[req.Key]; !exists {
+			s.metaOrder[j.BuildID] = append(s.metaOrder[j.BuildID], req.Key)
+		}
+		data[req.Key] = req.Value
+		w.WriteHeader(http.StatusOK)
+
+	case "get":
+		value, exists := data[req.Key]
+		if !exists {
+			http.Error(w, `{"message":"No key found"}`, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, api.MetaData{Key: req.Key, Value: value})
+
+	case "exists":
+		_, exists := data[req.Key]
+		writeJSON(w, http.StatusOK, api.MetaDataExists{Exists: exists})
+
+	case "keys":
+		keys := append([]string{}, s.metaOrder[j.BuildID]...)
+		writeJSON(w, http.StatusOK, keys)
+
+	default:
+		s.unhandle(w, r)
+	}
+}
+
+func (s *Server) createArtifacts(w http.ResponseWriter, r *http.Request, j *job) {
+	var batch api.ArtifactBatch
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Like Buildkite, it uses the IDs the agent gives the batch and its
+	// artifacts, so creating them again doesn't duplicate them
+	if batch.ID == "" {
+		batch.ID = s.newUUID()
+	}
+
+	creation := api.ArtifactBatchCreateResponse{
+		ID:                 batch.ID,
+		UploadInstructions: &api.ArtifactUploadInstructions{Data: map[string]string{"path": "${artifact:path}"}},
+	}
+	creation.UploadInstructions.Action.URL = "http://" + r.Host
+	creation.UploadInstructions.Action.Method = http.MethodPost
+	creation.UploadInstructions.Action.Path = "/artifact-uploads/" + creation.ID
+	creation.UploadInstructions.Action.FileInput = "file"
+
+	for _, a := range batch.Artifacts {
+		artifact := s.artifact(j.ID, a.ID)
+		if artifact == nil {
+			id := a.ID
+			if id == "" {
+				id = s.newUUID()
+			}
+			artifact = &Artifact{
+				ID:        id,
+				JobID:     j.ID,
+				Path:      a.Path,
+				State:     "new",
+				Sha1Sum:   a.Sha1Sum,
+				Sha256Sum: a.Sha256Sum,
+			}
+			s.artifacts = append(s.artifacts, artifact)
+		}
+		s.uploads[creation.ID+"/"+a.Path] = artifact
+		creation.ArtifactIDs = append(creation.ArtifactIDs, artifact.ID)
+	}
+
+	writeJSON(w, http.StatusCreated, creation)
+}
+
+// artifact returns the job's artifact with the ID, if it's been created
+func (s *Server) artifact(jobID, id string) *Artifact {
+	if id == "" {
+		return nil
+	}
+	for _, a := range s.artifacts {
+		if a.ID == id && a.JobID == jobID {
+			return a
+		}
+	}
+	return nil
+}
+
+func (s *Server) uploadArtifact(w http.ResponseWriter, r *http.Request, batchID string) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	artifact, ok := s.uploads[batchID+"/"+r.FormValue("path")]
+	if !ok {
+		http.Error(w, "No artifact to upload", http.StatusNotFound)
+		return
+	}
+
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+
+	contents, err := io.ReadAll(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sha1Sum := sha1.Sum(contents)
+	sha256Sum := sha256.Sum256(contents)
+	if artifact.Sha1Sum != "" && artifact.Sha1Sum != hex.EncodeToString(sha1Sum[:]) ||
+		artifact.Sha256Sum != "" && artifact.Sha256Sum != hex.EncodeToString(sha256Sum[:]) {
+		http.Error(w, "The artifact's contents don't match its checksum", http.StatusBadRequest)
+		return
+	}
+
+	artifact.Contents = contents
+	delete(s.uploads, batchID+"/"+artifact.Path)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) downloadArtifact(w http.ResponseWriter, id string) {
+	for _, a := range s.artifacts {
+		if a.ID == id && a.Contents != nil {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = io.Copy(w, bytes.NewReader(a.Contents))
+			return
+		}
+	}
+	http.Error(w, "No artifact found", http.StatusNotFound)
+}
+
+// searchArtifacts finds the build's uploaded artifacts whose paths match the
+// query, as a glob, and which are in the state and from the job in the scope
+// if they're given
+func (s *Server) searchArtifacts(w http.ResponseWriter, r *http.Request, buildID string) {
+	query := r.URL.Query().Get("query")
+	state := r.URL.Query().Get("state")
+	scope := r.URL.Query().Get("scope")
+
+	results := []*api.Artifact{}
+	for _, a := range s.artifacts {
+		j := s.jobs[a.JobID]
+		if j == nil || j.BuildID != buildID || (state != "" && a.State != state) || (scope != "" && a.JobID != scope) {
+			continue
+		}
+		if query != "" && query != a.Path {
+			if matched, _ := path.Match(query, a.Path); !matched {
+				continue
+			}
+		}
+		results = append(results, &api.Artifact{
+			ID:        a.ID,
+			Path:      a.Path,
+			FileSize:  int64(len(a.Contents)),
+			Sha1Sum:   a.Sha1Sum,
+			Sha256Sum: a.Sha256Sum,
+			JobID:     a.JobID,
+			URL:       "http://" + r.Host + "/artifacts/" + a.ID,
+		})
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
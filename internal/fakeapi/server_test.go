@@ -0,0 +1,209 @@
+package fakeapi
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerRunsAJob(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	server := NewServer(logger.Discard, Config{Token: "llamas", Seed: 1})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	jobID := server.AddJob(map[string]string{"BUILDKITE_COMMAND": "echo hello"})
+
+	_, _, err := api.NewClient(logger.Discard, api.Config{Endpoint: ts.URL, Token: "alpacas"}).
+		Register(ctx, &api.AgentRegisterRequest{Name: "agent-1"})
+	assert.Error(t, err, "it should only register agents with its token")
+
+	reg, _, err := api.NewClient(logger.Discard, api.Config{Endpoint: ts.URL, Token: "llamas"}).
+		Register(ctx, &api.AgentRegisterRequest{Name: "agent-1"})
+	require.NoError(t, err)
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: ts.URL, Token: reg.AccessToken})
+
+	ping, _, err := client.Ping(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, ping.Job)
+	assert.Equal(t, jobID, ping.Job.ID)
+	assigned := ping.Job
+
+	ping, _, err = client.Ping(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, ping.Job, "it shouldn't give an agent a job while it's running one")
+
+	key := api.Header{Name: api.IdempotencyKeyHeader, Value: "accept-1"}
+	job, _, err := client.AcceptJob(ctx, assigned, key)
+	require.NoError(t, err)
+
+	_, _, err = client.AcceptJob(ctx, assigned, key)
+	require.NoError(t, err, "a retried accept with the same key should succeed")
+	_, _, err = client.AcceptJob(ctx, assigned)
+	assert.Error(t, err, "the job shouldn't be accepted twice")
+	assert.Equal(t, "echo hello", job.Env["BUILDKITE_COMMAND"])
+	assert.Equal(t, "agent-1", job.Env["BUILDKITE_AGENT_NAME"])
+	assert.Equal(t, server.BuildID(), job.Env["BUILDKITE_BUILD_ID"])
+
+	_, err = client.StartJob(ctx, job)
+	require.NoError(t, err)
+
+	_, err = client.UploadChunk(ctx, job.ID, &api.Chunk{Data: "world\n", Sequence: 2, Offset: 6, Size: 6})
+	require.NoError(t, err)
+	_, err = client.UploadChunk(ctx, job.ID, &api.Chunk{Data: "hello\n", Sequence: 1, Offset: 0, Size: 6})
+	require.NoError(t, err)
+
+	_, err = client.SetMetaData(ctx, job.ID, &api.MetaData{Key: "release", Value: "v1"})
+	require.NoError(t, err)
+	data, _, err := client.GetMetaData(ctx, job.ID, "release")
+	require.NoError(t, err)
+	assert.Equal(t, "v1", data.Value)
+	exists, _, err := client.ExistsMetaData(ctx, job.ID, "nope")
+	require.NoError(t, err)
+	assert.False(t, exists.Exists)
+
+	_, err = client.Annotate(ctx, job.ID, &api.Annotation{Body: "Hello", Context: "greeting"})
+	require.NoError(t, err)
+	_, err = client.Annotate(ctx, job.ID, &api.Annotation{Body: " world", Context: "greeting", Append: true})
+	require.NoError(t, err)
+
+	job.ExitStatus = "0"
+	_, err = client.FinishJob(ctx, job)
+	require.NoError(t, err)
+
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	finished, err := server.WaitForJob(waitCtx, jobID)
+	require.NoError(t, err)
+
+	assert.Equal(t, JobStateFinished, finished.State)
+	assert.Equal(t, "0", finished.ExitStatus)
+	assert.Equal(t, "agent-1", finished.AgentName)
+	assert.Equal(t, "hello\nworld\n", finished.Log)
+	assert.Equal(t, []api.MetaData{{Key: "release", Value: "v1"}}, server.MetaData(server.BuildID()))
+	assert.Equal(t, []api.Annotation{{Body: "Hello world", Context: "greeting"}}, server.Annotations(server.BuildID()))
+	assert.Empty(t, server.Unhandled())
+}
+
+func TestServerArtifacts(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	server := NewServer(logger.Discard, Config{})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	jobID := server.AddJob(nil)
+
+	reg, _, err := api.NewClient(logger.Discard, api.Config{Endpoint: ts.URL, Token: "llamas"}).
+		Register(ctx, &api.AgentRegisterRequest{Name: "agent-1"})
+	require.NoError(t, err)
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: ts.URL, Token: reg.AccessToken})
+
+	creation, _, err := client.CreateArtifacts(ctx, jobID, &api.ArtifactBatch{
+		Artifacts: []*api.Artifact{{Path: "logs/out.txt"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, creation.ArtifactIDs, 1)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for k, v := range creation.UploadInstructions.Data {
+		if v == "${artifact:path}" {
+			v = "logs/out.txt"
+		}
+		require.NoError(t, form.WriteField(k, v))
+	}
+	fw, err := form.CreateFormFile(creation.UploadInstructions.Action.FileInput, "out.txt")
+	require.NoError(t, err)
+	_, _ = fw.Write([]byte("some output"))
+	require.NoError(t, form.Close())
+
+	action := creation.UploadInstructions.Action
+	resp, err := http.Post(action.URL+action.Path, form.FormDataContentType(), &body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	_, err = client.UpdateArtifacts(ctx, jobID, map[string]string{creation.ArtifactIDs[0]: "finished"})
+	require.NoError(t, err)
+
+	found, _, err := client.SearchArtifacts(ctx, server.BuildID(), &api.ArtifactSearchOptions{Query: "logs/*.txt", State: "finished"})
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, "logs/out.txt", found[0].Path)
+
+	resp, err = http.Get(found[0].URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var downloaded bytes.Buffer
+	_, _ = downloaded.ReadFrom(resp.Body)
+	assert.Equal(t, "some output", downloaded.String())
+
+	artifacts := server.Artifacts()
+	require.Len(t, artifacts, 1)
+	assert.Equal(t, "finished", artifacts[0].State)
+	assert.Equal(t, []byte("some output"), artifacts[0].Contents)
+}
+
+func TestServerIsDeterministic(t *testing.T) {
+	t.Parallel()
+
+	ids := func(seed int64) []string {
+		server := NewServer(logger.Discard, Config{Seed: seed})
+		return []string{server.BuildID(), server.AddJob(nil), server.AddJob(nil)}
+	}
+
+	assert.Equal(t, ids(42), ids(42))
+	assert.NotEqual(t, ids(42), ids(43))
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, ids(42)[0])
+}
+
+func TestServerCancelsJobs(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	server := NewServer(logger.Discard, Config{})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	jobID := server.AddJob(nil)
+
+	reg, _, err := api.NewClient(logger.Discard, api.Config{Endpoint: ts.URL, Token: "llamas"}).
+		Register(ctx, &api.AgentRegisterRequest{Name: "agent-1"})
+	require.NoError(t, err)
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: ts.URL, Token: reg.AccessToken})
+
+	job, _, err := client.AcquireJob(ctx, jobID)
+	require.NoError(t, err)
+	_, err = client.StartJob(ctx, job)
+	require.NoError(t, err)
+
+	require.NoError(t, server.CancelJob(jobID))
+
+	state, _, err := client.GetJobState(ctx, jobID)
+	require.NoError(t, err)
+	assert.Equal(t, JobStateCanceling, state.State)
+
+	job.ExitStatus = "-1"
+	job.SignalReason = "cancel"
+	_, err = client.FinishJob(ctx, job)
+	require.NoError(t, err)
+
+	canceled, ok := server.Job(jobID)
+	require.True(t, ok)
+	assert.Equal(t, JobStateCanceled, canceled.State)
+	assert.Equal(t, "cancel", canceled.SignalReason)
+}
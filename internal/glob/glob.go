@@ -0,0 +1,576 @@
+// Package glob matches artifact paths against glob patterns, and finds the
+// files that match them. Uploads and downloads of artifacts share it, so a
+// pattern means the same thing to both, on every platform:
+//
+//   - / separates the components of a path. On Windows, so does \.
+//   - * matches any run of characters in a component, and ? any one of them.
+//     Both match a leading dot.
+//   - [abc], [a-z] and [!abc] (or [^abc]) match one character in, or not in,
+//     a class of them.
+//   - ** as a whole component matches any number of components, including
+//     none, so a/**/b matches a/b and a/x/y/b, and a/** matches everything
+//     in a. Anywhere else it's the same as *.
+//   - {a,b,c} matches any one of a, b or c, which can be patterns themselves,
+//     with their own braces or slashes.
+//   - Except on Windows, \ matches the character after it literally.
+//
+// A Set of patterns can have exclusions: patterns starting with ! that
+// exclude the paths they match from those the other patterns include,
+// whatever order they're in.
+package glob
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// Whether \ escapes the next character, rather than separating components
+var escapes = runtime.GOOS != "windows"
+
+// Pattern is a glob pattern
+type Pattern struct {
+	pattern    string
+	expansions []*expansion
+}
+
+// expansion is one of the patterns a pattern's braces expand to
+type expansion struct {
+	pattern string
+	re      *regexp.Regexp
+
+	// The directory the matches are in, and how many components below it
+	// they can be, or -1 for any number
+	base     string
+	maxDepth int
+
+	// Whether the pattern has no wildcards, and is only ever matched by
+	// itself
+	literal bool
+}
+
+// Compile parses a pattern
+func Compile(pattern string) (*Pattern, error) {
+	if pattern == "" {
+		return nil, errors.New("empty pattern")
+	}
+
+	p := &Pattern{pattern: pattern}
+	for _, e := range expandBraces(toSlash(pattern)) {
+		e = trimDotSlash(e)
+		re, err := regexp.Compile("^" + patternRegexp(e) + "$")
+		if err != nil {
+			return nil, err
+		}
+
+		base, rest := splitBase(e)
+		depth := -1
+		if !hasGlobstar(rest) {
+			depth = strings.Count(rest, "/") + 1
+		}
+
+		p.expansions = append(p.expansions, &expansion{
+			pattern:  e,
+			re:       re,
+			base:     base,
+			maxDepth: depth,
+			literal:  !hasMeta(e),
+		})
+	}
+	return p, nil
+}
+
+// String returns the pattern as it was given
+func (p *Pattern) String() string {
+	return p.pattern
+}
+
+// Expansions returns the patterns the pattern's braces expand to, with /
+// separators
+func (p *Pattern) Expansions() []string {
+	expansions := make([]string, 0, len(p.expansions))
+	for _, e := range p.expansions {
+		expansions = append(expansions, e.pattern)
+	}
+	return expansions
+}
+
+// Match returns whether the pattern matches a path
+func (p *Pattern) Match(path string) bool {
+	path = trimDotSlash(toSlash(path))
+	for _, e := range p.expansions {
+		if e.re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Literal returns whether the pattern names a path without any wildcards,
+// rather than matching it
+func (p *Pattern) Literal(path string) bool {
+	path = trimDotSlash(toSlash(path))
+	for _, e := range p.expansions {
+		if e.literal && e.re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Glob returns the files and directories that match the pattern, in the
+// order they're found. Relative patterns are relative to the working
+// directory. Symbolic links to directories are only followed into if
+// followSymlinks is true. A pattern without any wildcards returns an error
+// satisfying errors.Is(err, os.ErrNotExist) if its file doesn't exist.
+func (p *Pattern) Glob(followSymlinks bool) ([]string, error) {
+	var matches []string
+	seen := make(map[string]bool)
+	literal := true
+
+	for _, e := range p.expansions {
+		literal = literal && e.literal && len(p.expansions) == 1
+
+		found, err := e.glob(followSymlinks)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range found {
+			if !seen[m] {
+				seen[m] = true
+				matches = append(matches, m)
+			}
+		}
+	}
+
+	if literal && len(matches) == 0 {
+		return nil, &os.PathError{Op: "glob", Path: p.pattern, Err: os.ErrNotExist}
+	}
+	return matches, nil
+}
+
+func (e *expansion) glob(followSymlinks bool) ([]string, error) {
+	if e.literal {
+		if _, err := os.Lstat(filepath.FromSlash(e.pattern)); err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return []string{filepath.FromSlash(e.pattern)}, nil
+	}
+
+	dir := e.base
+	if dir == "" {
+		dir = "."
+	}
+	info, err := os.Stat(filepath.FromSlash(dir))
+	if err != nil || !info.IsDir() {
+		// Nothing can match in a directory that isn't there
+		return nil, nil
+	}
+
+	w := &walker{expansion: e, followSymlinks: followSymlinks}
+	if followSymlinks {
+		if real, err := realPath(dir); err == nil {
+			w.ancestors = append(w.ancestors, real)
+		}
+	}
+	w.walk(e.base, 1)
+	return w.matches, nil
+}
+
+// walker finds the paths that match an expansion in the directories below
+// its base
+type walker struct {
+	*expansion
+	followSymlinks bool
+	matches        []string
+
+	// The real paths of the directories being walked, so links back to them
+	// aren't followed round in circles
+	ancestors []string
+}
+
+func (w *walker) walk(dir string, depth int) {
+	osDir := filepath.FromSlash(dir)
+	if dir == "" {
+		osDir = "."
+	}
+
+	// Directories that can't be read can't have matches found in them
+	entries, err := os.ReadDir(osDir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		path := joinPath(dir, entry.Name())
+		if w.re.MatchString(path) {
+			w.matches = append(w.matches, filepath.FromSlash(path))
+		}
+
+		if w.maxDepth >= 0 && depth >= w.maxDepth {
+			continue
+		}
+
+		switch {
+		case !w.followSymlinks:
+			if entry.IsDir() {
+				w.walk(path, depth+1)
+			}
+
+		case entry.IsDir() || entry.Type()&os.ModeSymlink != 0:
+			real, err := realPath(path)
+			if err != nil {
+				continue
+			}
+			if info, err := os.Stat(real); err != nil || !info.IsDir() || w.isAncestor(real) {
+				continue
+			}
+			w.ancestors = append(w.ancestors, real)
+			w.walk(path, depth+1)
+			w.ancestors = w.ancestors[:len(w.ancestors)-1]
+		}
+	}
+}
+
+// realPath returns the absolute path of a file with no symbolic links in it
+func realPath(path string) (string, error) {
+	abs, err := filepath.Abs(filepath.FromSlash(path))
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+func (w *walker) isAncestor(real string) bool {
+	for _, a := range w.ancestors {
+		if a == real {
+			return true
+		}
+	}
+	return false
+}
+
+// Set is a list of patterns, some of which may be exclusions
+type Set struct {
+	include []*Pattern
+	exclude []*Pattern
+}
+
+// NewSet parses a list of patterns. Those starting with ! are exclusions,
+// and empty ones are ignored.
+func NewSet(patterns []string) (*Set, error) {
+	s := &Set{}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		exclude := strings.HasPrefix(pattern, "!")
+		p, err := Compile(strings.TrimPrefix(pattern, "!"))
+		if err != nil {
+			return nil, err
+		}
+
+		if exclude {
+			s.exclude = append(s.exclude, p)
+		} else {
+			s.include = append(s.include, p)
+		}
+	}
+	return s, nil
+}
+
+// Include returns the patterns that include paths, in the order they were
+// given
+func (s *Set) Include() []*Pattern {
+	return s.include
+}
+
+// Empty returns whether the set doesn't have any patterns, not even
+// exclusions
+func (s *Set) Empty() bool {
+	return len(s.include) == 0 && len(s.exclude) == 0
+}
+
+// Match returns whether one of the set's patterns includes a path, and none
+// of its exclusions exclude it
+func (s *Set) Match(path string) bool {
+	for _, p := range s.include {
+		if p.Match(path) {
+			return !s.Excluded(path)
+		}
+	}
+	return false
+}
+
+// Excluded returns whether one of the set's exclusions excludes a path
+func (s *Set) Excluded(path string) bool {
+	for _, p := range s.exclude {
+		if p.Match(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func toSlash(path string) string {
+	if escapes {
+		return path
+	}
+	return strings.ReplaceAll(path, `\`, "/")
+}
+
+func trimDotSlash(path string) string {
+	for strings.HasPrefix(path, "./") && len(path) > 2 {
+		path = path[2:]
+	}
+	return path
+}
+
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	if strings.HasSuffix(dir, "/") {
+		return dir + name
+	}
+	return dir + "/" + name
+}
+
+// splitBase splits a pattern into the directory before its first wildcard,
+// and the rest of it
+func splitBase(pattern string) (base, rest string) {
+	slash := -1
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' && escapes:
+			i++
+		case c == '*' || c == '?' || c == '[':
+			if slash == 0 {
+				return "/", pattern[1:]
+			}
+			if slash < 0 {
+				return "", pattern
+			}
+			base = unescape(pattern[:slash])
+			if base != "" && filepath.VolumeName(base) == base {
+				// C: is the working directory on C, not its root
+				base += "/"
+			}
+			return base, pattern[slash+1:]
+		case c == '/':
+			slash = i
+		}
+	}
+	return "", pattern
+}
+
+func unescape(s string) string {
+	if !escapes || !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// hasMeta returns whether a pattern (without braces) has any wildcards in it
+func hasMeta(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			if escapes {
+				return true
+			}
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+func hasGlobstar(pattern string) bool {
+	for _, c := range strings.Split(pattern, "/") {
+		if c == "**" {
+			return true
+		}
+	}
+	return false
+}
+
+// patternRegexp translates a pattern without braces into a regular
+// expression
+func patternRegexp(pattern string) string {
+	var b strings.Builder
+	components := strings.Split(pattern, "/")
+
+	for i, c := range components {
+		last := i == len(components)-1
+
+		if c == "**" {
+			if last {
+				b.WriteString(".*")
+			} else {
+				// Any number of components, and the slashes after them
+				b.WriteString("(?:[^/]*/)*")
+			}
+			continue
+		}
+
+		b.WriteString(componentRegexp(c))
+		if !last {
+			b.WriteString("/")
+		}
+	}
+	return b.String()
+}
+
+func componentRegexp(c string) string {
+	var b strings.Builder
+	for i := 0; i < len(c); i++ {
+		switch ch := c[i]; ch {
+		case '*':
+			b.WriteString("[^/]*")
+			for i+1 < len(c) && c[i+1] == '*' {
+				i++
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			class, n := classRegexp(c[i:])
+			if n == 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			b.WriteString(class)
+			i += n - 1
+		case '\\':
+			if escapes && i+1 < len(c) {
+				i++
+				b.WriteString(regexp.QuoteMeta(c[i : i+1]))
+				continue
+			}
+			b.WriteString(`\\`)
+		default:
+			b.WriteString(regexp.QuoteMeta(c[i : i+1]))
+		}
+	}
+	return b.String()
+}
+
+// classRegexp translates the character class at the start of s, returning
+// how much of s it was, or 0 if it isn't closed
+func classRegexp(s string) (string, int) {
+	i := 1
+	negate := false
+	if i < len(s) && (s[i] == '!' || s[i] == '^') {
+		negate = true
+		i++
+	}
+
+	var b strings.Builder
+	b.WriteString("[")
+	if negate {
+		b.WriteString("^/")
+	}
+
+	start := i
+	for ; i < len(s); i++ {
+		ch := s[i]
+		if ch == ']' && i > start {
+			b.WriteString("]")
+			return b.String(), i + 1
+		}
+		if ch == '\\' && escapes && i+1 < len(s) {
+			i++
+			ch = s[i]
+		}
+		if ch == '-' && i > start && i+1 < len(s) && s[i+1] != ']' {
+			b.WriteByte('-')
+			continue
+		}
+		if strings.IndexByte(`\[]^-`, ch) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(ch)
+	}
+	return "", 0
+}
+
+// expandBraces returns the patterns a pattern's braces expand to, in order.
+// Braces without a comma in them, or that aren't closed, aren't expanded.
+func expandBraces(pattern string) []string {
+	start, end, commas := findBraces(pattern)
+	if start < 0 {
+		return []string{pattern}
+	}
+
+	prefix, suffix := pattern[:start], pattern[end+1:]
+	var alternatives []string
+	last := start + 1
+	for _, comma := range commas {
+		alternatives = append(alternatives, pattern[last:comma])
+		last = comma + 1
+	}
+	alternatives = append(alternatives, pattern[last:end])
+
+	var expanded []string
+	for _, a := range alternatives {
+		expanded = append(expanded, expandBraces(prefix+a+suffix)...)
+	}
+	return expanded
+}
+
+// findBraces finds the first pair of braces with a comma in them, and the
+// commas between them that aren't in other braces
+func findBraces(pattern string) (start, end int, commas []int) {
+	for ; start < len(pattern); start++ {
+		c := pattern[start]
+		if c == '\\' && escapes {
+			start++
+			continue
+		}
+		if c != '{' {
+			continue
+		}
+
+		depth := 0
+		commas = commas[:0]
+		for i := start + 1; i < len(pattern); i++ {
+			switch pattern[i] {
+			case '\\':
+				if escapes {
+					i++
+				}
+			case '{':
+				depth++
+			case ',':
+				if depth == 0 {
+					commas = append(commas, i)
+				}
+			case '}':
+				if depth > 0 {
+					depth--
+					continue
+				}
+				if len(commas) > 0 {
+					return start, i, commas
+				}
+				i = len(pattern)
+			}
+		}
+	}
+	return -1, -1, nil
+}
@@ -0,0 +1,228 @@
+package glob
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandBraces(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		pattern string
+		want    []string
+	}{
+		{pattern: "a/*.txt", want: []string{"a/*.txt"}},
+		{pattern: "*.{jpg,png}", want: []string{"*.jpg", "*.png"}},
+		{pattern: "{a,b/c}/{x,y}", want: []string{"a/x", "a/y", "b/c/x", "b/c/y"}},
+		{pattern: "a{b,c{d,e}}f", want: []string{"abf", "acdf", "acef"}},
+		{pattern: "{a,}b", want: []string{"ab", "b"}},
+		{pattern: "{a}b", want: []string{"{a}b"}},
+		{pattern: "{a,b", want: []string{"{a,b"}},
+	} {
+		tc := tc
+		t.Run(tc.pattern, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.want, expandBraces(tc.pattern))
+		})
+	}
+}
+
+func TestPatternMatch(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		pattern string
+		match   []string
+		noMatch []string
+	}{
+		{
+			pattern: "*.log",
+			match:   []string{"build.log", ".log", "./build.log"},
+			noMatch: []string{"logs/build.log", "build.log.gz"},
+		},
+		{
+			pattern: "logs/**/*.log",
+			match:   []string{"logs/a.log", "logs/x/a.log", "logs/x/y/z/a.log"},
+			noMatch: []string{"a.log", "logsx/a.log", "logs/x/a.txt"},
+		},
+		{
+			pattern: "**/*.log",
+			match:   []string{"a.log", "x/y/a.log"},
+			noMatch: []string{"a.txt"},
+		},
+		{
+			pattern: "dist/**",
+			match:   []string{"dist/a", "dist/x/y/z"},
+			noMatch: []string{"dist", "distx/a"},
+		},
+		{
+			pattern: "a**b/c",
+			match:   []string{"ab/c", "axxb/c"},
+			noMatch: []string{"ax/yb/c"},
+		},
+		{
+			pattern: "report-?.[jx]ml",
+			match:   []string{"report-1.xml", "report-a.jml"},
+			noMatch: []string{"report-12.xml", "report-1.yml"},
+		},
+		{
+			pattern: "[!a-c]*.txt",
+			match:   []string{"d.txt", "z1.txt"},
+			noMatch: []string{"a.txt", "c1.txt"},
+		},
+		{
+			pattern: "pkg/*.{tar.gz,zip}",
+			match:   []string{"pkg/app.tar.gz", "pkg/app.zip"},
+			noMatch: []string{"pkg/app.tar", "pkg/x/app.zip"},
+		},
+		{
+			pattern: "/var/log/*.log",
+			match:   []string{"/var/log/syslog.log"},
+			noMatch: []string{"var/log/syslog.log"},
+		},
+		{
+			pattern: "a+(b).txt",
+			match:   []string{"a+(b).txt"},
+			noMatch: []string{"aab.txt"},
+		},
+		{
+			pattern: "[unclosed",
+			match:   []string{"[unclosed"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.pattern, func(t *testing.T) {
+			t.Parallel()
+
+			p, err := Compile(tc.pattern)
+			require.NoError(t, err)
+			for _, path := range tc.match {
+				assert.True(t, p.Match(path), "Match(%q)", path)
+			}
+			for _, path := range tc.noMatch {
+				assert.False(t, p.Match(path), "Match(%q)", path)
+			}
+		})
+	}
+}
+
+func TestPatternMatchEscapes(t *testing.T) {
+	t.Parallel()
+
+	p, err := Compile(`a\*.txt`)
+	require.NoError(t, err)
+
+	if runtime.GOOS == "windows" {
+		// \ separates components on Windows
+		assert.True(t, p.Match(`a\b.txt`))
+		assert.True(t, p.Match(`a/b.txt`))
+	} else {
+		assert.True(t, p.Match("a*.txt"))
+		assert.False(t, p.Match("ab.txt"))
+	}
+}
+
+func TestPatternLiteral(t *testing.T) {
+	t.Parallel()
+
+	p, err := Compile("{coverage,reports/*}")
+	require.NoError(t, err)
+	assert.True(t, p.Literal("coverage"))
+	assert.True(t, p.Literal("./coverage"))
+	assert.False(t, p.Literal("reports/junit"))
+	assert.True(t, p.Match("reports/junit"))
+}
+
+func TestSet(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewSet([]string{"!**/*.map", "dist/**", " ", "docs/*.md"})
+	require.NoError(t, err)
+	assert.False(t, s.Empty())
+	assert.Len(t, s.Include(), 2)
+
+	assert.True(t, s.Match("dist/app.js"))
+	assert.True(t, s.Match("docs/README.md"))
+	assert.False(t, s.Match("dist/app.js.map"))
+	assert.False(t, s.Match("src/app.js"))
+	assert.True(t, s.Excluded("src/app.js.map"))
+
+	s, err = NewSet(nil)
+	require.NoError(t, err)
+	assert.True(t, s.Empty())
+}
+
+func TestPatternGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{
+		"build.log",
+		"logs/a.log",
+		"logs/x/b.log",
+		"logs/x/y/c.log",
+		"logs/x/notes.txt",
+		"pkg/app.tar.gz",
+		"pkg/app.zip",
+		"pkg/app.deb",
+		"other/d.log",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(f))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o777))
+		require.NoError(t, os.WriteFile(path, []byte(f), 0o666))
+	}
+
+	// A link into another directory, and one back up to the top
+	symlinks := runtime.GOOS != "windows"
+	if symlinks {
+		require.NoError(t, os.Symlink(filepath.Join(dir, "other"), filepath.Join(dir, "logs", "other-link")))
+		require.NoError(t, os.Symlink(dir, filepath.Join(dir, "logs", "loop")))
+	}
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	glob := func(pattern string, followSymlinks bool) []string {
+		t.Helper()
+		p, err := Compile(pattern)
+		require.NoError(t, err)
+		matches, err := p.Glob(followSymlinks)
+		require.NoError(t, err)
+		for i, m := range matches {
+			matches[i] = filepath.ToSlash(m)
+		}
+		sort.Strings(matches)
+		return matches
+	}
+
+	assert.Equal(t, []string{"build.log"}, glob("*.log", false))
+	assert.Equal(t, []string{"logs/a.log", "logs/x/b.log", "logs/x/y/c.log"}, glob("logs/**/*.log", false))
+	assert.Equal(t, []string{"build.log", "logs/a.log", "logs/x/b.log", "logs/x/y/c.log", "other/d.log"}, glob("**/*.log", false))
+	assert.Equal(t, []string{"logs/x/b.log"}, glob("./logs/*/*.log", false))
+	assert.Equal(t, []string{"pkg/app.tar.gz", "pkg/app.zip"}, glob("pkg/app.{tar.gz,zip,rpm}", false))
+	assert.Equal(t, []string{"build.log", "pkg/app.deb"}, glob("{build.log,pkg/*.deb}", false))
+	assert.Equal(t, []string{filepath.ToSlash(filepath.Join(dir, "logs", "a.log"))}, glob(filepath.Join(dir, "logs", "*.log"), false))
+	assert.Empty(t, glob("nowhere/**/*.log", false))
+
+	if symlinks {
+		// Links are only followed if asked, and loops aren't followed round
+		assert.Equal(t, []string{"logs/a.log", "logs/loop/build.log", "logs/loop/other/d.log", "logs/other-link/d.log", "logs/x/b.log", "logs/x/y/c.log"},
+			glob("logs/**/*.log", true))
+	}
+
+	// Paths without wildcards are checked for
+	p, err := Compile("missing.log")
+	require.NoError(t, err)
+	_, err = p.Glob(false)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	assert.Equal(t, []string{"build.log"}, glob("build.log", false))
+}
@@ -1,23 +1,36 @@
 package hook
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
 	"text/template"
 
-	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/agent/v3/env"
-	"github.com/buildkite/agent/v3/utils"
+	"github.com/buildkite/agent/v3/internal/utils"
+	"github.com/buildkite/agent/v3/shell"
 )
 
 const (
 	hookExitStatusEnv = "BUILDKITE_HOOK_EXIT_STATUS"
 	hookWorkingDirEnv = "BUILDKITE_HOOK_WORKING_DIR"
 
+	// EnvFileEnv is the environment variable with the path to the file that
+	// hooks can write environment changes to, as lines of JSON objects, e.g.
+	//
+	//	jq -cn --arg v "$VALUE" '{"MY_VAR": $v}' >> "$BUILDKITE_HOOK_ENV_FILE"
+	//
+	// A null value unsets the variable. Unlike exporting variables, these
+	// changes are kept exactly as written, whatever the value has in it, and
+	// even if the hook calls exit.
+	EnvFileEnv = "BUILDKITE_HOOK_ENV_FILE"
+
 	batchScript = `@echo off
 SETLOCAL ENABLEDELAYEDEXPANSION
 buildkite-agent env dump > "{{.BeforeEnvFileName}}"
@@ -27,28 +40,45 @@ SET BUILDKITE_HOOK_WORKING_DIR=%CD%
 buildkite-agent env dump > "{{.AfterEnvFileName}}"
 EXIT %BUILDKITE_HOOK_EXIT_STATUS%`
 
+	// The environment is dumped by Start-Process so its output goes straight
+	// to the file, as piping it through PowerShell would decode and re-encode
+	// it with the console's code page, mangling unicode values. An error the
+	// hook throws fails it, but its environment is still captured.
 	powershellScript = `$ErrorActionPreference = "STOP"
-buildkite-agent env dump | Set-Content "{{.BeforeEnvFileName}}"
-{{.PathToHook}}
-if ($LASTEXITCODE -eq $null) {$Env:BUILDKITE_HOOK_EXIT_STATUS = 0} else {$Env:BUILDKITE_HOOK_EXIT_STATUS = $LASTEXITCODE}
+Start-Process -FilePath buildkite-agent -ArgumentList "env","dump" -RedirectStandardOutput "{{.BeforeEnvFileName}}" -NoNewWindow -Wait
+$global:LASTEXITCODE = $null
+try {
+  & {{pwshQuote .PathToHook}}
+  if ($LASTEXITCODE -eq $null) {$Env:BUILDKITE_HOOK_EXIT_STATUS = 0} else {$Env:BUILDKITE_HOOK_EXIT_STATUS = $LASTEXITCODE}
+} catch {
+  [Console]::Error.WriteLine($_)
+  $Env:BUILDKITE_HOOK_EXIT_STATUS = 1
+}
 $Env:BUILDKITE_HOOK_WORKING_DIR = $PWD | Select-Object -ExpandProperty Path
-buildkite-agent env dump | Set-Content "{{.AfterEnvFileName}}"
+Start-Process -FilePath buildkite-agent -ArgumentList "env","dump" -RedirectStandardOutput "{{.AfterEnvFileName}}" -NoNewWindow -Wait
 exit $Env:BUILDKITE_HOOK_EXIT_STATUS`
 
-	bashScript = `buildkite-agent env dump > "{{.BeforeEnvFileName}}"
+	// Bash hooks can export anything, including functions, so the environment
+	// is dumped null-delimited to keep every value exactly as it is.
+	bashScript = `buildkite-agent env dump --format null-delimited > "{{.BeforeEnvFileName}}"
 . "{{.PathToHook}}"
 export BUILDKITE_HOOK_EXIT_STATUS=$?
 export BUILDKITE_HOOK_WORKING_DIR=$PWD
-buildkite-agent env dump > "{{.AfterEnvFileName}}"
+buildkite-agent env dump --format null-delimited > "{{.AfterEnvFileName}}"
 exit $BUILDKITE_HOOK_EXIT_STATUS`
 )
 
 var (
 	batchScriptTmpl      = template.Must(template.New("batch").Parse(batchScript))
-	powershellScriptTmpl = template.Must(template.New("pwsh").Parse(powershellScript))
+	powershellScriptTmpl = template.Must(template.New("pwsh").Funcs(template.FuncMap{"pwshQuote": pwshQuote}).Parse(powershellScript))
 	bashScriptTmpl       = template.Must(template.New("bash").Parse(bashScript))
 )
 
+// pwshQuote quotes a string for PowerShell, where it's taken literally
+func pwshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
 type scriptTemplateInput struct {
 	BeforeEnvFileName string
 	AfterEnvFileName  string
@@ -97,6 +127,7 @@ type ScriptWrapper struct {
 	scriptFile    *os.File
 	beforeEnvFile *os.File
 	afterEnvFile  *os.File
+	envFile       *os.File
 }
 
 func WithHookPath(path string) scriptWrapperOpt {
@@ -169,6 +200,15 @@ func NewScriptWrapper(opts ...scriptWrapperOpt) (*ScriptWrapper, error) {
 	}
 	wrap.afterEnvFile.Close()
 
+	// And the hook can write the changes it wants to make here
+	wrap.envFile, err = shell.TempFileWithExtension(
+		"buildkite-agent-bootstrap-hook-env-changes",
+	)
+	if err != nil {
+		return nil, err
+	}
+	wrap.envFile.Close()
+
 	absolutePathToHook, err := filepath.Abs(wrap.hookPath)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to find absolute path to \"%s\" (%s)", wrap.hookPath, err)
@@ -211,14 +251,23 @@ func (wrap *ScriptWrapper) Path() string {
 	return wrap.scriptFile.Name()
 }
 
+// EnvFile returns the path to the file the hook can write environment changes
+// to, which should be passed to the hook as BUILDKITE_HOOK_ENV_FILE
+func (wrap *ScriptWrapper) EnvFile() string {
+	return wrap.envFile.Name()
+}
+
 // Close cleans up the wrapper script and the environment files
 func (wrap *ScriptWrapper) Close() {
 	os.Remove(wrap.scriptFile.Name())
 	os.Remove(wrap.beforeEnvFile.Name())
 	os.Remove(wrap.afterEnvFile.Name())
+	os.Remove(wrap.envFile.Name())
 }
 
-// Changes returns the changes in the environment and working dir after the hook script runs
+// Changes returns the changes in the environment and working dir after the hook
+// script runs. If the hook exited early, the changes it wrote to its env file
+// are returned along with a HookExitError.
 func (wrap *ScriptWrapper) Changes() (HookScriptChanges, error) {
 	beforeEnvContents, err := os.ReadFile(wrap.beforeEnvFile.Name())
 	if err != nil {
@@ -230,24 +279,26 @@ func (wrap *ScriptWrapper) Changes() (HookScriptChanges, error) {
 		return HookScriptChanges{}, fmt.Errorf("Failed to read \"%s\" (%s)", wrap.afterEnvFile.Name(), err)
 	}
 
-	// An empty afterEnvFile indicates that the hook early-exited from within the
-	// ScriptWrapper, so the working directory and environment changes weren't
-	// captured.
-	if len(afterEnvContents) == 0 {
-		return HookScriptChanges{}, &HookExitError{hookPath: wrap.hookPath}
+	beforeEnv, err := parseEnvDump(beforeEnvContents)
+	if err != nil {
+		return HookScriptChanges{}, fmt.Errorf("failed to unmarshal before env file: %w, file contents: %q", err, string(beforeEnvContents))
 	}
 
-	var (
-		beforeEnv env.Environment
-		afterEnv  env.Environment
-	)
-
-	err = json.Unmarshal(beforeEnvContents, &beforeEnv)
+	written, err := readEnvFile(wrap.envFile.Name())
 	if err != nil {
-		return HookScriptChanges{}, fmt.Errorf("failed to unmarshal before env file: %w, file contents: %q", err, string(beforeEnvContents))
+		return HookScriptChanges{}, err
 	}
 
-	err = json.Unmarshal(afterEnvContents, &afterEnv)
+	// An empty afterEnvFile indicates that the hook early-exited from within the
+	// ScriptWrapper, so the working directory and environment changes weren't
+	// captured. Only what it wrote to its env file is known.
+	if len(afterEnvContents) == 0 {
+		diff := env.Diff{Added: map[string]string{}, Changed: map[string]env.DiffPair{}, Removed: map[string]struct{}{}}
+		applyWrittenEnv(&diff, beforeEnv, written)
+		return HookScriptChanges{Diff: diff}, &HookExitError{hookPath: wrap.hookPath}
+	}
+
+	afterEnv, err := parseEnvDump(afterEnvContents)
 	if err != nil {
 		return HookScriptChanges{}, fmt.Errorf("failed to unmarshal after env file: %w, file contents: %q", err, string(afterEnvContents))
 	}
@@ -268,5 +319,95 @@ func (wrap *ScriptWrapper) Changes() (HookScriptChanges, error) {
 	// Bash sets this, but we don't care about it
 	diff.Remove("_")
 
+	// What the hook wrote to its env file takes precedence over what it exported
+	applyWrittenEnv(&diff, beforeEnv, written)
+
 	return HookScriptChanges{Diff: diff, afterWd: afterWd}, nil
 }
+
+// parseEnvDump parses the output of `buildkite-agent env dump`, which is
+// null-delimited from bash hooks and JSON otherwise. An older agent earlier in
+// the PATH ignores the format and dumps JSON, so the contents decide which.
+func parseEnvDump(data []byte) (env.Environment, error) {
+	if bytes.HasSuffix(data, []byte{0}) {
+		return env.FromNullDelimited(data), nil
+	}
+
+	var e env.Environment
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// writtenEnv is a change a hook wrote to its env file, where a nil value
+// unsets the variable
+type writtenEnv struct {
+	key   string
+	value *string
+}
+
+// readEnvFile reads the changes written to a hook's env file, in the order
+// they were written. Each line is a JSON object of names to string or null
+// values.
+func readEnvFile(path string) ([]writtenEnv, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read \"%s\" (%s)", path, err)
+	}
+	defer f.Close()
+
+	var changes []writtenEnv
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var vars map[string]*string
+		if err := json.Unmarshal(line, &vars); err != nil {
+			return nil, fmt.Errorf("%s line %d should be a JSON object of environment variables: %w", EnvFileEnv, n, err)
+		}
+
+		// The keys of an object aren't ordered, so sort them to apply the
+		// changes the same way each time
+		keys := make([]string, 0, len(vars))
+		for k := range vars {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if k == "" || strings.ContainsRune(k, '=') {
+				return nil, fmt.Errorf("%s line %d has an invalid environment variable name %q", EnvFileEnv, n, k)
+			}
+			changes = append(changes, writtenEnv{key: k, value: vars[k]})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read \"%s\" (%s)", path, err)
+	}
+	return changes, nil
+}
+
+// applyWrittenEnv updates a diff from the environment before the hook ran
+// with the changes the hook wrote to its env file
+func applyWrittenEnv(diff *env.Diff, before env.Environment, written []writtenEnv) {
+	for _, w := range written {
+		diff.Remove(w.key)
+
+		old, existed := before.Get(w.key)
+		switch {
+		case w.value == nil:
+			if existed {
+				diff.Removed[w.key] = struct{}{}
+			}
+		case !existed:
+			diff.Added[w.key] = *w.value
+		case old != *w.value:
+			diff.Changed[w.key] = env.DiffPair{Old: old, New: *w.value}
+		}
+	}
+}
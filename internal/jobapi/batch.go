@@ -0,0 +1,60 @@
+package jobapi
+
+import "github.com/buildkite/agent/v3/api"
+
+// Buildkite-imposed maximum length of annotation body (bytes). Appends are
+// only merged while the merged body stays under it.
+const maxAnnotationBodySize = 1024 * 1024
+
+// op is a single queued call to the Buildkite API, or a flush marker
+type op struct {
+	metaData   *api.MetaData
+	annotation *api.Annotation
+
+	// If set, this op is a flush marker, and the channel is closed once all
+	// the ops queued before it have been sent
+	flushed chan struct{}
+}
+
+// coalesce reduces a run of queued ops to fewer API calls that leave the build
+// in the same state. Calls are sent in the order they were queued, so a call
+// that depends on an earlier one (an annotation that reads meta-data, say) still
+// sees it. To keep that order, only consecutive calls are merged:
+//
+//   - A meta-data set replaces an immediately preceding set of the same key.
+//   - An append to an annotation is merged into an immediately preceding call
+//     for the same context, if the style is unchanged.
+//
+// Flush markers are never merged, so nothing is coalesced across them.
+func coalesce(ops []op) []op {
+	var out []op
+
+	for _, o := range ops {
+		if len(out) > 0 && o.flushed == nil {
+			prev := &out[len(out)-1]
+			switch {
+			case o.metaData != nil && prev.metaData != nil && prev.metaData.Key == o.metaData.Key:
+				prev.metaData = o.metaData
+				continue
+
+			case o.annotation != nil && prev.annotation != nil && prev.annotation.Context == o.annotation.Context && canMergeAnnotation(prev.annotation, o.annotation):
+				merged := *prev.annotation
+				merged.Body += o.annotation.Body
+				prev.annotation = &merged
+				continue
+			}
+		}
+		out = append(out, o)
+	}
+
+	return out
+}
+
+func canMergeAnnotation(prev, next *api.Annotation) bool {
+	// A call with no body only updates the style, so there's nothing to append to
+	return next.Append &&
+		prev.Body != "" &&
+		next.Body != "" &&
+		(next.Style == "" || next.Style == prev.Style) &&
+		len(prev.Body)+len(next.Body) <= maxAnnotationBodySize
+}
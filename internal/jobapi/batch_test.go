@@ -0,0 +1,125 @@
+package jobapi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalesce(t *testing.T) {
+	t.Parallel()
+
+	flush := make(chan struct{})
+
+	for _, tc := range []struct {
+		name string
+		ops  []op
+		want []op
+	}{
+		{
+			name: "consecutive meta-data sets of a key are merged",
+			ops: []op{
+				{metaData: &api.MetaData{Key: "a", Value: "1"}},
+				{metaData: &api.MetaData{Key: "a", Value: "2"}},
+				{metaData: &api.MetaData{Key: "b", Value: "1"}},
+			},
+			want: []op{
+				{metaData: &api.MetaData{Key: "a", Value: "2"}},
+				{metaData: &api.MetaData{Key: "b", Value: "1"}},
+			},
+		},
+		{
+			name: "meta-data sets aren't moved past other calls",
+			ops: []op{
+				{metaData: &api.MetaData{Key: "a", Value: "1"}},
+				{annotation: &api.Annotation{Context: "x", Body: "a is 1"}},
+				{metaData: &api.MetaData{Key: "a", Value: "2"}},
+			},
+			want: []op{
+				{metaData: &api.MetaData{Key: "a", Value: "1"}},
+				{annotation: &api.Annotation{Context: "x", Body: "a is 1"}},
+				{metaData: &api.MetaData{Key: "a", Value: "2"}},
+			},
+		},
+		{
+			name: "consecutive appends merge into the previous call for the context",
+			ops: []op{
+				{annotation: &api.Annotation{Context: "x", Body: "one", Style: "info"}},
+				{annotation: &api.Annotation{Context: "x", Body: " two", Append: true}},
+				{annotation: &api.Annotation{Context: "x", Body: " three", Style: "info", Append: true}},
+				{annotation: &api.Annotation{Context: "y", Body: "other"}},
+			},
+			want: []op{
+				{annotation: &api.Annotation{Context: "x", Body: "one two three", Style: "info"}},
+				{annotation: &api.Annotation{Context: "y", Body: "other"}},
+			},
+		},
+		{
+			name: "appends aren't moved past other calls",
+			ops: []op{
+				{annotation: &api.Annotation{Context: "x", Body: "one"}},
+				{metaData: &api.MetaData{Key: "a", Value: "1"}},
+				{annotation: &api.Annotation{Context: "x", Body: " two", Append: true}},
+			},
+			want: []op{
+				{annotation: &api.Annotation{Context: "x", Body: "one"}},
+				{metaData: &api.MetaData{Key: "a", Value: "1"}},
+				{annotation: &api.Annotation{Context: "x", Body: " two", Append: true}},
+			},
+		},
+		{
+			name: "appends with a different style aren't merged",
+			ops: []op{
+				{annotation: &api.Annotation{Context: "x", Body: "one", Style: "info"}},
+				{annotation: &api.Annotation{Context: "x", Body: " two", Style: "error", Append: true}},
+			},
+			want: []op{
+				{annotation: &api.Annotation{Context: "x", Body: "one", Style: "info"}},
+				{annotation: &api.Annotation{Context: "x", Body: " two", Style: "error", Append: true}},
+			},
+		},
+		{
+			name: "replacing calls aren't merged",
+			ops: []op{
+				{annotation: &api.Annotation{Context: "x", Body: "one"}},
+				{annotation: &api.Annotation{Context: "x", Body: "two"}},
+			},
+			want: []op{
+				{annotation: &api.Annotation{Context: "x", Body: "one"}},
+				{annotation: &api.Annotation{Context: "x", Body: "two"}},
+			},
+		},
+		{
+			name: "appends aren't merged beyond the body size limit",
+			ops: []op{
+				{annotation: &api.Annotation{Context: "x", Body: strings.Repeat("a", maxAnnotationBodySize)}},
+				{annotation: &api.Annotation{Context: "x", Body: "b", Append: true}},
+			},
+			want: []op{
+				{annotation: &api.Annotation{Context: "x", Body: strings.Repeat("a", maxAnnotationBodySize)}},
+				{annotation: &api.Annotation{Context: "x", Body: "b", Append: true}},
+			},
+		},
+		{
+			name: "nothing is coalesced across a flush",
+			ops: []op{
+				{annotation: &api.Annotation{Context: "x", Body: "one"}},
+				{flushed: flush},
+				{annotation: &api.Annotation{Context: "x", Body: " two", Append: true}},
+			},
+			want: []op{
+				{annotation: &api.Annotation{Context: "x", Body: "one"}},
+				{flushed: flush},
+				{annotation: &api.Annotation{Context: "x", Body: " two", Append: true}},
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.want, coalesce(tc.ops))
+		})
+	}
+}
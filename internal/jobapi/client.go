@@ -0,0 +1,85 @@
+package jobapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// Client makes calls to a job API server over its socket
+type Client struct {
+	http *http.Client
+}
+
+// NewClient returns a client for the server listening on socketPath
+func NewClient(socketPath string) *Client {
+	return &Client{http: NewHTTPClient(socketPath)}
+}
+
+// NewHTTPClient returns a HTTP client that makes every request to the server
+// listening on socketPath, whatever the host in the URL
+func NewHTTPClient(socketPath string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
+
+// SetMetaData queues a meta-data set on the job's build
+func (c *Client) SetMetaData(ctx context.Context, metaData *api.MetaData) error {
+	return c.post(ctx, "/meta-data/set", metaData)
+}
+
+// Annotate queues an annotation on the job's build
+func (c *Client) Annotate(ctx context.Context, annotation *api.Annotation) error {
+	return c.post(ctx, "/annotate", annotation)
+}
+
+// Flush waits until everything queued has been sent to Buildkite
+func (c *Client) Flush(ctx context.Context) error {
+	return c.post(ctx, "/flush", nil)
+}
+
+func (c *Client) post(ctx context.Context, path string, body any) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	// The host is ignored, as we always dial the socket
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://job-api"+path, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	data, _ := io.ReadAll(resp.Body)
+
+	var errResp errorResponse
+	if err := json.Unmarshal(data, &errResp); err == nil && errResp.Error != "" {
+		return fmt.Errorf("job API %s: %s", path, errResp.Error)
+	}
+	return fmt.Errorf("job API %s: %s", path, resp.Status)
+}
@@ -0,0 +1,125 @@
+package jobapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// The path on the socket that Agent API calls are forwarded from
+	agentAPIPrefix = "/agent-api/"
+
+	// AgentAPIEndpoint is the Agent API endpoint to use when making calls
+	// through the socket, with a HTTP client from NewHTTPClient. The host is
+	// ignored.
+	AgentAPIEndpoint = "http://job-api" + agentAPIPrefix
+)
+
+// The things a job can do to itself through the Agent API. Everything else
+// under jobs/<id>/, like finishing the job, is up to the agent running it.
+var jobResources = []string{"annotations", "artifacts", "data", "oidc", "pipelines"}
+
+// agentAPIProxy returns a handler that forwards calls to the Agent API, adding
+// the agent's token, if they only act on the job
+func (s *Server) agentAPIProxy() (http.Handler, error) {
+	target, err := url.Parse(s.AgentEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing agent endpoint: %w", err)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = target.Host
+		r.Header.Set("Authorization", "Token "+s.AgentToken)
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		s.logger.Warn("[JobAPI] Forwarding %s %s: %v", r.Method, r.URL.Path, err)
+		writeError(w, http.StatusBadGateway, err)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.authorizeAgentAPICall(r); err != nil {
+			s.logger.Warn("[JobAPI] Refused %s %s: %v", r.Method, r.URL.Path, err)
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}), nil
+}
+
+// authorizeAgentAPICall returns an error unless the call only acts on this
+// job, or on things the job is allowed to look at and change, like the steps
+// and artifacts in its build
+func (s *Server) authorizeAgentAPICall(r *http.Request) error {
+	// A job's calls are only allowed for its own build
+	ownBuild := func(buildID string) bool {
+		return s.BuildID != "" && buildID == s.BuildID
+	}
+
+	// An escaped path could be read differently by the Agent API
+	if r.URL.RawPath != "" {
+		return errors.New("escaped paths aren't allowed")
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch parts[0] {
+	case "jobs":
+		if len(parts) >= 3 && parts[1] == s.jobID && slices.Contains(jobResources, parts[2]) {
+			return nil
+		}
+
+	case "builds":
+		if len(parts) == 4 && ownBuild(parts[1]) && parts[2] == "artifacts" && parts[3] == "search" {
+			return nil
+		}
+
+	case "steps":
+		// Steps are looked up by ID or key within the build_id the call
+		// gives, so that has to be the job's build
+		if len(parts) >= 2 {
+			buildID, err := stepCallBuildID(r)
+			if err != nil {
+				return err
+			}
+			if ownBuild(buildID) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("%s isn't something job %s can do", r.URL.Path, s.jobID)
+}
+
+// stepCallBuildID returns the build_id in the body of a call to steps/,
+// leaving the body to be forwarded
+func stepCallBuildID(r *http.Request) (string, error) {
+	if r.Body == nil {
+		return "", nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", fmt.Errorf("reading body: %w", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var call struct {
+		Build string `json:"build_id"`
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &call); err != nil {
+			return "", fmt.Errorf("parsing body: %w", err)
+		}
+	}
+	return call.Build, nil
+}
@@ -0,0 +1,119 @@
+package jobapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentAPIProxyOnlyAllowsCallsForTheJob(t *testing.T) {
+	t.Parallel()
+
+	var paths []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("Authorization"), "Token agent-token"; got != want {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		paths = append(paths, r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/search") {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	server := NewServer(logger.Discard, filepath.Join(t.TempDir(), "job.sock"), "job-1", &fakeAPIClient{})
+	server.AgentEndpoint = upstream.URL + "/v3/"
+	server.AgentToken = "agent-token"
+	server.BuildID = "build-1"
+	require.NoError(t, server.Start())
+	defer server.Stop(context.Background())
+
+	ctx := context.Background()
+	client := api.NewClient(logger.Discard, api.Config{
+		Endpoint:   AgentAPIEndpoint,
+		HTTPClient: NewHTTPClient(server.SocketPath),
+	})
+
+	_, err := client.SetMetaData(ctx, "job-1", &api.MetaData{Key: "a", Value: "b"})
+	assert.NoError(t, err)
+
+	_, _, err = client.SearchArtifacts(ctx, "build-1", &api.ArtifactSearchOptions{Query: "*"})
+	assert.NoError(t, err)
+
+	_, err = client.SetMetaData(ctx, "job-2", &api.MetaData{Key: "a", Value: "b"})
+	assert.True(t, api.IsErrHavingStatus(err, http.StatusForbidden), "SetMetaData on another job: %v", err)
+
+	_, err = client.FinishJob(ctx, &api.Job{ID: "job-1"})
+	assert.True(t, api.IsErrHavingStatus(err, http.StatusForbidden), "FinishJob: %v", err)
+
+	_, err = client.StepUpdate(ctx, "my-step", &api.StepUpdate{Build: "build-1", Attribute: "label", Value: "hi"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"/v3/jobs/job-1/data/set",
+		"/v3/builds/build-1/artifacts/search",
+		"/v3/steps/my-step",
+	}, paths)
+}
+
+func TestAgentAPIProxyRefusesCallsForOtherBuilds(t *testing.T) {
+	t.Parallel()
+
+	var paths []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Write([]byte(`[]`))
+	}))
+	defer upstream.Close()
+
+	server := NewServer(logger.Discard, filepath.Join(t.TempDir(), "job.sock"), "job-1", &fakeAPIClient{})
+	server.AgentEndpoint = upstream.URL + "/v3/"
+	server.AgentToken = "agent-token"
+	server.BuildID = "build-1"
+	require.NoError(t, server.Start())
+	defer server.Stop(context.Background())
+
+	ctx := context.Background()
+	client := api.NewClient(logger.Discard, api.Config{
+		Endpoint:   AgentAPIEndpoint,
+		HTTPClient: NewHTTPClient(server.SocketPath),
+	})
+
+	_, _, err := client.SearchArtifacts(ctx, "build-2", &api.ArtifactSearchOptions{Query: "*"})
+	assert.True(t, api.IsErrHavingStatus(err, http.StatusForbidden), "SearchArtifacts on another build: %v", err)
+
+	_, _, err = client.StepExport(ctx, "my-step", &api.StepExportRequest{Build: "build-2", Attribute: "label"})
+	assert.True(t, api.IsErrHavingStatus(err, http.StatusForbidden), "StepExport on another build: %v", err)
+
+	_, err = client.StepUpdate(ctx, "my-step", &api.StepUpdate{Attribute: "label", Value: "hi"})
+	assert.True(t, api.IsErrHavingStatus(err, http.StatusForbidden), "StepUpdate without a build: %v", err)
+
+	assert.Empty(t, paths)
+}
+
+func TestServerWithoutBatchingWaitsForCalls(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeAPIClient{}
+	server := NewServer(logger.Discard, filepath.Join(t.TempDir(), "job.sock"), "job-1", fake)
+	server.BatchInterval = 0
+	require.NoError(t, server.Start())
+	defer server.Stop(context.Background())
+
+	err := NewClient(server.SocketPath).SetMetaData(context.Background(), &api.MetaData{Key: "a", Value: "b"})
+	require.NoError(t, err)
+
+	// No flush needed, as the call has already been made
+	assert.Equal(t, []string{"job-1 meta-data a=b"}, fake.calls)
+}
@@ -0,0 +1,350 @@
+// Package jobapi provides a local socket that commands run within a job use to
+// talk to the agent running the job, instead of calling the Buildkite API
+// directly. Calls made through it can be queued and coalesced, so a job making
+// many meta-data and annotation calls in quick succession makes far fewer
+// requests to Buildkite. It can also forward the job's other calls to the
+// Agent API, so the job doesn't need the agent's access token.
+//
+// It is intended for internal use by buildkite-agent only.
+package jobapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/roko"
+)
+
+// DefaultBatchInterval is how long the server waits for more calls to arrive
+// before sending what it has
+const DefaultBatchInterval = 100 * time.Millisecond
+
+// APIClient is the part of the Buildkite Agent API the server calls on behalf
+// of the job
+type APIClient interface {
+	SetMetaData(context.Context, string, *api.MetaData) (*api.Response, error)
+	Annotate(context.Context, string, *api.Annotation) (*api.Response, error)
+}
+
+// Server listens on a unix socket for calls from commands in a job
+type Server struct {
+	// The path of the socket
+	SocketPath string
+
+	// How long to wait for more calls before sending a batch. If zero, calls
+	// are sent straight away, and the caller waits until they have been.
+	BatchInterval time.Duration
+
+	// If set, calls to the Agent API made through /agent-api/ are forwarded
+	// to this endpoint with this token, as long as they only act on the job
+	AgentEndpoint string
+	AgentToken    string
+
+	// The job's build, which is the only one whose artifacts and steps it
+	// can look at and change through /agent-api/
+	BuildID string
+
+	logger logger.Logger
+	jobID  string
+	client APIClient
+
+	http   *http.Server
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	queue []op
+	errs  []error
+	wake  chan struct{}
+	done  chan struct{}
+}
+
+// NewServer returns a server for the given job, which is not yet listening
+func NewServer(l logger.Logger, socketPath, jobID string, client APIClient) *Server {
+	return &Server{
+		SocketPath:    socketPath,
+		BatchInterval: DefaultBatchInterval,
+		logger:        l,
+		jobID:         jobID,
+		client:        client,
+		wake:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+}
+
+// Start listens on the socket and starts sending queued calls
+func (s *Server) Start() error {
+	// A socket left over from an agent that didn't shut down cleanly would
+	// stop us from listening
+	if err := os.Remove(s.SocketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	ln, err := net.Listen("unix", s.SocketPath)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", s.SocketPath, err)
+	}
+
+	// Only the user running the job should be able to use the socket
+	if err := os.Chmod(s.SocketPath, 0600); err != nil {
+		ln.Close()
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/meta-data/set", s.handleMetaDataSet)
+	mux.HandleFunc("/annotate", s.handleAnnotate)
+	mux.HandleFunc("/flush", s.handleFlush)
+
+	if s.AgentEndpoint != "" {
+		proxy, err := s.agentAPIProxy()
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		mux.Handle(agentAPIPrefix, http.StripPrefix(strings.TrimSuffix(agentAPIPrefix, "/"), proxy))
+	}
+
+	s.http = &http.Server{Handler: mux}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	go func() {
+		if err := s.http.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("[JobAPI] Server failed: %v", err)
+		}
+	}()
+
+	go s.run()
+
+	return nil
+}
+
+// Stop stops accepting calls, waits for everything already queued to be sent,
+// and returns any errors from sending that haven't already been reported
+func (s *Server) Stop(ctx context.Context) error {
+	if err := s.http.Shutdown(ctx); err != nil {
+		s.logger.Warn("[JobAPI] Error shutting down server: %v", err)
+	}
+
+	err := s.Flush(ctx)
+
+	s.cancel()
+	<-s.done
+
+	if rmErr := os.Remove(s.SocketPath); rmErr != nil && !os.IsNotExist(rmErr) {
+		s.logger.Warn("[JobAPI] Error removing socket: %v", rmErr)
+	}
+
+	return err
+}
+
+// Flush waits for all the calls queued so far to be sent, and returns any
+// errors from sending them that haven't already been reported
+func (s *Server) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	s.enqueue(op{flushed: flushed})
+
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.mu.Lock()
+	errs := s.errs
+	s.errs = nil
+	s.mu.Unlock()
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return &sendError{errs: errs}
+}
+
+func (s *Server) enqueue(o op) {
+	s.mu.Lock()
+	s.queue = append(s.queue, o)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Server) run() {
+	defer close(s.done)
+
+	for {
+		select {
+		case <-s.wake:
+		case <-s.ctx.Done():
+			return
+		}
+
+		// Give the job a moment to queue up more calls
+		if s.BatchInterval > 0 {
+			select {
+			case <-time.After(s.BatchInterval):
+			case <-s.ctx.Done():
+				return
+			}
+		}
+
+		s.mu.Lock()
+		ops := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+
+		batch := coalesce(ops)
+		if len(batch) < len(ops) {
+			s.logger.Debug("[JobAPI] Coalesced %d calls into %d", len(ops), len(batch))
+		}
+
+		for _, o := range batch {
+			if o.flushed != nil {
+				close(o.flushed)
+				continue
+			}
+			if err := s.send(o); err != nil {
+				s.logger.Error("[JobAPI] %v", err)
+				s.mu.Lock()
+				s.errs = append(s.errs, err)
+				s.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (s *Server) send(o op) error {
+	switch {
+	case o.metaData != nil:
+		err := roko.NewRetrier(
+			roko.WithMaxAttempts(10),
+			roko.WithStrategy(roko.Constant(5*time.Second)),
+		).DoWithContext(s.ctx, func(r *roko.Retrier) error {
+			resp, err := s.client.SetMetaData(s.ctx, s.jobID, o.metaData)
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+				r.Break()
+			}
+			if err != nil {
+				s.logger.Warn("[JobAPI] %s (%s)", err, r)
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to set meta-data %q: %w", o.metaData.Key, err)
+		}
+
+	case o.annotation != nil:
+		err := roko.NewRetrier(
+			roko.WithMaxAttempts(5),
+			roko.WithStrategy(roko.Constant(1*time.Second)),
+			roko.WithJitter(),
+		).DoWithContext(s.ctx, func(r *roko.Retrier) error {
+			resp, err := s.client.Annotate(s.ctx, s.jobID, o.annotation)
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+				r.Break()
+			}
+			if err != nil {
+				s.logger.Warn("[JobAPI] %s (%s)", err, r)
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to annotate build with context %q: %w", o.annotation.Context, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) handleMetaDataSet(w http.ResponseWriter, r *http.Request) {
+	var m api.MetaData
+	if !decodeRequest(w, r, &m) {
+		return
+	}
+	if m.Key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("meta-data key is required"))
+		return
+	}
+	s.enqueue(op{metaData: &m})
+	s.respondQueued(w, r)
+}
+
+func (s *Server) handleAnnotate(w http.ResponseWriter, r *http.Request) {
+	var a api.Annotation
+	if !decodeRequest(w, r, &a) {
+		return
+	}
+	s.enqueue(op{annotation: &a})
+	s.respondQueued(w, r)
+}
+
+// respondQueued responds to a call that has been queued. Without batching,
+// that's once it has been sent.
+func (s *Server) respondQueued(w http.ResponseWriter, r *http.Request) {
+	if s.BatchInterval > 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	s.handleFlush(w, r)
+}
+
+func (s *Server) handleFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+	if err := s.Flush(r.Context()); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decoding request: %w", err))
+		return false
+	}
+	return true
+}
+
+// errorResponse is the body of an unsuccessful response
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(errorResponse{Error: err.Error()})
+}
+
+// sendError is returned from a flush when queued calls failed to send
+type sendError struct {
+	errs []error
+}
+
+func (e *sendError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
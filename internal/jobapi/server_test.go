@@ -0,0 +1,73 @@
+package jobapi
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeAPIClient struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (c *fakeAPIClient) SetMetaData(_ context.Context, jobID string, m *api.MetaData) (*api.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, fmt.Sprintf("%s meta-data %s=%s", jobID, m.Key, m.Value))
+	return nil, nil
+}
+
+func (c *fakeAPIClient) Annotate(_ context.Context, jobID string, a *api.Annotation) (*api.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, fmt.Sprintf("%s annotate %s: %s", jobID, a.Context, a.Body))
+	return nil, nil
+}
+
+func TestServerCoalescesCallsUntilFlushed(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fake := &fakeAPIClient{}
+
+	server := NewServer(logger.Discard, filepath.Join(t.TempDir(), "job.sock"), "job-1", fake)
+	server.BatchInterval = 50 * time.Millisecond
+	require.NoError(t, server.Start())
+
+	client := NewClient(server.SocketPath)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, client.SetMetaData(ctx, &api.MetaData{Key: "count", Value: fmt.Sprint(i)}))
+	}
+	for i := 0; i < 5; i++ {
+		require.NoError(t, client.Annotate(ctx, &api.Annotation{Context: "log", Body: fmt.Sprint(i), Append: i > 0}))
+	}
+	require.NoError(t, client.Flush(ctx))
+
+	assert.Equal(t, []string{
+		"job-1 meta-data count=4",
+		"job-1 annotate log: 01234",
+	}, fake.calls)
+
+	require.NoError(t, server.Stop(ctx))
+	assert.NoFileExists(t, server.SocketPath)
+}
+
+func TestServerRejectsMetaDataWithoutKey(t *testing.T) {
+	t.Parallel()
+
+	server := NewServer(logger.Discard, filepath.Join(t.TempDir(), "job.sock"), "job-1", &fakeAPIClient{})
+	require.NoError(t, server.Start())
+	defer server.Stop(context.Background())
+
+	err := NewClient(server.SocketPath).SetMetaData(context.Background(), &api.MetaData{Value: "x"})
+	assert.EqualError(t, err, "job API /meta-data/set: meta-data key is required")
+}
@@ -0,0 +1,48 @@
+package locale
+
+// japanese is the Japanese translation of the messages about the most common
+// ways agents fail, and what they're doing while they start and stop
+var japanese = Catalog{
+	// Starting and registering
+	"Registering agent with Buildkite...":                                "Buildkite にエージェントを登録しています...",
+	"Registering agent %d of %d with Buildkite...":                       "Buildkite にエージェントを登録しています (%d/%d)...",
+	"Successfully registered agent \"%s\" with tags [%s]":                "エージェント \"%s\" をタグ [%s] で登録しました",
+	"Buildkite rejected the registration (%s)":                           "Buildkite がエージェントの登録を拒否しました。エージェントトークンを確認してください (%s)",
+	"Failed to find hostname: %s":                                        "ホスト名を取得できませんでした: %s",
+	"Unable to find executable path for bootstrap":                       "bootstrap の実行ファイルのパスが見つかりません",
+	"Failed to parse cancel-signal: %v":                                  "cancel-signal を解析できませんでした: %v",
+	"Failed to create builds path: %v":                                   "ビルドパスを作成できませんでした: %v",
+	"You can't spawn multiple agents and acquire a job at the same time": "複数のエージェントの起動とジョブの取得は同時に行えません",
+	"Could not start health check server: %v":                            "ヘルスチェックサーバーを起動できませんでした: %v",
+	"Starting %d Agent(s)":                                               "%d 個のエージェントを起動しています",
+	"You can press Ctrl-C to stop the agents":                            "Ctrl-C でエージェントを停止できます",
+
+	// Talking to Buildkite
+	"Failed to heartbeat %s. Will try again in %s. (No heartbeat yet)":                                             "ハートビートに失敗しました (%s)。%s 後に再試行します。(まだ一度も成功していません)",
+	"Failed to heartbeat %s. Will try again in %s. (Last successful was %v ago)":                                   "ハートビートに失敗しました (%s)。%s 後に再試行します。(最後に成功したのは %v 前です)",
+	"%d API requests were rejected by the rate limit since the last heartbeat":                                     "前回のハートビート以降、%d 件の API リクエストがレート制限により拒否されました",
+	"Failed to ping the new endpoint %s - ignoring switch for now (%s)":                                            "新しいエンドポイント %s に ping できなかったため、今回は切り替えません (%s)",
+	"Buildkite rejected the call to acquire the job (%s)":                                                          "Buildkite がジョブの取得を拒否しました (%s)",
+	"The job is waiting for a dependency (%s)":                                                                     "ジョブは依存先を待っています (%s)",
+	"Buildkite rejected the call to accept the job (%s)":                                                           "Buildkite がジョブの受け入れを拒否しました (%s)",
+	"Buildkite rejected the call to start the job (%s)":                                                            "Buildkite がジョブの開始を拒否しました (%s)",
+	"Buildkite rejected the call to finish the job (%s)":                                                           "Buildkite がジョブの終了を拒否しました (%s)",
+	"Buildkite rejected the chunk upload (%s)":                                                                     "Buildkite がログのチャンクのアップロードを拒否しました (%s)",
+	"%d chunks failed to upload for this job":                                                                      "このジョブのログのチャンク %d 個をアップロードできませんでした",
+	"Problem with getting job state %s (%s)":                                                                       "ジョブ %s の状態を取得できませんでした (%s)",
+	"[JobRunner] Job %s has run for longer than the maximum of %s, canceling it":                                   "[JobRunner] ジョブ %s の実行時間が上限の %s を超えたため、キャンセルします",
+	"Unexpected error canceling job (err: %s)":                                                                     "ジョブのキャンセル中に予期しないエラーが発生しました (err: %s)",
+	"Toolchains have changed since the agent registered: %s. The agent's tags will be updated when it's restarted": "エージェントの登録後にツールチェーンが変更されました: %s。エージェントのタグは再起動時に更新されます",
+
+	// Stopping
+	"Disconnecting...":                                           "切断しています...",
+	"Job finished. Disconnecting...":                             "ジョブが終了しました。切断しています...",
+	"All agents have been idle for %d seconds. Disconnecting...": "すべてのエージェントが %d 秒間アイドル状態でした。切断しています...",
+	"Agent is already gracefully stopping...":                    "エージェントはすでに正常に停止しようとしています...",
+	"Gracefully stopping agent. Waiting for current job to finish before disconnecting...":            "エージェントを正常に停止しています。実行中のジョブが終了してから切断します...",
+	"Gracefully stopping agent. Since there is no job running, the agent will disconnect immediately": "エージェントを正常に停止しています。実行中のジョブがないため、すぐに切断します",
+	"Forcefully stopping agent. The current job will be canceled before disconnecting...":             "エージェントを強制的に停止しています。実行中のジョブをキャンセルしてから切断します...",
+	"Forcefully stopping agent. Since there is no job running, the agent will disconnect immediately": "エージェントを強制的に停止しています。実行中のジョブがないため、すぐに切断します",
+	"Received CTRL-C, send again to forcefully kill the agent(s)":                                     "CTRL-C を受け取りました。もう一度送るとエージェントを強制終了します",
+	"Forcefully stopping running jobs and stopping the agent(s)":                                      "実行中のジョブを強制的に停止し、エージェントを停止しています",
+}
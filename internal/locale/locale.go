@@ -0,0 +1,103 @@
+// Package locale translates the messages the agent logs for the people
+// running it, like why it couldn't register or heartbeat, into other
+// languages. What jobs log isn't translated.
+//
+// Translations are kept in catalogs keyed by the English format strings the
+// messages are logged with, so messages that haven't been translated are
+// logged in English.
+package locale
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	// English is the language messages are written in
+	English = "en"
+
+	// Japanese has translations of the most common failures
+	Japanese = "ja"
+
+	// System takes the language from the LC_ALL, LC_MESSAGES or LANG
+	// environment variables, the same as other programs do
+	System = "system"
+)
+
+// Catalog is the translations of format strings into a language, keyed by
+// the English ones. Translations can use explicit argument indexes, like
+// %[2]s, to put arguments in a different order.
+type Catalog map[string]string
+
+// Translate returns the translation of a format string, or the format string
+// if there isn't one. A nil catalog doesn't translate anything.
+func (c Catalog) Translate(format string) string {
+	if translated, ok := c[format]; ok {
+		return translated
+	}
+	return format
+}
+
+var catalogs = map[string]Catalog{
+	English:  nil,
+	Japanese: japanese,
+}
+
+// Languages returns the languages there are catalogs for
+func Languages() []string {
+	languages := make([]string, 0, len(catalogs))
+	for language := range catalogs {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// Lookup returns the catalog for a locale, like ja, ja_JP.UTF-8 or system.
+// An empty locale is English. It's an error for a locale to be in a language
+// there isn't a catalog for, unless it was taken from the environment, when
+// it's English.
+func Lookup(locale string) (Catalog, error) {
+	switch locale {
+	case "":
+		return nil, nil
+	case System:
+		catalog, ok := catalogs[Language(systemLocale())]
+		if !ok {
+			return nil, nil
+		}
+		return catalog, nil
+	}
+
+	catalog, ok := catalogs[Language(locale)]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported locale %q, expected one of %s or %s", locale, strings.Join(Languages(), ", "), System)
+	}
+	return catalog, nil
+}
+
+// Language returns the language of a locale, like ja for ja_JP.UTF-8. The
+// C and POSIX locales are English.
+func Language(locale string) string {
+	if i := strings.IndexAny(locale, "_-.@"); i >= 0 {
+		locale = locale[:i]
+	}
+	language := strings.ToLower(locale)
+	if language == "" || language == "c" || language == "posix" {
+		return English
+	}
+	return language
+}
+
+// systemLocale returns the locale messages are in from the environment,
+// which LC_ALL overrides LC_MESSAGES for, which overrides LANG
+func systemLocale() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if locale := os.Getenv(name); locale != "" {
+			return locale
+		}
+	}
+	return English
+}
@@ -0,0 +1,107 @@
+package locale
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var verbRE = regexp.MustCompile(`%(?:\[(\d+)\])?[-+# 0]*\d*(?:\.\d+)?([a-zA-Z%])`)
+
+// verbs returns the verbs in a format string with the index of the argument
+// each formats, like 1s 2d
+func verbs(format string) []string {
+	var vs []string
+	next := 1
+	for _, m := range verbRE.FindAllStringSubmatch(format, -1) {
+		if m[2] == "%" {
+			continue
+		}
+		if m[1] != "" {
+			next, _ = strconv.Atoi(m[1])
+		}
+		vs = append(vs, strconv.Itoa(next)+m[2])
+		next++
+	}
+	sort.Strings(vs)
+	return vs
+}
+
+func TestTranslationsFormatTheSameArguments(t *testing.T) {
+	t.Parallel()
+
+	for language, catalog := range catalogs {
+		for format, translated := range catalog {
+			assert.Equal(t, verbs(format), verbs(translated), "%s translation of %q", language, format)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	for _, tc := range []struct {
+		locale, lang, err string
+		japanese          bool
+	}{
+		{locale: ""},
+		{locale: "en"},
+		{locale: "ja", japanese: true},
+		{locale: "ja_JP.UTF-8", japanese: true},
+		{locale: "system", lang: "ja_JP.UTF-8", japanese: true},
+		{locale: "system", lang: "C.UTF-8"},
+		{locale: "system", lang: "fr_FR.UTF-8"},
+		{locale: "fr", err: `Unsupported locale "fr", expected one of en, ja or system`},
+	} {
+		t.Setenv("LC_ALL", "")
+		t.Setenv("LC_MESSAGES", "")
+		t.Setenv("LANG", tc.lang)
+
+		catalog, err := Lookup(tc.locale)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, "Lookup(%q)", tc.locale)
+			continue
+		}
+		require.NoError(t, err, "Lookup(%q)", tc.locale)
+		assert.Equal(t, tc.japanese, catalog != nil, "Lookup(%q) with LANG=%q is Japanese", tc.locale, tc.lang)
+	}
+}
+
+func TestLanguage(t *testing.T) {
+	t.Parallel()
+
+	for locale, want := range map[string]string{
+		"ja":              "ja",
+		"ja_JP.UTF-8":     "ja",
+		"ja-JP":           "ja",
+		"JA_JP.eucJP":     "ja",
+		"de_DE@euro":      "de",
+		"C":               "en",
+		"POSIX":           "en",
+		"":                "en",
+		"en_AU.ISO8859-1": "en",
+	} {
+		assert.Equal(t, want, Language(locale), "Language(%q)", locale)
+	}
+}
+
+func TestLoggerTranslatesMessages(t *testing.T) {
+	t.Parallel()
+
+	buf := logger.NewBuffer()
+	l := NewLogger(buf, japanese).WithFields(logger.StringField("agent", "my-agent"))
+
+	l.Warn("Buildkite rejected the call to start the job (%s)", "401 Unauthorized")
+	l.Info("Not translated %d", 1)
+
+	assert.Equal(t, []string{
+		"[warn] Buildkite がジョブの開始を拒否しました (401 Unauthorized)",
+		"[info] Not translated 1",
+	}, buf.Messages)
+
+	// English doesn't need translating
+	assert.Same(t, logger.Logger(buf), NewLogger(buf, nil))
+}
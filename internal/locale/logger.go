@@ -0,0 +1,45 @@
+package locale
+
+import "github.com/buildkite/agent/v3/logger"
+
+// NewLogger returns a logger that translates the format strings of what's
+// logged to it with a catalog, before logging it to l
+func NewLogger(l logger.Logger, c Catalog) logger.Logger {
+	if c == nil {
+		return l
+	}
+	return &translatingLogger{Logger: l, catalog: c}
+}
+
+type translatingLogger struct {
+	logger.Logger
+	catalog Catalog
+}
+
+func (l *translatingLogger) Debug(format string, v ...any) {
+	l.Logger.Debug(l.catalog.Translate(format), v...)
+}
+
+func (l *translatingLogger) Error(format string, v ...any) {
+	l.Logger.Error(l.catalog.Translate(format), v...)
+}
+
+func (l *translatingLogger) Fatal(format string, v ...any) {
+	l.Logger.Fatal(l.catalog.Translate(format), v...)
+}
+
+func (l *translatingLogger) Notice(format string, v ...any) {
+	l.Logger.Notice(l.catalog.Translate(format), v...)
+}
+
+func (l *translatingLogger) Warn(format string, v ...any) {
+	l.Logger.Warn(l.catalog.Translate(format), v...)
+}
+
+func (l *translatingLogger) Info(format string, v ...any) {
+	l.Logger.Info(l.catalog.Translate(format), v...)
+}
+
+func (l *translatingLogger) WithFields(fields ...logger.Field) logger.Logger {
+	return &translatingLogger{Logger: l.Logger.WithFields(fields...), catalog: l.catalog}
+}
@@ -0,0 +1,127 @@
+// Package lock provides advisory locks on files, for processes on the same
+// host to take turns at things like caches, git mirrors and plugin checkouts.
+//
+// They're flock(2) locks on Unix and LockFileEx locks on Windows, so the OS
+// releases them when the process holding them exits, however it exits, and
+// they're never left behind to be broken.
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// ErrLocked is returned by TryAcquire when another lock is in the way
+var ErrLocked = errors.New("locked by another process")
+
+// How often a lock that's held elsewhere is tried again while waiting for it
+const retryDelay = 50 * time.Millisecond
+
+// Mode is how a lock is held
+type Mode int
+
+const (
+	// Exclusive locks are held by one holder at a time, like a writer's
+	Exclusive Mode = iota
+
+	// Shared locks can be held by many holders at once, like readers', but
+	// not while an exclusive lock is held
+	Shared
+)
+
+func (m Mode) String() string {
+	switch m {
+	case Exclusive:
+		return "exclusive"
+	case Shared:
+		return "shared"
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// Lock is a lock held on a file. Locks on the same file conflict whether
+// they're held by different processes or the same one.
+type Lock struct {
+	flock *flock.Flock
+	mode  Mode
+}
+
+// Acquire waits until it holds a lock on the file at path, which is created
+// if it isn't there, or the context is done, when it returns the context's
+// error
+func Acquire(ctx context.Context, path string, mode Mode) (*Lock, error) {
+	l, err := newLock(path, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	try := l.flock.TryLockContext
+	if mode == Shared {
+		try = l.flock.TryRLockContext
+	}
+	if _, err := try(ctx, retryDelay); err != nil {
+		l.flock.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// TryAcquire takes a lock on the file at path, which is created if it isn't
+// there, if it can without waiting. It returns ErrLocked if it can't.
+func TryAcquire(path string, mode Mode) (*Lock, error) {
+	l, err := newLock(path, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	try := l.flock.TryLock
+	if mode == Shared {
+		try = l.flock.TryRLock
+	}
+	locked, err := try()
+	if err == nil && !locked {
+		err = ErrLocked
+	}
+	if err != nil {
+		l.flock.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func newLock(path string, mode Mode) (*Lock, error) {
+	if mode != Exclusive && mode != Shared {
+		return nil, fmt.Errorf("invalid lock mode %v", mode)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(abs), 0o777); err != nil {
+		return nil, err
+	}
+	return &Lock{flock: flock.New(abs), mode: mode}, nil
+}
+
+// Path returns the absolute path of the locked file
+func (l *Lock) Path() string {
+	return l.flock.Path()
+}
+
+// Mode returns how the lock is held
+func (l *Lock) Mode() Mode {
+	return l.mode
+}
+
+// Unlock releases the lock. The file is left where it is, as removing it
+// could let another process lock a new file at the same path while a third
+// still has the old one locked.
+func (l *Lock) Unlock() error {
+	return l.flock.Unlock()
+}
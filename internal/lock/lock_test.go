@@ -0,0 +1,100 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExclusiveLocksConflict(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "cache", "my.lock")
+
+	l, err := TryAcquire(path, Exclusive)
+	require.NoError(t, err)
+	assert.Equal(t, Exclusive, l.Mode())
+
+	for _, mode := range []Mode{Exclusive, Shared} {
+		_, err := TryAcquire(path, mode)
+		assert.ErrorIs(t, err, ErrLocked, "TryAcquire(%q, %v)", path, mode)
+	}
+
+	require.NoError(t, l.Unlock())
+
+	l, err = TryAcquire(path, Exclusive)
+	require.NoError(t, err)
+	require.NoError(t, l.Unlock())
+}
+
+func TestSharedLocksAreShared(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "my.lock")
+
+	first, err := TryAcquire(path, Shared)
+	require.NoError(t, err)
+	second, err := TryAcquire(path, Shared)
+	require.NoError(t, err)
+
+	// Until they're both unlocked, nothing can have it exclusively
+	_, err = TryAcquire(path, Exclusive)
+	assert.ErrorIs(t, err, ErrLocked)
+
+	require.NoError(t, first.Unlock())
+	_, err = TryAcquire(path, Exclusive)
+	assert.ErrorIs(t, err, ErrLocked)
+
+	require.NoError(t, second.Unlock())
+	l, err := TryAcquire(path, Exclusive)
+	require.NoError(t, err)
+	require.NoError(t, l.Unlock())
+}
+
+func TestAcquireWaitsForTheLock(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "my.lock")
+
+	held, err := TryAcquire(path, Exclusive)
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		held.Unlock()
+	}()
+
+	start := time.Now()
+	l, err := Acquire(context.Background(), path, Shared)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	assert.Equal(t, path, l.Path())
+	require.NoError(t, l.Unlock())
+}
+
+func TestAcquireStopsWhenTheContextIsDone(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "my.lock")
+
+	held, err := TryAcquire(path, Exclusive)
+	require.NoError(t, err)
+	defer held.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err = Acquire(ctx, path, Exclusive)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "Acquire(ctx, %q, Exclusive) error = %v, want context.DeadlineExceeded", path, err)
+}
+
+func TestInvalidMode(t *testing.T) {
+	t.Parallel()
+
+	_, err := TryAcquire(filepath.Join(t.TempDir(), "my.lock"), Mode(7))
+	assert.EqualError(t, err, "invalid lock mode Mode(7)")
+}
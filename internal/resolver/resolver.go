@@ -0,0 +1,154 @@
+// Package resolver lets the agent resolve hostnames differently to the host
+// it runs on, either with static overrides or by using particular nameservers
+// or a DNS over HTTPS server. This is for split-horizon DNS setups, where the
+// system resolver inside build hosts gives the wrong answers.
+//
+// It is intended for internal use by buildkite-agent only.
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const defaultDNSPort = "53"
+
+// Config describes how hostnames should be resolved. The zero value uses the
+// system resolver.
+type Config struct {
+	// Hosts maps hostnames to the IP address to use for them, like entries in
+	// /etc/hosts. These take priority over any resolver.
+	Hosts map[string]string
+
+	// Nameservers to query instead of the system's, as host:port
+	Nameservers []string
+
+	// The URL of a DNS over HTTPS (RFC 8484) server to query instead of the
+	// system's resolver
+	DoHURL string
+}
+
+// IsZero returns whether the config leaves resolution to the system
+func (c Config) IsZero() bool {
+	return len(c.Hosts) == 0 && len(c.Nameservers) == 0 && c.DoHURL == ""
+}
+
+// ParseHosts parses host overrides given as hostname=ip
+func ParseHosts(entries []string) (map[string]string, error) {
+	hosts := map[string]string{}
+	for _, entry := range entries {
+		host, ip, ok := strings.Cut(entry, "=")
+		host = strings.TrimSpace(host)
+		ip = strings.TrimSpace(ip)
+		if !ok || host == "" {
+			return nil, fmt.Errorf("invalid DNS override %q, expected hostname=ip", entry)
+		}
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid DNS override %q: %q is not an IP address", entry, ip)
+		}
+		hosts[strings.ToLower(host)] = ip
+	}
+	return hosts, nil
+}
+
+// ParseResolver parses a resolver, which is either the https:// URL of a DNS
+// over HTTPS server, or a comma separated list of nameservers, with optional
+// ports
+func ParseResolver(s string) (nameservers []string, dohURL string, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, "", nil
+	}
+
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid DNS over HTTPS URL %q: %w", s, err)
+		}
+		if u.Scheme != "https" || u.Host == "" {
+			return nil, "", fmt.Errorf("invalid DNS over HTTPS URL %q, expected https://host/path", s)
+		}
+		return nil, s, nil
+	}
+
+	for _, ns := range strings.Split(s, ",") {
+		ns = strings.TrimSpace(ns)
+		if ns == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(ns)
+		if err != nil {
+			host, port = strings.Trim(ns, "[]"), defaultDNSPort
+		}
+		if net.ParseIP(host) == nil {
+			return nil, "", fmt.Errorf("invalid nameserver %q, expected an IP address", ns)
+		}
+		nameservers = append(nameservers, net.JoinHostPort(host, port))
+	}
+	return nameservers, "", nil
+}
+
+// DialContext returns a dial function that resolves hostnames according to
+// the config, and otherwise dials using d
+func (c Config) DialContext(d *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if c.IsZero() {
+		return d.DialContext
+	}
+
+	dialer := *d
+	dialer.Resolver = c.resolver(d)
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, c.override(address))
+	}
+}
+
+// override replaces the host in address if there's an override for it
+func (c Config) override(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if ip, ok := c.Hosts[strings.ToLower(strings.TrimSuffix(host, "."))]; ok {
+		return net.JoinHostPort(ip, port)
+	}
+	return address
+}
+
+// resolver returns the resolver to look up hosts without overrides, or nil
+// for the system resolver
+func (c Config) resolver(d *net.Dialer) *net.Resolver {
+	switch {
+	case c.DoHURL != "":
+		return newDoHResolver(c.DoHURL, c.Hosts, d)
+
+	case len(c.Nameservers) > 0:
+		var next uint32
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				// Take turns, so that the resolver's retries try each nameserver
+				i := atomic.AddUint32(&next, 1) - 1
+				return d.DialContext(ctx, network, c.Nameservers[int(i)%len(c.Nameservers)])
+			},
+		}
+	}
+	return nil
+}
+
+// Install makes the default HTTP transport, used by the artifact storage
+// clients, resolve hostnames according to the config
+func Install(c Config) {
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t.DialContext = c.DialContext(&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		})
+	}
+}
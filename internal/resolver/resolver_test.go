@@ -0,0 +1,137 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHosts(t *testing.T) {
+	t.Parallel()
+
+	hosts, err := ParseHosts([]string{"agent.buildkite.com=10.0.0.1", " Artifacts.Example.com = ::1 "})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"agent.buildkite.com":   "10.0.0.1",
+		"artifacts.example.com": "::1",
+	}, hosts)
+
+	for _, entry := range []string{"agent.buildkite.com", "=10.0.0.1", "agent.buildkite.com=llamas"} {
+		_, err := ParseHosts([]string{entry})
+		assert.Error(t, err, "ParseHosts(%q)", entry)
+	}
+}
+
+func TestParseResolver(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		in          string
+		nameservers []string
+		dohURL      string
+		err         bool
+	}{
+		{in: ""},
+		{in: "10.0.0.2", nameservers: []string{"10.0.0.2:53"}},
+		{in: "10.0.0.2, 10.0.0.3:5353", nameservers: []string{"10.0.0.2:53", "10.0.0.3:5353"}},
+		{in: "[::1]:5353,::2", nameservers: []string{"[::1]:5353", "[::2]:53"}},
+		{in: "https://dns.example.com/dns-query", dohURL: "https://dns.example.com/dns-query"},
+		{in: "http://dns.example.com/dns-query", err: true},
+		{in: "dns.example.com", err: true},
+	} {
+		nameservers, dohURL, err := ParseResolver(tc.in)
+		if tc.err {
+			assert.Error(t, err, "ParseResolver(%q)", tc.in)
+			continue
+		}
+		require.NoError(t, err, "ParseResolver(%q)", tc.in)
+		assert.Equal(t, tc.nameservers, nameservers, "ParseResolver(%q)", tc.in)
+		assert.Equal(t, tc.dohURL, dohURL, "ParseResolver(%q)", tc.in)
+	}
+}
+
+func TestDialContextUsesHostOverrides(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	dial := Config{Hosts: map[string]string{"agent.example.invalid": "127.0.0.1"}}.DialContext(&net.Dialer{})
+	conn, err := dial(context.Background(), "tcp", net.JoinHostPort("Agent.Example.Invalid.", port))
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestDoHConnResolvesThroughServer(t *testing.T) {
+	t.Parallel()
+
+	// A DNS over HTTPS server that says every A record is 192.0.2.1
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "wrong content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answerA(query, net.IPv4(192, 0, 2, 1)))
+	}))
+	defer server.Close()
+
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return &dohConn{ctx: ctx, client: server.Client(), url: server.URL}, nil
+		},
+	}
+
+	addrs, err := r.LookupHost(context.Background(), "build.internal")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, addrs)
+}
+
+// answerA builds a response to a single question DNS query, answering it
+// with ip if it's for an A record, or with no answers otherwise
+func answerA(query []byte, ip net.IP) []byte {
+	// Skip over the question's name to find its type
+	i := 12
+	for query[i] != 0 {
+		i += int(query[i]) + 1
+	}
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+	question := query[12 : i+5]
+
+	resp := append([]byte{}, query[:12]...)
+	resp[2] |= 0x80                   // this is a response
+	resp[3] = 0x80                    // recursion available, no error
+	copy(resp[6:12], make([]byte, 6)) // no answers, authorities or additionals yet
+	resp = append(resp, question...)
+
+	if qtype == 1 {
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		resp = append(resp,
+			0xc0, 12, // the name in the question
+			0, 1, // A
+			0, 1, // IN
+			0, 0, 0, 60, // TTL
+			0, 4, // length
+		)
+		resp = append(resp, ip.To4()...)
+	}
+	return resp
+}
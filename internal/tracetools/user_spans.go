@@ -0,0 +1,115 @@
+package tracetools
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	ddext "gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+)
+
+// User spans are marked in a job's log with an APC escape sequence, like the
+// ansi-timestamps experiment's timestamps, so they aren't shown in the log:
+// ESC _ bk;span=start;name=npm%20install;t=1690000000000 BEL
+var userSpanMarkerRegexp = regexp.MustCompile("\x1b_bk;span=(start|end);name=([^;\x07]*);t=(\\d+)\x07")
+
+// UserSpan is a span of a job's time that its scripts marked the start and
+// end of with buildkite-agent span start and end
+type UserSpan struct {
+	Name  string
+	Start time.Time
+	End   time.Time
+}
+
+func (s UserSpan) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// UserSpanMarker returns the marker for the start or end of a span at a time
+func UserSpanMarker(action, name string, t time.Time) string {
+	return fmt.Sprintf("\x1b_bk;span=%s;name=%s;t=%d\x07", action, url.QueryEscape(name), t.UnixMilli())
+}
+
+// UserSpanScanner finds the spans marked in a job's log. Spans with the same
+// name can be nested, and each end marker ends the latest of them to start.
+type UserSpanScanner struct {
+	open map[string][]time.Time
+}
+
+func NewUserSpanScanner() *UserSpanScanner {
+	return &UserSpanScanner{open: make(map[string][]time.Time)}
+}
+
+// Scan returns the spans a line of the log ends. End markers without a start
+// marker are ignored.
+func (s *UserSpanScanner) Scan(line string) []UserSpan {
+	var spans []UserSpan
+	for _, m := range userSpanMarkerRegexp.FindAllStringSubmatch(line, -1) {
+		name, err := url.QueryUnescape(m[2])
+		if err != nil {
+			continue
+		}
+		ms, err := strconv.ParseInt(m[3], 10, 64)
+		if err != nil {
+			continue
+		}
+		t := time.UnixMilli(ms)
+
+		if m[1] == "start" {
+			s.open[name] = append(s.open[name], t)
+			continue
+		}
+
+		starts := s.open[name]
+		if len(starts) == 0 {
+			continue
+		}
+		spans = append(spans, UserSpan{Name: name, Start: starts[len(starts)-1], End: t})
+		if len(starts) == 1 {
+			delete(s.open, name)
+		} else {
+			s.open[name] = starts[:len(starts)-1]
+		}
+	}
+	return spans
+}
+
+// Open returns the names of the spans that have started but not ended
+func (s *UserSpanScanner) Open() []string {
+	names := make([]string, 0, len(s.open))
+	for name := range s.open {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RecordUserSpan adds a span that's already ended to the trace in the
+// context, as a child of its current span
+func RecordUserSpan(ctx context.Context, span UserSpan, tracingBackend string) {
+	switch tracingBackend {
+	case BackendDatadog:
+		opts := []opentracing.StartSpanOption{opentracing.StartTime(span.Start)}
+		if parent := opentracing.SpanFromContext(ctx); parent != nil {
+			opts = append(opts, opentracing.ChildOf(parent.Context()))
+		}
+		s := opentracing.StartSpan("user.span", opts...)
+		s.SetTag(ddext.ResourceName, span.Name)
+		s.SetTag(ddext.AnalyticsEvent, true)
+		s.SetTag("span.name", span.Name)
+		s.FinishWithOptions(opentracing.FinishOptions{FinishTime: span.End})
+
+	case BackendOpenTelemetry:
+		_, s := otel.Tracer("buildkite-agent").Start(ctx, span.Name, trace.WithTimestamp(span.Start))
+		s.SetAttributes(attribute.String("analytics.event", "true"), attribute.String("span.name", span.Name))
+		s.End(trace.WithTimestamp(span.End))
+	}
+}
@@ -0,0 +1,61 @@
+package tracetools
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestUserSpanScanner(t *testing.T) {
+	t.Parallel()
+
+	at := func(ms int64) time.Time { return time.UnixMilli(1690000000000 + ms) }
+
+	s := NewUserSpanScanner()
+	assert.Empty(t, s.Scan("npm install"))
+	assert.Empty(t, s.Scan(UserSpanMarker("start", "npm install", at(0))+"added 1203 packages"))
+	assert.Empty(t, s.Scan(UserSpanMarker("start", "build; then test", at(100))))
+	assert.Empty(t, s.Scan(UserSpanMarker("start", "npm install", at(200))))
+
+	// Markers can be anywhere in a line, and there can be more than one
+	line := "[2023-07-22T04:26:40Z] " + UserSpanMarker("end", "npm install", at(1200)) + "ok" + UserSpanMarker("end", "npm install", at(1500))
+	assert.Equal(t, []UserSpan{
+		{Name: "npm install", Start: at(200), End: at(1200)},
+		{Name: "npm install", Start: at(0), End: at(1500)},
+	}, s.Scan(line))
+
+	// Ends without starts are ignored
+	assert.Empty(t, s.Scan(UserSpanMarker("end", "webpack", at(2000))))
+
+	assert.Equal(t, []string{"build; then test"}, s.Open())
+	spans := s.Scan(UserSpanMarker("end", "build; then test", at(2100)))
+	require.Len(t, spans, 1)
+	assert.Equal(t, 2*time.Second, spans[0].Duration())
+	assert.Empty(t, s.Open())
+}
+
+func TestRecordUserSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	ctx, job := provider.Tracer("test").Start(context.Background(), "job")
+	start := time.UnixMilli(1690000000000)
+	RecordUserSpan(ctx, UserSpan{Name: "webpack", Start: start, End: start.Add(time.Minute)}, BackendOpenTelemetry)
+	job.End()
+
+	ended := recorder.Ended()
+	require.Len(t, ended, 2)
+	assert.Equal(t, "webpack", ended[0].Name())
+	assert.Equal(t, start, ended[0].StartTime())
+	assert.Equal(t, start.Add(time.Minute), ended[0].EndTime())
+	assert.Equal(t, job.SpanContext().SpanID(), ended[0].Parent().SpanID())
+}
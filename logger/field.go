@@ -5,17 +5,22 @@ import (
 	"time"
 )
 
+// Field is a key and value logged along with messages, like the name of the
+// agent that logged them
 type Field interface {
 	Key() string
 	String() string
 }
 
+// Fields is the fields a logger logs messages with
 type Fields []Field
 
+// Add adds fields to the end of the list
 func (f *Fields) Add(fields ...Field) {
 	*f = append(*f, fields...)
 }
 
+// Get returns the fields with a key, in the order they were added
 func (f *Fields) Get(key string) []Field {
 	fields := []Field{}
 	for _, field := range *f {
@@ -26,6 +31,7 @@ func (f *Fields) Get(key string) []Field {
 	return fields
 }
 
+// GenericField is a Field whose value is formatted with a fmt verb
 type GenericField struct {
 	key    string
 	value  any
@@ -40,6 +46,7 @@ func (f GenericField) String() string {
 	return fmt.Sprintf(f.format, f.value)
 }
 
+// StringField returns a field with a string value
 func StringField(key, value string) Field {
 	return GenericField{
 		key:    key,
@@ -48,6 +55,7 @@ func StringField(key, value string) Field {
 	}
 }
 
+// IntField returns a field with an int value
 func IntField(key string, value int) Field {
 	return GenericField{
 		key:    key,
@@ -56,6 +64,7 @@ func IntField(key string, value int) Field {
 	}
 }
 
+// DurationField returns a field with a time.Duration value, like 1.5s
 func DurationField(key string, value time.Duration) Field {
 	return GenericField{
 		key:    key,
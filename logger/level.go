@@ -5,8 +5,11 @@ import (
 	"strings"
 )
 
+// Level is how important a message is. Loggers only log messages at their
+// level or above.
 type Level int
 
+// The levels, from least to most important
 const (
 	DEBUG Level = iota
 	NOTICE
@@ -25,6 +28,8 @@ var levelNames = []string{
 	"FATAL",
 }
 
+// LevelFromString returns the level with a name like info or INFO. warning
+// is the same as warn.
 func LevelFromString(s string) (Level, error) {
 	switch strings.ToLower(s) {
 	case "debug":
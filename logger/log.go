@@ -2,7 +2,9 @@
 // configurable formats to different outputs, such as a console, plain text
 // file, or a JSON file.
 //
-// It is intended for internal use by buildkite-agent only.
+// The api and process packages log with its Logger, so programs that use
+// them can pass their own implementation, or Discard. It follows the
+// module's semantic versioning.
 package logger
 
 import (
@@ -28,6 +30,7 @@ const (
 	cyan      = "1;36"
 )
 
+// DateFormat is the layout of the times text logs start with
 const (
 	DateFormat = "2006-01-02 15:04:05"
 )
@@ -37,19 +40,42 @@ var (
 	windowsColors bool
 )
 
+// Logger logs messages at different levels. Messages are formatted with
+// their arguments like fmt.Sprintf.
 type Logger interface {
+	// Debug logs a message about what's happening in detail, which is only
+	// logged at the DEBUG level
 	Debug(format string, v ...any)
+
+	// Error logs a message about something that failed
 	Error(format string, v ...any)
+
+	// Fatal logs a message about something the program can't carry on
+	// after, and exits with status 1
 	Fatal(format string, v ...any)
+
+	// Notice logs a message that's more important than information, but
+	// isn't a warning
 	Notice(format string, v ...any)
+
+	// Warn logs a message about something that might be a problem
 	Warn(format string, v ...any)
+
+	// Info logs a message about what's happening
 	Info(format string, v ...any)
 
+	// WithFields returns a copy of the logger that logs the fields with
+	// each message, along with any it already had
 	WithFields(fields ...Field) Logger
+
+	// SetLevel sets the least important level of the messages to log
 	SetLevel(level Level)
+
+	// Level returns the least important level of the messages logged
 	Level() Level
 }
 
+// ConsoleLogger is a Logger that prints messages with a Printer
 type ConsoleLogger struct {
 	level   Level
 	exitFn  func(int)
@@ -57,6 +83,8 @@ type ConsoleLogger struct {
 	printer Printer
 }
 
+// NewConsoleLogger returns a logger that prints messages at all levels with
+// printer, and calls exitFn with 1 after a message is logged with Fatal
 func NewConsoleLogger(printer Printer, exitFn func(int)) Logger {
 	return &ConsoleLogger{
 		level:   DEBUG,
@@ -115,10 +143,14 @@ func (l *ConsoleLogger) Level() Level {
 	return l.level
 }
 
+// Printer prints the messages a ConsoleLogger logs
 type Printer interface {
 	Print(level Level, msg string, fields Fields)
 }
 
+// TextPrinter prints messages as lines of text, after the time and their
+// level, followed by their fields. Fields can be shown before messages, or
+// not at all.
 type TextPrinter struct {
 	Colors bool
 	Writer io.Writer
@@ -127,6 +159,8 @@ type TextPrinter struct {
 	IsVisibleFn func(Field) bool
 }
 
+// NewTextPrinter returns a TextPrinter that prints to w, in color if the
+// terminal supports it
 func NewTextPrinter(w io.Writer) *TextPrinter {
 	return &TextPrinter{
 		Writer: w,
@@ -220,6 +254,7 @@ func (l *TextPrinter) Print(level Level, msg string, fields Fields) {
 	mutex.Unlock()
 }
 
+// ColorsSupported returns whether stdout is a terminal that can show colors
 func ColorsSupported() bool {
 	// Color support for windows is set in init
 	if runtime.GOOS == "windows" && !windowsColors {
@@ -234,10 +269,13 @@ func ColorsSupported() bool {
 	return false
 }
 
+// JSONPrinter prints messages as JSON objects, one per line, with their time,
+// level and fields
 type JSONPrinter struct {
 	Writer io.Writer
 }
 
+// NewJSONPrinter returns a JSONPrinter that prints to w
 func NewJSONPrinter(w io.Writer) *JSONPrinter {
 	return &JSONPrinter{
 		Writer: w,
@@ -261,6 +299,7 @@ func (p *JSONPrinter) Print(level Level, msg string, fields Fields) {
 	mutex.Unlock()
 }
 
+// Discard is a Logger that doesn't log anything
 var Discard = &ConsoleLogger{
 	printer: &TextPrinter{
 		Writer: io.Discard,
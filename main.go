@@ -3,14 +3,14 @@
 package main
 
 // see https://blog.golang.org/generate
-//go:generate go run mime/generate.go
-//go:generate go fmt mime/mime.go
+//go:generate go run internal/mime/generate.go
+//go:generate go fmt internal/mime/mime.go
 
 import (
 	"fmt"
 	"os"
 
-	"github.com/buildkite/agent/v3/clicommand"
+	"github.com/buildkite/agent/v3/internal/clicommand"
 	"github.com/buildkite/agent/v3/version"
 	"github.com/urfave/cli"
 )
@@ -66,6 +66,12 @@ func main() {
 		clicommand.AcknowledgementsCommand,
 		clicommand.AgentStartCommand,
 		clicommand.AnnotateCommand,
+		clicommand.BadgeCommand,
+		clicommand.BenchCommand,
+		clicommand.BenchJobCommand,
+		clicommand.CompletionCommand,
+		clicommand.DoctorCommand,
+		clicommand.FakeAPICommand,
 		{
 			Name:  "annotation",
 			Usage: "Make changes an annotation on the currently running build",
@@ -81,6 +87,29 @@ func main() {
 				clicommand.ArtifactDownloadCommand,
 				clicommand.ArtifactSearchCommand,
 				clicommand.ArtifactShasumCommand,
+				clicommand.ArtifactPublishCommand,
+			},
+		},
+		{
+			Name:  "benchmark",
+			Usage: "Keep and compare the build's benchmark results",
+			Subcommands: []cli.Command{
+				clicommand.BenchmarkUploadCommand,
+			},
+		},
+		{
+			Name:  "cache",
+			Usage: "Save and restore files, like dependencies, between builds",
+			Subcommands: []cli.Command{
+				clicommand.CacheSaveCommand,
+				clicommand.CacheRestoreCommand,
+			},
+		},
+		{
+			Name:  "coverage",
+			Usage: "Keep and compare the build's test coverage",
+			Subcommands: []cli.Command{
+				clicommand.CoverageUploadCommand,
 			},
 		},
 		{
@@ -90,6 +119,29 @@ func main() {
 				clicommand.EnvDumpCommand,
 			},
 		},
+		{
+			Name:  "group",
+			Usage: "Fold the job's log output into named groups",
+			Subcommands: []cli.Command{
+				clicommand.GroupOpenCommand,
+				clicommand.GroupCloseCommand,
+			},
+		},
+		{
+			Name:  "hook",
+			Usage: "Inspect the hooks that jobs run",
+			Subcommands: []cli.Command{
+				clicommand.HookAuditCommand,
+			},
+		},
+		{
+			Name:  "input",
+			Usage: "Get the values of block and input steps' fields",
+			Subcommands: []cli.Command{
+				clicommand.InputGetCommand,
+			},
+		},
+		clicommand.InstallCommand,
 		{
 			Name:  "meta-data",
 			Usage: "Get/set data from Buildkite jobs",
@@ -114,6 +166,23 @@ func main() {
 				clicommand.PipelineUploadCommand,
 			},
 		},
+		{
+			Name:  "plugin",
+			Usage: "Work with the plugins used by pipelines",
+			Subcommands: []cli.Command{
+				clicommand.PluginChecksumCommand,
+			},
+		},
+		clicommand.RunCommand,
+		clicommand.ScaffoldCommand,
+		{
+			Name:  "span",
+			Usage: "Time spans of a job, like its dependencies being installed",
+			Subcommands: []cli.Command{
+				clicommand.SpanStartCommand,
+				clicommand.SpanEndCommand,
+			},
+		},
 		{
 			Name:  "step",
 			Usage: "Get or update an attribute of a build step",
@@ -122,6 +191,14 @@ func main() {
 				clicommand.StepUpdateCommand,
 			},
 		},
+		{
+			Name:  "terraform",
+			Usage: "Review and approve terraform plans before they're applied",
+			Subcommands: []cli.Command{
+				clicommand.TerraformUploadPlanCommand,
+				clicommand.TerraformWaitForApprovalCommand,
+			},
+		},
 		clicommand.BootstrapCommand,
 	}
 
@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package process
+
+import "syscall"
+
+// setCredential has the process run as the configured user, with its group
+// and no supplementary groups
+func (p *Process) setCredential() error {
+	if p.command.SysProcAttr == nil {
+		p.command.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	p.command.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    p.conf.Credential.UID,
+		Gid:    p.conf.Credential.GID,
+		Groups: []uint32{},
+	}
+	return nil
+}
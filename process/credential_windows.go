@@ -0,0 +1,7 @@
+package process
+
+import "errors"
+
+func (p *Process) setCredential() error {
+	return errors.New("Running processes as another user is only supported on Unix")
+}
@@ -0,0 +1,129 @@
+package process
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
+)
+
+// OutputTranscoder makes sure output is UTF-8 before it's written on, as
+// bytes that aren't break rendering the log and encoding it as JSON.
+//
+// It either decodes all of the output from a given encoding, like
+// windows-1252 or cp437, or with the encoding "auto", keeps the output that's
+// valid UTF-8 and decodes the bytes that aren't as windows-1252, which is
+// what the output of most tools that don't write UTF-8 turns out to be. With
+// the encoding "utf-8", bytes that aren't valid UTF-8 are replaced with
+// U+FFFD. To ensure a sequence split between writes is written out, be sure
+// to call Flush when done.
+type OutputTranscoder struct {
+	mu sync.Mutex
+	w  io.Writer
+
+	// Decodes all of the output, if an encoding was given
+	decoder *transform.Writer
+
+	// Decodes the bytes that aren't valid UTF-8, in "auto"
+	fallback *charmap.Charmap
+
+	// The start of a UTF-8 sequence that might be finished in the next write
+	pending []byte
+}
+
+// NewOutputTranscoder sets up an OutputTranscoder outputting UTF-8 to an
+// io.Writer w, from output in the named encoding.
+func NewOutputTranscoder(w io.Writer, name string) (*OutputTranscoder, error) {
+	t := &OutputTranscoder{w: w}
+	if strings.EqualFold(name, "auto") {
+		t.fallback = charmap.Windows1252
+		return t, nil
+	}
+
+	enc, err := lookupEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	t.decoder = transform.NewWriter(w, enc.NewDecoder())
+	return t, nil
+}
+
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	if enc, err := ianaindex.IANA.Encoding(name); err == nil && enc != nil {
+		return enc, nil
+	}
+	if enc, err := htmlindex.Get(name); err == nil {
+		return enc, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q", name)
+}
+
+// Write writes the given data to the OutputTranscoder's output as UTF-8.
+// The start of a sequence at the end of the data may be held back in an
+// internal buffer and written in a subsequent call to Write.
+func (t *OutputTranscoder) Write(data []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.decoder != nil {
+		return t.decoder.Write(data)
+	}
+
+	buf := append(t.pending, data...)
+	t.pending = nil
+
+	out := make([]byte, 0, len(buf))
+	for i := 0; i < len(buf); {
+		if buf[i] < utf8.RuneSelf {
+			out = append(out, buf[i])
+			i++
+			continue
+		}
+
+		r, size := utf8.DecodeRune(buf[i:])
+		switch {
+		case r != utf8.RuneError || size > 1:
+			out = append(out, buf[i:i+size]...)
+		case !utf8.FullRune(buf[i:]):
+			// Wait for the rest of the sequence
+			t.pending = append([]byte{}, buf[i:]...)
+			size = len(buf) - i
+		default:
+			out = utf8.AppendRune(out, t.fallback.DecodeByte(buf[i]))
+		}
+		i += size
+	}
+
+	if _, err := t.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Flush writes out anything held back, as it won't be finished.
+func (t *OutputTranscoder) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.decoder != nil {
+		return t.decoder.Close()
+	}
+
+	var out []byte
+	for _, b := range t.pending {
+		out = utf8.AppendRune(out, t.fallback.DecodeByte(b))
+	}
+	t.pending = nil
+	if len(out) == 0 {
+		return nil
+	}
+	_, err := t.w.Write(out)
+	return err
+}
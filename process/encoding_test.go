@@ -0,0 +1,103 @@
+package process_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buildkite/agent/v3/process"
+)
+
+func TestOutputTranscoder(t *testing.T) {
+	tests := []struct {
+		name, encoding, input, want string
+	}{
+		{
+			name:     "auto keeps utf-8",
+			encoding: "auto",
+			input:    "héllo wörld ✅ 🦙\n",
+			want:     "héllo wörld ✅ 🦙\n",
+		},
+		{
+			name:     "auto decodes windows-1252",
+			encoding: "auto",
+			input:    "caf\xe9 \x93quoted\x94 \x80 5\n",
+			want:     "café “quoted” € 5\n",
+		},
+		{
+			name:     "auto decodes a mix",
+			encoding: "auto",
+			input:    "ok ✅, na\xefve\n",
+			want:     "ok ✅, naïve\n",
+		},
+		{
+			name:     "auto decodes an unfinished sequence",
+			encoding: "auto",
+			input:    "trailing \xe2\x9c",
+			want:     "trailing âœ",
+		},
+		{
+			name:     "utf-8 replaces invalid bytes",
+			encoding: "utf-8",
+			input:    "caf\xe9 ✅\n",
+			want:     "caf� ✅\n",
+		},
+		{
+			name:     "cp437",
+			encoding: "cp437",
+			input:    "\xc9\xcd\xbb box \x81ber\n",
+			want:     "╔═╗ box über\n",
+		},
+		{
+			name:     "windows-1251",
+			encoding: "windows-1251",
+			input:    "\xcf\xf0\xe8\xe2\xe5\xf2\n",
+			want:     "Привет\n",
+		},
+		{
+			name:     "shift_jis",
+			encoding: "shift_jis",
+			input:    "\x82\xb1\x82\xf1\x82\xc9\x82\xbf\x82\xcd\n",
+			want:     "こんにちは\n",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Write a byte at a time, as well as all at once, so sequences
+			// are split between writes
+			for _, chunk := range []int{1, len(tc.input)} {
+				out := &bytes.Buffer{}
+				tw, err := process.NewOutputTranscoder(out, tc.encoding)
+				if err != nil {
+					t.Fatalf("process.NewOutputTranscoder(out, %q) error = %v", tc.encoding, err)
+				}
+
+				for i := 0; i < len(tc.input); i += chunk {
+					end := i + chunk
+					if end > len(tc.input) {
+						end = len(tc.input)
+					}
+					if _, err := tw.Write([]byte(tc.input[i:end])); err != nil {
+						t.Fatalf("tw.Write(%q) error = %v", tc.input[i:end], err)
+					}
+				}
+				if err := tw.Flush(); err != nil {
+					t.Fatalf("tw.Flush() = %v", err)
+				}
+
+				if got := out.String(); got != tc.want {
+					t.Errorf("written in chunks of %d, output = %q, want %q", chunk, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestOutputTranscoderUnknownEncoding(t *testing.T) {
+	if _, err := process.NewOutputTranscoder(&bytes.Buffer{}, "klingon"); err == nil {
+		t.Errorf(`process.NewOutputTranscoder(out, "klingon") error = nil, want an error`)
+	}
+}
@@ -0,0 +1,228 @@
+package process
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// The streams a line of output can come from. Output from a PTY can't be
+// told apart, so is all from the pty stream.
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+	StreamPTY    = "pty"
+)
+
+// Lines partially written to a LineMetadataExtractor are held back until
+// they're finished, up to this many bytes
+const maxLineMetadataBuffer = 64 * 1024
+
+// The levels of the lines the bootstrap writes itself, rather than the
+// processes it runs
+const (
+	LevelComment = "comment"
+	LevelWarning = "warning"
+	LevelError   = "error"
+)
+
+var (
+	lineTagRE  = regexp.MustCompile(`\x1b_bk;stream=([a-z]+);source=([^;\x07\x1b]*)\x07`)
+	levelTagRE = regexp.MustCompile(`\x1b_bk;level=([a-z]+)\x07`)
+)
+
+// LineTag returns the tag that starts a line of output to record the stream
+// and process it came from. It's an APC escape sequence, like the
+// ansi-timestamps experiment's timestamps, which terminals don't show:
+//
+//	\x1b_bk;stream=stderr;source=hook:agent:pre-command\x07
+func LineTag(stream, source string) string {
+	source = strings.Map(func(r rune) rune {
+		if r == ';' || r < ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, source)
+	return "\x1b_bk;stream=" + stream + ";source=" + source + "\x07"
+}
+
+// LevelTag returns the tag that starts a line the bootstrap wrote itself, like
+// a comment, warning or error, to record its level. Unlike LineTags, they're
+// left in the log, so it can be styled and filtered by them:
+//
+//	\x1b_bk;level=warning\x07
+func LevelTag(level string) string {
+	return "\x1b_bk;level=" + level + "\x07"
+}
+
+// LineTagger writes output to w with a LineTag at the start of each line.
+// Each line is written in one call to w, so taggers for a command's stdout
+// and stderr can share w and a lock. To write out a final line that isn't
+// finished, call Flush.
+type LineTagger struct {
+	w   io.Writer
+	mu  *sync.Mutex
+	tag []byte
+	buf []byte
+}
+
+// NewLineTagger returns a LineTagger that writes to w while holding mu, if
+// it isn't nil
+func NewLineTagger(w io.Writer, mu *sync.Mutex, stream, source string) *LineTagger {
+	return &LineTagger{w: w, mu: mu, tag: []byte(LineTag(stream, source))}
+}
+
+func (t *LineTagger) Write(data []byte) (int, error) {
+	t.buf = append(t.buf, data...)
+	for {
+		i := bytes.IndexByte(t.buf, '\n')
+		if i < 0 {
+			return len(data), nil
+		}
+		if err := t.writeLine(t.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		t.buf = t.buf[i+1:]
+	}
+}
+
+// Flush writes out any line that hasn't been finished
+func (t *LineTagger) Flush() error {
+	if len(t.buf) == 0 {
+		return nil
+	}
+	err := t.writeLine(t.buf)
+	t.buf = nil
+	return err
+}
+
+func (t *LineTagger) writeLine(line []byte) error {
+	if t.mu != nil {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+	}
+	_, err := t.w.Write(append(append([]byte{}, t.tag...), line...))
+	return err
+}
+
+// The source of lines without a tag, which the bootstrap wrote itself, like
+// its headers
+const untaggedLineSource = "bootstrap"
+
+// LineMetadata is where the lines of a job's output from Line on came from,
+// until the next LineMetadata. Lines are numbered from 1.
+type LineMetadata struct {
+	Line   int    `json:"line"`
+	Stream string `json:"stream,omitempty"`
+	Source string `json:"source"`
+	Level  string `json:"level,omitempty"`
+}
+
+// LineMetadataExtractor takes the LineTags out of the output written to it
+// and writes the rest on to w, keeping a record of where each line came
+// from, and the level of those with a LevelTag. Lines without a LineTag are
+// recorded as being from the bootstrap. To write out a final line that isn't
+// finished, call Flush.
+type LineMetadataExtractor struct {
+	w   io.Writer
+	buf []byte
+
+	// Whether the last line written out wasn't finished, so the rest of it
+	// is from the same place
+	midLine bool
+
+	mu      sync.Mutex
+	line    int
+	records []LineMetadata
+}
+
+// NewLineMetadataExtractor returns a LineMetadataExtractor that writes what's
+// written to it to w, without the line tags
+func NewLineMetadataExtractor(w io.Writer) *LineMetadataExtractor {
+	return &LineMetadataExtractor{w: w, line: 1}
+}
+
+func (e *LineMetadataExtractor) Write(data []byte) (int, error) {
+	e.buf = append(e.buf, data...)
+	for {
+		i := bytes.IndexByte(e.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := e.writeLine(e.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[i+1:]
+	}
+
+	// Don't hold back more than a long line's worth of output
+	if len(e.buf) > maxLineMetadataBuffer {
+		if err := e.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// Flush writes out any line that hasn't been finished
+func (e *LineMetadataExtractor) Flush() error {
+	if len(e.buf) == 0 {
+		return nil
+	}
+	err := e.writeLine(e.buf)
+	e.buf = nil
+	return err
+}
+
+func (e *LineMetadataExtractor) writeLine(line []byte) error {
+	level := ""
+	if m := levelTagRE.FindSubmatch(line); m != nil {
+		level = string(m[1])
+	}
+
+	if m := lineTagRE.FindSubmatch(line); m != nil {
+		e.record(string(m[1]), string(m[2]), level)
+		line = lineTagRE.ReplaceAll(line, nil)
+	} else if !e.midLine {
+		e.record("", untaggedLineSource, level)
+	}
+
+	finished := len(line) > 0 && line[len(line)-1] == '\n'
+	e.midLine = !finished
+	if finished {
+		e.mu.Lock()
+		e.line++
+		e.mu.Unlock()
+	}
+
+	_, err := e.w.Write(line)
+	return err
+}
+
+func (e *LineMetadataExtractor) record(stream, source, level string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if n := len(e.records); n > 0 {
+		last := &e.records[n-1]
+		if last.Stream == stream && last.Source == source && last.Level == level {
+			return
+		}
+		// A line only has the one record, of the last place it was written from
+		if last.Line == e.line {
+			last.Stream, last.Source, last.Level = stream, source, level
+			return
+		}
+	}
+	e.records = append(e.records, LineMetadata{Line: e.line, Stream: stream, Source: source, Level: level})
+}
+
+// Records returns where the lines of output written so far came from
+func (e *LineMetadataExtractor) Records() []LineMetadata {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]LineMetadata{}, e.records...)
+}
@@ -0,0 +1,117 @@
+package process_test
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/process"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLineTag(t *testing.T) {
+	got := process.LineTag(process.StreamStderr, "plugin:my;plugin\x07:command")
+	want := "\x1b_bk;stream=stderr;source=plugin:my_plugin_:command\x07"
+	if got != want {
+		t.Errorf("LineTag() = %q, want %q", got, want)
+	}
+}
+
+func TestLineTaggerAndExtractor(t *testing.T) {
+	var log bytes.Buffer
+	extractor := process.NewLineMetadataExtractor(&log)
+
+	var mu sync.Mutex
+	hookOut := process.NewLineTagger(extractor, &mu, process.StreamStdout, "hook:agent:pre-command")
+	commandOut := process.NewLineTagger(extractor, &mu, process.StreamStdout, "command")
+	commandErr := process.NewLineTagger(extractor, &mu, process.StreamStderr, "command")
+
+	for _, write := range []struct {
+		w    *process.LineTagger
+		data string
+	}{
+		{hookOut, "Installing "},
+		{hookOut, "dependencies\nDone\n"},
+		{commandOut, "Running tests\n"},
+		{commandErr, "warning: deprecated\n"},
+		{commandErr, "warning: slow\n"},
+		{commandOut, "ok"},
+	} {
+		if _, err := write.w.Write([]byte(write.data)); err != nil {
+			t.Fatalf("LineTagger.Write(%q) error = %v", write.data, err)
+		}
+	}
+
+	// Output the bootstrap writes itself isn't tagged
+	_, _ = extractor.Write([]byte("~~~ Uploading artifacts\n"))
+
+	for _, w := range []*process.LineTagger{hookOut, commandOut, commandErr} {
+		if err := w.Flush(); err != nil {
+			t.Fatalf("LineTagger.Flush() error = %v", err)
+		}
+	}
+	if err := extractor.Flush(); err != nil {
+		t.Fatalf("LineMetadataExtractor.Flush() error = %v", err)
+	}
+
+	wantLog := "Installing dependencies\nDone\nRunning tests\nwarning: deprecated\nwarning: slow\n~~~ Uploading artifacts\nok"
+	if diff := cmp.Diff(log.String(), wantLog); diff != "" {
+		t.Errorf("log diff (-got +want):\n%s", diff)
+	}
+
+	wantRecords := []process.LineMetadata{
+		{Line: 1, Stream: "stdout", Source: "hook:agent:pre-command"},
+		{Line: 3, Stream: "stdout", Source: "command"},
+		{Line: 4, Stream: "stderr", Source: "command"},
+		{Line: 6, Source: "bootstrap"},
+		{Line: 7, Stream: "stdout", Source: "command"},
+	}
+	if diff := cmp.Diff(extractor.Records(), wantRecords); diff != "" {
+		t.Errorf("extractor.Records() diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestLineMetadataExtractorRecordsLevels(t *testing.T) {
+	var log bytes.Buffer
+	extractor := process.NewLineMetadataExtractor(&log)
+
+	var mu sync.Mutex
+	commandOut := process.NewLineTagger(extractor, &mu, process.StreamStdout, "command")
+
+	warning := process.LevelTag(process.LevelWarning)
+	comment := process.LevelTag(process.LevelComment)
+	for _, write := range []struct {
+		w    io.Writer
+		data string
+	}{
+		{extractor, comment + "# Preparing working directory\n"},
+		{extractor, comment + "# Fetching\n"},
+		{commandOut, "Cloning\n"},
+		{extractor, warning + "⚠️ Warning: Couldn't clean\n"},
+		{extractor, "^^^ +++\n"},
+	} {
+		if _, err := write.w.Write([]byte(write.data)); err != nil {
+			t.Fatalf("Write(%q) error = %v", write.data, err)
+		}
+	}
+	if err := extractor.Flush(); err != nil {
+		t.Fatalf("LineMetadataExtractor.Flush() error = %v", err)
+	}
+
+	// Levels are left in the log, for it to be styled by
+	wantLog := comment + "# Preparing working directory\n" + comment + "# Fetching\nCloning\n" + warning + "⚠️ Warning: Couldn't clean\n^^^ +++\n"
+	if diff := cmp.Diff(log.String(), wantLog); diff != "" {
+		t.Errorf("log diff (-got +want):\n%s", diff)
+	}
+
+	wantRecords := []process.LineMetadata{
+		{Line: 1, Source: "bootstrap", Level: "comment"},
+		{Line: 3, Stream: "stdout", Source: "command"},
+		{Line: 4, Source: "bootstrap", Level: "warning"},
+		{Line: 5, Source: "bootstrap"},
+	}
+	if diff := cmp.Diff(extractor.Records(), wantRecords); diff != "" {
+		t.Errorf("extractor.Records() diff (-got +want):\n%s", diff)
+	}
+}
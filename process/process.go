@@ -1,6 +1,10 @@
-// Package process provides a helper for running and managing a subprocess.
+// Package process runs and supervises a subprocess: starting it in its own
+// process group, optionally with a PTY, streaming its output, and
+// interrupting or terminating it and the processes it started.
 //
-// It is intended for internal use by buildkite-agent only.
+// It's how buildkite-agent runs jobs, and can be imported to supervise
+// processes the same way. Incompatible changes to it are only made in a new
+// major version of the module.
 package process
 
 import (
@@ -23,8 +27,11 @@ const (
 	termType = "xterm-256color"
 )
 
+// Signal is a Unix signal, by its number on Linux, that can be sent to a
+// process on any OS. On Windows, they're approximated.
 type Signal int
 
+// The signals that can be sent to processes
 const (
 	SIGHUP  Signal = 1
 	SIGINT  Signal = 2
@@ -43,6 +50,7 @@ var signalMap = map[string]Signal{
 	"SIGTERM": SIGTERM,
 }
 
+// WaitStatus is how a process exited, like syscall.WaitStatus
 type WaitStatus interface {
 	ExitStatus() int
 	Signaled() bool
@@ -58,6 +66,7 @@ func (s Signal) String() string {
 	return strconv.FormatInt(int64(s), 10)
 }
 
+// ParseSignal returns the signal with a name like SIGTERM or sigterm
 func ParseSignal(sig string) (Signal, error) {
 	s, ok := signalMap[strings.ToUpper(sig)]
 	if !ok {
@@ -78,6 +87,27 @@ type Config struct {
 	Stderr          io.Writer
 	Dir             string
 	InterruptSignal Signal
+
+	// How long the process is given to exit after it's interrupted, before
+	// its process group (or job object, on Windows) is killed along with
+	// anything it started. Zero leaves killing it to the caller.
+	SignalGracePeriod time.Duration
+
+	// Run the process with a restricted token, on Windows
+	RestrictedToken bool
+
+	// Run the process as another user, on Unix. We need to be root to.
+	Credential *Credential
+
+	// Run the process in the foreground of the terminal that Stdin is, so it
+	// can read from it and gets the terminal's signals, like Ctrl-C
+	Interactive bool
+}
+
+// Credential is the user and group to run a process as
+type Credential struct {
+	UID uint32
+	GID uint32
 }
 
 // Process is an operating system level process
@@ -90,8 +120,10 @@ type Process struct {
 	command       *exec.Cmd
 	mu            sync.Mutex
 	started, done chan struct{}
+	interrupted   bool
 
 	winJobHandle uintptr
+	winToken     uintptr
 }
 
 // New returns a new instance of Process
@@ -117,6 +149,15 @@ func (p *Process) WaitStatus() WaitStatus {
 	return p.status
 }
 
+// ProcessState returns the state of the process once it has finished, which
+// includes its resource usage, or nil if it hasn't
+func (p *Process) ProcessState() *os.ProcessState {
+	if p.command == nil {
+		return nil
+	}
+	return p.command.ProcessState
+}
+
 // Run the command and block until it finishes
 func (p *Process) Run(ctx context.Context) error {
 	if p.command != nil {
@@ -132,6 +173,19 @@ func (p *Process) Run(ctx context.Context) error {
 		p.setupProcessGroup()
 	}
 
+	if p.conf.RestrictedToken {
+		if err := p.restrictToken(); err != nil {
+			return err
+		}
+		defer p.closeRestrictedToken()
+	}
+
+	if p.conf.Credential != nil {
+		if err := p.setCredential(); err != nil {
+			return err
+		}
+	}
+
 	// Configure working dir and fail if it doesn't exist, otherwise
 	// we get confusing errors about fork/exec failing because the file
 	// doesn't exist
@@ -245,6 +299,13 @@ func (p *Process) Run(ctx context.Context) error {
 	// exits with a zero exit status.
 	p.waitResult = p.command.Wait()
 
+	// Take back the terminal from an interactive process
+	if p.conf.Interactive {
+		if err := p.restoreForeground(); err != nil {
+			p.logger.Error("[Process] Failed to restore the terminal's foreground process group: %v", err)
+		}
+	}
+
 	// Signal waiting consumers in Done() by closing the done channel
 	close(p.done)
 
@@ -322,11 +383,34 @@ func (p *Process) Interrupt() error {
 		if termErr := p.terminateProcessGroup(); termErr != nil {
 			return termErr
 		}
+		return nil
+	}
+
+	if p.conf.SignalGracePeriod > 0 && !p.interrupted {
+		p.interrupted = true
+		go p.terminateAfterGracePeriod()
 	}
 
 	return nil
 }
 
+// terminateAfterGracePeriod kills the process group once the process exits,
+// or once the grace period is up if it hasn't. Processes it started can
+// outlive it, and would otherwise be orphaned.
+func (p *Process) terminateAfterGracePeriod() {
+	select {
+	case <-p.Done():
+		p.logger.Debug("[Process] Process with PID: %d exited after being interrupted, killing what's left of its process group", p.pid)
+
+	case <-time.After(p.conf.SignalGracePeriod):
+		p.logger.Debug("[Process] Process with PID: %d hasn't exited %v after being interrupted, killing it", p.pid, p.conf.SignalGracePeriod)
+	}
+
+	if err := p.Terminate(); err != nil {
+		p.logger.Debug("[Process] Failed terminate: %v", err)
+	}
+}
+
 // Terminate the process
 func (p *Process) Terminate() error {
 	p.mu.Lock()
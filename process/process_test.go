@@ -7,8 +7,10 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/exec"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -73,6 +75,63 @@ func TestProcessOutputPTY(t *testing.T) {
 	assertProcessDoesntExist(t, p)
 }
 
+func TestProcessOutputWithRestrictedToken(t *testing.T) {
+	stdout := &bytes.Buffer{}
+
+	p := process.New(logger.Discard, process.Config{
+		Path:            os.Args[0],
+		Env:             []string{"TEST_MAIN=output"},
+		Stdout:          stdout,
+		Stderr:          io.Discard,
+		RestrictedToken: true,
+	})
+
+	err := p.Run(context.Background())
+	if runtime.GOOS != "windows" {
+		if err == nil {
+			t.Fatalf("p.Run(ctx) = nil, want an error as restricted tokens are only supported on Windows")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("p.Run(ctx) = %v", err)
+	}
+
+	if got, want := stdout.String(), "llamas1llamas2"; got != want {
+		t.Errorf("stdout.String() = %q, want %q", got, want)
+	}
+}
+
+func TestProcessRunsWithCredential(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Credentials are only supported on Unix")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("Running as another user needs root")
+	}
+
+	for _, pty := range []bool{false, true} {
+		stdout := &bytes.Buffer{}
+
+		p := process.New(logger.Discard, process.Config{
+			Path:       "id",
+			Args:       []string{"-u"},
+			PTY:        pty,
+			Stdout:     stdout,
+			Stderr:     io.Discard,
+			Credential: &process.Credential{UID: 65534, GID: 65534},
+		})
+
+		if err := p.Run(context.Background()); err != nil {
+			t.Fatalf("p.Run(ctx) = %v", err)
+		}
+
+		if got, want := strings.TrimSpace(stdout.String()), "65534"; got != want {
+			t.Errorf("with PTY %t, stdout.String() = %q, want %q", pty, got, want)
+		}
+	}
+}
+
 func TestProcessInput(t *testing.T) {
 	stdout := &bytes.Buffer{}
 
@@ -263,6 +322,78 @@ func TestProcessSetsProcessGroupID(t *testing.T) {
 	assertProcessDoesntExist(t, p)
 }
 
+func TestProcessKillsWhatsLeftAfterInterrupting(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Works in windows, but not in docker")
+	}
+
+	for _, tc := range []struct {
+		name              string
+		env               string
+		signalGracePeriod time.Duration
+	}{
+		{
+			// Its child has to be killed as soon as it exits, not after the
+			// grace period
+			name:              "when it exits",
+			env:               "TEST_EXIT_ON_SIGNAL=true",
+			signalGracePeriod: time.Minute,
+		},
+		{
+			name:              "when it doesn't exit in time",
+			signalGracePeriod: 100 * time.Millisecond,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			stdoutr, stdoutw := io.Pipe()
+
+			p := process.New(logger.Discard, process.Config{
+				Path:              os.Args[0],
+				Env:               []string{"TEST_MAIN=tester-orphan", tc.env},
+				Stdout:            stdoutw,
+				SignalGracePeriod: tc.signalGracePeriod,
+			})
+
+			go func() {
+				defer stdoutw.Close()
+				_ = p.Run(context.Background())
+			}()
+
+			waitUntilReady(t, stdoutr)
+
+			var childPid int
+			if _, err := fmt.Fscanln(stdoutr, &childPid); err != nil {
+				t.Fatalf("fmt.Fscanln(stdoutr, &childPid) error = %v", err)
+			}
+
+			if err := p.Interrupt(); err != nil {
+				t.Fatalf("p.Interrupt() = %v", err)
+			}
+			go func() { _, _ = io.Copy(io.Discard, stdoutr) }()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for isRunning(childPid) {
+				if time.Now().After(deadline) {
+					t.Fatalf("Child process %d is still running after its parent was interrupted", childPid)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		})
+	}
+}
+
+// isRunning returns whether the process exists and hasn't exited, as once it's
+// orphaned it's left to init to reap
+func isRunning(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil || proc.Signal(syscall.Signal(0)) != nil {
+		return false
+	}
+	stat, err := exec.Command("ps", "-o", "stat=", "-p", strconv.Itoa(pid)).Output()
+	return err == nil && !strings.HasPrefix(strings.TrimSpace(string(stat)), "Z")
+}
+
 func assertProcessDoesntExist(t *testing.T, p *process.Process) {
 	t.Helper()
 
@@ -328,6 +459,34 @@ func TestMain(m *testing.M) {
 		fmt.Printf("SIG %v", <-signals)
 		os.Exit(0)
 
+	case "tester-orphan":
+		if os.Getenv("TEST_EXIT_ON_SIGNAL") == "" {
+			signal.Ignore(syscall.SIGTERM, syscall.SIGINT)
+		}
+		child := exec.Command(os.Args[0])
+		child.Env = []string{"TEST_MAIN=tester-ignore-signals"}
+		childStdout, err := child.StdoutPipe()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := child.Start(); err != nil {
+			log.Fatal(err)
+		}
+		// Wait for the child to be ignoring signals
+		if _, err := io.ReadFull(childStdout, make([]byte, len("Ready\n"))); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Ready")
+		fmt.Println(child.Process.Pid)
+		_ = child.Wait()
+		os.Exit(0)
+
+	case "tester-ignore-signals":
+		signal.Ignore(syscall.SIGTERM, syscall.SIGINT)
+		fmt.Println("Ready")
+		time.Sleep(time.Minute)
+		os.Exit(0)
+
 	case "tester-pgid":
 		pid := syscall.Getpid()
 		pgid, err := process.GetPgid(pid)
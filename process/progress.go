@@ -0,0 +1,141 @@
+package process
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// The longest line ProgressCollapser holds back, beyond which it's written
+// out as is
+const maxCollapsedLineLength = 64 * 1024
+
+// ProgressCollapser collapses lines that are rewritten with carriage returns,
+// like progress bars, so the output doesn't grow with every update. Each line
+// is written once it's finished, along with a snapshot of it at most once an
+// interval while it's being rewritten. To ensure a line still in progress is
+// written out, be sure to call Flush when done.
+type ProgressCollapser struct {
+	w        io.Writer
+	interval time.Duration
+	now      func() time.Time
+
+	mu sync.Mutex
+
+	// The line being written, since the last carriage return
+	line []byte
+
+	// The line before it was last rewritten, if it has been
+	rewritten []byte
+
+	// Whether the last byte was a carriage return, which could be the start
+	// of a CRLF rather than a rewrite
+	cr bool
+
+	// The last snapshot of the line, and when it was written
+	snapshot   []byte
+	snapshotAt time.Time
+}
+
+// NewProgressCollapser sets up a ProgressCollapser outputting to an
+// io.Writer w, writing snapshots of lines being rewritten every interval.
+func NewProgressCollapser(w io.Writer, interval time.Duration) *ProgressCollapser {
+	return &ProgressCollapser{
+		w:        w,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+// Write writes the given data to the ProgressCollapser's output, apart from
+// the updates to lines being rewritten. Lines are held back until they're
+// finished, and written in a subsequent call to Write.
+func (p *ProgressCollapser) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, b := range data {
+		if p.cr {
+			p.cr = false
+			if b == '\n' {
+				if err := p.finishLine("\r\n"); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			if err := p.rewrite(); err != nil {
+				return 0, err
+			}
+		}
+
+		switch b {
+		case '\r':
+			p.cr = true
+		case '\n':
+			if err := p.finishLine("\n"); err != nil {
+				return 0, err
+			}
+		default:
+			p.line = append(p.line, b)
+			if len(p.line) > maxCollapsedLineLength {
+				if _, err := p.w.Write(p.line); err != nil {
+					return 0, err
+				}
+				p.line, p.rewritten, p.snapshot = p.line[:0], nil, nil
+			}
+		}
+	}
+
+	return len(data), nil
+}
+
+// rewrite starts the line again after a carriage return, writing a snapshot
+// of it if it's been long enough since the last
+func (p *ProgressCollapser) rewrite() error {
+	if len(p.line) > 0 {
+		p.rewritten = append(p.rewritten[:0], p.line...)
+	}
+	p.line = p.line[:0]
+
+	if p.rewritten == nil || p.now().Sub(p.snapshotAt) < p.interval {
+		return nil
+	}
+	p.snapshot = append(p.snapshot[:0], p.rewritten...)
+	p.snapshotAt = p.now()
+	_, err := p.w.Write(append(append([]byte{}, p.snapshot...), '\n'))
+	return err
+}
+
+// finishLine writes the line as it was last rewritten, unless it's just been
+// written as a snapshot
+func (p *ProgressCollapser) finishLine(newline string) error {
+	line := p.line
+	if len(line) == 0 && p.rewritten != nil {
+		line = p.rewritten
+	}
+
+	var err error
+	if p.snapshot == nil || !bytes.Equal(line, p.snapshot) {
+		_, err = p.w.Write(append(append([]byte{}, line...), newline...))
+	}
+	p.line, p.rewritten, p.snapshot = p.line[:0], nil, nil
+	return err
+}
+
+// Flush writes out the line in progress, if there is one.
+func (p *ProgressCollapser) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	line := p.line
+	if len(line) == 0 {
+		line = p.rewritten
+	}
+	p.line, p.rewritten, p.snapshot, p.cr = p.line[:0], nil, nil, false
+	if len(line) == 0 {
+		return nil
+	}
+	_, err := p.w.Write(line)
+	return err
+}
@@ -0,0 +1,92 @@
+package process_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/process"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestProgressCollapser(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		writes   []string
+		want     string
+	}{
+		{
+			name:     "plain lines",
+			interval: time.Hour,
+			writes:   []string{"alpacas\nllamas\n", "\n"},
+			want:     "alpacas\nllamas\n\n",
+		},
+		{
+			name:     "progress bar",
+			interval: time.Hour,
+			writes:   []string{"Downloading 0%\rDownloading 50%\rDownloading 100%\ndone\n"},
+			want:     "Downloading 0%\nDownloading 100%\ndone\n",
+		},
+		{
+			name:     "snapshots",
+			interval: 0,
+			writes:   []string{"1/3\r2/3\r3/3\n"},
+			want:     "1/3\n2/3\n3/3\n",
+		},
+		{
+			name:     "finished as last snapshot",
+			interval: time.Hour,
+			writes:   []string{"50%\r50%\n"},
+			want:     "50%\n",
+		},
+		{
+			name:     "CRLF",
+			interval: time.Hour,
+			writes:   []string{"alpacas\r", "\nllamas\r\n"},
+			want:     "alpacas\r\nllamas\r\n",
+		},
+		{
+			name:     "rewritten across writes",
+			interval: time.Hour,
+			writes:   []string{"Pulling 1", "0%\rPulling 2", "0%\r", "Pulling 30%", "\r\n"},
+			want:     "Pulling 10%\nPulling 30%\r\n",
+		},
+		{
+			name:     "unfinished line",
+			interval: time.Hour,
+			writes:   []string{"Password: "},
+			want:     "Password: ",
+		},
+		{
+			name:     "unfinished progress",
+			interval: time.Hour,
+			writes:   []string{"1%\r2%\r"},
+			want:     "1%\n2%",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var out bytes.Buffer
+			p := process.NewProgressCollapser(&out, tc.interval)
+			for _, w := range tc.writes {
+				if _, err := p.Write([]byte(w)); err != nil {
+					t.Fatalf("p.Write(%q) error = %v", w, err)
+				}
+			}
+			if err := p.Flush(); err != nil {
+				t.Fatalf("p.Flush() error = %v", err)
+			}
+
+			if diff := cmp.Diff(tc.want, out.String()); diff != "" {
+				t.Errorf("output diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
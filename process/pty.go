@@ -10,6 +10,8 @@ import (
 	"github.com/creack/pty"
 )
 
+// StartPTY starts a command with a new PTY as its stdin, stdout and stderr,
+// and returns the PTY's controlling end
 func StartPTY(c *exec.Cmd) (*os.File, error) {
 	return pty.Start(c)
 }
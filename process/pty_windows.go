@@ -6,6 +6,7 @@ import (
 	"os/exec"
 )
 
+// StartPTY returns an error, as Windows doesn't have PTYs
 func StartPTY(c *exec.Cmd) (*os.File, error) {
 	return nil, errors.New("PTY is not supported on Windows")
 }
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package process
+
+import "errors"
+
+func (p *Process) restrictToken() error {
+	return errors.New("Restricted tokens are only supported on Windows")
+}
+
+func (p *Process) closeRestrictedToken() {}
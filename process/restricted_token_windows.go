@@ -0,0 +1,76 @@
+//go:build windows
+// +build windows
+
+package process
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// x/sys/windows doesn't have CreateRestrictedToken
+var procCreateRestrictedToken = windows.NewLazySystemDLL("advapi32.dll").NewProc("CreateRestrictedToken")
+
+// Removes every privilege but SeChangeNotifyPrivilege
+const disableMaxPrivilege = 0x1
+
+// restrictToken has the process run with a token of its own, made from the
+// agent's with the Administrators group only usable to deny access, every
+// privilege removed, and medium integrity, so it can't read or write what's
+// labeled at a higher integrity, like the agent's configuration
+func (p *Process) restrictToken() error {
+	var token windows.Token
+	access := uint32(windows.TOKEN_DUPLICATE | windows.TOKEN_QUERY | windows.TOKEN_ASSIGN_PRIMARY | windows.TOKEN_ADJUST_DEFAULT)
+	if err := windows.OpenProcessToken(windows.CurrentProcess(), access, &token); err != nil {
+		return fmt.Errorf("Failed to open the agent's token: %w", err)
+	}
+	defer token.Close()
+
+	admins, err := windows.CreateWellKnownSid(windows.WinBuiltinAdministratorsSid)
+	if err != nil {
+		return err
+	}
+	denyOnly := []windows.SIDAndAttributes{{Sid: admins}}
+
+	var restricted windows.Token
+	r, _, err := procCreateRestrictedToken.Call(
+		uintptr(token),
+		disableMaxPrivilege,
+		uintptr(len(denyOnly)), uintptr(unsafe.Pointer(&denyOnly[0])),
+		0, 0, // privileges to delete, beyond disableMaxPrivilege
+		0, 0, // restricting SIDs
+		uintptr(unsafe.Pointer(&restricted)))
+	if r == 0 {
+		return fmt.Errorf("Failed to create a restricted token: %w", err)
+	}
+
+	medium, err := windows.CreateWellKnownSid(windows.WinMediumLabelSid)
+	if err != nil {
+		restricted.Close()
+		return err
+	}
+	label := windows.Tokenmandatorylabel{Label: windows.SIDAndAttributes{Sid: medium, Attributes: windows.SE_GROUP_INTEGRITY}}
+	if err := windows.SetTokenInformation(restricted, windows.TokenIntegrityLevel, (*byte)(unsafe.Pointer(&label)), label.Size()); err != nil {
+		restricted.Close()
+		return fmt.Errorf("Failed to lower the restricted token's integrity: %w", err)
+	}
+
+	if p.command.SysProcAttr == nil {
+		p.command.SysProcAttr = &windows.SysProcAttr{}
+	}
+	p.command.SysProcAttr.Token = syscall.Token(restricted)
+	p.winToken = uintptr(restricted)
+	return nil
+}
+
+// closeRestrictedToken closes the process's restricted token, which is only
+// needed until it's started
+func (p *Process) closeRestrictedToken() {
+	if p.winToken != 0 {
+		_ = windows.Token(p.winToken).Close()
+		p.winToken = 0
+	}
+}
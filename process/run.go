@@ -8,6 +8,7 @@ import (
 	"github.com/buildkite/agent/v3/logger"
 )
 
+// Run runs a command and returns its output, without trailing newlines
 func Run(l logger.Logger, command string, arg ...string) (string, error) {
 	output, err := exec.Command(command, arg...).Output()
 
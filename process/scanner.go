@@ -9,16 +9,20 @@ import (
 	"github.com/buildkite/agent/v3/logger"
 )
 
+// Scanner reads lines from a reader, however long they are
 type Scanner struct {
 	logger logger.Logger
 }
 
+// NewScanner returns a Scanner that logs what it's doing to l at debug level
 func NewScanner(l logger.Logger) *Scanner {
 	return &Scanner{
 		logger: l,
 	}
 }
 
+// ScanLines calls f with each line read from r, without its line ending,
+// until r returns io.EOF
 func (s *Scanner) ScanLines(r io.Reader, f func(line string)) error {
 	var reader = bufio.NewReader(r)
 	var appending []byte
@@ -79,6 +83,7 @@ func (s *Scanner) ScanLines(r io.Reader, f func(line string)) error {
 	return nil
 }
 
+// Buffer is a bytes.Buffer that's safe to write to and read from at once
 type Buffer struct {
 	mu  sync.RWMutex
 	buf bytes.Buffer
@@ -5,6 +5,8 @@ package process
 
 import (
 	"fmt"
+	"os"
+	"os/signal"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -17,7 +19,27 @@ func (p *Process) setupProcessGroup() {
 			Setpgid: true,
 			Pgid:    0,
 		}
+
+		// The new process group has to be in the foreground of the terminal
+		// to read from it
+		if tty, ok := p.conf.Stdin.(*os.File); ok && p.conf.Interactive {
+			p.command.SysProcAttr.Foreground = true
+			p.command.SysProcAttr.Ctty = int(tty.Fd())
+		}
+	}
+}
+
+// restoreForeground puts our process group back in the foreground of the
+// terminal after an interactive process has finished. We're in the
+// background until then, so would be stopped by SIGTTOU for changing it.
+func (p *Process) restoreForeground() error {
+	tty, ok := p.conf.Stdin.(*os.File)
+	if !ok {
+		return nil
 	}
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+	return unix.IoctlSetPointerInt(int(tty.Fd()), unix.TIOCSPGRP, syscall.Getpgrp())
 }
 
 func (p *Process) postStart() error {
@@ -42,6 +64,7 @@ func (p *Process) interruptProcessGroup() error {
 	return syscall.Kill(-p.pid, syscall.Signal(intSignal))
 }
 
+// GetPgid returns the process group ID of a process
 func GetPgid(pid int) (int, error) {
 	return syscall.Getpgid(pid)
 }
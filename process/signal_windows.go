@@ -30,6 +30,11 @@ func (p *Process) setupProcessGroup() {
 	p.winJobHandle = jobHandle
 }
 
+// restoreForeground is a no-op on Windows, where processes share the console
+func (p *Process) restoreForeground() error {
+	return nil
+}
+
 func newJobObject() (uintptr, error) {
 	handle, err := windows.CreateJobObject(nil, nil)
 	if err != nil {
@@ -71,8 +76,14 @@ func (p *Process) postStart() error {
 }
 
 func (p *Process) terminateProcessGroup() error {
+	if p.winJobHandle == 0 {
+		return nil
+	}
+
 	p.logger.Debug("[Process] Terminating process tree by destroying job")
-	return windows.CloseHandle(windows.Handle(p.winJobHandle))
+	handle := p.winJobHandle
+	p.winJobHandle = 0
+	return windows.CloseHandle(windows.Handle(handle))
 }
 
 func (p *Process) interruptProcessGroup() error {
@@ -85,6 +96,7 @@ func (p *Process) interruptProcessGroup() error {
 	return nil
 }
 
+// GetPgid returns an error, as Windows doesn't have process groups
 func GetPgid(pid int) (int, error) {
 	return 0, errors.New("Not implemented on Windows")
 }
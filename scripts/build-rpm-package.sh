@@ -32,6 +32,10 @@ elif [ "$BUILD_ARCH" == "ppc64" ]; then
   ARCH="ppc64"
 elif [ "$BUILD_ARCH" == "ppc64le" ]; then
   ARCH="ppc64le"
+elif [ "$BUILD_ARCH" == "s390x" ]; then
+  ARCH="s390x"
+elif [ "$BUILD_ARCH" == "riscv64" ]; then
+  ARCH="riscv64"
 else
   echo "Unknown architecture: $BUILD_ARCH"
   exit 1
@@ -56,6 +56,6 @@ chmod 644 "${OUTPUT_FILE}"
 
 # gzipped version for embedding purposes
 gzip -kf "${OUTPUT_FILE}"
-mv "${OUTPUT_FILE}.gz" clicommand/
+mv "${OUTPUT_FILE}.gz" internal/clicommand/
 
 exit 0
@@ -0,0 +1,152 @@
+package shell
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var errLockBusy = errors.New("Locked by other process")
+
+// Where Linux keeps an ID that changes each time it boots. Process IDs from
+// an earlier boot don't mean anything.
+const bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// lockOwner is the process that holds a pidLock
+type lockOwner struct {
+	PID  int
+	Host string
+
+	// The ID of the boot the process was started in, if the OS has them
+	Boot string
+}
+
+// String returns the lock file's contents for the owner. The PID is on the
+// first line, so agents that only read the PID still understand it.
+func (o lockOwner) String() string {
+	return fmt.Sprintf("%d\n%s\n%s\n", o.PID, o.Host, o.Boot)
+}
+
+func parseLockOwner(data []byte) (lockOwner, error) {
+	lines := strings.Split(string(data), "\n")
+	pid, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil || pid <= 0 {
+		return lockOwner{}, fmt.Errorf("invalid process ID %q", lines[0])
+	}
+
+	o := lockOwner{PID: pid}
+	if len(lines) > 1 {
+		o.Host = strings.TrimSpace(lines[1])
+	}
+	if len(lines) > 2 {
+		o.Boot = strings.TrimSpace(lines[2])
+	}
+	return o, nil
+}
+
+func currentLockOwner() lockOwner {
+	host, _ := os.Hostname()
+	boot, _ := os.ReadFile(bootIDPath)
+	return lockOwner{PID: os.Getpid(), Host: host, Boot: strings.TrimSpace(string(boot))}
+}
+
+// pidLock is a lock file holding the process ID, host and boot of the
+// process that locked it. Lock files left by processes that are no longer
+// running, like a bootstrap that crashed, are taken to be stale and broken.
+type pidLock struct {
+	path  string
+	owner lockOwner
+}
+
+func newPIDLock(path string) *pidLock {
+	return &pidLock{path: path, owner: currentLockOwner()}
+}
+
+// tryLock tries to take the lock once. If it broke a stale lock to do so,
+// it returns who held it.
+func (l *pidLock) tryLock() (stale *lockOwner, err error) {
+	for {
+		ok, err := l.link()
+		if err != nil || ok {
+			return stale, err
+		}
+
+		data, err := os.ReadFile(l.path)
+		if os.IsNotExist(err) {
+			// It was unlocked in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		owner, err := parseLockOwner(data)
+		if err == nil && !l.isStale(owner) {
+			return nil, errLockBusy
+		}
+
+		// Only break the lock if it's still the stale one, and not one
+		// that another process took after breaking it first
+		if current, err := os.ReadFile(l.path); err != nil || !bytes.Equal(current, data) {
+			continue
+		}
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		stale = &owner
+	}
+}
+
+// link links a file with the lock's contents to the lock's path, which fails
+// if something's already there, returning whether it was linked
+func (l *pidLock) link() (bool, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(l.owner.String())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.Link(tmp.Name(), l.path); err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// isStale returns whether a lock's owner has stopped running. Processes on
+// other hosts can't be checked, so their locks are never stale.
+func (l *pidLock) isStale(owner lockOwner) bool {
+	if owner.Host != "" && owner.Host != l.owner.Host {
+		return false
+	}
+	if owner.Boot != "" && l.owner.Boot != "" && owner.Boot != l.owner.Boot {
+		return true
+	}
+	if owner.PID == l.owner.PID {
+		return true
+	}
+	return !processRunning(owner.PID)
+}
+
+// Unlock removes the lock file, if it's still this process's
+func (l *pidLock) Unlock() error {
+	data, err := os.ReadFile(l.path)
+	if err != nil || string(data) != l.owner.String() {
+		return fmt.Errorf("lock %q is no longer held by this process", l.path)
+	}
+	return os.Remove(l.path)
+}
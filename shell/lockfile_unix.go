@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package shell
+
+import (
+	"errors"
+	"syscall"
+)
+
+// processRunning returns whether a process is running. Processes owned by
+// other users can't be signalled, but are running.
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
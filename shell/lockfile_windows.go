@@ -0,0 +1,26 @@
+package shell
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// The exit code of a process that's still running
+const processStillActive = 259
+
+// processRunning returns whether a process is running. Processes that can't
+// be opened because of their permissions are running.
+func processRunning(pid int) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return errors.Is(err, windows.ERROR_ACCESS_DENIED)
+	}
+	defer windows.CloseHandle(h)
+
+	var code uint32
+	if err := windows.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == processStillActive
+}
@@ -0,0 +1,347 @@
+package shell
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/process"
+)
+
+// Logger represents a logger that outputs to a buildkite shell.
+type Logger interface {
+	io.Writer
+
+	// Printf prints a line of output
+	Printf(format string, v ...any)
+
+	// Headerf prints a Buildkite formatted header
+	Headerf(format string, v ...any)
+
+	// Commentf prints a comment line, e.g `# my comment goes here`
+	Commentf(format string, v ...any)
+
+	// Errorf shows a Buildkite formatted error expands the previous group
+	Errorf(format string, v ...any)
+
+	// Warningf shows a buildkite bootstrap warning
+	Warningf(format string, v ...any)
+
+	// Promptf prints a shell prompt
+	Promptf(format string, v ...any)
+}
+
+// CommandLogger is a Logger that records the commands a Shell runs, with
+// their exit status and how long they took
+type CommandLogger interface {
+	Logger
+
+	// CommandFinished records a command finishing
+	CommandFinished(command string, exitStatus int, duration time.Duration)
+}
+
+// StderrLogger is a Logger that writes to Stderr
+var StderrLogger = &WriterLogger{
+	Writer: os.Stderr,
+	Ansi:   true,
+}
+
+// DiscardLogger discards all log messages
+var DiscardLogger = &WriterLogger{
+	Writer: io.Discard,
+}
+
+// WriterLogger provides a logger that writes to an io.Writer
+type WriterLogger struct {
+	Writer io.Writer
+	Ansi   bool
+
+	// Whether to start each line of comments, warnings and errors with a
+	// process.LevelTag, so they can be told apart from commands' output
+	TagLevels bool
+}
+
+func (wl *WriterLogger) Write(b []byte) (int, error) {
+	wl.Printf("%s", b)
+	return len(b), nil
+}
+
+func (wl *WriterLogger) Printf(format string, v ...any) {
+	fmt.Fprintf(wl.Writer, "%s", fmt.Sprintf(format, v...))
+	fmt.Fprintln(wl.Writer)
+}
+
+func (wl *WriterLogger) Headerf(format string, v ...any) {
+	fmt.Fprintf(wl.Writer, "~~~ %s", fmt.Sprintf(format, v...))
+	fmt.Fprintln(wl.Writer)
+}
+
+func (wl *WriterLogger) Commentf(format string, v ...any) {
+	if wl.Ansi {
+		wl.printLevelf(process.LevelComment, ansiColor("# %s", "90"), fmt.Sprintf(format, v...))
+	} else {
+		wl.printLevelf(process.LevelComment, "# %s", fmt.Sprintf(format, v...))
+	}
+}
+
+func (wl *WriterLogger) Errorf(format string, v ...any) {
+	if wl.Ansi {
+		wl.printLevelf(process.LevelError, ansiColor("🚨 Error: %s", "31"), fmt.Sprintf(format, v...))
+	} else {
+		wl.printLevelf(process.LevelError, "🚨 Error: %s", fmt.Sprintf(format, v...))
+	}
+	wl.Printf("^^^ +++")
+}
+
+func (wl *WriterLogger) Warningf(format string, v ...any) {
+	if wl.Ansi {
+		wl.printLevelf(process.LevelWarning, ansiColor("⚠️ Warning: %s", "33"), fmt.Sprintf(format, v...))
+	} else {
+		wl.printLevelf(process.LevelWarning, "⚠️ Warning: %s", fmt.Sprintf(format, v...))
+	}
+	wl.Printf("^^^ +++")
+}
+
+// printLevelf prints a line at a level, tagging each of its lines with it if
+// the logger's tagging levels
+func (wl *WriterLogger) printLevelf(level, format string, v ...any) {
+	if !wl.TagLevels {
+		wl.Printf(format, v...)
+		return
+	}
+	tag := process.LevelTag(level)
+	wl.Printf("%s", tag+strings.ReplaceAll(fmt.Sprintf(format, v...), "\n", "\n"+tag))
+}
+
+func (wl *WriterLogger) Promptf(format string, v ...any) {
+	prompt := "$"
+	if runtime.GOOS == "windows" {
+		prompt = ">"
+	}
+	if wl.Ansi {
+		wl.Printf(ansiColor(prompt, "90")+" %s", fmt.Sprintf(format, v...))
+	} else {
+		wl.Printf(prompt+" %s", fmt.Sprintf(format, v...))
+	}
+}
+
+// JSONLogger is a Logger that writes each line as a JSONLogRecord, so job
+// logs can be ingested by log aggregators without parsing the text format
+type JSONLogger struct {
+	Writer io.Writer
+
+	mu     sync.Mutex
+	phases []jsonLoggerPhase
+}
+
+type jsonLoggerPhase struct {
+	name    string
+	started time.Time
+}
+
+// JSONLogRecord is a line written by a JSONLogger. Its type is what wrote
+// it: output, header, comment, error, warning or prompt for the Logger's
+// methods, command when a command finishes, and phase at the start and end
+// of each of the bootstrap's phases.
+type JSONLogRecord struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Phase   string    `json:"phase,omitempty"`
+	Event   string    `json:"event,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Command string    `json:"command,omitempty"`
+
+	// Only on command records and the end of phases, with the duration in
+	// seconds
+	ExitStatus *int     `json:"exit_status,omitempty"`
+	Duration   *float64 `json:"duration,omitempty"`
+}
+
+func (jl *JSONLogger) Write(b []byte) (int, error) {
+	jl.Printf("%s", strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
+
+func (jl *JSONLogger) Printf(format string, v ...any) {
+	// Lines from a PTY end in \r\n, rather than just \n
+	jl.write(JSONLogRecord{Type: "output", Message: strings.TrimSuffix(fmt.Sprintf(format, v...), "\r")})
+}
+
+func (jl *JSONLogger) Headerf(format string, v ...any) {
+	jl.write(JSONLogRecord{Type: "header", Message: fmt.Sprintf(format, v...)})
+}
+
+func (jl *JSONLogger) Commentf(format string, v ...any) {
+	jl.write(JSONLogRecord{Type: "comment", Message: fmt.Sprintf(format, v...)})
+}
+
+func (jl *JSONLogger) Errorf(format string, v ...any) {
+	jl.write(JSONLogRecord{Type: "error", Message: fmt.Sprintf(format, v...)})
+}
+
+func (jl *JSONLogger) Warningf(format string, v ...any) {
+	jl.write(JSONLogRecord{Type: "warning", Message: fmt.Sprintf(format, v...)})
+}
+
+func (jl *JSONLogger) Promptf(format string, v ...any) {
+	jl.write(JSONLogRecord{Type: "prompt", Command: fmt.Sprintf(format, v...)})
+}
+
+func (jl *JSONLogger) CommandFinished(command string, exitStatus int, duration time.Duration) {
+	seconds := duration.Seconds()
+	jl.write(JSONLogRecord{Type: "command", Command: command, ExitStatus: &exitStatus, Duration: &seconds})
+}
+
+// StartPhase records the start of a phase, which the records written until
+// it ends are part of. Phases can be started within other phases.
+func (jl *JSONLogger) StartPhase(phase string) {
+	jl.mu.Lock()
+	jl.phases = append(jl.phases, jsonLoggerPhase{name: phase, started: time.Now()})
+	jl.mu.Unlock()
+
+	jl.write(JSONLogRecord{Type: "phase", Event: "start"})
+}
+
+// EndPhase records the end of a phase, with its exit status
+func (jl *JSONLogger) EndPhase(phase string, exitStatus int) {
+	record := JSONLogRecord{Type: "phase", Event: "end", Phase: phase, ExitStatus: &exitStatus}
+
+	jl.mu.Lock()
+	for i := len(jl.phases) - 1; i >= 0; i-- {
+		if jl.phases[i].name == phase {
+			seconds := time.Since(jl.phases[i].started).Seconds()
+			record.Duration = &seconds
+			jl.phases = jl.phases[:i]
+			break
+		}
+	}
+	jl.mu.Unlock()
+
+	jl.write(record)
+}
+
+func (jl *JSONLogger) write(record JSONLogRecord) {
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+
+	record.Time = time.Now()
+	if record.Phase == "" && len(jl.phases) > 0 {
+		record.Phase = jl.phases[len(jl.phases)-1].name
+	}
+
+	// Encoding a record with only strings and numbers in it can't fail, and
+	// output like <branch> is more readable left unescaped
+	enc := json.NewEncoder(jl.Writer)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(record)
+}
+
+func ansiColor(s, attributes string) string {
+	return fmt.Sprintf("\033[%sm%s\033[0m", attributes, s)
+}
+
+// TestingLogger is a Logger that logs to a test, with t.Logf
+type TestingLogger struct {
+	*testing.T
+}
+
+func (tl TestingLogger) Write(b []byte) (int, error) {
+	tl.Logf("%s", b)
+	return len(b), nil
+}
+
+func (tl TestingLogger) Printf(format string, v ...any) {
+	tl.Logf(format, v...)
+}
+
+func (tl TestingLogger) Headerf(format string, v ...any) {
+	tl.Logf("~~~ "+format, v...)
+}
+
+func (tl TestingLogger) Commentf(format string, v ...any) {
+	tl.Logf("# %s", fmt.Sprintf(format, v...))
+}
+
+func (tl TestingLogger) Errorf(format string, v ...any) {
+	tl.Logf("🚨 Error: %s", fmt.Sprintf(format, v...))
+}
+
+func (tl TestingLogger) Warningf(format string, v ...any) {
+	tl.Logf("⚠️ Warning: %s", fmt.Sprintf(format, v...))
+}
+
+func (tl TestingLogger) Promptf(format string, v ...any) {
+	prompt := "$"
+	if runtime.GOOS == "windows" {
+		prompt = ">"
+	}
+	tl.Logf(prompt+" %s", fmt.Sprintf(format, v...))
+}
+
+// LoggerStreamer is an io.Writer that prints what's written to it to a
+// Logger a line at a time, with a prefix. Nothing's printed until the first
+// whole line has been written.
+type LoggerStreamer struct {
+	Logger  Logger
+	Prefix  string
+	started bool
+	buf     *bytes.Buffer
+	offset  int
+}
+
+var lineRegexp = regexp.MustCompile(`(?m:^(.*)\r?\n)`)
+
+// NewLoggerStreamer returns a LoggerStreamer that prints to logger
+func NewLoggerStreamer(logger Logger) *LoggerStreamer {
+	return &LoggerStreamer{
+		Logger: logger,
+		buf:    bytes.NewBuffer([]byte("")),
+	}
+}
+
+func (l *LoggerStreamer) Write(p []byte) (n int, err error) {
+	if bytes.ContainsRune(p, '\n') {
+		l.started = true
+	}
+
+	if n, err = l.buf.Write(p); err != nil {
+		return
+	}
+
+	err = l.Output()
+	return
+}
+
+// Close prints what's left of the last line, if it didn't end with a newline
+func (l *LoggerStreamer) Close() error {
+	if remaining := l.buf.String()[l.offset:]; len(remaining) > 0 {
+		l.Logger.Printf("%s%s", l.Prefix, remaining)
+	}
+	l.buf = bytes.NewBuffer([]byte(""))
+	return nil
+}
+
+// Output prints the whole lines that have been written since it was last
+// called, once the first has been
+func (l *LoggerStreamer) Output() error {
+	if !l.started {
+		return nil
+	}
+
+	matches := lineRegexp.FindAllStringSubmatch(l.buf.String()[l.offset:], -1)
+
+	for _, match := range matches {
+		l.Logger.Printf("%s%s", l.Prefix, match[1])
+		l.offset += len(match[0])
+	}
+
+	return nil
+}
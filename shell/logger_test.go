@@ -0,0 +1,149 @@
+package shell_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/process"
+	"github.com/buildkite/agent/v3/shell"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAnsiLogger(t *testing.T) {
+	got := &bytes.Buffer{}
+	l := shell.WriterLogger{Writer: got, Ansi: false}
+
+	l.Headerf("Testing header: %q", "llamas")
+	l.Printf("Testing print: %q", "llamas")
+	l.Commentf("Testing comment: %q", "llamas")
+	l.Errorf("Testing error: %q", "llamas")
+	l.Warningf("Testing warning: %q", "llamas")
+	l.Promptf("Testing prompt: %q", "llamas")
+
+	want := &bytes.Buffer{}
+
+	fmt.Fprintln(want, `~~~ Testing header: "llamas"`)
+	fmt.Fprintln(want, `Testing print: "llamas"`)
+	fmt.Fprintln(want, `# Testing comment: "llamas"`)
+	fmt.Fprintln(want, `🚨 Error: Testing error: "llamas"`)
+	fmt.Fprintln(want, "^^^ +++")
+	fmt.Fprintln(want, `⚠️ Warning: Testing warning: "llamas"`)
+	fmt.Fprintln(want, "^^^ +++")
+
+	if runtime.GOOS == "windows" {
+		fmt.Fprintln(want, `> Testing prompt: "llamas"`)
+	} else {
+		fmt.Fprintln(want, `$ Testing prompt: "llamas"`)
+	}
+
+	if diff := cmp.Diff(got.String(), want.String()); diff != "" {
+		t.Fatalf("shell.WriterLogger output buffer diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestWriterLoggerTagsLevels(t *testing.T) {
+	got := &bytes.Buffer{}
+	l := shell.WriterLogger{Writer: got, Ansi: false, TagLevels: true}
+
+	l.Headerf("Testing header")
+	l.Printf("Testing print")
+	l.Commentf("Testing comment\nover two lines")
+	l.Errorf("Testing error")
+	l.Warningf("Testing warning")
+
+	comment := process.LevelTag(process.LevelComment)
+	want := &bytes.Buffer{}
+	fmt.Fprintln(want, "~~~ Testing header")
+	fmt.Fprintln(want, "Testing print")
+	fmt.Fprintln(want, comment+"# Testing comment")
+	fmt.Fprintln(want, comment+"over two lines")
+	fmt.Fprintln(want, process.LevelTag(process.LevelError)+"🚨 Error: Testing error")
+	fmt.Fprintln(want, "^^^ +++")
+	fmt.Fprintln(want, process.LevelTag(process.LevelWarning)+"⚠️ Warning: Testing warning")
+	fmt.Fprintln(want, "^^^ +++")
+
+	if diff := cmp.Diff(got.String(), want.String()); diff != "" {
+		t.Fatalf("shell.WriterLogger output buffer diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestLoggerStreamer(t *testing.T) {
+	got := &bytes.Buffer{}
+	l := &shell.WriterLogger{Writer: got, Ansi: false}
+
+	streamer := shell.NewLoggerStreamer(l)
+	streamer.Prefix = "TEST>"
+
+	fmt.Fprintf(streamer, "#")
+	fmt.Fprintln(streamer, " Rest of the line")
+	fmt.Fprintf(streamer, "#")
+	fmt.Fprintln(streamer, " And another")
+	fmt.Fprint(streamer, "# No line end")
+
+	if err := streamer.Close(); err != nil {
+		t.Errorf("streamer.Close() = %v", err)
+	}
+
+	want := &bytes.Buffer{}
+
+	fmt.Fprintln(want, "TEST># Rest of the line")
+	fmt.Fprintln(want, "TEST># And another")
+	fmt.Fprintln(want, "TEST># No line end")
+
+	if diff := cmp.Diff(got.String(), want.String()); diff != "" {
+		t.Fatalf("shell.WriterLogger output buffer diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	got := &bytes.Buffer{}
+	l := &shell.JSONLogger{Writer: got}
+
+	l.Headerf("Testing header: %q", "llamas")
+	l.StartPhase("checkout")
+	l.Promptf("git clone %s", "llamas")
+	l.CommandFinished("git clone llamas", 128, 1500*time.Millisecond)
+	l.Errorf("Testing error: %q", "llamas")
+	l.EndPhase("checkout", 128)
+	fmt.Fprintln(l, "Testing write")
+
+	var records []shell.JSONLogRecord
+	dec := json.NewDecoder(got)
+	for dec.More() {
+		var record shell.JSONLogRecord
+		if err := dec.Decode(&record); err != nil {
+			t.Fatalf("dec.Decode(&record) error = %v", err)
+		}
+		if record.Time.IsZero() {
+			t.Errorf("record.Time is zero for %+v", record)
+		}
+		record.Time = time.Time{}
+		if record.Type == "phase" && record.Event == "end" {
+			if record.Duration == nil {
+				t.Errorf("record.Duration is nil for the end of a phase")
+			}
+			record.Duration = nil
+		}
+		records = append(records, record)
+	}
+
+	exitStatus := 128
+	seconds := 1.5
+	want := []shell.JSONLogRecord{
+		{Type: "header", Message: `Testing header: "llamas"`},
+		{Type: "phase", Event: "start", Phase: "checkout"},
+		{Type: "prompt", Phase: "checkout", Command: "git clone llamas"},
+		{Type: "command", Phase: "checkout", Command: "git clone llamas", ExitStatus: &exitStatus, Duration: &seconds},
+		{Type: "error", Phase: "checkout", Message: `Testing error: "llamas"`},
+		{Type: "phase", Event: "end", Phase: "checkout", ExitStatus: &exitStatus},
+		{Type: "output", Message: "Testing write"},
+	}
+
+	if diff := cmp.Diff(records, want); diff != "" {
+		t.Fatalf("shell.JSONLogger records diff (-got +want):\n%s", diff)
+	}
+}
@@ -1,7 +1,10 @@
 // Package shell provides a cross-platform virtual shell abstraction for
-// executing commands.
+// executing commands, with a working directory and environment of its own,
+// that logs the commands it runs the way Buildkite job logs show them.
 //
-// It is intended for internal use by buildkite-agent only.
+// It's what the agent's bootstrap runs hooks, plugins and commands with. Its
+// exported API, and that of the env package it uses for environments, only
+// changes incompatibly in a new major version of the module.
 package shell
 
 import (
@@ -23,18 +26,25 @@ import (
 	"github.com/opentracing/opentracing-go"
 
 	"github.com/buildkite/agent/v3/env"
-	"github.com/buildkite/agent/v3/experiments"
+	"github.com/buildkite/agent/v3/internal/lock"
+	"github.com/buildkite/agent/v3/internal/tracetools"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/process"
-	"github.com/buildkite/agent/v3/tracetools"
 	"github.com/buildkite/shellwords"
-	"github.com/gofrs/flock"
-	"github.com/nightlyone/lockfile"
 )
 
-var (
-	lockRetryDuration = time.Second
-)
+// ErrCommandTimedOut is wrapped by the error from running a command that was
+// killed because it took longer than its timeout
+var ErrCommandTimedOut = errors.New("command timed out")
+
+type commandTimeoutKey struct{}
+
+// WithCommandTimeout returns a context in which the commands a Shell runs are
+// killed if they take longer than timeout, rather than its CommandTimeout. A
+// timeout of 0 means they can take as long as they need.
+func WithCommandTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, commandTimeoutKey{}, timeout)
+}
 
 // Shell represents a virtual shell, handles logging, executing commands and
 // provides hooks for capturing output and exit conditions.
@@ -70,6 +80,37 @@ type Shell struct {
 
 	// The signal to use to interrupt the command
 	InterruptSignal process.Signal
+
+	// How long an interrupted command is given to exit before it's killed,
+	// along with any processes it started, or 0 to leave them running
+	SignalGracePeriod time.Duration
+
+	// Whether to start each line of commands' output with a process.LineTag
+	// of its stream and Source
+	TagLines bool
+
+	// What the commands being run are part of, like a hook or the job's
+	// command, for tagging their output
+	Source string
+
+	// The longest each command can run before it's killed, unless its
+	// context was given another with WithCommandTimeout, or 0 for no limit
+	CommandTimeout time.Duration
+
+	// Called after each LockFile with how long it waited for the lock
+	LockWaited func(LockWait)
+}
+
+// LockWait is how long a Shell waited for a lock, whether it got it or timed
+// out
+type LockWait struct {
+	Path     string
+	Duration time.Duration
+	Acquired bool
+
+	// How many stale pid lock files, left by processes that weren't running
+	// any more, were broken
+	StaleBroken int
 }
 
 // New returns a new Shell
@@ -96,12 +137,16 @@ func (s *Shell) WithStdin(r io.Reader) *Shell {
 	defer s.cmdLock.Unlock()
 	// Can't copy struct like `newsh := *s` because sync.Mutex can't be copied.
 	return &Shell{
-		Logger:          s.Logger,
-		Env:             s.Env,
-		stdin:           r, // our new stdin
-		Writer:          s.Writer,
-		wd:              s.wd,
-		InterruptSignal: s.InterruptSignal,
+		Logger:            s.Logger,
+		Env:               s.Env,
+		stdin:             r, // our new stdin
+		Writer:            s.Writer,
+		wd:                s.wd,
+		InterruptSignal:   s.InterruptSignal,
+		SignalGracePeriod: s.SignalGracePeriod,
+		TagLines:          s.TagLines,
+		Source:            s.Source,
+		CommandTimeout:    s.CommandTimeout,
 	}
 }
 
@@ -182,89 +227,103 @@ func (s *Shell) WaitStatus() (process.WaitStatus, error) {
 	return s.cmd.proc.WaitStatus(), nil
 }
 
-// LockFile is a pid-based lock for cross-process locking
+// LockFile is a cross-process lock on a file
 type LockFile interface {
 	Unlock() error
 }
 
-func (s *Shell) lockfile(ctx context.Context, path string, timeout time.Duration) (LockFile, error) {
-	absolutePathToLock, err := filepath.Abs(path)
+// How often the pid lock file that older agents use is tried again while
+// it's held
+var lockRetryDuration = time.Second
+
+// LockFile waits for an exclusive lock on a file next to path, for up to the
+// timeout. Locks are released by the OS when the process holding them exits,
+// so they're never left behind by bootstraps that crashed.
+//
+// Agents from before these locks took a pid lock file at path instead, so
+// while they might still be running on the same host during an upgrade, that
+// lock is taken too. The lock file it leaves behind if the bootstrap crashes
+// is broken by the next one to want it.
+func (s *Shell) LockFile(ctx context.Context, path string, timeout time.Duration) (LockFile, error) {
+	// + "f" is the file agents locked with the flock-file-locks experiment,
+	// which they'll still be locking while they're upgraded
+	absolutePathToPIDLock, err := filepath.Abs(path)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to find absolute path to lock \"%s\" (%v)", path, err)
 	}
+	absolutePathToLock := absolutePathToPIDLock + "f"
 
-	lock, err := lockfile.New(absolutePathToLock)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to create lock \"%s\" (%s)", absolutePathToLock, err)
-	}
+	wait := LockWait{Path: absolutePathToLock}
+	start := time.Now()
+	defer func() {
+		wait.Duration = time.Since(start)
+		if s.LockWaited != nil {
+			s.LockWaited(wait)
+		}
+	}()
 
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	for {
-		// Keep trying the lock until we get it
-		if err := lock.TryLock(); err != nil {
-			s.Commentf("Could not acquire lock on \"%s\" (%s)", absolutePathToLock, err)
-			s.Commentf("Trying again in %s...", lockRetryDuration)
-			time.Sleep(lockRetryDuration)
-		} else {
-			break
-		}
-
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		default:
-			// No value ready, moving on
-		}
+	l, err := lock.TryAcquire(absolutePathToLock, lock.Exclusive)
+	if errors.Is(err, lock.ErrLocked) {
+		s.Commentf("Waiting up to %s for lock on \"%s\", which another process has", timeout, absolutePathToLock)
+		l, err = lock.Acquire(ctx, absolutePathToLock, lock.Exclusive)
 	}
-
-	return &lock, err
-}
-
-func (s *Shell) flock(ctx context.Context, path string, timeout time.Duration) (LockFile, error) {
-	absolutePathToLock, err := filepath.Abs(path + "f") // + "f" to ensure that flocks and lockfiles never share a filename
 	if err != nil {
-		return nil, fmt.Errorf("Failed to find absolute path to lock \"%s\" (%v)", path, err)
+		return nil, err
 	}
 
-	lock := flock.New(absolutePathToLock)
+	pl, err := s.pidLock(ctx, absolutePathToPIDLock, &wait)
+	if err != nil {
+		l.Unlock()
+		return nil, err
+	}
 
-	ctx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
+	wait.Acquired = true
+	return &migrationLock{lock: l, pidLock: pl}, nil
+}
 
+// pidLock waits for the pid lock file that older agents lock, breaking it if
+// the process that held it isn't running any more
+func (s *Shell) pidLock(ctx context.Context, path string, wait *LockWait) (*pidLock, error) {
+	pl := newPIDLock(path)
 	for {
-		// Keep trying the lock until we get it
-		if gotLock, err := lock.TryLock(); !gotLock || err != nil {
-			if err != nil {
-				s.Commentf("Could not acquire lock on \"%s\" (%s)", absolutePathToLock, err)
-			} else {
-				s.Commentf("Could not acquire lock on \"%s\" (Locked by other process)", absolutePathToLock)
-			}
-			s.Commentf("Trying again in %s...", lockRetryDuration)
-			time.Sleep(lockRetryDuration)
-		} else {
-			break
+		stale, err := pl.tryLock()
+		if stale != nil {
+			wait.StaleBroken++
+			s.Commentf("Broke stale lock on \"%s\" held by process %d, which isn't running any more", path, stale.PID)
+		}
+		if err == nil {
+			return pl, nil
 		}
 
+		s.Commentf("Could not acquire lock on \"%s\" (%s)", path, err)
+		s.Commentf("Trying again in %s...", lockRetryDuration)
+
 		select {
 		case <-ctx.Done():
 			return nil, ctx.Err()
-		default:
-			// No value ready, moving on
+		case <-time.After(lockRetryDuration):
 		}
 	}
+}
 
-	return lock, err
+// migrationLock holds both the lock and the pid lock file that older agents
+// use for the same path
+type migrationLock struct {
+	lock    *lock.Lock
+	pidLock *pidLock
 }
 
-// Create a cross-process file-based lock based on pid files
-func (s *Shell) LockFile(ctx context.Context, path string, timeout time.Duration) (LockFile, error) {
-	if experiments.IsEnabled("flock-file-locks") {
-		s.Commentf("Using flock-file-locks experiment 🧪")
-		return s.flock(ctx, path, timeout)
+// Unlock removes the pid lock file before releasing the lock, so nothing can
+// take the lock while the pid lock file is still there
+func (l *migrationLock) Unlock() error {
+	pidErr := l.pidLock.Unlock()
+	if err := l.lock.Unlock(); err != nil {
+		return err
 	}
-	return s.lockfile(ctx, path, timeout)
+	return pidErr
 }
 
 // Run runs a command, write stdout and stderr to the logger and return an error
@@ -291,9 +350,26 @@ func (s *Shell) RunWithoutPrompt(ctx context.Context, command string, arg ...str
 	}
 
 	return s.executeCommand(ctx, cmd, s.Writer, executeFlags{
-		Stdout: true,
-		Stderr: true,
-		PTY:    s.PTY,
+		Stdout:    true,
+		Stderr:    true,
+		PTY:       s.PTY,
+		JobOutput: true,
+	})
+}
+
+// RunInteractive runs a command attached to the terminal the shell's own
+// process was started from, with its stdin, so it can prompt for input. Its
+// output goes straight to the terminal, so isn't written to the shell's
+// writer. It doesn't show a prompt.
+func (s *Shell) RunInteractive(ctx context.Context, command string, arg ...string) error {
+	cmd, err := s.buildCommand(command, arg...)
+	if err != nil {
+		s.Errorf("Error building command: %v", err)
+		return err
+	}
+
+	return s.executeCommand(ctx, cmd, os.Stdout, executeFlags{
+		Interactive: true,
 	})
 }
 
@@ -372,8 +448,10 @@ func (s *Shell) RunScript(ctx context.Context, path string, extra env.Environmen
 		if s.Debug {
 			s.Commentf("Attempting to run %s with Powershell", path)
 		}
+		// The execution policy of Windows installs would otherwise stop
+		// unsigned scripts, like the hook runner, from running
 		command = "powershell.exe"
-		args = []string{"-file", path}
+		args = []string{"-NonInteractive", "-ExecutionPolicy", "Bypass", "-File", path}
 
 	case !isWindows && isBash:
 		bashPath, err := s.AbsolutePath("bash")
@@ -400,9 +478,10 @@ func (s *Shell) RunScript(ctx context.Context, path string, extra env.Environmen
 	cmd.Env = customEnv.ToSlice()
 
 	return s.executeCommand(ctx, cmd, s.Writer, executeFlags{
-		Stdout: true,
-		Stderr: true,
-		PTY:    s.PTY,
+		Stdout:    true,
+		Stderr:    true,
+		PTY:       s.PTY,
+		JobOutput: true,
 	})
 }
 
@@ -421,12 +500,13 @@ func (s *Shell) buildCommand(name string, arg ...string) (*command, error) {
 	}
 
 	cfg := process.Config{
-		Path:            absPath,
-		Args:            arg,
-		Env:             s.Env.ToSlice(),
-		Stdin:           s.stdin,
-		Dir:             s.wd,
-		InterruptSignal: s.InterruptSignal,
+		Path:              absPath,
+		Args:              arg,
+		Env:               s.Env.ToSlice(),
+		Stdin:             s.stdin,
+		Dir:               s.wd,
+		InterruptSignal:   s.InterruptSignal,
+		SignalGracePeriod: s.SignalGracePeriod,
 	}
 
 	// Add env that commands expect a shell to set
@@ -446,6 +526,12 @@ type executeFlags struct {
 
 	// Run the command in a PTY
 	PTY bool
+
+	// Whether the output is the job's, so can be tagged with where it's from
+	JobOutput bool
+
+	// Run the command attached to our terminal, rather than capturing it
+	Interactive bool
 }
 
 func round(d time.Duration) time.Duration {
@@ -488,8 +574,19 @@ func (s *Shell) executeCommand(ctx context.Context, cmd *command, w io.Writer, f
 
 	cmdStr := process.FormatCommand(cmd.Path, cmd.Args)
 
+	timeout := s.CommandTimeout
+	if d, ok := ctx.Value(commandTimeoutKey{}).(time.Duration); ok {
+		timeout = d
+	}
+	runCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	t := time.Now()
 	if s.Debug {
-		t := time.Now()
 		defer func() {
 			s.Commentf("↳ Command completed in %v", round(time.Since(t)))
 		}()
@@ -497,14 +594,39 @@ func (s *Shell) executeCommand(ctx context.Context, cmd *command, w io.Writer, f
 
 	cfg := cmd.Config
 
+	// Output from stdout and stderr is tagged separately, unless they're
+	// both the PTY
+	stdout, stderr := w, w
+	if flags.JobOutput && s.TagLines {
+		source := s.Source
+		if source == "" {
+			source = "bootstrap"
+		}
+		var mu sync.Mutex
+		stream := process.StreamStdout
+		if flags.PTY {
+			stream = process.StreamPTY
+		}
+		stdoutTagger := process.NewLineTagger(w, &mu, stream, source)
+		stderrTagger := process.NewLineTagger(w, &mu, process.StreamStderr, source)
+		defer stdoutTagger.Flush()
+		defer stderrTagger.Flush()
+		stdout, stderr = stdoutTagger, stderrTagger
+	}
+
 	// Modify process config based on execution flags
-	if flags.PTY {
+	if flags.Interactive {
+		cfg.Interactive = true
+		cfg.Stdin = os.Stdin
+		cfg.Stdout = os.Stdout
+		cfg.Stderr = os.Stderr
+	} else if flags.PTY {
 		cfg.PTY = true
-		cfg.Stdout = w
+		cfg.Stdout = stdout
 	} else {
 		// Show stdout if requested or via debug
 		if flags.Stdout {
-			cfg.Stdout = w
+			cfg.Stdout = stdout
 		} else if s.Debug {
 			stdOutStreamer := NewLoggerStreamer(s.Logger)
 			defer stdOutStreamer.Close()
@@ -513,7 +635,7 @@ func (s *Shell) executeCommand(ctx context.Context, cmd *command, w io.Writer, f
 
 		// Show stderr if requested or via debug
 		if flags.Stderr {
-			cfg.Stderr = w
+			cfg.Stderr = stderr
 		} else if s.Debug {
 			stdErrStreamer := NewLoggerStreamer(s.Logger)
 			defer stdErrStreamer.Close()
@@ -527,11 +649,23 @@ func (s *Shell) executeCommand(ctx context.Context, cmd *command, w io.Writer, f
 	s.cmd.proc = p
 	s.cmdLock.Unlock()
 
-	if err := p.Run(ctx); err != nil {
+	if err := p.Run(runCtx); err != nil {
 		return fmt.Errorf("Error running %q: %w", cmdStr, err)
 	}
 
-	return p.WaitResult()
+	err := p.WaitResult()
+
+	// The process group was killed when the timeout's context finished, as
+	// long as the context it was run with didn't finish first
+	if timeout > 0 && ctx.Err() == nil && errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		s.Errorf("%q was killed after taking longer than %v", cmdStr, timeout)
+		err = fmt.Errorf("%w: %q took longer than %v", ErrCommandTimedOut, cmdStr, timeout)
+	}
+
+	if cl, ok := s.Logger.(CommandLogger); ok {
+		cl.CommandFinished(cmdStr, GetExitCode(err), time.Since(t))
+	}
+	return err
 }
 
 // GetExitCode extracts an exit code from an error where the platform supports it,
@@ -565,6 +699,8 @@ func IsExitSignaled(err error) bool {
 	return false
 }
 
+// IsExitError returns whether the error is, or wraps, an ExitError or an
+// exec.ExitError, from a command that exited with a non-zero status
 func IsExitError(err error) bool {
 	if cause := new(ExitError); errors.As(err, &cause) {
 		return true
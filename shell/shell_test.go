@@ -1,9 +1,13 @@
 package shell_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
@@ -14,8 +18,7 @@ import (
 	"testing"
 	"time"
 
-	"github.com/buildkite/agent/v3/bootstrap/shell"
-	"github.com/buildkite/agent/v3/experiments"
+	"github.com/buildkite/agent/v3/shell"
 	"github.com/buildkite/bintest/v3"
 	"github.com/google/go-cmp/cmp"
 )
@@ -106,6 +109,126 @@ func TestRun(t *testing.T) {
 	}
 }
 
+func TestRunWithJSONLogger(t *testing.T) {
+	sshKeygen, err := bintest.CompileProxy("ssh-keygen")
+	if err != nil {
+		t.Fatalf("bintest.CompileProxy(ssh-keygen) error = %v", err)
+	}
+	defer sshKeygen.Close()
+
+	out := &bytes.Buffer{}
+
+	sh := newShellForTest(t)
+	sh.PTY = false
+	sh.Writer = &bytes.Buffer{}
+	sh.Logger = &shell.JSONLogger{Writer: out}
+
+	go func() {
+		call := <-sshKeygen.Ch
+		call.Exit(3)
+	}()
+
+	if err := sh.Run(context.Background(), sshKeygen.Path, "-f", "my_hosts"); shell.GetExitCode(err) != 3 {
+		t.Errorf(`sh.Run(ssh-keygen, "-f", "my_hosts") error = %v, want exit status 3`, err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("sh.Logger wrote %d lines, want 2:\n%s", len(lines), out)
+	}
+
+	var record shell.JSONLogRecord
+	if err := json.Unmarshal([]byte(lines[1]), &record); err != nil {
+		t.Fatalf("json.Unmarshal(%q) error = %v", lines[1], err)
+	}
+	if record.Type != "command" || record.Command != sshKeygen.Path+" -f my_hosts" {
+		t.Errorf("record = %+v, want a command record for ssh-keygen", record)
+	}
+	if record.ExitStatus == nil || *record.ExitStatus != 3 {
+		t.Errorf("record.ExitStatus = %v, want 3", record.ExitStatus)
+	}
+	if record.Duration == nil {
+		t.Errorf("record.Duration = nil, want how long the command took")
+	}
+}
+
+func TestRunWithCommandTimeout(t *testing.T) {
+	sshKeygen, err := bintest.CompileProxy("ssh-keygen")
+	if err != nil {
+		t.Fatalf("bintest.CompileProxy(ssh-keygen) error = %v", err)
+	}
+	defer sshKeygen.Close()
+
+	out := &bytes.Buffer{}
+
+	sh := newShellForTest(t)
+	sh.PTY = false
+	sh.Writer = out
+	sh.Logger = &shell.WriterLogger{Writer: out, Ansi: false}
+	sh.CommandTimeout = 100 * time.Millisecond
+
+	// It hangs until it's killed
+	go func() {
+		<-sshKeygen.Ch
+	}()
+
+	err = sh.Run(context.Background(), sshKeygen.Path, "-f", "my_hosts")
+	if !errors.Is(err, shell.ErrCommandTimedOut) {
+		t.Errorf(`sh.Run(ssh-keygen, "-f", "my_hosts") error = %v, want shell.ErrCommandTimedOut`, err)
+	}
+	if !strings.Contains(out.String(), "was killed after taking longer than 100ms") {
+		t.Errorf("sh.Logger output = %q, want it to say the command was killed", out)
+	}
+
+	// It can be given longer
+	go func() {
+		call := <-sshKeygen.Ch
+		time.Sleep(200 * time.Millisecond)
+		call.Exit(0)
+	}()
+
+	ctx := shell.WithCommandTimeout(context.Background(), 0)
+	if err := sh.Run(ctx, sshKeygen.Path, "-f", "my_hosts"); err != nil {
+		t.Errorf(`sh.Run(ssh-keygen, "-f", "my_hosts") with no timeout error = %v`, err)
+	}
+}
+
+func TestRunWithTaggedLines(t *testing.T) {
+	sshKeygen, err := bintest.CompileProxy("ssh-keygen")
+	if err != nil {
+		t.Fatalf("bintest.CompileProxy(ssh-keygen) error = %v", err)
+	}
+	defer sshKeygen.Close()
+
+	out := &bytes.Buffer{}
+
+	sh := newShellForTest(t)
+	sh.PTY = false
+	sh.Writer = out
+	sh.TagLines = true
+	sh.Source = "hook:local:pre-command"
+
+	go func() {
+		call := <-sshKeygen.Ch
+		fmt.Fprintln(call.Stdout, "Llama party! 🎉")
+		fmt.Fprint(call.Stderr, "Llama drama! 🚨")
+		call.Exit(0)
+	}()
+
+	if err := sh.Run(context.Background(), sshKeygen.Path); err != nil {
+		t.Errorf("sh.Run(ssh-keygen) error = %v", err)
+	}
+
+	for _, want := range []string{
+		"\x1b_bk;stream=stdout;source=hook:local:pre-command\x07Llama party! 🎉\n",
+		"\x1b_bk;stream=stderr;source=hook:local:pre-command\x07Llama drama! 🚨",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("sh.Writer = %q, want it to contain %q", out.String(), want)
+		}
+	}
+}
+
 func TestRunWithStdin(t *testing.T) {
 	out := &bytes.Buffer{}
 	sh := newShellForTest(t)
@@ -312,39 +435,172 @@ func TestLockFileRetriesAndTimesOut(t *testing.T) {
 	}
 }
 
-func TestFlockRetriesAndTimesOut(t *testing.T) {
-	experiments.Enable("flock-file-locks")
-	defer experiments.Disable("flock-file-locks")
+func TestLockFileIsReleasedWhenItsProcessDies(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Flakey on windows")
+	}
+
+	lockPath := filepath.Join(t.TempDir(), "my.lock")
+
+	// A bootstrap that crashes while it has the lock doesn't leave it held
+	cmd, err := acquireLockInOtherProcess(lockPath)
+	if err != nil {
+		t.Fatalf("acquireLockInOtherProcess(%q) error = %v", lockPath, err)
+	}
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	var waits []shell.LockWait
+	sh := newShellForTest(t)
+	sh.LockWaited = func(w shell.LockWait) { waits = append(waits, w) }
+
+	lock, err := sh.LockFile(context.Background(), lockPath, 10*time.Second)
+	if err != nil {
+		t.Fatalf("sh.LockFile(%q) error = %v", lockPath, err)
+	}
+	defer lock.Unlock()
 
-	TestLockFileRetriesAndTimesOut(t)
+	if len(waits) != 1 || !waits[0].Acquired || waits[0].Duration < 500*time.Millisecond {
+		t.Errorf("LockWaited with %+v, want one acquired lock after at least 500ms", waits)
+	}
 }
 
-func acquireLockInOtherProcess(lockfile string) (*exec.Cmd, error) {
-	flockExperimentEnabled := false
-	expectedLockPath := lockfile
-	if experiments.IsEnabled("flock-file-locks") {
-		flockExperimentEnabled = true
-		expectedLockPath = lockfile + "f" // flock-locked files are created with the suffix 'f'
+func TestLockFileBreaksStaleLocksLeftByOlderAgents(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Flakey on windows")
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("os.Hostname() error = %v", err)
+	}
+
+	// A process that's been and gone, like a bootstrap that crashed
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	if err := exited.Run(); err != nil {
+		t.Fatalf("exited.Run() error = %v", err)
+	}
+	deadPID := exited.ProcessState.Pid()
+
+	for _, tc := range []struct {
+		name     string
+		contents string
+		broken   bool
+	}{
+		{name: "dead process", contents: fmt.Sprintf("%d\n%s\n\n", deadPID, host), broken: true},
+		{name: "dead process with only a PID", contents: fmt.Sprintf("%d\n", deadPID), broken: true},
+		{name: "earlier boot", contents: fmt.Sprintf("%d\n%s\nsome-other-boot\n", os.Getppid(), host), broken: runtime.GOOS == "linux"},
+		{name: "other host", contents: fmt.Sprintf("%d\nsome-other-host\n\n", deadPID), broken: false},
+		{name: "running process", contents: fmt.Sprintf("%d\n%s\n\n", os.Getppid(), host), broken: false},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			lockPath := filepath.Join(t.TempDir(), "my.lock")
+			if err := os.WriteFile(lockPath, []byte(tc.contents), 0o644); err != nil {
+				t.Fatalf("os.WriteFile(%q) error = %v", lockPath, err)
+			}
+
+			var waits []shell.LockWait
+			sh := newShellForTest(t)
+			sh.LockWaited = func(w shell.LockWait) { waits = append(waits, w) }
+
+			lock, err := sh.LockFile(context.Background(), lockPath, time.Second)
+			if !tc.broken {
+				if err != context.DeadlineExceeded {
+					t.Errorf("sh.LockFile(%q) error = %v, want context.DeadlineExceeded", lockPath, err)
+				}
+				if got, want := waits, []shell.LockWait{{Path: lockPath + "f", Duration: waits[0].Duration}}; !cmp.Equal(got, want) {
+					t.Errorf("LockWaited with %v, want %v", got, want)
+				}
+
+				// Locks held by someone else are left alone
+				if data, _ := os.ReadFile(lockPath); string(data) != tc.contents {
+					t.Errorf("lock file contents = %q, want %q", data, tc.contents)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("sh.LockFile(%q) error = %v", lockPath, err)
+			}
+			if got, want := len(waits), 1; got != want {
+				t.Fatalf("LockWaited called %d times, want %d", got, want)
+			}
+			if !waits[0].Acquired || waits[0].StaleBroken != 1 {
+				t.Errorf("LockWaited with %+v, want Acquired and StaleBroken = 1", waits[0])
+			}
+
+			data, err := os.ReadFile(lockPath)
+			if err != nil {
+				t.Fatalf("os.ReadFile(%q) error = %v", lockPath, err)
+			}
+			if got, want := strings.SplitN(string(data), "\n", 2)[0], strconv.Itoa(os.Getpid()); got != want {
+				t.Errorf("lock file PID = %q, want %q", got, want)
+			}
+
+			if err := lock.Unlock(); err != nil {
+				t.Errorf("lock.Unlock() error = %v", err)
+			}
+			if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+				t.Errorf("os.Stat(%q) error = %v, want not exist", lockPath, err)
+			}
+		})
+	}
+}
+
+func TestLockFileUnlockLeavesOtherProcessesLocks(t *testing.T) {
+	t.Parallel()
+
+	lockPath := filepath.Join(t.TempDir(), "my.lock")
+	sh := newShellForTest(t)
+
+	lock, err := sh.LockFile(context.Background(), lockPath, time.Second)
+	if err != nil {
+		t.Fatalf("sh.LockFile(%q) error = %v", lockPath, err)
 	}
 
+	// Another process broke the lock and took it
+	other := fmt.Sprintf("%d\n\n\n", os.Getppid())
+	if err := os.WriteFile(lockPath, []byte(other), 0o644); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", lockPath, err)
+	}
+
+	if err := lock.Unlock(); err == nil {
+		t.Errorf("lock.Unlock() error = %v, want non-nil error", err)
+	}
+	if data, _ := os.ReadFile(lockPath); string(data) != other {
+		t.Errorf("lock file contents = %q, want %q", data, other)
+	}
+}
+
+func acquireLockInOtherProcess(lockfile string) (*exec.Cmd, error) {
 	cmd := exec.Command(os.Args[0], "-test.run=TestAcquiringLockHelperProcess", "--", lockfile)
-	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1", "FLOCK_EXPERIMENT_ENABLED=" + strconv.FormatBool(flockExperimentEnabled)}
+	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
 
-	err := cmd.Start()
+	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		return cmd, err
 	}
+	if err := cmd.Start(); err != nil {
+		return cmd, err
+	}
 
-	// wait for the above process to get a lock
-	for {
-		if _, err = os.Stat(expectedLockPath); os.IsNotExist(err) {
-			time.Sleep(time.Millisecond * 10)
-			continue
+	// wait for the above process to say it's got the lock. The lock file is
+	// there before it's locked, so it can't be waited for instead.
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), "Acquired lock") {
+			go io.Copy(io.Discard, stderr)
+			return cmd, nil
 		}
-		break
 	}
-
-	return cmd, nil
+	cmd.Process.Kill()
+	return cmd, fmt.Errorf("helper process exited without acquiring the lock: %v", scanner.Err())
 }
 
 // TestAcquiringLockHelperProcess isn't a real test. It's used as a helper process
@@ -353,12 +609,6 @@ func TestAcquiringLockHelperProcess(t *testing.T) {
 		return
 	}
 
-	if os.Getenv("FLOCK_EXPERIMENT_ENABLED") == "true" {
-		experiments.Enable("flock-file-locks")
-	} else {
-		experiments.Disable("flock-file-locks")
-	}
-
 	fileName := os.Args[len(os.Args)-1]
 	sh := newShellForTest(t)
 
@@ -9,7 +9,7 @@ import (
 
 // You can overridden buildVersion at compile time by using:
 //
-//  go run -ldflags "-X github.com/buildkite/agent/v3/agent.buildVersion=abc" . --version
+//  go run -ldflags "-X github.com/buildkite/agent/v3/version.buildVersion=abc" . --version
 //
 // On CI, the binaries are always build with the buildVersion variable set.
 //
@@ -19,10 +19,13 @@ import (
 var baseVersion string
 var buildVersion string
 
+// Version returns the agent's version, like 3.44.0
 func Version() string {
 	return strings.TrimSpace(baseVersion)
 }
 
+// BuildVersion returns the build of the agent's version, or x if it wasn't
+// set when it was built
 func BuildVersion() string {
 	if buildVersion != "" {
 		return buildVersion
@@ -31,6 +34,7 @@ func BuildVersion() string {
 	}
 }
 
+// UserAgent returns the HTTP User-Agent the agent identifies itself with
 func UserAgent() string {
 	return "buildkite-agent/" + Version() + "." + BuildVersion() + " (" + runtime.GOOS + "; " + runtime.GOARCH + ")"
 }